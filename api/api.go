@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/sirupsen/logrus"
@@ -22,6 +23,10 @@ func Mount(
 	bucketName string,
 	flags *FlagStorage) (fs *Goofys, mfs *fuse.MountedFileSystem, err error) {
 
+	// the mount keeps flags, and we fill in the backend below. The
+	// caller may mount something else with them next
+	flags = flags.Clone()
+
 	if flags.DebugS3 {
 		SetCloudLogLevel(logrus.DebugLevel)
 	}
@@ -32,6 +37,7 @@ func Mount(
 		ErrorLogger:             GetStdLogger(NewLogger("fuse"), logrus.ErrorLevel),
 		DisableWritebackCaching: true,
 	}
+	setPlatformMountOptions(mountCfg, bucketName, flags)
 
 	if flags.DebugFuse {
 		fuseLog := GetLogger("fuse")
@@ -40,17 +46,38 @@ func Mount(
 		mountCfg.DebugLogger = GetStdLogger(fuseLog, logrus.DebugLevel)
 	}
 
+	if internal.IsGCSEndpoint(bucketName) {
+		spec, err := internal.ParseBucketSpec(bucketName)
+		if err != nil {
+			return nil, nil, err
+		}
+		// with or without --gcs
+		if flags.Backend == nil {
+			flags.Backend = (&GCSConfig{}).Init()
+		}
+		bucketName = spec.Bucket
+		if spec.Prefix != "" {
+			bucketName += ":" + spec.Prefix
+		}
+	}
+
 	if flags.Backend == nil {
 		if spec, err := internal.ParseBucketSpec(bucketName); err == nil {
 			switch spec.Scheme {
 			case "adl":
-				auth, err := AzureAuthorizerConfig{
-					Log: GetLogger("adlv1"),
-				}.Authorizer()
-				if err != nil {
-					err = fmt.Errorf("couldn't load azure credentials: %v",
-						err)
-					return nil, nil, err
+				var auth autorest.Authorizer
+				if flags.CredentialsCommand != "" {
+					auth = NewCommandAuthorizer(flags.CredentialsCommand,
+						flags.CredentialsRefresh)
+				} else {
+					auth, err = AzureAuthorizerConfig{
+						Log: GetLogger("adlv1"),
+					}.Authorizer()
+					if err != nil {
+						err = fmt.Errorf("couldn't load azure credentials: %v",
+							err)
+						return nil, nil, err
+					}
 				}
 				flags.Backend = &ADLv1Config{
 					Endpoint:   spec.Bucket,
@@ -63,8 +90,24 @@ func Mount(
 				if spec.Prefix != "" {
 					bucketName = ":" + spec.Prefix
 				}
+			case "webhdfs", "swebhdfs":
+				scheme := "http"
+				if spec.Scheme == "swebhdfs" {
+					scheme = "https"
+				}
+				flags.Backend = (&WebHDFSConfig{
+					Endpoint:        scheme + "://" + spec.Bucket + "/webhdfs/v1",
+					User:            flags.WebHDFSUser,
+					DelegationToken: flags.WebHDFSDelegationToken,
+				}).Init()
+				// like adl, the path is the prefix
+				bucketName = ""
+				if spec.Prefix != "" {
+					bucketName = ":" + spec.Prefix
+				}
 			case "wasb":
-				config, err := AzureBlobConfig(flags.Endpoint, spec.Bucket, "blob")
+				config, err := AzureBlobConfigWithKey(flags.Endpoint, spec.Bucket, "blob",
+					flags.AzureAccount, flags.AzureKey)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -81,7 +124,14 @@ func Mount(
 					bucketName += ":" + spec.Prefix
 				}
 			case "abfs":
-				config, err := AzureBlobConfig(flags.Endpoint, spec.Bucket, "dfs")
+				var config AZBlobConfig
+				if flags.CredentialsCommand != "" {
+					config, err = AzureBlobConfigWithoutKey(flags.Endpoint,
+						spec.Bucket, "dfs", flags.AzureAccount)
+				} else {
+					config, err = AzureBlobConfigWithKey(flags.Endpoint, spec.Bucket,
+						"dfs", flags.AzureAccount, flags.AzureKey)
+				}
 				if err != nil {
 					return nil, nil, err
 				}
@@ -98,9 +148,14 @@ func Mount(
 					bucketName += ":" + spec.Prefix
 				}
 
+				var auth autorest.Authorizer = &config
+				if flags.CredentialsCommand != "" {
+					auth = NewCommandAuthorizer(flags.CredentialsCommand,
+						flags.CredentialsRefresh)
+				}
 				flags.Backend = &ADLv2Config{
 					Endpoint:   config.Endpoint,
-					Authorizer: &config,
+					Authorizer: auth,
 				}
 				bucketName = spec.Bucket
 				if spec.Prefix != "" {
@@ -110,11 +165,26 @@ func Mount(
 		}
 	}
 
-	fs = NewGoofys(ctx, bucketName, flags)
-	if fs == nil {
-		err = fmt.Errorf("Mount: initialization failed")
+	fs, err = NewGoofysWithError(ctx, bucketName, flags)
+	if err != nil {
+		err = fmt.Errorf("Mount: initialization failed: %v", err)
 		return
 	}
+	if flags.ControlSocket != "" {
+		_, err = fs.ListenControl(flags.ControlSocket)
+		if err != nil {
+			err = fmt.Errorf("Mount: control socket: %v", err)
+			return
+		}
+	}
+	if flags.MetricsListen != "" {
+		_, err = fs.ListenMetrics(flags.MetricsListen)
+		if err != nil {
+			err = fmt.Errorf("Mount: metrics: %v", err)
+			return
+		}
+	}
+
 	server := fuseutil.NewFileSystemServer(FusePanicLogger{fs})
 
 	mfs, err = fuse.Mount(flags.MountPoint, server, mountCfg)
@@ -180,12 +250,17 @@ func Mount(
 
 // expose Goofys related functions and types for extending and mounting elsewhere
 var (
-	MassageMountFlags = internal.MassageMountFlags
-	NewGoofys         = internal.NewGoofys
-	TryUnmount        = internal.TryUnmount
-	MyUserAndGroup    = internal.MyUserAndGroup
+	MassageMountFlags  = internal.MassageMountFlags
+	NewGoofys          = internal.NewGoofys
+	NewGoofysWithError = internal.NewGoofysWithError
+	TryUnmount         = internal.TryUnmount
+	MyUserAndGroup     = internal.MyUserAndGroup
 )
 
 type (
 	Goofys = internal.Goofys
+	// what Goofys.SubscribeEvents delivers
+	Event           = internal.Event
+	EventType       = internal.EventType
+	EventSubscriber = internal.EventSubscriber
 )
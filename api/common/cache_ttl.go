@@ -0,0 +1,71 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+// CacheTTLOverrides are the TTLs from --cache-ttl-override, keyed by
+// path under the mount point. It's a trie of path components, a path
+// gets the TTL of the longest prefix that is itself or one of its
+// parents
+type CacheTTLOverrides struct {
+	ttl      *time.Duration
+	children map[string]*CacheTTLOverrides
+}
+
+func (t *CacheTTLOverrides) Set(prefix string, ttl time.Duration) {
+	node := t
+	for _, c := range strings.Split(prefix, "/") {
+		if c == "" {
+			continue
+		}
+		if node.children == nil {
+			node.children = make(map[string]*CacheTTLOverrides)
+		}
+		child := node.children[c]
+		if child == nil {
+			child = &CacheTTLOverrides{}
+			node.children[c] = child
+		}
+		node = child
+	}
+	node.ttl = &ttl
+}
+
+// Lookup returns the TTL for name, ok is false if no prefix matches
+func (t *CacheTTLOverrides) Lookup(name string) (ttl time.Duration, ok bool) {
+	for node := t; node != nil; {
+		if node.ttl != nil {
+			ttl, ok = *node.ttl, true
+		}
+
+		var c string
+		for c == "" && name != "" {
+			if slash := strings.IndexByte(name, '/'); slash != -1 {
+				c, name = name[:slash], name[slash+1:]
+			} else {
+				c, name = name, ""
+			}
+		}
+		if c == "" {
+			break
+		}
+		node = node.children[c]
+	}
+	return
+}
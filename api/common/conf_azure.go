@@ -44,6 +44,15 @@ type AZBlobConfig struct {
 	AccountKey       string
 	SasToken         SASTokenProvider
 	TokenRenewBuffer time.Duration
+	// how many times a part of a multipart upload that failed on
+	// the server side is sent again, from --max-retries
+	MaxRetries int
+	// from the transport flags, nil is the default transport
+	HTTPClient *http.Client
+	// soft deleted blobs are listed too, from --list-deleted
+	ListDeleted bool
+	// added to every request, from --request-header
+	RequestHeaders map[string]string
 
 	Container string
 	Prefix    string
@@ -284,12 +293,38 @@ func azureFindAccount(client azblob.AccountsClient, account string) (*azblob.End
 }
 
 func AzureBlobConfig(endpoint string, location string, storageType string) (config AZBlobConfig, err error) {
+	return AzureBlobConfigWithKey(endpoint, location, storageType, "", "")
+}
+
+// AzureBlobConfigWithKey is AzureBlobConfig but account and accountKey,
+// if not empty, take precedence over the environment
+func AzureBlobConfigWithKey(endpoint string, location string, storageType string,
+	account string, accountKey Secret) (config AZBlobConfig, err error) {
+	return azureBlobConfig(endpoint, location, storageType, account, accountKey, true)
+}
+
+// AzureBlobConfigWithoutKey is for requests that are signed with a
+// token instead, it only finds the account and the endpoint. Without
+// one the endpoint is the public cloud's
+func AzureBlobConfigWithoutKey(endpoint string, location string, storageType string,
+	account string) (config AZBlobConfig, err error) {
+	return azureBlobConfig(endpoint, location, storageType, account, "", false)
+}
+
+func azureBlobConfig(endpoint string, location string, storageType string,
+	account string, accountKey Secret, needKey bool) (config AZBlobConfig, err error) {
+
 	if storageType != "blob" && storageType != "dfs" {
 		panic(fmt.Sprintf("unknown storage type: %v", storageType))
 	}
 
-	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
-	key := os.Getenv("AZURE_STORAGE_KEY")
+	if account == "" {
+		account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	key := string(accountKey)
+	if key == "" {
+		key = os.Getenv("AZURE_STORAGE_KEY")
+	}
 	configDir := os.Getenv("AZURE_CONFIG_DIR")
 
 	// check if the url contains the storage endpoint
@@ -346,7 +381,7 @@ func AzureBlobConfig(endpoint string, location string, storageType string) (conf
 		return
 	}
 
-	if endpoint == "" || key == "" {
+	if needKey && (endpoint == "" || key == "") {
 		var client azblob.AccountsClient
 		client, err = azureAccountsClient(account)
 		if err == nil {
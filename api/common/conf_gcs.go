@@ -0,0 +1,36 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+)
+
+// GCSConfig is for the native GCS backend, which talks the JSON api
+// instead of going through the S3 interop layer
+type GCSConfig struct {
+	// service account key to use instead of the Application
+	// Default Credentials
+	CredentialsFile string
+	// only needed to create buckets
+	ProjectId string
+}
+
+func (c *GCSConfig) Init() *GCSConfig {
+	if c.ProjectId == "" {
+		c.ProjectId = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	return c
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
@@ -30,7 +31,8 @@ import (
 type S3Config struct {
 	Profile         string
 	AccessKey       string
-	SecretKey       string
+	SecretKey       Secret
+	SessionToken    Secret
 	RoleArn         string
 	RoleExternalId  string
 	RoleSessionName string
@@ -42,14 +44,19 @@ type S3Config struct {
 
 	StorageClass string
 
-	UseSSE     bool
-	UseKMS     bool
-	KMSKeyID   string
-	SseC       string
-	SseCDigest string
-	ACL        string
+	UseSSE   bool
+	UseKMS   bool
+	KMSKeyID string
+	// what's written under these prefixes of the bucket is
+	// encrypted with their KMS key instead, see KMSKeyFor
+	KMSKeyPrefixes map[string]string
+	SseC           string
+	SseCDigest     string
+	ACL            string
 
 	Subdomain bool
+	// requests aren't signed, see --anonymous
+	Anonymous bool
 
 	Credentials *credentials.Credentials
 	Session     *session.Session
@@ -72,7 +79,7 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 		Region: &c.Region,
 		Logger: GetLogger("s3"),
 	}).WithHTTPClient(&http.Client{
-		Transport: &defaultHTTPTransport,
+		Transport: GetHTTPTransport(flags),
 		Timeout:   flags.HTTPTimeout,
 	})
 	if flags.DebugS3 {
@@ -81,7 +88,8 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 
 	if c.Credentials == nil {
 		if c.AccessKey != "" {
-			c.Credentials = credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, "")
+			c.Credentials = credentials.NewStaticCredentials(c.AccessKey,
+				string(c.SecretKey), string(c.SessionToken))
 		}
 	}
 	if flags.Endpoint != "" {
@@ -114,22 +122,49 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 			})
 	}
 
+	if c.Anonymous {
+		c.Credentials = credentials.AnonymousCredentials
+	}
 	if c.Credentials != nil {
 		awsConfig.Credentials = c.Credentials
 	}
 
-	if c.SseC != "" {
-		key, err := base64.StdEncoding.DecodeString(c.SseC)
-		if err != nil {
-			return nil, fmt.Errorf("sse-c is not base64-encoded: %v", err)
-		}
+	return awsConfig, nil
+}
 
-		c.SseC = string(key)
-		m := md5.Sum(key)
-		c.SseCDigest = base64.StdEncoding.EncodeToString(m[:])
+// SetSseC takes the base64 customer key for SSE-C, and keeps it
+// decoded along with its md5, which is what goes in the headers
+func (c *S3Config) SetSseC(encoded string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("sse-c is not base64-encoded: %v", err)
+	}
+	// AES256 is the only algorithm
+	if len(key) != 32 {
+		return fmt.Errorf("sse-c key is %v bytes, needs to be 32", len(key))
 	}
 
-	return awsConfig, nil
+	c.SseC = string(key)
+	m := md5.Sum(key)
+	c.SseCDigest = base64.StdEncoding.EncodeToString(m[:])
+	return nil
+}
+
+// KMSKeyFor is the KMS key of the longest of KMSKeyPrefixes that key
+// is under. A prefix is a directory whether or not it ends with /, so
+// "restricted" covers restricted/a but not restricted-not/a
+func (c *S3Config) KMSKeyFor(key string) (keyID string, ok bool) {
+	var longest string
+	for prefix, id := range c.KMSKeyPrefixes {
+		dir := strings.Trim(prefix, "/")
+		if dir != "" && !strings.HasPrefix(key, dir+"/") {
+			continue
+		}
+		if !ok || len(dir) > len(longest) {
+			longest, keyID, ok = dir, id, true
+		}
+	}
+	return
 }
 
 type stsConfigProvider struct {
@@ -0,0 +1,42 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+	"os/user"
+)
+
+// WebHDFSConfig is for a Hadoop namenode's REST api, without
+// kerberos. Requests are made as User, or with DelegationToken
+// instead if there's one
+type WebHDFSConfig struct {
+	// http://namenode:9870/webhdfs/v1
+	Endpoint        string
+	User            string
+	DelegationToken Secret
+}
+
+func (c *WebHDFSConfig) Init() *WebHDFSConfig {
+	if c.User == "" {
+		c.User = os.Getenv("HADOOP_USER_NAME")
+	}
+	if c.User == "" {
+		if u, err := user.Current(); err == nil {
+			c.User = u.Username
+		}
+	}
+	return c
+}
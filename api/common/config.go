@@ -17,11 +17,13 @@
 package common
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"mime"
-	"net"
-	"net/http"
 	"os"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -31,51 +33,346 @@ type FlagStorage struct {
 	MountPoint        string
 	MountPointArg     string
 	MountPointCreated string
+	// refuse every change to the bucket in the backend, like -o ro
+	// does too
+	BackendReadOnly bool
 
 	Cache    []string
 	DirMode  os.FileMode
 	FileMode os.FileMode
 	Uid      uint32
 	Gid      uint32
+	// chmod is kept in the mode metadata, and mode, uid and gid
+	// metadata like s3fs writes override the above
+	PermMetadata bool
+	// on ADLv2 accounts with a hierarchical namespace, chmod and
+	// the mode are the path's own permissions. Owners and groups
+	// in these, by AAD object id or name, are shown as the uid
+	// and gid they map to
+	UseBackendACLs bool
+	ACLUsers       map[string]uint32
+	ACLGroups      map[string]uint32
+	// the mtime utimens sets is kept in metadata and shown instead
+	// of when the file was uploaded
+	PreserveMtime bool
+	// HEAD a file before removing or truncating it, and fail if
+	// it's under Object Lock
+	RespectObjectLock bool
+
+	// blocks of what's read are kept here, up to DiskCacheSize
+	// bytes. Empty for none
+	DiskCacheDir  string
+	DiskCacheSize uint64
+
+	ExcludeAppleDouble bool
+	ExcludeDSStore     bool
+	ExcludeVolumeIcon  bool
+	// names that are only kept in memory, never sent to the
+	// backend, see --hide-pattern
+	HidePatterns []string
+	// symlinks are empty objects with their target in this
+	// metadata key. Empty to not support them
+	SymlinkMetadataKey string
+	// user.goofys.deleted and user.goofys.undelete on directories,
+	// and .goofys-restore in them
+	Undelete bool
+	// soft deleted blobs show up in listings
+	ListDeleted bool
+
+	ControlSocket string
+	MetricsListen string
+
+	Snapshots           bool
+	SnapshotGranularity time.Duration
+	SnapshotCount       int
+	SnapshotVisible     bool
+	// a hidden .versions in every directory
+	VersionedView bool
+	// a directory was changed when its newest child was, or when
+	// we removed one
+	DirMtimeFromChildren bool
+	// keys that aren't valid file names are listed escaped
+	// instead of skipped
+	EscapeInvalidNames bool
+
+	WriteQuotaBytes   uint64
+	WriteQuotaObjects uint64
+	WriteQuotaSoft    float64
+	WriteQuotaState   string
 
 	// Common Backend Config
 	UseContentType bool
-	Endpoint       string
+	// by extension, lowercase with the dot. Looked at before the
+	// built-in table
+	MimeTypes map[string]string
+	// for extensions that neither knows, instead of leaving it to
+	// the backend
+	ContentTypeDefault string
+	Endpoint           string
+
+	// from GOOFYS_CONFIG_JSON, these take precedence over the
+	// environment
+	AzureAccount string
+	AzureKey     Secret
+
+	// azure tokens come from what this prints instead, see
+	// CommandAuthorizer
+	CredentialsCommand string
+	CredentialsRefresh time.Duration
+
+	// for webhdfs://, the user to make requests as if there's no
+	// delegation token
+	WebHDFSUser            string
+	WebHDFSDelegationToken Secret
 
 	Backend interface{}
 
 	// Tuning
-	Cheap        bool
-	ExplicitDir  bool
-	StatCacheTTL time.Duration
-	TypeCacheTTL time.Duration
+	Cheap       bool
+	ExplicitDir bool
+	// what mkdir creates: none, slash (the default), s3fs or hadoop
+	DirMarkerStyle string
+	StatCacheTTL   time.Duration
+	TypeCacheTTL   time.Duration
+	// how long a lookup that found nothing is believed, 0 to
+	// always ask the backend
+	NegCacheTTL  time.Duration
 	HTTPTimeout  time.Duration
+	OpTimeout    time.Duration
+	ListPrefetch int
+	// pages of a listing a readdir can be ahead of the kernel
+	ReaddirMaxPagesAhead int
+	// both ttls for some paths, nil if there's none. It's not
+	// changed after parsing, so clones share it
+	CacheTTLOverrides *CacheTTLOverrides
+	// of a part of a multipart upload to azure that failed on the
+	// server side
+	MaxRetries int
+
+	// of the http transport, 0 is the default
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+	DialTimeout         time.Duration
+	NoHTTP2             bool
+	NoCompression       bool
+	// added to every request, see --request-header
+	RequestHeaders map[string]string
+
+	ReadCoalesceWindow uint64
+	// in bytes, 0 is the default
+	ReadAhead uint64
+	// --multipart-part-size, 0 is the backend's default
+	PartSize uint64
+	// --write-buffer-size, used instead of PartSize on backends that
+	// take parts of any size, 0 is PartSize
+	WriteBufferSize uint64
+	// smaller files are uploaded with one PutBlob, 0 is whatever
+	// fits in the first part
+	MultipartThreshold uint64
+	// of parts not uploaded yet before writes wait, 0 is no limit
+	MaxDirtyBytes uint64
+	// parts of a file uploading at once before its writes wait, 0
+	// is the default
+	MaxPartsInFlight int
+	// inodes kept before the least recently used ones that aren't
+	// in use are dropped, 0 is no limit
+	MaxCachedInodes int
+
+	HedgeDelay   time.Duration
+	HedgeMaxSize uint64
+	HedgePercent int
+	// fewer reads and writes in flight when throttled
+	AdaptiveRetry bool
+	// requests moving data and the rest each have this many in
+	// flight at most, 0 is no limit
+	MaxDataRequests     int
+	MaxMetadataRequests int
+
+	DeleteConcurrency int
+	// unlink returns before the object is deleted, so the deletes
+	// can go in batches
+	BatchUnlink       bool
+	RenameParallelism int
+
+	// an ADLv1 append that's rejected as too large is retried in
+	// pieces of this many bytes
+	ADLv1AppendChunk uint64
+	// backends that can't copy on the server read and append
+	// ranges of this many bytes instead, 0 is the default
+	CopyPartSize uint64
+
+	// how long df can show the same usage of the bucket
+	StatFSCacheTTL time.Duration
+
+	// hash reads of whole objects and compare with what the
+	// backend says they should hash to
+	CheckReadIntegrity bool
+
+	// fail flushing a file that was deleted by someone else
+	// while it was open, instead of writing it again
+	NoRecreateDeleted bool
+	// fail flushing a file that someone else changed since we
+	// last looked at it, instead of overwriting their change
+	FailOnConflict bool
+	// how many times, and for how long, a failed multipart upload
+	// is kept for the next flush to resume
+	FlushRetries  int
+	FlushRetryAge time.Duration
+	// how many times a lookup or read that finds nothing is tried
+	// again, if we wrote the file less than the window ago
+	RawConsistencyRetries int
+	RawConsistencyWindow  time.Duration
+	// return EINTR from an interrupted flush instead of waiting
+	// for it, the upload carries on
+	AbandonInterruptedFlush bool
+	// how long SIGTERM waits for open files to be flushed before
+	// aborting their uploads and unmounting
+	DrainTimeout time.Duration
+
+	NoMPUCleanup       bool
+	MPUCleanupInterval time.Duration
+	MPUCleanupAge      time.Duration
+
+	// overrides of how backend errors map to errnos, keyed by
+	// http status or provider error code
+	ErrorMap map[string]syscall.Errno
 
 	// Debugging
 	DebugFuse  bool
 	DebugS3    bool
+	DebugADL   bool
 	Foreground bool
+	// text or json
+	LogFormat string
 }
 
 func (flags *FlagStorage) GetMimeType(fileName string) (retMime *string) {
-	if flags.UseContentType {
-		dotPosition := strings.LastIndex(fileName, ".")
-		if dotPosition == -1 {
-			return nil
-		}
-		mimeType := mime.TypeByExtension(fileName[dotPosition:])
+	if !flags.UseContentType {
+		return nil
+	}
+
+	// a dot in a directory name isn't an extension
+	fileName = fileName[strings.LastIndex(fileName, "/")+1:]
+
+	var mimeType string
+	if dotPosition := strings.LastIndex(fileName, "."); dotPosition != -1 {
+		ext := fileName[dotPosition:]
+		mimeType = flags.MimeTypes[strings.ToLower(ext)]
 		if mimeType == "" {
-			return nil
+			mimeType = mime.TypeByExtension(ext)
 		}
-		semicolonPosition := strings.LastIndex(mimeType, ";")
-		if semicolonPosition == -1 {
-			return &mimeType
+	}
+	if mimeType == "" {
+		mimeType = flags.ContentTypeDefault
+	}
+	if mimeType == "" {
+		return nil
+	}
+
+	semicolonPosition := strings.LastIndex(mimeType, ";")
+	if semicolonPosition != -1 {
+		mimeType = mimeType[:semicolonPosition]
+	}
+	return &mimeType
+}
+
+// ParseMimeTypes reads the mime.types format: a type and then its
+// extensions on each line, and # for comments
+func ParseMimeTypes(r io.Reader) (map[string]string, error) {
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.Contains(fields[0], "/") {
+			return nil, fmt.Errorf("line %v: %q is not a mime type", n, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			types["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
 		}
-		s := mimeType[:semicolonPosition]
-		retMime = &s
 	}
+	return types, scanner.Err()
+}
+
+// Clone returns a copy that can be changed without affecting flags,
+// so more than one bucket can be mounted from the same flags, each
+// with its own owner and modes. The backend config is copied too,
+// backends fill in things like the region as they start
+func (flags *FlagStorage) Clone() *FlagStorage {
+	c := *flags
 
-	return
+	if flags.MountOptions != nil {
+		c.MountOptions = make(map[string]string, len(flags.MountOptions))
+		for k, v := range flags.MountOptions {
+			c.MountOptions[k] = v
+		}
+	}
+	if flags.MimeTypes != nil {
+		c.MimeTypes = make(map[string]string, len(flags.MimeTypes))
+		for k, v := range flags.MimeTypes {
+			c.MimeTypes[k] = v
+		}
+	}
+	if flags.ACLUsers != nil {
+		c.ACLUsers = make(map[string]uint32, len(flags.ACLUsers))
+		for k, v := range flags.ACLUsers {
+			c.ACLUsers[k] = v
+		}
+	}
+	if flags.ACLGroups != nil {
+		c.ACLGroups = make(map[string]uint32, len(flags.ACLGroups))
+		for k, v := range flags.ACLGroups {
+			c.ACLGroups[k] = v
+		}
+	}
+	if flags.RequestHeaders != nil {
+		c.RequestHeaders = make(map[string]string, len(flags.RequestHeaders))
+		for k, v := range flags.RequestHeaders {
+			c.RequestHeaders[k] = v
+		}
+	}
+	if flags.ErrorMap != nil {
+		c.ErrorMap = make(map[string]syscall.Errno, len(flags.ErrorMap))
+		for k, v := range flags.ErrorMap {
+			c.ErrorMap[k] = v
+		}
+	}
+	c.Cache = append([]string(nil), flags.Cache...)
+	if flags.HidePatterns != nil {
+		c.HidePatterns = append([]string(nil), flags.HidePatterns...)
+	}
+
+	switch config := flags.Backend.(type) {
+	case *S3Config:
+		b := *config
+		c.Backend = &b
+	case *AZBlobConfig:
+		b := *config
+		c.Backend = &b
+	case *ADLv1Config:
+		b := *config
+		c.Backend = &b
+	case *ADLv2Config:
+		b := *config
+		c.Backend = &b
+	case *GCSConfig:
+		b := *config
+		c.Backend = &b
+	case *WebHDFSConfig:
+		b := *config
+		c.Backend = &b
+	}
+
+	return &c
 }
 
 func (flags *FlagStorage) Cleanup() {
@@ -86,21 +383,3 @@ func (flags *FlagStorage) Cleanup() {
 		}
 	}
 }
-
-var defaultHTTPTransport = http.Transport{
-	Proxy: http.ProxyFromEnvironment,
-	DialContext: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-		DualStack: true,
-	}).DialContext,
-	MaxIdleConns:          1000,
-	MaxIdleConnsPerHost:   1000,
-	IdleConnTimeout:       90 * time.Second,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 10 * time.Second,
-}
-
-func GetHTTPTransport() *http.Transport {
-	return &defaultHTTPTransport
-}
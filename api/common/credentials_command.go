@@ -0,0 +1,225 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// how long --credentials-command can take before we give up on it
+const CREDENTIALS_COMMAND_TIMEOUT = time.Minute
+
+var credsLog = GetLogger("credentials")
+
+// CommandAuthorizer signs azure requests with a bearer token that
+// --credentials-command prints, like
+// {"access_token": "...", "expires_on": 1577836800}. expires_on is
+// in seconds since the epoch like az prints it, as a number or a
+// string, or RFC 3339.
+//
+// The command is run again when the token is about to expire, and
+// when a request was rejected with 401 (see Transport). Only one runs
+// at a time, requests that need a new token meanwhile wait for it
+type CommandAuthorizer struct {
+	Command string
+	// a token that expires sooner than this is refreshed
+	RefreshBefore time.Duration
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+
+	// held while the command runs
+	refreshMu sync.Mutex
+}
+
+func NewCommandAuthorizer(command string, refreshBefore time.Duration) *CommandAuthorizer {
+	return &CommandAuthorizer{
+		Command:       command,
+		RefreshBefore: refreshBefore,
+	}
+}
+
+func runCredentialsCommand(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CREDENTIALS_COMMAND_TIMEOUT)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+type commandToken struct {
+	AccessToken string          `json:"access_token"`
+	ExpiresOn   json.RawMessage `json:"expires_on"`
+}
+
+func parseCommandToken(out []byte) (token string, expires time.Time, err error) {
+	var t commandToken
+	err = json.Unmarshal(out, &t)
+	if err != nil {
+		return
+	}
+	if t.AccessToken == "" {
+		err = fmt.Errorf("no access_token")
+		return
+	}
+
+	var s string
+	if json.Unmarshal(t.ExpiresOn, &s) != nil {
+		s = string(t.ExpiresOn)
+	}
+	if secs, err2 := strconv.ParseInt(s, 10, 64); err2 == nil {
+		expires = time.Unix(secs, 0)
+	} else if expires, err = time.Parse(time.RFC3339, s); err != nil {
+		err = fmt.Errorf("invalid expires_on: %v", string(t.ExpiresOn))
+		return
+	}
+	return t.AccessToken, expires, nil
+}
+
+// fresh returns the cached token if it doesn't need to be refreshed,
+// and isn't the one that was rejected
+func (a *CommandAuthorizer) fresh(rejected string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && a.token != rejected &&
+		time.Until(a.expires) > a.RefreshBefore {
+		return a.token
+	}
+	return ""
+}
+
+// Token returns a token to sign a request with, running the command
+// if there's none or it's about to expire. rejected is a token the
+// server didn't take, which is never returned again
+func (a *CommandAuthorizer) Token(rejected string) (string, error) {
+	if token := a.fresh(rejected); token != "" {
+		return token, nil
+	}
+
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	// someone else may have while we waited
+	if token := a.fresh(rejected); token != "" {
+		return token, nil
+	}
+
+	out, err := runCredentialsCommand(a.Command)
+	if err == nil {
+		var token string
+		var expires time.Time
+		token, expires, err = parseCommandToken(out)
+		if err == nil {
+			credsLog.Debugf("new token from credentials command, expires at %v",
+				expires)
+			a.mu.Lock()
+			a.token = token
+			a.expires = expires
+			a.mu.Unlock()
+			return token, nil
+		}
+	}
+
+	credsLog.Errorf("credentials command failed: %v", err)
+
+	// what we have may still work for a while
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && a.token != rejected && time.Now().Before(a.expires) {
+		return a.token, nil
+	}
+	return "", fmt.Errorf("credentials command failed: %v", err)
+}
+
+func (a *CommandAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			token, err := a.Token("")
+			if err != nil {
+				return r, err
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+			return r, nil
+		})
+	}
+}
+
+// Transport sends a request that was rejected with 401 once more
+// with a new token. Requests whose body can't be read again are not
+func (a *CommandAuthorizer) Transport(rt http.RoundTripper) http.RoundTripper {
+	return commandAuthTransport{a, rt}
+}
+
+type commandAuthTransport struct {
+	auth *CommandAuthorizer
+	rt   http.RoundTripper
+}
+
+func (t commandAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, err
+	}
+
+	rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	token, tokenErr := t.auth.Token(rejected)
+	if tokenErr != nil {
+		return resp, err
+	}
+
+	retry := req.WithContext(req.Context())
+	retry.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		retry.Header[k] = v
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+	}
+
+	credsLog.Infof("%v %v was unauthorized, trying again with a new token",
+		req.Method, req.URL.Path)
+	resp.Body.Close()
+	return t.rt.RoundTrip(retry)
+}
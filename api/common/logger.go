@@ -15,12 +15,14 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	glog "log"
 	"log/syslog"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
@@ -34,6 +36,10 @@ var cloudLogLevel = logrus.InfoLevel
 
 var syslogHook *logrus_syslog.SyslogHook
 
+// every logger writes one json object per line instead, see
+// SetLogFormat
+var jsonLogs bool
+
 func InitLoggers(logToSyslog bool) {
 	if logToSyslog {
 		var err error
@@ -51,6 +57,19 @@ func InitLoggers(logToSyslog bool) {
 	}
 }
 
+// SetLogFormat is --log-format, text or json
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		jsonLogs = false
+	case "json":
+		jsonLogs = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
 func SetCloudLogLevel(level logrus.Level) {
 	cloudLogLevel = level
 
@@ -76,6 +95,10 @@ func (l *LogHandle) Format(e *logrus.Entry) ([]byte, error) {
 		lvl = *l.Lvl
 	}
 
+	if jsonLogs {
+		return l.formatJSON(e, lvl)
+	}
+
 	if syslogHook == nil {
 		const timeFormat = "2006/01/02 15:04:05.000000"
 
@@ -96,6 +119,29 @@ func (l *LogHandle) Format(e *logrus.Entry) ([]byte, error) {
 	return []byte(str), nil
 }
 
+func (l *LogHandle) formatJSON(e *logrus.Entry, lvl logrus.Level) ([]byte, error) {
+	fields := make(logrus.Fields, len(e.Data)+4)
+	for k, v := range e.Data {
+		if err, ok := v.(error); ok {
+			// errors marshal to {}
+			v = err.Error()
+		}
+		fields[k] = v
+	}
+	if syslogHook == nil {
+		fields["time"] = e.Time.Format(time.RFC3339Nano)
+	}
+	fields["logger"] = l.name
+	fields["level"] = lvl.String()
+	fields["msg"] = e.Message
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
 // for aws.Logger
 func (l *LogHandle) Log(args ...interface{}) {
 	l.Debugln(args...)
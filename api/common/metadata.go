@@ -0,0 +1,132 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Metadata goes through EncodeMetadata before it's given to a backend
+// and DecodeMetadata when it comes back, so it looks the same on all
+// of them. S3 only takes ASCII and lowercases keys, azure only takes
+// keys that are C# identifiers, so keys are lowercase letters, digits
+// and _ escapes, and values are printable ASCII and % escapes.
+//
+// What we wrote has METADATA_VERSION_KEY. Metadata without it was
+// written before, or by someone else, and is read like it used to be
+const METADATA_VERSION_KEY = "goofys_meta"
+const METADATA_VERSION = "1"
+
+// EncodeMetadataKey keeps a-z and 0-9, except a leading digit, and
+// turns every other byte into _xx
+func EncodeMetadataKey(k string) string {
+	var s strings.Builder
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9' && i != 0) {
+			s.WriteByte(c)
+		} else {
+			fmt.Fprintf(&s, "_%02x", c)
+		}
+	}
+	return s.String()
+}
+
+func DecodeMetadataKey(k string) (string, error) {
+	var s strings.Builder
+	for i := 0; i < len(k); i++ {
+		if k[i] != '_' {
+			s.WriteByte(k[i])
+			continue
+		}
+		if i+2 >= len(k) {
+			return "", fmt.Errorf("truncated escape in %v", k)
+		}
+		c, err := strconv.ParseUint(k[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %v", k)
+		}
+		s.WriteByte(byte(c))
+		i += 2
+	}
+	return s.String(), nil
+}
+
+// EncodeMetadataValue keeps printable ASCII except %, and turns every
+// other byte into %XX
+func EncodeMetadataValue(v []byte) string {
+	var s strings.Builder
+	for _, c := range v {
+		if c >= 0x20 && c < 0x7f && c != '%' {
+			s.WriteByte(c)
+		} else {
+			fmt.Fprintf(&s, "%%%02X", c)
+		}
+	}
+	return s.String()
+}
+
+func DecodeMetadataValue(v string) []byte {
+	value, err := url.PathUnescape(v)
+	if err != nil {
+		// not something we wrote
+		return []byte(v)
+	}
+	return []byte(value)
+}
+
+func EncodeMetadata(meta map[string][]byte) map[string]*string {
+	metadata := make(map[string]*string, len(meta)+1)
+	if len(meta) == 0 {
+		return metadata
+	}
+
+	for k, v := range meta {
+		value := EncodeMetadataValue(v)
+		metadata[EncodeMetadataKey(k)] = &value
+	}
+	version := METADATA_VERSION
+	metadata[METADATA_VERSION_KEY] = &version
+	return metadata
+}
+
+func DecodeMetadata(metadata map[string]*string) map[string][]byte {
+	meta := make(map[string][]byte, len(metadata))
+
+	_, versioned := metadata[METADATA_VERSION_KEY]
+	for k, v := range metadata {
+		if k == METADATA_VERSION_KEY || v == nil {
+			continue
+		}
+
+		if versioned {
+			key, err := DecodeMetadataKey(k)
+			if err != nil {
+				// someone else added it after us
+				key = k
+			}
+			k = key
+		} else {
+			// backends disagree on case, this is how it
+			// used to be
+			k = strings.ToLower(k)
+		}
+		meta[k] = DecodeMetadataValue(*v)
+	}
+	return meta
+}
@@ -23,6 +23,8 @@ import (
 	"github.com/jacobsa/fuse/fuseutil"
 )
 
+// FusePanicLogger turns panics of Fs into EIO, and gives every op a
+// trace id
 type FusePanicLogger struct {
 	Fs fuseutil.FileSystem
 }
@@ -37,110 +39,164 @@ func LogPanic(err *error) {
 }
 
 func (fs FusePanicLogger) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
+	ctx, done := traceOp(ctx, "StatFS", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.StatFS(ctx, op)
 }
 func (fs FusePanicLogger) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	ctx, done := traceOp(ctx, "LookUpInode", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.LookUpInode(ctx, op)
 }
 func (fs FusePanicLogger) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) (err error) {
+	ctx, done := traceOp(ctx, "GetInodeAttributes", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.GetInodeAttributes(ctx, op)
 }
 func (fs FusePanicLogger) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) (err error) {
+	ctx, done := traceOp(ctx, "SetInodeAttributes", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.SetInodeAttributes(ctx, op)
 }
 func (fs FusePanicLogger) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) (err error) {
+	ctx, done := traceOp(ctx, "ForgetInode", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ForgetInode(ctx, op)
 }
 func (fs FusePanicLogger) MkDir(ctx context.Context, op *fuseops.MkDirOp) (err error) {
+	ctx, done := traceOp(ctx, "MkDir", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.MkDir(ctx, op)
 }
 func (fs FusePanicLogger) MkNode(ctx context.Context, op *fuseops.MkNodeOp) (err error) {
+	ctx, done := traceOp(ctx, "MkNode", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.MkNode(ctx, op)
 }
 func (fs FusePanicLogger) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) (err error) {
+	ctx, done := traceOp(ctx, "CreateFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.CreateFile(ctx, op)
 }
 func (fs FusePanicLogger) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) (err error) {
+	ctx, done := traceOp(ctx, "CreateLink", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.CreateLink(ctx, op)
 }
 func (fs FusePanicLogger) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) (err error) {
+	ctx, done := traceOp(ctx, "CreateSymlink", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.CreateSymlink(ctx, op)
 }
 func (fs FusePanicLogger) Rename(ctx context.Context, op *fuseops.RenameOp) (err error) {
+	ctx, done := traceOp(ctx, "Rename", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.Rename(ctx, op)
 }
 func (fs FusePanicLogger) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err error) {
+	ctx, done := traceOp(ctx, "RmDir", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.RmDir(ctx, op)
 }
 func (fs FusePanicLogger) Unlink(ctx context.Context, op *fuseops.UnlinkOp) (err error) {
+	ctx, done := traceOp(ctx, "Unlink", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.Unlink(ctx, op)
 }
 func (fs FusePanicLogger) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) (err error) {
+	ctx, done := traceOp(ctx, "OpenDir", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.OpenDir(ctx, op)
 }
 func (fs FusePanicLogger) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) (err error) {
+	ctx, done := traceOp(ctx, "ReadDir", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ReadDir(ctx, op)
 }
 func (fs FusePanicLogger) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) (err error) {
+	ctx, done := traceOp(ctx, "ReleaseDirHandle", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ReleaseDirHandle(ctx, op)
 }
 func (fs FusePanicLogger) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
+	ctx, done := traceOp(ctx, "OpenFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.OpenFile(ctx, op)
 }
 func (fs FusePanicLogger) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
+	ctx, done := traceOp(ctx, "ReadFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ReadFile(ctx, op)
 }
 func (fs FusePanicLogger) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) (err error) {
+	ctx, done := traceOp(ctx, "WriteFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.WriteFile(ctx, op)
 }
 func (fs FusePanicLogger) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) (err error) {
+	ctx, done := traceOp(ctx, "SyncFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.SyncFile(ctx, op)
 }
 func (fs FusePanicLogger) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (err error) {
+	ctx, done := traceOp(ctx, "FlushFile", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.FlushFile(ctx, op)
 }
 func (fs FusePanicLogger) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) (err error) {
+	ctx, done := traceOp(ctx, "ReleaseFileHandle", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ReleaseFileHandle(ctx, op)
 }
 func (fs FusePanicLogger) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) (err error) {
+	ctx, done := traceOp(ctx, "ReadSymlink", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ReadSymlink(ctx, op)
 }
 func (fs FusePanicLogger) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) (err error) {
+	ctx, done := traceOp(ctx, "RemoveXattr", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.RemoveXattr(ctx, op)
 }
 func (fs FusePanicLogger) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) (err error) {
+	ctx, done := traceOp(ctx, "GetXattr", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.GetXattr(ctx, op)
 }
 func (fs FusePanicLogger) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) (err error) {
+	ctx, done := traceOp(ctx, "ListXattr", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.ListXattr(ctx, op)
 }
 func (fs FusePanicLogger) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) (err error) {
+	ctx, done := traceOp(ctx, "SetXattr", op)
+	defer done(&err)
 	defer LogPanic(&err)
 	return fs.Fs.SetXattr(ctx, op)
 }
@@ -0,0 +1,182 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/sirupsen/logrus"
+)
+
+// every fuse op gets a trace id, which the backend requests it causes
+// log too and send in this header, so one grep finds all of it
+const TRACE_ID_HEADER = "X-Goofys-Trace-Id"
+
+type traceIdKey struct{}
+type traceStartKey struct{}
+
+// trace ids are this and a counter, so they are unique across mounts
+var tracePrefix uint32
+var traceSeq uint64
+
+func init() {
+	var b [4]byte
+	rand.Read(b[:])
+	tracePrefix = binary.BigEndian.Uint32(b[:])
+}
+
+func NewTraceId() string {
+	return fmt.Sprintf("%08x%08x", tracePrefix, atomic.AddUint64(&traceSeq, 1))
+}
+
+func WithTraceId(ctx context.Context, id string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, traceIdKey{}, id)
+}
+
+// TraceId is the trace id in ctx, "" if there's none
+func TraceId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(traceIdKey{}).(string)
+	return id
+}
+
+// TraceOnly is a Context with only the trace id of ctx, for requests
+// that outlive the op or shouldn't be interrupted with it. nil if
+// there's none
+func TraceOnly(ctx context.Context) context.Context {
+	id := TraceId(ctx)
+	if id == "" {
+		return nil
+	}
+	return WithTraceId(nil, id)
+}
+
+// TraceRequest gives r the trace id header of the op it's for, if
+// any, and notes when it was sent for TraceFields
+func TraceRequest(r *http.Request) *http.Request {
+	id := TraceId(r.Context())
+	if id == "" {
+		return r
+	}
+	r.Header.Set(TRACE_ID_HEADER, id)
+	return r.WithContext(context.WithValue(r.Context(), traceStartKey{}, time.Now()))
+}
+
+// RequestTraceFields is what to log about a request from
+// TraceRequest, nil if it has no trace id
+func RequestTraceFields(r *http.Request) logrus.Fields {
+	if id := TraceId(r.Context()); id != "" {
+		return logrus.Fields{"trace": id}
+	}
+	return nil
+}
+
+// TraceFields is what to log about the response to a request from
+// TraceRequest, nil if it has no trace id
+func TraceFields(r *http.Response) logrus.Fields {
+	if r == nil || r.Request == nil {
+		return nil
+	}
+	ctx := r.Request.Context()
+	id := TraceId(ctx)
+	if id == "" {
+		return nil
+	}
+	fields := logrus.Fields{
+		"trace":  id,
+		"status": r.StatusCode,
+	}
+	if start, ok := ctx.Value(traceStartKey{}).(time.Time); ok {
+		fields["latency"] = time.Since(start).String()
+	}
+	return fields
+}
+
+// traceOp gives a fuse op its trace id, done logs how long it took
+// with --debug_fuse
+func traceOp(ctx context.Context, name string, op interface{}) (context.Context, func(*error)) {
+	id := NewTraceId()
+	start := time.Now()
+	return WithTraceId(ctx, id), func(err *error) {
+		fuseLog := GetLogger("fuse")
+		if !fuseLog.IsLevelEnabled(logrus.DebugLevel) {
+			return
+		}
+		fields := logrus.Fields{
+			"trace":   id,
+			"latency": time.Since(start).String(),
+		}
+		if *err != nil {
+			fields["error"] = (*err).Error()
+		}
+		fuseLog.WithFields(fields).Debugf("%v %v", name, describeOp(op))
+	}
+}
+
+// describeOp is what an op is about, without what's read or written
+func describeOp(op interface{}) string {
+	switch op := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.GetInodeAttributesOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.SetInodeAttributesOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.MkDirOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.CreateFileOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.CreateSymlinkOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.RenameOp:
+		return fmt.Sprintf("%v %q %v %q", op.OldParent, op.OldName,
+			op.NewParent, op.NewName)
+	case *fuseops.RmDirOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.UnlinkOp:
+		return fmt.Sprintf("%v %q", op.Parent, op.Name)
+	case *fuseops.OpenDirOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.ReadDirOp:
+		return fmt.Sprintf("%v %v", op.Inode, op.Offset)
+	case *fuseops.OpenFileOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.ReadFileOp:
+		return fmt.Sprintf("%v %v %v", op.Inode, op.Offset, len(op.Dst))
+	case *fuseops.WriteFileOp:
+		return fmt.Sprintf("%v %v %v", op.Inode, op.Offset, len(op.Data))
+	case *fuseops.SyncFileOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.FlushFileOp:
+		return fmt.Sprintf("%v", op.Inode)
+	case *fuseops.GetXattrOp:
+		return fmt.Sprintf("%v %q", op.Inode, op.Name)
+	case *fuseops.SetXattrOp:
+		return fmt.Sprintf("%v %q", op.Inode, op.Name)
+	}
+	return ""
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// parallel range GETs of readahead and multipart uploads all go to
+// the same host, keep enough connections around for them
+const DEFAULT_MAX_IDLE_CONNS_PER_HOST = 1000
+const DEFAULT_IDLE_CONN_TIMEOUT = 90 * time.Second
+const DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+
+var httpLog = GetLogger("http")
+
+// what a transport is built from, with the defaults filled in
+type transportSettings struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+	dialTimeout         time.Duration
+	noHTTP2             bool
+	noCompression       bool
+}
+
+func newTransportSettings(flags *FlagStorage) (t transportSettings) {
+	t = transportSettings{
+		maxIdleConns:        flags.MaxIdleConns,
+		maxIdleConnsPerHost: flags.MaxIdleConnsPerHost,
+		idleConnTimeout:     flags.IdleConnTimeout,
+		tlsHandshakeTimeout: flags.TLSHandshakeTimeout,
+		dialTimeout:         flags.DialTimeout,
+		noHTTP2:             flags.NoHTTP2,
+		noCompression:       flags.NoCompression,
+	}
+	if t.maxIdleConnsPerHost == 0 {
+		t.maxIdleConnsPerHost = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	}
+	if t.maxIdleConns == 0 {
+		// 0 would be no limit for http.Transport
+		t.maxIdleConns = t.maxIdleConnsPerHost
+	}
+	if t.idleConnTimeout == 0 {
+		t.idleConnTimeout = DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	if t.tlsHandshakeTimeout == 0 {
+		t.tlsHandshakeTimeout = DEFAULT_TLS_HANDSHAKE_TIMEOUT
+	}
+	if t.dialTimeout == 0 {
+		t.dialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	return
+}
+
+func (t transportSettings) newTransport() *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   t.dialTimeout,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          t.maxIdleConns,
+		MaxIdleConnsPerHost:   t.maxIdleConnsPerHost,
+		IdleConnTimeout:       t.idleConnTimeout,
+		TLSHandshakeTimeout:   t.tlsHandshakeTimeout,
+		ExpectContinueTimeout: 10 * time.Second,
+		DisableCompression:    t.noCompression,
+	}
+	if t.noHTTP2 {
+		// a non-nil empty map keeps the transport from
+		// negotiating h2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+var transportsMu sync.Mutex
+
+// backends with the same settings share a transport and so its
+// connections, a different mount in the same process can have its
+// own
+var transports = make(map[transportSettings]*tracingTransport)
+
+// all the transports count in one place
+var hostsStats = &transportStats{
+	hosts: make(map[string]*hostStats),
+}
+
+// GetHTTPTransport returns the transport for the connection flags,
+// zero ones are the defaults
+func GetHTTPTransport(flags *FlagStorage) http.RoundTripper {
+	settings := newTransportSettings(flags)
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	t, ok := transports[settings]
+	if !ok {
+		httpLog.Debugf("new http transport: max idle conns %v (%v per host), "+
+			"idle timeout %v, dial timeout %v, tls handshake timeout %v, "+
+			"http2 %v, compression %v",
+			settings.maxIdleConns, settings.maxIdleConnsPerHost,
+			settings.idleConnTimeout, settings.dialTimeout,
+			settings.tlsHandshakeTimeout, !settings.noHTTP2,
+			!settings.noCompression)
+
+		t = &tracingTransport{
+			Transport: settings.newTransport(),
+			stats:     hostsStats,
+		}
+		transports[settings] = t
+	}
+	return t
+}
+
+type TransportStats struct {
+	Requests    uint64 `json:"requests"`
+	NewConns    uint64 `json:"new_conns"`
+	ReusedConns uint64 `json:"reused_conns"`
+	// total time spent, in nanoseconds
+	DNSTime     time.Duration `json:"dns_time_ns"`
+	ConnectTime time.Duration `json:"connect_time_ns"`
+	TLSTime     time.Duration `json:"tls_time_ns"`
+}
+
+type hostStats struct {
+	requests    uint64
+	newConns    uint64
+	reusedConns uint64
+	dnsTime     int64
+	connectTime int64
+	tlsTime     int64
+}
+
+// GetTransportStats returns the connection counters of each host we
+// talked to
+func GetTransportStats() map[string]TransportStats {
+	return hostsStats.Stats()
+}
+
+type transportStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+type tracingTransport struct {
+	*http.Transport
+	stats *transportStats
+}
+
+func (t *transportStats) host(name string) *hostStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.hosts[name]
+	if !ok {
+		stats = &hostStats{}
+		t.hosts[name] = stats
+	}
+	return stats
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stats := t.stats.host(req.URL.Host)
+	atomic.AddUint64(&stats.requests, 1)
+
+	// dialing both address families may call these concurrently
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+	since := func(start *time.Time, total *int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !start.IsZero() {
+			atomic.AddInt64(total, int64(time.Since(*start)))
+			*start = time.Time{}
+		}
+	}
+	now := func(start *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*start = time.Now()
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&stats.reusedConns, 1)
+			} else {
+				atomic.AddUint64(&stats.newConns, 1)
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			now(&dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			since(&dnsStart, &stats.dnsTime)
+		},
+		ConnectStart: func(network, addr string) {
+			now(&connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			since(&connectStart, &stats.connectTime)
+		},
+		TLSHandshakeStart: func() {
+			now(&tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			since(&tlsStart, &stats.tlsTime)
+		},
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.Transport.RoundTrip(req)
+}
+
+func (t *transportStats) Stats() map[string]TransportStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make(map[string]TransportStats, len(t.hosts))
+	for name, stats := range t.hosts {
+		res[name] = TransportStats{
+			Requests:    atomic.LoadUint64(&stats.requests),
+			NewConns:    atomic.LoadUint64(&stats.newConns),
+			ReusedConns: atomic.LoadUint64(&stats.reusedConns),
+			DNSTime:     time.Duration(atomic.LoadInt64(&stats.dnsTime)),
+			ConnectTime: time.Duration(atomic.LoadInt64(&stats.connectTime)),
+			TLSTime:     time.Duration(atomic.LoadInt64(&stats.tlsTime)),
+		}
+	}
+	return res
+}
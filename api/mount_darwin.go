@@ -0,0 +1,41 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goofys
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"github.com/jacobsa/fuse"
+)
+
+// macFUSE and FUSE-T take a different set of mount options than
+// linux. Let the kernel extension filter AppleDouble files too so
+// we see fewer of those requests in the first place.
+func setPlatformMountOptions(mountCfg *fuse.MountConfig, bucketName string,
+	flags *FlagStorage) {
+
+	mountCfg.VolumeName = bucketName
+	if mountCfg.Options == nil {
+		mountCfg.Options = make(map[string]string)
+	}
+
+	if _, ok := mountCfg.Options["volname"]; !ok {
+		mountCfg.Options["volname"] = bucketName
+	}
+	if flags.ExcludeAppleDouble {
+		mountCfg.Options["noappledouble"] = ""
+		mountCfg.Options["noapplexattr"] = ""
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// how many reads and writes can be in flight before we are ever
+// throttled, and at most
+const ADAPTIVE_MAX_WINDOW = 128
+
+// AdaptiveBackend limits how many reads and writes are in flight at
+// once with --adaptive-retry. The limit is halved every time the
+// backend throttles us, and goes up by one after every limit's worth
+// of requests that went through, like tcp does with its window.
+// Requests over the limit wait for one to finish. Everything else
+// goes straight through, it's the data that gets us throttled
+type AdaptiveBackend struct {
+	StorageBackend
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	window   float64
+	inflight int
+	// throttles of requests sent before this were because of the
+	// window we already halved
+	lastDecrease time.Time
+}
+
+func NewAdaptiveBackend(cloud StorageBackend) *AdaptiveBackend {
+	b := &AdaptiveBackend{
+		StorageBackend: cloud,
+		window:         ADAPTIVE_MAX_WINDOW,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *AdaptiveBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+// Window returns the current limit, and how many are in flight
+func (b *AdaptiveBackend) Window() (window int, inflight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.window), b.inflight
+}
+
+func (b *AdaptiveBackend) acquire() (start time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.inflight >= int(b.window) {
+		b.cond.Wait()
+	}
+	b.inflight++
+	return time.Now()
+}
+
+func (b *AdaptiveBackend) release(start time.Time, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inflight--
+	old := int(b.window)
+
+	if isThrottled(err) {
+		if start.After(b.lastDecrease) {
+			b.window /= 2
+			if b.window < 1 {
+				b.window = 1
+			}
+			b.lastDecrease = time.Now()
+		}
+	} else if err == nil {
+		b.window += 1 / b.window
+		if b.window > ADAPTIVE_MAX_WINDOW {
+			b.window = ADAPTIVE_MAX_WINDOW
+		}
+	}
+
+	if int(b.window) < old {
+		s3Log.Warnf("throttled, %v requests in flight at most now (was %v)",
+			int(b.window), old)
+	} else if int(b.window) > old {
+		s3Log.Debugf("%v requests in flight at most now", int(b.window))
+	}
+	b.cond.Broadcast()
+}
+
+func (b *AdaptiveBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.GetBlob(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.PutBlob(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.MultipartBlobBegin(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.MultipartBlobAdd(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.MultipartBlobAbort(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.MultipartBlobCommit(param)
+	b.release(start, err)
+	return resp, err
+}
+
+func (b *AdaptiveBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	start := b.acquire()
+	resp, err := b.StorageBackend.AppendBlob(param)
+	b.release(start, err)
+	return resp, err
+}
+
+// findAdaptiveBackend returns the AdaptiveBackend among the wrappers
+// of cloud, nil if --adaptive-retry is off
+func findAdaptiveBackend(cloud StorageBackend) (adaptive *AdaptiveBackend) {
+	walkBackends(cloud, func(b StorageBackend) bool {
+		adaptive, _ = b.(*AdaptiveBackend)
+		return adaptive != nil
+	})
+	return
+}
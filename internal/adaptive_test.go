@@ -0,0 +1,177 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	. "gopkg.in/check.v1"
+)
+
+// gateBackend holds every GET until it's let go, and then fails it
+// with err
+type gateBackend struct {
+	memBackend
+
+	gets int
+	err  error
+	gate chan struct{}
+}
+
+func (b *gateBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.mu.Lock()
+	b.gets++
+	b.mu.Unlock()
+
+	<-b.gate
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &GetBlobOutput{}, nil
+}
+
+func (b *gateBackend) started() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.gets
+}
+
+type AdaptiveTest struct {
+	cloud    *gateBackend
+	adaptive *AdaptiveBackend
+}
+
+var _ = Suite(&AdaptiveTest{})
+
+func (s *AdaptiveTest) SetUpTest(t *C) {
+	s.cloud = &gateBackend{gate: make(chan struct{})}
+	s.adaptive = NewAdaptiveBackend(s.cloud)
+}
+
+// get starts n GETs and waits until they all got to the backend
+func (s *AdaptiveTest) get(t *C, n int) *sync.WaitGroup {
+	before := s.cloud.started()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.adaptive.GetBlob(&GetBlobInput{Key: "a"})
+		}()
+	}
+	for s.cloud.started() != before+n {
+		time.Sleep(time.Millisecond)
+	}
+	return &wg
+}
+
+func (s *AdaptiveTest) TestThrottled(t *C) {
+	t.Assert(isThrottled(syscall.EAGAIN), Equals, true)
+	t.Assert(isThrottled(awserr.New("SlowDown", "Please reduce your request rate.", nil)),
+		Equals, true)
+	t.Assert(isThrottled(syscall.EIO), Equals, false)
+	t.Assert(isThrottled(nil), Equals, false)
+}
+
+func (s *AdaptiveTest) TestHalveOnce(t *C) {
+	s.cloud.err = syscall.EAGAIN
+
+	// they were all sent with the same window, which is one
+	// mistake
+	wg := s.get(t, 10)
+	close(s.cloud.gate)
+	wg.Wait()
+
+	window, inflight := s.adaptive.Window()
+	t.Assert(window, Equals, ADAPTIVE_MAX_WINDOW/2)
+	t.Assert(inflight, Equals, 0)
+
+	// but one sent after that is another
+	s.get(t, 1).Wait()
+	window, _ = s.adaptive.Window()
+	t.Assert(window, Equals, ADAPTIVE_MAX_WINDOW/4)
+}
+
+func (s *AdaptiveTest) TestNeverZero(t *C) {
+	s.cloud.err = syscall.EAGAIN
+	close(s.cloud.gate)
+
+	for i := 0; i < 10; i++ {
+		s.get(t, 1).Wait()
+	}
+	window, _ := s.adaptive.Window()
+	t.Assert(window, Equals, 1)
+}
+
+func (s *AdaptiveTest) TestGrow(t *C) {
+	close(s.cloud.gate)
+	s.adaptive.window = 2
+
+	// a window's worth of successes for every one more, 2 then 3
+	// then some of 4
+	for i := 0; i < 6; i++ {
+		s.get(t, 1).Wait()
+	}
+	window, _ := s.adaptive.Window()
+	t.Assert(window, Equals, 4)
+
+	// and errors that aren't throttling don't count either way
+	s.cloud.err = syscall.EIO
+	for i := 0; i < 10; i++ {
+		s.get(t, 1).Wait()
+	}
+	window, _ = s.adaptive.Window()
+	t.Assert(window, Equals, 4)
+
+	s.cloud.err = nil
+	s.adaptive.window = ADAPTIVE_MAX_WINDOW
+	s.get(t, 1).Wait()
+	window, _ = s.adaptive.Window()
+	t.Assert(window, Equals, ADAPTIVE_MAX_WINDOW)
+}
+
+func (s *AdaptiveTest) TestWait(t *C) {
+	s.adaptive.window = 2
+	wg := s.get(t, 2)
+
+	done := make(chan struct{})
+	go func() {
+		s.adaptive.GetBlob(&GetBlobInput{Key: "a"})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	t.Assert(s.cloud.started(), Equals, 2)
+	_, inflight := s.adaptive.Window()
+	t.Assert(inflight, Equals, 2)
+
+	// one finishing lets it in
+	s.cloud.gate <- struct{}{}
+	for s.cloud.started() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(s.cloud.gate)
+	wg.Wait()
+	<-done
+	_, inflight = s.adaptive.Window()
+	t.Assert(inflight, Equals, 0)
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// BackendInitError is why Init couldn't use the account, said so
+// that whoever mounts knows what to fix
+type BackendInitError struct {
+	Backend string
+	Account string
+	Path    string
+	Reason  string
+	// what the backend said
+	Err error
+}
+
+func (e BackendInitError) Error() string {
+	return fmt.Sprintf("%v account %q, path %v: %v (%v)", e.Backend, e.Account,
+		e.Path, e.Reason, e.Err)
+}
+
+// adlInitError looks at how the probe of Init failed. Bad
+// credentials, missing permissions and an endpoint that doesn't
+// resolve get a BackendInitError, nil means the usual mapping
+// applies. key is what was probed, a random name under what's
+// mounted
+func adlInitError(backend, account, key string, resp *http.Response, err error) error {
+	initErr := BackendInitError{
+		Backend: backend,
+		Account: account,
+		Path:    path.Dir("/" + key),
+		Err:     err,
+	}
+
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			initErr.Reason = "authentication failed, check the credentials"
+		case http.StatusForbidden:
+			initErr.Reason = "permission denied, check the access granted to the credentials"
+		default:
+			return nil
+		}
+		if initErr.Err == nil {
+			initErr.Err = fmt.Errorf("%v", resp.Status)
+		}
+		return initErr
+	}
+
+	for cause := err; cause != nil; {
+		switch e := cause.(type) {
+		case *net.DNSError:
+			initErr.Reason = fmt.Sprintf("cannot resolve %v, check the account name and endpoint",
+				e.Name)
+			return initErr
+		case adal.TokenRefreshError:
+			// never got as far as the account
+			initErr.Reason = "cannot get a token, check the credentials"
+			return initErr
+		case autorest.DetailedError:
+			cause = e.Original
+		case *url.Error:
+			cause = e.Err
+		case *net.OpError:
+			cause = e.Err
+		default:
+			cause = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"runtime"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Every read and write from the kernel goes through these paths, at
+// up to 128KB each. Anything they allocate is multiplied by how many
+// of them it takes to move a GB, and ends up as GC time
+type AllocTest struct {
+	cloud *slowBackend
+}
+
+var _ = Suite(&AllocTest{})
+
+func (s *AllocTest) SetUpTest(t *C) {
+	s.cloud = &slowBackend{size: 1024 * 1024 * 1024}
+}
+
+func (s *AllocTest) newReader() *FileHandle {
+	fh := newTestFileHandle(s.cloud)
+	// stream without readahead, so we only see the cost of a read
+	fh.inode.fs.flags.Cheap = true
+	fh.inode.Attributes.Size = s.cloud.size
+	fh.inode.KnownSize = &s.cloud.size
+	return fh
+}
+
+func (s *AllocTest) newWriter() *FileHandle {
+	fh := newTestFileHandle(s.cloud)
+	// so nothing is uploaded while the first part fills up
+	fh.inode.fs.flags.Cheap = true
+	return fh
+}
+
+func (s *AllocTest) TestReadAllocs(t *C) {
+	fh := s.newReader()
+	buf := make([]byte, 4096)
+	off := int64(0)
+
+	var err error
+
+	// the first run opens the stream
+	allocs := testing.AllocsPerRun(100, func() {
+		var n int
+		n, err = fh.ReadFile(off, buf)
+		off += int64(n)
+	})
+	t.Assert(err, IsNil)
+	t.Assert(off, Equals, int64(101*len(buf)))
+	t.Assert(allocs, Equals, float64(0))
+}
+
+func (s *AllocTest) TestWriteAllocs(t *C) {
+	fh := s.newWriter()
+	buf := make([]byte, 4096)
+
+	var err error
+
+	// 101 writes fit in the first part
+	allocs := testing.AllocsPerRun(100, func() {
+		err = fh.WriteFile(fh.nextWriteOffset, buf)
+	})
+	t.Assert(err, IsNil)
+	t.Assert(fh.nextWriteOffset, Equals, int64(101*len(buf)))
+	t.Assert(allocs, Equals, float64(0))
+}
+
+func (s *AllocTest) TestRangeHeader(t *C) {
+	t.Assert(rangeHeader(0, 1), Equals, "bytes=0-0")
+	t.Assert(rangeHeader(5*1024*1024, 1024), Equals, "bytes=5242880-5243903")
+	t.Assert(rangeHeader(100, 0), Equals, "bytes=100-")
+	t.Assert(testing.AllocsPerRun(100, func() {
+		rangeHeader(1<<40, 1<<20)
+	}) <= 1, Equals, true)
+}
+
+func gcCPUFraction() float64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.GCCPUFraction
+}
+
+// run with -check.b -check.bmem to see allocs/op, compare before and
+// after changing anything on the read path
+func (s *AllocTest) BenchmarkReadAllocs(t *C) {
+	const SIZE = 128 * 1024
+	s.cloud.size = uint64(t.N+1) * SIZE
+	fh := s.newReader()
+	buf := make([]byte, SIZE)
+	t.SetBytes(SIZE)
+	t.ResetTimer()
+
+	for i := 0; i < t.N; i++ {
+		_, err := fh.ReadFile(int64(i)*SIZE, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.StopTimer()
+	t.Logf("GC CPU fraction: %v", gcCPUFraction())
+}
+
+func (s *AllocTest) BenchmarkWriteAllocs(t *C) {
+	const SIZE = 128 * 1024
+	buf := make([]byte, SIZE)
+	t.SetBytes(SIZE)
+	t.ResetTimer()
+
+	var fh *FileHandle
+	for i := 0; i < t.N; i++ {
+		if fh == nil {
+			fh = s.newWriter()
+		}
+		err := fh.WriteFile(fh.nextWriteOffset, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// flush as a small file, so each file costs one PUT
+		if fh.nextWriteOffset == 4*1024*1024 {
+			err = fh.FlushFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh = nil
+		}
+	}
+
+	t.StopTimer()
+	t.Logf("GC CPU fraction: %v", gcCPUFraction())
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+type AnonymousTest struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// the method of every request, and whether it was signed
+	requests []string
+	signed   int
+}
+
+var _ = Suite(&AnonymousTest{})
+
+func (s *AnonymousTest) SetUpTest(t *C) {
+	s.requests = nil
+	s.signed = 0
+	// a public bucket with nothing in it
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.mu.Lock()
+			s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+			if r.Header.Get("Authorization") != "" {
+				s.signed++
+			}
+			s.mu.Unlock()
+
+			if r.Method == "HEAD" && r.URL.Path == "/bucket" {
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+}
+
+func (s *AnonymousTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *AnonymousTest) parse(args ...string) *FlagStorage {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run(append(append([]string{"goofys"}, args...), "bucket", "/mnt"))
+	return flags
+}
+
+func (s *AnonymousTest) TestFlag(t *C) {
+	flags := s.parse("--anonymous")
+	t.Assert(flags, NotNil)
+	t.Assert(flags.Backend.(*S3Config).Anonymous, Equals, true)
+	t.Assert(isReadOnlyMount(flags), Equals, true)
+
+	t.Assert(s.parse("--anonymous", "--requester-pays"), IsNil)
+	t.Assert(s.parse("--anonymous", "--profile", "foo"), IsNil)
+}
+
+func (s *AnonymousTest) TestAnonymous(t *C) {
+	flags := &FlagStorage{
+		Endpoint: s.server.URL,
+		Backend:  (&S3Config{Anonymous: true, RegionSet: true}).Init(),
+	}
+	cloud, err := NewBackend("bucket", flags)
+	t.Assert(err, IsNil)
+	t.Assert(cloud.Init("key"), IsNil)
+	t.Assert(cloud.Capabilities().ReadOnly, Equals, true)
+
+	// not even sent
+	before := len(s.requests)
+	_, err = cloud.PutBlob(&PutBlobInput{
+		Key:  "file",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+	t.Assert(s.requests, HasLen, before)
+	t.Assert(s.signed, Equals, 0)
+}
+
+func (s *AnonymousTest) TestNoCredentials(t *C) {
+	config := (&S3Config{
+		RegionSet: true,
+		// what the sdk has when it finds nothing
+		Credentials: credentials.NewChainCredentials(nil),
+	}).Init()
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, config)
+	t.Assert(err, IsNil)
+	t.Assert(s3.Init("key"), IsNil)
+
+	t.Assert(s3.awsConfig.Credentials, Equals, credentials.AnonymousCredentials)
+	t.Assert(s3.Capabilities().ReadOnly, Equals, true)
+	t.Assert(s.requests, DeepEquals, []string{"HEAD /bucket/key"})
+	t.Assert(s.signed, Equals, 0)
+}
+
+func (s *AnonymousTest) TestCredentials(t *C) {
+	config := (&S3Config{
+		RegionSet: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+	}).Init()
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, config)
+	t.Assert(err, IsNil)
+	t.Assert(s3.Init("key"), IsNil)
+
+	t.Assert(s3.awsConfig.Credentials, Not(Equals), credentials.AnonymousCredentials)
+	t.Assert(s3.Capabilities().ReadOnly, Equals, false)
+	t.Assert(s.signed, Equals, 1)
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// appendBackend is a slowBackend that can append, and remembers where
+type appendBackend struct {
+	slowBackend
+	appendedAt []uint64
+	partsAt    []uint64
+}
+
+func (b *appendBackend) Capabilities() *Capabilities {
+	return &Capabilities{
+		Name:           "append",
+		AnyPartSize:    true,
+		SupportsAppend: true,
+	}
+}
+
+func (b *appendBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appendedAt = append(b.appendedAt, param.Offset)
+	b.parts = make(map[uint32]int)
+	return &MultipartBlobCommitInput{Key: &param.Key}, nil
+}
+
+func (b *appendBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	b.mu.Lock()
+	b.partsAt = append(b.partsAt, param.Offset)
+	b.mu.Unlock()
+	return b.slowBackend.MultipartBlobAdd(param)
+}
+
+type AppendTest struct {
+	cloud *appendBackend
+	inode *Inode
+}
+
+var _ = Suite(&AppendTest{})
+
+func (s *AppendTest) SetUpTest(t *C) {
+	s.cloud = &appendBackend{}
+	s.inode = newTestInode(s.cloud)
+	s.inode.KnownSize = PUInt64(100)
+	s.inode.Attributes.Size = 100
+}
+
+func (s *AppendTest) TestAppend(t *C) {
+	fh := NewFileHandle(s.inode, fuseops.OpMetadata{})
+
+	t.Assert(fh.WriteFile(100, []byte("hello")), IsNil)
+	t.Assert(fh.WriteFile(105, []byte(" world")), IsNil)
+	t.Assert(s.inode.Attributes.Size, Equals, uint64(111))
+	t.Assert(fh.FlushFile(), IsNil)
+
+	// not written again
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(s.cloud.begun, Equals, 0)
+	t.Assert(s.cloud.appendedAt, DeepEquals, []uint64{100})
+	t.Assert(s.cloud.partsAt, DeepEquals, []uint64{100})
+	t.Assert(s.cloud.committed, Equals, 1)
+	t.Assert(*s.inode.KnownSize, Equals, uint64(111))
+
+	// and again from the new end
+	t.Assert(fh.WriteFile(111, []byte("!")), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.appendedAt, DeepEquals, []uint64{100, 111})
+	t.Assert(*s.inode.KnownSize, Equals, uint64(112))
+}
+
+func (s *AppendTest) TestNotAtTheEnd(t *C) {
+	fh := NewFileHandle(s.inode, fuseops.OpMetadata{})
+
+	t.Assert(fh.WriteFile(50, []byte("hello")), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.appendedAt, HasLen, 0)
+}
+
+func (s *AppendTest) TestRewrite(t *C) {
+	fh := NewFileHandle(s.inode, fuseops.OpMetadata{})
+
+	// from the start is still a PUT
+	t.Assert(fh.WriteFile(0, []byte("hello")), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.appendedAt, HasLen, 0)
+	t.Assert(*s.inode.KnownSize, Equals, uint64(5))
+}
+
+func (s *AppendTest) TestNoAppend(t *C) {
+	cloud := &slowBackend{}
+	fh := newTestFileHandle(cloud)
+	fh.inode.KnownSize = PUInt64(100)
+	fh.inode.Attributes.Size = 100
+
+	t.Assert(fh.WriteFile(100, []byte("hello")), Equals, syscall.ENOTSUP)
+}
+
+func (s *AppendTest) TestExtend(t *C) {
+	// ftruncate of a file that's not open is appended right away
+	t.Assert(s.inode.truncate(150), IsNil)
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(s.cloud.gets, Equals, 0)
+	t.Assert(s.cloud.appendedAt, DeepEquals, []uint64{100})
+	t.Assert(s.cloud.partsAt, DeepEquals, []uint64{100})
+	t.Assert(*s.inode.KnownSize, Equals, uint64(150))
+
+	// not smaller
+	t.Assert(s.inode.truncate(120), IsNil)
+	t.Assert(s.cloud.appendedAt, HasLen, 1)
+	t.Assert(s.inode.Attributes.Size, Equals, uint64(150))
+}
+
+func (s *AppendTest) TestExtendOpen(t *C) {
+	fh, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	t.Assert(s.inode.truncate(200), IsNil)
+	t.Assert(s.inode.Attributes.Size, Equals, uint64(200))
+	t.Assert(s.cloud.appendedAt, HasLen, 0)
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(s.cloud.appendedAt, DeepEquals, []uint64{100})
+	t.Assert(*s.inode.KnownSize, Equals, uint64(200))
+
+	// only once
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.appendedAt, HasLen, 1)
+}
+
+func (s *AppendTest) TestExtendWritten(t *C) {
+	s.cloud.keepPut = true
+	fh, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	// the zeros go after what was written instead
+	t.Assert(fh.WriteFile(0, []byte("hello")), IsNil)
+	t.Assert(s.inode.truncate(10), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.appendedAt, HasLen, 0)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(string(s.cloud.put), Equals, "hello\x00\x00\x00\x00\x00")
+	t.Assert(*s.inode.KnownSize, Equals, uint64(10))
+}
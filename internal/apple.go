@@ -0,0 +1,85 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Finder and the rest of macOS probe every directory they visit for a
+// handful of well known files and every file for AppleDouble (._foo)
+// sidecars and com.apple.* xattrs. On an object store each of those
+// probes is a HEAD and a LIST, so we short circuit them here. The
+// logic is platform independent so it can be exercised on linux, but
+// the defaults only turn it on for darwin.
+
+const (
+	APPLE_DOUBLE_PREFIX = "._"
+	APPLE_XATTR_PREFIX  = "com.apple."
+	DS_STORE            = ".DS_Store"
+	VOLUME_ICON         = ".VolumeIcon.icns"
+)
+
+func isAppleDouble(name string) bool {
+	return strings.HasPrefix(name, APPLE_DOUBLE_PREFIX) &&
+		len(name) > len(APPLE_DOUBLE_PREFIX)
+}
+
+func isAppleXattr(name string) bool {
+	return strings.HasPrefix(name, APPLE_XATTR_PREFIX)
+}
+
+// isExcludedName returns true if name should never be looked up,
+// created or listed
+func (fs *Goofys) isExcludedName(name string) bool {
+	if fs.flags.ExcludeAppleDouble && isAppleDouble(name) {
+		return true
+	}
+	if fs.flags.ExcludeDSStore && name == DS_STORE {
+		return true
+	}
+	if fs.flags.ExcludeVolumeIcon && name == VOLUME_ICON {
+		return true
+	}
+	return false
+}
+
+// isUnlistedName returns true if name is left out of dir's listing.
+// That's the excluded names, the ones --hide-pattern keeps in memory,
+// .goofys-restore, and .snapshots and .versions, so that find, du,
+// rsync and friends don't walk every snapshot and version. Those can
+// still be looked up directly
+func (fs *Goofys) isUnlistedName(dir *Inode, name string) bool {
+	if fs.isExcludedName(name) || isHiddenName(fs.flags.HidePatterns, name) {
+		return true
+	}
+	if fs.flags.VersionedView && name == VERSIONS_DIR {
+		return true
+	}
+	if fs.flags.Undelete && name == RESTORE_FILE {
+		return true
+	}
+	return fs.flags.Snapshots && !fs.flags.SnapshotVisible &&
+		dir.Id == fuseops.RootInodeID && name == SNAPSHOT_DIR
+}
+
+// isExcludedXattr returns true if the xattr is one that we don't
+// persist and should answer from the fast path without consulting
+// the backend
+func (fs *Goofys) isExcludedXattr(name string) bool {
+	return fs.flags.ExcludeAppleDouble && isAppleXattr(name)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"context"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type AppleTest struct {
+}
+
+var _ = Suite(&AppleTest{})
+
+func (s *AppleTest) TestIsAppleDouble(t *C) {
+	t.Assert(isAppleDouble("._foo"), Equals, true)
+	t.Assert(isAppleDouble("._"), Equals, false)
+	t.Assert(isAppleDouble("._."), Equals, true)
+	t.Assert(isAppleDouble("foo._bar"), Equals, false)
+	t.Assert(isAppleDouble(".foo"), Equals, false)
+	t.Assert(isAppleDouble(DS_STORE), Equals, false)
+}
+
+func (s *AppleTest) TestIsAppleXattr(t *C) {
+	t.Assert(isAppleXattr("com.apple.FinderInfo"), Equals, true)
+	t.Assert(isAppleXattr("com.apple.quarantine"), Equals, true)
+	t.Assert(isAppleXattr("user.com.apple.foo"), Equals, false)
+	t.Assert(isAppleXattr("s3.etag"), Equals, false)
+}
+
+func (s *AppleTest) TestExcludedName(t *C) {
+	fs := newTestFs(&memBackend{}, nil)
+	for _, name := range []string{"._foo", DS_STORE, VOLUME_ICON, "foo"} {
+		t.Assert(fs.isExcludedName(name), Equals, false)
+	}
+
+	fs.flags.ExcludeAppleDouble = true
+	t.Assert(fs.isExcludedName("._foo"), Equals, true)
+	t.Assert(fs.isExcludedName(DS_STORE), Equals, false)
+	t.Assert(fs.isExcludedXattr("com.apple.FinderInfo"), Equals, true)
+	t.Assert(fs.isExcludedXattr("user.foo"), Equals, false)
+
+	fs.flags.ExcludeDSStore = true
+	t.Assert(fs.isExcludedName(DS_STORE), Equals, true)
+	t.Assert(fs.isExcludedName(VOLUME_ICON), Equals, false)
+
+	fs.flags.ExcludeVolumeIcon = true
+	t.Assert(fs.isExcludedName(VOLUME_ICON), Equals, true)
+	t.Assert(fs.isExcludedName("foo"), Equals, false)
+	t.Assert(fs.isExcludedName(".DS_Store.bak"), Equals, false)
+}
+
+func (s *AppleTest) TestUnlistedName(t *C) {
+	fs := newTestFs(&memBackend{}, &FlagStorage{
+		ExcludeDSStore: true,
+		HidePatterns:   []string{"._*"},
+		VersionedView:  true,
+		Snapshots:      true,
+	})
+	root := fs.testRoot()
+	dir := newTestDir(root, "dir")
+
+	for _, name := range []string{DS_STORE, "._foo", VERSIONS_DIR} {
+		t.Assert(fs.isUnlistedName(dir, name), Equals, true)
+	}
+	t.Assert(fs.isUnlistedName(root, SNAPSHOT_DIR), Equals, true)
+	t.Assert(fs.isUnlistedName(dir, SNAPSHOT_DIR), Equals, false)
+	t.Assert(fs.isUnlistedName(dir, "foo"), Equals, false)
+
+	// hidden names can be created, unlike excluded ones
+	t.Assert(fs.isExcludedName("._foo"), Equals, false)
+
+	fs.flags.SnapshotVisible = true
+	t.Assert(fs.isUnlistedName(root, SNAPSHOT_DIR), Equals, false)
+}
+
+func (s *AppleTest) TestExcludedOps(t *C) {
+	// none of these should reach the backend
+	fs := newTestFs(&memBackend{}, &FlagStorage{
+		ExcludeAppleDouble: true,
+		ExcludeDSStore:     true,
+	})
+
+	err := fs.LookUpInode(context.TODO(), &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "._foo",
+	})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	err = fs.CreateFile(context.TODO(), &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   DS_STORE,
+	})
+	t.Assert(err, Equals, syscall.EPERM)
+
+	err = fs.GetXattr(context.TODO(), &fuseops.GetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  "com.apple.FinderInfo",
+	})
+	t.Assert(err, Equals, ENOATTR)
+
+	err = fs.SetXattr(context.TODO(), &fuseops.SetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  "com.apple.quarantine",
+	})
+	t.Assert(err, Equals, syscall.ENOTSUP)
+}
@@ -15,11 +15,15 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
@@ -31,10 +35,47 @@ type Capabilities struct {
 	// indicates that the blob store has native support for directories
 	DirBlob bool
 	Name    string
+	// mutations always fail with EROFS
+	ReadOnly bool
+	// PutBlob and multipart uploads honor IfMatch
+	ConditionalWrite bool
+	// PutBlob and multipart uploads honor IfNotExists
+	ConditionalCreate bool
+	// a part that failed can be added again, and a commit that
+	// failed can be tried again
+	ResumableMultipart bool
+	// PutBlob and MultipartBlobBegin honor StorageClass
+	StorageClass bool
+	// parts other than the last can be smaller than the minimum
+	// S3 has, so fsync can send what's buffered
+	AnyPartSize bool
+	// user metadata is ignored by PutBlob and not returned by
+	// HeadBlob
+	NoMetadata bool
+	// AppendBlob adds to an existing object without sending what's
+	// there again
+	SupportsAppend bool
+	// AppendBlob needs the object to be at least this big
+	MinAppendOffset uint64
+	// limits on keys, 0 or empty for none. MaxKeyLength is in
+	// bytes unless KeyLengthInChars
+	MaxKeyLength     int
+	KeyLengthInChars bool
+	MaxPathDepth     int
+	InvalidKeyChars  string
+
+	// limit on user metadata in bytes, keys and values as they are
+	// sent, 0 for none
+	MaxMetadataSize int
+
+	// the biggest object there can be, 0 if there's no limit
+	MaxObjectSize uint64
 }
 
 type HeadBlobInput struct {
 	Key string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type BlobItemOutput struct {
@@ -43,6 +84,22 @@ type BlobItemOutput struct {
 	LastModified *time.Time
 	Size         uint64
 	StorageClass *string
+	// only some backends have these
+	Atime  *time.Time
+	Crtime *time.Time
+	// only azure with --list-deleted, soft deleted and can be
+	// restored
+	Deleted bool
+	// only ADLv2 with --use-backend-acls
+	ACL *BlobACL
+}
+
+// BlobACL is who an object belongs to and its rwx bits, on backends
+// with POSIX permissions
+type BlobACL struct {
+	Owner string
+	Group string
+	Mode  os.FileMode
 }
 
 type HeadBlobOutput struct {
@@ -52,15 +109,69 @@ type HeadBlobOutput struct {
 	Metadata    map[string]*string
 	IsDirBlob   bool
 
+	// S3 Object Lock, if the object has a retention or legal hold
+	ObjectLockMode *string
+	RetainUntil    *time.Time
+	LegalHold      bool
+
+	// AES256 or aws:kms, only S3 says
+	ServerSideEncryption *string
+
 	RequestId string
 }
 
+// ListBlobsInput is the same across backends, modeled after S3
+// ListObjectsV2:
+//
+// - Items and Prefixes are each in key order, and together have at
+//   most MaxKeys entries. A page may have fewer even if there's more
+// - IsTruncated is true iff there's another page, and then
+//   NextContinuationToken is set. Tokens are opaque, pass them back
+//   as they are. An empty token is valid
+// - with a token, StartAfter is ignored
+// - if Prefix ends with / and that dir exists, the first page has an
+//   item for the dir itself. Without the /, Prefix "dir" lists "dir/"
+//   as a prefix, and a file named Prefix is an item
 type ListBlobsInput struct {
 	Prefix            *string
 	Delimiter         *string
 	MaxKeys           *uint32
 	StartAfter        *string // XXX: not supported by Azure
 	ContinuationToken *string
+	// cancelling it aborts the request
+	Context context.Context
+}
+
+// opTimeout is --op-timeout, how long a request to the backend can
+// take, retries included, before it gives up. 0 is forever. Backends
+// embed it so that every mount has its own
+type opTimeout time.Duration
+
+// requestContext is what the backend's request should use for the
+// Context of an input, which is nil unless it can be interrupted. It
+// expires after --op-timeout, cancel has to be called once the
+// request is done with
+func (t opTimeout) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if t == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(t))
+}
+
+// cancelOnClose is the body of a GET, the request's context is
+// cancelled once it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 type BlobPrefixOutput struct {
@@ -76,8 +187,63 @@ type ListBlobsOutput struct {
 	RequestId string
 }
 
+// a walk of a big tree goes through a page of items for every 1000
+// keys, reuse them instead of leaving them all to the gc
+var listItemsPool = sync.Pool{
+	New: func() interface{} {
+		return []BlobItemOutput(nil)
+	},
+}
+
+func getListItems() []BlobItemOutput {
+	return listItemsPool.Get().([]BlobItemOutput)[:0]
+}
+
+// putListItems gives back the items of a listing page. Nothing may
+// refer to the slice afterward
+func putListItems(items []BlobItemOutput) {
+	if cap(items) == 0 {
+		return
+	}
+	// don't keep the keys alive
+	items = items[:cap(items)]
+	for i := range items {
+		items[i] = BlobItemOutput{}
+	}
+	listItemsPool.Put(items[:0])
+}
+
+type ListBlobVersionsInput struct {
+	Prefix          *string
+	Delimiter       *string
+	MaxKeys         *uint32
+	KeyMarker       *string
+	VersionIdMarker *string
+}
+
+type BlobVersionOutput struct {
+	BlobItemOutput
+
+	VersionId      *string
+	IsLatest       bool
+	IsDeleteMarker bool
+}
+
+type ListBlobVersionsOutput struct {
+	Prefixes []BlobPrefixOutput
+	// sorted by key, and newest version first for the same key
+	Versions            []BlobVersionOutput
+	NextKeyMarker       *string
+	NextVersionIdMarker *string
+	IsTruncated         bool
+
+	RequestId string
+}
+
 type DeleteBlobInput struct {
 	Key string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type DeleteBlobOutput struct {
@@ -86,15 +252,57 @@ type DeleteBlobOutput struct {
 
 type DeleteBlobsInput struct {
 	Items []string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type DeleteBlobsOutput struct {
 	RequestId string
 }
 
+// DeleteBlobsError is from DeleteBlobs when only some of the keys
+// couldn't be deleted, the others are gone
+type DeleteBlobsError struct {
+	// why each key that's left failed
+	Failed map[string]error
+}
+
+func (e *DeleteBlobsError) Error() string {
+	keys := make([]string, 0, len(e.Failed))
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	msg := fmt.Sprintf("unable to delete %v keys:", len(keys))
+	for i, key := range keys {
+		if i == 10 {
+			msg += " ..."
+			break
+		}
+		msg += fmt.Sprintf(" %v=%v", key, e.Failed[key])
+	}
+	return msg
+}
+
+// Errno is what to tell the kernel, the errno of the first key that
+// failed with one
+func (e *DeleteBlobsError) Errno() error {
+	var err error = syscall.EIO
+	var first string
+	for key, keyErr := range e.Failed {
+		if errno, ok := keyErr.(syscall.Errno); ok && (first == "" || key < first) {
+			first, err = key, errno
+		}
+	}
+	return err
+}
+
 type RenameBlobInput struct {
 	Source      string
 	Destination string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type RenameBlobOutput struct {
@@ -109,6 +317,10 @@ type CopyBlobInput struct {
 	ETag         *string            // if non-nil, do conditional copy
 	Metadata     map[string]*string // if nil, copy from Source
 	StorageClass *string            // if nil, copy from Source
+	// if nil, from Destination's name when Metadata is replaced
+	ContentType *string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type CopyBlobOutput struct {
@@ -116,16 +328,35 @@ type CopyBlobOutput struct {
 }
 
 type GetBlobInput struct {
-	Key     string
-	Start   uint64
-	Count   uint64
+	Key   string
+	Start uint64
+	Count uint64
+	// fail with ESTALE if the object no longer has this etag. Not
+	// every backend checks it
 	IfMatch *string
+	// if non-nil, read this version instead of the latest
+	VersionId *string
+	// cancelling it aborts the request, and reading the body
+	Context context.Context
+	// ask for what the whole object hashes to, see
+	// GetBlobOutput.Checksum
+	Checksum bool
+}
+
+// BlobChecksum is a hash of a whole object, as the backend has it
+type BlobChecksum struct {
+	// one of md5, crc32, crc32c, sha1 or sha256
+	Algorithm string
+	Value     []byte
 }
 
 type GetBlobOutput struct {
 	HeadBlobOutput
 
 	Body io.ReadCloser
+	// set if Checksum was asked for, the backend knows it, and Body
+	// is the whole object
+	Checksum *BlobChecksum
 
 	RequestId string
 }
@@ -135,9 +366,19 @@ type PutBlobInput struct {
 	Metadata    map[string]*string
 	ContentType *string
 	DirBlob     bool
+	// only overwrite if the object still has this etag, otherwise
+	// fail with EBUSY. Ignored without Capabilities.ConditionalWrite
+	IfMatch *string
+	// only create the object, fail with EBUSY if someone else
+	// already did. Ignored without Capabilities.ConditionalCreate
+	IfNotExists bool
+	// if nil, the backend's default
+	StorageClass *string
 
 	Body io.ReadSeeker
 	Size *uint64
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type PutBlobOutput struct {
@@ -151,6 +392,28 @@ type MultipartBlobBeginInput struct {
 	Key         string
 	Metadata    map[string]*string
 	ContentType *string
+	// like PutBlobInput.IfMatch, for backends that replace the
+	// object when the upload begins
+	IfMatch      *string
+	IfNotExists  bool
+	StorageClass *string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
+}
+
+// AppendBlobInput is like MultipartBlobBeginInput, except the object
+// has to exist and is kept. Parts go after what's there, and the
+// commit makes them visible
+type AppendBlobInput struct {
+	Key string
+	// how big the object is now, where the first part goes. The
+	// append fails if it has a different size by the time we get
+	// to it
+	Offset      uint64
+	ContentType *string
+	IfMatch     *string
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type MultipartBlobCommitInput struct {
@@ -160,6 +423,12 @@ type MultipartBlobCommitInput struct {
 	UploadId *string
 	Parts    []*string
 	NumParts uint32
+	// like PutBlobInput.IfMatch, checked at commit
+	IfMatch     *string
+	IfNotExists bool
+	// the fuse op that commits or aborts it, for its trace id.
+	// Can be nil
+	Context context.Context
 
 	// for GCS
 	backendData interface{}
@@ -174,6 +443,8 @@ type MultipartBlobAddInput struct {
 	Size   uint64 // GCS wants to know part size
 	Last   bool   // GCS needs to know if this part is the last one
 	Offset uint64 // ADLv2 needs to know offset
+	// the fuse op that wants it, for its trace id. Can be nil
+	Context context.Context
 }
 
 type MultipartBlobAddOutput struct {
@@ -190,9 +461,27 @@ type MultipartBlobAbortOutput struct {
 }
 
 type MultipartExpireInput struct {
+	// only uploads of keys under this prefix
+	Prefix string
+	// only uploads started longer ago than this, 48 hours if 0
+	OlderThan time.Duration
+	// uploads we are still writing to, which are never aborted
+	Live func(uploadId string) bool
+	// only report what would be aborted
+	DryRun bool
+}
+
+type ExpiredUpload struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+	// of the parts that were uploaded
+	Size uint64
 }
 
 type MultipartExpireOutput struct {
+	Aborted []ExpiredUpload
+
 	RequestId string
 }
 
@@ -210,6 +499,18 @@ type MakeBucketOutput struct {
 	RequestId string
 }
 
+type GetBucketUsageInput struct {
+}
+
+type GetBucketUsageOutput struct {
+	// what the bucket takes up, which is more than the sum of the
+	// sizes if the backend keeps copies
+	Bytes   uint64
+	Objects uint64
+
+	RequestId string
+}
+
 /// Implementations of all the functions here are expected to be
 /// concurrency-safe, except for
 ///
@@ -224,6 +525,7 @@ type StorageBackend interface {
 	Bucket() string
 	HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error)
 	ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error)
+	ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error)
 	DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error)
 	DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error)
 	RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error)
@@ -235,8 +537,14 @@ type StorageBackend interface {
 	MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error)
 	MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error)
 	MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error)
+	// ENOTSUP unless Capabilities().SupportsAppend. Continue with
+	// MultipartBlobAdd and MultipartBlobCommit like after
+	// MultipartBlobBegin
+	AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error)
 	RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error)
 	MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error)
+	// ENOTSUP if the backend can't tell cheaply
+	GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error)
 }
 
 var SmallActionsGate = Ticket{Total: 100}.Init()
@@ -269,6 +577,24 @@ func (p sortBlobItemOutput) Swap(i, j int) {
 	p[i], p[j] = p[j], p[i]
 }
 
+// by key, and newest version first for the same key
+type sortBlobVersionOutput []BlobVersionOutput
+
+func (p sortBlobVersionOutput) Len() int {
+	return len(p)
+}
+
+func (p sortBlobVersionOutput) Less(i, j int) bool {
+	if *p[i].Key != *p[j].Key {
+		return *p[i].Key < *p[j].Key
+	}
+	return p[i].LastModified.After(*p[j].LastModified)
+}
+
+func (p sortBlobVersionOutput) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
 func (b BlobItemOutput) String() string {
 	return fmt.Sprintf("%v: %v", *b.Key, b.Size)
 }
@@ -327,6 +653,11 @@ func (s *StorageBackendInitWrapper) ListBlobs(param *ListBlobsInput) (*ListBlobs
 	return s.StorageBackend.ListBlobs(param)
 }
 
+func (s *StorageBackendInitWrapper) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	s.Init("")
+	return s.StorageBackend.ListBlobVersions(param)
+}
+
 func (s *StorageBackendInitWrapper) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	s.Init("")
 	return s.StorageBackend.DeleteBlob(param)
@@ -382,6 +713,11 @@ func (s *StorageBackendInitWrapper) MultipartExpire(param *MultipartExpireInput)
 	return s.StorageBackend.MultipartExpire(param)
 }
 
+func (s *StorageBackendInitWrapper) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	s.Init("")
+	return s.StorageBackend.AppendBlob(param)
+}
+
 func (s *StorageBackendInitWrapper) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
 	s.Init("")
 	return s.StorageBackend.RemoveBucket(param)
@@ -392,6 +728,11 @@ func (s *StorageBackendInitWrapper) MakeBucket(param *MakeBucketInput) (*MakeBuc
 	return s.StorageBackend.MakeBucket(param)
 }
 
+func (s *StorageBackendInitWrapper) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	s.Init("")
+	return s.StorageBackend.GetBucketUsage(param)
+}
+
 type StorageBackendInitError struct {
 	error
 }
@@ -440,6 +781,10 @@ func (e StorageBackendInitError) ListBlobs(param *ListBlobsInput) (*ListBlobsOut
 	}
 }
 
+func (e StorageBackendInitError) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, e
+}
+
 func (e StorageBackendInitError) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	return nil, e
 }
@@ -499,6 +844,10 @@ func (e StorageBackendInitError) MultipartExpire(param *MultipartExpireInput) (*
 	return nil, e
 }
 
+func (e StorageBackendInitError) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return nil, e
+}
+
 func (e StorageBackendInitError) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
 	return nil, e
 }
@@ -506,3 +855,7 @@ func (e StorageBackendInitError) RemoveBucket(param *RemoveBucketInput) (*Remove
 func (e StorageBackendInitError) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
 	return nil, e
 }
+
+func (e StorageBackendInitError) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	return nil, e
+}
@@ -20,11 +20,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -39,7 +43,9 @@ import (
 type ADLv1 struct {
 	cap Capabilities
 
-	flags  *FlagStorage
+	flags *FlagStorage
+	errorMap
+	opTimeout
 	config *ADLv1Config
 
 	client  *adl.Client
@@ -50,6 +56,8 @@ type ADLv1 struct {
 	// but that seems more involved. This bucket is more like a
 	// backend level prefix mostly to ease testing
 	bucket string
+	// what an append that was too large is split into
+	appendChunk uint64
 }
 
 type ADLv1Err struct {
@@ -78,14 +86,36 @@ func IsADLv1Endpoint(endpoint string) bool {
 	//return strings.HasSuffix(endpoint, ".azuredatalakestore.net")
 }
 
-func adlLogResp(level logrus.Level, r *http.Response) {
-	if adls1Log.IsLevelEnabled(level) {
+// adlLogger is what an ADL mount logs its requests to. With
+// --debug_adl it's one of its own at debug level, so that the other
+// mounts of the process aren't changed
+func adlLogger(shared *LogHandle, name string, flags *FlagStorage) *LogHandle {
+	if !flags.DebugADL {
+		return shared
+	}
+	l := NewLogger(name)
+	l.Level = logrus.DebugLevel
+	return l
+}
+
+func adlLogResp(logger *LogHandle, level logrus.Level, r *http.Response) {
+	if logger.IsLevelEnabled(level) {
 		op := r.Request.URL.Query().Get("op")
 		requestId := r.Request.Header.Get(ADL1_REQUEST_ID)
 		respId := r.Header.Get(ADL1_REQUEST_ID)
-		adls1Log.Logf(level, "%v %v %v %v %v", op, r.Request.URL.String(),
-			requestId, r.Status, respId)
+		logger.WithFields(TraceFields(r)).Logf(level, "%v %v %v %v %v",
+			op, r.Request.URL.String(), requestId, r.Status, respId)
+	}
+}
+
+// adlTransport is the transport for ADLv1 and ADLv2 requests, which
+// sends ones that were unauthorized again with --credentials-command
+func adlTransport(flags *FlagStorage, auth autorest.Authorizer) http.RoundTripper {
+	transport := GetHTTPTransport(flags)
+	if cmd, ok := auth.(*CommandAuthorizer); ok {
+		transport = cmd.Transport(transport)
 	}
+	return transport
 }
 
 func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, error) {
@@ -93,6 +123,11 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("Invalid endpoint: %v", config.Endpoint)
 	}
+	// the directory everything is under, it can be more than one
+	// level deep
+	bucket = strings.TrimSuffix(normalizePrefix(bucket), "/")
+
+	logger := adlLogger(adls1Log, "adlv1", flags)
 
 	LogRequest := func(p autorest.Preparer) autorest.Preparer {
 		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
@@ -111,11 +146,14 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 
 			u, _ := uuid.NewV4()
 			r.Header.Add(ADL1_REQUEST_ID, u.String())
+			setRequestHeaders(r.Header, flags.RequestHeaders)
+			r = TraceRequest(r)
 
-			if adls1Log.IsLevelEnabled(logrus.DebugLevel) {
+			if logger.IsLevelEnabled(logrus.DebugLevel) {
 				op := r.URL.Query().Get("op")
 				requestId := r.Header.Get(ADL1_REQUEST_ID)
-				adls1Log.Debugf("%v %v %v", op, r.URL.String(), requestId)
+				logger.WithFields(RequestTraceFields(r)).Debugf("%v %v %v",
+					op, r.URL.String(), requestId)
 			}
 
 			r, err := p.Prepare(r)
@@ -128,7 +166,9 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 
 	LogResponse := func(p autorest.Responder) autorest.Responder {
 		return autorest.ResponderFunc(func(r *http.Response) error {
-			adlLogResp(logrus.DebugLevel, r)
+			adlLogResp(logger, logrus.DebugLevel, r)
+			noteFailedRequest(logger, "adl", r.Request.URL.Query().Get("op"), r,
+				r.Request.Header.Get(ADL1_REQUEST_ID), r.Header.Get(ADL1_REQUEST_ID))
 			err := p.Respond(r)
 			if err != nil {
 				log.Error(err)
@@ -142,18 +182,32 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 	adlClient.BaseClient.Client.RequestInspector = LogRequest
 	adlClient.BaseClient.Client.ResponseInspector = LogResponse
 	adlClient.BaseClient.AdlsFileSystemDNSSuffix = parts[1]
-	adlClient.BaseClient.Sender.(*http.Client).Transport = GetHTTPTransport()
+	adlClient.BaseClient.Sender.(*http.Client).Transport = adlTransport(flags, config.Authorizer)
+	adlClient.BaseClient.Sender.(*http.Client).Timeout = flags.HTTPTimeout
+
+	appendChunk := flags.ADLv1AppendChunk
+	if appendChunk == 0 {
+		appendChunk = ADLV1_MAX_APPEND
+	}
 
 	b := &ADLv1{
-		flags:   flags,
-		config:  config,
-		client:  &adlClient,
-		account: parts[0],
-		bucket:  bucket,
+		flags:       flags,
+		errorMap:    errorMap(flags.ErrorMap),
+		opTimeout:   opTimeout(flags.OpTimeout),
+		config:      config,
+		client:      &adlClient,
+		account:     parts[0],
+		bucket:      bucket,
+		appendChunk: appendChunk,
 		cap: Capabilities{
 			NoParallelMultipart: true,
 			DirBlob:             true,
 			Name:                "adl",
+			NoMetadata:          true,
+			AnyPartSize:         true,
+			SupportsAppend:      true,
+			MaxMultipartSize:    ADLV1_MAX_PART_SIZE,
+			ConditionalCreate:   true,
 		},
 	}
 
@@ -164,9 +218,25 @@ func (b *ADLv1) Bucket() string {
 	return b.bucket
 }
 
-func mapADLv1Error(resp *http.Response, err error, rawError bool) error {
+// ObjectLocation has the key with the directory that's our bucket
+func (b *ADLv1) ObjectLocation(key string) objectLocation {
+	path := b.path(key)
+	if strings.HasSuffix(key, "/") {
+		path += "/"
+	}
+	return objectLocation{
+		Endpoint: "https://" + b.config.Endpoint,
+		Key:      path,
+		URL:      "adl://" + b.config.Endpoint + "/" + path,
+	}
+}
+
+func (m errorMap) mapADLv1Error(resp *http.Response, err error, rawError bool) error {
 	if resp == nil {
-		if err != nil {
+		if _, ok := err.(syscall.Errno); ok {
+			// nothing was sent, we already know why
+			return err
+		} else if err != nil {
 			return syscall.EAGAIN
 		} else {
 			return err
@@ -188,11 +258,11 @@ func mapADLv1Error(resp *http.Response, err error, rawError bool) error {
 				return syscall.EAGAIN
 			}
 		} else {
-			err = mapHttpError(resp.StatusCode)
+			err = m.mapHttpError(resp.StatusCode)
 			if err != nil {
 				return err
 			} else {
-				adlLogResp(logrus.ErrorLevel, resp)
+				adlLogResp(adls1Log, logrus.ErrorLevel, resp)
 				return syscall.EINVAL
 			}
 		}
@@ -213,8 +283,14 @@ func (b *ADLv1) path(key string) string {
 }
 
 func (b *ADLv1) Init(key string) error {
-	res, err := b.client.GetFileStatus(context.TODO(), b.account, b.path(key), nil)
-	err = mapADLv1Error(res.Response.Response, err, true)
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.GetFileStatus(ctx, b.account, b.path(key), nil)
+	initErr := adlInitError(b.cap.Name, b.account, b.path(key), res.Response.Response, err)
+	if initErr != nil {
+		return initErr
+	}
+	err = b.mapADLv1Error(res.Response.Response, err, true)
 	if adlErr, ok := err.(ADLv1Err); ok {
 		if adlErr.RemoteException.Exception == "FileNotFoundException" {
 			return nil
@@ -232,172 +308,252 @@ func adlv1LastModified(t int64) time.Time {
 }
 
 func adlv1FileStatus2BlobItem(f *adl.FileStatusProperties, key *string) BlobItemOutput {
-	return BlobItemOutput{
+	item := BlobItemOutput{
 		Key:          key,
 		LastModified: PTime(adlv1LastModified(*f.ModificationTime)),
 		Size:         uint64(*f.Length),
 	}
+	if f.AccessTime != nil {
+		item.Atime = PTime(adlv1LastModified(*f.AccessTime))
+	}
+	return item
 }
 
 func (b *ADLv1) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
-	res, err := b.client.GetFileStatus(context.TODO(), b.account, b.path(param.Key), nil)
-	err = mapADLv1Error(res.Response.Response, err, false)
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.GetFileStatus(ctx, b.account, b.path(param.Key), nil)
+	err = b.mapADLv1Error(res.Response.Response, err, false)
 	if err != nil {
 		return nil, err
 	}
 
+	isDir := res.FileStatus.Type == "DIRECTORY"
+
+	// there's no metadata, but the permissions are read back
+	// like the mode metadata is elsewhere
+	var meta map[string]*string
+	if b.flags.PermMetadata && res.FileStatus.Permission != nil {
+		perm, err := strconv.ParseUint(*res.FileStatus.Permission, 8, 32)
+		if err == nil {
+			mode := permModeMetadata(os.FileMode(perm), isDir)
+			meta = map[string]*string{PERM_METADATA_MODE: PString(string(mode))}
+		}
+	}
+
 	return &HeadBlobOutput{
 		BlobItemOutput: adlv1FileStatus2BlobItem(res.FileStatus, &param.Key),
-		IsDirBlob:      res.FileStatus.Type == "DIRECTORY",
+		IsDirBlob:      isDir,
+		Metadata:       meta,
 	}, nil
 
 }
 
-func (b *ADLv1) appendToListResults(path string, recursive bool, startAfter string,
-	maxKeys *uint32, prefixes []BlobPrefixOutput, items []BlobItemOutput) (adl.FileStatusesResult, []BlobPrefixOutput, []BlobItemOutput, error) {
+// SetPermission is chmod, --file-mode and --dir-mode are only what
+// new files and directories get
+func (b *ADLv1) SetPermission(key string, mode os.FileMode) error {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	// in base 10, LogRequest makes it octal like for CREATE
+	res, err := b.client.SetPermission(ctx, b.account, b.path(key),
+		strconv.Itoa(int(mode.Perm())))
+	return b.mapADLv1Error(res.Response, err, false)
+}
+
+// listDir is LISTSTATUS of path, from after listAfter, for
+// appendToListResults
+func (b *ADLv1) listDir(ctx context.Context, path string, listAfter string,
+	listSize *int32) ([]webhdfsFileStatus, error) {
 
-	res, err := b.client.ListFileStatus(context.TODO(), b.account, b.path(path),
-		nil, "", "", nil)
-	err = mapADLv1Error(res.Response.Response, err, false)
+	res, err := b.client.ListFileStatus(ctx, b.account, b.path(path),
+		listSize, listAfter, "", nil)
+	err = b.mapADLv1Error(res.Response.Response, err, false)
 	if err != nil {
-		return adl.FileStatusesResult{}, nil, nil, err
+		return nil, err
 	}
 
-	if path != "" {
-		if len(*res.FileStatuses.FileStatus) == 1 &&
-			*(*res.FileStatuses.FileStatus)[0].PathSuffix == "" {
-			// path is actually a file
-			if !strings.HasSuffix(path, "/") {
-				items = append(items,
-					adlv1FileStatus2BlobItem(&(*res.FileStatuses.FileStatus)[0], &path))
-			}
-			return res, prefixes, items, nil
+	statuses := make([]webhdfsFileStatus, 0, len(*res.FileStatuses.FileStatus))
+	for _, f := range *res.FileStatuses.FileStatus {
+		status := webhdfsFileStatus{
+			PathSuffix:       nilStr(f.PathSuffix),
+			Type:             string(f.Type),
+			Length:           *f.Length,
+			ModificationTime: *f.ModificationTime,
 		}
-
-		if !recursive {
-			if strings.HasSuffix(path, "/") {
-				// we listed for the dir object itself
-				items = append(items, BlobItemOutput{
-					Key: PString(path),
-				})
-			} else {
-				prefixes = append(prefixes, BlobPrefixOutput{
-					PString(path + "/"),
-				})
-			}
+		if f.AccessTime != nil {
+			status.AccessTime = *f.AccessTime
 		}
+		statuses = append(statuses, status)
 	}
+	return statuses, nil
+}
 
-	path = strings.TrimRight(path, "/")
-
-	if maxKeys != nil {
-		*maxKeys -= uint32(len(*res.FileStatuses.FileStatus))
-	}
+func (b *ADLv1) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	return listWebHDFS(ctx, param, b.listDir, -1)
+}
 
-	for _, i := range *res.FileStatuses.FileStatus {
-		key := *i.PathSuffix
-		if path != "" {
-			key = path + "/" + key
+// pageListResults takes what comes after startAfter, up to maxKeys
+// items and prefixes together (0 is no limit), in key order. If there
+// are more, the token for the next page is returned
+func pageListResults(prefixes []BlobPrefixOutput, items []BlobItemOutput,
+	startAfter string, maxKeys uint32) ([]BlobPrefixOutput, []BlobItemOutput, *string) {
+
+	sort.Sort(sortBlobPrefixOutput(prefixes))
+	sort.Sort(sortBlobItemOutput(items))
+
+	var outPrefixes []BlobPrefixOutput
+	var outItems []BlobItemOutput
+	var last string
+	var p, i, n int
+
+	for p < len(prefixes) || i < len(items) {
+		var key string
+		isPrefix := i == len(items) ||
+			(p < len(prefixes) && *prefixes[p].Prefix < *items[i].Key)
+		if isPrefix {
+			key = *prefixes[p].Prefix
+		} else {
+			key = *items[i].Key
 		}
-
-		if i.Type == "DIRECTORY" {
-			if recursive {
-				// we shouldn't generate prefixes if
-				// it's a recursive listing
-				items = append(items,
-					adlv1FileStatus2BlobItem(&i, PString(key+"/")))
-
-				_, prefixes, items, err = b.appendToListResults(key,
-					recursive, "", maxKeys, prefixes, items)
+		if startAfter != "" && key <= startAfter {
+			if isPrefix {
+				p++
 			} else {
-				prefixes = append(prefixes, BlobPrefixOutput{
-					Prefix: PString(key + "/"),
-				})
+				i++
 			}
+			continue
+		}
+		if maxKeys != 0 && uint32(n) == maxKeys {
+			return outPrefixes, outItems, PString(last)
+		}
+
+		if isPrefix {
+			outPrefixes = append(outPrefixes, prefixes[p])
+			p++
 		} else {
-			items = append(items, adlv1FileStatus2BlobItem(&i, &key))
+			outItems = append(outItems, items[i])
+			i++
 		}
+		last = key
+		n++
 	}
 
-	return res, prefixes, items, nil
+	return outPrefixes, outItems, nil
 }
 
-func (b *ADLv1) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
-	var recursive bool
-	if param.Delimiter == nil {
-		// used by tests to cleanup (and also slurping, but
-		// that's only enabled on S3 right now)
-		recursive = true
-		// cannot emulate these
-		if param.ContinuationToken != nil || param.StartAfter != nil {
-			return nil, syscall.ENOTSUP
-		}
-	} else if *param.Delimiter != "/" {
-		return nil, syscall.ENOTSUP
-	}
-	continuationToken := param.ContinuationToken
-	if param.StartAfter != nil {
-		continuationToken = param.StartAfter
-	}
+func (b *ADLv1) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
 
-	_, prefixes, items, err := b.appendToListResults(nilStr(param.Prefix),
-		recursive, nilStr(continuationToken), param.MaxKeys, nil, nil)
-	if err == fuse.ENOENT {
-		err = nil
-	} else if err != nil {
+func (b *ADLv1) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	err := b.delete(param.Context, strings.TrimRight(param.Key, "/"), false)
+	if err != nil {
 		return nil, err
 	}
-
-	return &ListBlobsOutput{
-		Prefixes:    prefixes,
-		Items:       items,
-		IsTruncated: false,
-	}, nil
+	return &DeleteBlobOutput{}, nil
 }
 
-func (b *ADLv1) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
-	res, err := b.client.Delete(context.TODO(), b.account, b.path(strings.TrimRight(param.Key, "/")), PBool(false))
-	err = mapADLv1Error(res.Response.Response, err, false)
+func (b *ADLv1) delete(ctx context.Context, key string, recursive bool) error {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	res, err := b.client.Delete(ctx, b.account, b.path(key), PBool(recursive))
+	err = b.mapADLv1Error(res.Response.Response, err, false)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if !*res.OperationResult {
-		return nil, fuse.ENOENT
+		return fuse.ENOENT
 	}
-	return &DeleteBlobOutput{}, nil
+	return nil
 }
 
-func (b *ADLv1) DeleteBlobs(param *DeleteBlobsInput) (ret *DeleteBlobsOutput, err error) {
-	// if we delete a directory that's not empty, ADLv1 returns
-	// 403. That can happen if we want to delete both "dir1" and
-	// "dir1/file" but delete them in the wrong order for example
-	// sort the blobs so the deepest tree are deleted first to
-	// avoid this problem unfortunately because of this dependency
-	// it's difficult to delete in parallel
-	sort.Slice(param.Items, func(i, j int) bool {
-		depth1 := len(strings.Split(strings.TrimRight(param.Items[i], "/"), "/"))
-		depth2 := len(strings.Split(strings.TrimRight(param.Items[j], "/"), "/"))
-		if depth1 != depth2 {
-			return depth2 < depth1
-		} else {
-			return strings.Compare(param.Items[i], param.Items[j]) < 0
+// adlv1DeleteRoots returns the keys that aren't under another one,
+// and whether anything is under them
+func adlv1DeleteRoots(items []string) map[string]bool {
+	keys := make(map[string]bool, len(items))
+	for _, i := range items {
+		keys[strings.TrimRight(i, "/")] = true
+	}
+
+	roots := make(map[string]bool)
+	for k := range keys {
+		root := k
+		for i := 0; i < len(k); i++ {
+			if k[i] == '/' && keys[k[:i]] {
+				root = k[:i]
+				break
+			}
 		}
-	})
 
-	for _, i := range param.Items {
-		_, err := b.DeleteBlob(&DeleteBlobInput{i})
-		if err != nil {
-			return nil, err
+		if root != k {
+			roots[root] = true
+		} else if _, ok := roots[k]; !ok {
+			roots[k] = false
 		}
+	}
+	return roots
+}
 
+func (b *ADLv1) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	err := deleteRoots(param.Context, param.Items, b.delete)
+	if err != nil {
+		return nil, err
 	}
 	return &DeleteBlobsOutput{}, nil
 }
 
+// deleteRoots deletes items with del, for backends where a directory
+// that isn't empty can't be deleted. If we delete a directory that's
+// not empty, ADLv1 returns 403, so "dir1" can't go before "dir1/file".
+// Instead we delete dir1 recursively, which takes dir1/file with it.
+// That also takes anything under dir1 that we weren't asked to
+// delete, but deleting dir1 would have failed then. What's left don't
+// depend on each other and go in parallel
+func deleteRoots(ctx context.Context, items []string,
+	del func(ctx context.Context, key string, recursive bool) error) (deleteError error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	defer wg.Wait()
+
+	for key, recursive := range adlv1DeleteRoots(items) {
+		SmallActionsGate.Take(1, true)
+		wg.Add(1)
+
+		go func(key string, recursive bool) {
+			defer func() {
+				SmallActionsGate.Return(1)
+				wg.Done()
+			}()
+
+			err := del(ctx, key, recursive)
+			if err != nil {
+				mu.Lock()
+				if deleteError == nil {
+					deleteError = err
+				}
+				mu.Unlock()
+			}
+		}(key, recursive)
+
+		mu.Lock()
+		failed := deleteError != nil
+		mu.Unlock()
+		if failed {
+			return
+		}
+	}
+
+	return
+}
+
 func (b *ADLv1) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
-	r, err := b.client.RenamePreparer(context.TODO(), b.account, b.path(param.Source),
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	r, err := b.client.RenamePreparer(ctx, b.account, b.path(param.Source),
 		b.path(param.Destination))
-	err = mapADLv1Error(nil, err, false)
+	err = b.mapADLv1Error(nil, err, false)
 	if err != nil {
 		return nil, err
 	}
@@ -407,13 +563,13 @@ func (b *ADLv1) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
 	r.URL.RawQuery = params.Encode()
 
 	resp, err := b.client.RenameSender(r)
-	err = mapADLv1Error(resp, err, false)
+	err = b.mapADLv1Error(resp, err, false)
 	if err != nil {
 		return nil, err
 	}
 
 	res, err := b.client.RenameResponder(resp)
-	err = mapADLv1Error(resp, err, false)
+	err = b.mapADLv1Error(resp, err, false)
 	if err != nil {
 		return nil, err
 	}
@@ -433,8 +589,76 @@ func (b *ADLv1) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
 	return &RenameBlobOutput{}, nil
 }
 
+// APPEND is documented to take this much. Bigger ones usually work
+// but may return 404
+const ADLV1_MAX_APPEND = 4 * 1024 * 1024
+
+// CopyBlob reads the source and appends it to a temporary file next
+// to the destination, which is then renamed over it, so the
+// destination is never half written. If we crash in the middle the
+// temporary file is left behind. ADLv1 doesn't have metadata, so
+// Metadata and StorageClass are ignored
 func (b *ADLv1) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
-	return nil, syscall.ENOTSUP
+	chunk := b.appendChunk
+	if param.Size != nil && *param.Size < chunk {
+		chunk = MaxUInt64(*param.Size, 1)
+	}
+
+	src, err := b.GetBlob(&GetBlobInput{Key: param.Source})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+
+	tmp := param.Destination + ".goofys-copy-" + RandStringBytesMaskImprSrc(8)
+	mpu, err := b.MultipartBlobBegin(&MultipartBlobBeginInput{Key: tmp})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.copyParts(mpu, src.Body, chunk)
+	if err == nil {
+		_, err = b.MultipartBlobCommit(mpu)
+	} else {
+		b.MultipartBlobAbort(mpu)
+	}
+	if err == nil {
+		_, err = b.RenameBlob(&RenameBlobInput{
+			Source:      tmp,
+			Destination: param.Destination,
+		})
+	}
+	if err != nil {
+		b.DeleteBlob(&DeleteBlobInput{Key: tmp})
+		return nil, err
+	}
+
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *ADLv1) copyParts(mpu *MultipartBlobCommitInput, body io.Reader, chunk uint64) error {
+	buf := make([]byte, chunk)
+	for part := uint32(1); ; part++ {
+		n, err := io.ReadFull(body, buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		_, err = b.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     mpu,
+			PartNumber: part,
+			Body:       bytes.NewReader(buf[:n]),
+			Size:       uint64(n),
+		})
+		if err != nil {
+			return err
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
 }
 
 func (b *ADLv1) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
@@ -459,10 +683,12 @@ func (b *ADLv1) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		filesessionid = &u
 	}
 
-	resp, err := b.client.Open(context.TODO(), b.account, b.path(param.Key), length, offset,
+	ctx, cancel := b.requestContext(param.Context)
+	resp, err := b.client.Open(ctx, b.account, b.path(param.Key), length, offset,
 		filesessionid)
-	err = mapADLv1Error(resp.Response.Response, err, false)
+	err = b.mapADLv1Error(resp.Response.Response, err, false)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 	if resp.Value != nil {
@@ -490,7 +716,7 @@ func (b *ADLv1) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 			ContentType: contentType,
 			IsDirBlob:   false,
 		},
-		Body: *resp.Value,
+		Body: cancelOnClose{*resp.Value, cancel},
 	}
 	resp.Value = nil
 
@@ -504,10 +730,7 @@ func (b *ADLv1) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 			return nil, err
 		}
 	} else {
-		res, err := b.client.Create(context.TODO(), b.account, b.path(param.Key),
-			&ReadSeekerCloser{param.Body}, PBool(true), adl.CLOSE, nil,
-			PInt32(int32(b.flags.FileMode)))
-		err = mapADLv1Error(res.Response, err, false)
+		err := b.create(param.Context, param.Key, param.Body, adl.CLOSE, nil, param.IfNotExists)
 		if err != nil {
 			return nil, err
 		}
@@ -516,6 +739,25 @@ func (b *ADLv1) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	return &PutBlobOutput{}, nil
 }
 
+// create is CREATE, which overwrites unless ifNotExists. Then the
+// file being there already is EBUSY
+func (b *ADLv1) create(ctx context.Context, key string, body io.ReadSeeker, syncFlag adl.SyncFlag,
+	leaseId *uuid.UUID, ifNotExists bool) error {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	res, err := b.client.Create(ctx, b.account, b.path(key),
+		&ReadSeekerCloser{body}, PBool(!ifNotExists), syncFlag, leaseId,
+		PInt32(int32(b.flags.FileMode)))
+	err = b.mapADLv1Error(res.Response, err, ifNotExists)
+	if adlErr, ok := err.(ADLv1Err); ok {
+		if adlErr.RemoteException.Exception == "FileAlreadyExistsException" {
+			return syscall.EBUSY
+		}
+		err = b.mapADLv1Error(adlErr.resp, err, false)
+	}
+	return err
+}
+
 func (b *ADLv1) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
 	// ADLv1 doesn't have the concept of atomic replacement which
 	// means that when we replace an object, readers may see
@@ -529,10 +771,8 @@ func (b *ADLv1) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 		return nil, err
 	}
 
-	res, err := b.client.Create(context.TODO(), b.account, b.path(param.Key),
-		&ReadSeekerCloser{bytes.NewReader([]byte(""))}, PBool(true), adl.DATA, &leaseId,
-		PInt32(int32(b.flags.FileMode)))
-	err = mapADLv1Error(res.Response, err, false)
+	err = b.create(param.Context, param.Key, bytes.NewReader([]byte("")), adl.DATA, &leaseId,
+		param.IfNotExists)
 	if err != nil {
 		return nil, err
 	}
@@ -544,16 +784,22 @@ func (b *ADLv1) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 	}, nil
 }
 
+// errADLv1AppendTooLarge is returned by uploadPart if the append may
+// have been rejected because of its size
+var errADLv1AppendTooLarge = errors.New("append too large")
+
 func (b *ADLv1) uploadPart(param *MultipartBlobAddInput, offset uint64) error {
 	leaseId, err := uuid.FromString(*param.Commit.UploadId)
 	if err != nil {
 		return err
 	}
 
-	res, err := b.client.Append(context.TODO(), b.account, *param.Commit.Key,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Append(ctx, b.account, *param.Commit.Key,
 		&ReadSeekerCloser{param.Body}, PInt64(int64(offset-param.Size)), adl.DATA,
 		&leaseId, &leaseId)
-	err = mapADLv1Error(res.Response, err, true)
+	err = b.mapADLv1Error(res.Response, err, true)
 	if err != nil {
 		if adlErr, ok := err.(ADLv1Err); ok {
 			if adlErr.resp.StatusCode == 404 {
@@ -565,6 +811,9 @@ func (b *ADLv1) uploadPart(param *MultipartBlobAddInput, offset uint64) error {
 				// created. The behavior is odd: seems
 				// like the first stream will error
 				// but the latter stream works fine
+				if param.Size > b.appendChunk {
+					return errADLv1AppendTooLarge
+				}
 				err = fuse.EINVAL
 				return err
 			} else if adlErr.resp.StatusCode == 400 &&
@@ -574,7 +823,7 @@ func (b *ADLv1) uploadPart(param *MultipartBlobAddInput, offset uint64) error {
 					return nil
 				}
 			}
-			err = mapADLv1Error(adlErr.resp, err, false)
+			err = b.mapADLv1Error(adlErr.resp, err, false)
 		}
 	}
 	return err
@@ -585,10 +834,12 @@ func (b *ADLv1) detectTransientError(param *MultipartBlobAddInput, offset uint64
 	if err != nil {
 		return err
 	}
-	res, err := b.client.Append(context.TODO(), b.account, *param.Commit.Key,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Append(ctx, b.account, *param.Commit.Key,
 		&ReadSeekerCloser{bytes.NewReader([]byte(""))},
 		PInt64(int64(offset)), adl.CLOSE, &leaseId, &leaseId)
-	err = mapADLv1Error(res.Response, err, false)
+	err = b.mapADLv1Error(res.Response, err, false)
 	return err
 }
 
@@ -603,8 +854,15 @@ func (b *ADLv1) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAd
 		panic("Incorrect commit data type")
 	}
 
-	commitData.Size += param.Size
-	err := b.uploadPart(param, commitData.Size)
+	offset := commitData.Size + param.Size
+	err := b.uploadPart(param, offset)
+	if err == errADLv1AppendTooLarge {
+		adls1Log.Infof("append of %v bytes to %v was rejected, retrying in %v byte pieces",
+			param.Size, *param.Commit.Key, b.appendChunk)
+		err = b.uploadPieces(param, commitData)
+	} else if err == nil {
+		commitData.Size = offset
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -612,6 +870,42 @@ func (b *ADLv1) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAd
 	return &MultipartBlobAddOutput{}, nil
 }
 
+// uploadPieces appends param.Body in pieces of appendChunk. Each one
+// is tried once, so a 404 this time isn't because of the size.
+// commitData.Size is moved past every piece that made it, so it
+// stays where the file really ends even if one fails
+func (b *ADLv1) uploadPieces(param *MultipartBlobAddInput,
+	commitData *ADLv1MultipartBlobCommitInput) error {
+
+	_, err := param.Body.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, MinUInt64(b.appendChunk, param.Size))
+	for left := param.Size; left > 0; {
+		n := MinUInt64(left, uint64(len(buf)))
+		_, err = io.ReadFull(param.Body, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		offset := commitData.Size + n
+		err = b.uploadPart(&MultipartBlobAddInput{
+			Commit:     param.Commit,
+			PartNumber: param.PartNumber,
+			Body:       bytes.NewReader(buf[:n]),
+			Size:       n,
+		}, offset)
+		if err != nil {
+			return err
+		}
+		commitData.Size = offset
+		left -= n
+	}
+	return nil
+}
+
 func (b *ADLv1) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
 	// there's no such thing as abort, but at least we should release the lease
 	// which technically is more like a commit than abort
@@ -619,9 +913,11 @@ func (b *ADLv1) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartB
 	if err != nil {
 		return nil, err
 	}
-	res, err := b.client.Append(context.TODO(), b.account, *param.Key,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Append(ctx, b.account, *param.Key,
 		&ReadSeekerCloser{bytes.NewReader([]byte(""))}, nil, adl.CLOSE, &leaseId, &leaseId)
-	err = mapADLv1Error(res.Response, err, false)
+	err = b.mapADLv1Error(res.Response, err, false)
 	if err != nil {
 		return nil, err
 	}
@@ -640,16 +936,25 @@ func (b *ADLv1) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multipart
 	if err != nil {
 		return nil, err
 	}
-	res, err := b.client.Append(context.TODO(), b.account, *param.Key,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Append(ctx, b.account, *param.Key,
 		&ReadSeekerCloser{bytes.NewReader([]byte(""))}, PInt64(int64(commitData.Size)),
 		adl.CLOSE, &leaseId, &leaseId)
-	err = mapADLv1Error(res.Response, err, false)
+	err = b.mapADLv1Error(res.Response, err, false)
 	if err == fuse.ENOENT {
 		// either the blob was concurrently deleted or we got
 		// another CREATE which broke our lease. Either way
 		// technically we did finish uploading data so swallow
-		// the error
-		err = nil
+		// the error, unless someone else winning is what we
+		// are asked to look out for
+		if b.flags.FailOnConflict {
+			adls1Log.Warnf("lost the lease on %v, someone else replaced "+
+				"or deleted it", *param.Key)
+			err = syscall.ESTALE
+		} else {
+			err = nil
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -662,13 +967,34 @@ func (b *ADLv1) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOu
 	return nil, syscall.ENOTSUP
 }
 
+// AppendBlob is MultipartBlobBegin without the CREATE that empties the
+// file. The APPENDs say where they expect the file to end, so if
+// someone else wrote to it since the upload fails instead of mixing
+// their data with ours
+func (b *ADLv1) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	leaseId, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartBlobCommitInput{
+		Key:      PString(b.path(param.Key)),
+		UploadId: PString(leaseId.String()),
+		backendData: &ADLv1MultipartBlobCommitInput{
+			Size: param.Offset,
+		},
+	}, nil
+}
+
 func (b *ADLv1) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
 	if b.bucket == "" {
 		return nil, fuse.EINVAL
 	}
 
-	res, err := b.client.Delete(context.TODO(), b.account, b.path(""), PBool(false))
-	err = mapADLv1Error(res.Response.Response, err, false)
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.Delete(ctx, b.account, b.path(""), PBool(false))
+	err = b.mapADLv1Error(res.Response.Response, err, false)
 	if err != nil {
 		return nil, err
 	}
@@ -692,10 +1018,41 @@ func (b *ADLv1) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
 	return &MakeBucketOutput{}, nil
 }
 
+func (b *ADLv1) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.GetContentSummary(ctx, b.account, b.path(""))
+	err = b.mapADLv1Error(res.Response.Response, err, false)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := res.ContentSummary
+	if summary == nil {
+		return nil, syscall.EIO
+	}
+	out := &GetBucketUsageOutput{}
+	// includes the replicas
+	if summary.SpaceConsumed != nil {
+		out.Bytes = uint64(*summary.SpaceConsumed)
+	} else if summary.Length != nil {
+		out.Bytes = uint64(*summary.Length)
+	}
+	if summary.FileCount != nil {
+		out.Objects += uint64(*summary.FileCount)
+	}
+	if summary.DirectoryCount != nil {
+		out.Objects += uint64(*summary.DirectoryCount)
+	}
+	return out, nil
+}
+
 func (b *ADLv1) mkdir(dir string) error {
-	res, err := b.client.Mkdirs(context.TODO(), b.account, b.path(dir),
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.Mkdirs(ctx, b.account, b.path(dir),
 		PInt32(int32(b.flags.DirMode)))
-	err = mapADLv1Error(res.Response.Response, err, true)
+	err = b.mapADLv1Error(res.Response.Response, err, true)
 	if err != nil {
 		return err
 	}
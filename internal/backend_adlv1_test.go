@@ -0,0 +1,274 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+// handlerTransport sends requests to a handler instead of the network
+type handlerTransport struct {
+	http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, r)
+	resp := w.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+type ADLv1Test struct {
+	adl *ADLv1
+
+	mu sync.Mutex
+	// appends bigger than this get 404
+	maxAppend int
+	size      int
+	// offset and size of each append that was taken
+	appends [][2]int
+	// CREATE without overwrite fails
+	exists bool
+	// the lease was broken, the final append fails
+	leaseLost bool
+	// GETFILESTATUS answers with this, instead of not found
+	statusCode int
+}
+
+var _ = Suite(&ADLv1Test{})
+
+func (s *ADLv1Test) SetUpTest(t *C) {
+	s.maxAppend = 1024 * 1024
+	s.size = 0
+	s.appends = nil
+	s.exists = false
+	s.leaseLost = false
+	s.statusCode = 0
+
+	var err error
+	s.adl, err = NewADLv1("bucket", &FlagStorage{ADLv1AppendChunk: 256 * 1024},
+		&ADLv1Config{Endpoint: "account.azuredatalakestore.net"})
+	t.Assert(err, IsNil)
+	s.adl.client.Sender.(*http.Client).Transport = handlerTransport{
+		http.HandlerFunc(s.serve),
+	}
+}
+
+func (s *ADLv1Test) serve(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	// there's none on a client request without one
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch q.Get("op") {
+	case "GETFILESTATUS":
+		if s.statusCode != 0 {
+			w.WriteHeader(s.statusCode)
+			io.WriteString(w, `{"RemoteException":{"exception":"AccessControlException"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"RemoteException":{"exception":"FileNotFoundException"}}`)
+	case "CREATE":
+		if s.exists && q.Get("overwrite") == "false" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"RemoteException":{"exception":"FileAlreadyExistsException"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "APPEND":
+		if s.leaseLost && q.Get("syncFlag") == "CLOSE" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"RemoteException":{"exception":"FileNotFoundException"}}`)
+			return
+		}
+		if len(body) > s.maxAppend {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"RemoteException":{"exception":"FileNotFoundException"}}`)
+			return
+		}
+		if q.Get("offset") != "" {
+			offset, _ := strconv.Atoi(q.Get("offset"))
+			if offset != s.size {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"RemoteException":{"exception":"BadOffsetException"}}`)
+				return
+			}
+			s.appends = append(s.appends, [2]int{offset, len(body)})
+		}
+		s.size += len(body)
+	}
+}
+
+func (s *ADLv1Test) add(mpu *MultipartBlobCommitInput, size int) error {
+	_, err := s.adl.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit: mpu,
+		Body:   bytes.NewReader(make([]byte, size)),
+		Size:   uint64(size),
+	})
+	return err
+}
+
+func (s *ADLv1Test) TestSplitAppend(t *C) {
+	mpu, err := s.adl.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "file"})
+	t.Assert(err, IsNil)
+	commitData := mpu.backendData.(*ADLv1MultipartBlobCommitInput)
+
+	s.maxAppend = 512 * 1024
+	t.Assert(s.add(mpu, 100*1024), IsNil)
+	// too big, retried in 256KB pieces
+	t.Assert(s.add(mpu, 600*1024+100), IsNil)
+	t.Assert(s.add(mpu, 100), IsNil)
+
+	t.Assert(s.appends, DeepEquals, [][2]int{
+		{0, 100 * 1024},
+		{100 * 1024, 256 * 1024},
+		{356 * 1024, 256 * 1024},
+		{612 * 1024, 88*1024 + 100},
+		{700*1024 + 100, 100},
+	})
+	t.Assert(commitData.Size, Equals, uint64(s.size))
+}
+
+func (s *ADLv1Test) TestSmallAppendRejected(t *C) {
+	mpu, err := s.adl.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "file"})
+	t.Assert(err, IsNil)
+	commitData := mpu.backendData.(*ADLv1MultipartBlobCommitInput)
+
+	t.Assert(s.add(mpu, 1024), IsNil)
+	// not because of the size, so there's nothing to split
+	s.maxAppend = 0
+	t.Assert(s.add(mpu, 1024), Equals, fuse.EINVAL)
+	t.Assert(commitData.Size, Equals, uint64(1024))
+
+	// the pieces are only tried once
+	s.maxAppend = 100 * 1024
+	t.Assert(s.add(mpu, 600*1024), Equals, fuse.EINVAL)
+	t.Assert(commitData.Size, Equals, uint64(1024))
+}
+
+func (s *ADLv1Test) TestPartSize(t *C) {
+	fh := newTestFileHandle(s.adl)
+	t.Assert(fh.partSize(), Equals, uint64(ADLV1_MAX_PART_SIZE))
+
+	fh.inode.fs.flags.PartSize = 100 * 1024 * 1024
+	t.Assert(fh.partSize(), Equals, uint64(ADLV1_MAX_PART_SIZE))
+	// it takes parts of any size
+	fh.inode.fs.flags.WriteBufferSize = 1024 * 1024
+	t.Assert(fh.partSize(), Equals, uint64(1024*1024))
+}
+
+func (s *ADLv1Test) TestCreateConflict(t *C) {
+	s.exists = true
+
+	_, err := s.adl.PutBlob(&PutBlobInput{
+		Key:         "file",
+		Body:        bytes.NewReader([]byte("data")),
+		IfNotExists: true,
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+	_, err = s.adl.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:         "file",
+		IfNotExists: true,
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	// overwriting it is still fine
+	_, err = s.adl.PutBlob(&PutBlobInput{
+		Key:  "file",
+		Body: bytes.NewReader([]byte("data")),
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *ADLv1Test) TestLeaseLost(t *C) {
+	commit := func() error {
+		s.size = 0
+		mpu, err := s.adl.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "file"})
+		t.Assert(err, IsNil)
+		t.Assert(s.add(mpu, 1024), IsNil)
+		_, err = s.adl.MultipartBlobCommit(mpu)
+		return err
+	}
+
+	s.leaseLost = true
+	// someone else's CREATE won, we don't mind unless asked to
+	t.Assert(commit(), IsNil)
+	s.adl.flags.FailOnConflict = true
+	t.Assert(commit(), Equals, syscall.ESTALE)
+}
+
+func (s *ADLv1Test) TestInitError(t *C) {
+	t.Assert(s.adl.Init("prefix/random"), IsNil)
+
+	s.statusCode = http.StatusUnauthorized
+	err := s.adl.Init("prefix/random")
+	initErr, ok := err.(BackendInitError)
+	t.Assert(ok, Equals, true)
+	t.Assert(initErr.Account, Equals, "account")
+	t.Assert(initErr.Path, Equals, "/bucket/prefix")
+	t.Assert(err, ErrorMatches, `adl account "account", path /bucket/prefix: authentication failed.*`)
+
+	s.statusCode = http.StatusForbidden
+	err = s.adl.Init("prefix/random")
+	t.Assert(err, ErrorMatches, `.*: permission denied.*`)
+
+	// the rest are as before
+	s.statusCode = http.StatusBadRequest
+	err = s.adl.Init("prefix/random")
+	_, ok = err.(BackendInitError)
+	t.Assert(ok, Equals, false)
+}
+
+func (s *ADLv1Test) TestInitErrorDNS(t *C) {
+	err := autorest.DetailedError{
+		Original: &url.Error{
+			Op:  "Get",
+			URL: "https://acount.azuredatalakestore.net/webhdfs/v1/",
+			Err: &net.OpError{
+				Op:  "dial",
+				Err: &net.DNSError{Name: "acount.azuredatalakestore.net"},
+			},
+		},
+	}
+	initErr := adlInitError("adl", "acount", "random", nil, err)
+	t.Assert(initErr, ErrorMatches,
+		`adl account "acount", path /: cannot resolve acount.azuredatalakestore.net.*`)
+
+	// timeouts and such are left alone
+	t.Assert(adlInitError("adl", "account", "random", nil,
+		&url.Error{Err: syscall.ETIMEDOUT}), IsNil)
+}
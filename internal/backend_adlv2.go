@@ -25,6 +25,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -44,11 +45,16 @@ import (
 type ADLv2 struct {
 	cap Capabilities
 
-	flags  *FlagStorage
+	flags *FlagStorage
+	errorMap
+	opTimeout
 	config *ADLv2Config
 
 	client adl2PathClient
 	bucket string
+
+	// the storage account, for error messages
+	account string
 }
 
 const ADL2_CLIENT_REQUEST_ID = "X-Ms-Client-Request-Id"
@@ -66,18 +72,19 @@ func IsADLv2Endpoint(endpoint string) bool {
 	return strings.HasPrefix(endpoint, "abfs://")
 }
 
-func adl2LogResp(level logrus.Level, r *http.Response) {
+func adl2LogResp(logger *LogHandle, level logrus.Level, r *http.Response) {
 	if r == nil {
 		return
 	}
 
-	if adl2Log.IsLevelEnabled(level) {
+	if logger.IsLevelEnabled(level) {
 		requestId := r.Request.Header.Get(ADL2_CLIENT_REQUEST_ID)
 		respId := r.Header.Get(ADL2_REQUEST_ID)
 		// don't log anything if this is being called twice,
 		// which it is via ResponseInspector
 		if respId != "" {
-			adl2Log.Logf(level, "%v %v %v %v %v", r.Request.Method,
+			logger.WithFields(TraceFields(r)).Logf(level,
+				"%v %v %v %v %v", r.Request.Method,
 				r.Request.URL.String(),
 				requestId, r.Status, respId)
 			r.Header.Del(ADL2_REQUEST_ID)
@@ -98,6 +105,8 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 	storageAccountName := parts[0]
 	dnsSuffix := parts[1]
 
+	logger := adlLogger(adl2Log, "adlv2", flags)
+
 	LogRequest := func(p autorest.Preparer) autorest.Preparer {
 		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
 			r.URL.Scheme = u.Scheme
@@ -107,6 +116,8 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 			r.Header.Set("X-Ms-Date", date)
 			r.Header.Set("X-Ms-Version", "2018-11-09")
 			r.Header.Set(ADL2_CLIENT_REQUEST_ID, uuid.New().String())
+			setRequestHeaders(r.Header, flags.RequestHeaders)
+			r = TraceRequest(r)
 			r.Header.Set("Accept-Charset", "utf-8")
 			r.Header.Set("Content-Type", "")
 			r.Header.Set("Accept", "application/json, application/octet-stream")
@@ -123,7 +134,7 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 				r.Body = http.NoBody
 			}
 
-			if adl2Log.IsLevelEnabled(logrus.DebugLevel) {
+			if logger.IsLevelEnabled(logrus.DebugLevel) {
 				requestId := r.Header.Get(ADL2_CLIENT_REQUEST_ID)
 				op := r.Method
 				switch op {
@@ -141,8 +152,8 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 						op += fmt.Sprintf("(%v)", r.ContentLength)
 					}
 				}
-				adl2Log.Debugf("%v %v %v", op,
-					r.URL.String(), requestId)
+				logger.WithFields(RequestTraceFields(r)).Debugf("%v %v %v",
+					op, r.URL.String(), requestId)
 			}
 
 			r, err := p.Prepare(r)
@@ -155,7 +166,18 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 
 	LogResponse := func(p autorest.Responder) autorest.Responder {
 		return autorest.ResponderFunc(func(r *http.Response) error {
-			adl2LogResp(logrus.DebugLevel, r)
+			if r != nil {
+				// before adl2LogResp, which may drop the
+				// request id
+				op := r.Request.Method
+				if action := r.Request.URL.Query().Get("action"); action != "" {
+					op += " " + action
+				}
+				noteFailedRequest(logger, "adl2", op, r,
+					r.Request.Header.Get(ADL2_CLIENT_REQUEST_ID),
+					r.Header.Get(ADL2_REQUEST_ID))
+			}
+			adl2LogResp(logger, logrus.DebugLevel, r)
 			err := p.Respond(r)
 			if err != nil {
 				adl2Log.Error(err)
@@ -168,17 +190,29 @@ func NewADLv2(bucket string, flags *FlagStorage, config *ADLv2Config) (*ADLv2, e
 	client.Authorizer = config.Authorizer
 	client.RequestInspector = LogRequest
 	client.ResponseInspector = LogResponse
-	client.Sender.(*http.Client).Transport = GetHTTPTransport()
+	client.Sender.(*http.Client).Transport = adlTransport(flags, config.Authorizer)
+	client.Sender.(*http.Client).Timeout = flags.HTTPTimeout
 
 	b := &ADLv2{
-		flags:  flags,
-		config: config,
-		client: adl2PathClient{client},
-		bucket: bucket,
+		flags:     flags,
+		errorMap:  errorMap(flags.ErrorMap),
+		opTimeout: opTimeout(flags.OpTimeout),
+		config:    config,
+		client:    adl2PathClient{client},
+		bucket:    bucket,
 		cap: Capabilities{
-			DirBlob: true,
-			Name:    "adl2",
+			DirBlob:           true,
+			Name:              "adl2",
+			ConditionalWrite:  true,
+			ConditionalCreate: true,
+			AnyPartSize:       true,
+			SupportsAppend:    true,
+			// same as blobs
+			MaxKeyLength:     1024,
+			KeyLengthInChars: true,
+			MaxPathDepth:     254,
 		},
+		account: storageAccountName,
 	}
 
 	return b, nil
@@ -188,8 +222,32 @@ func (b *ADLv2) Bucket() string {
 	return b.bucket
 }
 
+func (b *ADLv2) ObjectLocation(key string) objectLocation {
+	endpoint := strings.TrimRight(b.config.Endpoint, "/")
+	return objectLocation{
+		Endpoint: endpoint,
+		Key:      key,
+		URL:      endpoint + "/" + b.bucket + "/" + key,
+	}
+}
+
 func (b *ADLv2) Init(key string) (err error) {
-	_, err = b.HeadBlob(&HeadBlobInput{Key: key})
+	// like HeadBlob, but we want to see how it failed
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.Read(ctx, b.bucket, key, "", "", nil, "", "", "", "",
+		"", nil, "")
+	if err == nil {
+		(*res.Value).Close()
+		return nil
+	}
+
+	initErr := adlInitError(b.cap.Name, b.account, b.bucket+"/"+key,
+		res.Response.Response, err)
+	if initErr != nil {
+		return initErr
+	}
+	err = b.mapADLv2Error(res.Response.Response, err, false)
 	if err == fuse.ENOENT {
 		err = nil
 	}
@@ -215,7 +273,7 @@ func decodeADLv2Error(body io.Reader) (adlErr adl2.DataLakeStorageError, err err
 	return
 }
 
-func mapADLv2Error(resp *http.Response, err error, rawError bool) error {
+func (m errorMap) mapADLv2Error(resp *http.Response, err error, rawError bool) error {
 	if resp == nil {
 		if err != nil {
 			if detailedError, ok := err.(autorest.DetailedError); ok {
@@ -247,7 +305,7 @@ func mapADLv2Error(resp *http.Response, err error, rawError bool) error {
 			switch resp.StatusCode {
 			case http.StatusBadRequest:
 				if !adl2Log.IsLevelEnabled(logrus.DebugLevel) {
-					adl2LogResp(logrus.ErrorLevel, resp)
+					adl2LogResp(adl2Log, logrus.ErrorLevel, resp)
 				}
 				adlErr, err := decodeADLv2Error(resp.Body)
 				if err == nil {
@@ -270,12 +328,12 @@ func mapADLv2Error(resp *http.Response, err error, rawError bool) error {
 				return syscall.EAGAIN
 			}
 
-			err = mapHttpError(resp.StatusCode)
+			err = m.mapHttpError(resp.StatusCode)
 			if err != nil {
 				return err
 			} else {
 				if !adl2Log.IsLevelEnabled(logrus.DebugLevel) {
-					adl2LogResp(logrus.ErrorLevel, resp)
+					adl2LogResp(adl2Log, logrus.ErrorLevel, resp)
 				}
 				adl2Log.Errorf("resp: %#v %v", resp, err)
 				return syscall.EINVAL
@@ -286,6 +344,22 @@ func mapADLv2Error(resp *http.Response, err error, rawError bool) error {
 	}
 }
 
+// adl2Retryable is if a request failed because the server was busy or
+// broken, or never answered
+func adl2Retryable(resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
 func getHeader(resp *http.Response, key string) *string {
 	if v, set := resp.Header[http.CanonicalHeaderKey(key)]; set {
 		return &v[0]
@@ -318,37 +392,144 @@ func (b *ADLv2) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 		key = key[:len(key)-1]
 	}
 
+	var acl *HeadBlobOutput
+	if b.flags.UseBackendACLs {
+		var err error
+		acl, err = b.headACL(param.Context, key)
+		if err != nil || acl.IsDirBlob {
+			return acl, err
+		}
+	}
+
 	// GetProperties(GetStatus) does not return user defined
 	// properties, despite what the documentation says, use a 0
 	// bytes range get instead
 	res, err := b.GetBlob(&GetBlobInput{
-		Key:   key,
-		Start: 0,
-		Count: 0,
+		Key:     key,
+		Start:   0,
+		Count:   0,
+		Context: param.Context,
 	})
 	if err != nil {
 		return nil, err
 	}
 	res.Body.Close()
 
+	if acl != nil {
+		res.HeadBlobOutput.ACL = acl.ACL
+	}
 	return &res.HeadBlobOutput, nil
 }
 
+// headACL is GetProperties(GetAccessControl), which has the owner,
+// group and permissions that a GET doesn't, but no metadata
+func (b *ADLv2) headACL(ctx context.Context, key string) (*HeadBlobOutput, error) {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	res, err := b.client.GetProperties(ctx, b.bucket, key, adl2.GetAccessControl,
+		nil, "", "", "", "", "", "", nil, "")
+	if err != nil {
+		return nil, b.mapADLv2Error(res.Response, err, false)
+	}
+
+	item := adlv2ToBlobItem(res.Response, key)
+	item.ACL = adlv2ACL(getHeader(res.Response, "x-ms-owner"),
+		getHeader(res.Response, "x-ms-group"),
+		getHeader(res.Response, "x-ms-permissions"))
+	return &HeadBlobOutput{
+		BlobItemOutput: item,
+		IsDirBlob:      res.Header.Get("x-ms-resource-type") == "directory",
+		RequestId:      res.Header.Get(ADL2_REQUEST_ID),
+	}, nil
+}
+
+// adlv2ACL is nil if the account has no hierarchical namespace, then
+// there are no permissions
+func adlv2ACL(owner, group, permissions *string) *BlobACL {
+	if permissions == nil {
+		return nil
+	}
+	mode, ok := parseADLv2Permissions(*permissions)
+	if !ok {
+		adl2Log.Warnf("ignoring permissions %q", *permissions)
+		return nil
+	}
+	return &BlobACL{
+		Owner: nilStr(owner),
+		Group: nilStr(group),
+		Mode:  mode,
+	}
+}
+
+// parseADLv2Permissions is the mode of symbolic permissions like
+// rwxr-x---, which have a + after them if there are more ACL entries
+func parseADLv2Permissions(p string) (mode os.FileMode, ok bool) {
+	p = strings.TrimSuffix(p, "+")
+	if len(p) != 9 {
+		return 0, false
+	}
+	for i, c := range p {
+		bit := os.FileMode(1) << uint(8-i)
+		switch {
+		case c == '-':
+		case c == rune("rwxrwxrwx"[i]):
+			mode |= bit
+		case i == 8 && c == 't':
+			mode |= bit | os.ModeSticky
+		case i == 8 && c == 'T':
+			mode |= os.ModeSticky
+		default:
+			return 0, false
+		}
+	}
+	return mode, true
+}
+
+// SetPermission is chmod, on accounts with a hierarchical namespace.
+// The owner, group and the rest of the ACL stay
+func (b *ADLv2) SetPermission(key string, mode os.FileMode) error {
+	perm := fmt.Sprintf("%04o", uint32(mode.Perm()))
+	if mode&os.ModeSticky != 0 {
+		perm = "1" + perm[1:]
+	}
+
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := b.client.Update(ctx, adl2.SetAccessControl, b.bucket,
+		strings.TrimSuffix(key, "/"), nil,
+		nil, nil, nil, "", "", "", "", "", "", "", "", "",
+		"", "", perm, "", "", "", "", "", nil, "", nil, "")
+	if err != nil {
+		return b.mapADLv2Error(res.Response, err, false)
+	}
+	return nil
+}
+
 func (b *ADLv2) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	if param.Delimiter != nil && *param.Delimiter != "/" {
 		return nil, fuse.EINVAL
 	}
 
+	// the path we list for shows up as the first entry, which
+	// counts towards MaxKeys
+	firstPage := param.ContinuationToken == nil
+	dirEntry := firstPage && param.Delimiter != nil && param.Prefix != nil
+
 	var maxResults *int32
 	if param.MaxKeys != nil {
 		maxResults = PInt32(int32(*param.MaxKeys))
+		if dirEntry && *maxResults > 1 {
+			*maxResults -= 1
+		}
 	}
 
-	res, err := b.client.List(context.TODO(), param.Delimiter == nil, b.bucket,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.List(ctx, param.Delimiter == nil, b.bucket,
 		nilStr(param.Prefix), nilStr(param.ContinuationToken), maxResults,
 		nil, "", nil, "")
 	if err != nil {
-		err = mapADLv2Error(res.Response.Response, err, false)
+		err = b.mapADLv2Error(res.Response.Response, err, false)
 		if err == fuse.ENOENT {
 			return &ListBlobsOutput{
 				RequestId: res.Response.Response.Header.Get(ADL2_REQUEST_ID),
@@ -361,7 +542,7 @@ func (b *ADLv2) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	var prefixes []BlobPrefixOutput
 	var items []BlobItemOutput
 
-	if param.Delimiter != nil && param.Prefix != nil {
+	if dirEntry {
 		// we didn't get 404 which means the path must
 		// exists. If the path is actually a file, adlv2
 		// returns the file itself as the result. That's
@@ -389,6 +570,20 @@ func (b *ADLv2) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		}
 	}
 
+	if dirEntry && param.MaxKeys != nil && *param.MaxKeys == 1 &&
+		len(items)+len(prefixes) == 1 {
+		// no room for anything else. An empty token starts
+		// from the beginning, without the dir entry since
+		// that's only on the first page
+		return &ListBlobsOutput{
+			Prefixes:              prefixes,
+			Items:                 items,
+			NextContinuationToken: PString(""),
+			IsTruncated:           true,
+			RequestId:             res.Response.Response.Header.Get(ADL2_REQUEST_ID),
+		}, nil
+	}
+
 	for _, p := range *res.Paths {
 		if param.Delimiter != nil {
 			if p.isDirectory() {
@@ -403,12 +598,16 @@ func (b *ADLv2) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		if p.isDirectory() {
 			key += "/"
 		}
-		items = append(items, BlobItemOutput{
+		item := BlobItemOutput{
 			Key:          &key,
 			ETag:         p.ETag,
 			LastModified: parseADLv2Time(nilStr(p.LastModified)),
 			Size:         uint64(p.contentLength()),
-		})
+		}
+		if b.flags.UseBackendACLs {
+			item.ACL = adlv2ACL(p.Owner, p.Group, p.Permissions)
+		}
+		items = append(items, item)
 	}
 
 	continuationToken := getHeader(res.Response.Response, "x-ms-continuation")
@@ -422,14 +621,20 @@ func (b *ADLv2) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	}, nil
 }
 
+func (b *ADLv2) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
 func (b *ADLv2) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	if strings.HasSuffix(param.Key, "/") {
-		return b.DeleteBlob(&DeleteBlobInput{param.Key[:len(param.Key)-1]})
+		return b.DeleteBlob(&DeleteBlobInput{Key: param.Key[:len(param.Key)-1]})
 	}
 
-	res, err := b.client.Delete(context.TODO(), b.bucket, param.Key, nil, "", "",
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Delete(ctx, b.bucket, param.Key, nil, "", "",
 		/*ifMatch=*/ "", "", "", "", "", nil, "")
-	err = mapADLv2Error(res.Response, err, false)
+	err = b.mapADLv2Error(res.Response, err, false)
 	if err != nil {
 		return nil, err
 	}
@@ -454,7 +659,7 @@ func (b *ADLv2) DeleteBlobs(param *DeleteBlobsInput) (ret *DeleteBlobsOutput, er
 	})
 
 	for _, i := range param.Items {
-		_, err := b.DeleteBlob(&DeleteBlobInput{i})
+		_, err := b.DeleteBlob(&DeleteBlobInput{Key: i})
 		if err != nil {
 			return nil, err
 		}
@@ -478,12 +683,15 @@ func (b *ADLv2) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
 
 	var requestId string
 	for cont := true; cont; cont = continuation != "" {
-		res, err := b.client.Create(context.TODO(), b.bucket, renameDest,
+		// each page of a big directory gets its own deadline
+		ctx, cancel := b.requestContext(param.Context)
+		res, err := b.client.Create(ctx, b.bucket, renameDest,
 			"", continuation, "", "", "", "", "", "", "", "", "", "",
 			renameSource, "", "", "", "", "", "", "", "", "", "", "",
 			"", "", "", nil, "")
+		cancel()
 		if err != nil {
-			return nil, mapADLv2Error(res.Response, err, false)
+			return nil, b.mapADLv2Error(res.Response, err, false)
 		}
 
 		continuation = res.Header.Get("x-ms-continuation")
@@ -494,15 +702,20 @@ func (b *ADLv2) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
 }
 
 func (b *ADLv2) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
-	if param.Source != param.Destination || param.Metadata == nil {
+	if param.Source != param.Destination {
+		return b.copyParts(param)
+	}
+	if param.Metadata == nil {
 		return nil, syscall.ENOTSUP
 	}
 
-	res, err := b.client.Update(context.TODO(), adl2.SetProperties, b.bucket, param.Source, nil,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	res, err := b.client.Update(ctx, adl2.SetProperties, b.bucket, param.Source, nil,
 		nil, nil, nil, "", "", "", "", "", "", "", "", b.toADLProperties(param.Metadata),
 		"", "", "", "", "", "", "", "", nil, "", nil, "")
 	if err != nil {
-		return nil, mapADLv2Error(res.Response, err, false)
+		return nil, b.mapADLv2Error(res.Response, err, false)
 	}
 
 	return &CopyBlobOutput{
@@ -510,6 +723,53 @@ func (b *ADLv2) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	}, nil
 }
 
+// copyParts has no server side copy to use, so the source is read a
+// range at a time and appended to a temporary file next to the
+// destination, which is then renamed over it like ADLv1 does
+func (b *ADLv2) copyParts(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	head, err := b.HeadBlob(&HeadBlobInput{Key: param.Source})
+	if err != nil {
+		return nil, err
+	}
+	etag := head.ETag
+	if param.ETag != nil {
+		etag = param.ETag
+	}
+	metadata := param.Metadata
+	if metadata == nil {
+		metadata = head.Metadata
+	}
+	contentType := param.ContentType
+	if contentType == nil {
+		contentType = head.ContentType
+	}
+
+	tmp := param.Destination + ".goofys-copy-" + RandStringBytesMaskImprSrc(8)
+	mpu, err := b.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:         tmp,
+		Metadata:    metadata,
+		ContentType: contentType,
+		IfNotExists: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = multipartBlobCopy(b, param.Source, etag, head.Size, mpu, b.flags.CopyPartSize)
+	if err == nil {
+		_, err = b.RenameBlob(&RenameBlobInput{
+			Source:      tmp,
+			Destination: param.Destination,
+		})
+	}
+	if err != nil {
+		b.DeleteBlob(&DeleteBlobInput{Key: tmp})
+		return nil, err
+	}
+
+	return &CopyBlobOutput{}, nil
+}
+
 func (b *ADLv2) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 	var bytes string
 	if param.Start != 0 || param.Count != 0 {
@@ -520,15 +780,32 @@ func (b *ADLv2) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		}
 	}
 
-	res, err := b.client.Read(context.TODO(), b.bucket, param.Key, bytes,
+	ctx, cancel := b.requestContext(param.Context)
+	res, err := b.client.Read(ctx, b.bucket, param.Key, bytes,
 		"", nil, nilStr(param.IfMatch), "", "", "",
 		"", nil, "")
 	if err != nil {
-		return nil, mapADLv2Error(res.Response.Response, err, false)
+		cancel()
+		return nil, b.mapADLv2Error(res.Response.Response, err, false)
 	}
 
+	metadata := fromADLProperties(param.Key, res.Header["X-Ms-Properties"])
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: adlv2ToBlobItem(res.Response.Response, param.Key),
+			ContentType:    getHeader(res.Response.Response, "Content-Type"),
+			IsDirBlob:      res.Header.Get("X-Ms-Resource-Type") == string(adl2.Directory),
+			Metadata:       metadata,
+		},
+		Body: cancelOnClose{*res.Value, cancel},
+	}, nil
+}
+
+// fromADLProperties undoes toADLProperties
+func fromADLProperties(key string, properties []string) map[string]*string {
 	metadata := make(map[string]*string)
-	for _, p := range res.Header["X-Ms-Properties"] {
+	for _, p := range properties {
 		csv := strings.Split(p, ",")
 		for _, kv := range csv {
 			kv = strings.TrimSpace(kv)
@@ -538,30 +815,21 @@ func (b *ADLv2) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 
 			s := strings.SplitN(kv, "=", 2)
 			if len(s) != 2 {
-				adl2Log.Warnf("Dropping property: %v: %v", param.Key, kv)
+				adl2Log.Warnf("Dropping property: %v: %v", key, kv)
 				continue
 			}
-			key := strings.TrimSpace(s[0])
+			k := strings.TrimSpace(s[0])
 			value := strings.TrimSpace(s[1])
 			buf, err := base64.StdEncoding.DecodeString(value)
 			if err != nil {
 				adl2Log.Warnf("Unable to decode property: %v: %v",
-					param.Key, key)
+					key, k)
 				continue
 			}
-			metadata[key] = PString(string(buf))
+			metadata[k] = PString(string(buf))
 		}
 	}
-
-	return &GetBlobOutput{
-		HeadBlobOutput: HeadBlobOutput{
-			BlobItemOutput: adlv2ToBlobItem(res.Response.Response, param.Key),
-			ContentType:    getHeader(res.Response.Response, "Content-Type"),
-			IsDirBlob:      res.Header.Get("X-Ms-Resource-Type") == string(adl2.Directory),
-			Metadata:       metadata,
-		},
-		Body: *res.Value,
-	}, nil
+	return metadata
 }
 
 func (b *ADLv2) toADLProperties(metadata map[string]*string) string {
@@ -580,46 +848,79 @@ func (b *ADLv2) toADLProperties(metadata map[string]*string) string {
 	return s
 }
 
-func (b *ADLv2) create(key string, pathType adl2.PathResourceType, contentType *string,
-	metadata map[string]*string, leaseId string) (resp autorest.Response, err error) {
-	resp, err = b.client.Create(context.TODO(), b.bucket, key,
+func (b *ADLv2) create(ctx context.Context, key string, pathType adl2.PathResourceType, contentType *string,
+	metadata map[string]*string, leaseId string, ifMatch *string,
+	ifNotExists bool) (resp autorest.Response, err error) {
+	var etag string
+	if ifMatch != nil {
+		etag = quoteETag(*ifMatch)
+	}
+	var ifNoneMatch string
+	if ifNotExists {
+		ifNoneMatch = "*"
+	}
+
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	resp, err = b.client.Create(ctx, b.bucket, key,
 		pathType, "", "", "", "", "", "", "", nilStr(contentType),
-		"", "", "", "", leaseId, "", b.toADLProperties(metadata), "", "", "", "", "", "",
+		"", "", "", "", leaseId, "", b.toADLProperties(metadata), "", "", etag, ifNoneMatch, "", "",
 		"", "", "", "", "", nil, "")
 	if err != nil {
-		err = mapADLv2Error(resp.Response, err, false)
+		if ifNotExists && resp.Response != nil &&
+			(resp.StatusCode == http.StatusConflict ||
+				resp.StatusCode == http.StatusPreconditionFailed) {
+			// PathAlreadyExists, someone else created it
+			resp.Body.Close()
+			return resp, syscall.EBUSY
+		}
+		err = b.mapADLv2IfMatchError(resp.Response, err, etag)
 	}
 	return
 }
 
-func (b *ADLv2) append(key string, offset int64, size int64, body io.ReadSeeker,
+// mapADLv2IfMatchError is mapADLv2Error, except that 412 is EBUSY if
+// we asked for an etag. Otherwise 412 is a lease problem
+func (m errorMap) mapADLv2IfMatchError(resp *http.Response, err error, ifMatch string) error {
+	if ifMatch != "" && resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return syscall.EBUSY
+	}
+	return m.mapADLv2Error(resp, err, false)
+}
+
+func (b *ADLv2) append(ctx context.Context, key string, offset int64, size int64, body io.ReadSeeker,
 	leaseId string) (resp autorest.Response, err error) {
-	resp, err = b.client.Update(context.TODO(), adl2.Append, b.bucket,
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	resp, err = b.client.Update(ctx, adl2.Append, b.bucket,
 		key, &offset, nil, nil, &size, "", leaseId, "",
 		"", "", "", "", "", "", "", "", "", "",
 		"", "", "", "", &ReadSeekerCloser{body},
 		"", nil, "")
 	if err != nil {
-		err = mapADLv2Error(resp.Response, err, false)
+		err = b.mapADLv2Error(resp.Response, err, false)
 	}
 	return
 }
 
-func (b *ADLv2) flush(key string, offset int64, contentType string, leaseId string) (res autorest.Response, err error) {
-	res, err = b.client.Update(context.TODO(), adl2.Flush, b.bucket,
+func (b *ADLv2) flush(ctx context.Context, key string, offset int64, contentType string, leaseId string) (res autorest.Response, err error) {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	res, err = b.client.Update(ctx, adl2.Flush, b.bucket,
 		key, &offset, PBool(false), PBool(true), PInt64(0), "", leaseId, "",
 		contentType, "", "", "", "", "", "", "", "", "",
 		"", "", "", "", nil, "", nil, "")
 	if err != nil {
-		err = mapADLv2Error(res.Response, err, false)
+		err = b.mapADLv2Error(res.Response, err, false)
 	}
 	return
 }
 
 func (b *ADLv2) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	if param.DirBlob {
-		res, err := b.create(param.Key, adl2.Directory, param.ContentType,
-			param.Metadata, "")
+		res, err := b.create(param.Context, param.Key, adl2.Directory, param.ContentType,
+			param.Metadata, "", nil, false)
 		if err != nil {
 			return nil, err
 		}
@@ -631,8 +932,8 @@ func (b *ADLv2) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 			panic("size cannot be nil")
 		}
 
-		create, err := b.create(param.Key, adl2.File, param.ContentType,
-			param.Metadata, "")
+		create, err := b.create(param.Context, param.Key, adl2.File, param.ContentType,
+			param.Metadata, "", param.IfMatch, param.IfNotExists)
 		if err != nil {
 			return nil, err
 		}
@@ -651,12 +952,12 @@ func (b *ADLv2) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 		// not doing a lease for these because append to 0
 		// would guarantee that we don't have concurrent
 		// appends, and flushing is safe to do
-		_, err = b.append(param.Key, 0, size, param.Body, "")
+		_, err = b.append(param.Context, param.Key, 0, size, param.Body, "")
 		if err != nil {
 			return nil, err
 		}
 
-		flush, err := b.flush(param.Key, size, nilStr(param.ContentType), "")
+		flush, err := b.flush(param.Context, param.Key, size, nilStr(param.ContentType), "")
 		if err != nil {
 			return nil, err
 		}
@@ -671,16 +972,30 @@ func (b *ADLv2) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 // lease, replace the object, then release the lease
 func (b *ADLv2) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
 	leaseId := uuid.New().String()
-	err := b.lease(adl2.Acquire, param.Key, leaseId, 60, "")
+	// with the lease nobody else can change the file until we
+	// commit, so the etag only has to match now
+	var ifMatch string
+	if param.IfMatch != nil {
+		ifMatch = quoteETag(*param.IfMatch)
+	}
+	var err error
+	if param.IfNotExists {
+		// there's nothing to lease, and if someone else
+		// creates it first that's a conflict
+		err = fuse.ENOENT
+	} else {
+		err = b.lease(param.Context, adl2.Acquire, param.Key, leaseId, 60, ifMatch)
+	}
 	if err == fuse.ENOENT {
 		// the file didn't exist, we will create the file
 		// first and then acquire the lease
-		create, err := b.create(param.Key, adl2.File, param.ContentType, param.Metadata, "")
+		create, err := b.create(param.Context, param.Key, adl2.File, param.ContentType, param.Metadata, "", nil,
+			param.IfNotExists)
 		if err != nil {
 			return nil, err
 		}
 
-		err = b.lease(adl2.Acquire, param.Key, leaseId, 60,
+		err = b.lease(param.Context, adl2.Acquire, param.Key, leaseId, 60,
 			create.Response.Header.Get("ETag"))
 		if err != nil {
 			return nil, err
@@ -692,7 +1007,7 @@ func (b *ADLv2) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 
 		defer func() {
 			if err != nil {
-				err2 := b.lease(adl2.Release, param.Key, leaseId, 0, "")
+				err2 := b.lease(param.Context, adl2.Release, param.Key, leaseId, 0, "")
 				if err2 != nil {
 					adl2Log.Errorf("Unable to release lease for %v: %v",
 						param.Key, err2)
@@ -700,7 +1015,7 @@ func (b *ADLv2) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 			}
 		}()
 
-		_, err = b.create(param.Key, adl2.File, param.ContentType, param.Metadata, leaseId)
+		_, err = b.create(param.Context, param.Key, adl2.File, param.ContentType, param.Metadata, leaseId, nil, false)
 		if err != nil {
 			return nil, err
 		}
@@ -712,16 +1027,7 @@ func (b *ADLv2) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 		RenewLeaseStop: make(chan bool, 1),
 	}
 
-	go func() {
-		for {
-			select {
-			case <-commitData.RenewLeaseStop:
-				break
-			case <-time.After(30 * time.Second):
-				b.lease(adl2.Renew, param.Key, leaseId, 60, "")
-			}
-		}
-	}()
+	go b.renewLease(param.Key, leaseId, commitData.RenewLeaseStop)
 
 	return &MultipartBlobCommitInput{
 		Key:         &param.Key,
@@ -731,7 +1037,65 @@ func (b *ADLv2) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBl
 	}, nil
 }
 
-func (b *ADLv2) lease(action adl2.PathLeaseAction, key string, leaseId string, durationSec int32,
+// renewLease keeps the lease of an upload until the commit is done
+// with it
+func (b *ADLv2) renewLease(key string, leaseId string, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(30 * time.Second):
+			b.lease(nil, adl2.Renew, key, leaseId, 60, "")
+		}
+	}
+}
+
+// AppendBlob takes the lease like MultipartBlobBegin, but keeps the
+// file instead of creating it again. Parts are appended at their
+// offset, which starts where the file ends now
+func (b *ADLv2) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	leaseId := uuid.New().String()
+	var ifMatch string
+	if param.IfMatch != nil {
+		ifMatch = quoteETag(*param.IfMatch)
+	}
+	err := b.lease(param.Context, adl2.Acquire, param.Key, leaseId, 60, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	// nobody can change it now, but someone could have since we
+	// last looked
+	head, err := b.HeadBlob(&HeadBlobInput{Key: param.Key})
+	if err == nil && head.Size != param.Offset {
+		adl2Log.Warnf("%v is %v bytes instead of %v, not appending to it",
+			param.Key, head.Size, param.Offset)
+		err = syscall.EBUSY
+	}
+	if err != nil {
+		err2 := b.lease(param.Context, adl2.Release, param.Key, leaseId, 0, "")
+		if err2 != nil {
+			adl2Log.Errorf("Unable to release lease for %v: %v",
+				param.Key, err2)
+		}
+		return nil, err
+	}
+
+	commitData := &ADLv2MultipartBlobCommitInput{
+		Size:           param.Offset,
+		ContentType:    nilStr(param.ContentType),
+		RenewLeaseStop: make(chan bool, 1),
+	}
+	go b.renewLease(param.Key, leaseId, commitData.RenewLeaseStop)
+
+	return &MultipartBlobCommitInput{
+		Key:         &param.Key,
+		UploadId:    &leaseId,
+		backendData: commitData,
+	}, nil
+}
+
+func (b *ADLv2) lease(ctx context.Context, action adl2.PathLeaseAction, key string, leaseId string, durationSec int32,
 	ifMatch string) error {
 	var proposeLeaseId string
 	var prevLeaseId string
@@ -746,10 +1110,12 @@ func (b *ADLv2) lease(action adl2.PathLeaseAction, key string, leaseId string, d
 		duration = &durationSec
 	}
 
-	res, err := b.client.Lease(context.TODO(), action, b.bucket, key,
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	res, err := b.client.Lease(ctx, action, b.bucket, key,
 		duration, nil, prevLeaseId, proposeLeaseId, ifMatch, "", "", "", "", nil, "")
 	if err != nil {
-		err = mapADLv2Error(res.Response, err, false)
+		err = b.mapADLv2IfMatchError(res.Response, err, ifMatch)
 	}
 	return err
 }
@@ -761,8 +1127,13 @@ func (b *ADLv2) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAd
 		panic("Incorrect commit data type")
 	}
 
-	res, err := b.append(*param.Commit.Key, int64(param.Offset), int64(param.Size),
-		param.Body, *param.Commit.UploadId)
+	var res autorest.Response
+	err := retryPart(adl2Log, *param.Commit.Key, param.PartNumber, param.Body,
+		b.flags.MaxRetries, func() (retryable bool, err error) {
+			res, err = b.append(param.Context, *param.Commit.Key, int64(param.Offset), int64(param.Size),
+				param.Body, *param.Commit.UploadId)
+			return adl2Retryable(res.Response, err), err
+		})
 	if err != nil {
 		return nil, err
 	}
@@ -775,7 +1146,13 @@ func (b *ADLv2) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAd
 
 func (b *ADLv2) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
 	if param.UploadId != nil {
-		err := b.lease(adl2.Release, *param.Key, *param.UploadId, 0, "")
+		if commitData, ok := param.backendData.(*ADLv2MultipartBlobCommitInput); ok {
+			select {
+			case commitData.RenewLeaseStop <- true:
+			default:
+			}
+		}
+		err := b.lease(param.Context, adl2.Release, *param.Key, *param.UploadId, 0, "")
 		if err != nil {
 			return nil, err
 		}
@@ -797,46 +1174,58 @@ func (b *ADLv2) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multipart
 		// lease during abort
 		param.UploadId = nil
 
-		err2 := b.lease(adl2.Release, *param.Key, leaseId, 0, "")
+		err2 := b.lease(param.Context, adl2.Release, *param.Key, leaseId, 0, "")
 		if err2 != nil {
 			adl2Log.Errorf("Unable to release lease for %v: %v",
 				*param.Key, err2)
 		}
 	}()
 
-	flush, err := b.flush(*param.Key, int64(commitData.Size), commitData.ContentType, *param.UploadId)
+	flush, err := b.flush(param.Context, *param.Key, int64(commitData.Size), commitData.ContentType, *param.UploadId)
 	if err != nil {
 		return nil, err
 	}
 
 	return &MultipartBlobCommitOutput{
-		ETag:      nil,
+		ETag:      getHeader(flush.Response, "ETag"),
 		RequestId: flush.Response.Header.Get(ADL2_REQUEST_ID),
 	}, nil
 }
 
 func (b *ADLv2) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	// uploads append to the file itself under a lease, nothing
+	// is left behind. Appends that were never flushed are
+	// dropped by the service
 	return nil, syscall.ENOTSUP
 }
 
 func (b *ADLv2) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
 	fs := adl2.FilesystemClient{b.client.BaseClient}
-	res, err := fs.Delete(context.TODO(), b.bucket, "", "", uuid.New().String(), nil, "")
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := fs.Delete(ctx, b.bucket, "", "", uuid.New().String(), nil, "")
 	if err != nil {
-		return nil, mapADLv2Error(res.Response, err, false)
+		return nil, b.mapADLv2Error(res.Response, err, false)
 	}
 	return &RemoveBucketOutput{}, nil
 }
 
 func (b *ADLv2) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
 	fs := adl2.FilesystemClient{b.client.BaseClient}
-	res, err := fs.Create(context.TODO(), b.bucket, "", uuid.New().String(), nil, "")
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	res, err := fs.Create(ctx, b.bucket, "", uuid.New().String(), nil, "")
 	if err != nil {
-		return nil, mapADLv2Error(res.Response, err, false)
+		return nil, b.mapADLv2Error(res.Response, err, false)
 	}
 	return &MakeBucketOutput{}, nil
 }
 
+func (b *ADLv2) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	// we would have to list the whole filesystem
+	return nil, syscall.ENOTSUP
+}
+
 // hacked from azure-sdk-for-go
 // remove after these bugs are fixed:
 // https://github.com/Azure/azure-sdk-for-go/issues/5502
@@ -17,13 +17,18 @@ package internal
 import (
 	. "github.com/AITRICS/goofys/api/common"
 
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -55,18 +60,16 @@ type requestWrapper struct {
 	pipeline.Request
 }
 
-var pipelineHTTPClient = newDefaultHTTPClient()
-
 // Clone of https://github.com/Azure/azure-pipeline-go/blob/master/pipeline/core.go#L202
 func newDefaultHTTPClient() *http.Client {
 	return &http.Client{
-		Transport: GetHTTPTransport(),
+		Transport: GetHTTPTransport(&FlagStorage{}),
 	}
 }
 
 // Creates a pipeline.Factory object that fixes headers related to azure blob store
-// and sends HTTP requests to Go's default http.Client.
-func newAzBlobHTTPClientFactory() pipeline.Factory {
+// and sends HTTP requests to client, with the --request-header headers.
+func newAzBlobHTTPClientFactory(client *http.Client, headers map[string]string) pipeline.Factory {
 	return pipeline.FactoryFunc(
 		func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
 			return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
@@ -87,10 +90,24 @@ func newAzBlobHTTPClientFactory() pipeline.Factory {
 						request.Header[keyLower] = value
 					}
 				}
+				setRequestHeaders(request.Header, headers)
 				// Send the HTTP request.
-				r, err := pipelineHTTPClient.Do(request.WithContext(ctx))
+				req := TraceRequest(request.WithContext(ctx))
+				r, err := client.Do(req)
 				if err != nil {
 					err = pipeline.NewError(err, "HTTP request failed")
+				} else {
+					op := request.Method
+					if comp := request.URL.Query().Get("comp"); comp != "" {
+						op += " " + comp
+					}
+					if fields := TraceFields(r); fields != nil {
+						azbLog.WithFields(fields).Debugf("%v %v", op,
+							request.URL.Path)
+					}
+					noteFailedRequest(azbLog, "wasb", op, r,
+						request.Header.Get("x-ms-client-request-id"),
+						r.Header.Get("x-ms-request-id"))
 				}
 				return pipeline.NewHTTPResponse(r), err
 			}
@@ -99,13 +116,17 @@ func newAzBlobHTTPClientFactory() pipeline.Factory {
 
 type AZBlob struct {
 	config *AZBlobConfig
-	cap    Capabilities
+	errorMap
+	opTimeout
+	cap Capabilities
 
 	mu sync.Mutex
 	u  *azblob.ServiceURL
 	c  *azblob.ContainerURL
 
 	pipeline pipeline.Pipeline
+	// signs the deletes that go in a batch, without sending them
+	signer pipeline.Pipeline
 
 	bucket           string
 	bareURL          string
@@ -118,6 +139,11 @@ type AZBlob struct {
 var azbLog = GetLogger("azblob")
 
 func NewAZBlob(container string, config *AZBlobConfig) (*AZBlob, error) {
+	client := config.HTTPClient
+	if client == nil {
+		client = newDefaultHTTPClient()
+	}
+
 	po := azblob.PipelineOptions{
 		Log: pipeline.LogOptions{
 			Log: func(level pipeline.LogLevel, msg string) {
@@ -148,10 +174,11 @@ func NewAZBlob(container string, config *AZBlobConfig) (*AZBlob, error) {
 		RequestLog: azblob.RequestLogOptions{
 			LogWarningIfTryOverThreshold: time.Duration(-1),
 		},
-		HTTPSender: newAzBlobHTTPClientFactory(),
+		HTTPSender: newAzBlobHTTPClientFactory(client, config.RequestHeaders),
 	}
 
-	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), po)
+	var cred azblob.Credential = azblob.NewAnonymousCredential()
+	p := azblob.NewPipeline(cred, po)
 	bareURL := config.Endpoint
 
 	var bu *azblob.ServiceURL
@@ -163,7 +190,8 @@ func NewAZBlob(container string, config *AZBlobConfig) (*AZBlob, error) {
 			return nil, fmt.Errorf("Unable to construct credential: %v", err)
 		}
 
-		p = azblob.NewPipeline(credential, po)
+		cred = skewSharedKeyCredential{credential}
+		p = azblob.NewPipeline(cred, po)
 
 		u, err := url.Parse(bareURL)
 		if err != nil {
@@ -180,10 +208,21 @@ func NewAZBlob(container string, config *AZBlobConfig) (*AZBlob, error) {
 	b := &AZBlob{
 		config: config,
 		cap: Capabilities{
-			MaxMultipartSize: 100 * 1024 * 1024,
-			Name:             "wasb",
+			MaxMultipartSize:   100 * 1024 * 1024,
+			Name:               "wasb",
+			ConditionalWrite:   true,
+			ConditionalCreate:  true,
+			ResumableMultipart: true,
+			AnyPartSize:        true,
+			MaxKeyLength:       1024,
+			KeyLengthInChars:   true,
+			MaxPathDepth:       254,
+			MaxMetadataSize:    8 * 1024,
+			// 50000 blocks of the biggest we send
+			MaxObjectSize: 50000 * 100 * 1024 * 1024,
 		},
 		pipeline:         p,
+		signer:           pipeline.NewPipeline([]pipeline.Factory{cred}, pipeline.Options{HTTPSender: azbSignOnly}),
 		bucket:           container,
 		bareURL:          bareURL,
 		sasTokenProvider: config.SasToken,
@@ -204,6 +243,15 @@ func (b *AZBlob) Bucket() string {
 	return b.bucket
 }
 
+func (b *AZBlob) ObjectLocation(key string) objectLocation {
+	endpoint := strings.TrimRight(b.config.Endpoint, "/")
+	return objectLocation{
+		Endpoint: endpoint,
+		Key:      key,
+		URL:      endpoint + "/" + b.bucket + "/" + key,
+	}
+}
+
 func (b *AZBlob) refreshToken() (*azblob.ContainerURL, error) {
 	if b.sasTokenProvider == nil {
 		return b.c, nil
@@ -320,7 +368,7 @@ func (b *AZBlob) updateToken() (*azblob.ContainerURL, error) {
 func (b *AZBlob) testBucket(key string) (err error) {
 	_, err = b.HeadBlob(&HeadBlobInput{Key: key})
 	if err != nil {
-		err = mapAZBError(err)
+		err = b.mapAZBError(err)
 		if err == fuse.ENOENT {
 			err = nil
 		}
@@ -339,81 +387,89 @@ func (b *AZBlob) Init(key string) error {
 	return err
 }
 
-func mapAZBError(err error) error {
+func (m errorMap) mapAZBError(err error) error {
 	if err == nil {
 		return nil
 	}
 
 	if stgErr, ok := err.(azblob.StorageError); ok {
-		switch stgErr.ServiceCode() {
-		case azblob.ServiceCodeBlobAlreadyExists:
-			return syscall.EACCES
-		case azblob.ServiceCodeBlobNotFound:
-			return fuse.ENOENT
-		case azblob.ServiceCodeContainerAlreadyExists:
-			return syscall.EEXIST
-		case azblob.ServiceCodeContainerBeingDeleted:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeContainerDisabled:
-			return syscall.EACCES
-		case azblob.ServiceCodeContainerNotFound:
-			return syscall.ENODEV
-		case azblob.ServiceCodeCopyAcrossAccountsNotSupported:
-			return fuse.EINVAL
-		case azblob.ServiceCodeSourceConditionNotMet:
-			return fuse.EINVAL
-		case azblob.ServiceCodeSystemInUse:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeTargetConditionNotMet:
-			return fuse.EINVAL
-		case azblob.ServiceCodeBlobBeingRehydrated:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeBlobArchived:
-			return fuse.EINVAL
-		case azblob.ServiceCodeAccountBeingCreated:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeAuthenticationFailed:
-			return syscall.EACCES
-		case azblob.ServiceCodeConditionNotMet:
-			return syscall.EBUSY
-		case azblob.ServiceCodeInternalError:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeInvalidAuthenticationInfo:
-			return syscall.EACCES
-		case azblob.ServiceCodeOperationTimedOut:
-			return syscall.EAGAIN
-		case azblob.ServiceCodeResourceNotFound:
-			return fuse.ENOENT
-		case azblob.ServiceCodeServerBusy:
-			return syscall.EAGAIN
-		case "AuthorizationFailure": // from Azurite emulator
-			return syscall.EACCES
-		default:
-			err = mapHttpError(stgErr.Response().StatusCode)
-			if err != nil {
-				return err
-			} else {
-				azbLog.Errorf("code=%v status=%v err=%v", stgErr.ServiceCode(), stgErr.Response().Status, stgErr)
-				return stgErr
-			}
+		err = m.mapErrorCode(string(stgErr.ServiceCode()))
+		if err == nil {
+			err = m.mapHttpError(stgErr.Response().StatusCode)
 		}
+		if err != nil {
+			return err
+		} else {
+			azbLog.Errorf("code=%v status=%v err=%v", stgErr.ServiceCode(), stgErr.Response().Status, stgErr)
+			return stgErr
+		}
+	} else if timedOut(pipeline.Cause(err)) {
+		return syscall.ETIMEDOUT
 	} else {
 		return err
 	}
 }
 
+// azbRetryable is if a request failed because the server was busy or
+// broken, or it timed out
+func azbRetryable(err error) bool {
+	if stgErr, ok := err.(azblob.StorageError); ok {
+		switch stgErr.Response().StatusCode {
+		case http.StatusInternalServerError, http.StatusServiceUnavailable:
+			return true
+		}
+		return false
+	}
+	return err != nil && timedOut(pipeline.Cause(err))
+}
+
+// azbIfMatch fails the request with ConditionNotMet if the blob has
+// changed. Listings give us etags without the quotes
+func azbIfMatch(etag *string) azblob.BlobAccessConditions {
+	if etag == nil {
+		return azblob.BlobAccessConditions{}
+	}
+	return azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+			IfMatch: azblob.ETag(quoteETag(*etag)),
+		},
+	}
+}
+
+// azbIf is azbIfMatch, unless we only want to create the blob. Then
+// it fails with BlobAlreadyExists if it's there
+func azbIf(etag *string, ifNotExists bool) azblob.BlobAccessConditions {
+	if !ifNotExists {
+		return azbIfMatch(etag)
+	}
+	return azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+			IfNoneMatch: azblob.ETagAny,
+		},
+	}
+}
+
+// mapAZBCreateError is mapAZBError, except that the blob being there
+// is a conflict if we asked for it not to be
+func (m errorMap) mapAZBCreateError(err error, ifNotExists bool) error {
+	if stgErr, ok := err.(azblob.StorageError); ok && ifNotExists &&
+		stgErr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists {
+		return syscall.EBUSY
+	}
+	return m.mapAZBError(err)
+}
+
 func pMetadata(m map[string]string) map[string]*string {
-	metadata := make(map[string]*string)
-	for k, _ := range m {
-		k = strings.ToLower(k)
-		v := m[k]
-		metadata[k] = &v
+	metadata := make(map[string]*string, len(m))
+	for k, v := range m {
+		v := v
+		metadata[strings.ToLower(k)] = &v
 	}
 	return metadata
 }
 
 func nilMetadata(m map[string]*string) map[string]string {
-	metadata := make(map[string]string)
+	metadata := make(map[string]string, len(m))
 	for k, v := range m {
 		k = strings.ToLower(k)
 		metadata[k] = nilStr(v)
@@ -428,7 +484,10 @@ func (b *AZBlob) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 	}
 
 	if strings.HasSuffix(param.Key, "/") {
-		dirBlob, err := b.HeadBlob(&HeadBlobInput{Key: param.Key[:len(param.Key)-1]})
+		dirBlob, err := b.HeadBlob(&HeadBlobInput{
+			Key:     param.Key[:len(param.Key)-1],
+			Context: param.Context,
+		})
 		if err == nil {
 			if !dirBlob.IsDirBlob {
 				// we requested for a dir suffix, but this isn't one
@@ -439,9 +498,11 @@ func (b *AZBlob) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key)
-	resp, err := blob.GetProperties(context.TODO(), azblob.BlobAccessConditions{})
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	resp, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{})
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 
 	metadata := resp.NewMetadata()
@@ -452,6 +513,11 @@ func (b *AZBlob) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 	// don't expose this to user land
 	delete(metadata, AzureDirBlobMetadataKey)
 
+	var crtime *time.Time
+	if t := resp.CreationTime(); !t.IsZero() {
+		crtime = &t
+	}
+
 	return &HeadBlobOutput{
 		BlobItemOutput: BlobItemOutput{
 			Key:          &param.Key,
@@ -459,6 +525,7 @@ func (b *AZBlob) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 			LastModified: PTime(resp.LastModified()),
 			Size:         uint64(resp.ContentLength()),
 			StorageClass: PString(resp.AccessTier()),
+			Crtime:       crtime,
 		},
 		ContentType: PString(resp.ContentType()),
 		Metadata:    pMetadata(metadata),
@@ -497,10 +564,43 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 
 	var blobItems []azblob.BlobItem
 	var nextMarker *string
+	var sortItems bool
+
+	prefix := nilStr(param.Prefix)
+	maxKeys := nilUint32(param.MaxKeys)
+	var dirBlob *BlobItemOutput
+
+	if strings.HasSuffix(prefix, "/") && param.ContinuationToken == nil {
+		// because azure doesn't use dir/ blobs, dir/ would not show up
+		// so we make another request to fill that in. Only on the
+		// first page, and it counts towards MaxKeys like the other
+		// items
+		head, err := b.HeadBlob(&HeadBlobInput{Key: prefix, Context: param.Context})
+		if err == nil {
+			*head.Key += "/"
+			dirBlob = &head.BlobItemOutput
+		} else if err != fuse.ENOENT {
+			return nil, err
+		}
+
+		if dirBlob != nil && maxKeys == 1 {
+			// no room for anything else. An empty marker
+			// starts from the beginning, without the dir
+			// blob since that's only on the first page
+			return &ListBlobsOutput{
+				Prefixes:              prefixes,
+				Items:                 []BlobItemOutput{*dirBlob},
+				NextContinuationToken: PString(""),
+				IsTruncated:           true,
+			}, nil
+		} else if dirBlob != nil && maxKeys != 0 {
+			maxKeys--
+		}
+	}
 
 	options := azblob.ListBlobsSegmentOptions{
-		Prefix:     nilStr(param.Prefix),
-		MaxResults: int32(nilUint32(param.MaxKeys)),
+		Prefix:     prefix,
+		MaxResults: int32(maxKeys),
 		Details: azblob.BlobListingDetails{
 			// blobfuse (following wasb) convention uses
 			// an empty blob with "hdi_isfolder" metadata
@@ -511,18 +611,23 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 			// https://github.com/Azure/azure-storage-fuse/issues/222
 			// https://blogs.msdn.microsoft.com/mostlytrue/2014/04/22/wasb-back-stories-masquerading-a-key-value-store/
 			Metadata: true,
+			// --list-deleted
+			Deleted: b.config.ListDeleted,
 		},
 	}
 
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+
 	if param.Delimiter != nil {
-		resp, err := c.ListBlobsHierarchySegment(context.TODO(),
+		resp, err := c.ListBlobsHierarchySegment(ctx,
 			azblob.Marker{
 				param.ContinuationToken,
 			},
 			nilStr(param.Delimiter),
 			options)
 		if err != nil {
-			return nil, mapAZBError(err)
+			return nil, b.mapAZBError(err)
 		}
 
 		for i, _ := range resp.Segment.BlobPrefixes {
@@ -539,30 +644,41 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		blobItems = resp.Segment.BlobItems
 		nextMarker = resp.NextMarker.Val
 	} else {
-		resp, err := c.ListBlobsFlatSegment(context.TODO(),
+		resp, err := c.ListBlobsFlatSegment(ctx,
 			azblob.Marker{
 				param.ContinuationToken,
 			},
 			options)
 		if err != nil {
-			return nil, mapAZBError(err)
+			return nil, b.mapAZBError(err)
 		}
 
 		blobItems = resp.Segment.BlobItems
 		nextMarker = resp.NextMarker.Val
 
-		if b.config.Endpoint == AzuriteEndpoint &&
-			!sort.IsSorted(sortBlobItemOutput(items)) {
-			sort.Sort(sortBlobItemOutput(items))
-		}
+		// XXX in Azurite this is not sorted either. Sorted
+		// below, once items are filled in
+		sortItems = b.config.Endpoint == AzuriteEndpoint
 	}
 
-	var sortItems bool
-
 	for idx, _ := range blobItems {
 		i := &blobItems[idx]
 		p := &i.Properties
 
+		// a blob can be deleted more than once, and be there
+		// again. Those come next to each other, we want one of
+		// each name and the live one if there's one
+		if n := len(items); n != 0 && *items[n-1].Key == i.Name {
+			if i.Deleted || !items[n-1].Deleted {
+				continue
+			}
+			items = items[:n-1]
+		}
+		if i.Deleted && i.Metadata[AzureDirBlobMetadataKey] != "" {
+			// there's nothing in a deleted directory blob
+			continue
+		}
+
 		if i.Metadata[AzureDirBlobMetadataKey] != "" {
 			i.Name = i.Name + "/"
 
@@ -594,22 +710,14 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 			LastModified: PTime(p.LastModified),
 			Size:         uint64(*p.ContentLength),
 			StorageClass: PString(string(p.AccessTier)),
+			Crtime:       p.CreationTime,
+			Deleted:      i.Deleted,
 		})
 	}
 
-	if strings.HasSuffix(options.Prefix, "/") {
-		// because azure doesn't use dir/ blobs, dir/ would not show up
-		// so we make another request to fill that in
-		dirBlob, err := b.HeadBlob(&HeadBlobInput{options.Prefix})
-		if err == nil {
-			*dirBlob.Key += "/"
-			items = append(items, dirBlob.BlobItemOutput)
-			sortItems = true
-		} else if err == fuse.ENOENT {
-			err = nil
-		} else {
-			return nil, err
-		}
+	if dirBlob != nil {
+		items = append(items, *dirBlob)
+		sortItems = true
 	}
 
 	// items are supposed to be alphabetical, but if there was a directory we would
@@ -631,6 +739,180 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	}, nil
 }
 
+// the version id of a blob itself, the others are its snapshots
+const AZBLOB_CURRENT_VERSION = "current"
+
+// ListBlobVersions lists snapshots as the older versions of a blob.
+// Azure only lists them in flat listings, so a delimiter is done
+// here: what's under a prefix is listed too, and only the prefix is
+// returned. KeyMarker is the azure marker and VersionIdMarker is the
+// last prefix returned, so the next page doesn't have it again
+func (b *AZBlob) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	c, err := b.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := nilStr(param.Prefix)
+	delim := nilStr(param.Delimiter)
+	lastPrefix := nilStr(param.VersionIdMarker)
+
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+
+	out := &ListBlobVersionsOutput{}
+	marker := azblob.Marker{Val: param.KeyMarker}
+	// versions of the same blob, oldest first the way azure lists
+	// them: the snapshots and then the blob itself
+	var group []BlobVersionOutput
+	flush := func() {
+		for i := len(group) - 1; i >= 0; i-- {
+			out.Versions = append(out.Versions, group[i])
+		}
+		group = group[:0]
+	}
+
+	// a blob's versions could be split across pages, we keep going
+	// until a page ends with a blob itself
+	for {
+		resp, err := c.ListBlobsFlatSegment(ctx, marker,
+			azblob.ListBlobsSegmentOptions{
+				Prefix:     prefix,
+				MaxResults: int32(nilUint32(param.MaxKeys)),
+				Details: azblob.BlobListingDetails{
+					Metadata:  true,
+					Snapshots: true,
+				},
+			})
+		if err != nil {
+			return nil, b.mapAZBError(err)
+		}
+		out.RequestId = resp.RequestID()
+
+		items := resp.Segment.BlobItems
+		for i := range items {
+			item := &items[i]
+			name := item.Name
+			if item.Metadata[AzureDirBlobMetadataKey] != "" {
+				name += "/"
+			}
+
+			if delim != "" {
+				if idx := strings.Index(name[len(prefix):], delim); idx != -1 {
+					p := name[:len(prefix)+idx+len(delim)]
+					if p != lastPrefix {
+						lastPrefix = p
+						out.Prefixes = append(out.Prefixes,
+							BlobPrefixOutput{Prefix: PString(p)})
+					}
+					continue
+				}
+			}
+			if strings.HasSuffix(name, "/") {
+				// a directory, there's nothing to read
+				continue
+			}
+
+			if len(group) != 0 && *group[0].Key != name {
+				flush()
+			}
+			props := &item.Properties
+			v := BlobVersionOutput{
+				BlobItemOutput: BlobItemOutput{
+					Key:          PString(name),
+					ETag:         PString(string(props.Etag)),
+					LastModified: PTime(props.LastModified),
+					Size:         uint64(*props.ContentLength),
+					StorageClass: PString(string(props.AccessTier)),
+				},
+				VersionId: PString(item.Snapshot),
+			}
+			if item.Snapshot == "" {
+				v.VersionId = PString(AZBLOB_CURRENT_VERSION)
+				v.IsLatest = true
+			}
+			group = append(group, v)
+		}
+
+		marker = resp.NextMarker
+		if !marker.NotDone() || len(items) == 0 || items[len(items)-1].Snapshot == "" {
+			break
+		}
+	}
+	flush()
+
+	if marker.NotDone() {
+		out.NextKeyMarker = marker.Val
+		out.NextVersionIdMarker = PString(lastPrefix)
+		out.IsTruncated = true
+	}
+	return out, nil
+}
+
+// ListDeletedBlobs is for --undelete. Soft deleted blobs are only
+// listed when asked for, and come with the live ones
+func (b *AZBlob) ListDeletedBlobs(prefix string) ([]string, error) {
+	c, err := b.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+
+	live := make(map[string]bool)
+	var deleted []string
+	marker := azblob.Marker{}
+	for marker.NotDone() {
+		resp, err := c.ListBlobsHierarchySegment(ctx, marker, "/",
+			azblob.ListBlobsSegmentOptions{
+				Prefix: prefix,
+				Details: azblob.BlobListingDetails{
+					Deleted: true,
+				},
+			})
+		if err != nil {
+			return nil, b.mapAZBError(err)
+		}
+
+		for _, i := range resp.Segment.BlobItems {
+			name := i.Name[len(prefix):]
+			if i.Deleted {
+				deleted = append(deleted, name)
+			} else {
+				live[name] = true
+			}
+		}
+		marker = resp.NextMarker
+	}
+
+	// replaced ones are there as deleted too, and a blob can be
+	// deleted more than once
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range deleted {
+		if !live[name] && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// UndeleteBlob brings back a soft deleted blob, and the snapshots
+// that were deleted with it
+func (b *AZBlob) UndeleteBlob(key string) error {
+	c, err := b.refreshToken()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	_, err = c.NewBlobURL(key).Undelete(ctx)
+	return b.mapAZBError(err)
+}
+
 func (b *AZBlob) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	c, err := b.refreshToken()
 	if err != nil {
@@ -642,14 +924,189 @@ func (b *AZBlob) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key)
-	_, err = blob.Delete(context.TODO(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 	return &DeleteBlobOutput{}, nil
 }
 
-func (b *AZBlob) DeleteBlobs(param *DeleteBlobsInput) (ret *DeleteBlobsOutput, deleteError error) {
+// a blob batch can't have more than this many requests
+const AZB_BATCH_SIZE = 256
+
+// azbSignOnly ends a pipeline without sending the request, the
+// policies before it have signed it by then
+var azbSignOnly = pipeline.FactoryFunc(
+	func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			return pipeline.NewHTTPResponse(&http.Response{
+				StatusCode: http.StatusAccepted,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+			}), nil
+		}
+	})
+
+// responseError is the errno for a response that's not what we
+// wanted, nil if we don't have one
+func (b *AZBlob) responseError(r *http.Response) error {
+	err := b.mapErrorCode(r.Header.Get("x-ms-error-code"))
+	if err == nil {
+		err = b.mapHttpError(r.StatusCode)
+	}
+	return err
+}
+
+func (b *AZBlob) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	if b.config.Endpoint == AzuriteEndpoint {
+		// XXX Azurite doesn't have blob batch
+		return b.deleteBlobsOneByOne(param)
+	}
+
+	c, err := b.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]error)
+	for keys := param.Items; len(keys) != 0; {
+		n := MinInt(len(keys), AZB_BATCH_SIZE)
+		err = b.deleteBatch(param.Context, c, keys[:n], failed)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[n:]
+	}
+	if len(failed) != 0 {
+		return nil, &DeleteBlobsError{Failed: failed}
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+// deleteBatch deletes keys with one blob batch request, and adds
+// the ones that couldn't be deleted to failed. The error is for the
+// whole batch
+func (b *AZBlob) deleteBatch(ctx context.Context, c *azblob.ContainerURL, keys []string, failed map[string]error) error {
+	boundary := "batch_" + uuid.New().String()
+	var body bytes.Buffer
+
+	for i, key := range keys {
+		// dir/ is dir with hdi_isfolder
+		u := c.NewBlobURL(strings.TrimSuffix(key, "/")).URL()
+		sub, err := pipeline.NewRequest(http.MethodDelete, u, nil)
+		if err != nil {
+			return err
+		}
+		// each one is signed as if it was sent on its own
+		_, err = b.signer.Do(context.Background(), nil, sub)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&body, "--%v\r\n"+
+			"Content-Type: application/http\r\n"+
+			"Content-Transfer-Encoding: binary\r\n"+
+			"Content-ID: %v\r\n\r\n", boundary, i)
+		fmt.Fprintf(&body, "%v %v HTTP/1.1\r\n", sub.Method, sub.URL.RequestURI())
+		sub.Header.Write(&body)
+		body.WriteString("Content-Length: 0\r\n\r\n")
+	}
+	fmt.Fprintf(&body, "--%v--\r\n", boundary)
+
+	u := c.URL()
+	q := u.Query()
+	q.Set("restype", "container")
+	q.Set("comp", "batch")
+	u.RawQuery = q.Encode()
+
+	req, err := pipeline.NewRequest(http.MethodPost, u, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	req.Header.Set("x-ms-version", azblob.ServiceVersion)
+
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	resp, err := b.pipeline.Do(ctx, nil, req)
+	if err != nil {
+		return b.mapAZBError(err)
+	}
+	r := resp.Response()
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusAccepted {
+		err = b.responseError(r)
+		if err == nil {
+			azbLog.Errorf("blob batch status=%v code=%v", r.Status,
+				r.Header.Get("x-ms-error-code"))
+			err = syscall.EIO
+		}
+		return err
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	answered := make([]bool, len(keys))
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return b.mapAZBError(err)
+		}
+
+		id := i
+		if contentId := part.Header.Get("Content-ID"); contentId != "" {
+			id, err = strconv.Atoi(contentId)
+			if err != nil {
+				return fmt.Errorf("blob batch: bad Content-ID %v", contentId)
+			}
+		}
+
+		// the CRLF that ends the headers goes with the boundary
+		subResp, err := http.ReadResponse(bufio.NewReader(
+			io.MultiReader(part, strings.NewReader("\r\n"))), nil)
+		if err != nil {
+			return b.mapAZBError(err)
+		}
+		subResp.Body.Close()
+
+		if id < 0 || id >= len(keys) {
+			continue
+		}
+		answered[id] = true
+
+		switch subResp.StatusCode {
+		case http.StatusAccepted, http.StatusNotFound:
+			// gone either way
+		default:
+			err = b.responseError(subResp)
+			if err == nil {
+				azbLog.Errorf("delete %v status=%v code=%v", keys[id],
+					subResp.Status, subResp.Header.Get("x-ms-error-code"))
+				err = syscall.EIO
+			}
+			failed[keys[id]] = err
+		}
+	}
+
+	for i, ok := range answered {
+		if !ok {
+			failed[keys[i]] = syscall.EIO
+		}
+	}
+	return nil
+}
+
+func (b *AZBlob) deleteBlobsOneByOne(param *DeleteBlobsInput) (ret *DeleteBlobsOutput, deleteError error) {
 	var wg sync.WaitGroup
 	defer func() {
 		wg.Wait()
@@ -670,9 +1127,9 @@ func (b *AZBlob) DeleteBlobs(param *DeleteBlobsInput) (ret *DeleteBlobsOutput, d
 				wg.Done()
 			}()
 
-			_, err := b.DeleteBlob(&DeleteBlobInput{key})
+			_, err := b.DeleteBlob(&DeleteBlobInput{Key: key})
 			if err != nil {
-				err = mapAZBError(err)
+				err = b.mapAZBError(err)
 				if err != fuse.ENOENT {
 					deleteError = err
 				}
@@ -691,7 +1148,35 @@ func (b *AZBlob) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
 	return nil, syscall.ENOTSUP
 }
 
+// setMetadata replaces the metadata of key without copying it, which
+// also leaves its content type alone
+func (b *AZBlob) setMetadata(ctx context.Context, key string, metadata map[string]*string) (*CopyBlobOutput, error) {
+	c, err := b.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	m := nilMetadata(metadata)
+	if strings.HasSuffix(key, "/") {
+		// directory blobs are stored without the /
+		key = key[:len(key)-1]
+		m[AzureDirBlobMetadataKey] = "true"
+	}
+
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+	_, err = c.NewBlobURL(key).SetMetadata(ctx, m, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, b.mapAZBError(err)
+	}
+	return &CopyBlobOutput{}, nil
+}
+
 func (b *AZBlob) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	if param.Source == param.Destination && param.Metadata != nil {
+		return b.setMetadata(param.Context, param.Source, param.Metadata)
+	}
+
 	if strings.HasSuffix(param.Source, "/") && strings.HasSuffix(param.Destination, "/") {
 		param.Source = param.Source[:len(param.Source)-1]
 		param.Destination = param.Destination[:len(param.Destination)-1]
@@ -705,30 +1190,69 @@ func (b *AZBlob) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 
 	src := c.NewBlobURL(param.Source)
 	dest := c.NewBlobURL(param.Destination)
-	resp, err := dest.StartCopyFromURL(context.TODO(), src.URL(), nilMetadata(param.Metadata),
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	resp, err := dest.StartCopyFromURL(ctx, src.URL(), nilMetadata(param.Metadata),
 		azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{})
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 
 	if resp.CopyStatus() == azblob.CopyStatusPending {
 		time.Sleep(50 * time.Millisecond)
 
+		// the copy can take a while, only each poll has a deadline
+		getProperties := func() (*azblob.BlobGetPropertiesResponse, error) {
+			ctx, cancel := b.requestContext(param.Context)
+			defer cancel()
+			return dest.GetProperties(ctx, azblob.BlobAccessConditions{})
+		}
+
 		var copy *azblob.BlobGetPropertiesResponse
-		for copy, err = dest.GetProperties(context.TODO(), azblob.BlobAccessConditions{}); err == nil; copy, err = dest.GetProperties(context.TODO(), azblob.BlobAccessConditions{}) {
+		for copy, err = getProperties(); err == nil; copy, err = getProperties() {
 			// if there's a new copy, we can only assume the last one was done
 			if copy.CopyStatus() != azblob.CopyStatusPending || copy.CopyID() != resp.CopyID() {
 				break
 			}
 		}
 		if err != nil {
-			return nil, mapAZBError(err)
+			return nil, b.mapAZBError(err)
+		}
+	}
+
+	if param.ContentType != nil {
+		// the copy keeps the source's, the rest of the
+		// headers have to be set along with it
+		err = b.setContentType(dest, *param.ContentType)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return &CopyBlobOutput{}, nil
 }
 
+func (b *AZBlob) setContentType(blob azblob.BlobURL, contentType string) error {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+
+	props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return b.mapAZBError(err)
+	}
+	headers := props.NewHTTPHeaders()
+	if headers.ContentType == contentType {
+		return nil
+	}
+	headers.ContentType = contentType
+
+	_, err = blob.SetHTTPHeaders(ctx, headers, azblob.BlobAccessConditions{})
+	if err != nil {
+		return b.mapAZBError(err)
+	}
+	return nil
+}
+
 func (b *AZBlob) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 	c, err := b.refreshToken()
 	if err != nil {
@@ -736,20 +1260,22 @@ func (b *AZBlob) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key)
-	var ifMatch azblob.ETag
-	if param.IfMatch != nil {
-		ifMatch = azblob.ETag(*param.IfMatch)
+	if param.VersionId != nil && *param.VersionId != AZBLOB_CURRENT_VERSION {
+		// one of its snapshots
+		blob = blob.WithSnapshot(*param.VersionId)
 	}
-
-	resp, err := blob.Download(context.TODO(),
+	ctx, cancel := b.requestContext(param.Context)
+	resp, err := blob.Download(ctx,
 		int64(param.Start), int64(param.Count),
-		azblob.BlobAccessConditions{
-			ModifiedAccessConditions: azblob.ModifiedAccessConditions{
-				IfMatch: ifMatch,
-			},
-		}, false)
+		azbIfMatch(param.IfMatch), false)
 	if err != nil {
-		return nil, mapAZBError(err)
+		cancel()
+		err = b.mapAZBError(err)
+		if err == syscall.EBUSY && param.IfMatch != nil {
+			// replaced since we started reading it
+			err = syscall.ESTALE
+		}
+		return nil, err
 	}
 
 	metadata := pMetadata(resp.NewMetadata())
@@ -766,10 +1292,30 @@ func (b *AZBlob) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 			ContentType: PString(resp.ContentType()),
 			Metadata:    metadata,
 		},
-		Body: resp.Body(azblob.RetryReaderOptions{}),
+		Body:     cancelOnClose{resp.Body(azblob.RetryReaderOptions{}), cancel},
+		Checksum: azbChecksum(param, resp),
 	}, nil
 }
 
+// azbChecksum is the Content-MD5 of the blob, if it has one. It's only
+// there if whoever uploaded it set it, we don't
+func azbChecksum(param *GetBlobInput, resp *azblob.DownloadResponse) *BlobChecksum {
+	if !param.Checksum || !isWholeRange(resp.ContentRange()) {
+		return nil
+	}
+
+	md5 := resp.ContentMD5()
+	if len(md5) == 0 {
+		// a range, even one that's all of it, has the md5 of
+		// the blob here instead
+		md5 = resp.BlobContentMD5()
+	}
+	if len(md5) == 0 {
+		return nil
+	}
+	return &BlobChecksum{Algorithm: "md5", Value: md5}
+}
+
 func (b *AZBlob) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	c, err := b.refreshToken()
 	if err != nil {
@@ -795,14 +1341,16 @@ func (b *AZBlob) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key).ToBlockBlobURL()
-	resp, err := blob.Upload(context.TODO(),
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	resp, err := blob.Upload(ctx,
 		body,
 		azblob.BlobHTTPHeaders{
 			ContentType: nilStr(param.ContentType),
 		},
-		nilMetadata(param.Metadata), azblob.BlobAccessConditions{})
+		nilMetadata(param.Metadata), azbIf(param.IfMatch, param.IfNotExists))
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBCreateError(err, param.IfNotExists)
 	}
 
 	return &PutBlobOutput{
@@ -833,15 +1381,20 @@ func (b *AZBlob) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobA
 	blockId := fmt.Sprintf(*param.Commit.UploadId, param.PartNumber)
 	base64BlockId := base64.StdEncoding.EncodeToString([]byte(blockId))
 
-	atomic.AddUint32(&param.Commit.NumParts, 1)
-
-	_, err = blob.StageBlock(context.TODO(), base64BlockId, param.Body,
-		azblob.LeaseAccessConditions{}, nil)
+	err = retryPart(azbLog, *param.Commit.Key, param.PartNumber, param.Body,
+		b.config.MaxRetries, func() (bool, error) {
+			ctx, cancel := b.requestContext(param.Context)
+			defer cancel()
+			_, err := blob.StageBlock(ctx, base64BlockId, param.Body,
+				azblob.LeaseAccessConditions{}, nil)
+			return azbRetryable(err), err
+		})
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 
 	param.Commit.Parts[param.PartNumber-1] = &base64BlockId
+	atomic.AddUint32(&param.Commit.NumParts, 1)
 
 	return &MultipartBlobAddOutput{}, nil
 }
@@ -864,11 +1417,13 @@ func (b *AZBlob) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multipar
 		parts[i] = *param.Parts[i]
 	}
 
-	resp, err := blob.CommitBlockList(context.TODO(), parts,
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	resp, err := blob.CommitBlockList(ctx, parts,
 		azblob.BlobHTTPHeaders{}, nilMetadata(param.Metadata),
-		azblob.BlobAccessConditions{})
+		azbIf(param.IfMatch, param.IfNotExists))
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBCreateError(err, param.IfNotExists)
 	}
 
 	return &MultipartBlobCommitOutput{
@@ -876,7 +1431,146 @@ func (b *AZBlob) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multipar
 	}, nil
 }
 
+// azbUploadId is the upload a block we staged belongs to, from its
+// base64 block id
+func azbUploadId(blockId string) (string, bool) {
+	name, err := base64.StdEncoding.DecodeString(blockId)
+	if err != nil {
+		return "", false
+	}
+	sep := strings.LastIndex(string(name), "::")
+	if sep == -1 {
+		return "", false
+	}
+	return string(name[:sep]) + "::%05d", true
+}
+
+// MultipartExpire discards the blocks of uploads that were never
+// committed. Until they are, the blob is listed as empty if we also
+// ask for uncommitted blobs. Blocks staged on top of a blob that
+// already existed don't show up, azure drops those after a week
 func (b *AZBlob) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	c, err := b.refreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	olderThan := param.OlderThan
+	if olderThan == 0 {
+		olderThan = 48 * time.Hour
+	}
+	expireBefore := time.Now().Add(-olderThan)
+
+	out := &MultipartExpireOutput{}
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ctx, cancel := b.requestContext(nil)
+		resp, err := c.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: param.Prefix,
+			Details: azblob.BlobListingDetails{
+				UncommittedBlobs: true,
+			},
+		})
+		cancel()
+		if err != nil {
+			return out, b.mapAZBError(err)
+		}
+		marker = resp.NextMarker
+
+		for _, i := range resp.Segment.BlobItems {
+			p := &i.Properties
+			if p.ContentLength == nil || *p.ContentLength != 0 ||
+				p.LastModified.IsZero() || p.LastModified.After(expireBefore) {
+				continue
+			}
+
+			upload, err := b.expireUpload(c, i.Name, p.LastModified, param)
+			if err == syscall.EACCES {
+				return out, err
+			} else if err != nil {
+				// someone else may have finished it
+				// in the mean time
+				azbLog.Debugf("expire %v = %v", i.Name, err)
+			} else if upload != nil {
+				out.Aborted = append(out.Aborted, *upload)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// expireUpload discards the uncommitted blocks of key if it's an
+// upload that isn't live, and returns what it was
+func (b *AZBlob) expireUpload(c *azblob.ContainerURL, key string, initiated time.Time,
+	param *MultipartExpireInput) (*ExpiredUpload, error) {
+
+	blob := c.NewBlockBlobURL(key)
+
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	blocks, err := blob.GetBlockList(ctx, azblob.BlockListAll, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return nil, b.mapAZBError(err)
+	}
+	if len(blocks.CommittedBlocks) != 0 || len(blocks.UncommittedBlocks) == 0 {
+		// a real blob after all
+		return nil, nil
+	}
+
+	uploadId, ok := azbUploadId(blocks.UncommittedBlocks[0].Name)
+	if !ok {
+		// not one of ours
+		return nil, nil
+	}
+	if param.Live != nil && param.Live(uploadId) {
+		azbLog.Debugf("Keeping MPU Key=%v Id=%v", key, uploadId)
+		return nil, nil
+	}
+
+	var size uint64
+	for _, block := range blocks.UncommittedBlocks {
+		size += uint64(block.Size)
+	}
+
+	if !param.DryRun {
+		// there's no way to delete uncommitted blocks, but
+		// putting a blob in their place discards them. If the
+		// upload was committed in the mean time this fails
+		put, err := blob.Upload(ctx, bytes.NewReader([]byte("")),
+			azblob.BlobHTTPHeaders{}, nil,
+			azblob.BlobAccessConditions{
+				ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+					IfNoneMatch: azblob.ETagAny,
+				},
+			})
+		if err != nil {
+			return nil, b.mapAZBError(err)
+		}
+
+		_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone,
+			azblob.BlobAccessConditions{
+				ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+					IfMatch: put.ETag(),
+				},
+			})
+		if err != nil {
+			return nil, b.mapAZBError(err)
+		}
+	}
+
+	return &ExpiredUpload{
+		Key:       key,
+		UploadId:  uploadId,
+		Initiated: initiated,
+		Size:      size,
+	}, nil
+}
+
+func (b *AZBlob) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	// block blobs could, by committing the old block list with
+	// ours after it, but objects written with PutBlob don't have
+	// a block list
 	return nil, syscall.ENOTSUP
 }
 
@@ -886,9 +1580,11 @@ func (b *AZBlob) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, er
 		return nil, err
 	}
 
-	_, err = c.Delete(context.TODO(), azblob.ContainerAccessConditions{})
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	_, err = c.Delete(ctx, azblob.ContainerAccessConditions{})
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 	return &RemoveBucketOutput{}, nil
 }
@@ -899,9 +1595,16 @@ func (b *AZBlob) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
 		return nil, err
 	}
 
-	_, err = c.Create(context.TODO(), nil, azblob.PublicAccessNone)
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	_, err = c.Create(ctx, nil, azblob.PublicAccessNone)
 	if err != nil {
-		return nil, mapAZBError(err)
+		return nil, b.mapAZBError(err)
 	}
 	return &MakeBucketOutput{}, nil
 }
+
+func (b *AZBlob) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	// we would have to list the whole container
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,690 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"github.com/jacobsa/fuse"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCS talks to Google Cloud Storage with the JSON api. Unlike GCS3
+// it doesn't need HMAC keys, and it has compose and conditional
+// writes
+type GCS struct {
+	cap Capabilities
+
+	flags *FlagStorage
+	errorMap
+	opTimeout
+	config *GCSConfig
+
+	client     *storage.Client
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+var gcsLog = GetLogger("gcs")
+
+// parts of multipart uploads are objects under here until the
+// commit composes them, listings don't show them
+const GCS_MPU_PREFIX = ".goofys-mpu/"
+
+// compose takes at most this many objects at a time
+const GCS_MAX_COMPOSE = 32
+
+// what MultipartBlobBegin was given that the commit needs
+type gcsMultipart struct {
+	contentType  *string
+	storageClass *string
+}
+
+func IsGCSEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "gs://")
+}
+
+func NewGCS(bucket string, flags *FlagStorage, config *GCSConfig) (*GCS, error) {
+	var opts []option.ClientOption
+	if config.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(config.CredentialsFile))
+	}
+	// otherwise the Application Default Credentials
+
+	return newGCS(bucket, flags, config, opts...)
+}
+
+// newGCS is NewGCS with the client options already made, tests use
+// it to talk to a fake server
+func newGCS(bucket string, flags *FlagStorage, config *GCSConfig,
+	opts ...option.ClientOption) (*GCS, error) {
+
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create gcs client: %v", err)
+	}
+
+	return &GCS{
+		cap: Capabilities{
+			Name:               "gs",
+			ConditionalWrite:   true,
+			ConditionalCreate:  true,
+			ResumableMultipart: true,
+			StorageClass:       true,
+			AnyPartSize:        true,
+			MaxKeyLength:       1024,
+			InvalidKeyChars:    "\r\n",
+			MaxMetadataSize:    8 * 1024,
+			MaxObjectSize:      5 * 1024 * 1024 * 1024 * 1024,
+		},
+		flags:      flags,
+		errorMap:   errorMap(flags.ErrorMap),
+		opTimeout:  opTimeout(flags.OpTimeout),
+		config:     config,
+		client:     client,
+		bucket:     client.Bucket(bucket),
+		bucketName: bucket,
+	}, nil
+}
+
+func (g *GCS) Init(key string) error {
+	_, err := g.HeadBlob(&HeadBlobInput{Key: key})
+	if err == fuse.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+func (g *GCS) Capabilities() *Capabilities {
+	return &g.cap
+}
+
+func (g *GCS) Bucket() string {
+	return g.bucketName
+}
+
+func (g *GCS) ObjectLocation(key string) objectLocation {
+	return objectLocation{
+		Endpoint: "https://storage.googleapis.com",
+		Key:      key,
+		URL:      "gs://" + g.bucketName + "/" + key,
+	}
+}
+
+func (m errorMap) mapGCSError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch err {
+	case storage.ErrObjectNotExist:
+		return fuse.ENOENT
+	case storage.ErrBucketNotExist:
+		return syscall.ENODEV
+	}
+
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		if len(apiErr.Errors) != 0 {
+			if e := m.mapErrorCode(apiErr.Errors[0].Reason); e != nil {
+				return e
+			}
+		}
+		if apiErr.Code == 412 {
+			// generation didn't match
+			return syscall.EBUSY
+		}
+		if e := m.mapHttpError(apiErr.Code); e != nil {
+			return e
+		}
+		gcsLog.Errorf("code=%v err=%v", apiErr.Code, apiErr.Message)
+		return apiErr
+	} else if timedOut(err) {
+		return syscall.ETIMEDOUT
+	} else {
+		return err
+	}
+}
+
+// the etag we give out is the generation, because that's what
+// conditional requests take
+func gcsETag(generation int64) *string {
+	return PString("\"" + strconv.FormatInt(generation, 10) + "\"")
+}
+
+func gcsGeneration(etag string) (int64, bool) {
+	gen, err := strconv.ParseInt(strings.Trim(etag, "\""), 10, 64)
+	return gen, err == nil && gen != 0
+}
+
+// gcsIf is obj that fails with EBUSY unless it's still at the
+// generation of ifMatch, or doesn't exist yet with ifNotExists
+func gcsIf(obj *storage.ObjectHandle, ifMatch *string, ifNotExists bool) (*storage.ObjectHandle, error) {
+	if ifNotExists {
+		return obj.If(storage.Conditions{DoesNotExist: true}), nil
+	}
+	if ifMatch == nil {
+		return obj, nil
+	}
+	gen, ok := gcsGeneration(*ifMatch)
+	if !ok {
+		// not one of ours, it can't match
+		return nil, syscall.EBUSY
+	}
+	return obj.If(storage.Conditions{GenerationMatch: gen}), nil
+}
+
+func gcsItem(attrs *storage.ObjectAttrs) BlobItemOutput {
+	item := BlobItemOutput{
+		Key:          PString(attrs.Name),
+		ETag:         gcsETag(attrs.Generation),
+		LastModified: PTime(attrs.Updated),
+		Size:         uint64(attrs.Size),
+		StorageClass: PString(attrs.StorageClass),
+	}
+	if !attrs.Created.IsZero() {
+		item.Crtime = PTime(attrs.Created)
+	}
+	return item
+}
+
+func (g *GCS) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	ctx, cancel := g.requestContext(param.Context)
+	defer cancel()
+	attrs, err := g.bucket.Object(param.Key).Attrs(ctx)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+
+	return &HeadBlobOutput{
+		BlobItemOutput: gcsItem(attrs),
+		ContentType:    PString(attrs.ContentType),
+		Metadata:       pMetadata(attrs.Metadata),
+		IsDirBlob:      strings.HasSuffix(param.Key, "/"),
+	}, nil
+}
+
+func (g *GCS) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var token string
+	if param.ContinuationToken != nil {
+		token = *param.ContinuationToken
+	} else if param.StartAfter != nil {
+		// like azure, the client we have can't start a listing
+		// anywhere but the beginning
+		return nil, syscall.ENOTSUP
+	}
+
+	q := &storage.Query{
+		Prefix:    nilStr(param.Prefix),
+		Delimiter: nilStr(param.Delimiter),
+	}
+
+	maxKeys := 1000
+	if param.MaxKeys != nil {
+		maxKeys = int(*param.MaxKeys)
+	}
+
+	ctx, cancel := g.requestContext(param.Context)
+	defer cancel()
+
+	var page []*storage.ObjectAttrs
+	next, err := iterator.NewPager(g.bucket.Objects(ctx, q), maxKeys, token).
+		NextPage(&page)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+
+	prefixes := make([]BlobPrefixOutput, 0)
+	items := getListItems()
+
+	for _, attrs := range page {
+		if attrs.Prefix != "" {
+			if attrs.Prefix == GCS_MPU_PREFIX {
+				continue
+			}
+			prefixes = append(prefixes, BlobPrefixOutput{
+				Prefix: PString(attrs.Prefix),
+			})
+		} else {
+			if strings.HasPrefix(attrs.Name, GCS_MPU_PREFIX) {
+				continue
+			}
+			items = append(items, gcsItem(attrs))
+		}
+	}
+
+	var nextToken *string
+	if next != "" {
+		nextToken = &next
+	}
+
+	return &ListBlobsOutput{
+		Prefixes:              prefixes,
+		Items:                 items,
+		NextContinuationToken: nextToken,
+		IsTruncated:           nextToken != nil,
+	}, nil
+}
+
+func (g *GCS) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (g *GCS) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	ctx, cancel := g.requestContext(param.Context)
+	defer cancel()
+	err := g.bucket.Object(param.Key).Delete(ctx)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return &DeleteBlobOutput{}, nil
+}
+
+func (g *GCS) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	// there's a batch api but the client doesn't do it
+	for _, key := range param.Items {
+		_, err := g.DeleteBlob(&DeleteBlobInput{Key: key})
+		if err != nil && err != fuse.ENOENT {
+			return nil, err
+		}
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+func (g *GCS) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	_, err := g.CopyBlob(&CopyBlobInput{
+		Source:      param.Source,
+		Destination: param.Destination,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = g.DeleteBlob(&DeleteBlobInput{Key: param.Source})
+	if err != nil {
+		return nil, err
+	}
+	return &RenameBlobOutput{}, nil
+}
+
+func (g *GCS) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	src, err := gcsIf(g.bucket.Object(param.Source), param.ETag, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// rewrite is done in as many requests as it takes, Run
+	// follows the token
+	c := g.bucket.Object(param.Destination).CopierFrom(src)
+	if param.Metadata != nil {
+		c.Metadata = nilMetadata(param.Metadata)
+	}
+	if param.StorageClass != nil {
+		c.StorageClass = *param.StorageClass
+	}
+	if param.ContentType != nil {
+		c.ContentType = *param.ContentType
+	}
+
+	ctx, cancel := g.requestContext(param.Context)
+	defer cancel()
+	_, err = c.Run(ctx)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return &CopyBlobOutput{}, nil
+}
+
+func (g *GCS) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	obj, err := gcsIf(g.bucket.Object(param.Key), param.IfMatch, false)
+	if err != nil {
+		return nil, syscall.ESTALE
+	}
+
+	length := int64(-1)
+	if param.Count != 0 {
+		length = int64(param.Count)
+	}
+
+	ctx, cancel := g.requestContext(param.Context)
+	r, err := obj.NewRangeReader(ctx, int64(param.Start), length)
+	if err != nil {
+		cancel()
+		err = g.mapGCSError(err)
+		if err == syscall.EBUSY && param.IfMatch != nil {
+			// replaced since we started reading it
+			err = syscall.ESTALE
+		}
+		return nil, err
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          &param.Key,
+				ETag:         gcsETag(r.Attrs.Generation),
+				LastModified: PTime(r.Attrs.LastModified),
+				Size:         uint64(r.Remain()),
+			},
+			ContentType: PString(r.Attrs.ContentType),
+		},
+		Body: cancelOnClose{r, cancel},
+	}, nil
+}
+
+// write is an upload in a single request, of body to obj
+func (g *GCS) write(ctx context.Context, obj *storage.ObjectHandle, body io.Reader, contentType *string,
+	metadata map[string]*string, storageClass *string) (*storage.ObjectAttrs, error) {
+
+	if body == nil {
+		body = bytes.NewReader([]byte(""))
+	}
+
+	ctx, cancel := g.requestContext(ctx)
+	defer cancel()
+
+	w := obj.NewWriter(ctx)
+	// we already have it all, no point in a resumable upload
+	w.ChunkSize = 0
+	w.ContentType = nilStr(contentType)
+	w.Metadata = nilMetadata(metadata)
+	w.StorageClass = nilStr(storageClass)
+
+	_, err := io.Copy(w, body)
+	if err != nil {
+		// fails the upload
+		cancel()
+		w.Close()
+		return nil, g.mapGCSError(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return w.Attrs(), nil
+}
+
+func (g *GCS) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	obj, err := gcsIf(g.bucket.Object(param.Key), param.IfMatch, param.IfNotExists)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if param.Body != nil {
+		body = param.Body
+	}
+	attrs, err := g.write(param.Context, obj, body, param.ContentType, param.Metadata,
+		param.StorageClass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PutBlobOutput{
+		ETag:         gcsETag(attrs.Generation),
+		StorageClass: PString(attrs.StorageClass),
+	}, nil
+}
+
+func gcsMPUDir(uploadId string) string {
+	return GCS_MPU_PREFIX + uploadId + "/"
+}
+
+// we can have up to 10K parts, so %05d sorts
+func gcsPartKey(uploadId string, partNumber uint32) string {
+	return fmt.Sprintf("%v%05d", gcsMPUDir(uploadId), partNumber)
+}
+
+// gcsComposeGroups splits keys into runs that can each be composed
+// in one request
+func gcsComposeGroups(keys []string) (groups [][]string) {
+	for len(keys) > GCS_MAX_COMPOSE {
+		groups = append(groups, keys[:GCS_MAX_COMPOSE])
+		keys = keys[GCS_MAX_COMPOSE:]
+	}
+	return append(groups, keys)
+}
+
+func (g *GCS) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	// parts go to their own objects, nothing to do on the server
+	// until the commit
+	uploadId := uuid.New().String()
+
+	return &MultipartBlobCommitInput{
+		Key:      &param.Key,
+		Metadata: param.Metadata,
+		UploadId: &uploadId,
+		Parts:    make([]*string, 10000),
+		IfMatch:  param.IfMatch,
+		backendData: &gcsMultipart{
+			contentType:  param.ContentType,
+			storageClass: param.StorageClass,
+		},
+		IfNotExists: param.IfNotExists,
+	}, nil
+}
+
+func (g *GCS) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	key := gcsPartKey(*param.Commit.UploadId, param.PartNumber)
+
+	// a part that's added again just replaces the object
+	_, err := g.write(param.Context, g.bucket.Object(key), param.Body, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.Commit.Parts[param.PartNumber-1] == nil {
+		atomic.AddUint32(&param.Commit.NumParts, 1)
+	}
+	param.Commit.Parts[param.PartNumber-1] = &key
+
+	return &MultipartBlobAddOutput{}, nil
+}
+
+// compose makes dest out of srcs, there can't be more than
+// GCS_MAX_COMPOSE of them
+func (g *GCS) compose(ctx context.Context, dest *storage.ObjectHandle, srcs []string,
+	config func(c *storage.Composer)) (*storage.ObjectAttrs, error) {
+
+	handles := make([]*storage.ObjectHandle, len(srcs))
+	for i, key := range srcs {
+		handles[i] = g.bucket.Object(key)
+	}
+
+	c := dest.ComposerFrom(handles...)
+	if config != nil {
+		config(c)
+	}
+
+	ctx, cancel := g.requestContext(ctx)
+	defer cancel()
+	attrs, err := c.Run(ctx)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return attrs, nil
+}
+
+func (g *GCS) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	keys := make([]string, param.NumParts)
+	for i := uint32(0); i < param.NumParts; i++ {
+		if param.Parts[i] == nil {
+			return nil, fmt.Errorf("part %v of %v is missing", i+1, *param.Key)
+		}
+		keys[i] = *param.Parts[i]
+	}
+	if len(keys) == 0 {
+		return nil, fuse.EINVAL
+	}
+
+	// fan in 32 at a time until they fit in one compose. The
+	// intermediate objects are under the upload's dir too, so
+	// they go away with the parts
+	for level := 0; len(keys) > GCS_MAX_COMPOSE; level++ {
+		groups := gcsComposeGroups(keys)
+		next := make([]string, len(groups))
+		for i, group := range groups {
+			next[i] = fmt.Sprintf("%vcompose-%v-%05d", gcsMPUDir(*param.UploadId),
+				level, i)
+			_, err := g.compose(param.Context, g.bucket.Object(next[i]), group, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys = next
+	}
+
+	dest, err := gcsIf(g.bucket.Object(*param.Key), param.IfMatch,
+		param.IfNotExists)
+	if err != nil {
+		return nil, err
+	}
+
+	mpu, _ := param.backendData.(*gcsMultipart)
+	attrs, err := g.compose(param.Context, dest, keys, func(c *storage.Composer) {
+		c.Metadata = nilMetadata(param.Metadata)
+		if mpu != nil {
+			c.ContentType = nilStr(mpu.contentType)
+			c.StorageClass = nilStr(mpu.storageClass)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// we have the object, the parts are just garbage now
+	err = g.deleteUpload(*param.UploadId)
+	if err != nil {
+		gcsLog.Warnf("Unable to clean up parts of %v: %v", *param.Key, err)
+	}
+
+	return &MultipartBlobCommitOutput{
+		ETag: gcsETag(attrs.Generation),
+	}, nil
+}
+
+// deleteUpload removes the parts of an upload, and anything composed
+// out of them on the way
+func (g *GCS) deleteUpload(uploadId string) error {
+	dir := gcsMPUDir(uploadId)
+	var token *string
+	for {
+		resp, err := g.list(dir, token)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, len(resp.Items))
+		for i, item := range resp.Items {
+			keys[i] = *item.Key
+		}
+		_, err = g.DeleteBlobs(&DeleteBlobsInput{Items: keys})
+		if err != nil {
+			return err
+		}
+		if !resp.IsTruncated {
+			return nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+// list is ListBlobs without hiding the parts of uploads
+func (g *GCS) list(prefix string, token *string) (*ListBlobsOutput, error) {
+	var t string
+	if token != nil {
+		t = *token
+	}
+
+	ctx, cancel := g.requestContext(nil)
+	defer cancel()
+
+	var page []*storage.ObjectAttrs
+	next, err := iterator.NewPager(g.bucket.Objects(ctx, &storage.Query{Prefix: prefix}),
+		1000, t).NextPage(&page)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+
+	items := make([]BlobItemOutput, len(page))
+	for i, attrs := range page {
+		items[i] = gcsItem(attrs)
+	}
+	return &ListBlobsOutput{
+		Items:                 items,
+		NextContinuationToken: PString(next),
+		IsTruncated:           next != "",
+	}, nil
+}
+
+func (g *GCS) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	err := g.deleteUpload(*param.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (g *GCS) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	// a lifecycle rule on .goofys-mpu/ does this better
+	return nil, syscall.ENOTSUP
+}
+
+func (g *GCS) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	// compose could do it, but the object would get a new
+	// generation anyway, that's no better than writing it again
+	return nil, syscall.ENOTSUP
+}
+
+func (g *GCS) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	ctx, cancel := g.requestContext(nil)
+	defer cancel()
+	err := g.bucket.Delete(ctx)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return &RemoveBucketOutput{}, nil
+}
+
+func (g *GCS) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	if g.config.ProjectId == "" {
+		// buckets belong to a project
+		return nil, syscall.ENOTSUP
+	}
+
+	ctx, cancel := g.requestContext(nil)
+	defer cancel()
+	err := g.bucket.Create(ctx, g.config.ProjectId, nil)
+	if err != nil {
+		return nil, g.mapGCSError(err)
+	}
+	return &MakeBucketOutput{}, nil
+}
+
+func (g *GCS) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	// only cloud monitoring knows, and that's hours behind
+	return nil, syscall.ENOTSUP
+}
@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"github.com/aws/aws-sdk-go/service/s3"
 
@@ -49,6 +50,11 @@ func NewGCS3(bucket string, flags *FlagStorage, config *S3Config) (*GCS3, error)
 	s := &GCS3{S3Backend: s3Backend}
 	s.S3Backend.gcs = true
 	s.S3Backend.cap.NoParallelMultipart = true
+	// the parts are a resumable upload that's only appended to
+	s.S3Backend.cap.ResumableMultipart = false
+	// there's no UploadPartCopy to append with
+	s.S3Backend.cap.SupportsAppend = false
+	s.S3Backend.cap.InvalidKeyChars = "\r\n"
 	return s, nil
 }
 
@@ -71,12 +77,17 @@ func (s *GCS3) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error)
 	}
 	wg.Wait()
 	if overallErr != nil {
-		return nil, mapAwsError(overallErr)
+		return nil, s.mapAwsError(overallErr)
 	}
 
 	return &DeleteBlobsOutput{}, nil
 }
 
+func (s *GCS3) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	// the XML API doesn't list generations
+	return nil, syscall.ENOTSUP
+}
+
 func (s *GCS3) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
 	mpu := s3.CreateMultipartUploadInput{
 		Bucket:       &s.bucket,
@@ -84,6 +95,9 @@ func (s *GCS3) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlo
 		StorageClass: &s.config.StorageClass,
 		ContentType:  param.ContentType,
 	}
+	if param.StorageClass != nil {
+		mpu.StorageClass = param.StorageClass
+	}
 
 	if s.config.UseSSE {
 		mpu.ServerSideEncryption = &s.sseType
@@ -106,14 +120,14 @@ func (s *GCS3) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlo
 	err := req.Send()
 	if err != nil {
 		s3Log.Errorf("CreateMultipartUpload %v = %v", param.Key, err)
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	location := req.HTTPResponse.Header.Get("Location")
 	_, err = url.Parse(location)
 	if err != nil {
 		s3Log.Errorf("CreateMultipartUpload %v %v = %v", param.Key, location, err)
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	return &MultipartBlobCommitInput{
@@ -168,7 +182,7 @@ func (s *GCS3) uploadPart(param *MultipartBlobAddInput, totalSize uint64, last b
 		if req.HTTPResponse.StatusCode == 308 {
 			err = nil
 		} else {
-			err = mapAwsError(err)
+			err = s.mapAwsError(err)
 			return
 		}
 	}
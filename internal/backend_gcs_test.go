@@ -0,0 +1,675 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"cloud.google.com/go/storage"
+	"github.com/jacobsa/fuse"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	. "gopkg.in/check.v1"
+)
+
+type GCSTest struct {
+}
+
+var _ = Suite(&GCSTest{})
+
+func (s *GCSTest) TestEndpoint(t *C) {
+	t.Assert(IsGCSEndpoint("gs://bucket"), Equals, true)
+	t.Assert(IsGCSEndpoint("gs://bucket/prefix"), Equals, true)
+	t.Assert(IsGCSEndpoint("bucket"), Equals, false)
+	t.Assert(IsGCSEndpoint("adl://bucket"), Equals, false)
+
+	spec, err := ParseBucketSpec("gs://bucket/dir/")
+	t.Assert(err, IsNil)
+	t.Assert(spec.Scheme, Equals, "gs")
+	t.Assert(spec.Bucket, Equals, "bucket")
+	t.Assert(spec.Prefix, Equals, "dir/")
+}
+
+func (s *GCSTest) TestETag(t *C) {
+	etag := gcsETag(1556300000123456)
+	t.Assert(*etag, Equals, "\"1556300000123456\"")
+
+	gen, ok := gcsGeneration(*etag)
+	t.Assert(ok, Equals, true)
+	t.Assert(gen, Equals, int64(1556300000123456))
+
+	// from another backend, or what GCS itself calls the etag
+	_, ok = gcsGeneration("\"d41d8cd98f00b204e9800998ecf8427e\"")
+	t.Assert(ok, Equals, false)
+	_, ok = gcsGeneration("CJ2y7aHn8+ECEAE=")
+	t.Assert(ok, Equals, false)
+	_, ok = gcsGeneration("")
+	t.Assert(ok, Equals, false)
+
+	_, err := gcsIf(nil, PString("\"abc\""), false)
+	t.Assert(err, Equals, syscall.EBUSY)
+}
+
+func (s *GCSTest) TestPartKey(t *C) {
+	t.Assert(gcsPartKey("upload", 1), Equals, GCS_MPU_PREFIX+"upload/00001")
+
+	// composed in the order they sort in
+	keys := []string{gcsPartKey("upload", 10), gcsPartKey("upload", 9),
+		gcsPartKey("upload", 10000)}
+	sort.Strings(keys)
+	t.Assert(keys, DeepEquals, []string{gcsPartKey("upload", 9),
+		gcsPartKey("upload", 10), gcsPartKey("upload", 10000)})
+}
+
+func (s *GCSTest) TestComposeGroups(t *C) {
+	keys := func(n int) (ret []string) {
+		for i := 0; i < n; i++ {
+			ret = append(ret, fmt.Sprintf("%v", i))
+		}
+		return
+	}
+
+	t.Assert(gcsComposeGroups(keys(1)), DeepEquals, [][]string{keys(1)})
+	t.Assert(gcsComposeGroups(keys(GCS_MAX_COMPOSE)), DeepEquals,
+		[][]string{keys(GCS_MAX_COMPOSE)})
+
+	groups := gcsComposeGroups(keys(GCS_MAX_COMPOSE*2 + 1))
+	t.Assert(len(groups), Equals, 3)
+	t.Assert(len(groups[0]), Equals, GCS_MAX_COMPOSE)
+	t.Assert(len(groups[1]), Equals, GCS_MAX_COMPOSE)
+	t.Assert(groups[2], DeepEquals, []string{fmt.Sprintf("%v", GCS_MAX_COMPOSE*2)})
+
+	// 10000 parts take two levels
+	groups = gcsComposeGroups(keys(10000))
+	t.Assert(len(groups), Equals, 313)
+	t.Assert(len(gcsComposeGroups(make([]string, len(groups)))), Equals, 10)
+}
+
+func (s *GCSTest) TestMapError(t *C) {
+	t.Assert(errorMap(nil).mapGCSError(nil), IsNil)
+	t.Assert(errorMap(nil).mapGCSError(storage.ErrObjectNotExist), Equals, fuse.ENOENT)
+	t.Assert(errorMap(nil).mapGCSError(storage.ErrBucketNotExist), Equals, syscall.ENODEV)
+	t.Assert(errorMap(nil).mapGCSError(&googleapi.Error{Code: 412}), Equals, syscall.EBUSY)
+	t.Assert(errorMap(nil).mapGCSError(&googleapi.Error{Code: 403}), Equals, syscall.EACCES)
+	t.Assert(errorMap(nil).mapGCSError(&googleapi.Error{Code: 429}), Equals, syscall.EAGAIN)
+}
+
+type gcsFakeObject struct {
+	data         []byte
+	generation   int64
+	contentType  string
+	storageClass string
+	metadata     map[string]string
+}
+
+// GCSServerTest talks to a fake of the parts of the JSON api we use,
+// with the objects of one bucket in a map
+type GCSServerTest struct {
+	server *httptest.Server
+	gcs    *GCS
+
+	mu         sync.Mutex
+	objects    map[string]*gcsFakeObject
+	generation int64
+}
+
+var _ = Suite(&GCSServerTest{})
+
+func (s *GCSServerTest) SetUpTest(t *C) {
+	s.objects = make(map[string]*gcsFakeObject)
+	s.generation = 1556300000000000
+
+	// the client reads objects over https no matter what the
+	// endpoint is
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	var err error
+	s.gcs, err = newGCS("bucket", &FlagStorage{}, &GCSConfig{},
+		option.WithEndpoint(s.server.URL+"/storage/v1/"),
+		option.WithHTTPClient(s.server.Client()))
+	t.Assert(err, IsNil)
+}
+
+func (s *GCSServerTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func gcsReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func gcsFakeError(w http.ResponseWriter, status int, reason string) {
+	gcsReply(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": reason,
+			"errors": []map[string]string{
+				{"reason": reason, "message": reason},
+			},
+		},
+	})
+}
+
+func (s *GCSServerTest) resource(key string) map[string]interface{} {
+	obj := s.objects[key]
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         "bucket",
+		"name":           key,
+		"generation":     strconv.FormatInt(obj.generation, 10),
+		"metageneration": "1",
+		"size":           strconv.Itoa(len(obj.data)),
+		"contentType":    obj.contentType,
+		"storageClass":   obj.storageClass,
+		"metadata":       obj.metadata,
+		"updated":        "2019-04-26T17:33:20Z",
+		"timeCreated":    "2019-04-26T17:33:20Z",
+	}
+}
+
+// matches is whether key is at the generation of param in q, which
+// is 0 for a key that doesn't exist
+func (s *GCSServerTest) matches(q url.Values, param string, key string) bool {
+	want := q.Get(param)
+	if want == "" {
+		return true
+	}
+	var gen int64
+	if obj, ok := s.objects[key]; ok {
+		gen = obj.generation
+	}
+	return want == strconv.FormatInt(gen, 10)
+}
+
+func (s *GCSServerTest) put(key string, obj *gcsFakeObject) {
+	s.generation++
+	obj.generation = s.generation
+	if obj.storageClass == "" {
+		obj.storageClass = "STANDARD"
+	}
+	s.objects[key] = obj
+}
+
+func (s *GCSServerTest) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// object names are escaped into a single segment
+	var p []string
+	for _, seg := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		seg, _ = url.PathUnescape(seg)
+		p = append(p, seg)
+	}
+	q := r.URL.Query()
+
+	switch {
+	case len(p) == 6 && p[0] == "upload" && r.Method == "POST":
+		s.upload(w, r)
+	case len(p) == 5 && p[0] == "storage" && r.Method == "GET":
+		s.list(w, q)
+	case len(p) == 6 && p[0] == "storage":
+		key := p[5]
+		if _, ok := s.objects[key]; !ok {
+			gcsFakeError(w, http.StatusNotFound, "notFound")
+		} else if r.Method == "DELETE" {
+			delete(s.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			gcsReply(w, http.StatusOK, s.resource(key))
+		}
+	case len(p) == 7 && p[6] == "compose":
+		s.compose(w, r, p[5])
+	case len(p) == 11 && p[6] == "rewriteTo":
+		s.rewrite(w, r, p[5], p[10])
+	case len(p) >= 2 && p[0] == "bucket" && r.Method == "GET":
+		s.read(w, r, strings.Join(p[1:], "/"))
+	default:
+		gcsFakeError(w, http.StatusBadRequest, "invalid")
+	}
+}
+
+func (s *GCSServerTest) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		gcsFakeError(w, http.StatusBadRequest, "invalid")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var attrs struct {
+		Name         string
+		ContentType  string
+		StorageClass string
+		Metadata     map[string]string
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&attrs)
+	}
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(part)
+	}
+	if err != nil {
+		gcsFakeError(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	if !s.matches(r.URL.Query(), "ifGenerationMatch", attrs.Name) {
+		gcsFakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return
+	}
+	s.put(attrs.Name, &gcsFakeObject{
+		data:         data,
+		contentType:  attrs.ContentType,
+		storageClass: attrs.StorageClass,
+		metadata:     attrs.Metadata,
+	})
+	gcsReply(w, http.StatusOK, s.resource(attrs.Name))
+}
+
+func (s *GCSServerTest) list(w http.ResponseWriter, q url.Values) {
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+
+	// keys and prefixes in the order they sort in
+	var names []string
+	isPrefix := make(map[string]bool)
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i != -1 {
+				dir := key[:len(prefix)+i+len(delim)]
+				if !isPrefix[dir] {
+					isPrefix[dir] = true
+					names = append(names, dir)
+				}
+				continue
+			}
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(q.Get("pageToken"))
+	end := len(names)
+	if max, err := strconv.Atoi(q.Get("maxResults")); err == nil && start+max < end {
+		end = start + max
+	}
+
+	items := make([]map[string]interface{}, 0)
+	prefixes := make([]string, 0)
+	for _, name := range names[start:end] {
+		if isPrefix[name] {
+			prefixes = append(prefixes, name)
+		} else {
+			items = append(items, s.resource(name))
+		}
+	}
+	resp := map[string]interface{}{
+		"kind":     "storage#objects",
+		"items":    items,
+		"prefixes": prefixes,
+	}
+	if end < len(names) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	gcsReply(w, http.StatusOK, resp)
+}
+
+func (s *GCSServerTest) compose(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct {
+		Destination struct {
+			ContentType  string
+			StorageClass string
+			Metadata     map[string]string
+		}
+		SourceObjects []struct {
+			Name string
+		}
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		gcsFakeError(w, http.StatusBadRequest, "invalid")
+		return
+	}
+	if len(req.SourceObjects) > GCS_MAX_COMPOSE {
+		gcsFakeError(w, http.StatusBadRequest, "invalid")
+		return
+	}
+	if !s.matches(r.URL.Query(), "ifGenerationMatch", key) {
+		gcsFakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return
+	}
+
+	var data []byte
+	for _, src := range req.SourceObjects {
+		obj, ok := s.objects[src.Name]
+		if !ok {
+			gcsFakeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		data = append(data, obj.data...)
+	}
+	s.put(key, &gcsFakeObject{
+		data:         data,
+		contentType:  req.Destination.ContentType,
+		storageClass: req.Destination.StorageClass,
+		metadata:     req.Destination.Metadata,
+	})
+	gcsReply(w, http.StatusOK, s.resource(key))
+}
+
+func (s *GCSServerTest) rewrite(w http.ResponseWriter, r *http.Request, src string, dest string) {
+	obj, ok := s.objects[src]
+	if !ok {
+		gcsFakeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	if !s.matches(r.URL.Query(), "ifSourceGenerationMatch", src) {
+		gcsFakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return
+	}
+
+	copied := *obj
+	s.put(dest, &copied)
+	gcsReply(w, http.StatusOK, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"done":                true,
+		"totalBytesRewritten": strconv.Itoa(len(obj.data)),
+		"objectSize":          strconv.Itoa(len(obj.data)),
+		"resource":            s.resource(dest),
+	})
+}
+
+func (s *GCSServerTest) read(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := s.objects[key]
+	if !ok {
+		gcsFakeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	if !s.matches(r.URL.Query(), "ifGenerationMatch", key) {
+		gcsFakeError(w, http.StatusPreconditionFailed, "conditionNotMet")
+		return
+	}
+
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, _ = strconv.Atoi(bounds[0])
+		end = len(data) - 1
+		if bounds[1] != "" {
+			end, _ = strconv.Atoi(bounds[1])
+		}
+		w.Header().Set("Content-Range",
+			fmt.Sprintf("bytes %v-%v/%v", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", obj.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", "Fri, 26 Apr 2019 17:33:20 GMT")
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *GCSServerTest) keys() (keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (s *GCSServerTest) readAll(t *C, param *GetBlobInput) string {
+	resp, err := s.gcs.GetBlob(param)
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *GCSServerTest) TestPutHeadGet(t *C) {
+	t.Assert(s.gcs.Init("dir/a"), IsNil)
+
+	put, err := s.gcs.PutBlob(&PutBlobInput{
+		Key:         "dir/a",
+		Body:        bytes.NewReader([]byte("hello world")),
+		ContentType: PString("text/plain"),
+		Metadata:    map[string]*string{"k": PString("v")},
+	})
+	t.Assert(err, IsNil)
+	t.Assert(*put.StorageClass, Equals, "STANDARD")
+
+	head, err := s.gcs.HeadBlob(&HeadBlobInput{Key: "dir/a"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size, Equals, uint64(11))
+	t.Assert(*head.ETag, Equals, *put.ETag)
+	t.Assert(*head.ContentType, Equals, "text/plain")
+	t.Assert(*head.Metadata["k"], Equals, "v")
+
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "dir/a"}), Equals, "hello world")
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "dir/a", Start: 6, Count: 5}),
+		Equals, "world")
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "dir/a", IfMatch: put.ETag}),
+		Equals, "hello world")
+
+	_, err = s.gcs.PutBlob(&PutBlobInput{
+		Key:  "dir/a",
+		Body: bytes.NewReader([]byte("replaced")),
+	})
+	t.Assert(err, IsNil)
+
+	// what we were reading is gone
+	_, err = s.gcs.GetBlob(&GetBlobInput{Key: "dir/a", IfMatch: put.ETag})
+	t.Assert(err, Equals, syscall.ESTALE)
+
+	_, err = s.gcs.HeadBlob(&HeadBlobInput{Key: "dir/missing"})
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.gcs.GetBlob(&GetBlobInput{Key: "dir/missing"})
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GCSServerTest) TestConditionalPut(t *C) {
+	put, err := s.gcs.PutBlob(&PutBlobInput{
+		Key:         "a",
+		Body:        bytes.NewReader([]byte("a")),
+		IfNotExists: true,
+	})
+	t.Assert(err, IsNil)
+
+	_, err = s.gcs.PutBlob(&PutBlobInput{
+		Key:         "a",
+		Body:        bytes.NewReader([]byte("b")),
+		IfNotExists: true,
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	_, err = s.gcs.PutBlob(&PutBlobInput{
+		Key:     "a",
+		Body:    bytes.NewReader([]byte("b")),
+		IfMatch: gcsETag(1),
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	put2, err := s.gcs.PutBlob(&PutBlobInput{
+		Key:     "a",
+		Body:    bytes.NewReader([]byte("b")),
+		IfMatch: put.ETag,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(*put2.ETag, Not(Equals), *put.ETag)
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "a"}), Equals, "b")
+}
+
+func (s *GCSServerTest) TestList(t *C) {
+	for _, key := range []string{"dir/a", "dir/b/c", "dir/d", gcsPartKey("upload", 1)} {
+		_, err := s.gcs.PutBlob(&PutBlobInput{Key: key})
+		t.Assert(err, IsNil)
+	}
+
+	// the parts of uploads aren't there
+	resp, err := s.gcs.ListBlobs(&ListBlobsInput{Delimiter: PString("/")})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Prefixes), Equals, 1)
+	t.Assert(*resp.Prefixes[0].Prefix, Equals, "dir/")
+	t.Assert(len(resp.Items), Equals, 0)
+	t.Assert(resp.IsTruncated, Equals, false)
+
+	var names []string
+	var token *string
+	for {
+		resp, err = s.gcs.ListBlobs(&ListBlobsInput{
+			Prefix:            PString("dir/"),
+			Delimiter:         PString("/"),
+			MaxKeys:           PUInt32(1),
+			ContinuationToken: token,
+		})
+		t.Assert(err, IsNil)
+		t.Assert(len(resp.Prefixes)+len(resp.Items), Equals, 1)
+		for _, p := range resp.Prefixes {
+			names = append(names, *p.Prefix)
+		}
+		for _, i := range resp.Items {
+			names = append(names, *i.Key)
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	t.Assert(names, DeepEquals, []string{"dir/a", "dir/b/", "dir/d"})
+
+	_, err = s.gcs.ListBlobs(&ListBlobsInput{StartAfter: PString("dir/a")})
+	t.Assert(err, Equals, syscall.ENOTSUP)
+}
+
+func (s *GCSServerTest) TestMultipart(t *C) {
+	commit, err := s.gcs.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:         "file",
+		ContentType: PString("text/plain"),
+	})
+	t.Assert(err, IsNil)
+
+	// more than one compose takes
+	n := GCS_MAX_COMPOSE + 1
+	var expected []byte
+	for i := n; i > 0; i-- {
+		_, err = s.gcs.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     commit,
+			PartNumber: uint32(i),
+			Body:       bytes.NewReader([]byte{byte('a' + i%26)}),
+		})
+		t.Assert(err, IsNil)
+	}
+	for i := 1; i <= n; i++ {
+		expected = append(expected, byte('a'+i%26))
+	}
+	t.Assert(commit.NumParts, Equals, uint32(n))
+
+	resp, err := s.gcs.MultipartBlobCommit(commit)
+	t.Assert(err, IsNil)
+
+	head, err := s.gcs.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(*head.ETag, Equals, *resp.ETag)
+	t.Assert(*head.ContentType, Equals, "text/plain")
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "file"}), Equals, string(expected))
+
+	// the parts and what was composed of them on the way are gone
+	t.Assert(s.keys(), DeepEquals, []string{"file"})
+}
+
+func (s *GCSServerTest) TestMultipartAbort(t *C) {
+	commit, err := s.gcs.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "file"})
+	t.Assert(err, IsNil)
+
+	_, err = s.gcs.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("a")),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.keys(), DeepEquals, []string{gcsPartKey(*commit.UploadId, 1)})
+
+	_, err = s.gcs.MultipartBlobAbort(commit)
+	t.Assert(err, IsNil)
+	t.Assert(len(s.keys()), Equals, 0)
+}
+
+func (s *GCSServerTest) TestRenameDelete(t *C) {
+	put, err := s.gcs.PutBlob(&PutBlobInput{
+		Key:  "a",
+		Body: bytes.NewReader([]byte("a")),
+	})
+	t.Assert(err, IsNil)
+
+	_, err = s.gcs.CopyBlob(&CopyBlobInput{
+		Source:      "a",
+		Destination: "b",
+		ETag:        gcsETag(1),
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	_, err = s.gcs.CopyBlob(&CopyBlobInput{
+		Source:      "a",
+		Destination: "b",
+		ETag:        put.ETag,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.readAll(t, &GetBlobInput{Key: "b"}), Equals, "a")
+
+	_, err = s.gcs.RenameBlob(&RenameBlobInput{Source: "b", Destination: "c"})
+	t.Assert(err, IsNil)
+	t.Assert(s.keys(), DeepEquals, []string{"a", "c"})
+
+	_, err = s.gcs.DeleteBlob(&DeleteBlobInput{Key: "b"})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// missing ones are fine in a batch
+	_, err = s.gcs.DeleteBlobs(&DeleteBlobsInput{Items: []string{"a", "b", "c"}})
+	t.Assert(err, IsNil)
+	t.Assert(len(s.keys()), Equals, 0)
+}
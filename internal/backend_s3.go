@@ -17,11 +17,14 @@ package internal
 import (
 	. "github.com/AITRICS/goofys/api/common"
 
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -31,6 +34,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/corehandlers"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/jacobsa/fuse"
@@ -43,14 +47,47 @@ type S3Backend struct {
 	bucket    string
 	awsConfig *aws.Config
 	flags     *FlagStorage
-	config    *S3Config
-	sseType   string
+	errorMap
+	opTimeout
+	config  *S3Config
+	sseType string
 
 	aws      bool
 	gcs      bool
 	v2Signer bool
 }
 
+// shared by every request that needs it, instead of a new copy each
+// time. The sdk doesn't modify its input
+var sseCAlgorithm = "AES256"
+
+// reads and part uploads are the bulk of our requests, their inputs
+// are reused once the request is sent
+var getObjectInputPool = sync.Pool{
+	New: func() interface{} {
+		return &s3.GetObjectInput{}
+	},
+}
+
+var uploadPartInputPool = sync.Pool{
+	New: func() interface{} {
+		return &s3.UploadPartInput{}
+	},
+}
+
+// rangeHeader formats the Range header for a GET. Count 0 means
+// the rest of the object
+func rangeHeader(start, count uint64) string {
+	var buf [64]byte
+	b := append(buf[:0], "bytes="...)
+	b = strconv.AppendUint(b, start, 10)
+	b = append(b, '-')
+	if count != 0 {
+		b = strconv.AppendUint(b, start+count-1, 10)
+	}
+	return string(b)
+}
+
 func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, error) {
 	awsConfig, err := config.ToAwsConfig(flags)
 	if err != nil {
@@ -60,9 +97,19 @@ func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, err
 		bucket:    bucket,
 		awsConfig: awsConfig,
 		flags:     flags,
+		errorMap:  errorMap(flags.ErrorMap),
+		opTimeout: opTimeout(flags.OpTimeout),
 		config:    config,
 		cap: Capabilities{
-			Name: "s3",
+			Name:               "s3",
+			ResumableMultipart: true,
+			StorageClass:       true,
+			SupportsAppend:     true,
+			MinAppendOffset:    S3_MIN_APPEND_OFFSET,
+			MaxKeyLength:       1024,
+			MaxMetadataSize:    2048,
+			MaxMultipartSize:   S3_MAX_PART_SIZE,
+			MaxObjectSize:      S3_MAX_OBJECT_SIZE,
 		},
 	}
 
@@ -82,10 +129,37 @@ func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, err
 	return s, nil
 }
 
+// sse is how what's written to key is encrypted, nil for not at all
+// or with SSE-C
+func (s *S3Backend) sse(key string) (sseType *string, kmsKeyID *string) {
+	if id, ok := s.config.KMSKeyFor(key); ok {
+		return aws.String(s3.ServerSideEncryptionAwsKms), &id
+	}
+	if s.config.UseSSE {
+		sseType = &s.sseType
+		if s.config.UseKMS && s.config.KMSKeyID != "" {
+			kmsKeyID = &s.config.KMSKeyID
+		}
+	}
+	return
+}
+
 func (s *S3Backend) Bucket() string {
 	return s.bucket
 }
 
+func (s *S3Backend) ObjectLocation(key string) objectLocation {
+	scheme := "s3"
+	if s.gcs {
+		scheme = "gs"
+	}
+	return objectLocation{
+		Endpoint: s.S3.Endpoint,
+		Key:      key,
+		URL:      scheme + "://" + s.bucket + "/" + key,
+	}
+}
+
 func (s *S3Backend) Capabilities() *Capabilities {
 	return &s.cap
 }
@@ -101,15 +175,29 @@ func addAcceptEncoding(req *request.Request) {
 }
 
 func addRequestPayer(req *request.Request) {
-	// "Requester Pays" is only applicable to these
+	// every request to a requester pays bucket needs it, including
+	// PutObject and UploadPart which are PUTs, or they are 403
 	// see https://docs.aws.amazon.com/AmazonS3/latest/dev/RequesterPaysBuckets.html
-	if req.HTTPRequest.Method == "GET" || req.HTTPRequest.Method == "HEAD" || req.HTTPRequest.Method == "POST" {
-		req.HTTPRequest.Header.Set("x-amz-request-payer", "requester")
+	req.HTTPRequest.Header.Set("x-amz-request-payer", "requester")
+}
+
+// addTraceId sends the trace id of the fuse op the request is for
+func addTraceId(req *request.Request) {
+	req.HTTPRequest = TraceRequest(req.HTTPRequest)
+}
+
+// logTrace logs how the request of a fuse op went, once it's done
+// with retrying
+func logTrace(req *request.Request) {
+	if fields := TraceFields(req.HTTPResponse); fields != nil {
+		s3Log.WithFields(fields).Debugf("%v %v", req.Operation.Name,
+			req.HTTPRequest.URL.Path)
 	}
 }
 
 func (s *S3Backend) setV2Signer(handlers *request.Handlers) {
 	handlers.Sign.Clear()
+	handlers.Sign.PushBack(signWithSkew)
 	handlers.Sign.PushBack(SignV2)
 	handlers.Sign.PushBackNamed(corehandlers.BuildContentLengthHandler)
 }
@@ -119,10 +207,29 @@ func (s *S3Backend) newS3() {
 	if s.config.RequesterPays {
 		s.S3.Handlers.Build.PushBack(addRequestPayer)
 	}
+	if s.flags.RequestHeaders != nil {
+		s.S3.Handlers.Build.PushBack(s.addRequestHeaders)
+	}
+	s.S3.Handlers.Build.PushBack(addTraceId)
+	s.S3.Handlers.Complete.PushBack(logTrace)
 	if s.v2Signer {
 		s.setV2Signer(&s.S3.Handlers)
+	} else {
+		s.S3.Handlers.Sign.PushFront(signWithSkew)
 	}
 	s.S3.Handlers.Sign.PushBack(addAcceptEncoding)
+	s.S3.Handlers.Retry.PushBack(retryOnSkew)
+	s.S3.Handlers.Retry.PushBack(s.noteFailedRequest)
+}
+
+// noteFailedRequest is for user.goofys.last-errors, it runs after
+// every try that failed
+func (s *S3Backend) noteFailedRequest(req *request.Request) {
+	if req.HTTPResponse == nil {
+		return
+	}
+	noteFailedRequest(s3Log, s.cap.Name, req.Operation.Name, req.HTTPResponse,
+		"", strings.Trim(s.getRequestId(req), ": "))
 }
 
 func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
@@ -149,10 +256,14 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 	if err != nil {
 		return
 	}
+	if s.config.RequesterPays {
+		req.Header.Set("x-amz-request-payer", "requester")
+	}
+	setRequestHeaders(req.Header, s.flags.RequestHeaders)
 
 	allowFails := 3
 	for i := 0; i < allowFails; i++ {
-		resp, err = http.DefaultTransport.RoundTrip(req)
+		resp, err = GetHTTPTransport(s.flags).RoundTrip(req)
 		if err != nil {
 			return
 		}
@@ -181,7 +292,8 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 	switch resp.StatusCode {
 	case 200:
 		// note that this only happen if the bucket is in us-east-1
-		if len(s.config.Profile) == 0 {
+		// requester pays buckets can't be accessed anonymously
+		if len(s.config.Profile) == 0 && !s.config.RequesterPays {
 			s.awsConfig.Credentials = credentials.AnonymousCredentials
 			s3Log.Infof("anonymous bucket detected")
 		}
@@ -214,7 +326,7 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 func (s *S3Backend) testBucket(key string) (err error) {
 	_, err = s.HeadBlob(&HeadBlobInput{Key: key})
 	if err != nil {
-		err = mapAwsError(err)
+		err = s.mapAwsError(err)
 		if err == fuse.ENOENT {
 			err = nil
 		}
@@ -234,6 +346,20 @@ func (s *S3Backend) fallbackV2Signer() (err error) {
 	return
 }
 
+// noCredentials is whether the sdk can't find any credentials to sign
+// with, which is fine if the bucket is public
+func (s *S3Backend) noCredentials() bool {
+	if s.awsConfig.Credentials == credentials.AnonymousCredentials ||
+		s.S3.Config.Credentials == nil {
+		return false
+	}
+	_, err := s.S3.Config.Credentials.Get()
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "NoCredentialProviders"
+	}
+	return false
+}
+
 func (s *S3Backend) Init(key string) error {
 	var isAws bool
 	var err error
@@ -256,8 +382,15 @@ func (s *S3Backend) Init(key string) error {
 		}
 	}
 
+	// the HEAD above is only anonymous if it worked in us-east-1
+	if s.config.Profile == "" && !s.config.RequesterPays && s.noCredentials() {
+		s3Log.Infof("no credentials found, trying anonymous access")
+		s.awsConfig.Credentials = credentials.AnonymousCredentials
+		s.newS3()
+	}
+
 	// try again with the credential to make sure
-	err = mapAwsError(s.testBucket(key))
+	err = s.mapAwsError(s.testBucket(key))
 	if err != nil {
 		if !isAws {
 			// EMC returns 403 because it doesn't support v4 signing
@@ -268,7 +401,7 @@ func (s *S3Backend) Init(key string) error {
 				if err != nil {
 					return err
 				}
-				err = mapAwsError(s.testBucket(key))
+				err = s.mapAwsError(s.testBucket(key))
 			}
 		}
 
@@ -277,12 +410,85 @@ func (s *S3Backend) Init(key string) error {
 		}
 	}
 
+	if len(s.config.KMSKeyPrefixes) != 0 {
+		if s.aws || s.flags.Endpoint == "" {
+			err = s.checkKMSKeys(kms.New(s.config.Session, s.awsConfig))
+			if err != nil {
+				return err
+			}
+		} else {
+			s3Log.Infof("not AWS, the keys of --sse-kms-prefix aren't checked")
+		}
+	}
+
+	if s.awsConfig.Credentials == credentials.AnonymousCredentials {
+		// writes can only be denied, so they fail right away
+		// instead. This also keeps the mpu cleaner away
+		s.cap.ReadOnly = true
+	}
+
+	// AWS has checked If-Match and If-None-Match on writes since
+	// 2024. Other S3s may ignore them, so they get the HEAD
+	s.cap.ConditionalWrite = s.aws || s.flags.Endpoint == ""
+	s.cap.ConditionalCreate = s.cap.ConditionalWrite
+
+	return nil
+}
+
+// checkKMSKeys asks KMS for a data key with each key of
+// --sse-kms-prefix, which S3 does on every write with it, so that a
+// wrong ARN or a missing permission fails the mount and not the first
+// write under the prefix
+func (s *S3Backend) checkKMSKeys(client *kms.KMS) error {
+	checked := make(map[string]bool)
+	for prefix, id := range s.config.KMSKeyPrefixes {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+
+		ctx, cancel := s.requestContext(nil)
+		_, err := client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(id),
+			KeySpec: aws.String(kms.DataKeySpecAes256),
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("KMS key %v of --sse-kms-prefix %v: %v", id, prefix, err)
+		}
+	}
 	return nil
 }
 
-func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, string, error) {
+// s3Precondition makes a PutObject or CompleteMultipartUpload
+// conditional. The headers go on the http request, so older SDKs
+// that don't know about them send them too
+func s3Precondition(req *request.Request, ifMatch *string, ifNotExists bool) {
+	if ifNotExists {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else if ifMatch != nil {
+		req.HTTPRequest.Header.Set("If-Match", quoteETag(*ifMatch))
+	}
+}
+
+// mapS3WriteError is mapAwsError, except that a precondition we asked
+// for failing is EBUSY. 409 is someone else's conditional write
+// racing ours
+func (m errorMap) mapS3WriteError(err error, conditional bool) error {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && conditional {
+		switch reqErr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return syscall.EBUSY
+		}
+	}
+	return m.mapAwsError(err)
+}
+
+func (s *S3Backend) ListObjectsV2(ctx context.Context,
+	params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, string, error) {
 	if s.aws {
 		req, resp := s.S3.ListObjectsV2Request(params)
+		req.SetContext(ctx)
 		err := req.Send()
 		if err != nil {
 			return nil, "", err
@@ -297,17 +503,26 @@ func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObject
 			Prefix:       params.Prefix,
 			RequestPayer: params.RequestPayer,
 		}
-		if params.StartAfter != nil {
-			v1.Marker = params.StartAfter
-		} else {
+		// like v2, the token wins, StartAfter is only for the
+		// first page
+		if params.ContinuationToken != nil {
 			v1.Marker = params.ContinuationToken
+		} else {
+			v1.Marker = params.StartAfter
 		}
 
-		objs, err := s.S3.ListObjects(&v1)
+		objs, err := s.S3.ListObjectsWithContext(ctx, &v1)
 		if err != nil {
 			return nil, "", err
 		}
 
+		nextMarker := objs.NextMarker
+		if nextMarker == nil && objs.IsTruncated != nil && *objs.IsTruncated {
+			// NextMarker is only returned with a delimiter,
+			// otherwise the last key is the marker
+			nextMarker = v1NextMarker(objs)
+		}
+
 		count := int64(len(objs.Contents))
 		v2Objs := s3.ListObjectsV2Output{
 			CommonPrefixes:        objs.CommonPrefixes,
@@ -319,7 +534,7 @@ func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObject
 			KeyCount:              &count,
 			MaxKeys:               objs.MaxKeys,
 			Name:                  objs.Name,
-			NextContinuationToken: objs.NextMarker,
+			NextContinuationToken: nextMarker,
 			Prefix:                objs.Prefix,
 			StartAfter:            objs.Marker,
 		}
@@ -328,6 +543,22 @@ func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObject
 	}
 }
 
+// v1NextMarker is the greater of the last key and the last common
+// prefix of a truncated v1 listing
+func v1NextMarker(objs *s3.ListObjectsOutput) *string {
+	var marker *string
+	if n := len(objs.Contents); n != 0 {
+		marker = objs.Contents[n-1].Key
+	}
+	if n := len(objs.CommonPrefixes); n != 0 {
+		prefix := objs.CommonPrefixes[n-1].Prefix
+		if marker == nil || (prefix != nil && *prefix > *marker) {
+			marker = prefix
+		}
+	}
+	return marker
+}
+
 func metadataToLower(m map[string]*string) map[string]*string {
 	if m != nil {
 		var toDelete []string
@@ -355,15 +586,22 @@ func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 		Key: &param.Key,
 	}
 	if s.config.SseC != "" {
-		head.SSECustomerAlgorithm = PString("AES256")
+		head.SSECustomerAlgorithm = &sseCAlgorithm
 		head.SSECustomerKey = &s.config.SseC
 		head.SSECustomerKeyMD5 = &s.config.SseCDigest
 	}
 
 	req, resp := s.S3.HeadObjectRequest(&head)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
+	}
+	sse := resp.ServerSideEncryption
+	if sse == nil && resp.SSECustomerAlgorithm != nil {
+		sse = PString("SSE-C")
 	}
 	return &HeadBlobOutput{
 		BlobItemOutput: BlobItemOutput{
@@ -373,10 +611,15 @@ func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 			Size:         uint64(*resp.ContentLength),
 			StorageClass: resp.StorageClass,
 		},
-		ContentType: resp.ContentType,
-		Metadata:    metadataToLower(resp.Metadata),
-		IsDirBlob:   strings.HasSuffix(param.Key, "/"),
-		RequestId:   s.getRequestId(req),
+		ContentType:    resp.ContentType,
+		Metadata:       metadataToLower(resp.Metadata),
+		IsDirBlob:      strings.HasSuffix(param.Key, "/"),
+		ObjectLockMode: resp.ObjectLockMode,
+		RetainUntil:    resp.ObjectLockRetainUntilDate,
+		LegalHold: aws.StringValue(resp.ObjectLockLegalHoldStatus) ==
+			s3.ObjectLockLegalHoldStatusOn,
+		ServerSideEncryption: sse,
+		RequestId:            s.getRequestId(req),
 	}, nil
 }
 
@@ -387,7 +630,9 @@ func (s *S3Backend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		maxKeys = aws.Int64(int64(*param.MaxKeys))
 	}
 
-	resp, reqId, err := s.ListObjectsV2(&s3.ListObjectsV2Input{
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	resp, reqId, err := s.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 		Bucket:            &s.bucket,
 		Prefix:            param.Prefix,
 		Delimiter:         param.Delimiter,
@@ -396,11 +641,11 @@ func (s *S3Backend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		ContinuationToken: param.ContinuationToken,
 	})
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	prefixes := make([]BlobPrefixOutput, 0)
-	items := make([]BlobItemOutput, 0)
+	items := getListItems()
 
 	for _, p := range resp.CommonPrefixes {
 		prefixes = append(prefixes, BlobPrefixOutput{Prefix: p.Prefix})
@@ -424,14 +669,83 @@ func (s *S3Backend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	}, nil
 }
 
+func (s *S3Backend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	var maxKeys *int64
+
+	if param.MaxKeys != nil {
+		maxKeys = aws.Int64(int64(*param.MaxKeys))
+	}
+
+	req, resp := s.ListObjectVersionsRequest(&s3.ListObjectVersionsInput{
+		Bucket:          &s.bucket,
+		Prefix:          param.Prefix,
+		Delimiter:       param.Delimiter,
+		MaxKeys:         maxKeys,
+		KeyMarker:       param.KeyMarker,
+		VersionIdMarker: param.VersionIdMarker,
+	})
+	ctx, cancel := s.requestContext(nil)
+	defer cancel()
+	req.SetContext(ctx)
+	err := req.Send()
+	if err != nil {
+		return nil, s.mapAwsError(err)
+	}
+
+	prefixes := make([]BlobPrefixOutput, 0)
+	versions := make([]BlobVersionOutput, 0)
+
+	for _, p := range resp.CommonPrefixes {
+		prefixes = append(prefixes, BlobPrefixOutput{Prefix: p.Prefix})
+	}
+	for _, v := range resp.Versions {
+		versions = append(versions, BlobVersionOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          v.Key,
+				ETag:         v.ETag,
+				LastModified: v.LastModified,
+				Size:         uint64(*v.Size),
+				StorageClass: v.StorageClass,
+			},
+			VersionId: v.VersionId,
+			IsLatest:  *v.IsLatest,
+		})
+	}
+	for _, d := range resp.DeleteMarkers {
+		versions = append(versions, BlobVersionOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          d.Key,
+				LastModified: d.LastModified,
+			},
+			VersionId:      d.VersionId,
+			IsLatest:       *d.IsLatest,
+			IsDeleteMarker: true,
+		})
+	}
+	// s3 returns delete markers separately, merge them back
+	sort.Stable(sortBlobVersionOutput(versions))
+
+	return &ListBlobVersionsOutput{
+		Prefixes:            prefixes,
+		Versions:            versions,
+		NextKeyMarker:       resp.NextKeyMarker,
+		NextVersionIdMarker: resp.NextVersionIdMarker,
+		IsTruncated:         *resp.IsTruncated,
+		RequestId:           s.getRequestId(req),
+	}, nil
+}
+
 func (s *S3Backend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
 	req, _ := s.DeleteObjectRequest(&s3.DeleteObjectInput{
 		Bucket: &s.bucket,
 		Key:    &param.Key,
 	})
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 	return &DeleteBlobOutput{s.getRequestId(req)}, nil
 }
@@ -449,13 +763,38 @@ func (s *S3Backend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, er
 	// Add list of objects to delete to Delete object
 	items.SetObjects(objs)
 
-	req, _ := s.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+	req, resp := s.DeleteObjectsRequest(&s3.DeleteObjectsInput{
 		Bucket: &s.bucket,
 		Delete: &items,
 	})
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
+	}
+
+	// the request succeeds even if none of the keys could be
+	// deleted
+	failed := make(map[string]error)
+	for _, e := range resp.Errors {
+		err := s.mapErrorCode(aws.StringValue(e.Code))
+		if objectLockDenied(aws.StringValue(e.Code), aws.StringValue(e.Message)) {
+			err = syscall.EPERM
+		}
+		if err == fuse.ENOENT {
+			continue
+		} else if err == nil {
+			s3Log.Errorf("DeleteObjects key=%v code=%v msg=%v request=%v",
+				aws.StringValue(e.Key), aws.StringValue(e.Code),
+				aws.StringValue(e.Message), s.getRequestId(req))
+			err = syscall.EIO
+		}
+		failed[aws.StringValue(e.Key)] = err
+	}
+	if len(failed) != 0 {
+		return nil, &DeleteBlobsError{Failed: failed}
 	}
 
 	return &DeleteBlobsOutput{s.getRequestId(req)}, nil
@@ -465,10 +804,8 @@ func (s *S3Backend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error
 	return nil, syscall.ENOTSUP
 }
 
-func (s *S3Backend) mpuCopyPart(from string, to string, mpuId string, bytes string, part int64,
-	sem semaphore, srcEtag *string, etag **string, errout *error) {
-
-	defer sem.P(1)
+func (s *S3Backend) mpuCopyPart(ctx context.Context, from string, to string, mpuId string,
+	bytes string, part int64, srcEtag *string) (etag *string, err error) {
 
 	// XXX use CopySourceIfUnmodifiedSince to ensure that
 	// we are copying from the same object
@@ -482,25 +819,25 @@ func (s *S3Backend) mpuCopyPart(from string, to string, mpuId string, bytes stri
 		PartNumber:        &part,
 	}
 	if s.config.SseC != "" {
-		params.SSECustomerAlgorithm = PString("AES256")
+		params.SSECustomerAlgorithm = &sseCAlgorithm
 		params.SSECustomerKey = &s.config.SseC
 		params.SSECustomerKeyMD5 = &s.config.SseCDigest
-		params.CopySourceSSECustomerAlgorithm = PString("AES256")
+		params.CopySourceSSECustomerAlgorithm = &sseCAlgorithm
 		params.CopySourceSSECustomerKey = &s.config.SseC
 		params.CopySourceSSECustomerKeyMD5 = &s.config.SseCDigest
 	}
 
 	s3Log.Debug(params)
 
-	resp, err := s.UploadPartCopy(params)
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	resp, err := s.UploadPartCopyWithContext(ctx, params)
 	if err != nil {
 		s3Log.Errorf("UploadPartCopy %v = %v", params, err)
-		*errout = mapAwsError(err)
-		return
+		return nil, s.mapAwsError(err)
 	}
 
-	*etag = resp.CopyPartResult.ETag
-	return
+	return resp.CopyPartResult.ETag, nil
 }
 
 func sizeToParts(size int64) (int, int64) {
@@ -523,7 +860,7 @@ func sizeToParts(size int64) (int, int64) {
 	return nParts, partSize
 }
 
-func (s *S3Backend) mpuCopyParts(size int64, from string, to string, mpuId string,
+func (s *S3Backend) mpuCopyParts(ctx context.Context, size int64, from string, to string, mpuId string,
 	srcEtag *string, etags []*string, partSize int64, err *error) {
 
 	rangeFrom := int64(0)
@@ -533,7 +870,15 @@ func (s *S3Backend) mpuCopyParts(size int64, from string, to string, mpuId strin
 	sem := make(semaphore, MAX_CONCURRENCY)
 	sem.P(MAX_CONCURRENCY)
 
-	for i := int64(1); rangeTo < size; i++ {
+	// the first error, no more parts are started after it
+	var mu sync.Mutex
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return *err != nil
+	}
+
+	for i := int64(1); rangeTo < size && !failed(); i++ {
 		rangeFrom = rangeTo
 		rangeTo = i * partSize
 		if rangeTo > size {
@@ -542,33 +887,55 @@ func (s *S3Backend) mpuCopyParts(size int64, from string, to string, mpuId strin
 		bytes := fmt.Sprintf("bytes=%v-%v", rangeFrom, rangeTo-1)
 
 		sem.V(1)
-		go s.mpuCopyPart(from, to, mpuId, bytes, i, sem, srcEtag, &etags[i-1], err)
+		go func(part int64) {
+			defer sem.P(1)
+			etag, partErr := s.mpuCopyPart(ctx, from, to, mpuId, bytes, part, srcEtag)
+			mu.Lock()
+			defer mu.Unlock()
+			if partErr != nil {
+				if *err == nil {
+					*err = partErr
+				}
+				return
+			}
+			etags[part-1] = etag
+		}(i)
 	}
 
 	sem.V(MAX_CONCURRENCY)
 }
 
-func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuId string,
-	srcEtag *string, metadata map[string]*string, storageClass *string) (requestId string, err error) {
+func (s *S3Backend) copyObjectMultipart(ctx context.Context, size int64, from string, to string, mpuId string,
+	srcEtag *string, metadata map[string]*string, storageClass *string,
+	contentType *string) (requestId string, err error) {
 	nParts, partSize := sizeToParts(size)
 	etags := make([]*string, nParts)
 
 	if mpuId == "" {
+		// it's ours to clean up then, otherwise the parts
+		// that were copied are paid for until the upload
+		// expires
+		defer func() {
+			if err != nil && mpuId != "" {
+				s.abortCopyMultipart(ctx, to, mpuId)
+			}
+		}()
+
+		if contentType == nil {
+			contentType = s.flags.GetMimeType(to)
+		}
 		params := &s3.CreateMultipartUploadInput{
 			Bucket:       &s.bucket,
 			Key:          &to,
 			StorageClass: storageClass,
-			ContentType:  s.flags.GetMimeType(to),
+			ContentType:  contentType,
 			Metadata:     metadataToLower(metadata),
 		}
 
-		if s.config.UseSSE {
-			params.ServerSideEncryption = &s.sseType
-			if s.config.UseKMS && s.config.KMSKeyID != "" {
-				params.SSEKMSKeyId = &s.config.KMSKeyID
-			}
+		if sseType, kmsKeyID := s.sse(to); sseType != nil {
+			params.ServerSideEncryption, params.SSEKMSKeyId = sseType, kmsKeyID
 		} else if s.config.SseC != "" {
-			params.SSECustomerAlgorithm = PString("AES256")
+			params.SSECustomerAlgorithm = &sseCAlgorithm
 			params.SSECustomerKey = &s.config.SseC
 			params.SSECustomerKeyMD5 = &s.config.SseCDigest
 		}
@@ -577,15 +944,17 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 			params.ACL = &s.config.ACL
 		}
 
-		resp, err := s.CreateMultipartUpload(params)
+		ctx, cancel := s.requestContext(ctx)
+		defer cancel()
+		resp, err := s.CreateMultipartUploadWithContext(ctx, params)
 		if err != nil {
-			return "", mapAwsError(err)
+			return "", s.mapAwsError(err)
 		}
 
 		mpuId = *resp.UploadId
 	}
 
-	s.mpuCopyParts(size, from, to, mpuId, srcEtag, etags, partSize, &err)
+	s.mpuCopyParts(ctx, size, from, to, mpuId, srcEtag, etags, partSize, &err)
 
 	if err != nil {
 		return
@@ -610,10 +979,13 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 		s3Log.Debug(params)
 
 		req, _ := s.CompleteMultipartUploadRequest(params)
+		ctx, cancel := s.requestContext(ctx)
+		defer cancel()
+		req.SetContext(ctx)
 		err = req.Send()
 		if err != nil {
 			s3Log.Errorf("Complete MPU %v = %v", params, err)
-			err = mapAwsError(err)
+			err = s.mapAwsError(err)
 		} else {
 			requestId = s.getRequestId(req)
 		}
@@ -622,18 +994,37 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 	return
 }
 
+func (s *S3Backend) abortCopyMultipart(ctx context.Context, key string, mpuId string) {
+	params := &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &mpuId,
+	}
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+	_, err := s.AbortMultipartUploadWithContext(ctx, params)
+	if err != nil {
+		s3Log.Errorf("AbortMultipartUpload %v = %v", params, err)
+	}
+}
+
 func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	// a new content type can only be given by replacing the
+	// metadata, with what's there if we weren't given any
 	metadataDirective := s3.MetadataDirectiveCopy
-	if param.Metadata != nil {
+	if param.Metadata != nil || param.ContentType != nil {
 		metadataDirective = s3.MetadataDirectiveReplace
 	}
 
 	COPY_LIMIT := uint64(5 * 1024 * 1024 * 1024)
 
+	// a multipart copy doesn't copy anything but the data, so
+	// what the source has is set on the new upload
 	if param.Size == nil || param.ETag == nil || (*param.Size > COPY_LIMIT &&
-		(param.Metadata == nil || param.StorageClass == nil)) {
+		(param.Metadata == nil || param.StorageClass == nil || param.ContentType == nil)) ||
+		(param.ContentType != nil && param.Metadata == nil) {
 
-		params := &HeadBlobInput{Key: param.Source}
+		params := &HeadBlobInput{Key: param.Source, Context: param.Context}
 		resp, err := s.HeadBlob(params)
 		if err != nil {
 			return nil, err
@@ -644,7 +1035,12 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		if param.Metadata == nil {
 			param.Metadata = resp.Metadata
 		}
-		param.StorageClass = resp.StorageClass
+		if param.StorageClass == nil {
+			param.StorageClass = resp.StorageClass
+		}
+		if param.ContentType == nil && *param.Size > COPY_LIMIT {
+			param.ContentType = resp.ContentType
+		}
 	}
 
 	if param.StorageClass == nil {
@@ -658,35 +1054,39 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	from := s.bucket + "/" + param.Source
 
 	if !s.gcs && *param.Size > COPY_LIMIT {
-		reqId, err := s.copyObjectMultipart(int64(*param.Size), from, param.Destination, "", param.ETag, param.Metadata, param.StorageClass)
+		reqId, err := s.copyObjectMultipart(param.Context, int64(*param.Size), from,
+			param.Destination, "", param.ETag, param.Metadata, param.StorageClass,
+			param.ContentType)
 		if err != nil {
 			return nil, err
 		}
 		return &CopyBlobOutput{reqId}, nil
 	}
 
+	contentType := param.ContentType
+	if contentType == nil {
+		contentType = s.flags.GetMimeType(param.Destination)
+	}
+
 	params := &s3.CopyObjectInput{
 		Bucket:            &s.bucket,
 		CopySource:        aws.String(pathEscape(from)),
 		Key:               &param.Destination,
 		StorageClass:      param.StorageClass,
-		ContentType:       s.flags.GetMimeType(param.Destination),
+		ContentType:       contentType,
 		Metadata:          metadataToLower(param.Metadata),
 		MetadataDirective: &metadataDirective,
 	}
 
 	s3Log.Debug(params)
 
-	if s.config.UseSSE {
-		params.ServerSideEncryption = &s.sseType
-		if s.config.UseKMS && s.config.KMSKeyID != "" {
-			params.SSEKMSKeyId = &s.config.KMSKeyID
-		}
+	if sseType, kmsKeyID := s.sse(param.Destination); sseType != nil {
+		params.ServerSideEncryption, params.SSEKMSKeyId = sseType, kmsKeyID
 	} else if s.config.SseC != "" {
-		params.SSECustomerAlgorithm = PString("AES256")
+		params.SSECustomerAlgorithm = &sseCAlgorithm
 		params.SSECustomerKey = &s.config.SseC
 		params.SSECustomerKeyMD5 = &s.config.SseCDigest
-		params.CopySourceSSECustomerAlgorithm = PString("AES256")
+		params.CopySourceSSECustomerAlgorithm = &sseCAlgorithm
 		params.CopySourceSSECustomerKey = &s.config.SseC
 		params.CopySourceSSECustomerKeyMD5 = &s.config.SseCDigest
 	}
@@ -696,42 +1096,63 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	}
 
 	req, _ := s.CopyObjectRequest(params)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
 		s3Log.Errorf("CopyObject %v = %v", params, err)
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	return &CopyBlobOutput{s.getRequestId(req)}, nil
 }
 
 func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
-	get := s3.GetObjectInput{
+	get := getObjectInputPool.Get().(*s3.GetObjectInput)
+	*get = s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &param.Key,
 	}
+	defer func() {
+		*get = s3.GetObjectInput{}
+		getObjectInputPool.Put(get)
+	}()
 
 	if s.config.SseC != "" {
-		get.SSECustomerAlgorithm = PString("AES256")
+		get.SSECustomerAlgorithm = &sseCAlgorithm
 		get.SSECustomerKey = &s.config.SseC
 		get.SSECustomerKeyMD5 = &s.config.SseCDigest
 	}
 
+	var bytes string
 	if param.Start != 0 || param.Count != 0 {
-		var bytes string
-		if param.Count != 0 {
-			bytes = fmt.Sprintf("bytes=%v-%v", param.Start, param.Start+param.Count-1)
-		} else {
-			bytes = fmt.Sprintf("bytes=%v-", param.Start)
-		}
+		bytes = rangeHeader(param.Start, param.Count)
 		get.Range = &bytes
 	}
-	// TODO handle IfMatch
+	get.IfMatch = param.IfMatch
+	get.VersionId = param.VersionId
 
-	req, resp := s.GetObjectRequest(&get)
+	ctx, cancel := s.requestContext(param.Context)
+	req, resp := s.GetObjectRequest(get)
+	req.SetContext(ctx)
+	if param.Checksum {
+		// like s3Precondition, the sdk doesn't know about it
+		req.HTTPRequest.Header.Set("x-amz-checksum-mode", "ENABLED")
+	}
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		cancel()
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidObjectState" {
+			s3Log.Errorf("%v is archived and has to be restored before it can be read",
+				param.Key)
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok && param.IfMatch != nil &&
+			reqErr.StatusCode() == http.StatusPreconditionFailed {
+			// replaced since we started reading it
+			return nil, syscall.ESTALE
+		}
+		return nil, s.mapAwsError(err)
 	}
 
 	return &GetBlobOutput{
@@ -746,14 +1167,48 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 			ContentType: resp.ContentType,
 			Metadata:    metadataToLower(resp.Metadata),
 		},
-		Body:      resp.Body,
+		Body:      cancelOnClose{resp.Body, cancel},
+		Checksum:  s.getChecksum(param, resp, req.HTTPResponse.Header),
 		RequestId: s.getRequestId(req),
 	}, nil
 }
 
+// getChecksum picks what the whole object should hash to. The ETag is
+// the md5 unless it was uploaded in parts or encrypted with a key
+// other than S3's own
+func (s *S3Backend) getChecksum(param *GetBlobInput, resp *s3.GetObjectOutput,
+	header http.Header) *BlobChecksum {
+	if !param.Checksum || !isWholeRange(nilStr(resp.ContentRange)) {
+		return nil
+	}
+
+	for _, c := range []struct {
+		algorithm string
+		value     *string
+	}{
+		{"sha256", PStringOrNil(header.Get("x-amz-checksum-sha256"))},
+		{"sha1", PStringOrNil(header.Get("x-amz-checksum-sha1"))},
+		{"crc32c", PStringOrNil(header.Get("x-amz-checksum-crc32c"))},
+		{"crc32", PStringOrNil(header.Get("x-amz-checksum-crc32"))},
+	} {
+		if sum := base64Checksum(c.algorithm, c.value); sum != nil {
+			return sum
+		}
+	}
+
+	if resp.SSECustomerAlgorithm != nil ||
+		nilStr(resp.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+	return etagMD5(resp.ETag)
+}
+
 func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	storageClass := s.config.StorageClass
-	if param.Size != nil && *param.Size < 128*1024 && storageClass == "STANDARD_IA" {
+	if param.StorageClass != nil {
+		// asked for, even if it's small
+		storageClass = *param.StorageClass
+	} else if param.Size != nil && *param.Size < 128*1024 && storageClass == "STANDARD_IA" {
 		storageClass = "STANDARD"
 	}
 
@@ -766,13 +1221,10 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 		ContentType:  param.ContentType,
 	}
 
-	if s.config.UseSSE {
-		put.ServerSideEncryption = &s.sseType
-		if s.config.UseKMS && s.config.KMSKeyID != "" {
-			put.SSEKMSKeyId = &s.config.KMSKeyID
-		}
+	if sseType, kmsKeyID := s.sse(param.Key); sseType != nil {
+		put.ServerSideEncryption, put.SSEKMSKeyId = sseType, kmsKeyID
 	} else if s.config.SseC != "" {
-		put.SSECustomerAlgorithm = PString("AES256")
+		put.SSECustomerAlgorithm = &sseCAlgorithm
 		put.SSECustomerKey = &s.config.SseC
 		put.SSECustomerKeyMD5 = &s.config.SseCDigest
 	}
@@ -782,9 +1234,14 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	}
 
 	req, resp := s.PutObjectRequest(put)
+	s3Precondition(req, param.IfMatch, param.IfNotExists)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapS3WriteError(err,
+			param.IfMatch != nil || param.IfNotExists)
 	}
 
 	return &PutBlobOutput{
@@ -800,15 +1257,16 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		Key:          &param.Key,
 		StorageClass: &s.config.StorageClass,
 		ContentType:  param.ContentType,
+		Metadata:     metadataToLower(param.Metadata),
+	}
+	if param.StorageClass != nil {
+		mpu.StorageClass = param.StorageClass
 	}
 
-	if s.config.UseSSE {
-		mpu.ServerSideEncryption = &s.sseType
-		if s.config.UseKMS && s.config.KMSKeyID != "" {
-			mpu.SSEKMSKeyId = &s.config.KMSKeyID
-		}
+	if sseType, kmsKeyID := s.sse(param.Key); sseType != nil {
+		mpu.ServerSideEncryption, mpu.SSEKMSKeyId = sseType, kmsKeyID
 	} else if s.config.SseC != "" {
-		mpu.SSECustomerAlgorithm = PString("AES256")
+		mpu.SSECustomerAlgorithm = &sseCAlgorithm
 		mpu.SSECustomerKey = &s.config.SseC
 		mpu.SSECustomerKeyMD5 = &s.config.SseCDigest
 	}
@@ -817,10 +1275,12 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		mpu.ACL = &s.config.ACL
 	}
 
-	resp, err := s.CreateMultipartUpload(&mpu)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	resp, err := s.CreateMultipartUploadWithContext(ctx, &mpu)
 	if err != nil {
 		s3Log.Errorf("CreateMultipartUpload %v = %v", param.Key, err)
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	return &MultipartBlobCommitInput{
@@ -828,37 +1288,55 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		Metadata: metadataToLower(param.Metadata),
 		UploadId: resp.UploadId,
 		Parts:    make([]*string, 10000), // at most 10K parts
+		Context:  param.Context,
 	}, nil
 }
 
 func (s *S3Backend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
-	en := &param.Commit.Parts[param.PartNumber-1]
-	atomic.AddUint32(&param.Commit.NumParts, 1)
+	partNumber := param.PartNumber
+	if appended, ok := param.Commit.backendData.(*s3Appended); ok {
+		partNumber += appended.copiedParts
+	}
+	en := &param.Commit.Parts[partNumber-1]
 
-	params := s3.UploadPartInput{
+	params := uploadPartInputPool.Get().(*s3.UploadPartInput)
+	*params = s3.UploadPartInput{
 		Bucket:     &s.bucket,
 		Key:        param.Commit.Key,
-		PartNumber: aws.Int64(int64(param.PartNumber)),
+		PartNumber: aws.Int64(int64(partNumber)),
 		UploadId:   param.Commit.UploadId,
 		Body:       param.Body,
 	}
+	defer func() {
+		// don't hold on to the part's buffer
+		*params = s3.UploadPartInput{}
+		uploadPartInputPool.Put(params)
+	}()
+
 	if s.config.SseC != "" {
-		params.SSECustomerAlgorithm = PString("AES256")
+		params.SSECustomerAlgorithm = &sseCAlgorithm
 		params.SSECustomerKey = &s.config.SseC
 		params.SSECustomerKeyMD5 = &s.config.SseCDigest
 	}
-	s3Log.Debug(params)
+	if s.flags.DebugS3 {
+		s3Log.Debug(*params)
+	}
 
-	req, resp := s.UploadPartRequest(&params)
+	req, resp := s.UploadPartRequest(params)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 
 	if *en != nil {
 		panic(fmt.Sprintf("etags for part %v already set: %v", param.PartNumber, **en))
 	}
 	*en = resp.ETag
+	// only counted once it's there, a failed part can be added again
+	atomic.AddUint32(&param.Commit.NumParts, 1)
 
 	return &MultipartBlobAddOutput{s.getRequestId(req)}, nil
 }
@@ -884,9 +1362,14 @@ func (s *S3Backend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multi
 	s3Log.Debug(mpu)
 
 	req, resp := s.CompleteMultipartUploadRequest(&mpu)
+	s3Precondition(req, param.IfMatch, param.IfNotExists)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapS3WriteError(err,
+			param.IfMatch != nil || param.IfNotExists)
 	}
 
 	s3Log.Debug(resp)
@@ -904,50 +1387,170 @@ func (s *S3Backend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*Multip
 		UploadId: param.UploadId,
 	}
 	req, _ := s.AbortMultipartUploadRequest(&mpu)
+	ctx, cancel := s.requestContext(param.Context)
+	defer cancel()
+	req.SetContext(ctx)
 	err := req.Send()
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 	return &MultipartBlobAbortOutput{s.getRequestId(req)}, nil
 }
 
 func (s *S3Backend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
-	mpu, err := s.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+	olderThan := param.OlderThan
+	if olderThan == 0 {
+		olderThan = 48 * time.Hour
+	}
+	expireBefore := time.Now().Add(-olderThan)
+
+	params := &s3.ListMultipartUploadsInput{
 		Bucket: &s.bucket,
-	})
-	if err != nil {
-		return nil, mapAwsError(err)
 	}
-	s3Log.Debug(mpu)
+	if param.Prefix != "" {
+		params.Prefix = &param.Prefix
+	}
+
+	out := &MultipartExpireOutput{}
+	var abortErr error
 
-	now := time.Now()
-	for _, upload := range mpu.Uploads {
-		expireTime := upload.Initiated.Add(48 * time.Hour)
+	err := s.ListMultipartUploadsPages(params, func(page *s3.ListMultipartUploadsOutput, last bool) bool {
+		s3Log.Debug(page)
 
-		if !expireTime.After(now) {
-			params := &s3.AbortMultipartUploadInput{
-				Bucket:   &s.bucket,
-				Key:      upload.Key,
-				UploadId: upload.UploadId,
+		for _, upload := range page.Uploads {
+			if upload.Initiated.After(expireBefore) ||
+				(param.Live != nil && param.Live(*upload.UploadId)) {
+				s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
+				continue
 			}
-			resp, err := s.AbortMultipartUpload(params)
-			s3Log.Debug(resp)
 
-			if mapAwsError(err) == syscall.EACCES {
-				break
+			// once it's aborted we can't tell how big it was
+			size := s.multipartSize(upload.Key, upload.UploadId)
+
+			if !param.DryRun {
+				resp, err := s.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+					Bucket:   &s.bucket,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				})
+				s3Log.Debug(resp)
+
+				if err != nil {
+					err = s.mapAwsError(err)
+					if err == syscall.EACCES {
+						abortErr = err
+						return false
+					}
+					// someone else may have finished it
+					// in the mean time
+					s3Log.Debugf("AbortMultipartUpload Key=%v Id=%v = %v",
+						*upload.Key, *upload.UploadId, err)
+					continue
+				}
 			}
-		} else {
-			s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
+
+			out.Aborted = append(out.Aborted, ExpiredUpload{
+				Key:       *upload.Key,
+				UploadId:  *upload.UploadId,
+				Initiated: *upload.Initiated,
+				Size:      size,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return out, s.mapAwsError(err)
+	}
+
+	return out, abortErr
+}
+
+func (s *S3Backend) multipartSize(key *string, uploadId *string) (size uint64) {
+	err := s.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   &s.bucket,
+		Key:      key,
+		UploadId: uploadId,
+	}, func(page *s3.ListPartsOutput, last bool) bool {
+		for _, p := range page.Parts {
+			size += uint64(aws.Int64Value(p.Size))
 		}
+		return true
+	})
+	if err != nil {
+		s3Log.Debugf("ListParts Key=%v Id=%v = %v", *key, *uploadId, err)
 	}
+	return
+}
 
-	return &MultipartExpireOutput{}, nil
+// the parts AppendBlob copies the object into have to be as big as
+// any part but the last, and no bigger than UploadPartCopy does
+const S3_MIN_APPEND_OFFSET = 5 * 1024 * 1024
+const S3_MAX_COPY_PART = 5 * 1024 * 1024 * 1024
+const S3_MAX_PART_SIZE = 5 * 1024 * 1024 * 1024
+const S3_MAX_OBJECT_SIZE = 5 * 1024 * 1024 * 1024 * 1024
+
+// s3Appended is the backendData of an upload begun by AppendBlob. The
+// first parts are the object as it was, the parts added after are
+// numbered from there
+type s3Appended struct {
+	copiedParts uint32
+}
+
+// AppendBlob begins an upload with what's there copied in on the
+// server side, so only what's appended is sent. The metadata, content
+// type and storage class are kept
+func (s *S3Backend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	if s.gcs || param.Offset < S3_MIN_APPEND_OFFSET {
+		return nil, syscall.ENOTSUP
+	}
+
+	head, err := s.HeadBlob(&HeadBlobInput{Key: param.Key, Context: param.Context})
+	if err != nil {
+		return nil, err
+	}
+	if head.Size != param.Offset || (param.IfMatch != nil &&
+		quoteETag(*param.IfMatch) != quoteETag(nilStr(head.ETag))) {
+		s3Log.Infof("AppendBlob %v: changed since, %v bytes etag %v", param.Key,
+			head.Size, nilStr(head.ETag))
+		return nil, syscall.EBUSY
+	}
+
+	contentType := head.ContentType
+	if contentType == nil {
+		contentType = param.ContentType
+	}
+	mpu, err := s.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:          param.Key,
+		Metadata:     head.Metadata,
+		ContentType:  contentType,
+		StorageClass: head.StorageClass,
+		Context:      param.Context,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(param.Offset)
+	nParts := (size + S3_MAX_COPY_PART - 1) / S3_MAX_COPY_PART
+	// evenly, so the last one isn't too small either
+	partSize := (size + nParts - 1) / nParts
+
+	s.mpuCopyParts(param.Context, size, s.bucket+"/"+param.Key, param.Key, *mpu.UploadId,
+		head.ETag, mpu.Parts[:nParts], partSize, &err)
+	if err != nil {
+		s.MultipartBlobAbort(mpu)
+		return nil, err
+	}
+
+	mpu.NumParts = uint32(nParts)
+	mpu.backendData = &s3Appended{uint32(nParts)}
+	return mpu, nil
 }
 
 func (s *S3Backend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
 	_, err := s.DeleteBucket(&s3.DeleteBucketInput{Bucket: &s.bucket})
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 	return &RemoveBucketOutput{}, nil
 }
@@ -958,7 +1561,13 @@ func (s *S3Backend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error
 		ACL:    &s.config.ACL,
 	})
 	if err != nil {
-		return nil, mapAwsError(err)
+		return nil, s.mapAwsError(err)
 	}
 	return &MakeBucketOutput{}, nil
 }
+
+func (s *S3Backend) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	// only CloudWatch knows without listing the whole bucket, and
+	// only once a day
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,999 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+)
+
+// WebHDFS talks to a Hadoop namenode over its REST api,
+// http://namenode:9870/webhdfs/v1. ADLv1 speaks a dialect of it, and
+// the two share how a listing of keys is made out of listing one
+// directory at a time. The data of OPEN, CREATE and APPEND goes to
+// the datanode that the namenode redirects to. There are no leases,
+// so unlike ADLv1 an upload doesn't keep others from writing
+type WebHDFS struct {
+	cap Capabilities
+
+	flags *FlagStorage
+	errorMap
+	opTimeout
+	config *WebHDFSConfig
+
+	client   *http.Client
+	endpoint *url.URL
+	// a directory everything is under, like for ADLv1
+	bucket string
+
+	// the namenode is older than LISTSTATUS_BATCH, which is
+	// Hadoop 2.8. Updated atomically
+	noListBatch int32
+}
+
+var webhdfsLog = GetLogger("webhdfs")
+
+// how many keys a listing returns when it's not told, the default
+// dfs.ls.limit
+const WEBHDFS_LIST_PAGE = 1000
+
+// webhdfs://namenode:9870/dir, or swebhdfs:// for https
+func IsWebHDFSEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "webhdfs://") ||
+		strings.HasPrefix(endpoint, "swebhdfs://")
+}
+
+// webhdfsFileStatus is a FileStatus of the WebHDFS api, a file or
+// directory
+type webhdfsFileStatus struct {
+	AccessTime int64
+	Length     int64
+	// in ms
+	ModificationTime int64
+	// the name under the directory that was listed, "" for what
+	// GETFILESTATUS was asked about
+	PathSuffix string
+	// octal
+	Permission string
+	// FILE, DIRECTORY or SYMLINK
+	Type string
+}
+
+func webhdfsFileStatus2BlobItem(f *webhdfsFileStatus, key *string) BlobItemOutput {
+	item := BlobItemOutput{
+		Key:          key,
+		LastModified: PTime(adlv1LastModified(f.ModificationTime)),
+		Size:         uint64(f.Length),
+	}
+	if f.AccessTime != 0 {
+		item.Atime = PTime(adlv1LastModified(f.AccessTime))
+	}
+	return item
+}
+
+// webhdfsListDir lists the directory path, from after the entry
+// listAfter. listSize is how many entries are wanted at least, nil
+// for all of them. If path is a file, it's the only entry and has no
+// PathSuffix
+type webhdfsListDir func(ctx context.Context, path string, listAfter string,
+	listSize *int32) ([]webhdfsFileStatus, error)
+
+// webhdfsListing is what ListBlobs has collected so far, in the order
+// the backend returns them
+type webhdfsListing struct {
+	prefixes []BlobPrefixOutput
+	items    []BlobItemOutput
+	// how many more we can take, -1 is no limit
+	budget int
+	// the last key we took, and whether there was more after it
+	last      string
+	truncated bool
+}
+
+func (l *webhdfsListing) take(key string) bool {
+	if l.budget == 0 {
+		l.truncated = true
+		return false
+	}
+	if l.budget > 0 {
+		l.budget--
+	}
+	l.last = key
+	return true
+}
+
+func (l *webhdfsListing) addItem(item BlobItemOutput) bool {
+	if !l.take(*item.Key) {
+		return false
+	}
+	l.items = append(l.items, item)
+	return true
+}
+
+func (l *webhdfsListing) addPrefix(prefix string) bool {
+	if !l.take(prefix) {
+		return false
+	}
+	l.prefixes = append(l.prefixes, BlobPrefixOutput{Prefix: PString(prefix)})
+	return true
+}
+
+// appendToListResults lists path and everything under it if
+// recursive, starting after the key `after`. Directories are listed
+// by name, so the part of `after` that's in this directory is what
+// we pass as listAfter, and if it's under a subdirectory we finish
+// that one first
+func appendToListResults(ctx context.Context, list webhdfsListDir, path string,
+	after string, recursive bool, l *webhdfsListing) error {
+
+	dir := strings.TrimRight(path, "/")
+	base := ""
+	if dir != "" {
+		base = dir + "/"
+	}
+
+	var listAfter string
+	if after != "" {
+		if !strings.HasPrefix(after, base) {
+			if after > base {
+				// everything here is before that
+				return nil
+			}
+			after = ""
+		} else {
+			rest := after[len(base):]
+			if i := strings.IndexByte(rest, '/'); i != -1 {
+				listAfter = rest[:i]
+				if recursive {
+					err := appendToListResults(ctx, list, base+listAfter, after, true, l)
+					if err != nil && err != fuse.ENOENT {
+						return err
+					}
+					if l.truncated {
+						return nil
+					}
+				}
+			} else {
+				listAfter = rest
+			}
+		}
+	}
+
+	// one more than we need so we know if there's more
+	var listSize *int32
+	if l.budget >= 0 {
+		listSize = PInt32(int32(l.budget + 1))
+	}
+
+	statuses, err := list(ctx, path, listAfter, listSize)
+	if err != nil {
+		return err
+	}
+
+	if path != "" && after == "" && listAfter == "" {
+		if len(statuses) == 1 && statuses[0].PathSuffix == "" {
+			// path is actually a file
+			if !strings.HasSuffix(path, "/") {
+				l.addItem(webhdfsFileStatus2BlobItem(&statuses[0], PString(path)))
+			}
+			return nil
+		}
+
+		if !recursive {
+			if strings.HasSuffix(path, "/") {
+				// we listed for the dir object itself
+				if !l.addItem(BlobItemOutput{Key: PString(path)}) {
+					return nil
+				}
+			} else if !l.addPrefix(path + "/") {
+				return nil
+			}
+		}
+	}
+
+	for _, i := range statuses {
+		key := base + i.PathSuffix
+
+		if i.Type == "DIRECTORY" {
+			if recursive {
+				// we shouldn't generate prefixes if
+				// it's a recursive listing
+				if !l.addItem(webhdfsFileStatus2BlobItem(&i, PString(key+"/"))) {
+					return nil
+				}
+
+				err = appendToListResults(ctx, list, key, "", true, l)
+				if err != nil && err != fuse.ENOENT {
+					return err
+				}
+				if l.truncated {
+					return nil
+				}
+			} else if !l.addPrefix(key + "/") {
+				return nil
+			}
+		} else if !l.addItem(webhdfsFileStatus2BlobItem(&i, &key)) {
+			return nil
+		}
+	}
+
+	// if we got all that we asked for, the last one didn't fit
+	return nil
+}
+
+// listWebHDFS is ListBlobs with list, up to budget keys unless
+// MaxKeys says otherwise. -1 is no limit
+func listWebHDFS(ctx context.Context, param *ListBlobsInput, list webhdfsListDir,
+	budget int) (*ListBlobsOutput, error) {
+	var recursive bool
+	if param.Delimiter == nil {
+		// used by tests to cleanup (and also slurping, but
+		// that's only enabled on S3 right now)
+		recursive = true
+	} else if *param.Delimiter != "/" {
+		return nil, syscall.ENOTSUP
+	}
+
+	l := webhdfsListing{budget: budget}
+	if maxKeys := nilUint32(param.MaxKeys); maxKeys != 0 {
+		l.budget = int(maxKeys)
+	}
+
+	// the token is the last key or prefix we returned, which
+	// works the same way as StartAfter
+	after := nilStr(param.StartAfter)
+	if param.ContinuationToken != nil {
+		after = *param.ContinuationToken
+	}
+
+	err := appendToListResults(ctx, list, nilStr(param.Prefix), after, recursive, &l)
+	if err == fuse.ENOENT {
+		err = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var next *string
+	if l.truncated {
+		next = PString(l.last)
+	}
+	// a directory is sorted by name, but "a/" comes after "a-b"
+	// as keys
+	prefixes, items, _ := pageListResults(l.prefixes, l.items, "", 0)
+
+	return &ListBlobsOutput{
+		Prefixes:              prefixes,
+		Items:                 items,
+		NextContinuationToken: next,
+		IsTruncated:           next != nil,
+	}, nil
+}
+
+func NewWebHDFS(bucket string, flags *FlagStorage, config *WebHDFSConfig) (*WebHDFS, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid endpoint: %v", config.Endpoint)
+	}
+	endpoint.Path = strings.TrimRight(endpoint.Path, "/")
+
+	b := &WebHDFS{
+		flags:     flags,
+		errorMap:  errorMap(flags.ErrorMap),
+		opTimeout: opTimeout(flags.OpTimeout),
+		config:    config,
+		endpoint:  endpoint,
+		bucket:    strings.TrimSuffix(normalizePrefix(bucket), "/"),
+		client: &http.Client{
+			Transport: GetHTTPTransport(flags),
+			Timeout:   flags.HTTPTimeout,
+			// the data of a write has to go to where we
+			// are redirected, see request
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cap: Capabilities{
+			NoParallelMultipart: true,
+			DirBlob:             true,
+			Name:                "webhdfs",
+			NoMetadata:          true,
+			AnyPartSize:         true,
+			SupportsAppend:      true,
+			ConditionalCreate:   true,
+			// not allowed in a path by hdfs
+			InvalidKeyChars: ":",
+		},
+	}
+	return b, nil
+}
+
+func (b *WebHDFS) Bucket() string {
+	return b.bucket
+}
+
+// ObjectLocation has the key with the directory that's our bucket
+func (b *WebHDFS) ObjectLocation(key string) objectLocation {
+	path := b.path(key)
+	if strings.HasSuffix(key, "/") {
+		path += "/"
+	}
+	scheme := "webhdfs"
+	if b.endpoint.Scheme == "https" {
+		scheme = "swebhdfs"
+	}
+	return objectLocation{
+		Endpoint: b.endpoint.String(),
+		Key:      path,
+		URL:      scheme + "://" + b.endpoint.Host + "/" + path,
+	}
+}
+
+func (b *WebHDFS) Capabilities() *Capabilities {
+	return &b.cap
+}
+
+func (b *WebHDFS) path(key string) string {
+	key = strings.TrimLeft(key, "/")
+	if b.bucket != "" {
+		if key != "" {
+			key = b.bucket + "/" + key
+		} else {
+			key = b.bucket
+		}
+	}
+	return key
+}
+
+// request sends op on key to the namenode. If data, it's an op that
+// the namenode redirects to a datanode, and body is sent to where it
+// says. size is how long body is, -1 if not known. body can't be sent
+// to the namenode as well, it would have to be read twice, so if it
+// doesn't redirect a write with a body that's EIO instead of
+// dropping the data
+func (b *WebHDFS) request(ctx context.Context, method string, op string, key string,
+	params url.Values, data bool, body io.Reader, size int64) (*http.Response, error) {
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("op", op)
+	if b.config.DelegationToken != "" {
+		params.Set("delegation", string(b.config.DelegationToken))
+	} else if b.config.User != "" {
+		params.Set("user.name", b.config.User)
+	}
+
+	u := *b.endpoint
+	u.Path += "/" + b.path(key)
+	u.RawQuery = params.Encode()
+
+	resp, err := b.send(ctx, op, method, u.String(), nil, 0)
+	if !data || err != nil {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		if body == nil || size == 0 || resp.StatusCode >= 300 {
+			// nothing was left out, or an error which has
+			// nothing to do with the body
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		webhdfsLog.Errorf("%v %v: %v without a redirect, the data wasn't sent",
+			op, key, resp.Status)
+		return nil, syscall.EIO
+	}
+	location := resp.Header.Get("Location")
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if location == "" {
+		webhdfsLog.Errorf("%v %v redirected to nowhere", op, key)
+		return nil, syscall.EIO
+	}
+
+	return b.send(ctx, op, method, location, body, size)
+}
+
+func (b *WebHDFS) send(ctx context.Context, op string, method string, u string,
+	body io.Reader, size int64) (*http.Response, error) {
+
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		// httpfs won't take it otherwise
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	setRequestHeaders(req.Header, b.flags.RequestHeaders)
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	req = TraceRequest(req)
+
+	// the url may have the delegation token
+	path := req.URL.Path
+	webhdfsLog.WithFields(RequestTraceFields(req)).Debugf("%v %v %v", method, op, path)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		webhdfsLog.Errorf("%v %v %v = %v", method, op, path, err)
+		return nil, err
+	}
+	webhdfsLog.WithFields(TraceFields(resp)).Debugf("%v %v %v %v", method, op, path,
+		resp.Status)
+	noteFailedRequest(webhdfsLog, "webhdfs", op, resp, "", "")
+	return resp, nil
+}
+
+// call is request of an op that returns json, which goes into out
+// unless it's nil. If rawError, a RemoteException is returned as an
+// ADLv1Err, which is what it also is for ADLv1
+func (b *WebHDFS) call(ctx context.Context, method string, op string, key string,
+	params url.Values, out interface{}, rawError bool) error {
+
+	resp, err := b.request(ctx, method, op, key, params, false, nil, 0)
+	err = b.mapADLv1Error(resp, err, rawError)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		webhdfsLog.Errorf("%v %v: %v", op, key, err)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// remoteError maps err from call with rawError, if it's a
+// RemoteException that isn't one of exceptions
+func (b *WebHDFS) remoteError(err error, exceptions map[string]error) error {
+	adlErr, ok := err.(ADLv1Err)
+	if !ok {
+		return err
+	}
+	if mapped, ok := exceptions[adlErr.RemoteException.Exception]; ok {
+		return mapped
+	}
+	return b.mapADLv1Error(adlErr.resp, err, false)
+}
+
+func (b *WebHDFS) Init(key string) error {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	resp, err := b.request(ctx, "GET", "GETFILESTATUS", key, nil, false, nil, 0)
+	initErr := adlInitError(b.cap.Name, b.endpoint.Host, b.path(key), resp, err)
+	if initErr != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return initErr
+	}
+	err = b.mapADLv1Error(resp, err, false)
+	if err == nil {
+		resp.Body.Close()
+	} else if err == fuse.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+func (b *WebHDFS) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+
+	var res struct {
+		FileStatus webhdfsFileStatus
+	}
+	err := b.call(ctx, "GET", "GETFILESTATUS", param.Key, nil, &res, false)
+	if err != nil {
+		return nil, err
+	}
+
+	isDir := res.FileStatus.Type == "DIRECTORY"
+
+	// there's no metadata, but the permissions are read back
+	// like the mode metadata is elsewhere
+	var meta map[string]*string
+	if b.flags.PermMetadata && res.FileStatus.Permission != "" {
+		perm, err := strconv.ParseUint(res.FileStatus.Permission, 8, 32)
+		if err == nil {
+			mode := permModeMetadata(os.FileMode(perm), isDir)
+			meta = map[string]*string{PERM_METADATA_MODE: PString(string(mode))}
+		}
+	}
+
+	return &HeadBlobOutput{
+		BlobItemOutput: webhdfsFileStatus2BlobItem(&res.FileStatus, &param.Key),
+		IsDirBlob:      isDir,
+		Metadata:       meta,
+	}, nil
+}
+
+// SetPermission is chmod, --file-mode and --dir-mode are only what
+// new files and directories get
+func (b *WebHDFS) SetPermission(key string, mode os.FileMode) error {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+	return b.call(ctx, "PUT", "SETPERMISSION", key, url.Values{
+		"permission": {fmt.Sprintf("%o", mode.Perm())},
+	}, nil, false)
+}
+
+// listDir is LISTSTATUS_BATCH, a page at a time until there are
+// listSize entries
+func (b *WebHDFS) listDir(ctx context.Context, path string, listAfter string,
+	listSize *int32) ([]webhdfsFileStatus, error) {
+
+	var statuses []webhdfsFileStatus
+	for atomic.LoadInt32(&b.noListBatch) == 0 {
+		params := url.Values{}
+		if listAfter != "" {
+			params.Set("startAfter", listAfter)
+		}
+
+		var res struct {
+			DirectoryListing struct {
+				PartialListing struct {
+					FileStatuses struct {
+						FileStatus []webhdfsFileStatus
+					}
+				}
+				RemainingEntries int
+			}
+		}
+		err := b.call(ctx, "GET", "LISTSTATUS_BATCH", path, params, &res, true)
+		if adlErr, ok := err.(ADLv1Err); ok &&
+			adlErr.RemoteException.Exception == "IllegalArgumentException" &&
+			strings.Contains(adlErr.RemoteException.Message, "LISTSTATUS_BATCH") {
+			webhdfsLog.Infof("no LISTSTATUS_BATCH, listing directories whole")
+			atomic.StoreInt32(&b.noListBatch, 1)
+			break
+		} else if err != nil {
+			return nil, b.remoteError(err, nil)
+		}
+
+		page := res.DirectoryListing.PartialListing.FileStatuses.FileStatus
+		statuses = append(statuses, page...)
+		if res.DirectoryListing.RemainingEntries == 0 || len(page) == 0 ||
+			(listSize != nil && len(statuses) >= int(*listSize)) {
+			return statuses, nil
+		}
+		listAfter = page[len(page)-1].PathSuffix
+	}
+
+	var res struct {
+		FileStatuses struct {
+			FileStatus []webhdfsFileStatus
+		}
+	}
+	err := b.call(ctx, "GET", "LISTSTATUS", path, nil, &res, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range res.FileStatuses.FileStatus {
+		// sorted by name
+		if f.PathSuffix > listAfter {
+			statuses = append(statuses, f)
+		}
+	}
+	return statuses, nil
+}
+
+func (b *WebHDFS) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	return listWebHDFS(ctx, param, b.listDir, WEBHDFS_LIST_PAGE)
+}
+
+func (b *WebHDFS) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *WebHDFS) delete(ctx context.Context, key string, recursive bool) error {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+
+	var res struct {
+		Boolean bool
+	}
+	err := b.call(ctx, "DELETE", "DELETE", key, url.Values{
+		"recursive": {strconv.FormatBool(recursive)},
+	}, &res, true)
+	err = b.remoteError(err, map[string]error{
+		"PathIsNotEmptyDirectoryException": syscall.ENOTEMPTY,
+	})
+	if err != nil {
+		return err
+	}
+	if !res.Boolean {
+		return fuse.ENOENT
+	}
+	return nil
+}
+
+func (b *WebHDFS) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	err := b.delete(param.Context, strings.TrimRight(param.Key, "/"), false)
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteBlobOutput{}, nil
+}
+
+func (b *WebHDFS) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	err := deleteRoots(param.Context, param.Items, b.delete)
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+// RenameBlob replaces the destination like elsewhere, which RENAME
+// only does with renameoptions
+func (b *WebHDFS) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+
+	resp, err := b.request(ctx, "PUT", "RENAME", param.Source, url.Values{
+		"destination":   {"/" + b.path(param.Destination)},
+		"renameoptions": {"OVERWRITE"},
+	}, false, nil, 0)
+	err = b.mapADLv1Error(resp, err, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// with renameoptions there's nothing, older namenodes may
+	// still say whether it worked
+	var res struct {
+		Boolean *bool
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err == nil && res.Boolean != nil && !*res.Boolean {
+		return nil, fuse.ENOENT
+	}
+	return &RenameBlobOutput{}, nil
+}
+
+// CopyBlob reads the source and writes it to a temporary file next to
+// the destination, which is then renamed over it, so the destination
+// is never half written. Metadata and StorageClass are ignored
+func (b *WebHDFS) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	src, err := b.GetBlob(&GetBlobInput{Key: param.Source})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+
+	size := int64(-1)
+	if param.Size != nil {
+		size = int64(*param.Size)
+	}
+
+	tmp := param.Destination + ".goofys-copy-" + RandStringBytesMaskImprSrc(8)
+	err = b.create(param.Context, tmp, src.Body, size, false)
+	if err == nil {
+		_, err = b.RenameBlob(&RenameBlobInput{
+			Source:      tmp,
+			Destination: param.Destination,
+		})
+	}
+	if err != nil {
+		b.DeleteBlob(&DeleteBlobInput{Key: tmp})
+		return nil, err
+	}
+
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *WebHDFS) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	params := url.Values{}
+	if param.Start != 0 {
+		params.Set("offset", strconv.FormatUint(param.Start, 10))
+	}
+	if param.Count != 0 {
+		params.Set("length", strconv.FormatUint(param.Count, 10))
+	}
+
+	ctx, cancel := b.requestContext(param.Context)
+	resp, err := b.request(ctx, "GET", "OPEN", param.Key, params, true, nil, 0)
+	err = b.mapADLv1Error(resp, err, false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key: &param.Key,
+			},
+			IsDirBlob: false,
+		},
+		Body: cancelOnClose{resp.Body, cancel},
+	}, nil
+}
+
+// create is CREATE, which overwrites unless ifNotExists. Then the
+// file being there already is EBUSY
+func (b *WebHDFS) create(ctx context.Context, key string, body io.Reader, size int64, ifNotExists bool) error {
+	ctx, cancel := b.requestContext(ctx)
+	defer cancel()
+
+	resp, err := b.request(ctx, "PUT", "CREATE", key, url.Values{
+		"overwrite":  {strconv.FormatBool(!ifNotExists)},
+		"permission": {fmt.Sprintf("%o", b.flags.FileMode.Perm())},
+	}, true, body, size)
+	err = b.remoteError(b.mapADLv1Error(resp, err, true), map[string]error{
+		"FileAlreadyExistsException": syscall.EBUSY,
+	})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (b *WebHDFS) mkdir(dir string) error {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+
+	var res struct {
+		Boolean bool
+	}
+	err := b.call(ctx, "PUT", "MKDIRS", dir, url.Values{
+		"permission": {fmt.Sprintf("%o", b.flags.DirMode.Perm())},
+	}, &res, false)
+	if err != nil {
+		return err
+	}
+	if !res.Boolean {
+		return fuse.EEXIST
+	}
+	return nil
+}
+
+func (b *WebHDFS) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	if param.DirBlob {
+		err := b.mkdir(param.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &PutBlobOutput{}, nil
+	}
+
+	var body io.Reader = bytes.NewReader(nil)
+	var size int64
+	if param.Body != nil {
+		body = param.Body
+		if param.Size != nil {
+			size = int64(*param.Size)
+		} else {
+			end, err := param.Body.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			_, err = param.Body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			size = end
+		}
+	}
+
+	err := b.create(param.Context, param.Key, body, size, param.IfNotExists)
+	if err != nil {
+		return nil, err
+	}
+	return &PutBlobOutput{}, nil
+}
+
+// webhdfsUpload is the backendData of an upload
+type webhdfsUpload struct {
+	// where the file ended before the upload, abort truncates it
+	// back to there
+	Start uint64
+	// where it ends now
+	Size uint64
+}
+
+// MultipartBlobBegin creates the file empty, and the parts are
+// appended to it. Readers see it grow, like on ADLv1
+func (b *WebHDFS) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	err := b.create(param.Context, param.Key, nil, 0, param.IfNotExists)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartBlobCommitInput{
+		Key:         PString(param.Key),
+		backendData: &webhdfsUpload{},
+	}, nil
+}
+
+func (b *WebHDFS) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	commitData, ok := param.Commit.backendData.(*webhdfsUpload)
+	if !ok {
+		panic("Incorrect commit data type")
+	}
+
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+	resp, err := b.request(ctx, "POST", "APPEND", *param.Commit.Key, nil, true,
+		param.Body, int64(param.Size))
+	err = b.mapADLv1Error(resp, err, false)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	commitData.Size += param.Size
+	return &MultipartBlobAddOutput{}, nil
+}
+
+// MultipartBlobAbort truncates what was appended. The file the upload
+// began with CREATE stays, empty, it replaced what was there already.
+// TRUNCATE is hadoop 2.7 and later, before that what was appended is
+// left and the abort fails
+func (b *WebHDFS) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	commitData, ok := param.backendData.(*webhdfsUpload)
+	if !ok {
+		panic("Incorrect commit data type")
+	}
+	if commitData.Size == commitData.Start {
+		return &MultipartBlobAbortOutput{}, nil
+	}
+
+	ctx, cancel := b.requestContext(param.Context)
+	defer cancel()
+
+	// false only means the last block is still being cut, which
+	// the namenode finishes by itself
+	var res struct {
+		Boolean bool
+	}
+	err := b.call(ctx, "POST", "TRUNCATE", *param.Key, url.Values{
+		"newlength": {strconv.FormatUint(commitData.Start, 10)},
+	}, &res, false)
+	if err != nil {
+		webhdfsLog.Errorf("could not truncate %v back to %v: %v", *param.Key,
+			commitData.Start, err)
+		return nil, err
+	}
+	commitData.Size = commitData.Start
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+// MultipartBlobCommit has nothing to do, the parts are in the file
+// already. APPEND can't say where it expects the file to end, so
+// with --fail-on-conflict we check that nobody else wrote to it
+func (b *WebHDFS) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	commitData, ok := param.backendData.(*webhdfsUpload)
+	if !ok {
+		panic("Incorrect commit data type")
+	}
+
+	if b.flags.FailOnConflict {
+		head, err := b.HeadBlob(&HeadBlobInput{Key: *param.Key})
+		if err == fuse.ENOENT {
+			err = syscall.ESTALE
+		}
+		if err != nil {
+			return nil, err
+		}
+		if head.Size != commitData.Size {
+			webhdfsLog.Warnf("%v is %v bytes instead of %v, someone else "+
+				"wrote to it", *param.Key, head.Size, commitData.Size)
+			return nil, syscall.ESTALE
+		}
+	}
+
+	return &MultipartBlobCommitOutput{}, nil
+}
+
+func (b *WebHDFS) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *WebHDFS) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return &MultipartBlobCommitInput{
+		Key: PString(param.Key),
+		backendData: &webhdfsUpload{
+			Start: param.Offset,
+			Size:  param.Offset,
+		},
+	}, nil
+}
+
+func (b *WebHDFS) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	if b.bucket == "" {
+		return nil, fuse.EINVAL
+	}
+
+	err := b.delete(nil, "", false)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoveBucketOutput{}, nil
+}
+
+func (b *WebHDFS) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	if b.bucket == "" {
+		return nil, fuse.EINVAL
+	}
+
+	err := b.mkdir("")
+	if err != nil {
+		return nil, err
+	}
+	return &MakeBucketOutput{}, nil
+}
+
+func (b *WebHDFS) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	ctx, cancel := b.requestContext(nil)
+	defer cancel()
+
+	var res struct {
+		ContentSummary struct {
+			DirectoryCount uint64
+			FileCount      uint64
+			Length         uint64
+			// includes the replicas
+			SpaceConsumed uint64
+		}
+	}
+	err := b.call(ctx, "GET", "GETCONTENTSUMMARY", "", nil, &res, false)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &res.ContentSummary
+	out := &GetBucketUsageOutput{
+		Bytes:   summary.SpaceConsumed,
+		Objects: summary.FileCount + summary.DirectoryCount,
+	}
+	if out.Bytes == 0 {
+		out.Bytes = summary.Length
+	}
+	return out, nil
+}
@@ -0,0 +1,450 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+// WebHDFSTest has a namenode that is also the datanode, with a flat
+// map of files and a page size of 2 for LISTSTATUS_BATCH
+type WebHDFSTest struct {
+	server *httptest.Server
+	hdfs   *WebHDFS
+
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// the namenode is too old for LISTSTATUS_BATCH
+	noBatch bool
+	// the namenode takes writes itself instead of redirecting
+	noRedirect bool
+	// query of the last request that wasn't redirected
+	query map[string]string
+}
+
+var _ = Suite(&WebHDFSTest{})
+
+func (s *WebHDFSTest) SetUpTest(t *C) {
+	s.files = map[string][]byte{
+		"/dir/a":   []byte("a"),
+		"/dir/b/c": []byte("c"),
+		"/dir/d":   []byte("dd"),
+		"/dir/e":   []byte("eee"),
+	}
+	s.dirs = map[string]bool{"/dir": true, "/dir/b": true}
+	s.noBatch = false
+	s.noRedirect = false
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	var err error
+	s.hdfs, err = NewWebHDFS("", &FlagStorage{}, &WebHDFSConfig{
+		Endpoint: s.server.URL + "/webhdfs/v1",
+		User:     "alice",
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *WebHDFSTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func webhdfsReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func webhdfsException(w http.ResponseWriter, status int, exception string, message string) {
+	webhdfsReply(w, status, map[string]interface{}{
+		"RemoteException": map[string]string{
+			"exception": exception,
+			"message":   message,
+		},
+	})
+}
+
+// children are the entries of dir, sorted
+func (s *WebHDFSTest) children(dir string) (names []string) {
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if !strings.HasPrefix(p, dir+"/") {
+			return
+		}
+		name := strings.SplitN(p[len(dir)+1:], "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for p := range s.files {
+		add(p)
+	}
+	for p := range s.dirs {
+		add(p)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (s *WebHDFSTest) status(p string, suffix string) map[string]interface{} {
+	f := map[string]interface{}{
+		"pathSuffix":       suffix,
+		"modificationTime": 1500000000000,
+		"permission":       "644",
+		"type":             "FILE",
+	}
+	if s.dirs[p] {
+		f["type"] = "DIRECTORY"
+		f["permission"] = "755"
+	} else {
+		f["length"] = len(s.files[p])
+	}
+	return f
+}
+
+func (s *WebHDFSTest) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	p := strings.TrimRight(strings.TrimPrefix(r.URL.Path, "/webhdfs/v1"), "/")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if q.Get("datanode") == "" {
+		s.query = make(map[string]string)
+		for k := range q {
+			s.query[k] = q.Get(k)
+		}
+	}
+
+	op := q.Get("op")
+	switch op {
+	case "OPEN", "CREATE", "APPEND":
+		if q.Get("datanode") == "" && !s.noRedirect {
+			if len(body) != 0 {
+				webhdfsException(w, http.StatusBadRequest,
+					"IllegalArgumentException", "data sent to the namenode")
+				return
+			}
+			q.Set("datanode", "true")
+			w.Header().Set("Location", s.server.URL+r.URL.Path+"?"+q.Encode())
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	_, isFile := s.files[p]
+	exists := isFile || s.dirs[p]
+
+	switch op {
+	case "GETFILESTATUS":
+		if !exists {
+			webhdfsException(w, http.StatusNotFound, "FileNotFoundException", p)
+			return
+		}
+		webhdfsReply(w, http.StatusOK, map[string]interface{}{
+			"FileStatus": s.status(p, ""),
+		})
+	case "LISTSTATUS", "LISTSTATUS_BATCH":
+		if op == "LISTSTATUS_BATCH" && s.noBatch {
+			webhdfsException(w, http.StatusBadRequest, "IllegalArgumentException",
+				"Invalid value for webhdfs parameter \"op\": No enum constant "+
+					"org.apache.hadoop.hdfs.web.resources.GetOpParam.Op.LISTSTATUS_BATCH")
+			return
+		}
+		if !exists {
+			webhdfsException(w, http.StatusNotFound, "FileNotFoundException", p)
+			return
+		}
+
+		statuses := []interface{}{}
+		remaining := 0
+		if isFile {
+			statuses = append(statuses, s.status(p, ""))
+		} else {
+			for _, name := range s.children(p) {
+				if op == "LISTSTATUS_BATCH" && name <= q.Get("startAfter") {
+					continue
+				}
+				if op == "LISTSTATUS_BATCH" && len(statuses) == 2 {
+					remaining++
+					continue
+				}
+				statuses = append(statuses, s.status(p+"/"+name, name))
+			}
+		}
+
+		fileStatuses := map[string]interface{}{"FileStatus": statuses}
+		if op == "LISTSTATUS" {
+			webhdfsReply(w, http.StatusOK, map[string]interface{}{
+				"FileStatuses": fileStatuses,
+			})
+		} else {
+			webhdfsReply(w, http.StatusOK, map[string]interface{}{
+				"DirectoryListing": map[string]interface{}{
+					"partialListing":   map[string]interface{}{"FileStatuses": fileStatuses},
+					"remainingEntries": remaining,
+				},
+			})
+		}
+	case "OPEN":
+		if !isFile {
+			webhdfsException(w, http.StatusNotFound, "FileNotFoundException", p)
+			return
+		}
+		w.Write(s.files[p])
+	case "CREATE":
+		if exists && q.Get("overwrite") == "false" {
+			webhdfsException(w, http.StatusForbidden, "FileAlreadyExistsException", p)
+			return
+		}
+		s.files[p] = body
+		w.WriteHeader(http.StatusCreated)
+	case "APPEND":
+		s.files[p] = append(s.files[p], body...)
+	case "TRUNCATE":
+		n, _ := strconv.Atoi(q.Get("newlength"))
+		if !isFile || n > len(s.files[p]) {
+			webhdfsException(w, http.StatusBadRequest,
+				"HadoopIllegalArgumentException", p)
+			return
+		}
+		s.files[p] = s.files[p][:n]
+		webhdfsReply(w, http.StatusOK, map[string]bool{"boolean": true})
+	case "DELETE":
+		if s.dirs[p] && len(s.children(p)) != 0 && q.Get("recursive") != "true" {
+			webhdfsException(w, http.StatusForbidden,
+				"PathIsNotEmptyDirectoryException", p)
+			return
+		}
+		for f := range s.files {
+			if f == p || strings.HasPrefix(f, p+"/") {
+				delete(s.files, f)
+			}
+		}
+		for d := range s.dirs {
+			if d == p || strings.HasPrefix(d, p+"/") {
+				delete(s.dirs, d)
+			}
+		}
+		webhdfsReply(w, http.StatusOK, map[string]bool{"boolean": exists})
+	case "RENAME":
+		if !isFile {
+			webhdfsException(w, http.StatusNotFound, "FileNotFoundException", p)
+			return
+		}
+		s.files[q.Get("destination")] = s.files[p]
+		delete(s.files, p)
+	default:
+		webhdfsException(w, http.StatusBadRequest, "UnsupportedOperationException", op)
+	}
+}
+
+func (s *WebHDFSTest) list(t *C, param *ListBlobsInput) (keys []string) {
+	for {
+		resp, err := s.hdfs.ListBlobs(param)
+		t.Assert(err, IsNil)
+		for _, p := range resp.Prefixes {
+			keys = append(keys, *p.Prefix)
+		}
+		for _, i := range resp.Items {
+			keys = append(keys, *i.Key)
+		}
+		if !resp.IsTruncated {
+			return
+		}
+		param.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+func (s *WebHDFSTest) TestEndpoint(t *C) {
+	t.Assert(IsWebHDFSEndpoint("webhdfs://namenode:9870/dir"), Equals, true)
+	t.Assert(IsWebHDFSEndpoint("swebhdfs://namenode:9871"), Equals, true)
+	t.Assert(IsWebHDFSEndpoint("adl://account.azuredatalakestore.net"), Equals, false)
+}
+
+func (s *WebHDFSTest) TestHead(t *C) {
+	resp, err := s.hdfs.HeadBlob(&HeadBlobInput{Key: "dir/e"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(3))
+	t.Assert(resp.IsDirBlob, Equals, false)
+	t.Assert(s.query["user.name"], Equals, "alice")
+
+	resp, err = s.hdfs.HeadBlob(&HeadBlobInput{Key: "dir/b"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.IsDirBlob, Equals, true)
+
+	_, err = s.hdfs.HeadBlob(&HeadBlobInput{Key: "dir/x"})
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *WebHDFSTest) TestDelegationToken(t *C) {
+	s.hdfs.config.DelegationToken = "token"
+	_, err := s.hdfs.HeadBlob(&HeadBlobInput{Key: "dir/e"})
+	t.Assert(err, IsNil)
+	t.Assert(s.query["delegation"], Equals, "token")
+	_, hasUser := s.query["user.name"]
+	t.Assert(hasUser, Equals, false)
+}
+
+func (s *WebHDFSTest) TestListBatch(t *C) {
+	keys := s.list(t, &ListBlobsInput{
+		Prefix:    PString("dir/"),
+		Delimiter: PString("/"),
+	})
+	// a page is prefixes, then items
+	t.Assert(keys, DeepEquals, []string{"dir/b/", "dir/", "dir/a", "dir/d", "dir/e"})
+
+	keys = s.list(t, &ListBlobsInput{
+		Prefix:    PString("dir/"),
+		Delimiter: PString("/"),
+		MaxKeys:   PUInt32(1),
+	})
+	t.Assert(keys, DeepEquals, []string{"dir/", "dir/a", "dir/b/", "dir/d", "dir/e"})
+
+	keys = s.list(t, &ListBlobsInput{Prefix: PString("dir")})
+	t.Assert(keys, DeepEquals, []string{"dir/a", "dir/b/", "dir/b/c", "dir/d", "dir/e"})
+}
+
+func (s *WebHDFSTest) TestListNoBatch(t *C) {
+	s.noBatch = true
+	keys := s.list(t, &ListBlobsInput{
+		Prefix:     PString("dir/"),
+		Delimiter:  PString("/"),
+		StartAfter: PString("dir/b/"),
+	})
+	t.Assert(keys, DeepEquals, []string{"dir/d", "dir/e"})
+	t.Assert(s.hdfs.noListBatch, Equals, int32(1))
+}
+
+func (s *WebHDFSTest) TestReadWrite(t *C) {
+	_, err := s.hdfs.PutBlob(&PutBlobInput{
+		Key:  "dir/f",
+		Body: bytes.NewReader([]byte("hello")),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(string(s.files["/dir/f"]), Equals, "hello")
+	t.Assert(s.query["overwrite"], Equals, "true")
+
+	_, err = s.hdfs.PutBlob(&PutBlobInput{
+		Key:         "dir/f",
+		Body:        bytes.NewReader([]byte("again")),
+		IfNotExists: true,
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	commit, err := s.hdfs.AppendBlob(&AppendBlobInput{Key: "dir/f", Offset: 5})
+	t.Assert(err, IsNil)
+	_, err = s.hdfs.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit: commit,
+		Body:   bytes.NewReader([]byte(" world")),
+		Size:   6,
+	})
+	t.Assert(err, IsNil)
+	_, err = s.hdfs.MultipartBlobCommit(commit)
+	t.Assert(err, IsNil)
+
+	resp, err := s.hdfs.GetBlob(&GetBlobInput{Key: "dir/f", Start: 6, Count: 5})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	// the fake datanode ignores the range
+	t.Assert(string(data), Equals, "hello world")
+	t.Assert(s.query["offset"], Equals, "6")
+	t.Assert(s.query["length"], Equals, "5")
+}
+
+func (s *WebHDFSTest) TestNoRedirect(t *C) {
+	s.noRedirect = true
+
+	_, err := s.hdfs.PutBlob(&PutBlobInput{
+		Key:  "dir/f",
+		Body: bytes.NewReader([]byte("hello")),
+	})
+	t.Assert(err, Equals, syscall.EIO)
+
+	// with nothing to send it doesn't matter
+	commit, err := s.hdfs.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "dir/g"})
+	t.Assert(err, IsNil)
+	_, err = s.hdfs.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit: commit,
+		Body:   bytes.NewReader([]byte("hello")),
+		Size:   5,
+	})
+	t.Assert(err, Equals, syscall.EIO)
+}
+
+func (s *WebHDFSTest) TestAbort(t *C) {
+	commit, err := s.hdfs.AppendBlob(&AppendBlobInput{Key: "dir/e", Offset: 3})
+	t.Assert(err, IsNil)
+	_, err = s.hdfs.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit: commit,
+		Body:   bytes.NewReader([]byte("fff")),
+		Size:   3,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(string(s.files["/dir/e"]), Equals, "eeefff")
+
+	_, err = s.hdfs.MultipartBlobAbort(commit)
+	t.Assert(err, IsNil)
+	t.Assert(string(s.files["/dir/e"]), Equals, "eee")
+	t.Assert(s.query["newlength"], Equals, "3")
+}
+
+func (s *WebHDFSTest) TestDelete(t *C) {
+	_, err := s.hdfs.DeleteBlob(&DeleteBlobInput{Key: "dir/b/"})
+	t.Assert(err, Equals, syscall.ENOTEMPTY)
+
+	_, err = s.hdfs.DeleteBlobs(&DeleteBlobsInput{
+		Items: []string{"dir/b/", "dir/b/c", "dir/a"},
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.children("/dir"), DeepEquals, []string{"d", "e"})
+
+	_, err = s.hdfs.DeleteBlob(&DeleteBlobInput{Key: "dir/a"})
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *WebHDFSTest) TestRename(t *C) {
+	_, err := s.hdfs.RenameBlob(&RenameBlobInput{
+		Source:      "dir/a",
+		Destination: "dir/z",
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.query["destination"], Equals, "/dir/z")
+	t.Assert(s.query["renameoptions"], Equals, "OVERWRITE")
+	t.Assert(string(s.files["/dir/z"]), Equals, "a")
+
+	_, err = s.hdfs.CopyBlob(&CopyBlobInput{Source: "dir/z", Destination: "dir/y"})
+	t.Assert(err, IsNil)
+	t.Assert(string(s.files["/dir/y"]), Equals, "a")
+	t.Assert(s.children("/dir"), DeepEquals, []string{"b", "d", "e", "y", "z"})
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The backend xattrs say where the object behind a file is and what
+// the last HEAD of it returned, for jobs that go to it with an SDK
+// instead: s3.key, s3.url, s3.endpoint, s3.etag, s3.storage-class,
+// s3.sse and s3.last-modified. They are named after the backend, gcs.
+// on GCS and adl. on Azure, and are read-only. s3.etag and
+// s3.storage-class are older than the rest, so the s3. names can be
+// read on every backend.
+//
+// etag and storage-class are what listings and lookups last said.
+// sse and last-modified only come from HEAD, which is done again when
+// it's older than --stat-cache-ttl or of another version of the file
+
+const (
+	XATTR_BACKEND_KEY           = "key"
+	XATTR_BACKEND_URL           = "url"
+	XATTR_BACKEND_ENDPOINT      = "endpoint"
+	XATTR_BACKEND_SSE           = "sse"
+	XATTR_BACKEND_LAST_MODIFIED = "last-modified"
+)
+
+// xattrNamespace is the prefix of the backend xattrs of cloud
+func xattrNamespace(cloud StorageBackend) string {
+	switch cloud.Capabilities().Name {
+	case "gs", "gcs":
+		return "gcs."
+	case "adl", "adl2", "wasb":
+		return "adl."
+	default:
+		return "s3."
+	}
+}
+
+// objectLocation is where an object is. Key is what the service knows
+// it as, which isn't what the backend was given if the backend adds a
+// prefix of its own
+type objectLocation struct {
+	Endpoint string
+	Key      string
+	URL      string
+}
+
+// objectLocator is a backend that can say where an object is
+type objectLocator interface {
+	ObjectLocation(key string) objectLocation
+}
+
+// headXattrs is what only HEAD tells about an object
+type headXattrs struct {
+	// of the object this is about
+	etag         string
+	sse          string
+	lastModified time.Time
+	// when the HEAD was
+	time time.Time
+}
+
+func newHeadXattrs(etag string, resp *HeadBlobOutput) *headXattrs {
+	h := &headXattrs{
+		etag: etag,
+		sse:  nilStr(resp.ServerSideEncryption),
+		time: time.Now(),
+	}
+	if resp.LastModified != nil {
+		h.lastModified = *resp.LastModified
+	}
+	return h
+}
+
+// backendXattrName is name without the backend namespace, if it's in
+// it
+func (inode *Inode) backendXattrName(name string) (string, bool) {
+	if strings.HasPrefix(name, "s3.") {
+		return name[3:], true
+	}
+	cloud, _ := inode.cloud()
+	if cloud == nil {
+		return "", false
+	}
+	ns := xattrNamespace(cloud)
+	if strings.HasPrefix(name, ns) {
+		return name[len(ns):], true
+	}
+	return "", false
+}
+
+// backendXattrs are the backend xattrs, without the namespace. There
+// are none if we don't know about an object, like for implicit dirs
+// and files that weren't flushed yet
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) backendXattrs() (meta map[string][]byte) {
+	meta = inode.s3Metadata()
+	if len(meta) == 0 {
+		return
+	}
+
+	cloud, key := inode.cloud()
+	if inode.isDir() {
+		key += "/"
+	}
+	meta[XATTR_BACKEND_KEY] = []byte(key)
+	if l, ok := unwrapBackend(cloud).(objectLocator); ok {
+		loc := l.ObjectLocation(key)
+		meta[XATTR_BACKEND_KEY] = []byte(loc.Key)
+		meta[XATTR_BACKEND_URL] = []byte(loc.URL)
+		meta[XATTR_BACKEND_ENDPOINT] = []byte(loc.Endpoint)
+	}
+
+	if h := inode.head; h != nil && h.etag == inode.etag {
+		if h.sse != "" {
+			meta[XATTR_BACKEND_SSE] = []byte(h.sse)
+		}
+		if !h.lastModified.IsZero() {
+			meta[XATTR_BACKEND_LAST_MODIFIED] =
+				[]byte(h.lastModified.UTC().Format(time.RFC3339))
+		}
+	}
+	return
+}
+
+// refreshHead HEADs the file again if what we have from the last HEAD
+// is older than maxAge, or was of another version
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) refreshHead(maxAge time.Duration) error {
+	if inode.isDir() || inode.KnownSize == nil {
+		return nil
+	}
+	if h := inode.head; h != nil && h.etag == inode.etag && time.Since(h.time) <= maxAge {
+		return nil
+	}
+
+	cloud, key := inode.cloud()
+	resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if err != nil {
+		err = inode.fs.mapAwsError(err)
+		if err == fuse.ENOENT {
+			// what we have is all there is
+			err = nil
+		}
+		return err
+	}
+	inode.fillXattrFromHead(resp)
+	return nil
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) getBackendXattr(name string) ([]byte, error) {
+	switch name {
+	case XATTR_BACKEND_SSE, XATTR_BACKEND_LAST_MODIFIED:
+		err := inode.refreshHead(inode.fs.flags.StatCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	value, ok := inode.backendXattrs()[name]
+	if !ok {
+		return nil, ENOATTR
+	}
+	return value, nil
+}
+
+// listBackendXattrs is for ListXattr, which only HEADs if it never
+// did for this version of the file
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) listBackendXattrs() ([]string, error) {
+	err := inode.refreshHead(math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := inode.backendXattrs()
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	cloud, _ := inode.cloud()
+	ns := xattrNamespace(cloud)
+	names := make([]string, 0, len(meta))
+	for k := range meta {
+		names = append(names, ns+k)
+	}
+	return names, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// locatedBackend is an object under a prefix of its own, and counts
+// HEADs
+type locatedBackend struct {
+	slowBackend
+	name  string
+	sse   string
+	mtime time.Time
+	heads int
+}
+
+func (b *locatedBackend) Capabilities() *Capabilities {
+	return &Capabilities{Name: b.name}
+}
+
+func (b *locatedBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.heads++
+	out, err := b.slowBackend.HeadBlob(param)
+	if err == nil {
+		out.LastModified = PTime(b.mtime)
+		out.ServerSideEncryption = PStringOrNil(b.sse)
+	}
+	return out, err
+}
+
+func (b *locatedBackend) ObjectLocation(key string) objectLocation {
+	return objectLocation{
+		Endpoint: "https://endpoint",
+		Key:      "prefix/" + key,
+		URL:      "s3://bucket/prefix/" + key,
+	}
+}
+
+type BackendXattrTest struct {
+	cloud *locatedBackend
+}
+
+var _ = Suite(&BackendXattrTest{})
+
+func (s *BackendXattrTest) SetUpTest(t *C) {
+	s.cloud = &locatedBackend{
+		name:  "s3",
+		sse:   "aws:kms",
+		mtime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	s.cloud.etag = "\"etag\""
+	s.cloud.size = 1024
+}
+
+func (s *BackendXattrTest) existing() *Inode {
+	inode := newTestInode(s.cloud)
+	inode.KnownSize = PUInt64(s.cloud.size)
+	inode.Attributes.Size = s.cloud.size
+	inode.fs.flags.StatCacheTTL = time.Minute
+	return inode
+}
+
+func (s *BackendXattrTest) TestList(t *C) {
+	inode := s.existing()
+
+	xattrs, err := inode.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(xattrs, DeepEquals, []string{"s3.endpoint", "s3.etag", "s3.key",
+		"s3.last-modified", "s3.sse", "s3.storage-class", "s3.url"})
+
+	for name, expected := range map[string]string{
+		"s3.endpoint":      "https://endpoint",
+		"s3.key":           "prefix/file",
+		"s3.url":           "s3://bucket/prefix/file",
+		"s3.sse":           "aws:kms",
+		"s3.last-modified": "2020-01-02T03:04:05Z",
+	} {
+		value, err := inode.GetXattr(name)
+		t.Assert(err, IsNil)
+		t.Assert(string(value), Equals, expected)
+	}
+	t.Assert(s.cloud.heads, Equals, 1)
+
+	// nothing until it's flushed
+	inode = newTestInode(s.cloud)
+	xattrs, err = inode.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(xattrs, HasLen, 0)
+	_, err = inode.GetXattr("s3.key")
+	t.Assert(err, Equals, ENOATTR)
+}
+
+func (s *BackendXattrTest) TestRefresh(t *C) {
+	inode := s.existing()
+
+	value, err := inode.GetXattr("s3.last-modified")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "2020-01-02T03:04:05Z")
+	t.Assert(s.cloud.heads, Equals, 1)
+
+	s.cloud.mtime = time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	value, err = inode.GetXattr("s3.last-modified")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "2020-01-02T03:04:05Z")
+
+	// older than --stat-cache-ttl
+	inode.head.time = time.Now().Add(-2 * time.Minute)
+	value, err = inode.GetXattr("s3.last-modified")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "2021-01-02T03:04:05Z")
+	t.Assert(s.cloud.heads, Equals, 2)
+
+	// the file was written since
+	s.cloud.etag = "\"etag2\""
+	inode.etag = "\"etag2\""
+	_, err = inode.GetXattr("s3.sse")
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.heads, Equals, 3)
+
+	// the rest is what we have
+	_, err = inode.GetXattr("s3.etag")
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.heads, Equals, 3)
+}
+
+func (s *BackendXattrTest) TestReadOnly(t *C) {
+	inode := s.existing()
+
+	for _, name := range []string{"s3.key", "s3.etag", "s3.last-modified"} {
+		t.Assert(inode.SetXattr(name, []byte("x"), 0), Equals, syscall.EPERM)
+		t.Assert(inode.RemoveXattr(name), Equals, syscall.EPERM)
+	}
+}
+
+func (s *BackendXattrTest) TestNamespace(t *C) {
+	s.cloud.name = "gs"
+	inode := s.existing()
+
+	xattrs, err := inode.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(xattrs, DeepEquals, []string{"gcs.endpoint", "gcs.etag", "gcs.key",
+		"gcs.last-modified", "gcs.sse", "gcs.storage-class", "gcs.url"})
+
+	value, err := inode.GetXattr("gcs.key")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "prefix/file")
+	t.Assert(inode.SetXattr("gcs.key", value, 0), Equals, syscall.EPERM)
+
+	// what there was before
+	value, err = inode.GetXattr("s3.etag")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "\"etag\"")
+
+	t.Assert(xattrNamespace(&locatedBackend{name: "adl2"}), Equals, "adl.")
+}
@@ -0,0 +1,305 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a delete waits for others to go in its batch
+const UNLINK_BATCH_DELAY = 10 * time.Millisecond
+
+// BatchUnlinkBackend is --batch-unlink. `rm -rf` unlinks a file at a
+// time and waits for each, so it goes no faster than one DeleteBlob
+// after another. Here DeleteBlob returns right away, and the keys are
+// deleted in multi-deletes of up to DELETE_BATCH_SIZE, with
+// --delete-concurrency of them in flight, as fast as the kernel sends
+// the unlinks.
+//
+// Anything else on a key waits for its delete to be done first, and
+// a listing for the deletes under its prefix. So a key never comes
+// back after it was unlinked, a new one with the same name isn't
+// deleted by the old unlink, and rmdir only deletes a directory after
+// everything in it, which ADLv1 needs. A delete that fails leaves the
+// key there for the next listing, where rmdir of its directory finds
+// it and fails with ENOTEMPTY, and the next unlink fails with its
+// error, like the next write does after a part failed to upload
+type BatchUnlinkBackend struct {
+	StorageBackend
+
+	gate *Ticket
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// not sent yet
+	queue []string
+	// queued or being deleted, and in what order they were queued
+	pending map[string]uint64
+	seq     uint64
+	// sends the queue if it doesn't fill up first
+	timer *time.Timer
+	// of a delete that failed, for the next unlink
+	err error
+
+	deleted      uint64
+	lastProgress time.Time
+}
+
+func NewBatchUnlinkBackend(cloud StorageBackend, flags *FlagStorage) *BatchUnlinkBackend {
+	concurrency := flags.DeleteConcurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_DELETE_CONCURRENCY
+	}
+
+	b := &BatchUnlinkBackend{
+		StorageBackend: cloud,
+		gate:           Ticket{Total: uint32(concurrency)}.Init(),
+		pending:        make(map[string]uint64),
+		lastProgress:   time.Now(),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *BatchUnlinkBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+func findBatchUnlinkBackend(cloud StorageBackend) (batch *BatchUnlinkBackend) {
+	walkBackends(cloud, func(b StorageBackend) bool {
+		batch, _ = b.(*BatchUnlinkBackend)
+		return batch != nil
+	})
+	return
+}
+
+func (b *BatchUnlinkBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		// this key is left alone, the error was another's
+		err := b.err
+		b.err = nil
+		return nil, err
+	}
+
+	if _, ok := b.pending[param.Key]; ok {
+		return &DeleteBlobOutput{}, nil
+	}
+	b.seq++
+	b.pending[param.Key] = b.seq
+	b.queue = append(b.queue, param.Key)
+
+	if len(b.queue) >= DELETE_BATCH_SIZE {
+		b.sendQueue()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(UNLINK_BATCH_DELAY, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.sendQueue()
+		})
+	}
+	return &DeleteBlobOutput{}, nil
+}
+
+// sendQueue starts a multi-delete of what's queued
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *BatchUnlinkBackend) sendQueue() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.queue) == 0 {
+		return
+	}
+	batch := b.queue
+	b.queue = nil
+	go b.send(batch)
+}
+
+// waitForDirs returns once the keys queued before batch under its
+// directory blobs are deleted. The ones in batch are up to DeleteBlobs
+func (b *BatchUnlinkBackend) waitForDirs(batch []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	first := b.pending[batch[0]]
+	for {
+		waiting := false
+		for _, dir := range batch {
+			if !strings.HasSuffix(dir, "/") {
+				continue
+			}
+			for key, seq := range b.pending {
+				if seq < first && strings.HasPrefix(key, dir) {
+					waiting = true
+					break
+				}
+			}
+			if waiting {
+				break
+			}
+		}
+		if !waiting {
+			return
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *BatchUnlinkBackend) send(batch []string) {
+	// batches before this one may still be going. Not under the gate,
+	// they may be waiting for it
+	b.waitForDirs(batch)
+
+	b.gate.Take(1, true)
+	defer b.gate.Return(1)
+
+	// the ADL backends sort the batch in place
+	items := make([]string, len(batch))
+	copy(items, batch)
+
+	var failed map[string]error
+	_, err := b.StorageBackend.DeleteBlobs(&DeleteBlobsInput{Items: items})
+	if partial, ok := err.(*DeleteBlobsError); ok {
+		failed = partial.Failed
+	} else if err != nil {
+		failed = make(map[string]error)
+		for _, key := range batch {
+			failed[key] = err
+		}
+	}
+	for key, err := range failed {
+		log.Errorf("unlink of %v failed, it's still there: %v", key, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, err := range failed {
+		if b.err == nil {
+			b.err = err
+		}
+	}
+
+	for _, key := range batch {
+		delete(b.pending, key)
+	}
+	b.deleted += uint64(len(batch) - len(failed))
+	if len(b.pending) == 0 || time.Since(b.lastProgress) >= REMOVE_PROGRESS_INTERVAL {
+		log.Infof("unlinked %v objects, %v to go", b.deleted, len(b.pending))
+		b.lastProgress = time.Now()
+	}
+	b.cond.Broadcast()
+}
+
+// waitFor returns once none of keys, or no key under prefix if it's
+// not nil, is being deleted
+func (b *BatchUnlinkBackend) waitFor(prefix *string, keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		waiting := false
+		for _, key := range keys {
+			if _, ok := b.pending[key]; ok {
+				waiting = true
+				break
+			}
+		}
+		if !waiting && prefix != nil {
+			for key := range b.pending {
+				if strings.HasPrefix(key, *prefix) {
+					waiting = true
+					break
+				}
+			}
+		}
+		if !waiting {
+			return
+		}
+		// no point waiting for the timer
+		b.sendQueue()
+		b.cond.Wait()
+	}
+}
+
+// Close waits for every delete that's queued
+func (b *BatchUnlinkBackend) Close() {
+	b.waitFor(PString(""))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		log.Errorf("unlinks failed before unmount: %v", b.err)
+		b.err = nil
+	}
+}
+
+func (b *BatchUnlinkBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.waitFor(nil, param.Key)
+	return b.StorageBackend.HeadBlob(param)
+}
+
+func (b *BatchUnlinkBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	b.waitFor(PString(nilStr(param.Prefix)))
+	return b.StorageBackend.ListBlobs(param)
+}
+
+func (b *BatchUnlinkBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	b.waitFor(PString(nilStr(param.Prefix)))
+	return b.StorageBackend.ListBlobVersions(param)
+}
+
+func (b *BatchUnlinkBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	b.waitFor(nil, param.Items...)
+	return b.StorageBackend.DeleteBlobs(param)
+}
+
+func (b *BatchUnlinkBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	b.waitFor(nil, param.Source, param.Destination)
+	return b.StorageBackend.RenameBlob(param)
+}
+
+func (b *BatchUnlinkBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.waitFor(nil, param.Source, param.Destination)
+	return b.StorageBackend.CopyBlob(param)
+}
+
+func (b *BatchUnlinkBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.waitFor(nil, param.Key)
+	return b.StorageBackend.GetBlob(param)
+}
+
+func (b *BatchUnlinkBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.waitFor(nil, param.Key)
+	return b.StorageBackend.PutBlob(param)
+}
+
+func (b *BatchUnlinkBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	b.waitFor(nil, param.Key)
+	return b.StorageBackend.MultipartBlobBegin(param)
+}
+
+func (b *BatchUnlinkBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	b.waitFor(nil, param.Key)
+	return b.StorageBackend.AppendBlob(param)
+}
@@ -17,7 +17,9 @@ package internal
 import (
 	. "github.com/AITRICS/goofys/api/common"
 
+	"fmt"
 	"io"
+	"net"
 	"runtime"
 	"runtime/debug"
 	"sync"
@@ -26,22 +28,90 @@ import (
 	"github.com/shirou/gopsutil/mem"
 )
 
+// BufferPool hands out memory in size classes of BUF_SIZE << n. A
+// request is carved into the classes that add up to it, so 5MB
+// readahead buffers and 125MB upload parts can share the same memory
+// without either waiting for a buffer of just the right size. Freed
+// buffers are kept on a free list per class. A bigger free buffer is
+// split when a smaller class runs out, and free buffers of any class
+// are dropped to make room when we have to allocate.
 type BufferPool struct {
 	mu   sync.Mutex
 	cond *sync.Cond
 
-	numBuffers uint64
-	maxBuffers uint64
+	// handed out and not yet freed
+	usedBytes uint64
+	// sitting in the free lists
+	freeBytes uint64
 
-	totalBuffers       uint64
-	computedMaxbuffers uint64
+	// limit on usedBytes + freeBytes, 0 to compute from available
+	// memory
+	maxBytes         uint64
+	computedMaxBytes uint64
 
-	pool *sync.Pool
+	totalRequests uint64
+	// number of requests that had to wait for memory
+	stalls uint64
+
+	classes [NUM_SIZE_CLASSES]bufferClass
 }
 
+type bufferClass struct {
+	free [][]byte
+
+	inUse    uint64
+	requests uint64
+	splits   uint64
+}
+
+// BUF_SIZE is the smallest size class, requests are rounded up to it
 const BUF_SIZE = 5 * 1024 * 1024
 
-func maxMemToUse(buffersNow uint64) uint64 {
+// size classes go up to BUF_SIZE << (NUM_SIZE_CLASSES - 1), which is
+// 80MB and covers readahead chunks and the part size ladder
+const NUM_SIZE_CLASSES = 5
+
+// buffers in the largest class are allocated directly and aren't kept
+// in the free lists, they are only used by the biggest parts and
+// keeping them around would starve everything else. They go to
+// directBuffers instead, so a file that is written a part after
+// another gets the same ones back, and the garbage collector takes
+// them once nobody does
+const DIRECT_ALLOC_CLASS = NUM_SIZE_CLASSES - 1
+
+var directBuffers = sync.Pool{
+	New: func() interface{} {
+		return []byte(nil)
+	},
+}
+
+func classSize(class int) uint64 {
+	return BUF_SIZE << uint(class)
+}
+
+func sizeClass(size uint64) int {
+	for c := 0; c < NUM_SIZE_CLASSES; c++ {
+		if classSize(c) == size {
+			return c
+		}
+	}
+	panic(fmt.Sprintf("%v is not a buffer size class", size))
+}
+
+// bufferClasses carves size, rounded up to BUF_SIZE, into size
+// classes, biggest first
+func bufferClasses(size uint64) (classes []int) {
+	n := uint64(pages(size, BUF_SIZE))
+	for c := NUM_SIZE_CLASSES - 1; c >= 0; c-- {
+		for n >= 1<<uint(c) {
+			classes = append(classes, c)
+			n -= 1 << uint(c)
+		}
+	}
+	return
+}
+
+func maxMemToUse(usedNow uint64) uint64 {
 	m, err := mem.VirtualMemory()
 	if err != nil {
 		panic(err)
@@ -64,9 +134,9 @@ func maxMemToUse(buffersNow uint64) uint64 {
 	log.Debugf("amount of allocated memory: %v %v", ms.Sys/1024/1024, ms.Alloc/1024/1024)
 
 	max := uint64(availableMem+ms.Sys) / 2
-	maxbuffers := MaxUInt64(max/BUF_SIZE, 1)
-	log.Debugf("using up to %v %vMB buffers, now is %v", maxbuffers, BUF_SIZE/1024/1024, buffersNow)
-	return maxbuffers
+	maxBytes := MaxUInt64(max/BUF_SIZE, 1) * BUF_SIZE
+	log.Debugf("using up to %vMB for buffers, now is %vMB", maxBytes/1024/1024, usedNow/1024/1024)
+	return maxBytes
 }
 
 func rounduUp(size uint64, pageSize int) int {
@@ -79,18 +149,13 @@ func pages(size uint64, pageSize int) int {
 
 func (pool BufferPool) Init() *BufferPool {
 	pool.cond = sync.NewCond(&pool.mu)
-
-	pool.computedMaxbuffers = pool.maxBuffers
-	pool.pool = &sync.Pool{New: func() interface{} {
-		return make([]byte, 0, BUF_SIZE)
-	}}
-
+	pool.computedMaxBytes = pool.maxBytes
 	return &pool
 }
 
 // for testing
 func NewBufferPool(maxSizeGlobal uint64) *BufferPool {
-	pool := BufferPool{maxBuffers: maxSizeGlobal / BUF_SIZE}.Init()
+	pool := BufferPool{maxBytes: maxSizeGlobal}.Init()
 	return pool
 }
 
@@ -98,40 +163,123 @@ func (pool *BufferPool) RequestBuffer() (buf []byte) {
 	return pool.RequestMultiple(BUF_SIZE, true)[0]
 }
 
+// LOCKS_REQUIRED(pool.mu)
 func (pool *BufferPool) recomputeBufferLimit() {
-	if pool.maxBuffers == 0 {
-		pool.computedMaxbuffers = maxMemToUse(pool.numBuffers)
-		if pool.computedMaxbuffers == 0 {
+	if pool.maxBytes == 0 {
+		pool.computedMaxBytes = maxMemToUse(pool.usedBytes)
+		if pool.computedMaxBytes == 0 {
 			panic("OOM")
 		}
 	}
+
+	if pool.usedBytes+pool.freeBytes > pool.computedMaxBytes {
+		pool.dropFree(pool.usedBytes + pool.freeBytes - pool.computedMaxBytes)
+	}
+}
+
+// dropFree gives free buffers back to the garbage collector, biggest
+// first, until at least want bytes are released or there's nothing
+// left to release
+//
+// LOCKS_REQUIRED(pool.mu)
+func (pool *BufferPool) dropFree(want uint64) {
+	var dropped uint64
+	for c := NUM_SIZE_CLASSES - 1; c >= 0 && dropped < want; c-- {
+		class := &pool.classes[c]
+		for len(class.free) != 0 && dropped < want {
+			class.free[len(class.free)-1] = nil
+			class.free = class.free[:len(class.free)-1]
+			dropped += classSize(c)
+		}
+	}
+	pool.freeBytes -= dropped
+}
+
+// get returns an empty buffer with the capacity of class, the caller
+// must have made sure that it fits within the limit
+//
+// LOCKS_REQUIRED(pool.mu)
+func (pool *BufferPool) get(c int) []byte {
+	class := &pool.classes[c]
+	class.requests++
+	class.inUse++
+	size := classSize(c)
+	pool.usedBytes += size
+
+	if n := len(class.free); n != 0 {
+		buf := class.free[n-1]
+		class.free[n-1] = nil
+		class.free = class.free[:n-1]
+		pool.freeBytes -= size
+		return buf
+	}
+
+	// split the smallest bigger buffer we have, the halves we
+	// don't need go to the free lists in between
+	for bigger := c + 1; bigger < DIRECT_ALLOC_CLASS; bigger++ {
+		free := pool.classes[bigger].free
+		if n := len(free); n != 0 {
+			buf := free[n-1]
+			free[n-1] = nil
+			pool.classes[bigger].free = free[:n-1]
+			pool.classes[bigger].splits++
+
+			for s := bigger - 1; s >= c; s-- {
+				half := classSize(s)
+				pool.classes[s].free = append(pool.classes[s].free,
+					buf[half:half:2*half])
+				buf = buf[:0:half]
+			}
+			pool.freeBytes -= size
+			return buf
+		}
+	}
+
+	if pool.usedBytes+pool.freeBytes > pool.computedMaxBytes {
+		pool.dropFree(pool.usedBytes + pool.freeBytes - pool.computedMaxBytes)
+	}
+	if c == DIRECT_ALLOC_CLASS {
+		if buf := directBuffers.Get().([]byte); cap(buf) != 0 {
+			return buf
+		}
+	}
+	return make([]byte, 0, size)
 }
 
 func (pool *BufferPool) RequestMultiple(size uint64, block bool) (buffers [][]byte) {
-	nPages := pages(size, BUF_SIZE)
+	classes := bufferClasses(size)
+	total := uint64(pages(size, BUF_SIZE)) * BUF_SIZE
 
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	if pool.totalBuffers%10 == 0 {
+	if pool.totalRequests%10 == 0 {
 		pool.recomputeBufferLimit()
 	}
+	pool.totalRequests++
 
 	bufferLog.Debugf("requesting %v", size)
 
-	for pool.numBuffers+uint64(nPages) > pool.computedMaxbuffers {
+	stalled := false
+	for pool.usedBytes+total > pool.computedMaxBytes {
 		if block {
-			if pool.numBuffers == 0 {
+			if pool.usedBytes == 0 {
+				pool.dropFree(pool.freeBytes)
 				pool.MaybeGC()
 				pool.recomputeBufferLimit()
-				if pool.numBuffers+uint64(nPages) > pool.computedMaxbuffers {
+				if pool.usedBytes+total > pool.computedMaxBytes {
 					// we don't have any in use buffers, and we've made attempts to
 					// free memory AND correct our limits, yet we still can't allocate.
 					// it's likely that we are simply asking for too much
 					log.Errorf("Unable to allocate %d bytes, limit is %d bytes",
-						nPages*BUF_SIZE, pool.computedMaxbuffers*BUF_SIZE)
+						total, pool.computedMaxBytes)
 					panic("OOM")
 				}
+				continue
+			}
+			if !stalled {
+				stalled = true
+				pool.stalls++
 			}
 			pool.cond.Wait()
 		} else {
@@ -139,17 +287,24 @@ func (pool *BufferPool) RequestMultiple(size uint64, block bool) (buffers [][]by
 		}
 	}
 
-	for i := 0; i < nPages; i++ {
-		pool.numBuffers++
-		pool.totalBuffers++
-		buf := pool.pool.Get()
-		buffers = append(buffers, buf.([]byte))
+	for _, c := range classes {
+		buffers = append(buffers, pool.get(c))
 	}
 	return
 }
 
+// Exhausted is true if requesting a buffer would have to wait. Used
+// to back off from speculative work before it competes with reads
+// and writes for memory
+func (pool *BufferPool) Exhausted() bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.computedMaxBytes != 0 && pool.usedBytes+BUF_SIZE > pool.computedMaxBytes
+}
+
 func (pool *BufferPool) MaybeGC() {
-	if pool.numBuffers == 0 {
+	if pool.usedBytes == 0 {
 		debug.FreeOSMemory()
 	}
 }
@@ -159,10 +314,63 @@ func (pool *BufferPool) Free(buf []byte) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	buf = buf[:0]
-	pool.pool.Put(buf)
-	pool.numBuffers--
-	pool.cond.Signal()
+	size := uint64(cap(buf))
+	c := sizeClass(size)
+	pool.classes[c].inUse--
+	pool.usedBytes -= size
+
+	if c != DIRECT_ALLOC_CLASS {
+		pool.classes[c].free = append(pool.classes[c].free, buf[:0])
+		pool.freeBytes += size
+	} else {
+		directBuffers.Put(buf[:0])
+	}
+	// waiters may want different sizes
+	pool.cond.Broadcast()
+}
+
+type BufferClassStats struct {
+	Size     uint64 `json:"size"`
+	InUse    uint64 `json:"in_use"`
+	Free     int    `json:"free"`
+	Requests uint64 `json:"requests"`
+	Splits   uint64 `json:"splits"`
+}
+
+type BufferPoolStats struct {
+	MaxBytes  uint64             `json:"max_bytes"`
+	UsedBytes uint64             `json:"used_bytes"`
+	FreeBytes uint64             `json:"free_bytes"`
+	Stalls    uint64             `json:"stalls"`
+	Classes   []BufferClassStats `json:"classes"`
+}
+
+func (pool *BufferPool) Stats() (stats BufferPoolStats) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	stats = BufferPoolStats{
+		MaxBytes:  pool.computedMaxBytes,
+		UsedBytes: pool.usedBytes,
+		FreeBytes: pool.freeBytes,
+		Stalls:    pool.stalls,
+	}
+	for c := range pool.classes {
+		class := &pool.classes[c]
+		stats.Classes = append(stats.Classes, BufferClassStats{
+			Size:     classSize(c),
+			InUse:    class.inUse,
+			Free:     len(class.free),
+			Requests: class.requests,
+			Splits:   class.splits,
+		})
+	}
+	return
+}
+
+// controlBuffers prints the utilization of each buffer size class
+func controlBuffers(fs *Goofys, args []string, conn net.Conn) error {
+	return writeControlReply(conn, nil, fs.bufferPool.Stats())
 }
 
 var mbufLog = GetLogger("mbuf")
@@ -174,6 +382,9 @@ type MBuf struct {
 	wbuf    int
 	rp      int
 	wp      int
+	// the last buffer is rounded up to a size class, this much of
+	// it is past the size asked for and isn't written to
+	spare int
 }
 
 func (mb MBuf) Init(h *BufferPool, size uint64, block bool) *MBuf {
@@ -184,11 +395,25 @@ func (mb MBuf) Init(h *BufferPool, size uint64, block bool) *MBuf {
 		if mb.buffers == nil {
 			return nil
 		}
+		total := 0
+		for _, b := range mb.buffers {
+			total += cap(b)
+		}
+		mb.spare = total - int(size)
 	}
 
 	return &mb
 }
 
+// room is how much can be written to buffers[i]
+func (mb *MBuf) room(i int) int {
+	room := cap(mb.buffers[i])
+	if i == len(mb.buffers)-1 {
+		room -= mb.spare
+	}
+	return room
+}
+
 func (mb *MBuf) Len() (length int) {
 	for i := mb.rbuf; i < int(len(mb.buffers)); i++ {
 		var bufSize int
@@ -252,7 +477,7 @@ func (mb *MBuf) Read(p []byte) (n int, err error) {
 		return
 	}
 
-	if mb.rp == cap(mb.buffers[mb.rbuf]) {
+	if mb.rp == mb.room(mb.rbuf) {
 		mb.rbuf++
 		mb.rp = 0
 	}
@@ -271,24 +496,24 @@ func (mb *MBuf) Read(p []byte) (n int, err error) {
 }
 
 func (mb *MBuf) Full() bool {
-	return mb.buffers == nil || (mb.wp == cap(mb.buffers[mb.wbuf]) && mb.wbuf+1 == len(mb.buffers))
+	return mb.buffers == nil || (mb.wp == mb.room(mb.wbuf) && mb.wbuf+1 == len(mb.buffers))
 }
 
 func (mb *MBuf) Write(p []byte) (n int, err error) {
 	b := mb.buffers[mb.wbuf]
 
-	if mb.wp == cap(b) {
+	if mb.wp == mb.room(mb.wbuf) {
 		if mb.wbuf+1 == len(mb.buffers) {
 			return
 		}
 		mb.wbuf++
 		b = mb.buffers[mb.wbuf]
 		mb.wp = 0
-	} else if mb.wp > cap(b) {
-		panic("mb.wp > cap(b)")
+	} else if mb.wp > mb.room(mb.wbuf) {
+		panic("mb.wp > mb.room(mb.wbuf)")
 	}
 
-	n = copy(b[mb.wp:cap(b)], p)
+	n = copy(b[mb.wp:mb.room(mb.wbuf)], p)
 	mb.wp += n
 	// resize the buffer to account for what we just read
 	mb.buffers[mb.wbuf] = mb.buffers[mb.wbuf][:mb.wp]
@@ -299,18 +524,18 @@ func (mb *MBuf) Write(p []byte) (n int, err error) {
 func (mb *MBuf) WriteFrom(r io.Reader) (n int, err error) {
 	b := mb.buffers[mb.wbuf]
 
-	if mb.wp == cap(b) {
+	if mb.wp == mb.room(mb.wbuf) {
 		if mb.wbuf+1 == len(mb.buffers) {
 			return
 		}
 		mb.wbuf++
 		b = mb.buffers[mb.wbuf]
 		mb.wp = 0
-	} else if mb.wp > cap(b) {
-		panic("mb.wp > cap(b)")
+	} else if mb.wp > mb.room(mb.wbuf) {
+		panic("mb.wp > mb.room(mb.wbuf)")
 	}
 
-	n, err = r.Read(b[mb.wp:cap(b)])
+	n, err = r.Read(b[mb.wp:mb.room(mb.wbuf)])
 	mb.wp += n
 	// resize the buffer to account for what we just read
 	mb.buffers[mb.wbuf] = mb.buffers[mb.wbuf][:mb.wp]
@@ -340,6 +565,9 @@ type Buffer struct {
 	buf    *MBuf
 	reader io.ReadCloser
 	err    error
+	// someone is reading from us, stop copying the stream into
+	// buf and let them read it directly once buf is drained
+	direct bool
 }
 
 type ReaderProvider func() (io.ReadCloser, error)
@@ -367,8 +595,9 @@ func (b *Buffer) readLoop(r ReaderProvider) {
 			}
 		}
 
-		if b.buf == nil {
-			// buffer was drained
+		if b.buf == nil || b.direct {
+			// buffer was drained, or the reader caught up
+			// with us and will read from the stream itself
 			b.mu.Unlock()
 			break
 		}
@@ -395,6 +624,16 @@ func (b *Buffer) readLoop(r ReaderProvider) {
 	bufferLog.Debugf("<-- readLoop()")
 }
 
+// Stream lets the reader read the rest of the stream directly into
+// its own buffer, saving a copy, once what we have buffered so far is
+// drained
+func (b *Buffer) Stream() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.direct = true
+}
+
 func (b *Buffer) readFromStream(p []byte) (n int, err error) {
 	bufferLog.Debugf("reading %v from stream", len(p))
 
@@ -120,7 +120,7 @@ func CompareReader(r1, r2 io.Reader) (int, error) {
 func (s *BufferTest) TestMBuf(t *C) {
 	h := NewBufferPool(1000 * 1024 * 1024)
 
-	n := uint64(2 * BUF_SIZE)
+	n := uint64(3 * BUF_SIZE)
 	mb := MBuf{}.Init(h, n, false)
 	t.Assert(len(mb.buffers), Equals, 2)
 
@@ -143,15 +143,15 @@ func (s *BufferTest) TestMBuf(t *C) {
 	t.Assert(mb.rbuf, Equals, 1)
 	t.Assert(mb.rp, Equals, BUF_SIZE)
 
-	t.Assert(h.numBuffers, Equals, uint64(2))
+	t.Assert(h.usedBytes, Equals, n)
 	mb.Free()
-	t.Assert(h.numBuffers, Equals, uint64(0))
+	t.Assert(h.usedBytes, Equals, uint64(0))
 }
 
 func (s *BufferTest) TestBufferWrite(t *C) {
 	h := NewBufferPool(1000 * 1024 * 1024)
 
-	n := uint64(2 * BUF_SIZE)
+	n := uint64(3 * BUF_SIZE)
 	mb := MBuf{}.Init(h, n, true)
 	t.Assert(len(mb.buffers), Equals, 2)
 
@@ -185,7 +185,7 @@ func (s *BufferTest) TestBufferWrite(t *C) {
 func (s *BufferTest) TestBufferLen(t *C) {
 	h := NewBufferPool(1000 * 1024 * 1024)
 
-	n := uint64(2*BUF_SIZE - 1)
+	n := uint64(3*BUF_SIZE - 1)
 	mb := MBuf{}.Init(h, n, true)
 	t.Assert(len(mb.buffers), Equals, 2)
 
@@ -198,7 +198,7 @@ func (s *BufferTest) TestBufferLen(t *C) {
 func (s *BufferTest) TestBuffer(t *C) {
 	h := NewBufferPool(1000 * 1024 * 1024)
 
-	n := uint64(2 * BUF_SIZE)
+	n := uint64(3 * BUF_SIZE)
 	mb := MBuf{}.Init(h, n, false)
 	t.Assert(len(mb.buffers), Equals, 2)
 
@@ -213,12 +213,34 @@ func (s *BufferTest) TestBuffer(t *C) {
 	t.Assert(diff, Equals, -1)
 	t.Assert(b.buf, IsNil)
 	t.Assert(b.reader, NotNil)
-	t.Assert(h.numBuffers, Equals, uint64(0))
+	t.Assert(h.usedBytes, Equals, uint64(0))
+}
+
+func (s *BufferTest) TestBufferStream(t *C) {
+	h := NewBufferPool(1000 * 1024 * 1024)
+
+	n := uint64(2 * BUF_SIZE)
+	mb := MBuf{}.Init(h, n, false)
+
+	r := func() (io.ReadCloser, error) {
+		return &SlowReader{io.LimitReader(&SeqReader{}, int64(n)), 1 * time.Millisecond}, nil
+	}
+
+	b := Buffer{}.Init(mb, r)
+	time.Sleep(10 * time.Millisecond)
+	b.Stream()
+
+	// what was buffered so far, followed by the rest of the stream
+	diff, err := CompareReader(b, io.LimitReader(&SeqReader{}, int64(n)))
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+	t.Assert(b.buf, IsNil)
+	t.Assert(h.usedBytes, Equals, uint64(0))
 }
 
 func (s *BufferTest) TestPool(t *C) {
 	const MAX = 8
-	pool := BufferPool{maxBuffers: MAX}.Init()
+	pool := NewBufferPool(MAX * BUF_SIZE)
 	var wg sync.WaitGroup
 
 	for i := 0; i < 10; i++ {
@@ -242,6 +264,138 @@ func (s *BufferTest) TestPool(t *C) {
 	wg.Wait()
 }
 
+func (s *BufferTest) TestPoolClasses(t *C) {
+	t.Assert(bufferClasses(1), DeepEquals, []int{0})
+	t.Assert(bufferClasses(BUF_SIZE), DeepEquals, []int{0})
+	t.Assert(bufferClasses(20*1024*1024), DeepEquals, []int{2})
+	t.Assert(bufferClasses(25*1024*1024), DeepEquals, []int{2, 0})
+	t.Assert(bufferClasses(125*1024*1024), DeepEquals, []int{4, 3, 0})
+	t.Assert(bufferClasses(200*1024*1024), DeepEquals, []int{4, 4, 3})
+}
+
+func (s *BufferTest) TestPoolSplit(t *C) {
+	pool := NewBufferPool(100 * BUF_SIZE)
+
+	bufs := pool.RequestMultiple(40*1024*1024, true)
+	t.Assert(bufs, HasLen, 1)
+	pool.Free(bufs[0])
+	t.Assert(pool.freeBytes, Equals, uint64(8*BUF_SIZE))
+
+	// 40MB -> 20MB + 10MB + 5MB free + 5MB handed out
+	buf := pool.RequestBuffer()
+	t.Assert(cap(buf), Equals, BUF_SIZE)
+	stats := pool.Stats()
+	t.Assert(stats.UsedBytes, Equals, uint64(BUF_SIZE))
+	t.Assert(stats.FreeBytes, Equals, uint64(7*BUF_SIZE))
+	t.Assert(stats.Classes[3].Splits, Equals, uint64(1))
+	for c := 0; c < 3; c++ {
+		t.Assert(stats.Classes[c].Free, Equals, 1)
+	}
+
+	// the halves don't overlap
+	buf2 := pool.RequestBuffer()
+	buf = append(buf, make([]byte, BUF_SIZE)...)
+	buf2 = append(buf2, bytes.Repeat([]byte{1}, BUF_SIZE)...)
+	t.Assert(buf[BUF_SIZE-1], Equals, byte(0))
+
+	pool.Free(buf)
+	pool.Free(buf2)
+	t.Assert(pool.usedBytes, Equals, uint64(0))
+	t.Assert(pool.freeBytes, Equals, uint64(8*BUF_SIZE))
+}
+
+func (s *BufferTest) TestPoolDropFree(t *C) {
+	pool := NewBufferPool(4 * BUF_SIZE)
+
+	var bufs [][]byte
+	for i := 0; i < 4; i++ {
+		bufs = append(bufs, pool.RequestBuffer())
+	}
+	for _, b := range bufs {
+		pool.Free(b)
+	}
+	t.Assert(pool.freeBytes, Equals, uint64(4*BUF_SIZE))
+
+	// memory is all in the free lists but in the wrong class, we
+	// shouldn't have to wait for it
+	bufs = pool.RequestMultiple(4*BUF_SIZE, false)
+	t.Assert(bufs, HasLen, 1)
+	t.Assert(pool.usedBytes, Equals, uint64(4*BUF_SIZE))
+	t.Assert(pool.freeBytes, Equals, uint64(0))
+	pool.Free(bufs[0])
+
+	// the largest class is never kept
+	pool = NewBufferPool(100 * BUF_SIZE)
+	bufs = pool.RequestMultiple(80*1024*1024, false)
+	t.Assert(bufs, HasLen, 1)
+	pool.Free(bufs[0])
+	t.Assert(pool.freeBytes, Equals, uint64(0))
+}
+
+func (s *BufferTest) TestPoolDirectReuse(t *C) {
+	pool := NewBufferPool(100 * BUF_SIZE)
+
+	// a part after another, like a big file being written. The
+	// sync.Pool may drop one now and then, but not all of them
+	reused := 0
+	var last *byte
+	for i := 0; i < 10; i++ {
+		buf := pool.RequestMultiple(80*1024*1024, true)[0]
+		t.Assert(cap(buf), Equals, 80*1024*1024)
+		if &buf[:1][0] == last {
+			reused++
+		}
+		last = &buf[:1][0]
+		pool.Free(buf)
+		t.Assert(pool.usedBytes, Equals, uint64(0))
+		t.Assert(pool.freeBytes, Equals, uint64(0))
+	}
+	t.Assert(reused > 0, Equals, true)
+}
+
+// readahead sized buffers and big upload parts shouldn't stall each
+// other as long as there's enough memory in total
+func (s *BufferTest) TestPoolSoak(t *C) {
+	const PART = 100 * 1024 * 1024
+	const READERS = 8
+	const WRITERS = 3
+
+	pool := NewBufferPool(READERS*BUF_SIZE + WRITERS*PART)
+	var wg sync.WaitGroup
+
+	for i := 0; i < READERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				mb := MBuf{}.Init(pool, BUF_SIZE, true)
+				mb.Write([]byte{1})
+				mb.Free()
+			}
+		}()
+	}
+
+	for i := 0; i < WRITERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				mb := MBuf{}.Init(pool, PART, true)
+				mb.Write([]byte{1})
+				time.Sleep(time.Millisecond)
+				mb.Free()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	stats := pool.Stats()
+	t.Assert(stats.Stalls, Equals, uint64(0))
+	t.Assert(stats.UsedBytes, Equals, uint64(0))
+	t.Assert(stats.FreeBytes <= stats.MaxBytes, Equals, true)
+}
+
 func (s *BufferTest) TestIssue193(t *C) {
 	h := NewBufferPool(1000 * 1024 * 1024)
 
@@ -0,0 +1,85 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type CacheTTLTest struct {
+}
+
+var _ = Suite(&CacheTTLTest{})
+
+func (s *CacheTTLTest) TestLookup(t *C) {
+	overrides := &CacheTTLOverrides{}
+	overrides.Set("incoming", 0)
+	overrides.Set("archive/", 12*time.Hour)
+	overrides.Set("archive/tmp", time.Second)
+
+	expected := map[string]time.Duration{
+		"incoming":           0,
+		"incoming/file":      0,
+		"incoming/dir/file":  0,
+		"archive":            12 * time.Hour,
+		"archive/2019/file":  12 * time.Hour,
+		"archive/tmp":        time.Second,
+		"archive/tmp/file":   time.Second,
+		"/archive//tmp/file": time.Second,
+		"archive/tmpfile":    12 * time.Hour,
+		"archive/tmp2/file":  12 * time.Hour,
+	}
+	for name, ttl := range expected {
+		got, ok := overrides.Lookup(name)
+		t.Assert(ok, Equals, true, Commentf("%v", name))
+		t.Assert(got, Equals, ttl, Commentf("%v", name))
+	}
+
+	// only whole components match
+	for _, name := range []string{"", "incomingfile", "arch", "other/incoming"} {
+		_, ok := overrides.Lookup(name)
+		t.Assert(ok, Equals, false, Commentf("%v", name))
+	}
+
+	// the whole bucket
+	overrides.Set("", time.Hour)
+	ttl, ok := overrides.Lookup("other/incoming")
+	t.Assert(ok, Equals, true)
+	t.Assert(ttl, Equals, time.Hour)
+}
+
+func (s *CacheTTLTest) TestInode(t *C) {
+	inode := newTestInode(&slowBackend{})
+	inode.Parent.Id = fuseops.RootInodeID
+	flags := inode.fs.flags
+	flags.StatCacheTTL = time.Minute
+	flags.TypeCacheTTL = 2 * time.Minute
+
+	t.Assert(inode.statCacheTTL(), Equals, time.Minute)
+	t.Assert(inode.typeCacheTTL(), Equals, 2*time.Minute)
+
+	flags.CacheTTLOverrides = &CacheTTLOverrides{}
+	flags.CacheTTLOverrides.Set("dir", time.Hour)
+	t.Assert(inode.statCacheTTL(), Equals, time.Minute)
+
+	flags.CacheTTLOverrides.Set("file", 0)
+	t.Assert(inode.statCacheTTL(), Equals, time.Duration(0))
+	t.Assert(inode.typeCacheTTL(), Equals, time.Duration(0))
+}
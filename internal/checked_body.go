@@ -0,0 +1,150 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"syscall"
+)
+
+// how many times we ask for the rest of a response that was cut short
+// before giving up with EIO
+const SHORT_READ_RETRIES = 3
+
+// getBlobChecked is GetBlob for reading file data. Some proxies end a
+// response early without an error, which would look like the file is
+// shorter than it is. The body we return counts what we read against
+// the length the server said it would send, and asks for whatever is
+// missing. If the backend gave us a checksum it also has to match
+func getBlobChecked(cloud StorageBackend, param *GetBlobInput) (*GetBlobOutput, error) {
+	resp, err := cloud.GetBlob(param)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := resp.Size
+	if expected == 0 {
+		// ADLv1 doesn't send a Content-Length
+		expected = param.Count
+	}
+	if expected == 0 {
+		// nothing to check against
+		return resp, nil
+	}
+
+	body := &checkedBody{
+		cloud:    cloud,
+		param:    *param,
+		body:     resp.Body,
+		expected: expected,
+	}
+	if body.param.IfMatch == nil {
+		// the rest has to come from the same object
+		body.param.IfMatch = resp.ETag
+	}
+	resp.Body = body
+	if resp.Checksum != nil {
+		// on top, so it sees what came from resuming too
+		resp.Body = newVerifiedBody(param.Key, body, resp.Checksum, expected)
+	}
+	return resp, nil
+}
+
+type checkedBody struct {
+	cloud StorageBackend
+	param GetBlobInput
+	// nil when the last response was cut short, the next Read asks
+	// for the rest
+	body     io.ReadCloser
+	expected uint64
+	read     uint64
+	retries  int
+}
+
+func (b *checkedBody) Read(p []byte) (n int, err error) {
+	if b.body == nil {
+		err = b.resume()
+		if err != nil {
+			return
+		}
+	}
+
+	n, err = b.body.Read(p)
+	b.read += uint64(n)
+
+	if b.read > b.expected {
+		s3Log.Errorf("%v: got more than the %v bytes we asked for",
+			b.param.Key, b.expected)
+		return n, syscall.EIO
+	}
+	if err == nil {
+		return
+	}
+	if b.read == b.expected {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return
+	}
+
+	if b.param.Context != nil && b.param.Context.Err() != nil {
+		// interrupted, don't ask for the rest
+		return n, err
+	}
+
+	s3Log.Warnf("%v: response ended after %v of %v bytes: %v",
+		b.param.Key, b.read, b.expected, err)
+	b.body.Close()
+	b.body = nil
+
+	if n != 0 {
+		// hand out what we have, the next Read picks up the rest
+		return n, nil
+	}
+
+	err = b.resume()
+	if err != nil {
+		return
+	}
+	return b.Read(p)
+}
+
+func (b *checkedBody) resume() error {
+	if b.retries == SHORT_READ_RETRIES {
+		s3Log.Errorf("%v: giving up after %v short responses",
+			b.param.Key, b.retries)
+		return syscall.EIO
+	}
+	b.retries++
+
+	param := b.param
+	param.Start += b.read
+	param.Count = b.expected - b.read
+	param.Checksum = false
+
+	resp, err := b.cloud.GetBlob(&param)
+	if err != nil {
+		return err
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *checkedBody) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// how long we sign with a measured offset before forgetting it. If
+// the host clock is still off, the next request that's refused
+// measures it again
+const CLOCK_SKEW_TTL = 15 * time.Minute
+
+// azure says AuthenticationFailed for a bad key too, so only believe
+// it's the clock if it's off by more than this
+const CLOCK_SKEW_MIN = 5 * time.Minute
+
+// ClockSkew is how far the host clock is behind the server's, as
+// measured from the Date of a response that was refused because of it
+type ClockSkew struct {
+	mu       sync.Mutex
+	offset   time.Duration
+	measured time.Time
+	// for tests
+	now func() time.Time
+}
+
+// the host clock is the same for every backend
+var clockSkew = &ClockSkew{}
+
+func (c *ClockSkew) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *ClockSkew) Offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.offset != 0 && c.clock().Sub(c.measured) > CLOCK_SKEW_TTL {
+		log.Infof("dropping clock skew correction of %v, will measure again if needed",
+			c.offset)
+		c.offset = 0
+	}
+	return c.offset
+}
+
+// Now is what the server thinks the time is
+func (c *ClockSkew) Now() time.Time {
+	return c.clock().Add(c.Offset())
+}
+
+// measure takes the Date header of a refused response, returns false
+// if there isn't one or it's within min of our clock
+func (c *ClockSkew) measure(date string, min time.Duration) bool {
+	if date == "" {
+		return false
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return false
+	}
+
+	now := c.clock()
+	offset := serverTime.Sub(now)
+	if offset < min && offset > -min {
+		return false
+	}
+
+	c.mu.Lock()
+	c.offset = offset
+	c.measured = now
+	c.mu.Unlock()
+
+	log.Warnf("!!! the clock on this host is off by %v from the server (%v), "+
+		"requests are signed with a corrected time but you should fix "+
+		"the clock (is NTP running?)", -offset, date)
+	return true
+}
+
+// signWithSkew is the first Sign handler, so both signers sign with
+// the corrected time
+func signWithSkew(req *request.Request) {
+	if clockSkew.Offset() == 0 {
+		return
+	}
+	req.Time = clockSkew.Now()
+	// otherwise the v4 signer re-signs a retry with time.Now()
+	req.LastSignedAt = time.Time{}
+	req.HTTPRequest.Header.Del("Authorization")
+}
+
+// retryOnSkew is a Retry handler that measures the skew from a
+// RequestTimeTooSkewed and gets the request re-signed
+func retryOnSkew(req *request.Request) {
+	err, ok := req.Error.(awserr.Error)
+	if !ok || err.Code() != "RequestTimeTooSkewed" || req.HTTPResponse == nil {
+		return
+	}
+	if clockSkew.measure(req.HTTPResponse.Header.Get("Date"), 0) {
+		req.Retryable = aws.Bool(true)
+	}
+}
+
+// skewSharedKeyCredential signs with the corrected time, and if azure
+// refuses a request because of the clock, measures and tries again.
+// Embedding the real credential keeps this an azblob.Credential
+type skewSharedKeyCredential struct {
+	*azblob.SharedKeyCredential
+}
+
+func (c skewSharedKeyCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	sign := c.SharedKeyCredential.New(next, po)
+
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		// the shared key policy only sets x-ms-date if we haven't
+		request.Header.Set("x-ms-date", clockSkew.Now().UTC().Format(http.TimeFormat))
+		resp, err := sign.Do(ctx, request)
+		if err == nil || resp == nil || resp.Response() == nil {
+			return resp, err
+		}
+
+		r := resp.Response()
+		if r.StatusCode != http.StatusForbidden ||
+			r.Header.Get("x-ms-error-code") != "AuthenticationFailed" ||
+			!clockSkew.measure(r.Header.Get("Date"), CLOCK_SKEW_MIN) {
+			return resp, err
+		}
+
+		if request.RewindBody() != nil {
+			return resp, err
+		}
+		r.Body.Close()
+		request.Header.Set("x-ms-date", clockSkew.Now().UTC().Format(http.TimeFormat))
+		return sign.Do(ctx, request)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ClockSkewTest struct {
+	now  time.Time
+	skew *ClockSkew
+}
+
+var _ = Suite(&ClockSkewTest{})
+
+func (s *ClockSkewTest) SetUpTest(t *C) {
+	s.now = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.skew = &ClockSkew{now: func() time.Time { return s.now }}
+}
+
+func (s *ClockSkewTest) TestMeasure(t *C) {
+	t.Assert(s.skew.Offset(), Equals, time.Duration(0))
+	t.Assert(s.skew.Now(), Equals, s.now)
+
+	t.Assert(s.skew.measure("", 0), Equals, false)
+	t.Assert(s.skew.measure("yesterday", 0), Equals, false)
+	t.Assert(s.skew.Offset(), Equals, time.Duration(0))
+
+	// the server is 20 minutes ahead of us
+	server := s.now.Add(20 * time.Minute)
+	t.Assert(s.skew.measure(server.Format(http.TimeFormat), 0), Equals, true)
+	t.Assert(s.skew.Offset(), Equals, 20*time.Minute)
+	t.Assert(s.skew.Now().Equal(server), Equals, true)
+
+	// and behind
+	server = s.now.Add(-30 * time.Minute)
+	t.Assert(s.skew.measure(server.Format(http.TimeFormat), 0), Equals, true)
+	t.Assert(s.skew.Offset(), Equals, -30*time.Minute)
+}
+
+func (s *ClockSkewTest) TestMeasureMin(t *C) {
+	// a bad azure key looks the same as a bad clock
+	server := s.now.Add(2 * time.Second)
+	t.Assert(s.skew.measure(server.Format(http.TimeFormat), CLOCK_SKEW_MIN), Equals, false)
+	t.Assert(s.skew.Offset(), Equals, time.Duration(0))
+
+	server = s.now.Add(-time.Hour)
+	t.Assert(s.skew.measure(server.Format(http.TimeFormat), CLOCK_SKEW_MIN), Equals, true)
+	t.Assert(s.skew.Offset(), Equals, -time.Hour)
+}
+
+func (s *ClockSkewTest) TestExpire(t *C) {
+	server := s.now.Add(time.Hour)
+	t.Assert(s.skew.measure(server.Format(http.TimeFormat), 0), Equals, true)
+
+	s.now = s.now.Add(CLOCK_SKEW_TTL)
+	t.Assert(s.skew.Offset(), Equals, time.Hour)
+
+	// someone fixed the clock, or we find out on the next refusal
+	s.now = s.now.Add(time.Second)
+	t.Assert(s.skew.Offset(), Equals, time.Duration(0))
+	t.Assert(s.skew.Now(), Equals, s.now)
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"syscall"
+)
+
+// Small reads that don't continue where the handle is streaming from
+// (O_DIRECT readers, threads of a process reading a file in
+// parallel, strided access) would each cost a request. Instead we
+// fetch the aligned block of ReadCoalesceWindow bytes around them,
+// and serve the reads that follow from it.
+
+const DEFAULT_READ_COALESCE_WINDOW = 1024 * 1024
+
+// how many blocks we keep for an inode, for all the processes reading
+// it
+const READ_COALESCE_BLOCKS = 8
+
+type readBlockKey struct {
+	// the process, or the file handle if we don't know its
+	// process. Blocks are not shared across processes, so that
+	// one doesn't see another's stale data after reopening the
+	// file
+	owner  interface{}
+	offset uint64
+}
+
+type readBlock struct {
+	key readBlockKey
+	// closed once the fetch is done. If both data and err are
+	// nil the body failed half way and the read should be retried
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (fh *FileHandle) readBlockOwner() interface{} {
+	if fh.Tgid != nil {
+		return *fh.Tgid
+	}
+	return fh
+}
+
+// getReadBlock returns the block for key, and whether the caller
+// should fetch it. Concurrent readers of a block that's being
+// fetched wait for the same request
+func (inode *Inode) getReadBlock(key readBlockKey) (block *readBlock, fetch bool) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	file := inode.fileData()
+	for i, b := range file.readBlocks {
+		if b.key == key {
+			// keep the most recently used at the end
+			copy(file.readBlocks[i:], file.readBlocks[i+1:])
+			file.readBlocks[len(file.readBlocks)-1] = b
+			return b, false
+		}
+	}
+
+	if len(file.readBlocks) == READ_COALESCE_BLOCKS {
+		copy(file.readBlocks, file.readBlocks[1:])
+		file.readBlocks = file.readBlocks[:len(file.readBlocks)-1]
+	}
+
+	block = &readBlock{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	file.readBlocks = append(file.readBlocks, block)
+	return block, true
+}
+
+// hasReadBlock is if the block around offset was already fetched, or
+// is being fetched, for fh's process
+func (fh *FileHandle) hasReadBlock(offset uint64) bool {
+	window := fh.inode.fs.flags.ReadCoalesceWindow
+	key := readBlockKey{
+		owner:  fh.readBlockOwner(),
+		offset: offset - offset%window,
+	}
+
+	fh.inode.mu.Lock()
+	defer fh.inode.mu.Unlock()
+
+	if fh.inode.file == nil {
+		return false
+	}
+	for _, b := range fh.inode.file.readBlocks {
+		if b.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (inode *Inode) dropReadBlock(block *readBlock) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file == nil {
+		return
+	}
+	for i, b := range inode.file.readBlocks {
+		if b == block {
+			inode.file.readBlocks = append(inode.file.readBlocks[:i],
+				inode.file.readBlocks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fh *FileHandle) fetchReadBlock(block *readBlock, window uint64) {
+	defer close(block.done)
+
+	start := block.key.offset
+	size := MinUInt64(window, fh.inode.Attributes.Size-start)
+
+	resp, err := getBlobChecked(fh.cloud, &GetBlobInput{
+		Key:      fh.key,
+		Start:    start,
+		Count:    size,
+		IfMatch:  fh.readETag,
+		Checksum: fh.inode.fs.flags.CheckReadIntegrity,
+	})
+	if err != nil {
+		block.err = err
+		fh.inode.dropReadBlock(block)
+		return
+	}
+	defer resp.Body.Close()
+
+	data := make([]byte, size)
+	n, err := io.ReadFull(resp.Body, data)
+	if err == nil || err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the object may have gotten shorter, what we
+		// have is all there is
+		block.data = data[:n]
+	} else {
+		fh.inode.logFuse("< coalesced read error", start, err)
+		if err == syscall.EIO {
+			// we already asked for the rest a few times
+			block.err = err
+		}
+		// otherwise always retry error on read
+		fh.inode.dropReadBlock(block)
+	}
+}
+
+func (fh *FileHandle) readFromBlock(offset uint64, buf []byte) (bytesRead int, err error) {
+	window := fh.inode.fs.flags.ReadCoalesceWindow
+	key := readBlockKey{
+		owner:  fh.readBlockOwner(),
+		offset: offset - offset%window,
+	}
+
+	block, fetch := fh.inode.getReadBlock(key)
+	if fetch {
+		fh.inode.logFuse("coalesced read", key.offset, window)
+		fh.fetchReadBlock(block, window)
+	} else {
+		<-block.done
+	}
+
+	if block.err != nil || block.data == nil {
+		return 0, block.err
+	}
+
+	start := offset - key.offset
+	if start >= uint64(len(block.data)) {
+		return 0, io.EOF
+	}
+
+	bytesRead = copy(buf, block.data[start:])
+	return
+}
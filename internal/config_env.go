@@ -0,0 +1,216 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// CONFIG_ENV holds the whole configuration as a json object, for
+// wrappers like the kubernetes csi drivers that would otherwise have
+// to build a command line. Keys are the long option names, ex:
+//
+//	{"stat-cache-ttl": "1m", "cheap": true, "o": ["allow_other"],
+//	 "credentials": {"aws_access_key_id": "...", "aws_secret_access_key": "..."}}
+const CONFIG_ENV = "GOOFYS_CONFIG_JSON"
+
+type EnvCredentials struct {
+	AWSAccessKeyId     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey Secret `json:"aws_secret_access_key"`
+	AWSSessionToken    Secret `json:"aws_session_token"`
+
+	AzureStorageAccount string `json:"azure_storage_account"`
+	AzureStorageKey     Secret `json:"azure_storage_key"`
+}
+
+type EnvConfig struct {
+	Options     map[string]interface{}
+	Credentials EnvCredentials
+
+	raw string
+}
+
+// LoadEnvConfig parses and then removes CONFIG_ENV from our
+// environment, so that it's not passed on to anything we run. Returns
+// nil if it's not set. Errors never include the values.
+func LoadEnvConfig() (config *EnvConfig, err error) {
+	raw, ok := os.LookupEnv(CONFIG_ENV)
+	if !ok {
+		return
+	}
+	os.Unsetenv(CONFIG_ENV)
+
+	config, err = parseEnvConfig(raw)
+	if err != nil {
+		err = fmt.Errorf("invalid %v: %v", CONFIG_ENV, err)
+	}
+	return
+}
+
+func parseEnvConfig(raw string) (config *EnvConfig, err error) {
+	var fields map[string]json.RawMessage
+
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&fields)
+	if err != nil {
+		// json errors may quote part of the input
+		return nil, fmt.Errorf("not a json object")
+	}
+
+	config = &EnvConfig{
+		Options: make(map[string]interface{}),
+		raw:     raw,
+	}
+
+	for k, v := range fields {
+		if k == "credentials" {
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.DisallowUnknownFields()
+			if dec.Decode(&config.Credentials) != nil {
+				return nil, fmt.Errorf("invalid credentials")
+			}
+			continue
+		}
+
+		var value interface{}
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.UseNumber()
+		if dec.Decode(&value) != nil {
+			return nil, fmt.Errorf("invalid value for %v", k)
+		}
+		config.Options[k] = value
+	}
+
+	return
+}
+
+func optionValues(name string, value interface{}) (values []string, err error) {
+	switch v := value.(type) {
+	case string:
+		values = []string{v}
+	case bool:
+		values = []string{fmt.Sprint(v)}
+	case json.Number:
+		values = []string{v.String()}
+	case []interface{}:
+		for _, e := range v {
+			var ev []string
+			ev, err = optionValues(name, e)
+			if err != nil {
+				return
+			}
+			values = append(values, ev...)
+		}
+	default:
+		err = fmt.Errorf("invalid value for %v", name)
+	}
+	return
+}
+
+// Args inserts the options right after the program name, flag parsing
+// will let anything that's explicitly on the command line override
+// them
+func (config *EnvConfig) Args(app *cli.App, args []string) ([]string, error) {
+	if config == nil || len(config.Options) == 0 {
+		return args, nil
+	}
+
+	known := make(map[string]bool)
+	for _, f := range app.Flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			known[strings.TrimSpace(name)] = true
+		}
+	}
+
+	// stable order so that repeated options come out the same
+	var names []string
+	for name, _ := range config.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var opts []string
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown option in %v: %v", CONFIG_ENV, name)
+		}
+
+		values, err := optionValues(name, config.Options[name])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", CONFIG_ENV, err)
+		}
+		for _, v := range values {
+			opts = append(opts, "--"+name+"="+v)
+		}
+	}
+
+	ret := []string{args[0]}
+	ret = append(ret, opts...)
+	ret = append(ret, args[1:]...)
+	return ret, nil
+}
+
+// ApplyCredentials should be called after PopulateFlags
+func (config *EnvConfig) ApplyCredentials(flags *FlagStorage) {
+	if config == nil {
+		return
+	}
+	creds := &config.Credentials
+
+	if creds.AWSAccessKeyId != "" {
+		if flags.Backend == nil {
+			flags.Backend = (&S3Config{}).Init()
+		}
+		if s3, ok := flags.Backend.(*S3Config); ok {
+			s3.AccessKey = creds.AWSAccessKeyId
+			s3.SecretKey = creds.AWSSecretAccessKey
+			s3.SessionToken = creds.AWSSessionToken
+		}
+	}
+
+	flags.AzureAccount = creds.AzureStorageAccount
+	flags.AzureKey = creds.AzureStorageKey
+}
+
+// String only shows the option names, values could be secrets like
+// --sse-c
+func (config *EnvConfig) String() string {
+	var names []string
+	for name, _ := range config.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%v options: %v", CONFIG_ENV, strings.Join(names, ", "))
+}
+
+// Environ is our environment for the daemonized child, which needs
+// to parse the config again
+func (config *EnvConfig) Environ() []string {
+	env := os.Environ()
+	if config != nil {
+		env = append(env, CONFIG_ENV+"="+config.raw)
+	}
+	return env
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+type EnvConfigTest struct {
+}
+
+var _ = Suite(&EnvConfigTest{})
+
+func (s *EnvConfigTest) TestArgs(t *C) {
+	config, err := parseEnvConfig(`{
+		"stat-cache-ttl": "5m",
+		"cheap": true,
+		"dir-mode": 493,
+		"o": ["allow_other", "ro"]
+	}`)
+	t.Assert(err, IsNil)
+
+	args, err := config.Args(NewApp(), []string{"goofys", "--stat-cache-ttl", "1s", "bucket", "/mnt"})
+	t.Assert(err, IsNil)
+	t.Assert(args, DeepEquals, []string{"goofys",
+		"--cheap=true", "--dir-mode=493", "--o=allow_other", "--o=ro", "--stat-cache-ttl=5m",
+		"--stat-cache-ttl", "1s", "bucket", "/mnt"})
+
+	// explicit flags win
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	t.Assert(app.Run(args), IsNil)
+	t.Assert(flags, NotNil)
+	t.Assert(flags.StatCacheTTL, Equals, time.Second)
+	t.Assert(flags.Cheap, Equals, true)
+	t.Assert(flags.DirMode, Equals, os.FileMode(0755))
+	t.Assert(flags.MountOptions["ro"], Equals, "")
+	_, ok := flags.MountOptions["allow_other"]
+	t.Assert(ok, Equals, true)
+
+	var nilConfig *EnvConfig
+	args, err = nilConfig.Args(NewApp(), []string{"goofys", "bucket", "/mnt"})
+	t.Assert(err, IsNil)
+	t.Assert(args, HasLen, 3)
+}
+
+func (s *EnvConfigTest) TestInvalid(t *C) {
+	_, err := parseEnvConfig(`{"sse-c": "hunter2`)
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "hunter2"), Equals, false)
+
+	_, err = parseEnvConfig(`{"credentials": {"password": "hunter2"}}`)
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "hunter2"), Equals, false)
+
+	config, err := parseEnvConfig(`{"no-such-flag": 1}`)
+	t.Assert(err, IsNil)
+	_, err = config.Args(NewApp(), []string{"goofys", "bucket", "/mnt"})
+	t.Assert(err, NotNil)
+
+	config, err = parseEnvConfig(`{"region": {"name": "us-west-2"}}`)
+	t.Assert(err, IsNil)
+	_, err = config.Args(NewApp(), []string{"goofys", "bucket", "/mnt"})
+	t.Assert(err, NotNil)
+}
+
+func (s *EnvConfigTest) TestCredentials(t *C) {
+	os.Setenv(CONFIG_ENV, `{"credentials": {
+		"aws_access_key_id": "AKID",
+		"aws_secret_access_key": "hunter2",
+		"azure_storage_key": "hunter3"
+	}}`)
+	config, err := LoadEnvConfig()
+	t.Assert(err, IsNil)
+
+	// scrubbed from our environment but passed on to the daemon
+	_, ok := os.LookupEnv(CONFIG_ENV)
+	t.Assert(ok, Equals, false)
+	env := config.Environ()
+	t.Assert(strings.HasPrefix(env[len(env)-1], CONFIG_ENV+"="), Equals, true)
+
+	flags := &FlagStorage{}
+	config.ApplyCredentials(flags)
+	s3, ok := flags.Backend.(*S3Config)
+	t.Assert(ok, Equals, true)
+	t.Assert(s3.AccessKey, Equals, "AKID")
+	t.Assert(string(s3.SecretKey), Equals, "hunter2")
+	t.Assert(string(flags.AzureKey), Equals, "hunter3")
+
+	for _, dump := range []string{
+		fmt.Sprintf("%v", *s3), fmt.Sprintf("%+v", *s3), fmt.Sprintf("%#v", *s3),
+		fmt.Sprintf("%+v", *flags), fmt.Sprintf("%+v", config.Credentials),
+		fmt.Sprintf("%v", config),
+	} {
+		t.Assert(strings.Contains(dump, "hunter"), Equals, false)
+	}
+}
+
+func (s *EnvConfigTest) TestClone(t *C) {
+	flags := &FlagStorage{
+		Uid:          1000,
+		FileMode:     0644,
+		MountOptions: map[string]string{"allow_other": ""},
+		Backend:      (&S3Config{}).Init(),
+	}
+
+	other := flags.Clone()
+	other.Uid = 2000
+	other.FileMode = 0600
+	other.MountOptions["ro"] = ""
+	other.Backend.(*S3Config).Region = "eu-west-1"
+
+	t.Assert(flags.Uid, Equals, uint32(1000))
+	t.Assert(flags.FileMode, Equals, os.FileMode(0644))
+	t.Assert(flags.MountOptions, DeepEquals, map[string]string{"allow_other": ""})
+	t.Assert(flags.Backend.(*S3Config).Region, Equals, "us-east-1")
+}
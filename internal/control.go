@@ -0,0 +1,176 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The control socket is a unix socket that accepts one command per
+// connection, as a single line of space separated words. Replies are
+// newline delimited json.
+
+type ControlCommand func(fs *Goofys, args []string, conn net.Conn) error
+
+var controlCommands = map[string]ControlCommand{
+	"buffers":   controlBuffers,
+	"events":    controlEvents,
+	"hedge":     controlHedge,
+	"mpu":       controlMPU,
+	"quota":     controlQuota,
+	"rm":        controlRm,
+	"transport": controlTransport,
+}
+
+type ControlServer struct {
+	fs       *Goofys
+	path     string
+	listener net.Listener
+}
+
+func (fs *Goofys) ListenControl(path string) (server *ControlServer, err error) {
+	// a previous instance might have crashed and left the socket
+	// behind
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// the commands don't go through the permission checks fuse
+	// would do, so only we get to send them. The socket is created
+	// 0600, chmod after listening would leave a window for others
+	// to connect
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+
+	server = &ControlServer{
+		fs:       fs,
+		path:     path,
+		listener: l,
+	}
+	go server.serve()
+	fs.control = server
+
+	log.Infof("listening for control commands on %v", path)
+	return
+}
+
+// Close stops taking commands, the listener removes the socket. An
+// event stream that's running ends when the mount's events are closed
+func (s *ControlServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *ControlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.Debugf("control socket %v: %v", s.path, err)
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+
+	cmd, ok := controlCommands[args[0]]
+	if !ok {
+		writeControlReply(conn, fmt.Errorf("unknown command: %v", args[0]), nil)
+		return
+	}
+
+	log.Debugf("control command %v", args)
+
+	err = cmd(s.fs, args[1:], conn)
+	if err != nil {
+		writeControlReply(conn, err, nil)
+	}
+}
+
+type controlReply struct {
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+func writeControlReply(w io.Writer, err error, result interface{}) error {
+	reply := controlReply{Result: result}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return json.NewEncoder(w).Encode(reply)
+}
+
+// controlEvents streams every event as a json object per line until
+// the client hangs up
+func controlEvents(fs *Goofys, args []string, conn net.Conn) error {
+	sub := fs.events.Subscribe(EVENT_BUFFER_SIZE)
+	defer fs.events.Unsubscribe(sub)
+
+	// we don't expect the client to send anything else, but that's
+	// how we find out that they went away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// unmounted
+				return nil
+			}
+			if err := enc.Encode(&e); err != nil {
+				return nil
+			}
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// controlTransport prints connection reuse and setup time of each
+// host we talked to
+func controlTransport(fs *Goofys, args []string, conn net.Conn) error {
+	return writeControlReply(conn, nil, GetTransportStats())
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// from <sys/un.h> and <sys/ucred.h>, syscall doesn't have them
+const (
+	SOL_LOCAL      = 0
+	LOCAL_PEERCRED = 1
+	XUCRED_VERSION = 0
+	XUCRED_NGROUPS = 16
+)
+
+type xucred struct {
+	Version uint32
+	Uid     uint32
+	Ngroups int16
+	Groups  [XUCRED_NGROUPS]uint32
+}
+
+// controlPeer returns who is on the other end of the control socket
+func controlPeer(conn net.Conn) (uid uint32, gid uint32, err error) {
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, syscall.EINVAL
+	}
+	raw, err := unix.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred xucred
+	err2 := raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			SOL_LOCAL, LOCAL_PEERCRED, uintptr(unsafe.Pointer(&cred)),
+			uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if err2 != nil {
+		return 0, 0, err2
+	}
+	if err != nil {
+		return
+	}
+	if cred.Version != XUCRED_VERSION || cred.Ngroups < 1 {
+		return 0, 0, syscall.EINVAL
+	}
+	// the first group is the effective one
+	return cred.Uid, cred.Groups[0], nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net"
+	"syscall"
+)
+
+// controlPeer returns who is on the other end of the control socket
+func controlPeer(conn net.Conn) (uid uint32, gid uint32, err error) {
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, syscall.EINVAL
+	}
+	raw, err := unix.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *syscall.Ucred
+	err2 := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if err2 != nil {
+		return 0, 0, err2
+	}
+	if err != nil {
+		return
+	}
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "gopkg.in/check.v1"
+)
+
+// just over what one CopyObject can do
+const COPY_TEST_SIZE = 6*1024*1024*1024 + 1
+
+type CopyMultipartTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+
+	mu sync.Mutex
+	// headers of the CreateMultipartUpload
+	created  []http.Header
+	ranges   []string
+	complete int
+	abort    int
+	failPart string
+
+	// part numbers of UploadPart, and the last CompleteMultipartUpload
+	uploaded []string
+	body     string
+}
+
+var _ = Suite(&CopyMultipartTest{})
+
+func (s *CopyMultipartTest) SetUpTest(t *C) {
+	s.created = nil
+	s.ranges = nil
+	s.uploaded = nil
+	s.body = ""
+	s.complete = 0
+	s.abort = 0
+	s.failPart = ""
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, &S3Config{
+		Region:       "us-east-1",
+		AccessKey:    "access",
+		SecretKey:    "secret",
+		StorageClass: "STANDARD",
+	})
+	t.Assert(err, IsNil)
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.newS3()
+}
+
+func (s *CopyMultipartTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *CopyMultipartTest) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == "HEAD":
+		w.Header().Set("Content-Length", fmt.Sprint(COPY_TEST_SIZE))
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("ETag", "\"source\"")
+		w.Header().Set("x-amz-storage-class", "STANDARD_IA")
+		w.Header().Set("x-amz-meta-foo", "bar")
+	case r.Method == "POST" && q.Get("uploadId") == "":
+		s.created = append(s.created, r.Header)
+		io.WriteString(w, "<InitiateMultipartUploadResult>"+
+			"<UploadId>upload</UploadId>"+
+			"</InitiateMultipartUploadResult>")
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		if q.Get("partNumber") == s.failPart {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>AccessDenied</Code>"+
+				"<Message>Access Denied</Message></Error>")
+			return
+		}
+		s.ranges = append(s.ranges, r.Header.Get("x-amz-copy-source-range"))
+		io.WriteString(w, "<CopyPartResult><ETag>\"etag\"</ETag></CopyPartResult>")
+	case r.Method == "PUT" && q.Get("partNumber") != "":
+		s.uploaded = append(s.uploaded, q.Get("partNumber"))
+		w.Header().Set("ETag", "\"part\"")
+	case r.Method == "POST":
+		s.complete++
+		s.body = string(body)
+		io.WriteString(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag>"+
+			"</CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		s.abort++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *CopyMultipartTest) TestCopy(t *C) {
+	_, err := s.s3.CopyBlob(&CopyBlobInput{
+		Source:      "src",
+		Destination: "dst",
+	})
+	t.Assert(err, IsNil)
+
+	// what the source has, which copying the parts doesn't
+	t.Assert(s.created, HasLen, 1)
+	t.Assert(s.created[0].Get("x-amz-storage-class"), Equals, "STANDARD_IA")
+	t.Assert(s.created[0].Get("Content-Type"), Equals, "video/mp4")
+	t.Assert(s.created[0].Get("x-amz-meta-foo"), Equals, "bar")
+
+	nParts, partSize := sizeToParts(COPY_TEST_SIZE)
+	t.Assert(nParts < 10000, Equals, true)
+	t.Assert(s.ranges, HasLen, nParts)
+
+	// every byte once
+	var starts []int64
+	for _, r := range s.ranges {
+		var from, to int64
+		_, err := fmt.Sscanf(r, "bytes=%d-%d", &from, &to)
+		t.Assert(err, IsNil)
+		t.Assert(to-from+1 <= partSize, Equals, true)
+		starts = append(starts, from, to)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	t.Assert(starts[0], Equals, int64(0))
+	t.Assert(starts[len(starts)-1], Equals, int64(COPY_TEST_SIZE-1))
+	for i := 1; i+1 < len(starts); i += 2 {
+		t.Assert(starts[i+1], Equals, starts[i]+1)
+	}
+
+	t.Assert(s.complete, Equals, 1)
+	t.Assert(s.abort, Equals, 0)
+}
+
+func (s *CopyMultipartTest) TestCopyFailed(t *C) {
+	s.failPart = "3"
+
+	_, err := s.s3.CopyBlob(&CopyBlobInput{
+		Source:       "src",
+		Destination:  "dst",
+		Size:         PUInt64(COPY_TEST_SIZE),
+		ETag:         PString("\"source\""),
+		Metadata:     map[string]*string{},
+		StorageClass: PString("STANDARD"),
+		ContentType:  PString("video/mp4"),
+	})
+	t.Assert(err, NotNil)
+
+	// the parts that did get copied aren't left behind
+	t.Assert(s.created, HasLen, 1)
+	t.Assert(s.complete, Equals, 0)
+	t.Assert(s.abort, Equals, 1)
+}
+
+func (s *CopyMultipartTest) TestAppend(t *C) {
+	mpu, err := s.s3.AppendBlob(&AppendBlobInput{
+		Key:     "src",
+		Offset:  COPY_TEST_SIZE,
+		IfMatch: PString("source"),
+	})
+	t.Assert(err, IsNil)
+
+	// kept like a copy would
+	t.Assert(s.created, HasLen, 1)
+	t.Assert(s.created[0].Get("x-amz-storage-class"), Equals, "STANDARD_IA")
+	t.Assert(s.created[0].Get("Content-Type"), Equals, "video/mp4")
+	t.Assert(s.created[0].Get("x-amz-meta-foo"), Equals, "bar")
+
+	// in as few parts as UploadPartCopy can do, none of them tiny
+	t.Assert(s.ranges, HasLen, 2)
+	sort.Strings(s.ranges)
+	t.Assert(s.ranges, DeepEquals, []string{
+		"bytes=0-3221225472",
+		"bytes=3221225473-6442450944",
+	})
+	t.Assert(mpu.NumParts, Equals, uint32(2))
+
+	// what's appended goes after them
+	_, err = s.s3.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     mpu,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("hello")),
+		Size:       5,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.uploaded, DeepEquals, []string{"3"})
+
+	_, err = s.s3.MultipartBlobCommit(mpu)
+	t.Assert(err, IsNil)
+	t.Assert(s.complete, Equals, 1)
+	for i := 1; i <= 3; i++ {
+		t.Assert(strings.Contains(s.body, fmt.Sprintf("<PartNumber>%v</PartNumber>", i)),
+			Equals, true)
+	}
+}
+
+func (s *CopyMultipartTest) TestAppendChanged(t *C) {
+	// someone else wrote it since
+	_, err := s.s3.AppendBlob(&AppendBlobInput{
+		Key:    "src",
+		Offset: COPY_TEST_SIZE - 1,
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+
+	_, err = s.s3.AppendBlob(&AppendBlobInput{
+		Key:     "src",
+		Offset:  COPY_TEST_SIZE,
+		IfMatch: PString("other"),
+	})
+	t.Assert(err, Equals, syscall.EBUSY)
+	t.Assert(s.created, HasLen, 0)
+}
+
+func (s *CopyMultipartTest) TestAppendFailed(t *C) {
+	s.failPart = "2"
+
+	_, err := s.s3.AppendBlob(&AppendBlobInput{
+		Key:    "src",
+		Offset: COPY_TEST_SIZE,
+	})
+	t.Assert(err, NotNil)
+	t.Assert(s.abort, Equals, 1)
+}
+
+func (s *CopyMultipartTest) TestAppendSmall(t *C) {
+	// the first part would be too small
+	_, err := s.s3.AppendBlob(&AppendBlobInput{
+		Key:    "src",
+		Offset: S3_MIN_APPEND_OFFSET - 1,
+	})
+	t.Assert(err, Equals, syscall.ENOTSUP)
+	t.Assert(s.created, HasLen, 0)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"io"
+	"sync"
+)
+
+const DEFAULT_COPY_PART_SIZE = 64 * 1024 * 1024
+
+// a copy that's taking long says how far it got every this many
+// parts
+const COPY_PROGRESS_PARTS = 16
+
+var copyLog = GetLogger("copy")
+
+// the parts of copies that are done are reused by the next ones
+var copyPartPool = sync.Pool{
+	New: func() interface{} {
+		return []byte(nil)
+	},
+}
+
+func getCopyPart(size uint64) []byte {
+	buf := copyPartPool.Get().([]byte)
+	if uint64(cap(buf)) < size {
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+func putCopyPart(buf []byte) {
+	if cap(buf) != 0 {
+		copyPartPool.Put(buf[:0])
+	}
+}
+
+type copyPart struct {
+	number uint32
+	offset uint64
+	buf    []byte
+	err    error
+}
+
+// multipartBlobCopy copies the first size bytes of src into mpu, for
+// backends that can read a range and append but can't copy on the
+// server. Parts of partSize are read with GetBlob and added in order,
+// the next one is read while the one before it is added so there are
+// at most 2 in memory. mpu is committed, or aborted if anything
+// fails. etag, if not nil, is what src has to still be
+func multipartBlobCopy(cloud StorageBackend, src string, etag *string, size uint64,
+	mpu *MultipartBlobCommitInput, partSize uint64) (err error) {
+
+	if partSize == 0 {
+		partSize = DEFAULT_COPY_PART_SIZE
+	}
+
+	parts := make(chan copyPart)
+	stop := make(chan bool)
+	go func() {
+		defer close(parts)
+
+		number := uint32(1)
+		for offset := uint64(0); offset < size; offset += partSize {
+			p := copyPart{number: number, offset: offset}
+			p.buf, p.err = readCopyPart(cloud, src, &etag, offset,
+				MinUInt64(partSize, size-offset))
+			select {
+			case parts <- p:
+			case <-stop:
+				putCopyPart(p.buf)
+				return
+			}
+			if p.err != nil {
+				return
+			}
+			number++
+		}
+	}()
+
+	for p := range parts {
+		if p.err != nil {
+			err = p.err
+			break
+		}
+
+		end := p.offset + uint64(len(p.buf))
+		_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     mpu,
+			PartNumber: p.number,
+			Body:       bytes.NewReader(p.buf),
+			Size:       uint64(len(p.buf)),
+			Last:       end == size,
+			Offset:     p.offset,
+		})
+		putCopyPart(p.buf)
+		if err != nil {
+			break
+		}
+
+		if p.number%COPY_PROGRESS_PARTS == 0 {
+			copyLog.Infof("copied %v of %v bytes of %v to %v", end, size,
+				src, *mpu.Key)
+		}
+	}
+	close(stop)
+
+	if err != nil {
+		copyLog.Errorf("copy of %v to %v failed: %v", src, *mpu.Key, err)
+		_, abortErr := cloud.MultipartBlobAbort(mpu)
+		if abortErr != nil {
+			copyLog.Warnf("unable to abort copy to %v: %v", *mpu.Key, abortErr)
+		}
+		return
+	}
+
+	_, err = cloud.MultipartBlobCommit(mpu)
+	return
+}
+
+// readCopyPart reads count bytes of key at offset. The first read
+// fixes etag if it wasn't, so all the parts are from the same object
+func readCopyPart(cloud StorageBackend, key string, etag **string, offset uint64,
+	count uint64) ([]byte, error) {
+
+	resp, err := getBlobChecked(cloud, &GetBlobInput{
+		Key:     key,
+		Start:   offset,
+		Count:   count,
+		IfMatch: *etag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if *etag == nil {
+		*etag = resp.ETag
+	}
+
+	buf := getCopyPart(count)
+	_, err = io.ReadFull(resp.Body, buf)
+	if err != nil {
+		putCopyPart(buf)
+		return nil, err
+	}
+	return buf, nil
+}
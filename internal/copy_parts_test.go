@@ -0,0 +1,173 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// rangeCopyBackend can read ranges of "src" and append to an upload,
+// and counts how many parts are read but not added yet
+type rangeCopyBackend struct {
+	memBackend
+
+	src   []byte
+	dst   []byte
+	reads int
+	// reads without IfMatch
+	unconditional int
+	inFlight      int
+	maxFlight     int
+	failAdd       uint32
+	failRead      uint32
+	aborted       bool
+	committed     bool
+}
+
+func (b *rangeCopyBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reads++
+	if uint32(b.reads) == b.failRead {
+		return nil, syscall.EIO
+	}
+	if param.IfMatch == nil {
+		b.unconditional++
+	} else if *param.IfMatch != "\"src\"" {
+		return nil, syscall.ESTALE
+	}
+	b.inFlight++
+	if b.inFlight > b.maxFlight {
+		b.maxFlight = b.inFlight
+	}
+
+	data := b.src[param.Start : param.Start+param.Count]
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:  &param.Key,
+				ETag: PString("\"src\""),
+				Size: uint64(len(data)),
+			},
+		},
+		Body: ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func (b *rangeCopyBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inFlight--
+	if param.PartNumber == b.failAdd {
+		return nil, syscall.EIO
+	}
+	if param.Offset != uint64(len(b.dst)) {
+		return nil, syscall.EINVAL
+	}
+	data, err := ioutil.ReadAll(param.Body)
+	if err != nil {
+		return nil, err
+	}
+	b.dst = append(b.dst, data...)
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (b *rangeCopyBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	b.aborted = true
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (b *rangeCopyBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	b.committed = true
+	return &MultipartBlobCommitOutput{}, nil
+}
+
+type CopyPartsTest struct {
+	cloud *rangeCopyBackend
+	mpu   *MultipartBlobCommitInput
+}
+
+var _ = Suite(&CopyPartsTest{})
+
+func (s *CopyPartsTest) SetUpTest(t *C) {
+	s.cloud = &rangeCopyBackend{
+		src: make([]byte, 10*1000+1),
+	}
+	(&SeqReader{}).Read(s.cloud.src)
+	s.mpu = &MultipartBlobCommitInput{Key: PString("dst")}
+}
+
+func (s *CopyPartsTest) TestCopy(t *C) {
+	size := uint64(len(s.cloud.src))
+	err := multipartBlobCopy(s.cloud, "src", PString("\"src\""), size, s.mpu, 1000)
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.committed, Equals, true)
+	t.Assert(s.cloud.aborted, Equals, false)
+	t.Assert(s.cloud.dst, DeepEquals, s.cloud.src)
+	t.Assert(s.cloud.reads, Equals, 11)
+	// one being added and the next one read
+	t.Assert(s.cloud.maxFlight <= 2, Equals, true)
+}
+
+func (s *CopyPartsTest) TestCopyETag(t *C) {
+	// the first part says which one it is, the rest have to be
+	// the same
+	err := multipartBlobCopy(s.cloud, "src", nil, 2500, s.mpu, 1000)
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.reads, Equals, 3)
+	t.Assert(s.cloud.unconditional, Equals, 1)
+
+	s.SetUpTest(t)
+	err = multipartBlobCopy(s.cloud, "src", PString("\"other\""), 100, s.mpu, 1000)
+	t.Assert(err, Equals, syscall.ESTALE)
+	t.Assert(s.cloud.aborted, Equals, true)
+	t.Assert(s.cloud.committed, Equals, false)
+}
+
+func (s *CopyPartsTest) TestCopyEmpty(t *C) {
+	err := multipartBlobCopy(s.cloud, "src", nil, 0, s.mpu, 1000)
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.committed, Equals, true)
+	t.Assert(s.cloud.reads, Equals, 0)
+}
+
+func (s *CopyPartsTest) TestCopyReadFailed(t *C) {
+	s.cloud.failRead = 3
+	err := multipartBlobCopy(s.cloud, "src", PString("\"src\""),
+		uint64(len(s.cloud.src)), s.mpu, 1000)
+	t.Assert(err, Equals, syscall.EIO)
+	t.Assert(s.cloud.aborted, Equals, true)
+	t.Assert(s.cloud.committed, Equals, false)
+	t.Assert(s.cloud.dst, HasLen, 2000)
+}
+
+func (s *CopyPartsTest) TestCopyAddFailed(t *C) {
+	s.cloud.failAdd = 2
+	err := multipartBlobCopy(s.cloud, "src", PString("\"src\""),
+		uint64(len(s.cloud.src)), s.mpu, 1000)
+	t.Assert(err, Equals, syscall.EIO)
+	t.Assert(s.cloud.aborted, Equals, true)
+	t.Assert(s.cloud.committed, Equals, false)
+	// nothing is read after the one that failed
+	s.cloud.mu.Lock()
+	t.Assert(s.cloud.reads <= 3, Equals, true)
+	s.cloud.mu.Unlock()
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CredentialsCommandTest struct {
+	dir string
+}
+
+var _ = Suite(&CredentialsCommandTest{})
+
+func (s *CredentialsCommandTest) SetUpTest(t *C) {
+	s.dir = t.MkDir()
+}
+
+// command prints t1, t2... every time it's run, expiring in expires
+// seconds
+func (s *CredentialsCommandTest) command(sleep string, expires int) string {
+	return fmt.Sprintf(`n=$(cat %[1]v/n 2>/dev/null || echo 0); n=$((n+1)); `+
+		`echo $n > %[1]v/n; sleep %[2]v; `+
+		`echo "{\"access_token\": \"t$n\", \"expires_on\": \"$(($(date +%%s) + %[3]v))\"}"`,
+		s.dir, sleep, expires)
+}
+
+func (s *CredentialsCommandTest) runs(t *C) int {
+	data, err := ioutil.ReadFile(s.dir + "/n")
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	t.Assert(err, IsNil)
+	return n
+}
+
+func (s *CredentialsCommandTest) TestToken(t *C) {
+	auth := NewCommandAuthorizer(s.command("0", 3600), 5*time.Minute)
+	token, err := auth.Token("")
+	t.Assert(err, IsNil)
+	t.Assert(token, Equals, "t1")
+
+	// it's cached
+	token, err = auth.Token("")
+	t.Assert(err, IsNil)
+	t.Assert(token, Equals, "t1")
+	t.Assert(s.runs(t), Equals, 1)
+
+	// unless the server didn't take it
+	token, err = auth.Token("t1")
+	t.Assert(err, IsNil)
+	t.Assert(token, Equals, "t2")
+	t.Assert(s.runs(t), Equals, 2)
+}
+
+func (s *CredentialsCommandTest) TestExpiresOn(t *C) {
+	for _, out := range []string{
+		`{"access_token": "a", "expires_on": 4102444800}`,
+		`{"access_token": "a", "expires_on": "4102444800"}`,
+		`{"access_token": "a", "expires_on": "2100-01-01T00:00:00Z"}`,
+	} {
+		auth := NewCommandAuthorizer("echo '"+out+"'", time.Minute)
+		token, err := auth.Token("")
+		t.Assert(err, IsNil, Commentf("%v", out))
+		t.Assert(token, Equals, "a")
+	}
+
+	for _, out := range []string{
+		`{"expires_on": 4102444800}`,
+		`{"access_token": "a", "expires_on": "tomorrow"}`,
+		`not json`,
+	} {
+		auth := NewCommandAuthorizer("echo '"+out+"'", time.Minute)
+		_, err := auth.Token("")
+		t.Assert(err, NotNil, Commentf("%v", out))
+	}
+}
+
+func (s *CredentialsCommandTest) TestRefresh(t *C) {
+	// always within the refresh window
+	auth := NewCommandAuthorizer(s.command("0", 60), 5*time.Minute)
+	for i := 1; i <= 3; i++ {
+		token, err := auth.Token("")
+		t.Assert(err, IsNil)
+		t.Assert(token, Equals, fmt.Sprintf("t%v", i))
+	}
+}
+
+func (s *CredentialsCommandTest) TestSingleFlight(t *C) {
+	auth := NewCommandAuthorizer(s.command("0.2", 3600), 5*time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := auth.Token("")
+			t.Check(err, IsNil)
+			t.Check(token, Equals, "t1")
+		}()
+	}
+	wg.Wait()
+	t.Assert(s.runs(t), Equals, 1)
+
+	// all of them were rejected at once, still one is enough
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := auth.Token("t1")
+			t.Check(err, IsNil)
+			t.Check(token, Equals, "t2")
+		}()
+	}
+	wg.Wait()
+	t.Assert(s.runs(t), Equals, 2)
+}
+
+func (s *CredentialsCommandTest) TestFailed(t *C) {
+	good := s.command("0", 60)
+	auth := NewCommandAuthorizer(good, 5*time.Minute)
+	token, err := auth.Token("")
+	t.Assert(err, IsNil)
+	t.Assert(token, Equals, "t1")
+
+	// the one we have hasn't expired yet
+	auth.Command = "exit 1"
+	token, err = auth.Token("")
+	t.Assert(err, IsNil)
+	t.Assert(token, Equals, "t1")
+
+	// but it's no good
+	_, err = auth.Token("t1")
+	t.Assert(err, NotNil)
+}
+
+func (s *CredentialsCommandTest) TestRetryUnauthorized(t *C) {
+	auth := NewCommandAuthorizer(s.command("0", 3600), 5*time.Minute)
+	// revoked while we still thought it was good
+	_, err := auth.Token("")
+	t.Assert(err, IsNil)
+
+	var requests []string
+	valid := "Bearer t2"
+	transport := auth.Transport(handlerTransport{
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body []byte
+			if r.Body != nil {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+			requests = append(requests, r.Header.Get("Authorization")+" "+string(body))
+			if r.Header.Get("Authorization") != valid {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}),
+	})
+
+	req, err := http.NewRequest("PUT", "https://account.dfs.core.windows.net/a",
+		strings.NewReader("hello"))
+	t.Assert(err, IsNil)
+	req.Header.Set("Authorization", "Bearer t1")
+	resp, err := transport.RoundTrip(req)
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	t.Assert(requests, DeepEquals, []string{"Bearer t1 hello", "Bearer t2 hello"})
+
+	// only once
+	requests = nil
+	valid = "Bearer nope"
+	req, _ = http.NewRequest("GET", "https://account.dfs.core.windows.net/a", nil)
+	req.Header.Set("Authorization", "Bearer t2")
+	resp, err = transport.RoundTrip(req)
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	t.Assert(requests, DeepEquals, []string{"Bearer t2 ", "Bearer t3 "})
+}
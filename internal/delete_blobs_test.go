@@ -0,0 +1,204 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "gopkg.in/check.v1"
+)
+
+type DeleteBlobsTest struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// blobs the azure server was asked to delete, and how many
+	// batches that took
+	deleted []string
+	batches int
+	errs    []string
+}
+
+var _ = Suite(&DeleteBlobsTest{})
+
+func (s *DeleteBlobsTest) SetUpTest(t *C) {
+	s.deleted = nil
+	s.batches = 0
+	s.errs = nil
+}
+
+func (s *DeleteBlobsTest) TearDownTest(t *C) {
+	if s.server != nil {
+		s.server.Close()
+		s.server = nil
+	}
+}
+
+func (s *DeleteBlobsTest) TestS3PerKeyErrors(t *C) {
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			io.WriteString(w, "<DeleteResult>"+
+				"<Deleted><Key>ok</Key></Deleted>"+
+				"<Error><Key>denied</Key><Code>AccessDenied</Code>"+
+				"<Message>Access Denied</Message></Error>"+
+				"<Error><Key>gone</Key><Code>NoSuchKey</Code>"+
+				"<Message>The specified key does not exist.</Message></Error>"+
+				"<Error><Key>odd</Key><Code>SomethingNew</Code>"+
+				"<Message>?</Message></Error>"+
+				"</DeleteResult>")
+		}))
+
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	t.Assert(err, IsNil)
+	s3.awsConfig.MaxRetries = aws.Int(0)
+	s3.newS3()
+
+	_, err = s3.DeleteBlobs(&DeleteBlobsInput{
+		Items: []string{"ok", "denied", "gone", "odd"},
+	})
+	partial, ok := err.(*DeleteBlobsError)
+	t.Assert(ok, Equals, true, Commentf("%v", err))
+	t.Assert(partial.Failed, DeepEquals, map[string]error{
+		"denied": syscall.EACCES,
+		"odd":    syscall.EIO,
+	})
+	t.Assert(partial.Errno(), Equals, syscall.EACCES)
+}
+
+// azureBatch answers a blob batch. Every delete succeeds except for
+// blobs named denied, or gone which don't exist
+func (s *DeleteBlobsTest) azureBatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method != http.MethodPost || r.URL.Query().Get("comp") != "batch" ||
+		r.URL.Query().Get("restype") != "container" {
+		s.errs = append(s.errs, fmt.Sprintf("unexpected %v %v", r.Method, r.URL))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.batches++
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		s.errs = append(s.errs, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the server closes the body once the response gets big enough
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.errs = append(s.errs, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary=batchresponse_1")
+	w.WriteHeader(http.StatusAccepted)
+
+	parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.errs = append(s.errs, err.Error())
+			return
+		}
+
+		sub, err := http.ReadRequest(bufio.NewReader(
+			io.MultiReader(part, strings.NewReader("\r\n"))))
+		if err != nil {
+			s.errs = append(s.errs, err.Error())
+			return
+		}
+		if sub.Method != http.MethodDelete ||
+			!strings.HasPrefix(sub.Header.Get("Authorization"), "SharedKey account:") ||
+			sub.Header.Get("x-ms-date") == "" {
+			s.errs = append(s.errs, fmt.Sprintf("unsigned %v %v", sub.Method, sub.URL))
+		}
+
+		name := strings.TrimPrefix(sub.URL.Path, "/container/")
+		status := "202 Accepted"
+		switch name {
+		case "denied":
+			status = "403 This request is not authorized to perform this operation\r\n" +
+				"x-ms-error-code: AuthorizationPermissionMismatch"
+		case "gone":
+			status = "404 The specified blob does not exist.\r\n" +
+				"x-ms-error-code: BlobNotFound"
+		default:
+			s.deleted = append(s.deleted, name)
+		}
+
+		fmt.Fprintf(w, "--batchresponse_1\r\n"+
+			"Content-Type: application/http\r\n"+
+			"Content-ID: %v\r\n\r\n"+
+			"HTTP/1.1 %v\r\n"+
+			"Content-Length: 0\r\n\r\n", part.Header.Get("Content-ID"), status)
+	}
+	io.WriteString(w, "--batchresponse_1--\r\n")
+}
+
+func (s *DeleteBlobsTest) TestAzureBatch(t *C) {
+	s.server = httptest.NewServer(http.HandlerFunc(s.azureBatch))
+
+	azb, err := NewAZBlob("container", &AZBlobConfig{
+		Endpoint:    s.server.URL + "/",
+		AccountName: "account",
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("key")),
+	})
+	t.Assert(err, IsNil)
+
+	keys := []string{"denied", "gone", "dir/"}
+	for i := 0; i < 300; i++ {
+		keys = append(keys, fmt.Sprintf("file%v", i))
+	}
+
+	_, err = azb.DeleteBlobs(&DeleteBlobsInput{Items: keys})
+	partial, ok := err.(*DeleteBlobsError)
+	t.Assert(ok, Equals, true, Commentf("%v", err))
+	t.Assert(partial.Failed, DeepEquals, map[string]error{
+		"denied": syscall.EACCES,
+	})
+
+	t.Assert(s.errs, IsNil)
+	t.Assert(s.batches, Equals, 2)
+	t.Assert(len(s.deleted), Equals, 301)
+	// hdi_isfolder blobs don't have the /
+	t.Assert(s.deleted[0], Equals, "dir")
+	t.Assert(s.deleted[300], Equals, "file299")
+}
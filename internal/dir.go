@@ -15,6 +15,8 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"sort"
 	"strings"
@@ -22,6 +24,8 @@ import (
 	"syscall"
 	"time"
 
+	. "github.com/AITRICS/goofys/api/common"
+
 	"github.com/aws/aws-sdk-go/aws"
 
 	"github.com/jacobsa/fuse"
@@ -38,10 +42,40 @@ type DirInodeData struct {
 	lastOpenDirIdx  int
 	seqOpenDirScore uint8
 	DirTime         time.Time
+	// bumped every time a listing of Children completes. The
+	// children that were in it carry the same number
+	listGen uint32
+	// the listGen whose children have been HEAD'ed in the
+	// background, see hydrateListed
+	hydratedGen uint32
+	// a reconcileDir is running
+	reconciling bool
+	// names that a lookup recently didn't find, and until when to
+	// believe it, see --neg-cache-ttl. Inserting a child clears
+	// its name
+	notFound map[string]time.Time
+	// readdirs going on. The InodeCache leaves alone the children
+	// they haven't returned yet, see DirHandle.lastName
+	readdirs []*DirHandle
+	// pages of a listing of Children being fetched, by their
+	// continuation token, "" for the first one. Readdirs that
+	// need the same page wait for the same request
+	listing map[string]*listPage
+	// a "dir_$folder$" was seen for this dir, see dir_marker.go.
+	// Protected by the parent's mu
+	folderMarker bool
 
 	Children []*Inode
 }
 
+// short, since someone else may create the name meanwhile. Long
+// enough for a build probing for the same headers over and over
+const DEFAULT_NEG_CACHE_TTL = 5 * time.Second
+
+// a dir forgets the negative lookups that expired once it has this
+// many, and all of them if none did
+const NEG_CACHE_MAX = 4096
+
 type DirHandleEntry struct {
 	Name   string
 	Inode  fuseops.InodeID
@@ -57,9 +91,35 @@ type DirHandle struct {
 	Marker        *string
 	lastFromCloud *string
 	done          bool
+	// number of subdirectories we've asked to be listed ahead
+	prefetched int
+	// what the listing we are doing will be, see DirInodeData.listGen
+	listGen uint32
 	// Time at which we started fetching child entries
 	// from cloud for this handle.
 	refreshStartTime time.Time
+	// pages after Marker that are listed ahead of what the
+	// kernel has read, see --readdir-max-pages-ahead
+	ahead []*listPage
+	// the entry we returned last and its offset. The next ReadDir
+	// goes on from it by name, the children before it may be
+	// evicted meanwhile. Also protected by inode.mu
+	lastName   *string
+	lastOffset fuseops.DirOffset
+}
+
+// listPage is a page of a listing of a dir. It's cancelled once all
+// the readdirs that took it gave up on it
+type listPage struct {
+	key    string
+	cancel context.CancelFunc
+	// closed once resp and err are set
+	ready chan struct{}
+	resp  *ListBlobsOutput
+	err   error
+	// readdirs that took it and haven't dropped it, protected by
+	// the dir's mu. The last one gives back the items
+	refs int
 }
 
 func NewDirHandle(inode *Inode) (dh *DirHandle) {
@@ -72,13 +132,13 @@ func (inode *Inode) OpenDir() (dh *DirHandle) {
 
 	parent := inode.Parent
 	cloud, _ := inode.cloud()
-	_, isS3 := cloud.(*S3Backend)
+	_, isS3 := unwrapBackend(cloud).(*S3Backend)
 	dir := inode.dir
 	if dir == nil {
 		panic(fmt.Sprintf("%v is not a directory", inode.FullName()))
 	}
 
-	if isS3 && parent != nil && inode.fs.flags.TypeCacheTTL != 0 {
+	if isS3 && parent != nil && inode.typeCacheTTL() != 0 {
 		parent.mu.Lock()
 		defer parent.mu.Unlock()
 
@@ -152,10 +212,13 @@ func (inode *Inode) OpenDir() (dh *DirHandle) {
 	}
 
 	dh = NewDirHandle(inode)
+	inode.mu.Lock()
+	dir.readdirs = append(dir.readdirs, dh)
+	inode.mu.Unlock()
 	return
 }
 
-func (dh *DirHandle) listObjectsSlurp(prefix string) (resp *ListBlobsOutput, err error) {
+func (dh *DirHandle) listObjectsSlurp(ctx context.Context, prefix string) (resp *ListBlobsOutput, err error) {
 	var marker *string
 	reqPrefix := prefix
 	inode := dh.inode
@@ -183,6 +246,7 @@ func (dh *DirHandle) listObjectsSlurp(prefix string) (resp *ListBlobsOutput, err
 	params := &ListBlobsInput{
 		Prefix:     &reqPrefix,
 		StartAfter: marker,
+		Context:    ctx,
 	}
 
 	resp, err = cloud.ListBlobs(params)
@@ -252,7 +316,8 @@ func (dh *DirHandle) listObjectsSlurp(prefix string) (resp *ListBlobsOutput, err
 	return
 }
 
-func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err error) {
+func (dh *DirHandle) listObjects(ctx context.Context, prefix string,
+	marker *string) (resp *ListBlobsOutput, err error) {
 	errSlurpChan := make(chan error, 1)
 	slurpChan := make(chan ListBlobsOutput, 1)
 	errListChan := make(chan error, 1)
@@ -264,11 +329,11 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	// multiple directories
 	parent := dh.inode.Parent
 
-	if dh.Marker == nil &&
-		fs.flags.TypeCacheTTL != 0 &&
+	if marker == nil &&
+		dh.inode.typeCacheTTL() != 0 &&
 		(parent != nil && parent.dir.seqOpenDirScore >= 2) {
 		go func() {
-			resp, err := dh.listObjectsSlurp(prefix)
+			resp, err := dh.listObjectsSlurp(ctx, prefix)
 			if err != nil {
 				errSlurpChan <- err
 			} else if resp != nil {
@@ -284,8 +349,9 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	listObjectsFlat := func() {
 		params := &ListBlobsInput{
 			Delimiter:         aws.String("/"),
-			ContinuationToken: dh.Marker,
+			ContinuationToken: marker,
 			Prefix:            &prefix,
+			Context:           ctx,
 		}
 
 		cloud, _ := dh.inode.cloud()
@@ -308,6 +374,10 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	case resp := <-slurpChan:
 		return &resp, nil
 	case err = <-errSlurpChan:
+	case <-interruptDone(ctx):
+		// the requests are cancelled too, and the channels
+		// are buffered so they don't wait for us
+		return nil, syscall.EINTR
 	}
 
 	if fs.flags.Cheap {
@@ -320,15 +390,143 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	case resp := <-listChan:
 		return &resp, nil
 	case err = <-errListChan:
+		if ctx != nil && ctx.Err() != nil {
+			err = syscall.EINTR
+		}
+		return
+	case <-interruptDone(ctx):
+		return nil, syscall.EINTR
+	}
+}
+
+// listPage returns the page of the listing of dh.inode after marker.
+// If another readdir is already listing it we wait for that, find
+// and ls -l of the same dir often run together. The request only has
+// the trace id of ctx, the others may still want it when ctx is done
+//
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) listPage(ctx context.Context, prefix string, marker *string) *listPage {
+	dir := dh.inode
+	key := nilStr(marker)
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if page := dir.dir.listing[key]; page != nil {
+		page.refs++
+		return page
+	}
+
+	page := &listPage{
+		key:   key,
+		ready: make(chan struct{}),
+		refs:  1,
+	}
+	ctx, page.cancel = context.WithCancel(WithTraceId(nil, TraceId(ctx)))
+	if dir.dir.listing == nil {
+		dir.dir.listing = make(map[string]*listPage)
+	}
+	dir.dir.listing[key] = page
+
+	go func() {
+		resp, err := dh.listObjects(ctx, prefix, marker)
+
+		dir.mu.Lock()
+		page.resp, page.err = resp, err
+		if dir.dir.listing[key] == page {
+			delete(dir.dir.listing, key)
+		}
+		dir.mu.Unlock()
+		close(page.ready)
+	}()
+	return page
+}
+
+// dropPage is when dh is done with page, or gave up on it
+//
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) dropPage(page *listPage) {
+	dir := dh.inode
+
+	dir.mu.Lock()
+	page.refs--
+	last := page.refs == 0
+	if last && dir.dir.listing[page.key] == page {
+		delete(dir.dir.listing, page.key)
+	}
+	dir.mu.Unlock()
+
+	if !last {
 		return
 	}
+	select {
+	case <-page.ready:
+		if page.resp != nil {
+			// everything we need from the page has been copied
+			putListItems(page.resp.Items)
+		}
+	default:
+	}
+	page.cancel()
+}
+
+// listAhead starts on the next page after the ones dh has, if it has
+// fewer than --readdir-max-pages-ahead. A page can only be asked for
+// once the one before it is back, so this is called as the kernel
+// reads on, and the pages after one that isn't read yet wait
+//
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) listAhead(ctx context.Context) {
+	if dh.done || dh.Marker == nil ||
+		len(dh.ahead) >= dh.inode.fs.flags.ReaddirMaxPagesAhead {
+		return
+	}
+
+	marker := dh.Marker
+	if n := len(dh.ahead); n != 0 {
+		last := dh.ahead[n-1]
+		select {
+		case <-last.ready:
+		default:
+			return
+		}
+		if last.err != nil || !last.resp.IsTruncated {
+			return
+		}
+		marker = last.resp.NextContinuationToken
+	}
+
+	_, prefix := dh.inode.cloud()
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+	dh.ahead = append(dh.ahead, dh.listPage(ctx, prefix, marker))
 }
 
 // LOCKS_REQUIRED(dh.mu)
 // LOCKS_EXCLUDED(dh.inode.mu)
 // LOCKS_EXCLUDED(dh.inode.fs)
 func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err error) {
-	en, ok := dh.inode.readDirFromCache(offset)
+	return dh.ReadDirInterruptible(nil, offset)
+}
+
+// ReadDirInterruptible is ReadDir that gives up listing with EINTR
+// once ctx is done. Nothing from the interrupted listing is used, the
+// next ReadDir lists again from where we were, or joins the listing if
+// another readdir kept it going
+//
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_EXCLUDED(dh.inode.mu)
+// LOCKS_EXCLUDED(dh.inode.fs)
+func (dh *DirHandle) ReadDirInterruptible(ctx context.Context,
+	offset fuseops.DirOffset) (en *DirHandleEntry, err error) {
+
+	if offset == 0 && dh.lastName != nil {
+		dh.rewind()
+	}
+
+	en, ok := dh.readDirFromCache(offset)
 	if ok {
 		return
 	}
@@ -336,6 +534,8 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	parent := dh.inode
 	fs := parent.fs
 
+	dh.listAhead(ctx)
+
 	// the dir expired, so we need to fetch from the cloud. there
 	// maybe static directories that we want to keep, so cloud
 	// listing should not overwrite them. here's what we do:
@@ -354,7 +554,6 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 			// refreshing this directory info from cloud.
 			dh.refreshStartTime = time.Now()
 		}
-		dh.mu.Unlock()
 
 		var prefix string
 		_, prefix = dh.inode.cloud()
@@ -362,9 +561,27 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 			prefix += "/"
 		}
 
-		resp, err := dh.listObjects(prefix)
+		var page *listPage
+		if len(dh.ahead) != 0 {
+			page = dh.ahead[0]
+			dh.ahead = dh.ahead[1:]
+		} else {
+			page = dh.listPage(ctx, prefix, dh.Marker)
+		}
+		dh.mu.Unlock()
+
+		var resp *ListBlobsOutput
+		select {
+		case <-page.ready:
+			resp, err = page.resp, page.err
+		case <-interruptDone(ctx):
+			err = syscall.EINTR
+		}
 		if err != nil {
+			dh.dropPage(page)
 			dh.mu.Lock()
+			// the pages after it are no good without it
+			dh.dropAhead()
 			return nil, err
 		}
 
@@ -373,26 +590,45 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 		parent.mu.Lock()
 		fs.mu.Lock()
 
+		var prefetch []*Inode
+
+		if dh.Marker == nil {
+			dh.listGen = parent.dir.listGen + 1
+		}
+
 		// this is only returned for non-slurped responses
 		for _, dir := range resp.Prefixes {
 			// strip trailing /
 			dirName := (*dir.Prefix)[0 : len(*dir.Prefix)-1]
 			// strip previous prefix
-			dirName = dirName[len(prefix):]
-			if len(dirName) == 0 {
+			rawName := dirName[len(prefix):]
+			if len(rawName) == 0 {
+				continue
+			}
+			dirName, ok := parent.listedName(rawName)
+			if !ok {
 				continue
 			}
 
 			if inode := parent.findChildUnlocked(dirName); inode != nil {
 				inode.AttrTime = time.Now()
+				inode.listGen = dh.listGen
 			} else {
 				inode := NewInode(fs, parent, &dirName)
+				inode.setRawName(rawName)
 				inode.ToDir()
 				fs.insertInode(parent, inode)
 				// these are fake dir entries, we will
 				// realize the refcnt when lookup is
 				// done
 				inode.refcnt = 0
+				inode.listGen = dh.listGen
+
+				if inode.typeCacheTTL() != 0 &&
+					dh.prefetched < fs.flags.ListPrefetch {
+					dh.prefetched++
+					prefetch = append(prefetch, inode)
+				}
 			}
 
 			dh.lastFromCloud = &dirName
@@ -412,10 +648,32 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 					// shouldn't happen
 					continue
 				}
+				rawName := baseName
+				if rawDir, isMarker := parent.folderMarkerDir(rawName); isMarker {
+					// hidden, but the dir is there
+					baseName, ok = parent.listedName(rawDir)
+					if !ok {
+						continue
+					}
+					if inode := parent.insertFolderMarker(baseName, rawDir); inode != nil {
+						inode.AttrTime = time.Now()
+						inode.listGen = dh.listGen
+					}
+					if dh.lastFromCloud == nil ||
+						strings.Compare(*dh.lastFromCloud, baseName) < 0 {
+						dh.lastFromCloud = &baseName
+					}
+					continue
+				}
+				baseName, ok = parent.listedName(rawName)
+				if !ok {
+					continue
+				}
 
 				inode := parent.findChildUnlocked(baseName)
 				if inode == nil {
 					inode = NewInode(fs, parent, &baseName)
+					inode.setRawName(rawName)
 					// these are fake dir entries,
 					// we will realize the refcnt
 					// when lookup is done
@@ -423,10 +681,14 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 					fs.insertInode(parent, inode)
 				}
 				inode.SetFromBlobItem(&obj)
+				inode.listGen = dh.listGen
 			} else {
 				// this is a slurped up object which
 				// was already cached
 				baseName = baseName[:slash]
+				if invalidName(baseName) {
+					baseName = escapeName(baseName)
+				}
 			}
 
 			if dh.lastFromCloud == nil ||
@@ -438,8 +700,15 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 		parent.mu.Unlock()
 		fs.mu.Unlock()
 
+		dh.dropPage(page)
+
+		if len(prefetch) != 0 {
+			fs.prefetchListings(prefetch)
+		}
+
 		if resp.IsTruncated {
 			dh.Marker = resp.NextContinuationToken
+			dh.listAhead(ctx)
 		} else {
 			dh.Marker = nil
 			dh.done = true
@@ -452,15 +721,16 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 
 	// Find the first non-stale child inode with offset >= `offset`.
 	var child *Inode
-	for int(offset) < len(parent.dir.Children) {
+	for i := dh.childIdx(offset); i < len(parent.dir.Children); {
 		// Note on locking: See comments at Inode::AttrTime, Inode::Parent.
-		childTmp := parent.dir.Children[offset]
+		childTmp := parent.dir.Children[i]
 		if childTmp.AttrTime.Before(dh.refreshStartTime) {
 			// childTmp.AttrTime < dh.refreshStartTime => the child entry was not
 			// updated from cloud by this dir Handle.
 			// So this is a stale entry that should be removed.
 			childTmp.Parent = nil
 			parent.removeChildUnlocked(childTmp)
+			parent.childrenChanged()
 		} else {
 			// Found a non-stale child inode.
 			child = childTmp
@@ -471,6 +741,9 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	if child == nil {
 		// we've reached the end
 		parent.dir.DirTime = time.Now()
+		if dh.listGen != 0 {
+			parent.dir.listGen = dh.listGen
+		}
 		parent.Attributes.Mtime = parent.findChildMaxTime()
 		return nil, nil
 	}
@@ -482,6 +755,8 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	}
 	if child.isDir() {
 		en.Type = fuseutil.DT_Directory
+	} else if child.symlink != nil {
+		en.Type = fuseutil.DT_Link
 	} else {
 		en.Type = fuseutil.DT_File
 	}
@@ -489,81 +764,231 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	if dh.lastFromCloud != nil && en.Name == *dh.lastFromCloud {
 		dh.lastFromCloud = nil
 	}
+	dh.returned(en)
 	return en, nil
 }
 
+// childIdx is where in Children the entry at offset is. Going on from
+// the entry we returned last is by name, the offsets of the ones
+// after it move when children before it are evicted or created.
+// Seeking anywhere else still goes by index
+//
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_REQUIRED(dh.inode.mu)
+func (dh *DirHandle) childIdx(offset fuseops.DirOffset) int {
+	if dh.lastName == nil {
+		return int(offset)
+	}
+	children := dh.inode.dir.Children
+	last := *dh.lastName
+	switch offset {
+	case dh.lastOffset:
+		return sort.Search(len(children), func(i int) bool {
+			return *children[i].Name > last
+		})
+	case dh.lastOffset - 1:
+		// the kernel had no room for it
+		return sort.Search(len(children), func(i int) bool {
+			return *children[i].Name >= last
+		})
+	}
+	return int(offset)
+}
+
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_REQUIRED(dh.inode.mu), for reading is enough
+func (dh *DirHandle) returned(en *DirHandleEntry) {
+	dh.lastName = &en.Name
+	dh.lastOffset = en.Offset
+}
+
+// readdirNeeds is whether a readdir going on may still return child,
+// so it can't be evicted. The last one returned may not have fit
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) readdirNeeds(child *Inode) bool {
+	for _, dh := range parent.dir.readdirs {
+		if dh.lastName == nil || *child.Name >= *dh.lastName {
+			return true
+		}
+	}
+	return false
+}
+
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) dropAhead() {
+	for _, page := range dh.ahead {
+		dh.dropPage(page)
+	}
+	dh.ahead = nil
+}
+
+// rewind starts over for a rewinddir. What's cached may be missing
+// what was evicted after we returned it, so unless it's fresh enough
+// to be served as it is we list again
+//
+// LOCKS_REQUIRED(dh.mu)
+// LOCKS_EXCLUDED(dh.inode.mu)
+func (dh *DirHandle) rewind() {
+	dh.dropAhead()
+	dh.Marker = nil
+	dh.lastFromCloud = nil
+	dh.done = false
+
+	dh.inode.mu.Lock()
+	dh.lastName = nil
+	dh.inode.mu.Unlock()
+}
+
 func (dh *DirHandle) CloseDir() error {
+	dh.mu.Lock()
+	dh.dropAhead()
+	dh.mu.Unlock()
+
+	dir := dh.inode
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for i, h := range dir.dir.readdirs {
+		if h == dh {
+			dir.dir.readdirs = append(dir.dir.readdirs[:i], dir.dir.readdirs[i+1:]...)
+			break
+		}
+	}
 	return nil
 }
 
-// prefix and newPrefix should include the trailing /
-// return all the renamed objects
-func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
+// how many objects a directory rename copies at once, unless
+// --rename-parallelism says otherwise
+const DEFAULT_RENAME_PARALLELISM = 20
+
+// prefix and newPrefix should include the trailing /. Objects are
+// moved a page at a time as the listing comes back: the page's new
+// keys are checked, the objects copied, up to --rename-parallelism at
+// once, and then deleted from the old place. The first error stops
+// the rest, and what was copied by then is still deleted, so nothing
+// is left in both places
+func (dir *Inode) renameChildren(ctx context.Context, cloud StorageBackend, prefix string,
 	newParent *Inode, newPrefix string) (err error) {
 
-	var copied []string
-	var res *ListBlobsOutput
+	parallelism := dir.fs.flags.RenameParallelism
+	if parallelism <= 0 {
+		parallelism = DEFAULT_RENAME_PARALLELISM
+	}
+	gate := Ticket{Total: uint32(parallelism)}.Init()
 
-	for true {
-		param := ListBlobsInput{
-			Prefix: &prefix,
-		}
-		if res != nil {
-			param.ContinuationToken = res.NextContinuationToken
+	moved := 0
+	var token *string
+	for {
+		var res *ListBlobsOutput
+		res, err = cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+			Context:           ctx,
+		})
+		if err != nil {
+			break
 		}
 
-		res, err = cloud.ListBlobs(&param)
+		// find out if the new keys are too long or too deep before
+		// any of them are copied
+		for _, i := range res.Items {
+			err = checkKey(cloud.Capabilities(), newPrefix+(*i.Key)[len(prefix):])
+			if err != nil {
+				break
+			}
+		}
 		if err != nil {
-			return
+			break
 		}
 
-		if len(res.Items) == 0 {
-			return
+		var copied []string
+		copied, err = copyChildren(ctx, cloud, gate, res.Items, prefix, newPrefix)
+		putListItems(res.Items)
+
+		if len(copied) != 0 {
+			s3Log.Debugf("rename copied %v", copied)
+			_, delErr := cloud.DeleteBlobs(&DeleteBlobsInput{
+				Items:   copied,
+				Context: ctx,
+			})
+			if partial, ok := delErr.(*DeleteBlobsError); ok {
+				// everything is at the new place, some of
+				// it is also still at the old one
+				s3Log.Errorf("rename %v: %v", prefix, delErr)
+				delErr = partial.Errno()
+			}
+			if err == nil {
+				err = delErr
+			}
+			moved += len(copied)
 		}
 
-		if copied == nil {
-			copied = make([]string, 0, len(res.Items))
+		if err != nil || !res.IsTruncated {
+			break
 		}
+		token = res.NextContinuationToken
+	}
+
+	if err != nil && moved != 0 {
+		s3Log.Errorf("rename %v to %v failed after moving %v objects: %v",
+			prefix, newPrefix, moved, err)
+	}
+	return
+}
 
-		// after the server side copy, we want to delete all the files
-		// using multi-delete, which is capped to 1000 on aws. If we
-		// are going to make an arbitrary limit that sounds like a
-		// good one (and we want to have an arbitrary limit because we
-		// don't want to rename a million objects here)
-		total := len(copied) + len(res.Items)
-		if total > 1000 || total == 1000 && res.IsTruncated {
-			return syscall.E2BIG
+// copyChildren copies items from under prefix to under newPrefix,
+// taking a ticket from gate for each copy. Say dir is "/a/dir" and it
+// has "1", "2", "3", and we are moving it to "/b/", items will be
+// a/dir/1, a/dir/2, a/dir/3, and we copy them to b/1, b/2, b/3. It
+// stops starting copies after the first one fails, and returns the
+// sources that were copied and that error
+func copyChildren(ctx context.Context, cloud StorageBackend, gate *Ticket,
+	items []BlobItemOutput, prefix string, newPrefix string) ([]string, error) {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	copied := make([]string, 0, len(items))
+
+	for _, i := range items {
+		gate.Take(1, true)
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			gate.Return(1)
+			break
 		}
 
-		// say dir is "/a/dir" and it has "1", "2", "3", and we are
-		// moving it to "/b/" items will be a/dir/1, a/dir/2, a/dir/3,
-		// and we will copy them to b/1, b/2, b/3 respectively
-		for _, i := range res.Items {
-			key := (*i.Key)[len(prefix):]
+		wg.Add(1)
+		go func(i BlobItemOutput) {
+			defer wg.Done()
+			defer gate.Return(1)
 
-			// TODO: coordinate with underlining copy and do this in parallel
-			_, err = cloud.CopyBlob(&CopyBlobInput{
+			_, err := cloud.CopyBlob(&CopyBlobInput{
 				Source:       *i.Key,
-				Destination:  newPrefix + key,
+				Destination:  newPrefix + (*i.Key)[len(prefix):],
 				Size:         &i.Size,
 				ETag:         i.ETag,
 				StorageClass: i.StorageClass,
+				Context:      ctx,
 			})
+
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return err
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
-
 			copied = append(copied, *i.Key)
-		}
-
-		if !res.IsTruncated {
-			break
-		}
+		}(i)
 	}
 
-	s3Log.Debugf("rename copied %v", copied)
-	_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: copied})
-	return err
+	wg.Wait()
+	return copied, firstErr
 }
 
 // Recursively resets the DirTime for child directories.
@@ -600,13 +1025,14 @@ func (inode *Inode) ResetForUnmount() {
 	// write operations under this directory will not know about this cloud.
 	inode.dir.cloud = nil
 	inode.dir.mountPrefix = ""
+	inode.dir.notFound = nil
 
 	// Clear metadata.
 	// Set the metadata values to nil instead of deleting them so that
 	// we know to fetch them again next time instead of thinking there's
 	// no metadata
-	inode.userMetadata = nil
-	inode.s3Metadata = nil
+	inode.userMetadata, inode.symlink, inode.perm = nil, nil, nil
+	inode.etag, inode.storageClass, inode.contentType = "", "", ""
 	inode.Attributes = InodeAttributes{}
 	inode.Invalid, inode.ImplicitDir = false, false
 	inode.mu.Unlock()
@@ -716,6 +1142,9 @@ func (parent *Inode) insertChild(inode *Inode) {
 }
 
 func (parent *Inode) insertChildUnlocked(inode *Inode) {
+	// created here, or seen in a listing
+	delete(parent.dir.notFound, *inode.Name)
+
 	l := len(parent.dir.Children)
 	if l == 0 {
 		parent.dir.Children = []*Inode{inode}
@@ -737,13 +1166,72 @@ func (parent *Inode) insertChildUnlocked(inode *Inode) {
 	}
 }
 
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) knownMissing(name string) bool {
+	until, ok := parent.dir.notFound[name]
+	return ok && time.Now().Before(until)
+}
+
+// addMissing remembers that a lookup didn't find name, so that the
+// next ones for --neg-cache-ttl don't have to ask the backend
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) addMissing(name string) {
+	ttl := parent.fs.flags.NegCacheTTL
+	if ttl == 0 || parent.findChildUnlocked(name) != nil {
+		// or it was created while we looked
+		return
+	}
+
+	now := time.Now()
+	if parent.dir.notFound == nil {
+		parent.dir.notFound = make(map[string]time.Time)
+	} else if len(parent.dir.notFound) >= NEG_CACHE_MAX {
+		for n, until := range parent.dir.notFound {
+			if !now.Before(until) {
+				delete(parent.dir.notFound, n)
+			}
+		}
+		if len(parent.dir.notFound) >= NEG_CACHE_MAX {
+			parent.dir.notFound = make(map[string]time.Time)
+		}
+	}
+	parent.dir.notFound[name] = now.Add(ttl)
+}
+
 func (parent *Inode) LookUp(name string) (inode *Inode, err error) {
+	return parent.LookUpWithContext(nil, name)
+}
+
+// LookUpWithContext is LookUp for a fuse op, whose trace id the
+// requests it makes carry
+func (parent *Inode) LookUpWithContext(ctx context.Context, name string) (inode *Inode, err error) {
 	parent.logFuse("Inode.LookUp", name)
 
-	inode, err = parent.LookUpInodeMaybeDir(name, parent.getChildName(name))
+	// only the trace id, the requests that lose the race are
+	// still running once the op is done
+	ctx = TraceOnly(ctx)
+
+	raw := parent.rawChildName(name)
+	if _, ok := parent.folderMarkerDir(raw); ok {
+		// only ever the marker of a dir
+		return nil, fuse.ENOENT
+	}
+	// a file we just wrote may not be found yet, see retryIfWritten
+	err = parent.findChild(name).retryIfWritten(func() (err error) {
+		inode, err = parent.LookUpInodeMaybeDir(ctx, raw, parent.getChildName(name))
+		return
+	})
+	if err == fuse.ENOENT {
+		inode, err = parent.lookUpFolderMarker(ctx, raw)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if raw != name {
+		inode.Name = &name
+		inode.rawName = &raw
+	}
 
 	return
 }
@@ -757,30 +1245,47 @@ func (parent *Inode) getChildName(name string) string {
 }
 
 func (parent *Inode) Unlink(name string) (err error) {
+	return parent.UnlinkWithContext(nil, name)
+}
+
+// UnlinkWithContext is Unlink for a fuse op, whose trace id the
+// request carries
+func (parent *Inode) UnlinkWithContext(ctx context.Context, name string) (err error) {
 	parent.logFuse("Unlink", name)
 
 	cloud, key := parent.cloud()
-	key = appendChildName(key, name)
+	key = appendChildName(key, parent.rawChildName(name))
+
+	ticket := parent.fs.events.reserve(key)
+	defer ticket.cancel()
 
 	_, err = cloud.DeleteBlob(&DeleteBlobInput{
-		Key: key,
+		Key:     key,
+		Context: TraceOnly(ctx),
 	})
 	if err == fuse.ENOENT {
-		// this might have been deleted out of band
+		// this might have been deleted out of band, and
+		// maybe more of what we have cached was too
+		go parent.fs.reconcileDir(parent, "unlink of a missing "+name)
 		err = nil
 	}
 	if err != nil {
 		return
 	}
+	ticket.publish(Event{Type: EVENT_UNLINK, Key: key})
 
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
 	inode := parent.findChildUnlocked(name)
 	if inode != nil {
+		if !inode.isDir() && inode.KnownSize != nil {
+			parent.fs.quota.Credit(int64(*inode.KnownSize), 1)
+		}
 		parent.removeChildUnlocked(inode)
 		inode.Parent = nil
 	}
+	parent.childrenChanged()
 
 	return
 }
@@ -815,31 +1320,42 @@ func (parent *Inode) Create(
 func (parent *Inode) MkDir(
 	name string) (inode *Inode, err error) {
 
+	return parent.MkDirWithContext(nil, name)
+}
+
+// MkDirWithContext is MkDir for a fuse op, whose trace id the request
+// carries
+func (parent *Inode) MkDirWithContext(ctx context.Context,
+	name string) (inode *Inode, err error) {
+
 	parent.logFuse("MkDir", name)
 
 	fs := parent.fs
 
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name)
-	if !cloud.Capabilities().DirBlob {
-		key += "/"
-	}
-	params := &PutBlobInput{
-		Key:     key,
-		Body:    nil,
-		DirBlob: true,
-	}
 
-	_, err = cloud.PutBlob(params)
-	if err != nil {
-		return
+	ticket := fs.events.reserve(key)
+	defer ticket.cancel()
+	// nil with --dir-marker-style none, the dir is only here
+	// until something is created in it
+	params := fs.dirMarker(cloud, key)
+	if params != nil {
+		params.Context = TraceOnly(ctx)
+		_, err = cloud.PutBlob(params)
+		if err != nil {
+			return
+		}
 	}
+	ticket.publish(Event{Type: EVENT_MKDIR, Key: key})
 
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
 	inode = NewInode(fs, parent, &name)
 	inode.ToDir()
+	inode.ImplicitDir = params == nil
+	inode.dir.folderMarker = params != nil && strings.HasSuffix(params.Key, FOLDER_MARKER_SUFFIX)
 	inode.touch()
 	if parent.Attributes.Mtime.Before(inode.Attributes.Mtime) {
 		parent.Attributes.Mtime = inode.Attributes.Mtime
@@ -848,6 +1364,72 @@ func (parent *Inode) MkDir(
 	return
 }
 
+// CreateSymlink writes an empty object with the target in its
+// metadata, backends without metadata can't have symlinks
+func (parent *Inode) CreateSymlink(
+	name string, target string) (inode *Inode, err error) {
+
+	return parent.CreateSymlinkWithContext(nil, name, target)
+}
+
+// CreateSymlinkWithContext is CreateSymlink for a fuse op, whose trace
+// id the request carries
+func (parent *Inode) CreateSymlinkWithContext(ctx context.Context,
+	name string, target string) (inode *Inode, err error) {
+
+	parent.logFuse("CreateSymlink", name, target)
+
+	fs := parent.fs
+	metaKey := fs.flags.SymlinkMetadataKey
+
+	cloud, key := parent.cloud()
+	if metaKey == "" || cloud.Capabilities().NoMetadata {
+		return nil, syscall.ENOTSUP
+	}
+	key = appendChildName(key, name)
+
+	err = fs.quota.Charge(0, 1)
+	if err != nil {
+		return
+	}
+
+	meta := map[string][]byte{
+		metaKey: []byte(target),
+	}
+	ticket := fs.events.reserve(key)
+	defer ticket.cancel()
+	resp, err := cloud.PutBlob(&PutBlobInput{
+		Key:      key,
+		Metadata: EncodeMetadata(meta),
+		Body:     bytes.NewReader(nil),
+		Size:     PUInt64(0),
+		Context:  TraceOnly(ctx),
+	})
+	if err != nil {
+		fs.quota.Credit(0, 1)
+		return
+	}
+	ticket.publish(Event{Type: EVENT_CREATE, Key: key, ETag: nilStr(resp.ETag)})
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	inode = NewInode(fs, parent, &name)
+	inode.Attributes = InodeAttributes{
+		Size:  0,
+		Mtime: time.Now(),
+	}
+	inode.KnownSize = PUInt64(0)
+	inode.etag = nilStr(resp.ETag)
+	inode.userMetadata = meta
+	inode.symlink = &target
+	inode.noteWritten()
+
+	parent.touch()
+
+	return
+}
+
 func appendChildName(parent, child string) string {
 	if len(parent) != 0 {
 		parent += "/"
@@ -855,19 +1437,20 @@ func appendChildName(parent, child string) string {
 	return parent + child
 }
 
-func (parent *Inode) isEmptyDir(fs *Goofys, name string) (isDir bool, err error) {
+func (parent *Inode) isEmptyDir(ctx context.Context, fs *Goofys, name string) (isDir bool, err error) {
 	cloud, key := parent.cloud()
-	key = appendChildName(key, name) + "/"
+	key = appendChildName(key, parent.rawChildName(name)) + "/"
 
 	params := &ListBlobsInput{
 		Delimiter: aws.String("/"),
 		MaxKeys:   PUInt32(2),
 		Prefix:    &key,
+		Context:   ctx,
 	}
 
 	resp, err := cloud.ListBlobs(params)
 	if err != nil {
-		return false, mapAwsError(err)
+		return false, fs.mapAwsError(err)
 	}
 
 	if len(resp.Prefixes) > 0 || len(resp.Items) > 1 {
@@ -888,20 +1471,31 @@ func (parent *Inode) isEmptyDir(fs *Goofys, name string) (isDir bool, err error)
 }
 
 func (parent *Inode) RmDir(name string) (err error) {
+	return parent.RmDirWithContext(nil, name)
+}
+
+// RmDirWithContext is RmDir for a fuse op, whose trace id the requests
+// it makes carry
+func (parent *Inode) RmDirWithContext(ctx context.Context, name string) (err error) {
 	parent.logFuse("Rmdir", name)
 
-	isDir, err := parent.isEmptyDir(parent.fs, name)
+	ctx = TraceOnly(ctx)
+	isDir, err := parent.isEmptyDir(ctx, parent.fs, name)
 	if err != nil {
 		return
 	}
+	cloud, key := parent.cloud()
+	key = appendChildName(key, parent.rawChildName(name))
+
+	ticket := parent.fs.events.reserve(key)
+	defer ticket.cancel()
+
 	// if this was an implicit dir, isEmptyDir would have returned
 	// isDir = false
 	if isDir {
-		cloud, key := parent.cloud()
-		key = appendChildName(key, name) + "/"
-
 		params := DeleteBlobInput{
-			Key: key,
+			Key:     key + "/",
+			Context: ctx,
 		}
 
 		_, err = cloud.DeleteBlob(&params)
@@ -910,6 +1504,28 @@ func (parent *Inode) RmDir(name string) (err error) {
 		}
 	}
 
+	parent.mu.RLock()
+	folderMarker := parent.hasFolderMarker(name)
+	parent.mu.RUnlock()
+	if folderMarker {
+		_, err = cloud.DeleteBlob(&DeleteBlobInput{
+			Key:     key + FOLDER_MARKER_SUFFIX,
+			Context: ctx,
+		})
+		if err == fuse.ENOENT {
+			// it was only "dir/", or someone else
+			// removed it
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if isDir || folderMarker {
+		ticket.publish(Event{Type: EVENT_RMDIR, Key: key})
+	}
+
 	// we know this entry is gone
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
@@ -919,6 +1535,7 @@ func (parent *Inode) RmDir(name string) (err error) {
 		parent.removeChildUnlocked(inode)
 		inode.Parent = nil
 	}
+	parent.childrenChanged()
 
 	return
 }
@@ -932,7 +1549,16 @@ func (parent *Inode) RmDir(name string) (err error) {
 // rename("file", "dir") = EISDIR
 // rename("dir", "file") = ENOTDIR
 func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error) {
+	return parent.RenameWithContext(nil, from, newParent, to)
+}
+
+// RenameWithContext is Rename for a fuse op, whose trace id the
+// requests it makes carry
+func (parent *Inode) RenameWithContext(ctx context.Context, from string,
+	newParent *Inode, to string) (err error) {
+
 	parent.logFuse("Rename", from, newParent.getChildName(to))
+	ctx = TraceOnly(ctx)
 
 	fromCloud, fromPath := parent.cloud()
 	toCloud, toPath := newParent.cloud()
@@ -942,7 +1568,7 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 		return
 	}
 
-	fromFullName := appendChildName(fromPath, from)
+	fromFullName := appendChildName(fromPath, parent.rawChildName(from))
 	fs := parent.fs
 
 	var size *uint64
@@ -950,7 +1576,7 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 	var toIsDir bool
 	var renameChildren bool
 
-	fromIsDir, err = parent.isEmptyDir(fs, from)
+	fromIsDir, err = parent.isEmptyDir(ctx, fs, from)
 	if err != nil {
 		if err == fuse.ENOTEMPTY {
 			renameChildren = true
@@ -959,21 +1585,28 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 		}
 	}
 
-	toFullName := appendChildName(toPath, to)
+	// Goofys.Rename holds parent.mu
+	folderMarker := parent.hasFolderMarker(from)
+	// an empty dir with only a "dir_$folder$"
+	onlyMarker := folderMarker && !fromIsDir
+	fromIsDir = fromIsDir || folderMarker
+
+	toFullName := appendChildName(toPath, newParent.rawChildName(to))
 
-	toIsDir, err = parent.isEmptyDir(fs, to)
+	toIsDir, err = parent.isEmptyDir(ctx, fs, to)
 	if err != nil {
 		return
 	}
 
 	if fromIsDir && !toIsDir {
 		_, err = fromCloud.HeadBlob(&HeadBlobInput{
-			Key: toFullName,
+			Key:     toFullName,
+			Context: ctx,
 		})
 		if err == nil {
 			return fuse.ENOTDIR
 		} else {
-			err = mapAwsError(err)
+			err = parent.fs.mapAwsError(err)
 			if err != fuse.ENOENT {
 				return
 			}
@@ -988,40 +1621,86 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 		size = PUInt64(0)
 	}
 
+	ticket := fs.events.reserve(strings.TrimRight(toFullName, "/"),
+		strings.TrimRight(fromFullName, "/"))
+	defer ticket.cancel()
+
 	if renameChildren && !fromCloud.Capabilities().DirBlob {
-		err = parent.renameChildren(fromCloud, fromFullName,
+		err = parent.renameChildren(ctx, fromCloud, fromFullName,
 			newParent, toFullName)
 		if err != nil {
 			return
 		}
-	} else {
-		err = parent.renameObject(fs, size, fromFullName, toFullName)
+	} else if !onlyMarker {
+		err = parent.renameObject(ctx, fs, size, fromFullName, toFullName)
+		if err == fuse.ENOENT {
+			go fs.reconcileDir(parent, "rename of a missing "+from)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if folderMarker {
+		err = parent.renameObject(ctx, fs, size,
+			strings.TrimRight(fromFullName, "/")+FOLDER_MARKER_SUFFIX,
+			strings.TrimRight(toFullName, "/")+FOLDER_MARKER_SUFFIX)
+		if err == fuse.ENOENT && !onlyMarker {
+			// the dir is marked some other way
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	e := Event{
+		Type:   EVENT_RENAME,
+		Key:    strings.TrimRight(toFullName, "/"),
+		OldKey: strings.TrimRight(fromFullName, "/"),
+	}
+	if size != nil {
+		e.Size = *size
 	}
+	ticket.publish(e)
 	return
 }
 
-func (parent *Inode) renameObject(fs *Goofys, size *uint64, fromFullName string, toFullName string) (err error) {
+func (parent *Inode) renameObject(ctx context.Context, fs *Goofys, size *uint64,
+	fromFullName string, toFullName string) (err error) {
+
 	cloud, _ := parent.cloud()
 
 	_, err = cloud.RenameBlob(&RenameBlobInput{
 		Source:      fromFullName,
 		Destination: toFullName,
+		Context:     ctx,
 	})
 	if err == nil || err != syscall.ENOTSUP {
 		return
 	}
 
+	var contentType *string
+	if !strings.HasSuffix(toFullName, "/") {
+		// the new name may mean a different type. If we don't
+		// know one for it the old one stays
+		contentType = fs.flags.GetMimeType(toFullName)
+	}
+
 	_, err = cloud.CopyBlob(&CopyBlobInput{
 		Source:      fromFullName,
 		Destination: toFullName,
 		Size:        size,
+		ContentType: contentType,
+		Context:     ctx,
 	})
 	if err != nil {
 		return
 	}
 
 	_, err = cloud.DeleteBlob(&DeleteBlobInput{
-		Key: fromFullName,
+		Key:     fromFullName,
+		Context: ctx,
 	})
 	if err != nil {
 		return
@@ -1053,10 +1732,21 @@ func sealPastDirs(dirs map[*Inode]bool, d *Inode) {
 func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*Inode]bool) {
 	fs := parent.fs
 	slash := strings.Index(path, "/")
-	if slash == -1 {
-		inode := parent.findChildUnlocked(path)
+	if rawDir, ok := parent.folderMarkerDir(path); ok && slash == -1 {
+		if dir, ok := parent.listedName(rawDir); ok {
+			if inode := parent.insertFolderMarker(dir, rawDir); inode != nil {
+				sealPastDirs(dirs, inode)
+			}
+		}
+	} else if slash == -1 {
+		name, ok := parent.listedName(path)
+		if !ok {
+			return
+		}
+		inode := parent.findChildUnlocked(name)
 		if inode == nil {
-			inode = NewInode(fs, parent, &path)
+			inode = NewInode(fs, parent, &name)
+			inode.setRawName(path)
 			inode.refcnt = 0
 			fs.insertInode(parent, inode)
 			inode.SetFromBlobItem(obj)
@@ -1075,13 +1765,18 @@ func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*I
 		}
 		sealPastDirs(dirs, parent)
 	} else {
-		dir := path[:slash]
+		rawDir := path[:slash]
 		path = path[slash+1:]
+		dir, ok := parent.listedName(rawDir)
+		if !ok {
+			return
+		}
 
 		if len(path) == 0 {
 			inode := parent.findChildUnlocked(dir)
 			if inode == nil {
 				inode = NewInode(fs, parent, &dir)
+				inode.setRawName(rawDir)
 				inode.ToDir()
 				inode.refcnt = 0
 				fs.insertInode(parent, inode)
@@ -1102,6 +1797,7 @@ func (parent *Inode) insertSubTree(path string, obj *BlobItemOutput, dirs map[*I
 			inode := parent.findChildUnlocked(dir)
 			if inode == nil {
 				inode = NewInode(fs, parent, &dir)
+				inode.setRawName(rawDir)
 				inode.ToDir()
 				inode.refcnt = 0
 				fs.insertInode(parent, inode)
@@ -1143,20 +1839,43 @@ func (parent *Inode) findChildMaxTime() time.Time {
 	return maxTime
 }
 
-func (parent *Inode) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEntry, ok bool) {
-	parent.mu.Lock()
-	defer parent.mu.Unlock()
+// childrenChanged is for --dir-mtime-from-children, a child was
+// removed or moved here. Unlike one that was written we don't know
+// when that happened, so it's now. parent.mu has to be held
+func (parent *Inode) childrenChanged() {
+	if parent.fs.flags.DirMtimeFromChildren {
+		parent.touch()
+	}
+}
+
+// listedRecently returns whether inode was in the latest listing of
+// parent, and that's younger than the stat cache ttl. A listing of a
+// big directory takes long enough that the entries from its first
+// pages may have expired by the time it's done
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) listedRecently(inode *Inode) bool {
+	return inode.listGen != 0 && inode.listGen == parent.dir.listGen &&
+		!expired(parent.dir.DirTime, inode.statCacheTTL())
+}
+
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEntry, ok bool) {
+	parent := dh.inode
+	parent.mu.RLock()
+	defer parent.mu.RUnlock()
 
 	if parent.dir == nil {
 		panic(*parent.FullName())
 	}
-	if !expired(parent.dir.DirTime, parent.fs.flags.TypeCacheTTL) {
+	if !expired(parent.dir.DirTime, parent.typeCacheTTL()) {
 		ok = true
 
-		if int(offset) >= len(parent.dir.Children) {
+		i := dh.childIdx(offset)
+		if i >= len(parent.dir.Children) {
 			return
 		}
-		child := parent.dir.Children[offset]
+		child := parent.dir.Children[i]
 
 		en = &DirHandleEntry{
 			Name:   *child.Name,
@@ -1165,21 +1884,23 @@ func (parent *Inode) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEn
 		}
 		if child.isDir() {
 			en.Type = fuseutil.DT_Directory
+		} else if child.symlink != nil {
+			en.Type = fuseutil.DT_Link
 		} else {
 			en.Type = fuseutil.DT_File
 		}
-
+		dh.returned(en)
 	}
 	return
 }
 
-func (parent *Inode) LookUpInodeNotDir(name string, c chan HeadBlobOutput, errc chan error) {
+func (parent *Inode) LookUpInodeNotDir(ctx context.Context, name string, c chan HeadBlobOutput, errc chan error) {
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name)
-	params := &HeadBlobInput{Key: key}
+	params := &HeadBlobInput{Key: key, Context: ctx}
 	resp, err := cloud.HeadBlob(params)
 	if err != nil {
-		errc <- mapAwsError(err)
+		errc <- parent.fs.mapAwsError(err)
 		return
 	}
 
@@ -1187,7 +1908,7 @@ func (parent *Inode) LookUpInodeNotDir(name string, c chan HeadBlobOutput, errc
 	c <- *resp
 }
 
-func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc chan error) {
+func (parent *Inode) LookUpInodeDir(ctx context.Context, name string, c chan ListBlobsOutput, errc chan error) {
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name) + "/"
 
@@ -1195,6 +1916,7 @@ func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc ch
 		Delimiter: aws.String("/"),
 		MaxKeys:   PUInt32(1),
 		Prefix:    &key,
+		Context:   ctx,
 	}
 
 	resp, err := cloud.ListBlobs(params)
@@ -1208,7 +1930,7 @@ func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc ch
 }
 
 // returned inode has nil Id
-func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *Inode, err error) {
+func (parent *Inode) LookUpInodeMaybeDir(ctx context.Context, name string, fullName string) (inode *Inode, err error) {
 	errObjectChan := make(chan error, 1)
 	objectChan := make(chan HeadBlobOutput, 2)
 	errDirBlobChan := make(chan error, 1)
@@ -1223,13 +1945,13 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 		panic("s3 disabled")
 	}
 
-	go parent.LookUpInodeNotDir(name, objectChan, errObjectChan)
+	go parent.LookUpInodeNotDir(ctx, name, objectChan, errObjectChan)
 	if !cloud.Capabilities().DirBlob && !parent.fs.flags.Cheap {
-		go parent.LookUpInodeNotDir(name+"/", objectChan, errDirBlobChan)
+		go parent.LookUpInodeNotDir(ctx, name+"/", objectChan, errDirBlobChan)
 		if !parent.fs.flags.ExplicitDir {
 			errDirChan = make(chan error, 1)
 			dirChan = make(chan ListBlobsOutput, 1)
-			go parent.LookUpInodeDir(name, dirChan, errDirChan)
+			go parent.LookUpInodeDir(ctx, name, dirChan, errDirChan)
 		}
 	}
 
@@ -1256,6 +1978,7 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 					inode.Attributes.Mtime = *resp.LastModified
 				}
 			}
+			inode.Attributes.setOtherTimes(&resp.BlobItemOutput)
 			inode.fillXattrFromHead(&resp)
 			return
 		case err = <-errObjectChan:
@@ -1271,12 +1994,16 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 					// it's actually a dir blob
 					entry := resp.Items[0]
 					if entry.ETag != nil {
-						inode.s3Metadata["etag"] = []byte(*entry.ETag)
+						inode.etag = *entry.ETag
 					}
 					if entry.StorageClass != nil {
-						inode.s3Metadata["storage-class"] = []byte(*entry.StorageClass)
+						inode.storageClass = internStorageClass(*entry.StorageClass)
 					}
 
+				} else if len(resp.Items) != 0 && resp.Items[0].LastModified != nil &&
+					inode.fs.flags.DirMtimeFromChildren {
+					// a child we know of until it's listed
+					inode.Attributes.Mtime = *resp.Items[0].LastModified
 				}
 				// if cheap is not on, the dir blob
 				// could exist but this returned first
@@ -1305,7 +2032,7 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 		switch checking {
 		case 2:
 			if parent.fs.flags.Cheap {
-				go parent.LookUpInodeNotDir(name+"/", objectChan, errDirBlobChan)
+				go parent.LookUpInodeNotDir(ctx, name+"/", objectChan, errDirBlobChan)
 			}
 		case 1:
 			if parent.fs.flags.ExplicitDir {
@@ -1314,7 +2041,7 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 			} else if parent.fs.flags.Cheap {
 				errDirChan = make(chan error, 1)
 				dirChan = make(chan ListBlobsOutput, 1)
-				go parent.LookUpInodeDir(name, dirChan, errDirChan)
+				go parent.LookUpInodeDir(ctx, name, dirChan, errDirChan)
 			}
 			break
 		doneCase:
@@ -0,0 +1,148 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Tools mark dirs differently on backends without them: with an empty
+// "dir/", also what s3fs does, with an empty "dir_$folder$" like
+// Hadoop's s3n and EMR, or not at all. --dir-marker-style is what
+// mkdir creates. "dir_$folder$" is taken for the dir and hidden from
+// listings with every style, but only looked up with hadoop, it's one
+// more HEAD for every lookup of what isn't there. A dir with more than
+// one kind of marker is still one dir, and rmdir removes them all
+
+const (
+	DIR_MARKER_NONE   = "none"
+	DIR_MARKER_SLASH  = "slash"
+	DIR_MARKER_S3FS   = "s3fs"
+	DIR_MARKER_HADOOP = "hadoop"
+)
+
+const FOLDER_MARKER_SUFFIX = "_$folder$"
+
+// what s3fs gives the "dir/" it creates
+const S3FS_DIR_CONTENT_TYPE = "application/x-directory"
+
+func (fs *Goofys) dirMarkerStyle() string {
+	if fs.flags.DirMarkerStyle == "" {
+		return DIR_MARKER_SLASH
+	}
+	return fs.flags.DirMarkerStyle
+}
+
+// dirMarker is what mkdir creates for the dir at key, nil if nothing
+func (fs *Goofys) dirMarker(cloud StorageBackend, key string) *PutBlobInput {
+	if cloud.Capabilities().DirBlob {
+		return &PutBlobInput{Key: key, DirBlob: true}
+	}
+
+	switch fs.dirMarkerStyle() {
+	case DIR_MARKER_NONE:
+		return nil
+	case DIR_MARKER_S3FS:
+		return &PutBlobInput{
+			Key:         key + "/",
+			DirBlob:     true,
+			ContentType: PString(S3FS_DIR_CONTENT_TYPE),
+		}
+	case DIR_MARKER_HADOOP:
+		return &PutBlobInput{Key: key + FOLDER_MARKER_SUFFIX, DirBlob: true}
+	default:
+		return &PutBlobInput{Key: key + "/", DirBlob: true}
+	}
+}
+
+// folderMarkerDir is the dir that raw, a name in parent, is the
+// "dir_$folder$" of
+func (parent *Inode) folderMarkerDir(raw string) (string, bool) {
+	if len(raw) <= len(FOLDER_MARKER_SUFFIX) || !strings.HasSuffix(raw, FOLDER_MARKER_SUFFIX) {
+		return "", false
+	}
+	cloud, _ := parent.cloud()
+	if cloud == nil || cloud.Capabilities().DirBlob {
+		return "", false
+	}
+	return raw[:len(raw)-len(FOLDER_MARKER_SUFFIX)], true
+}
+
+// insertFolderMarker is for a "dir_$folder$" that was listed, name
+// and rawName are of the dir. nil if there's a file by that name,
+// which is what it's taken for
+//
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_REQUIRED(parent.fs.mu)
+func (parent *Inode) insertFolderMarker(name string, rawName string) *Inode {
+	inode := parent.findChildUnlocked(name)
+	if inode == nil {
+		inode = NewInode(parent.fs, parent, &name)
+		inode.setRawName(rawName)
+		inode.ToDir()
+		// a fake dir entry like the others from a listing
+		inode.refcnt = 0
+		parent.fs.insertInode(parent, inode)
+	} else if !inode.isDir() {
+		return nil
+	}
+	inode.dir.folderMarker = true
+	return inode
+}
+
+// hasFolderMarker is whether the dir name may have a "dir_$folder$"
+// that has to go with it
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) hasFolderMarker(name string) bool {
+	if _, ok := parent.folderMarkerDir(name + FOLDER_MARKER_SUFFIX); !ok {
+		return false
+	}
+	inode := parent.findChildUnlocked(name)
+	if inode == nil || !inode.isDir() {
+		return false
+	}
+	return inode.dir.folderMarker || parent.fs.dirMarkerStyle() == DIR_MARKER_HADOOP
+}
+
+// lookUpFolderMarker is the dir name if there's a "name_$folder$",
+// with --dir-marker-style hadoop. Called once the other lookups found
+// nothing
+func (parent *Inode) lookUpFolderMarker(ctx context.Context, name string) (inode *Inode, err error) {
+	if parent.fs.dirMarkerStyle() != DIR_MARKER_HADOOP {
+		return nil, fuse.ENOENT
+	}
+	if _, ok := parent.folderMarkerDir(name + FOLDER_MARKER_SUFFIX); !ok {
+		return nil, fuse.ENOENT
+	}
+
+	cloud, key := parent.cloud()
+	key = appendChildName(key, name) + FOLDER_MARKER_SUFFIX
+	resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key, Context: ctx})
+	if err != nil {
+		return nil, parent.fs.mapAwsError(err)
+	}
+
+	inode = NewInode(parent.fs, parent, &name)
+	inode.ToDir()
+	inode.dir.folderMarker = true
+	if resp.LastModified != nil {
+		inode.Attributes.Mtime = *resp.LastModified
+	}
+	return
+}
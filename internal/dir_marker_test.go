@@ -0,0 +1,137 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+// markerBackend is an escapeBackend that remembers what was
+// written
+type markerBackend struct {
+	escapeBackend
+	puts    []*PutBlobInput
+	deleted []string
+}
+
+func (b *markerBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.puts = append(b.puts, param)
+	return b.escapeBackend.PutBlob(param)
+}
+
+func (b *markerBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	resp, err := b.escapeBackend.DeleteBlob(param)
+	if err == nil {
+		b.deleted = append(b.deleted, param.Key)
+	}
+	return resp, err
+}
+
+type DirMarkerTest struct {
+	fs    *Goofys
+	root  *Inode
+	cloud *markerBackend
+}
+
+var _ = Suite(&DirMarkerTest{})
+
+func (s *DirMarkerTest) setUp(style string, keys ...string) {
+	s.cloud = &markerBackend{}
+	s.cloud.add(keys...)
+	s.fs = newTestFs(s.cloud, &FlagStorage{Cheap: true, DirMarkerStyle: style})
+	s.root = s.fs.testRoot()
+}
+
+func (s *DirMarkerTest) TestListing(t *C) {
+	s.setUp(DIR_MARKER_SLASH, "a_$folder$", "a/file", "b_$folder$", "c/",
+		"c_$folder$", "file", "_$folder$")
+	t.Assert(listNames(t, s.root), DeepEquals,
+		[]string{"_$folder$", "a", "b", "c", "file"})
+
+	for _, name := range []string{"a", "b", "c"} {
+		t.Assert(s.root.findChild(name).isDir(), Equals, true)
+	}
+	t.Assert(s.root.findChild("b").dir.folderMarker, Equals, true)
+}
+
+func (s *DirMarkerTest) TestLookUp(t *C) {
+	s.setUp(DIR_MARKER_SLASH, "dir_$folder$")
+	_, err := s.root.LookUp("dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.root.LookUp("dir_$folder$")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	s.fs.flags.DirMarkerStyle = DIR_MARKER_HADOOP
+	inode, err := s.root.LookUp("dir")
+	t.Assert(err, IsNil)
+	t.Assert(inode.isDir(), Equals, true)
+	t.Assert(inode.dir.folderMarker, Equals, true)
+}
+
+func (s *DirMarkerTest) TestMkDir(t *C) {
+	for style, key := range map[string]string{
+		DIR_MARKER_SLASH:  "dir/",
+		DIR_MARKER_S3FS:   "dir/",
+		DIR_MARKER_HADOOP: "dir_$folder$",
+	} {
+		s.setUp(style)
+		inode, err := s.root.MkDir("dir")
+		t.Assert(err, IsNil)
+		t.Assert(inode.ImplicitDir, Equals, false)
+		t.Assert(s.cloud.keys(), DeepEquals, []string{key})
+		if style == DIR_MARKER_S3FS {
+			t.Assert(*s.cloud.puts[0].ContentType, Equals, S3FS_DIR_CONTENT_TYPE)
+		}
+	}
+
+	s.setUp(DIR_MARKER_NONE)
+	inode, err := s.root.MkDir("dir")
+	t.Assert(err, IsNil)
+	t.Assert(inode.ImplicitDir, Equals, true)
+	t.Assert(s.cloud.puts, HasLen, 0)
+}
+
+func (s *DirMarkerTest) TestRmDir(t *C) {
+	// both kinds
+	s.setUp(DIR_MARKER_SLASH, "dir/", "dir_$folder$")
+	t.Assert(listNames(t, s.root), DeepEquals, []string{"dir"})
+	t.Assert(s.root.RmDir("dir"), IsNil)
+	t.Assert(s.cloud.deleted, DeepEquals, []string{"dir/", "dir_$folder$"})
+	t.Assert(s.root.findChild("dir"), IsNil)
+
+	// only hadoop's
+	s.setUp(DIR_MARKER_SLASH, "dir_$folder$")
+	t.Assert(listNames(t, s.root), DeepEquals, []string{"dir"})
+	t.Assert(s.root.RmDir("dir"), IsNil)
+	t.Assert(s.cloud.deleted, DeepEquals, []string{"dir_$folder$"})
+
+	// not empty
+	s.setUp(DIR_MARKER_HADOOP, "dir_$folder$", "dir/file")
+	t.Assert(listNames(t, s.root), DeepEquals, []string{"dir"})
+	t.Assert(s.root.RmDir("dir"), Equals, fuse.ENOTEMPTY)
+	t.Assert(s.cloud.deleted, HasLen, 0)
+
+	// made with hadoop, marked with "dir/" by someone else
+	s.setUp(DIR_MARKER_HADOOP)
+	inode, err := s.root.MkDir("dir")
+	t.Assert(err, IsNil)
+	s.root.insertChild(inode)
+	s.cloud.add("dir/")
+	t.Assert(s.root.RmDir("dir"), IsNil)
+	t.Assert(s.cloud.deleted, DeepEquals, []string{"dir/", "dir_$folder$"})
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strconv"
+	"sync"
+)
+
+// getxattr of this on the root of the mount returns how many bytes
+// are in parts that are written but not uploaded yet
+const XATTR_DIRTY_BYTES = "user.goofys.dirty-bytes"
+
+// DirtyBytes counts the bytes in parts that are filled but not
+// uploaded yet, of every handle of the mount. A part is counted from
+// when it's handed to the upload until its buffer is freed, which is
+// after MultipartBlobAdd succeeds, or when a failed one is given up
+// on. With --max-dirty-bytes writers that need a new part wait until
+// there's room. A nil one counts nothing
+type DirtyBytes struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	bytes uint64
+	max   uint64
+
+	// writers wait in turn, so a big one can't keep taking the
+	// room that small ones are waiting for
+	nextTurn uint64
+	serving  uint64
+}
+
+func NewDirtyBytes(max uint64) *DirtyBytes {
+	d := &DirtyBytes{max: max}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *DirtyBytes) Bytes() uint64 {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bytes
+}
+
+func (d *DirtyBytes) add(n uint64) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bytes += n
+}
+
+func (d *DirtyBytes) done(n uint64) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bytes -= n
+	d.cond.Broadcast()
+}
+
+// wake lets the waiters look at giveUp again
+func (d *DirtyBytes) wake() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// wait returns once it's our turn and we are under the limit, or
+// giveUp says the part isn't going to be uploaded anyway. Nothing is
+// dirty means there's room, so a limit smaller than a part still
+// lets one through at a time
+func (d *DirtyBytes) wait(giveUp func() bool) {
+	if d == nil || d.max == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	turn := d.nextTurn
+	d.nextTurn++
+
+	for d.serving != turn || (d.bytes != 0 && d.bytes >= d.max && !giveUp()) {
+		d.cond.Wait()
+	}
+
+	d.serving++
+	d.cond.Broadcast()
+}
+
+func (d *DirtyBytes) xattr() []byte {
+	return []byte(strconv.FormatUint(d.Bytes(), 10))
+}
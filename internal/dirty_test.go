@@ -0,0 +1,135 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type DirtyTest struct {
+}
+
+var _ = Suite(&DirtyTest{})
+
+// waiting is how many are waiting or went through
+func (d *DirtyBytes) waiting() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nextTurn
+}
+
+func (s *DirtyTest) TestWaitInTurn(t *C) {
+	d := NewDirtyBytes(10)
+	// nothing dirty, always room
+	d.wait(func() bool { return false })
+
+	d.add(10)
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			d.wait(func() bool { return false })
+			order <- i
+		}(i)
+		// so they line up in order
+		for d.waiting() != uint64(i+2) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	select {
+	case <-order:
+		t.Fatal("shouldn't have gone through")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	d.done(5)
+	for i := 0; i < 3; i++ {
+		t.Assert(<-order, Equals, i)
+	}
+	t.Assert(d.Bytes(), Equals, uint64(5))
+}
+
+func (s *DirtyTest) TestWaitGiveUp(t *C) {
+	d := NewDirtyBytes(10)
+	d.add(20)
+
+	var giveUp bool
+	done := make(chan bool)
+	go func() {
+		d.wait(func() bool { return giveUp })
+		done <- true
+	}()
+	for d.waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	d.mu.Lock()
+	giveUp = true
+	d.mu.Unlock()
+	d.wake()
+	<-done
+	t.Assert(d.Bytes(), Equals, uint64(20))
+}
+
+func (s *DirtyTest) TestDirtyParts(t *C) {
+	cloud := &slowBackend{latency: 50 * time.Millisecond}
+	fh := newTestFileHandle(cloud)
+	fs := fh.inode.fs
+	fs.dirtyBytes = NewDirtyBytes(0)
+
+	t.Assert(writeTestFile(fh, 11*1024*1024), IsNil)
+	// the first two parts are uploading, the rest isn't full yet
+	t.Assert(fs.dirtyBytes.Bytes(), Equals, uint64(10*1024*1024))
+
+	root := fh.inode.Parent
+	root.Id = fuseops.RootInodeID
+	data, err := root.GetXattr(XATTR_DIRTY_BYTES)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "10485760")
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(fs.dirtyBytes.Bytes(), Equals, uint64(0))
+}
+
+func (s *DirtyTest) TestDirtyFailedPart(t *C) {
+	cloud := &slowBackend{
+		latency:   10 * time.Millisecond,
+		failPart:  1,
+		resumable: true,
+	}
+	fh := newTestFileHandle(cloud)
+	fs := fh.inode.fs
+	fs.flags.FlushRetries = 1
+	// no room for a second part until the first is uploaded
+	fs.dirtyBytes = NewDirtyBytes(5 * 1024 * 1024)
+
+	// which it never is, the write waiting for it finds out
+	// instead of waiting forever
+	t.Assert(writeTestFile(fh, 11*1024*1024), Equals, syscall.EIO)
+	t.Assert(fs.dirtyBytes.Bytes() >= uint64(5*1024*1024), Equals, true)
+
+	// the failed part is kept until the handle goes away
+	t.Assert(fh.FlushFile(), Equals, syscall.EIO)
+	fh.inode.fileHandles = 1
+	fh.Release()
+	for i := 0; i < 100 && fs.dirtyBytes.Bytes() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Assert(fs.dirtyBytes.Bytes(), Equals, uint64(0))
+}
@@ -0,0 +1,794 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// what --disk-cache-dir keeps, reads are aligned to it
+const DISK_CACHE_BLOCK = 1024 * 1024
+const DEFAULT_DISK_CACHE_SIZE_MB = 10 * 1024
+
+// the index is saved this often, if it changed
+const DISK_CACHE_SAVE_INTERVAL = 10 * time.Second
+const DISK_CACHE_INDEX = "index.json"
+
+// held with flock by the mount that uses the directory
+const DISK_CACHE_LOCK = "lock"
+
+var diskCacheLog = GetLogger("diskcache")
+
+// DiskCacheBackend keeps what GetBlob reads in files of
+// DISK_CACHE_BLOCK under --disk-cache-dir, named after the key, the
+// etag and where the block is. A read that has all of its blocks is
+// served from them, otherwise the aligned range around it is read
+// from the backend and written to the cache on the way. The least
+// recently read blocks are removed once there are more than
+// --disk-cache-size of them.
+//
+// The blocks of a key are only good for the etag they were read at.
+// The etag we last saw for a key, from a read, a HEAD or a listing,
+// is what the key has. Seeing another one, or writing or deleting
+// the key, removes all of its blocks. What's written is never
+// cached, only what's read back.
+//
+// The index is saved every DISK_CACHE_SAVE_INTERVAL and on unmount,
+// so the blocks are used again after a remount. Blocks it doesn't know
+// about are removed. Only one mount can use a directory at a time, it
+// holds DISK_CACHE_LOCK and another one fails to start
+type DiskCacheBackend struct {
+	StorageBackend
+
+	dir    string
+	bucket string
+	max    uint64
+
+	lock *os.File
+	// closed by Close to stop saveLoop, which closes saved
+	stop  chan struct{}
+	saved chan struct{}
+
+	mu      sync.Mutex
+	objects map[string]*diskCacheObject
+	// of *diskCacheBlock, least recently used first
+	lru  *list.List
+	used uint64
+	// since the index was last saved
+	changed bool
+}
+
+type diskCacheObject struct {
+	key  string
+	etag string
+	// 0 until we know
+	size   uint64
+	blocks map[uint64]*list.Element
+}
+
+type diskCacheBlock struct {
+	obj   *diskCacheObject
+	index uint64
+	size  uint64
+	used  time.Time
+}
+
+// what's saved in DISK_CACHE_INDEX
+type diskCacheIndex struct {
+	Bucket    string                 `json:"bucket"`
+	BlockSize uint64                 `json:"block_size"`
+	Objects   []diskCacheIndexObject `json:"objects"`
+}
+
+type diskCacheIndexObject struct {
+	Key    string                `json:"key"`
+	ETag   string                `json:"etag"`
+	Size   uint64                `json:"size,omitempty"`
+	Blocks []diskCacheIndexBlock `json:"blocks"`
+}
+
+type diskCacheIndexBlock struct {
+	Index uint64 `json:"index"`
+	Size  uint64 `json:"size"`
+	// unix nanoseconds
+	Used int64 `json:"used"`
+}
+
+func NewDiskCacheBackend(cloud StorageBackend, bucket string, dir string,
+	max uint64) (*DiskCacheBackend, error) {
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create disk cache %v: %v", dir, err)
+	}
+
+	// load removes the blocks another mount's index has
+	lock, err := os.OpenFile(filepath.Join(dir, DISK_CACHE_LOCK), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock disk cache %v: %v", dir, err)
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("disk cache %v is used by another mount", dir)
+		}
+		return nil, fmt.Errorf("unable to lock disk cache %v: %v", dir, err)
+	}
+
+	c := &DiskCacheBackend{
+		StorageBackend: cloud,
+		dir:            dir,
+		bucket:         bucket,
+		max:            max,
+		lock:           lock,
+		stop:           make(chan struct{}),
+		saved:          make(chan struct{}),
+		objects:        make(map[string]*diskCacheObject),
+		lru:            list.New(),
+	}
+	c.load()
+	go c.saveLoop()
+	return c, nil
+}
+
+func (c *DiskCacheBackend) Unwrap() StorageBackend {
+	return c.StorageBackend
+}
+
+// findDiskCacheBackend returns the DiskCacheBackend among the wrappers
+// of cloud, nil if there's no --disk-cache-dir
+func findDiskCacheBackend(cloud StorageBackend) (cache *DiskCacheBackend) {
+	walkBackends(cloud, func(b StorageBackend) bool {
+		cache, _ = b.(*DiskCacheBackend)
+		return cache != nil
+	})
+	return
+}
+
+// Close saves the index and lets another mount use the directory.
+// The cache can't be used after
+func (c *DiskCacheBackend) Close() error {
+	close(c.stop)
+	<-c.saved
+	return c.lock.Close()
+}
+
+func (c *DiskCacheBackend) blockPath(key string, etag string, index uint64) string {
+	h := sha256.Sum256([]byte(key + "\x00" + etag))
+	name := hex.EncodeToString(h[:16])
+	return filepath.Join(c.dir, name[:2], fmt.Sprintf("%v.%v", name, index))
+}
+
+func (c *DiskCacheBackend) load() {
+	indexPath := filepath.Join(c.dir, DISK_CACHE_INDEX)
+	lockPath := filepath.Join(c.dir, DISK_CACHE_LOCK)
+
+	var index diskCacheIndex
+	data, err := ioutil.ReadFile(indexPath)
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			diskCacheLog.Warnf("invalid disk cache index %v, starting empty: %v",
+				indexPath, err)
+		}
+	}
+
+	var blocks []*diskCacheBlock
+	keep := make(map[string]bool)
+	if err == nil && index.Bucket == c.bucket && index.BlockSize == DISK_CACHE_BLOCK {
+		for _, o := range index.Objects {
+			obj := &diskCacheObject{
+				key:    o.Key,
+				etag:   o.ETag,
+				size:   o.Size,
+				blocks: make(map[uint64]*list.Element),
+			}
+			for _, b := range o.Blocks {
+				path := c.blockPath(o.Key, o.ETag, b.Index)
+				fi, err := os.Stat(path)
+				if err != nil || uint64(fi.Size()) != b.Size {
+					continue
+				}
+				keep[path] = true
+				blocks = append(blocks, &diskCacheBlock{
+					obj:   obj,
+					index: b.Index,
+					size:  b.Size,
+					used:  time.Unix(0, b.Used),
+				})
+			}
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].used.Before(blocks[j].used)
+	})
+	for _, b := range blocks {
+		b.obj.blocks[b.index] = c.lru.PushBack(b)
+		c.objects[b.obj.key] = b.obj
+		c.used += b.size
+	}
+
+	// written after the index was last saved, or removed from it
+	// before that
+	filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && path != indexPath && path != lockPath &&
+			!keep[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	// --disk-cache-size may be smaller now
+	c.evict()
+	diskCacheLog.Infof("disk cache %v has %v blocks, %v bytes", c.dir, c.lru.Len(), c.used)
+	c.mu.Unlock()
+}
+
+func (c *DiskCacheBackend) saveLoop() {
+	ticker := time.NewTicker(DISK_CACHE_SAVE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.save()
+		case <-c.stop:
+			c.save()
+			close(c.saved)
+			return
+		}
+	}
+}
+
+func (c *DiskCacheBackend) save() {
+	c.mu.Lock()
+	if !c.changed {
+		c.mu.Unlock()
+		return
+	}
+
+	index := diskCacheIndex{
+		Bucket:    c.bucket,
+		BlockSize: DISK_CACHE_BLOCK,
+	}
+	for _, obj := range c.objects {
+		o := diskCacheIndexObject{
+			Key:  obj.key,
+			ETag: obj.etag,
+			Size: obj.size,
+		}
+		for _, e := range obj.blocks {
+			b := e.Value.(*diskCacheBlock)
+			o.Blocks = append(o.Blocks, diskCacheIndexBlock{
+				Index: b.index,
+				Size:  b.size,
+				Used:  b.used.UnixNano(),
+			})
+		}
+		index.Objects = append(index.Objects, o)
+	}
+	c.changed = false
+	c.mu.Unlock()
+
+	path := filepath.Join(c.dir, DISK_CACHE_INDEX)
+	data, err := json.Marshal(&index)
+	if err == nil {
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		diskCacheLog.Errorf("unable to save disk cache index to %v: %v", path, err)
+		c.mu.Lock()
+		c.changed = true
+		c.mu.Unlock()
+	}
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *DiskCacheBackend) removeBlock(e *list.Element) {
+	b := e.Value.(*diskCacheBlock)
+	c.lru.Remove(e)
+	delete(b.obj.blocks, b.index)
+	c.used -= b.size
+	c.changed = true
+	os.Remove(c.blockPath(b.obj.key, b.obj.etag, b.index))
+
+	if len(b.obj.blocks) == 0 && c.objects[b.obj.key] == b.obj {
+		delete(c.objects, b.obj.key)
+	}
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *DiskCacheBackend) removeObject(obj *diskCacheObject) {
+	for _, e := range obj.blocks {
+		c.removeBlock(e)
+	}
+	if c.objects[obj.key] == obj {
+		delete(c.objects, obj.key)
+	}
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *DiskCacheBackend) evict() {
+	for c.used > c.max && c.lru.Len() != 0 {
+		c.removeBlock(c.lru.Front())
+	}
+}
+
+// forget removes the blocks of a key that was written or deleted
+func (c *DiskCacheBackend) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if obj := c.objects[key]; obj != nil {
+		c.removeObject(obj)
+	}
+}
+
+// observe is a HEAD or a listing telling us what key is now
+func (c *DiskCacheBackend) observe(key string, etag *string, size uint64) {
+	if etag == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := c.objects[key]
+	if obj == nil {
+		return
+	}
+	if quoteETag(obj.etag) != quoteETag(*etag) {
+		diskCacheLog.Debugf("%v changed from %v to %v", key, obj.etag, *etag)
+		c.removeObject(obj)
+	} else if obj.size == 0 {
+		obj.size = size
+		c.changed = true
+	}
+}
+
+// prepare makes the blocks read now belong to etag, the ones of any
+// other etag are removed
+func (c *DiskCacheBackend) prepare(key string, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := c.objects[key]
+	if obj != nil && quoteETag(obj.etag) != quoteETag(etag) {
+		diskCacheLog.Debugf("%v changed from %v to %v", key, obj.etag, etag)
+		c.removeObject(obj)
+		obj = nil
+	}
+	if obj == nil {
+		c.objects[key] = &diskCacheObject{
+			key:    key,
+			etag:   quoteETag(etag),
+			blocks: make(map[uint64]*list.Element),
+		}
+	}
+}
+
+// putBlock keeps a block that was read. The block is the last one
+// of the object if it's short
+func (c *DiskCacheBackend) putBlock(key string, etag string, index uint64, data []byte) {
+	path := c.blockPath(key, etag, index)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		diskCacheLog.Errorf("unable to cache %v: %v", key, err)
+		return
+	}
+
+	// others may be reading the same block
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err == nil {
+		_, err = f.Write(data)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		diskCacheLog.Errorf("unable to cache %v: %v", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := c.objects[key]
+	if obj == nil || obj.etag != quoteETag(etag) {
+		// it changed while we were reading it
+		os.Remove(path)
+		return
+	}
+
+	size := uint64(len(data))
+	if e := obj.blocks[index]; e != nil {
+		b := e.Value.(*diskCacheBlock)
+		c.used -= b.size
+		b.size = size
+		b.used = time.Now()
+		c.lru.MoveToBack(e)
+	} else {
+		obj.blocks[index] = c.lru.PushBack(&diskCacheBlock{
+			obj:   obj,
+			index: index,
+			size:  size,
+			used:  time.Now(),
+		})
+	}
+	c.used += size
+	if size < DISK_CACHE_BLOCK {
+		obj.size = index*DISK_CACHE_BLOCK + size
+	}
+	c.changed = true
+	c.evict()
+}
+
+// hit returns the read from the cache if all of it is there
+func (c *DiskCacheBackend) hit(param *GetBlobInput) *GetBlobOutput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj := c.objects[param.Key]
+	if obj == nil {
+		return nil
+	}
+	if param.IfMatch != nil && quoteETag(*param.IfMatch) != quoteETag(obj.etag) {
+		// the backend knows which one it is now
+		return nil
+	}
+
+	end := param.Start + param.Count
+	if param.Count == 0 || (obj.size != 0 && end > obj.size) {
+		end = obj.size
+	}
+	if param.Start >= end {
+		return nil
+	}
+
+	first := param.Start / DISK_CACHE_BLOCK
+	last := (end - 1) / DISK_CACHE_BLOCK
+	files := make([]*os.File, 0, last-first+1)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		e := obj.blocks[i]
+		if e == nil || i*DISK_CACHE_BLOCK+e.Value.(*diskCacheBlock).size <
+			MinUInt64(end, (i+1)*DISK_CACHE_BLOCK) {
+			closeAll()
+			return nil
+		}
+
+		f, err := os.Open(c.blockPath(obj.key, obj.etag, i))
+		if err != nil {
+			diskCacheLog.Warnf("cached block of %v is gone: %v", obj.key, err)
+			closeAll()
+			c.removeBlock(e)
+			return nil
+		}
+		files = append(files, f)
+	}
+
+	_, err := files[0].Seek(int64(param.Start%DISK_CACHE_BLOCK), io.SeekStart)
+	if err != nil {
+		closeAll()
+		return nil
+	}
+
+	now := time.Now()
+	for i := first; i <= last; i++ {
+		e := obj.blocks[i]
+		e.Value.(*diskCacheBlock).used = now
+		c.lru.MoveToBack(e)
+	}
+	c.changed = true
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:  &param.Key,
+				ETag: PString(obj.etag),
+				Size: end - param.Start,
+			},
+		},
+		Body: &diskCacheReader{files: files, left: end - param.Start},
+	}
+}
+
+func (c *DiskCacheBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	if param.VersionId != nil || param.Checksum {
+		// not the latest, or we'd have to hash all of it
+		return c.StorageBackend.GetBlob(param)
+	}
+
+	if resp := c.hit(param); resp != nil {
+		return resp, nil
+	}
+
+	// the whole blocks around it, so they can be kept
+	get := *param
+	get.Start = param.Start - param.Start%DISK_CACHE_BLOCK
+	if param.Count != 0 {
+		end := param.Start + param.Count
+		if end%DISK_CACHE_BLOCK != 0 {
+			end += DISK_CACHE_BLOCK - end%DISK_CACHE_BLOCK
+		}
+		get.Count = end - get.Start
+	}
+
+	resp, err := c.StorageBackend.GetBlob(&get)
+	if err != nil {
+		return nil, err
+	}
+
+	fill := &diskCacheFill{
+		c:          c,
+		key:        param.Key,
+		body:       resp.Body,
+		blockStart: get.Start,
+		skip:       param.Start - get.Start,
+		left:       param.Count,
+		expected:   resp.Size,
+	}
+	if resp.Size != 0 && resp.Size <= fill.skip {
+		// it ends before what was asked for, let the backend
+		// say so
+		resp.Body.Close()
+		return c.StorageBackend.GetBlob(param)
+	}
+	if resp.ETag != nil {
+		fill.etag = quoteETag(*resp.ETag)
+		fill.block = make([]byte, 0, DISK_CACHE_BLOCK)
+		c.prepare(param.Key, fill.etag)
+	}
+
+	if resp.Size != 0 {
+		resp.Size -= fill.skip
+	}
+	if param.Count != 0 && resp.Size > param.Count {
+		resp.Size = param.Count
+	}
+	resp.Body = fill
+	return resp, nil
+}
+
+func (c *DiskCacheBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	resp, err := c.StorageBackend.HeadBlob(param)
+	if err == nil {
+		c.observe(param.Key, resp.ETag, resp.Size)
+	} else if err == syscall.ENOENT {
+		c.forget(param.Key)
+	}
+	return resp, err
+}
+
+func (c *DiskCacheBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	resp, err := c.StorageBackend.ListBlobs(param)
+	if err == nil {
+		for _, item := range resp.Items {
+			if item.Key != nil {
+				c.observe(*item.Key, item.ETag, item.Size)
+			}
+		}
+	}
+	return resp, err
+}
+
+func (c *DiskCacheBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	resp, err := c.StorageBackend.PutBlob(param)
+	c.forget(param.Key)
+	return resp, err
+}
+
+func (c *DiskCacheBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	resp, err := c.StorageBackend.MultipartBlobCommit(param)
+	c.forget(*param.Key)
+	return resp, err
+}
+
+func (c *DiskCacheBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	resp, err := c.StorageBackend.CopyBlob(param)
+	c.forget(param.Destination)
+	return resp, err
+}
+
+func (c *DiskCacheBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	resp, err := c.StorageBackend.RenameBlob(param)
+	c.forget(param.Source)
+	c.forget(param.Destination)
+	return resp, err
+}
+
+func (c *DiskCacheBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	resp, err := c.StorageBackend.DeleteBlob(param)
+	c.forget(param.Key)
+	return resp, err
+}
+
+func (c *DiskCacheBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	resp, err := c.StorageBackend.DeleteBlobs(param)
+	for _, key := range param.Items {
+		c.forget(key)
+	}
+	return resp, err
+}
+
+// diskCacheReader is a read that's all in the cache, from the block
+// files that were opened for it
+type diskCacheReader struct {
+	files []*os.File
+	left  uint64
+}
+
+func (r *diskCacheReader) Read(p []byte) (n int, err error) {
+	for len(r.files) != 0 && r.left != 0 {
+		if uint64(len(p)) > r.left {
+			p = p[:r.left]
+		}
+		n, err = r.files[0].Read(p)
+		r.left -= uint64(n)
+		if err == io.EOF {
+			r.files[0].Close()
+			r.files = r.files[1:]
+			err = nil
+		}
+		if n != 0 || err != nil {
+			return
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *diskCacheReader) Close() error {
+	for _, f := range r.files {
+		f.Close()
+	}
+	r.files = nil
+	return nil
+}
+
+// diskCacheFill is a read from the backend of the blocks around what
+// was asked for. Only that is returned, every block that is read
+// whole is kept
+type diskCacheFill struct {
+	c    *DiskCacheBackend
+	key  string
+	etag string
+	body io.ReadCloser
+
+	// the block being read and where it is, nil if we aren't
+	// keeping any
+	block      []byte
+	blockStart uint64
+	// of the body, before what was asked for
+	skip uint64
+	// of what was asked for, 0 if it's to the end
+	left uint64
+	done bool
+	// of the body, 0 if the backend didn't say
+	expected uint64
+	read     uint64
+}
+
+func (f *diskCacheFill) fill(p []byte) (n int, err error) {
+	n, err = f.body.Read(p)
+	f.read += uint64(n)
+
+	if f.block != nil {
+		for data := p[:n]; len(data) != 0; {
+			m := MinInt(len(data), DISK_CACHE_BLOCK-len(f.block))
+			f.block = append(f.block, data[:m]...)
+			data = data[m:]
+			if len(f.block) == DISK_CACHE_BLOCK {
+				f.c.putBlock(f.key, f.etag, f.blockStart/DISK_CACHE_BLOCK, f.block)
+				f.blockStart += DISK_CACHE_BLOCK
+				f.block = f.block[:0]
+			}
+		}
+
+		if err == io.EOF && len(f.block) != 0 && f.expected != 0 && f.read == f.expected {
+			// all the backend had, and short, so the
+			// object ends here
+			f.c.putBlock(f.key, f.etag, f.blockStart/DISK_CACHE_BLOCK, f.block)
+			f.block = nil
+		}
+	}
+	return
+}
+
+func (f *diskCacheFill) Read(p []byte) (n int, err error) {
+	if f.done {
+		return 0, io.EOF
+	}
+
+	for f.skip != 0 {
+		scratch := p
+		if uint64(len(scratch)) > f.skip {
+			scratch = scratch[:f.skip]
+		}
+		n, err = f.fill(scratch)
+		f.skip -= uint64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.left != 0 {
+		if uint64(len(p)) > f.left {
+			p = p[:f.left]
+		}
+		n, err = f.fill(p)
+		f.left -= uint64(n)
+		if f.left == 0 && err == nil {
+			// that's all that was asked for, the rest of the
+			// block is only for the cache
+			f.done = true
+			f.drain()
+		}
+		return
+	}
+
+	return f.fill(p)
+}
+
+// drain reads the rest of the block we are in, if we are keeping it
+func (f *diskCacheFill) drain() {
+	if len(f.block) == 0 {
+		return
+	}
+
+	scratch := make([]byte, DISK_CACHE_BLOCK-len(f.block))
+	for len(f.block) != 0 {
+		_, err := f.fill(scratch[:DISK_CACHE_BLOCK-len(f.block)])
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *diskCacheFill) Close() error {
+	return f.body.Close()
+}
@@ -0,0 +1,254 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// objectsBackend remembers what was read
+type objectsBackend struct {
+	memBackend
+	gets []string
+}
+
+func (b *objectsBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	resp, err := b.memBackend.GetBlob(param)
+	if err == nil {
+		b.mu.Lock()
+		b.gets = append(b.gets, fmt.Sprintf("%v %v-%v", param.Key, param.Start, param.Count))
+		b.mu.Unlock()
+	}
+	return resp, err
+}
+
+type DiskCacheTest struct {
+	dir   string
+	cloud *objectsBackend
+	cache *DiskCacheBackend
+	// 3.5 blocks of SeqReader
+	data []byte
+}
+
+var _ = Suite(&DiskCacheTest{})
+
+func (s *DiskCacheTest) SetUpTest(t *C) {
+	s.dir = t.MkDir()
+	s.cloud = &objectsBackend{}
+	s.data = make([]byte, 3*DISK_CACHE_BLOCK+DISK_CACHE_BLOCK/2)
+	(&SeqReader{}).Read(s.data)
+	s.cloud.set("file", s.data)
+
+	var err error
+	s.cache, err = NewDiskCacheBackend(s.cloud, "bucket", s.dir, 100*DISK_CACHE_BLOCK)
+	t.Assert(err, IsNil)
+}
+
+func (s *DiskCacheTest) TearDownTest(t *C) {
+	if s.cache != nil {
+		s.cache.Close()
+	}
+}
+
+func (s *DiskCacheTest) read(t *C, start uint64, count uint64) []byte {
+	resp, err := getBlobChecked(s.cache, &GetBlobInput{
+		Key:   "file",
+		Start: start,
+		Count: count,
+	})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	end := uint64(len(s.data))
+	if count != 0 && start+count < end {
+		end = start + count
+	}
+	t.Assert(data, DeepEquals, s.data[start:end])
+	return data
+}
+
+func (s *DiskCacheTest) blockFiles() (n int) {
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Base(path) != DISK_CACHE_INDEX &&
+			filepath.Base(path) != DISK_CACHE_LOCK {
+			n++
+		}
+		return nil
+	})
+	return
+}
+
+func (s *DiskCacheTest) TestHit(t *C) {
+	// the blocks around it
+	s.read(t, 100, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, DeepEquals, []string{
+		fmt.Sprintf("file 0-%v", 2*DISK_CACHE_BLOCK),
+	})
+	t.Assert(s.blockFiles(), Equals, 2)
+
+	// anything in them is there
+	s.read(t, 0, 10)
+	s.read(t, 1000, DISK_CACHE_BLOCK)
+	s.read(t, 0, 2*DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 1)
+
+	// the rest isn't, yet
+	s.read(t, 2*DISK_CACHE_BLOCK-10, 20)
+	t.Assert(s.cloud.gets, HasLen, 2)
+	t.Assert(s.cloud.gets[1], Equals,
+		fmt.Sprintf("file %v-%v", DISK_CACHE_BLOCK, 2*DISK_CACHE_BLOCK))
+}
+
+func (s *DiskCacheTest) TestSmallRead(t *C) {
+	// the rest of the block is read after what was asked for
+	s.read(t, 10, 10)
+	t.Assert(s.blockFiles(), Equals, 1)
+	s.read(t, DISK_CACHE_BLOCK/2, 1000)
+	t.Assert(s.cloud.gets, HasLen, 1)
+}
+
+func (s *DiskCacheTest) TestToTheEnd(t *C) {
+	s.read(t, 0, 0)
+	t.Assert(s.blockFiles(), Equals, 4)
+
+	// the short one is the end
+	s.read(t, 0, 0)
+	s.read(t, 3*DISK_CACHE_BLOCK, 0)
+	s.read(t, 3*DISK_CACHE_BLOCK, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 1)
+}
+
+func (s *DiskCacheTest) TestChanged(t *C) {
+	s.read(t, 0, DISK_CACHE_BLOCK)
+	t.Assert(s.blockFiles(), Equals, 1)
+
+	// someone else wrote it
+	s.data = bytes.Repeat([]byte("x"), len(s.data))
+	s.cloud.set("file", s.data)
+	_, err := s.cache.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(s.blockFiles(), Equals, 0)
+
+	s.read(t, 0, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 2)
+}
+
+func (s *DiskCacheTest) TestIfMatch(t *C) {
+	s.read(t, 0, DISK_CACHE_BLOCK)
+
+	// the backend says it's not that one anymore
+	_, err := s.cache.GetBlob(&GetBlobInput{
+		Key:     "file",
+		Count:   DISK_CACHE_BLOCK,
+		IfMatch: PString("\"old\""),
+	})
+	t.Assert(err, Equals, syscall.ESTALE)
+	t.Assert(s.cloud.gets, HasLen, 1)
+
+	resp, err := s.cache.GetBlob(&GetBlobInput{
+		Key:     "file",
+		Count:   DISK_CACHE_BLOCK,
+		IfMatch: PString("1"),
+	})
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Assert(s.cloud.gets, HasLen, 1)
+}
+
+func (s *DiskCacheTest) TestWrite(t *C) {
+	s.read(t, 0, DISK_CACHE_BLOCK)
+
+	// not cached, and what was is gone
+	s.data = []byte("hello")
+	_, err := s.cache.PutBlob(&PutBlobInput{
+		Key:  "file",
+		Body: bytes.NewReader(s.data),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(s.blockFiles(), Equals, 0)
+
+	s.read(t, 0, 0)
+	t.Assert(s.cloud.gets, HasLen, 2)
+}
+
+func (s *DiskCacheTest) TestEvict(t *C) {
+	s.cache.max = 2 * DISK_CACHE_BLOCK
+
+	s.read(t, 0, DISK_CACHE_BLOCK)
+	s.read(t, DISK_CACHE_BLOCK, DISK_CACHE_BLOCK)
+	// used, so it's not the oldest anymore
+	s.read(t, 0, DISK_CACHE_BLOCK)
+	s.read(t, 2*DISK_CACHE_BLOCK, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 3)
+	t.Assert(s.blockFiles(), Equals, 2)
+	t.Assert(s.cache.used, Equals, uint64(2*DISK_CACHE_BLOCK))
+
+	s.read(t, 0, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 3)
+	s.read(t, DISK_CACHE_BLOCK, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 4)
+}
+
+func (s *DiskCacheTest) TestRemount(t *C) {
+	s.read(t, 0, 2*DISK_CACHE_BLOCK)
+	s.cache.save()
+	// read after the index was saved, so it's not in it
+	s.read(t, 2*DISK_CACHE_BLOCK, DISK_CACHE_BLOCK)
+	t.Assert(s.blockFiles(), Equals, 3)
+
+	// like it crashed, without saving the index again
+	s.cache.changed = false
+	s.cache.Close()
+	cache, err := NewDiskCacheBackend(s.cloud, "bucket", s.dir, 100*DISK_CACHE_BLOCK)
+	t.Assert(err, IsNil)
+	s.cache = cache
+	t.Assert(s.blockFiles(), Equals, 2)
+
+	s.read(t, 100, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 2)
+
+	// not for another bucket
+	t.Assert(s.cache.Close(), IsNil)
+	s.cache, err = NewDiskCacheBackend(s.cloud, "other", s.dir, 100*DISK_CACHE_BLOCK)
+	t.Assert(err, IsNil)
+	t.Assert(s.blockFiles(), Equals, 0)
+}
+
+func (s *DiskCacheTest) TestUnmount(t *C) {
+	s.read(t, 0, 2*DISK_CACHE_BLOCK)
+
+	// another mount can't have it and remove our blocks
+	_, err := NewDiskCacheBackend(s.cloud, "bucket", s.dir, 100*DISK_CACHE_BLOCK)
+	t.Assert(err, NotNil)
+	t.Assert(s.blockFiles(), Equals, 2)
+
+	// what was read since the last save is saved at unmount
+	t.Assert(s.cache.Close(), IsNil)
+	s.cache, err = NewDiskCacheBackend(s.cloud, "bucket", s.dir, 100*DISK_CACHE_BLOCK)
+	t.Assert(err, IsNil)
+	t.Assert(s.blockFiles(), Equals, 2)
+	s.read(t, 100, DISK_CACHE_BLOCK)
+	t.Assert(s.cloud.gets, HasLen, 1)
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultErrorMap is what errno we return for an error from the
+// backend. It's keyed by http status, or by the error code the
+// provider sends back, which is looked up first. Errors that aren't
+// in here are passed on as they are and fuse turns them into EIO
+var defaultErrorMap = map[string]syscall.Errno{
+	"400": syscall.EINVAL,
+	"401": syscall.EACCES,
+	"403": syscall.EACCES,
+	"404": syscall.ENOENT,
+	"405": syscall.ENOTSUP,
+	"429": syscall.EAGAIN,
+	"500": syscall.EAGAIN,
+
+	// s3, reading something in GLACIER or DEEP_ARCHIVE that
+	// wasn't restored
+	"InvalidObjectState": syscall.EIO,
+	// s3, the errors of single keys of a multi-delete only have
+	// the code
+	"AccessDenied": syscall.EACCES,
+	"NoSuchKey":    syscall.ENOENT,
+
+	// azure blob
+	"AccountBeingCreated":            syscall.EAGAIN,
+	"AuthenticationFailed":           syscall.EACCES,
+	"AuthorizationFailure":           syscall.EACCES, // from Azurite emulator
+	"BlobAlreadyExists":              syscall.EACCES,
+	"BlobArchived":                   syscall.EINVAL,
+	"BlobBeingRehydrated":            syscall.EAGAIN,
+	"BlobNotFound":                   syscall.ENOENT,
+	"ConditionNotMet":                syscall.EBUSY,
+	"ContainerAlreadyExists":         syscall.EEXIST,
+	"ContainerBeingDeleted":          syscall.EAGAIN,
+	"ContainerDisabled":              syscall.EACCES,
+	"ContainerNotFound":              syscall.ENODEV,
+	"CopyAcrossAccountsNotSupported": syscall.EINVAL,
+	"InternalError":                  syscall.EAGAIN,
+	"InvalidAuthenticationInfo":      syscall.EACCES,
+	"OperationTimedOut":              syscall.EAGAIN,
+	"ResourceNotFound":               syscall.ENOENT,
+	"ServerBusy":                     syscall.EAGAIN,
+	"SourceConditionNotMet":          syscall.EINVAL,
+	"SystemInUse":                    syscall.EAGAIN,
+	"TargetConditionNotMet":          syscall.EINVAL,
+}
+
+// errorMap is the --map-error overrides of one mount, looked up
+// before defaultErrorMap. Backends embed it so each mount maps errors
+// its own way, a nil one is just the defaults
+type errorMap map[string]syscall.Errno
+
+// errnos that can be given to --map-error
+var errnoNames = map[string]syscall.Errno{
+	"EACCES":    syscall.EACCES,
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"EEXIST":    syscall.EEXIST,
+	"EINTR":     syscall.EINTR,
+	"EINVAL":    syscall.EINVAL,
+	"EIO":       syscall.EIO,
+	"ENODEV":    syscall.ENODEV,
+	"ENOENT":    syscall.ENOENT,
+	"ENOSPC":    syscall.ENOSPC,
+	"ENOTSUP":   syscall.ENOTSUP,
+	"EPERM":     syscall.EPERM,
+	"EROFS":     syscall.EROFS,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+func errnoName(errno syscall.Errno) string {
+	for name, e := range errnoNames {
+		if e == errno {
+			return name
+		}
+	}
+	return strconv.Itoa(int(errno))
+}
+
+// ParseErrorMapping parses an override like "503=EIO" or
+// "SlowDown=EAGAIN"
+func ParseErrorMapping(s string) (code string, errno syscall.Errno, err error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return "", 0, fmt.Errorf("expecting <status or code>=<errno>")
+	}
+
+	code = s[:idx]
+	errno, ok := errnoNames[strings.ToUpper(s[idx+1:])]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown errno %v", s[idx+1:])
+	}
+	return
+}
+
+// logMapping logs the errnos a mount ends up with
+func (m errorMap) logMapping() {
+	codes := make([]string, 0, len(defaultErrorMap)+len(m))
+	for code := range defaultErrorMap {
+		codes = append(codes, code)
+	}
+	for code := range m {
+		if _, ok := defaultErrorMap[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		if errno, ok := m[code]; ok {
+			log.Debugf("error %v -> %v (--map-error)", code, errnoName(errno))
+		} else {
+			log.Debugf("error %v -> %v", code, errnoName(defaultErrorMap[code]))
+		}
+	}
+}
+
+// isTransient is if an error from the backend may go away if we try
+// again. Errors we didn't map are things like connection resets
+func isTransient(err error) bool {
+	switch err {
+	case syscall.EAGAIN, syscall.EIO, syscall.ETIMEDOUT, syscall.EINTR:
+		return true
+	}
+	_, errno := err.(syscall.Errno)
+	return !errno
+}
+
+// timedOut is for errors from --http-timeout and --op-timeout, as the
+// http client returns them
+func timedOut(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// mapErrorCode returns the errno for a provider error code, or nil if
+// we don't map it
+func (m errorMap) mapErrorCode(code string) error {
+	if errno, ok := m[code]; ok {
+		return errno
+	}
+	if errno, ok := defaultErrorMap[code]; ok {
+		return errno
+	}
+	return nil
+}
+
+func (m errorMap) mapHttpError(status int) error {
+	return m.mapErrorCode(strconv.Itoa(status))
+}
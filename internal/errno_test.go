@@ -0,0 +1,149 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+type ErrnoTest struct {
+}
+
+var _ = Suite(&ErrnoTest{})
+
+func (s *ErrnoTest) TestHttpStatus(t *C) {
+	expected := map[int]error{
+		400: fuse.EINVAL,
+		401: syscall.EACCES,
+		403: syscall.EACCES,
+		404: fuse.ENOENT,
+		405: syscall.ENOTSUP,
+		429: syscall.EAGAIN,
+		500: syscall.EAGAIN,
+	}
+
+	for status := 100; status < 600; status++ {
+		t.Check(errorMap(nil).mapHttpError(status), Equals, expected[status],
+			Commentf("status %v", status))
+	}
+}
+
+func (s *ErrnoTest) TestErrorCodes(t *C) {
+	for code, errno := range defaultErrorMap {
+		t.Assert(errorMap(nil).mapErrorCode(code), Equals, errno)
+	}
+	t.Assert(errorMap(nil).mapErrorCode("BlobNotFound"), Equals, fuse.ENOENT)
+	t.Assert(errorMap(nil).mapErrorCode("ContainerNotFound"), Equals, syscall.ENODEV)
+	t.Assert(errorMap(nil).mapErrorCode("ConditionNotMet"), Equals, syscall.EBUSY)
+	t.Assert(errorMap(nil).mapErrorCode("InvalidObjectState"), Equals, syscall.EIO)
+	t.Assert(errorMap(nil).mapErrorCode("SlowDown"), IsNil)
+
+	// every default can be written as an override
+	for _, errno := range defaultErrorMap {
+		_, ok := errnoNames[errnoName(errno)]
+		t.Assert(ok, Equals, true)
+	}
+}
+
+func (s *ErrnoTest) TestParseErrorMapping(t *C) {
+	code, errno, err := ParseErrorMapping("503=EIO")
+	t.Assert(err, IsNil)
+	t.Assert(code, Equals, "503")
+	t.Assert(errno, Equals, syscall.EIO)
+
+	code, errno, err = ParseErrorMapping("SlowDown=eagain")
+	t.Assert(err, IsNil)
+	t.Assert(code, Equals, "SlowDown")
+	t.Assert(errno, Equals, syscall.EAGAIN)
+
+	for _, bad := range []string{"", "503", "=EIO", "503=", "503=EWHAT"} {
+		_, _, err = ParseErrorMapping(bad)
+		t.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
+
+func (s *ErrnoTest) TestOverrides(t *C) {
+	throttled := awserr.NewRequestFailure(
+		awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id")
+	// not mapped, so fuse makes it EIO
+	var defaults errorMap
+	t.Assert(defaults.mapAwsError(throttled), Equals, throttled)
+
+	m := errorMap{
+		"SlowDown": syscall.EAGAIN,
+		"500":      syscall.EIO,
+	}
+	t.Assert(m.mapAwsError(throttled), Equals, syscall.EAGAIN)
+	t.Assert(m.mapHttpError(500), Equals, syscall.EIO)
+	// the rest is untouched
+	t.Assert(m.mapHttpError(404), Equals, fuse.ENOENT)
+	t.Assert(defaultErrorMap["500"], Equals, syscall.EAGAIN)
+
+	// the code wins over the status
+	other := errorMap{
+		"503":      syscall.EIO,
+		"SlowDown": syscall.ETIMEDOUT,
+	}
+	t.Assert(other.mapAwsError(throttled), Equals, syscall.ETIMEDOUT)
+
+	// and a mount doesn't see the overrides of another
+	t.Assert(m.mapAwsError(throttled), Equals, syscall.EAGAIN)
+	t.Assert(defaults.mapHttpError(500), Equals, syscall.EAGAIN)
+}
+
+func (s *ErrnoTest) TestTimeout(t *C) {
+	var forever opTimeout
+	ctx, cancel := forever.requestContext(nil)
+	_, ok := ctx.Deadline()
+	t.Assert(ok, Equals, false)
+	cancel()
+
+	ctx, cancel = opTimeout(10 * time.Millisecond).requestContext(nil)
+	defer cancel()
+	<-ctx.Done()
+	t.Assert(ctx.Err(), Equals, context.DeadlineExceeded)
+
+	// what the sdk returns when the context expires, or the
+	// http client times out
+	t.Assert(errorMap(nil).mapAwsError(awserr.New("RequestCanceled", "request context canceled",
+		ctx.Err())), Equals, syscall.ETIMEDOUT)
+	t.Assert(errorMap(nil).mapAwsError(awserr.New("RequestError", "send request failed",
+		&url.Error{Op: "Get", URL: "http://localhost", Err: ctx.Err()})), Equals, syscall.ETIMEDOUT)
+	// but not when it's interrupted
+	t.Assert(errorMap(nil).mapAwsError(awserr.New("RequestCanceled", "request context canceled",
+		context.Canceled)), Not(Equals), syscall.ETIMEDOUT)
+}
+
+func (s *ErrnoTest) TestDeleteBlobsError(t *C) {
+	err := &DeleteBlobsError{Failed: map[string]error{
+		"c": syscall.EACCES,
+		"b": syscall.ENOSPC,
+		"a": fmt.Errorf("not an errno"),
+	}}
+	t.Assert(err.Errno(), Equals, syscall.ENOSPC)
+	t.Assert(err.Error(), Equals,
+		"unable to delete 3 keys: a=not an errno b=no space left on device c=permission denied")
+
+	err = &DeleteBlobsError{Failed: map[string]error{"a": fmt.Errorf("?")}}
+	t.Assert(err.Errno(), Equals, syscall.EIO)
+}
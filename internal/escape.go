@@ -0,0 +1,130 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Object keys can have things in them that a file name can't, or
+// that tools choke on: control characters like newlines, backslashes
+// and . or .. as a component. The kernel can't look up an entry like
+// that, so readdir of a dir that has one fails. They are skipped,
+// unless --escape-invalid-names lists them with the offending bytes
+// %-escaped. The inode remembers the part of the key it came from so
+// that it can be read and removed, '%' itself isn't escaped so a name
+// can't be unescaped without that.
+
+func invalidNameByte(c byte) bool {
+	return c < 0x20 || c == 0x7f || c == '\\'
+}
+
+// invalidName is whether a component of a key can't be a file name
+// as it is
+func invalidName(name string) bool {
+	if name == "." || name == ".." {
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if invalidNameByte(name[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeName makes a component of a key a valid file name
+func escapeName(name string) string {
+	if name == "." || name == ".." {
+		return strings.Repeat("%2E", len(name))
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if invalidNameByte(c) {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// listedName is the name of the child that a listing of parent found
+// as raw, the part of its key under parent. ok is false if it's to be
+// skipped. An escaped name never hides a key that has that name, the
+// key takes the inode over. Needs parent.mu
+func (parent *Inode) listedName(raw string) (name string, ok bool) {
+	fs := parent.fs
+
+	if !invalidName(raw) {
+		child := parent.findChildUnlocked(raw)
+		if child != nil && child.rawName != nil {
+			log.Warnf("%v: %q is also what %q is escaped to, hiding the latter",
+				*parent.FullName(), raw, *child.rawName)
+			child.rawName = nil
+		}
+		return raw, true
+	}
+
+	if !fs.flags.EscapeInvalidNames {
+		if _, warned := fs.invalidNames.LoadOrStore(parent.getChildName(raw), true); !warned {
+			log.Warnf("skipping %q in %v: not a valid file name, see --escape-invalid-names",
+				raw, *parent.FullName())
+		}
+		return "", false
+	}
+
+	name = escapeName(raw)
+	child := parent.findChildUnlocked(name)
+	if child != nil && (child.rawName == nil || *child.rawName != raw) {
+		if _, warned := fs.invalidNames.LoadOrStore(parent.getChildName(raw), true); !warned {
+			log.Warnf("%v: %q is escaped to %q which is taken, skipping it",
+				*parent.FullName(), raw, name)
+		}
+		return "", false
+	}
+	return name, true
+}
+
+// setRawName notes that the key of inode has raw where its name is,
+// see listedName
+func (inode *Inode) setRawName(raw string) {
+	if raw != *inode.Name {
+		inode.rawName = &raw
+	}
+}
+
+// keyName is the part of the key of inode under its parent
+func (inode *Inode) keyName() string {
+	if inode.rawName != nil {
+		return *inode.rawName
+	}
+	return *inode.Name
+}
+
+// rawChildName is keyName of the child called name, which may not be
+// cached
+func (parent *Inode) rawChildName(name string) string {
+	parent.mu.RLock()
+	defer parent.mu.RUnlock()
+
+	if inode := parent.findChildUnlocked(name); inode != nil {
+		return inode.keyName()
+	}
+	return name
+}
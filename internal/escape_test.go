@@ -0,0 +1,116 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// escapeBackend remembers what was looked up
+type escapeBackend struct {
+	memBackend
+	heads []string
+}
+
+func (b *escapeBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.mu.Lock()
+	b.heads = append(b.heads, param.Key)
+	b.mu.Unlock()
+	return b.memBackend.HeadBlob(param)
+}
+
+type EscapeTest struct {
+}
+
+var _ = Suite(&EscapeTest{})
+
+func newEscapeFs(escape bool, keys ...string) (fs *Goofys, root *Inode) {
+	cloud := &escapeBackend{}
+	cloud.add(keys...)
+	fs = newTestFs(cloud, &FlagStorage{Cheap: true, EscapeInvalidNames: escape})
+	return fs, fs.testRoot()
+}
+
+func listNames(t *C, dir *Inode) (names []string) {
+	dh := NewDirHandle(dir)
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	for i := 0; ; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		if en == nil {
+			return
+		}
+		if en.Name != "." && en.Name != ".." {
+			names = append(names, en.Name)
+		}
+	}
+}
+
+func (s *EscapeTest) TestEscapeName(t *C) {
+	t.Assert(invalidName("file.txt"), Equals, false)
+	t.Assert(invalidName("100%"), Equals, false)
+	t.Assert(invalidName("..."), Equals, false)
+	t.Assert(invalidName("new\nline"), Equals, true)
+	t.Assert(invalidName("."), Equals, true)
+
+	t.Assert(escapeName("new\nline"), Equals, "new%0Aline")
+	t.Assert(escapeName("back\\slash"), Equals, "back%5Cslash")
+	t.Assert(escapeName("tab\tdel\x7f"), Equals, "tab%09del%7F")
+	t.Assert(escapeName("."), Equals, "%2E")
+	t.Assert(escapeName(".."), Equals, "%2E%2E")
+}
+
+func (s *EscapeTest) TestSkipped(t *C) {
+	_, root := newEscapeFs(false, "file", "new\nline", "./dot", "back\\slash")
+	t.Assert(listNames(t, root), DeepEquals, []string{"file"})
+}
+
+func (s *EscapeTest) TestEscaped(t *C) {
+	fs, root := newEscapeFs(true, "file", "new\nline", "./dot", "back\\slash")
+	t.Assert(listNames(t, root), DeepEquals,
+		[]string{"%2E", "back%5Cslash", "file", "new%0Aline"})
+
+	lookup := fuseops.LookUpInodeOp{
+		Parent: root.Id,
+		Name:   "new%0Aline",
+	}
+	err := fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	t.Assert(root.dir.cloud.(*escapeBackend).heads, DeepEquals, []string{"new\nline"})
+
+	inode := fs.getInodeOrDie(lookup.Entry.Child)
+	t.Assert(*inode.Name, Equals, "new%0Aline")
+	_, key := inode.cloud()
+	t.Assert(key, Equals, "new\nline")
+
+	dot := root.findChild("%2E")
+	t.Assert(dot, NotNil)
+	_, key = dot.cloud()
+	t.Assert(key, Equals, ".")
+}
+
+func (s *EscapeTest) TestCollision(t *C) {
+	// the key that really has the name wins
+	_, root := newEscapeFs(true, "new\nline", "new%0Aline")
+	t.Assert(listNames(t, root), DeepEquals, []string{"new%0Aline"})
+
+	_, key := root.findChild("new%0Aline").cloud()
+	t.Assert(key, Equals, "new%0Aline")
+}
@@ -0,0 +1,280 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EVENT_CREATE   EventType = "create"
+	EVENT_WRITE    EventType = "write"
+	EVENT_RENAME   EventType = "rename"
+	EVENT_UNLINK   EventType = "unlink"
+	EVENT_MKDIR    EventType = "mkdir"
+	EVENT_RMDIR    EventType = "rmdir"
+	EVENT_OVERFLOW EventType = "overflow"
+)
+
+// Event describes a mutation that the backend has acknowledged. Keys
+// are full backend keys, including the mount prefix.
+type Event struct {
+	Type    EventType `json:"type"`
+	Key     string    `json:"key,omitempty"`
+	OldKey  string    `json:"old_key,omitempty"`
+	Size    uint64    `json:"size"`
+	ETag    string    `json:"etag,omitempty"`
+	Time    time.Time `json:"time"`
+	Dropped uint64    `json:"dropped,omitempty"`
+}
+
+const EVENT_BUFFER_SIZE = 4096
+
+type EventSubscriber struct {
+	C chan Event
+
+	// GUARDED_BY(EventStream.mu)
+	dropped uint64
+}
+
+// EventStream fans out events to subscribers. Events for the same
+// key are delivered in the order their requests were sent to the
+// backend: a ticket is reserved before the request and the event
+// waits for the earlier tickets on its keys to be published or
+// cancelled. Events for different keys are not held back by each
+// other. A slow subscriber never blocks the file system: once its
+// buffer is full events are dropped and an overflow event with the
+// number of dropped events is delivered when there's room again.
+type EventStream struct {
+	mu          sync.Mutex
+	subscribers map[*EventSubscriber]bool
+	// tickets that aren't delivered yet, oldest first
+	pending map[string][]*eventTicket
+	closed  bool
+}
+
+// eventTicket is the place of an event in the order of the keys it's
+// for
+type eventTicket struct {
+	stream *EventStream
+	keys   []string
+
+	// GUARDED_BY(stream.mu)
+	done  bool
+	event *Event
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{
+		subscribers: make(map[*EventSubscriber]bool),
+		pending:     make(map[string][]*eventTicket),
+	}
+}
+
+func (s *EventStream) Subscribe(bufSize int) *EventSubscriber {
+	sub := &EventSubscriber{
+		C: make(chan Event, bufSize),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		close(sub.C)
+	} else {
+		s.subscribers[sub] = true
+	}
+	return sub
+}
+
+func (s *EventStream) Unsubscribe(sub *EventSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// Close closes the channels of all subscribers, on unmount
+func (s *EventStream) Close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// Publish sends e once the events reserved before it for the same
+// keys are
+func (s *EventStream) Publish(e Event) {
+	s.reserve(e.keys()...).publish(e)
+}
+
+func (e *Event) keys() (keys []string) {
+	if e.Key != "" {
+		keys = append(keys, e.Key)
+	}
+	if e.OldKey != "" {
+		keys = append(keys, e.OldKey)
+	}
+	return
+}
+
+// reserve takes the next place for keys, the ticket has to be
+// published or cancelled or nothing after it for those keys is
+// delivered
+func (s *EventStream) reserve(keys ...string) *eventTicket {
+	if s == nil {
+		return nil
+	}
+
+	t := &eventTicket{stream: s, keys: keys}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		s.pending[key] = append(s.pending[key], t)
+	}
+	return t
+}
+
+// publish delivers e in the place of t, its keys are the ones t was
+// reserved for
+func (t *eventTicket) publish(e Event) {
+	if t == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	t.finish(&e)
+}
+
+// cancel gives up the place of t, after publish it does nothing so it
+// can be deferred
+func (t *eventTicket) cancel() {
+	if t == nil {
+		return
+	}
+	t.finish(nil)
+}
+
+func (t *eventTicket) finish(e *Event) {
+	s := t.stream
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.done {
+		return
+	}
+	t.done = true
+	t.event = e
+
+	if len(t.keys) == 0 {
+		// not in any order
+		if e != nil {
+			s.send(*e)
+		}
+		return
+	}
+
+	// delivering a ticket may let the next ones on its keys go
+	keys := append([]string(nil), t.keys...)
+	for len(keys) != 0 {
+		key := keys[len(keys)-1]
+		keys = keys[:len(keys)-1]
+
+		q := s.pending[key]
+		if len(q) == 0 || !q[0].done {
+			continue
+		}
+		head := q[0]
+		ready := true
+		for _, k := range head.keys {
+			if s.pending[k][0] != head {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			// it's still waiting on another key, and gets
+			// looked at again when that one moves
+			continue
+		}
+
+		for _, k := range head.keys {
+			if len(s.pending[k]) == 1 {
+				delete(s.pending, k)
+			} else {
+				s.pending[k] = s.pending[k][1:]
+			}
+			keys = append(keys, k)
+		}
+		if head.event != nil {
+			s.send(*head.event)
+		}
+	}
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *EventStream) send(e Event) {
+	for sub, _ := range s.subscribers {
+		if sub.dropped != 0 {
+			select {
+			case sub.C <- Event{
+				Type:    EVENT_OVERFLOW,
+				Time:    e.Time,
+				Dropped: sub.dropped,
+			}:
+				sub.dropped = 0
+			default:
+				sub.dropped++
+				continue
+			}
+		}
+
+		select {
+		case sub.C <- e:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// SubscribeEvents delivers what this mount changed in the bucket to
+// the returned subscriber until UnsubscribeEvents, or until unmount
+// closes its channel. See EventStream for the order
+func (fs *Goofys) SubscribeEvents(bufSize int) *EventSubscriber {
+	return fs.events.Subscribe(bufSize)
+}
+
+func (fs *Goofys) UnsubscribeEvents(sub *EventSubscriber) {
+	fs.events.Unsubscribe(sub)
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type EventTest struct {
+}
+
+var _ = Suite(&EventTest{})
+
+func (s *EventTest) TestOrdering(t *C) {
+	stream := NewEventStream()
+	sub := stream.Subscribe(10)
+
+	for i := 0; i < 10; i++ {
+		stream.Publish(Event{Type: EVENT_WRITE, Key: "file", Size: uint64(i)})
+	}
+
+	for i := 0; i < 10; i++ {
+		e := <-sub.C
+		t.Assert(e.Type, Equals, EVENT_WRITE)
+		t.Assert(e.Size, Equals, uint64(i))
+		t.Assert(e.Time.IsZero(), Equals, false)
+	}
+
+	stream.Unsubscribe(sub)
+	_, ok := <-sub.C
+	t.Assert(ok, Equals, false)
+
+	// no subscribers left, shouldn't block
+	stream.Publish(Event{Type: EVENT_UNLINK, Key: "file"})
+}
+
+func (s *EventTest) TestOrderingPerKey(t *C) {
+	stream := NewEventStream()
+	sub := stream.Subscribe(10)
+
+	first := stream.reserve("a")
+	second := stream.reserve("a")
+	other := stream.reserve("b")
+
+	// done first, but waits for the one sent before it
+	second.publish(Event{Type: EVENT_UNLINK, Key: "a"})
+	other.publish(Event{Type: EVENT_CREATE, Key: "b"})
+	t.Assert((<-sub.C).Key, Equals, "b")
+	t.Assert(len(sub.C), Equals, 0)
+
+	first.publish(Event{Type: EVENT_CREATE, Key: "a"})
+	t.Assert((<-sub.C).Type, Equals, EVENT_CREATE)
+	t.Assert((<-sub.C).Type, Equals, EVENT_UNLINK)
+
+	// a failed request doesn't hold up the rest
+	failed := stream.reserve("a")
+	next := stream.reserve("a")
+	next.publish(Event{Type: EVENT_CREATE, Key: "a"})
+	t.Assert(len(sub.C), Equals, 0)
+	failed.cancel()
+	t.Assert((<-sub.C).Type, Equals, EVENT_CREATE)
+
+	// a rename waits on both its keys, and what's after it on
+	// either waits for it
+	before := stream.reserve("a")
+	rename := stream.reserve("b", "a")
+	after := stream.reserve("b")
+	after.publish(Event{Type: EVENT_UNLINK, Key: "b"})
+	rename.publish(Event{Type: EVENT_RENAME, Key: "b", OldKey: "a"})
+	t.Assert(len(sub.C), Equals, 0)
+	before.publish(Event{Type: EVENT_WRITE, Key: "a"})
+	t.Assert((<-sub.C).Type, Equals, EVENT_WRITE)
+	t.Assert((<-sub.C).Type, Equals, EVENT_RENAME)
+	t.Assert((<-sub.C).Type, Equals, EVENT_UNLINK)
+
+	// published tickets can be cancelled, that's a no-op
+	before.cancel()
+	t.Assert(len(stream.pending), Equals, 0)
+	t.Assert(len(sub.C), Equals, 0)
+}
+
+func (s *EventTest) TestClose(t *C) {
+	stream := NewEventStream()
+	sub := stream.Subscribe(10)
+
+	stream.Close()
+	_, ok := <-sub.C
+	t.Assert(ok, Equals, false)
+
+	// unmounted already
+	sub = stream.Subscribe(10)
+	_, ok = <-sub.C
+	t.Assert(ok, Equals, false)
+	stream.Unsubscribe(sub)
+
+	stream.Publish(Event{Type: EVENT_CREATE, Key: "file"})
+}
+
+func (s *EventTest) TestOverflow(t *C) {
+	stream := NewEventStream()
+	sub := stream.Subscribe(2)
+
+	for i := 0; i < 5; i++ {
+		stream.Publish(Event{Type: EVENT_CREATE, Key: fmt.Sprintf("file%v", i)})
+	}
+
+	t.Assert((<-sub.C).Key, Equals, "file0")
+	t.Assert((<-sub.C).Key, Equals, "file1")
+
+	stream.Publish(Event{Type: EVENT_CREATE, Key: "file5"})
+	e := <-sub.C
+	t.Assert(e.Type, Equals, EVENT_OVERFLOW)
+	t.Assert(e.Dropped, Equals, uint64(3))
+	t.Assert((<-sub.C).Key, Equals, "file5")
+
+	// a nil stream is a no-op
+	var nilStream *EventStream
+	nilStream.Publish(Event{Type: EVENT_CREATE})
+}
+
+func (s *EventTest) TestControlSocket(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-control")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFs(&memBackend{}, nil)
+	server, err := fs.ListenControl(filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	defer server.Close()
+
+	// whatever the umask, only we can connect
+	fi, err := os.Stat(filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	t.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("events\n"))
+	t.Assert(err, IsNil)
+
+	// wait for the server to subscribe
+	for i := 0; i < 100; i++ {
+		fs.events.mu.Lock()
+		n := len(fs.events.subscribers)
+		fs.events.mu.Unlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fs.events.Publish(Event{Type: EVENT_MKDIR, Key: "dir"})
+	fs.events.Publish(Event{Type: EVENT_RENAME, Key: "dir2", OldKey: "dir"})
+
+	in := bufio.NewScanner(conn)
+	var e Event
+
+	t.Assert(in.Scan(), Equals, true)
+	t.Assert(json.Unmarshal(in.Bytes(), &e), IsNil)
+	t.Assert(e.Type, Equals, EVENT_MKDIR)
+	t.Assert(e.Key, Equals, "dir")
+
+	t.Assert(in.Scan(), Equals, true)
+	t.Assert(json.Unmarshal(in.Bytes(), &e), IsNil)
+	t.Assert(e.Type, Equals, EVENT_RENAME)
+	t.Assert(e.Key, Equals, "dir2")
+	t.Assert(e.OldKey, Equals, "dir")
+}
+
+func (s *EventTest) TestControlUnknownCommand(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-control")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFs(&memBackend{}, nil)
+	server, err := fs.ListenControl(filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	defer server.Close()
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("bogus\n"))
+	t.Assert(err, IsNil)
+
+	var reply controlReply
+	t.Assert(json.NewDecoder(conn).Decode(&reply), IsNil)
+	t.Assert(reply.Error, Equals, "unknown command: bogus")
+}
+
+func (s *EventTest) TestControlDestroy(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-control")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fs := newTestFs(&memBackend{}, nil)
+	_, err = fs.ListenControl(filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "sock"))
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("events\n"))
+	t.Assert(err, IsNil)
+
+	sub := fs.SubscribeEvents(1)
+	for i := 0; i < 100; i++ {
+		fs.events.mu.Lock()
+		n := len(fs.events.subscribers)
+		fs.events.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fs.Destroy()
+
+	// the stream ends, for embedders too
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	t.Assert(err, Equals, io.EOF)
+	_, ok := <-sub.C
+	t.Assert(ok, Equals, false)
+
+	// and nothing is listening anymore
+	_, err = os.Stat(filepath.Join(dir, "sock"))
+	t.Assert(os.IsNotExist(err), Equals, true)
+	_, err = net.Dial("unix", filepath.Join(dir, "sock"))
+	t.Assert(err, NotNil)
+}
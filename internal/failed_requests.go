@@ -0,0 +1,123 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// getxattr of this on the root of the mount returns the last
+// FAILED_REQUESTS_KEEP failed requests, as a json array
+const XATTR_LAST_ERRORS = "user.goofys.last-errors"
+const FAILED_REQUESTS_KEEP = 20
+
+// FailedRequest is a request the backend answered with an error, with
+// what its support wants to know about it
+type FailedRequest struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+	// the one we made up and sent, not every backend has it
+	ClientRequestId string `json:"client_request_id,omitempty"`
+	RequestId       string `json:"request_id,omitempty"`
+}
+
+// FailedRequests keeps the last few failed requests. Errors are
+// errnos by the time they get out of a backend, so it's filled from
+// down where the http responses are. Like backendMetrics it's one
+// for the whole process
+type FailedRequests struct {
+	mu   sync.Mutex
+	reqs []FailedRequest
+	// where the next one goes once reqs is full
+	next int
+}
+
+var failedRequests = &FailedRequests{}
+
+func (f *FailedRequests) add(r FailedRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, seen := range f.reqs {
+		// some clients run the response inspector twice
+		if r.RequestId != "" && seen.RequestId == r.RequestId {
+			return
+		}
+	}
+
+	if len(f.reqs) < FAILED_REQUESTS_KEEP {
+		f.reqs = append(f.reqs, r)
+		return
+	}
+	f.reqs[f.next] = r
+	f.next = (f.next + 1) % FAILED_REQUESTS_KEEP
+}
+
+// JSON is the kept requests, oldest first
+func (f *FailedRequests) JSON() []byte {
+	reqs := []FailedRequest{}
+	if f != nil {
+		f.mu.Lock()
+		reqs = append(reqs, f.reqs[f.next:]...)
+		reqs = append(reqs, f.reqs[:f.next]...)
+		f.mu.Unlock()
+	}
+
+	data, _ := json.Marshal(reqs)
+	return data
+}
+
+// noteFailedRequest keeps resp if it's an error, and logs it if it's
+// one on the server side, or throttling. Not found and failed
+// conditions are how some lookups and writes normally end, those are
+// left out
+func noteFailedRequest(logger *LogHandle, backend string, op string,
+	resp *http.Response, clientRequestId string, requestId string) {
+
+	if resp == nil || resp.StatusCode < 400 {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed,
+		http.StatusRequestedRangeNotSatisfiable:
+		return
+	}
+
+	r := FailedRequest{
+		Time:            time.Now(),
+		Backend:         backend,
+		Op:              op,
+		Status:          resp.StatusCode,
+		ClientRequestId: clientRequestId,
+		RequestId:       requestId,
+	}
+	if resp.Request != nil {
+		r.Path = resp.Request.URL.Path
+	}
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		logger.Warnf("%v %v failed with %v, client request id %q, request id %q",
+			r.Op, r.Path, r.Status, r.ClientRequestId, r.RequestId)
+	}
+	failedRequests.add(r)
+}
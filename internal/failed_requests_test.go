@@ -0,0 +1,105 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type FailedRequestsTest struct {
+	saved *FailedRequests
+}
+
+var _ = Suite(&FailedRequestsTest{})
+
+func (s *FailedRequestsTest) SetUpTest(t *C) {
+	s.saved = failedRequests
+	failedRequests = &FailedRequests{}
+}
+
+func (s *FailedRequestsTest) TearDownTest(t *C) {
+	failedRequests = s.saved
+}
+
+func failedResponse(status int, path string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Request:    &http.Request{URL: &url.URL{Path: path}},
+	}
+}
+
+func (s *FailedRequestsTest) parse(t *C, data []byte) (reqs []FailedRequest) {
+	t.Assert(json.Unmarshal(data, &reqs), IsNil)
+	return
+}
+
+func (s *FailedRequestsTest) TestNote(t *C) {
+	noteFailedRequest(s3Log, "s3", "GetObject", failedResponse(404, "/bucket/a"), "", "404")
+	noteFailedRequest(s3Log, "s3", "GetObject", failedResponse(200, "/bucket/a"), "", "200")
+	noteFailedRequest(s3Log, "adl2", "PATCH flush", failedResponse(503, "/fs/b"), "c1", "r1")
+	// the same response again
+	noteFailedRequest(s3Log, "adl2", "PATCH flush", failedResponse(503, "/fs/b"), "c1", "r1")
+
+	reqs := s.parse(t, failedRequests.JSON())
+	t.Assert(reqs, HasLen, 1)
+	t.Assert(reqs[0].Backend, Equals, "adl2")
+	t.Assert(reqs[0].Op, Equals, "PATCH flush")
+	t.Assert(reqs[0].Path, Equals, "/fs/b")
+	t.Assert(reqs[0].Status, Equals, 503)
+	t.Assert(reqs[0].ClientRequestId, Equals, "c1")
+	t.Assert(reqs[0].RequestId, Equals, "r1")
+}
+
+func (s *FailedRequestsTest) TestKeepsLast(t *C) {
+	t.Assert(string(failedRequests.JSON()), Equals, "[]")
+
+	for i := 0; i < FAILED_REQUESTS_KEEP+5; i++ {
+		noteFailedRequest(s3Log, "s3", "PutObject", failedResponse(500, "/bucket/a"),
+			"", fmt.Sprintf("r%v", i))
+	}
+
+	reqs := s.parse(t, failedRequests.JSON())
+	t.Assert(reqs, HasLen, FAILED_REQUESTS_KEEP)
+	// oldest first
+	t.Assert(reqs[0].RequestId, Equals, "r5")
+	t.Assert(reqs[FAILED_REQUESTS_KEEP-1].RequestId, Equals,
+		fmt.Sprintf("r%v", FAILED_REQUESTS_KEEP+4))
+}
+
+func (s *FailedRequestsTest) TestXattr(t *C) {
+	noteFailedRequest(s3Log, "s3", "PutObject", failedResponse(403, "/bucket/a"), "", "r1")
+
+	inode := newTestInode(&slowBackend{})
+	inode.fs.failedRequests = failedRequests
+
+	// only on the root
+	_, err := inode.GetXattr(XATTR_LAST_ERRORS)
+	t.Assert(err, Equals, ENOATTR)
+
+	root := inode.Parent
+	root.Id = fuseops.RootInodeID
+	data, err := root.GetXattr(XATTR_LAST_ERRORS)
+	t.Assert(err, IsNil)
+	reqs := s.parse(t, data)
+	t.Assert(reqs, HasLen, 1)
+	t.Assert(reqs[0].Status, Equals, 403)
+}
@@ -15,11 +15,17 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	. "github.com/AITRICS/goofys/api/common"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -33,26 +39,80 @@ type FileHandle struct {
 	mpuName   *string
 	dirty     bool
 	writeInit sync.Once
-	mpuWG     sync.WaitGroup
+	// waits for MultipartBlobBegin and all the parts
+	mpuWG sync.WaitGroup
+	// waits for MultipartBlobBegin only
+	mpuBeginWG sync.WaitGroup
+	// parts being uploaded in the background, see
+	// --max-parts-in-flight. Made by the first one
+	partsInFlight *Ticket
+
+	// first error from the background uploads, picked up by the
+	// next write or flush
+	mpuErrMu sync.Mutex
+	mpuErr   error
+	// parts that failed, or weren't tried because another one
+	// did, kept for the flush to add again. Also under mpuErrMu
+	pendingParts map[uint32]*pendingPart
+
+	// flushes that returned EINTR but are still going, see
+	// --abandon-interrupted-flush
+	flushWG        sync.WaitGroup
+	flushAbandoned int32
+
+	// writes, syncs and flushes, so a write can let go of mu while
+	// it waits for --max-parts-in-flight. Taken before mu
+	writeMu sync.Mutex
 
 	mu              sync.Mutex
 	mpuId           *MultipartBlobCommitInput
 	nextWriteOffset int64
 	lastPartId      uint32
+	// where the object ended when we started appending to it, 0
+	// if we are writing all of it. See canAppend
+	appendOffset int64
+	// how big the file is expected to be, 0 if we don't know
+	sizeHint uint64
 
 	poolHandle *BufferPool
 	buf        *MBuf
 
 	lastWriteError error
+	// trace id of the WriteFile, FlushFile or SyncFile that's
+	// writing, the requests it starts carry it. Protected by mu
+	writeTrace string
+
+	// the last flush failed but left the upload and pendingParts
+	// for the next one to pick up, see --flush-retries
+	resumeErr     error
+	flushRetries  int
+	flushFailedAt time.Time
 
 	// read
 	reader        io.ReadCloser
 	readBufOffset int64
+	// etag of the object we have been reading. Our requests ask
+	// for it so we don't piece together two versions of the file
+	readETag *string
+	// if the kernel can keep what it cached of the file, see
+	// Inode.OpenFile
+	keepPageCache bool
+
+	// cancelled when a read is interrupted, the requests of the
+	// stream and readahead use it. A new one is made for the next
+	// read
+	readMu     sync.Mutex
+	readCtx    context.Context
+	readCancel context.CancelFunc
+	// trace id of the ReadFile that's reading, the requests it
+	// starts carry it. Protected by mu
+	readTrace string
 
 	// parallel read
 	buffers           []*S3ReadBuffer
 	existingReadahead int
 	seqReadAmount     uint64
+	seqReads          int    // reads in a row that continued the last one
 	numOOORead        uint64 // number of out of order read
 	// User space PID. All threads created by a process will have the same TGID,
 	// but different PIDs[1].
@@ -62,9 +122,81 @@ type FileHandle struct {
 	Tgid *int32
 }
 
-const MAX_READAHEAD = uint32(400 * 1024 * 1024)
+// FileInodeData is what an inode needs once the file is opened,
+// truncated or has its storage class set. Most files of a big
+// listing never are, so it's left out of the Inode until then
+type FileInodeData struct {
+	// from a truncate, picked up by the next write from the start
+	sizeHint uint64
+	// truncated to 0 while open, the next flush writes an empty
+	// object even if nothing was written, see Inode.truncate
+	truncated bool
+	// grown to by a truncate while open, the next flush pads the
+	// file with zeros up to it, see Inode.extend
+	extendTo uint64
+	// utimens set the mtime metadata while the file was open, and
+	// no upload has taken it yet. See flushMtime
+	mtimePending bool
+	// a read found that the object changed under it, see
+	// FileHandle.objectChanged
+	pageCacheStale bool
+	// the etag when the file was last opened, the kernel may have
+	// pages of that version cached
+	openedETag string
+	// what user.s3.storage-class asked for, every flush from now
+	// on uses it
+	wantStorageClass string
+	// blocks of coalesced small reads, most recently used last
+	readBlocks []*readBlock
+
+	// handed out to every flush of a handle writing this file, so
+	// we know which was last. Updated atomically
+	flushSeq uint64
+	// serializes flushes, see FileHandle.FlushFile
+	flushMu sync.Mutex
+	// the flushSeq of what we last committed. Protected by flushMu
+	flushedSeq uint64
+}
+
+// fileData returns inode.file, which it allocates the first time.
+// Once there it stays, so it can be used without the lock after
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fileData() *FileInodeData {
+	if inode.file == nil {
+		inode.file = &FileInodeData{}
+	}
+	return inode.file
+}
+
+// how far ahead of sequential reads we read, unless --read-ahead-mb
+// says otherwise. What's read ahead comes from the global buffer pool,
+// if that's used up we read ahead less
+const DEFAULT_READ_AHEAD = 400 * 1024 * 1024
 const READAHEAD_CHUNK = uint32(20 * 1024 * 1024)
 
+// we start reading ahead after this many sequential reads, and stop
+// for good once we were wrong about it this many times
+const READAHEAD_SEQ_READS = 4
+const READAHEAD_MAX_MISSES = 3
+
+// sequential writes are collected into parts of --multipart-part-size,
+// which can't be smaller than what S3 takes for a part that isn't the
+// last. ADLv1 fails with 404 if we upload data larger than 30000000
+// bytes (28.6MB) (28MB also failed in reality)
+const DEFAULT_WRITE_BUFFER_SIZE = 5 * 1024 * 1024
+const MIN_WRITE_BUFFER_SIZE = 5 * 1024 * 1024
+const ADLV1_MAX_PART_SIZE = 20 * 1024 * 1024
+
+const MAX_PARTS = 10000
+
+// fsync stops sending what's buffered as a part after this many, to
+// leave part numbers for the rest of the file
+const MAX_SYNC_PARTS = MAX_PARTS / 2
+
+// what extend writes at a time, of zeros or what it has to write again
+const EXTEND_CHUNK = 1024 * 1024
+
 // NewFileHandle returns a new file handle for the given `inode` triggered by fuse
 // operation with the given `opMetadata`
 func NewFileHandle(inode *Inode, opMetadata fuseops.OpMetadata) *FileHandle {
@@ -79,45 +211,176 @@ func NewFileHandle(inode *Inode, opMetadata fuseops.OpMetadata) *FileHandle {
 	return fh
 }
 
+type pendingPart struct {
+	buf   *MBuf
+	total int64
+	last  bool
+}
+
+// writeContext is what the requests of a write carry: its trace id
+// and nothing else. Uploads outlive the op that started them, so they
+// aren't cancelled with it
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) writeContext() context.Context {
+	if fh.writeTrace != "" {
+		return WithTraceId(nil, fh.writeTrace)
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(fh.mu)
 func (fh *FileHandle) initWrite() {
 	fh.writeInit.Do(func() {
 		fh.mpuWG.Add(1)
-		go fh.initMPU()
+		fh.mpuBeginWG.Add(1)
+		go fh.initMPU(fh.writeContext())
 	})
 }
 
-func (fh *FileHandle) initMPU() {
+// initMPU and mpuPart run in the background and must not take fh.mu,
+// flush waits for them while holding it
+func (fh *FileHandle) initMPU(ctx context.Context) {
 	defer func() {
+		fh.mpuBeginWG.Done()
 		fh.mpuWG.Done()
 	}()
 
 	fs := fh.inode.fs
 	fh.mpuName = &fh.key
 
-	resp, err := fh.cloud.MultipartBlobBegin(&MultipartBlobBeginInput{
-		Key:         *fh.mpuName,
-		ContentType: fs.flags.GetMimeType(*fh.mpuName),
-	})
-
-	fh.mu.Lock()
-	defer fh.mu.Unlock()
+	var resp *MultipartBlobCommitInput
+	var err error
+	if fh.appendOffset != 0 {
+		resp, err = fh.cloud.AppendBlob(&AppendBlobInput{
+			Key:         *fh.mpuName,
+			Offset:      uint64(fh.appendOffset),
+			ContentType: fs.flags.GetMimeType(*fh.mpuName),
+			IfMatch:     fh.expectedETag(),
+			Context:     ctx,
+		})
+	} else {
+		resp, err = fh.cloud.MultipartBlobBegin(&MultipartBlobBeginInput{
+			Key:          *fh.mpuName,
+			Metadata:     fh.inode.metadataToWrite(),
+			ContentType:  fs.flags.GetMimeType(*fh.mpuName),
+			IfMatch:      fh.expectedETag(),
+			IfNotExists:  fh.expectNew(),
+			StorageClass: fh.inode.storageClassToWrite(),
+			Context:      ctx,
+		})
+	}
 
 	if err != nil {
-		fh.lastWriteError = mapAwsError(err)
+		fh.setMPUError(fh.inode.fs.mapAwsError(err))
 	} else {
 		fh.mpuId = resp
+		fs.liveUploads.Add(fh.cloud, resp)
 	}
 
 	return
 }
 
-func (fh *FileHandle) mpuPartNoSpawn(buf *MBuf, part uint32, total int64, last bool) (err error) {
+func (fh *FileHandle) abortMPU() {
+	fh.mpuId.Context = fh.writeContext()
+	go fh.cloud.MultipartBlobAbort(fh.mpuId)
+	fh.inode.fs.liveUploads.Remove(fh.mpuId)
+	fh.mpuId = nil
+}
+
+func (fh *FileHandle) setMPUError(err error) {
+	fh.mpuErrMu.Lock()
+	if fh.mpuErr == nil {
+		fh.mpuErr = err
+	}
+	fh.mpuErrMu.Unlock()
+
+	// a write waiting for room for its next part doesn't have
+	// to anymore
+	fh.inode.fs.dirtyBytes.wake()
+}
+
+func (fh *FileHandle) mpuError() error {
+	fh.mpuErrMu.Lock()
+	defer fh.mpuErrMu.Unlock()
+
+	return fh.mpuErr
+}
+
+// resumable is if a failed flush can be resumed, so parts that fail
+// are kept instead of freed
+func (fh *FileHandle) resumable() bool {
+	return fh.inode.fs.flags.FlushRetries != 0 &&
+		fh.cloud.Capabilities().ResumableMultipart
+}
+
+func (fh *FileHandle) keepPart(buf *MBuf, part uint32, total int64, last bool) {
+	fh.mpuErrMu.Lock()
+	defer fh.mpuErrMu.Unlock()
+
+	if fh.pendingParts == nil {
+		fh.pendingParts = make(map[uint32]*pendingPart)
+	}
+	fh.pendingParts[part] = &pendingPart{buf: buf, total: total, last: last}
+}
+
+func (fh *FileHandle) dropPendingParts() {
+	fh.mpuErrMu.Lock()
+	defer fh.mpuErrMu.Unlock()
+
+	for _, p := range fh.pendingParts {
+		fh.freePart(p.buf)
+	}
+	fh.pendingParts = nil
+}
+
+// freePart frees a part that was counted in fs.dirtyBytes
+func (fh *FileHandle) freePart(buf *MBuf) {
+	buf.Seek(0, io.SeekStart)
+	fh.inode.fs.dirtyBytes.done(uint64(buf.Len()))
+	buf.Free()
+}
+
+// addPendingParts adds what a failed flush couldn't, in order. The
+// parts that fail again are kept for the next flush
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) addPendingParts() (err error) {
+	fh.mpuErrMu.Lock()
+	pending := fh.pendingParts
+	fh.pendingParts = nil
+	fh.mpuErrMu.Unlock()
+
+	parts := make([]uint32, 0, len(pending))
+	for part := range pending {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+
+	for _, part := range parts {
+		p := pending[part]
+		if err != nil {
+			// no point trying the rest now
+			fh.keepPart(p.buf, part, p.total, p.last)
+			continue
+		}
+
+		p.buf.Seek(0, io.SeekStart)
+		err = fh.mpuPartNoSpawn(fh.writeContext(), p.buf, part, p.total, p.last)
+	}
+	return
+}
+
+func (fh *FileHandle) mpuPartNoSpawn(ctx context.Context, buf *MBuf, part uint32, total int64,
+	last bool) (err error) {
+
 	fs := fh.inode.fs
 
 	fs.replicators.Take(1, true)
 	defer fs.replicators.Return(1)
 
-	if part == 0 || part > 10000 {
+	if part == 0 || part > MAX_PARTS {
+		fh.freePart(buf)
 		return errors.New(fmt.Sprintf("invalid part number: %v", part))
 	}
 
@@ -128,12 +391,18 @@ func (fh *FileHandle) mpuPartNoSpawn(buf *MBuf, part uint32, total int64, last b
 		Size:       uint64(buf.Len()),
 		Last:       last,
 		Offset:     uint64(total - int64(buf.Len())),
+		Context:    ctx,
 	}
 
 	defer func() {
 		if mpu.Body != nil {
+			if err != nil && fh.resumable() {
+				// for the next flush to add again
+				fh.keepPart(buf, part, total, last)
+				return
+			}
 			bufferLog.Debugf("Free %T", buf)
-			buf.Free()
+			fh.freePart(buf)
 		}
 	}()
 
@@ -142,80 +411,355 @@ func (fh *FileHandle) mpuPartNoSpawn(buf *MBuf, part uint32, total int64, last b
 	return
 }
 
-func (fh *FileHandle) mpuPart(buf *MBuf, part uint32, total int64) {
+func (fh *FileHandle) mpuPart(ctx context.Context, buf *MBuf, part uint32, total int64) {
 	defer func() {
+		fh.partsInFlight.Return(1)
 		fh.mpuWG.Done()
 	}()
 
-	// maybe wait for CreateMultipartUpload
-	if fh.mpuId == nil {
-		fh.mpuWG.Wait()
-		// initMPU might have errored
-		if fh.mpuId == nil {
-			return
+	// maybe wait for MultipartBlobBegin
+	fh.mpuBeginWG.Wait()
+
+	// initMPU or another part might have errored, the upload
+	// is going to be aborted, or resumed by a later flush
+	if fh.mpuId == nil || fh.mpuError() != nil {
+		if fh.mpuId != nil && fh.resumable() {
+			fh.keepPart(buf, part, total, false)
+		} else {
+			fh.freePart(buf)
 		}
+		return
 	}
 
-	err := fh.mpuPartNoSpawn(buf, part, total, false)
+	err := fh.mpuPartNoSpawn(ctx, buf, part, total, false)
 	if err != nil {
-		if fh.lastWriteError == nil {
-			fh.lastWriteError = err
-		}
+		fh.setMPUError(err)
 	}
 }
 
 func (fh *FileHandle) waitForCreateMPU() (err error) {
+	fh.initWrite()
+	fh.mpuBeginWG.Wait()
+
 	if fh.mpuId == nil {
-		fh.mu.Unlock()
-		fh.initWrite()
-		fh.mpuWG.Wait() // wait for initMPU
-		fh.mu.Lock()
+		fh.lastWriteError = fh.mpuError()
+		return fh.lastWriteError
+	}
 
-		if fh.lastWriteError != nil {
-			return fh.lastWriteError
+	return
+}
+
+// configuredPartSize is the part size the flags ask for and which flag
+// that is, 0 if they don't. Backends that take parts of any size get
+// parts of --write-buffer-size if that's set
+func configuredPartSize(cap *Capabilities, flags *FlagStorage) (uint64, string) {
+	if cap.AnyPartSize && flags.WriteBufferSize != 0 {
+		return flags.WriteBufferSize, "--write-buffer-size"
+	}
+	return flags.PartSize, "--multipart-part-size"
+}
+
+// basePartSize is what the flags ask for, or what's best for cloud
+func basePartSize(cloud StorageBackend, flags *FlagStorage) uint64 {
+	if size, _ := configuredPartSize(cloud.Capabilities(), flags); size != 0 {
+		return size
+	}
+	if _, ok := unwrapBackend(cloud).(*ADLv1); ok {
+		// the biggest it takes, for fewer appends
+		return ADLV1_MAX_PART_SIZE
+	}
+	return DEFAULT_WRITE_BUFFER_SIZE
+}
+
+// nthPartSize is how big the part after the first n is. Parts get
+// bigger so big files fit in MAX_PARTS
+func nthPartSize(base uint64, n uint32, maxPartSize uint64) uint64 {
+	size := base
+	if n >= 2000 {
+		size = MaxUInt64(base, 125*1024*1024)
+	} else if n >= 1000 {
+		size = MaxUInt64(base, 25*1024*1024)
+	}
+
+	if maxPartSize != 0 {
+		size = MinUInt64(size, maxPartSize)
+	}
+	return size
+}
+
+// maxFileSize is how big a file can be in MAX_PARTS of nthPartSize
+func maxFileSize(base uint64, maxPartSize uint64) uint64 {
+	return 1000*nthPartSize(base, 0, maxPartSize) +
+		1000*nthPartSize(base, 1000, maxPartSize) +
+		(MAX_PARTS-2000)*nthPartSize(base, 2000, maxPartSize)
+}
+
+// checkPartSize is for mounting, the part size and
+// --multipart-threshold have to be parts the backend takes
+func checkPartSize(cloud StorageBackend, flags *FlagStorage) error {
+	cap := cloud.Capabilities()
+	maxPartSize := cap.MaxMultipartSize
+	partSize, flag := configuredPartSize(cap, flags)
+	if maxPartSize != 0 && partSize > maxPartSize {
+		return fmt.Errorf("%v %v is more than %v takes: %v",
+			flag, partSize, cap.Name, maxPartSize)
+	}
+	if maxPartSize != 0 && flags.MultipartThreshold > maxPartSize {
+		return fmt.Errorf("--multipart-threshold %v is more than %v takes in one part: %v",
+			flags.MultipartThreshold, cap.Name, maxPartSize)
+	}
+
+	if partSize != 0 {
+		max := maxFileSize(partSize, maxPartSize)
+		if cap.MaxObjectSize == 0 || max < cap.MaxObjectSize {
+			log.Warnf("with %v %v files can be at most %v bytes, "+
+				"writing bigger ones fails", flag, partSize, max)
 		}
 	}
+	return nil
+}
+
+func (fh *FileHandle) partSize() uint64 {
+	return nthPartSize(basePartSize(fh.cloud, fh.inode.fs.flags), fh.lastPartId,
+		fh.cloud.Capabilities().MaxMultipartSize)
+}
+
+// multipartThreshold is how big a file has to be to be uploaded in
+// parts. By default it's whatever doesn't fit in the first one
+func (fh *FileHandle) multipartThreshold() uint64 {
+	if threshold := fh.inode.fs.flags.MultipartThreshold; threshold != 0 {
+		return threshold
+	}
+	return nthPartSize(basePartSize(fh.cloud, fh.inode.fs.flags), 0,
+		fh.cloud.Capabilities().MaxMultipartSize)
+}
+
+// bufferSize is how much the next part can take. The first one has to
+// hold files up to --multipart-threshold, which are PUT from there
+func (fh *FileHandle) bufferSize() uint64 {
+	size := fh.partSize()
+	if fh.lastPartId == 0 {
+		size = MaxUInt64(size, fh.multipartThreshold())
+	}
+	return size
+}
 
+// expectMultipart is if a size hint says the file being written won't
+// fit in one part. Either way the first part is the buffer we are
+// writing to, and is uploaded from there with a PUT or as part 1.
+// Without a hint we don't guess, the upload is begun once the first
+// part is full: a file that turns out smaller would cost a begin and
+// an abort for nothing
+func (fh *FileHandle) expectMultipart() bool {
+	written := uint64(fh.nextWriteOffset)
+	// a file of exactly --multipart-threshold is uploaded as a
+	// multipart
+	return fh.sizeHint != 0 && written <= fh.sizeHint &&
+		fh.sizeHint >= fh.multipartThreshold()
+}
+
+// setSizeHint remembers the size a file was truncated to, which is
+// often done right before writing it out. Truncating a file we know
+// the size of to 0 is usually the start of rewriting it, likely to
+// about the same size
+func (inode *Inode) setSizeHint(size uint64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if size == 0 && inode.KnownSize != nil {
+		size = *inode.KnownSize
+	}
+	inode.fileData().sizeHint = size
+}
+
+func (inode *Inode) takeSizeHint() (size uint64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file != nil {
+		size = inode.file.sizeHint
+		inode.file.sizeHint = 0
+	}
 	return
 }
 
-func (fh *FileHandle) partSize() uint64 {
-	if _, ok := fh.cloud.(*ADLv1); ok {
-		// ADLv1 fails with 404 if we upload data larger than
-		// 30000000 bytes (28.6MB) (28MB also failed in reality)
-		return 20 * 1024 * 1024
+// truncate is a setattr of the size. The only truncate we can do
+// without the data is to 0, by putting an empty object over what's
+// there, with the same metadata. For an open file, like with
+// O_TRUNC, that's left to the flush of one of its handles, which is
+// most likely going to write the file anyway. Growing the file is
+// extend, shrinking it to anything else is ignored
+func (inode *Inode) truncate(size uint64) (err error) {
+	inode.setSizeHint(size)
+	if size != 0 {
+		return inode.extend(size)
 	}
 
-	if fh.lastPartId < 1000 {
-		return 5 * 1024 * 1024
-	} else if fh.lastPartId < 2000 {
-		return 25 * 1024 * 1024
-	} else {
-		maxPartSize := fh.cloud.Capabilities().MaxMultipartSize
-		tryPartSize := uint64(125 * 1024 * 1024)
-		if maxPartSize != 0 {
-			tryPartSize = MinUInt64(tryPartSize, maxPartSize)
+	inode.mu.Lock()
+	if inode.KnownSize == nil || *inode.KnownSize == 0 {
+		inode.mu.Unlock()
+		return
+	}
+	// so we can keep it
+	err = inode.fillXattr()
+	if err != nil {
+		inode.mu.Unlock()
+		return
+	}
+	inode.fileData().truncated = true
+	inode.Attributes.Size = 0
+	open := inode.fileHandles != 0
+	inode.mu.Unlock()
+
+	if !open {
+		fh := NewFileHandle(inode, fuseops.OpMetadata{})
+		err = fh.FlushFile()
+	}
+	return
+}
+
+func (inode *Inode) takeTruncated() (truncated bool) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file != nil {
+		truncated = inode.file.truncated
+		inode.file.truncated = false
+	}
+	return
+}
+
+// extend is a truncate up, to preallocate. The file is padded with
+// zeros at the next flush, right away if it's not open. What's there
+// isn't sent again if the backend can append, see FileHandle.extend
+func (inode *Inode) extend(size uint64) (err error) {
+	inode.mu.Lock()
+	if size <= inode.Attributes.Size {
+		inode.mu.Unlock()
+		return
+	}
+	// in case it has to be written again
+	err = inode.fillXattr()
+	if err != nil {
+		inode.mu.Unlock()
+		return
+	}
+	inode.fileData().extendTo = size
+	inode.Attributes.Size = size
+	open := inode.fileHandles != 0
+	inode.mu.Unlock()
+
+	if !open {
+		fh := NewFileHandle(inode, fuseops.OpMetadata{})
+		err = fh.FlushFile()
+	}
+	return
+}
+
+func (inode *Inode) takeExtendTo() (size uint64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file != nil {
+		size = inode.file.extendTo
+		inode.file.extendTo = 0
+	}
+	return
+}
+
+// extend writes zeros up to size, after what was written or, if
+// nothing was, after what's there. That's appended to if we can,
+// otherwise it's read and written again first
+func (fh *FileHandle) extend(size uint64) (err error) {
+	offset := uint64(fh.nextWriteOffset)
+	if !fh.dirty {
+		fh.inode.mu.Lock()
+		if fh.inode.KnownSize != nil {
+			offset = *fh.inode.KnownSize
 		}
-		return tryPartSize
+		etag := fh.inode.etag
+		fh.inode.mu.Unlock()
+
+		if offset != 0 && !fh.canAppend(int64(offset)) {
+			err = fh.writeExisting(offset, etag)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if offset >= size {
+		return
 	}
+
+	zeros := make([]byte, MinUInt64(size-offset, EXTEND_CHUNK))
+	for offset < size {
+		n := MinUInt64(size-offset, uint64(len(zeros)))
+		err = fh.writeFile(int64(offset), zeros[:n])
+		if err != nil {
+			return
+		}
+		offset += n
+	}
+	return
 }
 
-func (fh *FileHandle) uploadCurrentBuf(parallel bool) (err error) {
-	err = fh.waitForCreateMPU()
+// writeExisting writes the first size bytes of the object again, for
+// extend on backends that can't append
+func (fh *FileHandle) writeExisting(size uint64, etag string) (err error) {
+	fh.inode.logFuse("extend: writing the object again", size)
+
+	params := &GetBlobInput{Key: fh.key, Count: size}
+	if etag != "" {
+		params.IfMatch = &etag
+	}
+	resp, err := getBlobChecked(fh.cloud, params)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, MinUInt64(size, EXTEND_CHUNK))
+	for offset := uint64(0); offset < size; {
+		n := MinUInt64(size-offset, uint64(len(buf)))
+		_, err = io.ReadFull(resp.Body, buf[:n])
+		if err != nil {
+			return
+		}
+		err = fh.writeFile(int64(offset), buf[:n])
+		if err != nil {
+			return
+		}
+		offset += n
+	}
+	return
+}
+
+func (fh *FileHandle) uploadCurrentBuf(parallel bool) (err error) {
+	if parallel {
+		// the part will wait for MultipartBlobBegin, we
+		// don't have to
+		fh.initWrite()
+	} else {
+		err = fh.waitForCreateMPU()
+		if err != nil {
+			return
+		}
+	}
 
 	fh.lastPartId++
 	part := fh.lastPartId
 	buf := fh.buf
 	fh.buf = nil
+	fh.inode.fs.dirtyBytes.add(uint64(buf.Len()))
 
 	if parallel {
+		// the part is freed once it's uploaded, or kept for
+		// the next flush if that failed
 		fh.mpuWG.Add(1)
-		go fh.mpuPart(buf, part, fh.nextWriteOffset)
+		fh.takePartInFlight()
+		go fh.mpuPart(fh.writeContext(), buf, part, fh.nextWriteOffset)
 	} else {
-		err = fh.mpuPartNoSpawn(buf, part, fh.nextWriteOffset, false)
+		err = fh.mpuPartNoSpawn(fh.writeContext(), buf, part, fh.nextWriteOffset, false)
 		if fh.lastWriteError == nil {
 			fh.lastWriteError = err
 		}
@@ -224,30 +768,136 @@ func (fh *FileHandle) uploadCurrentBuf(parallel bool) (err error) {
 	return
 }
 
+// takePartInFlight waits until another part can be uploaded in the
+// background, --max-parts-in-flight or as many as the mount uploads at
+// once. A writer faster than that waits, so a file being written never
+// holds more than this many parts and the one being filled, however
+// big it gets. fh.mu is let go while we wait so reads of the file
+// don't wait with us, other writes and flushes do on fh.writeMu
+//
+// LOCKS_REQUIRED(fh.writeMu)
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) takePartInFlight() {
+	if fh.partsInFlight == nil {
+		max := fh.inode.fs.flags.MaxPartsInFlight
+		if max <= 0 {
+			max = int(fh.inode.fs.replicators.Total)
+		}
+		fh.partsInFlight = Ticket{Total: uint32(max)}.Init()
+	}
+	if !fh.partsInFlight.Take(1, false) {
+		fh.mu.Unlock()
+		fh.partsInFlight.Take(1, true)
+		fh.mu.Lock()
+	}
+}
+
+// canAppend is if a write at offset can be added to the end of the
+// object, instead of the file being written from the start: the
+// backend can do that, nothing was written to this handle yet, and
+// offset is where the object ends
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) canAppend(offset int64) bool {
+	if offset == 0 || fh.nextWriteOffset != 0 || fh.dirty {
+		return false
+	}
+	cap := fh.cloud.Capabilities()
+	if !cap.SupportsAppend || uint64(offset) < cap.MinAppendOffset {
+		return false
+	}
+
+	inode := fh.inode
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	return inode.KnownSize != nil && *inode.KnownSize == uint64(offset) &&
+		(inode.file == nil || !inode.file.truncated)
+}
+
 func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
-	fh.inode.logFuse("WriteFile", offset, len(data))
+	return fh.WriteFileWithContext(nil, offset, data)
+}
 
+// WriteFileWithContext is WriteFile for a fuse op, the requests it
+// starts carry its trace id
+func (fh *FileHandle) WriteFileWithContext(ctx context.Context, offset int64,
+	data []byte) (err error) {
+
+	// checked here because building the arguments for logFuse
+	// allocates, even if nothing is logged
+	if fh.inode.fs.flags.DebugFuse {
+		fh.inode.logFuse("WriteFile", offset, len(data))
+	}
+
+	fh.writeMu.Lock()
+	defer fh.writeMu.Unlock()
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	fh.writeTrace = TraceId(ctx)
+	defer func() { fh.writeTrace = "" }()
+
+	return fh.writeFile(offset, data)
+}
+
+// LOCKS_REQUIRED(fh.writeMu)
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) writeFile(offset int64, data []byte) (err error) {
+	// the error of a MultipartBlobBegin we started early doesn't
+	// matter if the file ends up fitting in one part
+	if fh.lastWriteError == nil && fh.lastPartId != 0 {
+		fh.lastWriteError = fh.mpuError()
+	}
+
 	if fh.lastWriteError != nil {
 		return fh.lastWriteError
 	}
 
+	if fh.inode.isStale() {
+		// and don't flush what we have so far
+		fh.lastWriteError = syscall.ESTALE
+		return fh.lastWriteError
+	}
+
+	if fh.canAppend(offset) {
+		fh.appendOffset = offset
+		fh.nextWriteOffset = offset
+	}
+
+	if offset > fh.nextWriteOffset && fh.dirty {
+		// skipping ahead isn't supported, but what was written
+		// before isn't lost with it
+		err = fh.flushFile()
+		if err != nil {
+			return
+		}
+	}
+
 	if offset != fh.nextWriteOffset {
 		fh.inode.errFuse("WriteFile: only sequential writes supported", fh.nextWriteOffset, offset)
 		fh.lastWriteError = syscall.ENOTSUP
 		return fh.lastWriteError
 	}
 
-	if offset == 0 {
+	if offset == fh.appendOffset {
+		// the first write, or one that didn't write anything
 		fh.poolHandle = fh.inode.fs.bufferPool
 		fh.dirty = true
+		fh.sizeHint = fh.inode.takeSizeHint()
+		if fh.inode.fs.flags.PreserveMtime {
+			fh.inode.dropMtime()
+		}
 	}
 
 	for {
 		if fh.buf == nil {
-			fh.buf = MBuf{}.Init(fh.poolHandle, fh.partSize(), true)
+			// --max-dirty-bytes, there's no point waiting if
+			// the upload already failed
+			fh.inode.fs.dirtyBytes.wait(func() bool {
+				return fh.mpuError() != nil
+			})
+			fh.buf = MBuf{}.Init(fh.poolHandle, fh.bufferSize(), true)
 		}
 
 		nCopied, _ := fh.buf.Write(data)
@@ -267,7 +917,15 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 		data = data[nCopied:]
 	}
 
+	// the hint says this is turning into a multipart upload, begin
+	// it while the rest of the first part is being written
+	if fh.lastPartId == 0 && !fh.inode.fs.flags.Cheap && fh.expectMultipart() {
+		fh.initWrite()
+	}
+
+	fh.inode.mu.Lock()
 	fh.inode.Attributes.Size = uint64(fh.nextWriteOffset)
+	fh.inode.mu.Unlock()
 
 	return
 }
@@ -277,6 +935,10 @@ type S3ReadBuffer struct {
 	offset uint64
 	size   uint32
 	buf    *Buffer
+	// aborts the request if we don't need it anymore
+	cancel context.CancelFunc
+
+	streaming bool
 }
 
 func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBuffer {
@@ -289,11 +951,18 @@ func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBu
 		return nil
 	}
 
+	ctx, cancel := context.WithCancel(fh.readContext())
+	b.cancel = cancel
+	ifMatch := fh.readETag
+	checksum := fh.inode.fs.flags.CheckReadIntegrity
 	b.buf = Buffer{}.Init(mbuf, func() (io.ReadCloser, error) {
-		resp, err := b.s3.GetBlob(&GetBlobInput{
-			Key:   fh.key,
-			Start: offset,
-			Count: uint64(size),
+		resp, err := getBlobChecked(b.s3, &GetBlobInput{
+			Key:      fh.key,
+			Start:    offset,
+			Count:    uint64(size),
+			IfMatch:  ifMatch,
+			Context:  ctx,
+			Checksum: checksum,
 		})
 		if err != nil {
 			return nil, err
@@ -305,8 +974,25 @@ func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBu
 	return &b
 }
 
+// Close throws away what's left, whatever is still on the way
+// included. The request has to be cancelled first, the read loop
+// holds on to buf while it waits for it
+func (b *S3ReadBuffer) Close() {
+	b.cancel()
+	b.buf.Close()
+}
+
 func (b *S3ReadBuffer) Read(offset uint64, p []byte) (n int, err error) {
 	if b.offset == offset {
+		if !b.streaming {
+			// we are the head of readahead, read the
+			// response straight into p from now on instead
+			// of copying it through our buffer. The ones
+			// behind us keep buffering
+			b.buf.Stream()
+			b.streaming = true
+		}
+
 		n, err = io.ReadFull(b.buf, p)
 		if n != 0 && err == io.ErrUnexpectedEOF {
 			err = nil
@@ -339,7 +1025,7 @@ func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead in
 
 		if fh.buffers[0].size == 0 {
 			// we've exhausted the first buffer
-			fh.buffers[0].buf.Close()
+			fh.buffers[0].Close()
 			fh.buffers = fh.buffers[1:]
 		}
 
@@ -354,22 +1040,28 @@ func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead in
 	return
 }
 
+func (fh *FileHandle) readAheadAmount() uint64 {
+	if fh.inode.fs.flags.ReadAhead != 0 {
+		return fh.inode.fs.flags.ReadAhead
+	}
+	return DEFAULT_READ_AHEAD
+}
+
 func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
-	existingReadahead := uint32(0)
+	existingReadahead := uint64(0)
 	for _, b := range fh.buffers {
-		existingReadahead += b.size
+		existingReadahead += uint64(b.size)
 	}
 
-	readAheadAmount := MAX_READAHEAD
+	readAheadAmount := fh.readAheadAmount()
 
-	for readAheadAmount-existingReadahead >= READAHEAD_CHUNK {
-		off := offset + uint64(existingReadahead)
+	for readAheadAmount >= existingReadahead+uint64(READAHEAD_CHUNK) {
+		off := offset + existingReadahead
 		remaining := fh.inode.Attributes.Size - off
 
-		// only read up to readahead chunk each time
-		size := MinUInt32(readAheadAmount-existingReadahead, READAHEAD_CHUNK)
-		// but don't read past the file
-		size = uint32(MinUInt64(uint64(size), remaining))
+		// only read up to readahead chunk each time, but don't
+		// read past the file
+		size := uint32(MinUInt64(uint64(READAHEAD_CHUNK), remaining))
 
 		if size != 0 {
 			fh.inode.logFuse("readahead", off, size, existingReadahead)
@@ -377,7 +1069,7 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 			readAheadBuf := S3ReadBuffer{}.Init(fh, off, size)
 			if readAheadBuf != nil {
 				fh.buffers = append(fh.buffers, readAheadBuf)
-				existingReadahead += size
+				existingReadahead += uint64(size)
 			} else {
 				if existingReadahead != 0 {
 					// don't do more readahead now, but don't fail, cross our
@@ -399,10 +1091,92 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 	return nil
 }
 
+func (fh *FileHandle) readContext() context.Context {
+	fh.readMu.Lock()
+	defer fh.readMu.Unlock()
+
+	if fh.readCtx == nil {
+		fh.readCtx, fh.readCancel = context.WithCancel(context.Background())
+	}
+	if fh.readTrace != "" {
+		return WithTraceId(fh.readCtx, fh.readTrace)
+	}
+	return fh.readCtx
+}
+
+// cancelReads aborts the requests of the stream and readahead, they
+// return errors from then on
+func (fh *FileHandle) cancelReads() {
+	fh.readMu.Lock()
+	defer fh.readMu.Unlock()
+
+	if fh.readCancel != nil {
+		fh.readCancel()
+		fh.readCtx = nil
+		fh.readCancel = nil
+	}
+}
+
+// dropReads throws away the stream and readahead, they were
+// cancelled and whatever is left in them is no good
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) dropReads() {
+	if fh.reader != nil {
+		fh.reader.Close()
+		fh.reader = nil
+	}
+
+	for _, b := range fh.buffers {
+		b.Close()
+	}
+	fh.buffers = nil
+	fh.seqReadAmount = 0
+	fh.seqReads = 0
+}
+
+// objectChanged is for when a read finds that the object isn't the
+// one we have been reading anymore. What we have of it is dropped,
+// and the next read goes on with whatever is there now. We can't
+// make the kernel drop the pages it has cached, the next open of the
+// file does that instead
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) objectChanged() {
+	fuseLog.Warnf("%v changed while it was being read",
+		*fh.inode.FullName())
+
+	fh.dropReads()
+	fh.readETag = nil
+
+	inode := fh.inode
+	inode.mu.Lock()
+	file := inode.fileData()
+	file.readBlocks = nil
+	file.pageCacheStale = true
+	inode.mu.Unlock()
+	// the size may have changed too
+	inode.AttrTime = time.Time{}
+}
+
 func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err error) {
-	fh.inode.logFuse("ReadFile", offset, len(buf))
+	return fh.ReadFileInterruptible(nil, offset, buf)
+}
+
+// ReadFileInterruptible is ReadFile that gives up with EINTR once ctx
+// is done. What we were streaming is dropped, the next read starts
+// over from where it asks for
+func (fh *FileHandle) ReadFileInterruptible(ctx context.Context,
+	offset int64, buf []byte) (bytesRead int, err error) {
+
+	debug := fh.inode.fs.flags.DebugFuse
+	if debug {
+		fh.inode.logFuse("ReadFile", offset, len(buf))
+	}
 	defer func() {
-		fh.inode.logFuse("< ReadFile", bytesRead, err)
+		if debug {
+			fh.inode.logFuse("< ReadFile", bytesRead, err)
+		}
 
 		if err != nil {
 			if err == io.EOF {
@@ -414,27 +1188,88 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	if fh.inode.isStale() {
+		return 0, syscall.ESTALE
+	}
+
+	fh.readTrace = TraceId(ctx)
+	defer func() { fh.readTrace = "" }()
+
+	// only a ctx that can be interrupted gets a flag and a closure,
+	// the rest of the reads don't allocate
+	var interrupted *int32
+	stop := func() {}
+	if interruptDone(ctx) != nil {
+		flag := new(int32)
+		interrupted = flag
+		stop = watchInterrupt(ctx, func() {
+			atomic.StoreInt32(flag, 1)
+			fh.cancelReads()
+		})
+	}
+
 	nwant := len(buf)
 	var nread int
+	changed := false
 
 	for bytesRead < nwant && err == nil {
-		nread, err = fh.readFile(offset+int64(bytesRead), buf[bytesRead:])
+		if ctx != nil && ctx.Err() != nil {
+			err = syscall.EINTR
+			break
+		}
+
+		err = fh.inode.retryIfWritten(func() (err error) {
+			nread, err = fh.readFile(offset+int64(bytesRead), buf[bytesRead:])
+			if err == syscall.ENOENT && fh.inode.recentlyWritten() {
+				// the reads that failed are started over
+				fh.dropReads()
+			}
+			return
+		})
 		if nread > 0 {
 			bytesRead += nread
 		}
+		if err == syscall.ESTALE && fh.readETag != nil && !changed {
+			// once, in case it keeps changing
+			changed = true
+			fh.objectChanged()
+			err = nil
+		}
+	}
+
+	stop()
+	if interrupted != nil && atomic.LoadInt32(interrupted) != 0 {
+		fh.dropReads()
+		if err != nil {
+			// what we got so far isn't returned, the
+			// kernel will ask for it again
+			fh.readBufOffset = offset
+			return 0, syscall.EINTR
+		}
+	}
+
+	// an invalid inode was never flushed, so the ENOENT isn't from
+	// the backend
+	if err == syscall.ENOENT && !fh.inode.Invalid {
+		fh.inode.markStale()
+		err = syscall.ESTALE
 	}
 
 	return
 }
 
 func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err error) {
+	coalesced := false
 	defer func() {
-		if bytesRead > 0 {
+		if bytesRead > 0 && !coalesced {
 			fh.readBufOffset += int64(bytesRead)
 			fh.seqReadAmount += uint64(bytesRead)
+			fh.seqReads++
 		}
 
-		fh.inode.logFuse("< readFile", bytesRead, err)
+		if fh.inode.fs.flags.DebugFuse {
+			fh.inode.logFuse("< readFile", bytesRead, err)
+		}
 	}()
 
 	if uint64(offset) >= fh.inode.Attributes.Size {
@@ -455,12 +1290,26 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 		fh.poolHandle = fs.bufferPool
 	}
 
+	// small reads away from where we are streaming would each cost
+	// a request, serve them from a bigger block instead. This
+	// leaves the stream and readahead alone for when we come back.
+	// Where nothing is streaming yet, a block we already have is
+	// cheaper than starting to
+	if window := fs.flags.ReadCoalesceWindow; window != 0 && uint64(len(buf)) < window &&
+		(fh.readBufOffset != offset ||
+			fh.reader == nil && fh.buffers == nil && fh.hasReadBlock(uint64(offset))) {
+		coalesced = true
+		bytesRead, err = fh.readFromBlock(uint64(offset), buf)
+		return
+	}
+
 	if fh.readBufOffset != offset {
 		// XXX out of order read, maybe disable prefetching
 		fh.inode.logFuse("out of order read", offset, fh.readBufOffset)
 
 		fh.readBufOffset = offset
 		fh.seqReadAmount = 0
+		fh.seqReads = 0
 		if fh.reader != nil {
 			fh.reader.Close()
 			fh.reader = nil
@@ -471,13 +1320,16 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 			fh.numOOORead++
 		}
 
+		// what's still being read ahead is of no use now
 		for _, b := range fh.buffers {
-			b.buf.Close()
+			b.Close()
 		}
 		fh.buffers = nil
 	}
 
-	if !fs.flags.Cheap && fh.seqReadAmount >= uint64(READAHEAD_CHUNK) && fh.numOOORead < 3 {
+	sequential := fh.seqReads >= READAHEAD_SEQ_READS ||
+		fh.seqReadAmount >= uint64(READAHEAD_CHUNK)
+	if !fs.flags.Cheap && sequential && fh.numOOORead < READAHEAD_MAX_MISSES {
 		if fh.reader != nil {
 			fh.inode.logFuse("cutover to the parallel algorithm")
 			fh.reader.Close()
@@ -492,8 +1344,9 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 			// fall back to read serially
 			fh.inode.logFuse("not enough memory, fallback to serial read")
 			fh.seqReadAmount = 0
+			fh.seqReads = 0
 			for _, b := range fh.buffers {
-				b.buf.Close()
+				b.Close()
 			}
 			fh.buffers = nil
 		}
@@ -505,9 +1358,11 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 }
 
 func (fh *FileHandle) Release() {
+	fh.cancelReads()
+
 	// read buffers
 	for _, b := range fh.buffers {
-		b.buf.Close()
+		b.Close()
 	}
 	fh.buffers = nil
 
@@ -515,6 +1370,20 @@ func (fh *FileHandle) Release() {
 		fh.reader.Close()
 	}
 
+	// a failed flush that wasn't tried again, or a write that
+	// failed because a part did and was never flushed
+	if fh.resumeErr != nil || fh.lastWriteError != nil {
+		if fh.mpuId != nil {
+			fh.abortMPU()
+		}
+		// parts still uploading may be kept when they fail,
+		// they count in --max-dirty-bytes until freed
+		go func() {
+			fh.mpuWG.Wait()
+			fh.dropPendingParts()
+		}()
+	}
+
 	// write buffers
 	if fh.poolHandle != nil {
 		if fh.buf != nil && fh.buf.buffers != nil {
@@ -536,6 +1405,9 @@ func (fh *FileHandle) Release() {
 	}
 
 	fh.inode.fileHandles -= 1
+	if fh.inode.fileHandles == 0 && fh.inode.file != nil {
+		fh.inode.file.readBlocks = nil
+	}
 }
 
 func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, err error) {
@@ -551,14 +1423,26 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 	}
 
 	if fh.reader == nil {
-		resp, err := fh.cloud.GetBlob(&GetBlobInput{
-			Key:   fh.key,
-			Start: uint64(offset),
+		resp, err := getBlobChecked(fh.cloud, &GetBlobInput{
+			Key:      fh.key,
+			Start:    uint64(offset),
+			IfMatch:  fh.readETag,
+			Context:  fh.readContext(),
+			Checksum: fh.inode.fs.flags.CheckReadIntegrity,
 		})
 		if err != nil {
 			return bytesRead, err
 		}
 
+		if resp.ETag != nil {
+			fh.readETag = resp.ETag
+		}
+
+		if resp.StorageClass != nil {
+			fh.inode.mu.Lock()
+			fh.inode.storageClass = internStorageClass(*resp.StorageClass)
+			fh.inode.mu.Unlock()
+		}
 		fh.reader = resp.Body
 	}
 
@@ -567,16 +1451,31 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 		if err != io.EOF {
 			fh.inode.logFuse("< readFromStream error", bytesRead, err)
 		}
-		// always retry error on read
 		fh.reader.Close()
 		fh.reader = nil
-		err = nil
+		if err != syscall.EIO {
+			// always retry error on read, unless the body
+			// already did
+			err = nil
+		}
 	}
 
 	return
 }
 
-func (fh *FileHandle) flushSmallFile() (err error) {
+// storageClassToWrite is what user.s3.storage-class asked for, nil
+// for --storage-class
+func (inode *Inode) storageClassToWrite() *string {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file == nil || inode.file.wantStorageClass == "" {
+		return nil
+	}
+	return PString(inode.file.wantStorageClass)
+}
+
+func (fh *FileHandle) flushSmallFile(ifMatch *string, ifNotExists bool) (err error) {
 	buf := fh.buf
 	fh.buf = nil
 
@@ -594,28 +1493,57 @@ func (fh *FileHandle) flushSmallFile() (err error) {
 	// we want to get key from inode because the file could have been renamed
 	_, key := fh.inode.cloud()
 	resp, err := fh.cloud.PutBlob(&PutBlobInput{
-		Key:         key,
-		Body:        buf,
-		Size:        PUInt64(uint64(buf.Len())),
-		ContentType: fs.flags.GetMimeType(*fh.inode.FullName()),
+		Key:          key,
+		Body:         buf,
+		Size:         PUInt64(uint64(buf.Len())),
+		Metadata:     fh.inode.metadataToWrite(),
+		ContentType:  fs.flags.GetMimeType(*fh.inode.FullName()),
+		IfMatch:      ifMatch,
+		IfNotExists:  ifNotExists,
+		StorageClass: fh.inode.storageClassToWrite(),
+		Context:      fh.writeContext(),
 	})
 	if err != nil {
+		err = fh.conflictError(err, ifMatch, ifNotExists)
 		fh.lastWriteError = err
 	} else {
 		inode := fh.inode
 		inode.mu.Lock()
 		defer inode.mu.Unlock()
 		if resp.ETag != nil {
-			inode.s3Metadata["etag"] = []byte(*resp.ETag)
+			inode.etag = *resp.ETag
+			fh.readETag = resp.ETag
 		}
 		if resp.StorageClass != nil {
-			inode.s3Metadata["storage-class"] = []byte(*resp.StorageClass)
+			inode.storageClass = internStorageClass(*resp.StorageClass)
 		}
 	}
 	return
 }
 
+func (fh *FileHandle) publishFlushEvent(ticket *eventTicket, key string, created bool,
+	size uint64) {
+
+	e := Event{
+		Type: EVENT_WRITE,
+		Key:  key,
+		Size: size,
+	}
+	if created {
+		e.Type = EVENT_CREATE
+	}
+
+	fh.inode.mu.Lock()
+	e.ETag = fh.inode.etag
+	fh.inode.mu.Unlock()
+
+	ticket.publish(e)
+}
+
 func (fh *FileHandle) resetToKnownSize() {
+	fh.inode.mu.Lock()
+	defer fh.inode.mu.Unlock()
+
 	if fh.inode.KnownSize != nil {
 		fh.inode.Attributes.Size = *fh.inode.KnownSize
 	} else {
@@ -624,13 +1552,241 @@ func (fh *FileHandle) resetToKnownSize() {
 	}
 }
 
+// deletedRemotely checks if the object we are about to overwrite is
+// still there. Only used with --no-recreate-deleted, where it costs a
+// HEAD per flush
+func (fh *FileHandle) deletedRemotely() bool {
+	if fh.inode.isStale() {
+		return true
+	}
+
+	_, key := fh.inode.cloud()
+	err := fh.inode.retryIfWritten(func() error {
+		_, err := fh.cloud.HeadBlob(&HeadBlobInput{Key: key})
+		return err
+	})
+	if err == syscall.ENOENT {
+		fh.inode.markStale()
+		return true
+	}
+	return false
+}
+
+// expectedETag is what the object has to still be for us to
+// overwrite it with --fail-on-conflict: the etag from when we last
+// looked it up, or last flushed it. nil if we don't check
+func (fh *FileHandle) expectedETag() *string {
+	if !fh.inode.fs.flags.FailOnConflict {
+		return nil
+	}
+
+	fh.inode.mu.Lock()
+	defer fh.inode.mu.Unlock()
+
+	if fh.inode.KnownSize == nil || fh.inode.etag == "" {
+		// nothing to overwrite
+		return nil
+	}
+	return PString(fh.inode.etag)
+}
+
+// expectNew is --fail-on-conflict for a file we are creating, the
+// object must not exist yet. Otherwise two of us creating the same
+// name would both think it's theirs
+func (fh *FileHandle) expectNew() bool {
+	if !fh.inode.fs.flags.FailOnConflict {
+		return false
+	}
+
+	fh.inode.mu.Lock()
+	defer fh.inode.mu.Unlock()
+
+	return fh.inode.KnownSize == nil
+}
+
+// checkConflict is --fail-on-conflict for backends that can't do
+// conditional writes. It's best effort, someone can still write
+// between the HEAD and our PUT. An empty etag means we are creating
+// the object
+func (fh *FileHandle) checkConflict(etag string) error {
+	_, key := fh.inode.cloud()
+	resp, err := fh.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if etag == "" {
+		if err != nil {
+			return nil
+		}
+		theirs := "unknown"
+		if resp.ETag != nil {
+			theirs = *resp.ETag
+		}
+		warnConflict(key, etag, theirs)
+		return syscall.ESTALE
+	}
+	if err != nil || resp.ETag == nil {
+		// deleted is up to --no-recreate-deleted, and if we
+		// can't tell we don't fail the flush
+		return nil
+	}
+	if quoteETag(*resp.ETag) == quoteETag(etag) {
+		return nil
+	}
+
+	warnConflict(key, etag, *resp.ETag)
+	return syscall.ESTALE
+}
+
+// conflictError is err, except that the backend failing a condition
+// we asked for (EBUSY) is ESTALE: someone else changed or created the
+// file. That's logged so whoever sorts it out knows which versions are
+// involved
+func (fh *FileHandle) conflictError(err error, ifMatch *string, ifNotExists bool) error {
+	if err != syscall.EBUSY || (ifMatch == nil && !ifNotExists) {
+		return err
+	}
+	fh.logConflict(nilStr(ifMatch))
+	return syscall.ESTALE
+}
+
+func (fh *FileHandle) logConflict(etag string) {
+	_, key := fh.inode.cloud()
+	theirs := "unknown"
+	resp, err := fh.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if err == nil && resp.ETag != nil {
+		theirs = *resp.ETag
+	} else if err == syscall.ENOENT {
+		theirs = "deleted"
+	}
+
+	warnConflict(key, etag, theirs)
+}
+
+func warnConflict(key string, ours string, theirs string) {
+	if ours == "" {
+		log.Warnf("%v was created by someone else, it's %v, not overwriting it",
+			key, theirs)
+		return
+	}
+	log.Warnf("%v was changed by someone else, expected etag %v but it's %v, "+
+		"not overwriting it", key, ours, theirs)
+}
+
+// discardWrites drops what this handle has written but not flushed
+func (fh *FileHandle) discardWrites() {
+	fh.mpuWG.Wait()
+	if fh.mpuId != nil {
+		fh.abortMPU()
+	}
+	if fh.buf != nil {
+		fh.buf.Free()
+		fh.buf = nil
+	}
+
+	fh.dropPendingParts()
+
+	fh.dirty = false
+	fh.writeInit = sync.Once{}
+	fh.nextWriteOffset = 0
+	fh.appendOffset = 0
+	fh.lastPartId = 0
+	fh.mpuErr = nil
+	fh.resumeErr = nil
+	fh.flushRetries = 0
+	fh.flushFailedAt = time.Time{}
+}
+
+// flushFailed is if the last flush failed and the next one will
+// resume it
+func (fh *FileHandle) flushFailed() bool {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	return fh.resumeErr != nil
+}
+
+// canResume is if the next flush can pick up where this failed one
+// left off, instead of aborting the upload and making the
+// application write the whole file again
+func (fh *FileHandle) canResume(err error) bool {
+	if fh.mpuId == nil || !fh.resumable() || !isTransient(err) {
+		return false
+	}
+
+	flags := fh.inode.fs.flags
+	if fh.flushFailedAt.IsZero() {
+		fh.flushFailedAt = time.Now()
+	}
+	if fh.flushRetries >= flags.FlushRetries ||
+		(flags.FlushRetryAge != 0 && time.Since(fh.flushFailedAt) > flags.FlushRetryAge) {
+		fh.inode.errFuse("FlushFile: giving up resuming", fh.flushRetries, err)
+		return false
+	}
+
+	fh.flushRetries++
+	return true
+}
+
+// FlushFile commits what this handle has written. Several handles can
+// be writing the same file at once, each into its own buffers and
+// multipart upload, and the one that is flushed last is what the
+// object ends up with: last close wins. Flushes of the same file are
+// serialized, and one that is overtaken by a later flush while it
+// waits for its turn is dropped rather than committed after it.
+//
+// With --fail-on-conflict, we also don't overwrite what someone else
+// has written since we last looked, and fail with ESTALE instead.
+//
+// A multipart upload that fails on the way is kept if the error may
+// go away, and the next flush (from close() or fsync()) only adds the
+// parts that are missing and commits it. Writes fail in the mean
+// time. After --flush-retries of those, or --flush-retry-age, the
+// upload is aborted like it always used to be
 func (fh *FileHandle) FlushFile() (err error) {
+	return fh.FlushFileWithContext(nil)
+}
+
+// FlushFileWithContext is FlushFile for a fuse op, the requests it
+// starts carry its trace id, the commit too
+func (fh *FileHandle) FlushFileWithContext(ctx context.Context) (err error) {
+	fh.writeMu.Lock()
+	defer fh.writeMu.Unlock()
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	fh.writeTrace = TraceId(ctx)
+	defer func() { fh.writeTrace = "" }()
+
+	return fh.flushFile()
+}
+
+// LOCKS_REQUIRED(fh.writeMu)
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) flushFile() (err error) {
+	if fh.inode.fs.flags.PreserveMtime {
+		// after the upload, once the object is there
+		defer func() {
+			if err == nil {
+				err = fh.inode.flushMtime(fh.writeContext())
+			}
+		}()
+	}
+
 	fh.inode.logFuse("FlushFile")
 
-	if !fh.dirty || fh.lastWriteError != nil {
+	if fh.resumeErr == nil && !fh.dirty && fh.lastWriteError == nil &&
+		fh.inode.takeTruncated() {
+		// nothing was written since, but the empty file still
+		// has to be
+		fh.poolHandle = fh.inode.fs.bufferPool
+		fh.dirty = true
+	}
+
+	if fh.resumeErr == nil && fh.lastWriteError == nil {
+		if size := fh.inode.takeExtendTo(); size != 0 {
+			fh.lastWriteError = fh.extend(size)
+		}
+	}
+
+	if fh.resumeErr == nil && (!fh.dirty || fh.lastWriteError != nil) {
 		if fh.lastWriteError != nil {
 			err = fh.lastWriteError
 			fh.resetToKnownSize()
@@ -638,41 +1794,185 @@ func (fh *FileHandle) FlushFile() (err error) {
 		return
 	}
 
+	fh.inode.mu.Lock()
+	file := fh.inode.fileData()
+	fh.inode.mu.Unlock()
+
+	seq := atomic.AddUint64(&file.flushSeq, 1)
+	file.flushMu.Lock()
+	defer file.flushMu.Unlock()
+
+	if seq < file.flushedSeq {
+		fh.inode.logFuse("FlushFile superseded by a later flush", seq,
+			file.flushedSeq)
+		fh.discardWrites()
+		return
+	}
+
 	fs := fh.inode.fs
+	created := fh.inode.KnownSize == nil
+
+	// before anything that could write the object, so the event
+	// is in the order of the requests for this key. A rename while
+	// we flush comes after it
+	_, eventKey := fh.inode.cloud()
+	ticket := fs.events.reserve(eventKey)
+	defer ticket.cancel()
+
+	// charge the quota up front so we don't commit anything we
+	// aren't allowed to
+	var quotaBytes, quotaObjects int64
+	quotaCharged := false
 
 	// abort mpu on error
 	defer func() {
 		if err != nil {
-			if fh.mpuId != nil {
-				go func() {
-					_, _ = fh.cloud.MultipartBlobAbort(fh.mpuId)
-					fh.mpuId = nil
-				}()
+			if quotaCharged {
+				fs.quota.Credit(quotaBytes, quotaObjects)
 			}
 
+			// parts may still be uploading if we didn't
+			// get to wait for them
+			fh.mpuWG.Wait()
 			fh.resetToKnownSize()
+
+			if fh.canResume(err) {
+				fh.inode.logFuse("FlushFile failed, the next one resumes",
+					fh.flushRetries, err)
+				fh.resumeErr = err
+				fh.lastWriteError = err
+				return
+			}
+
+			if fh.flushRetries != 0 {
+				// we gave up, the handle stays failed
+				fh.lastWriteError = err
+			}
+			fh.dropPendingParts()
+			if fh.mpuId != nil {
+				fh.abortMPU()
+			}
 		} else {
 			if fh.dirty {
-				// don't unset this if we never actually flushed
-				size := fh.inode.Attributes.Size
+				// don't unset this if we never actually
+				// flushed. What we wrote, other handles may be
+				// writing something else
+				size := uint64(fh.nextWriteOffset)
+
+				fh.inode.mu.Lock()
+				fh.inode.Attributes.Size = size
 				fh.inode.KnownSize = &size
 				fh.inode.Invalid = false
+				file.readBlocks = nil
+				// what we wrote replaced it
+				file.truncated = false
+				fh.inode.mu.Unlock()
+
+				fh.publishFlushEvent(ticket, eventKey, created, size)
+				file.flushedSeq = seq
+				fh.inode.noteWritten()
 			}
 			fh.dirty = false
 		}
 
 		fh.writeInit = sync.Once{}
 		fh.nextWriteOffset = 0
+		fh.appendOffset = 0
 		fh.lastPartId = 0
+		fh.mpuErr = nil
+		fh.resumeErr = nil
+		fh.flushRetries = 0
+		fh.flushFailedAt = time.Time{}
 	}()
 
-	if fh.lastPartId == 0 {
-		return fh.flushSmallFile()
+	if fh.resumeErr != nil {
+		if fs.flags.FlushRetryAge != 0 &&
+			time.Since(fh.flushFailedAt) > fs.flags.FlushRetryAge {
+			// too late, abort it
+			err = fh.resumeErr
+			return
+		}
+
+		fh.inode.logFuse("FlushFile resuming", fh.flushRetries, fh.resumeErr)
+		fh.resumeErr = nil
+		fh.lastWriteError = nil
+		fh.mpuErr = nil
+	}
+
+	if !created && fs.flags.NoRecreateDeleted && fh.deletedRemotely() {
+		fh.lastWriteError = syscall.ESTALE
+		err = fh.lastWriteError
+		return
+	}
+
+	ifMatch := fh.expectedETag()
+	if ifMatch != nil && !fh.cloud.Capabilities().ConditionalWrite {
+		fh.lastWriteError = fh.checkConflict(*ifMatch)
+		if fh.lastWriteError != nil {
+			err = fh.lastWriteError
+			return
+		}
+		ifMatch = nil
+	}
+	ifNotExists := fh.expectNew()
+	if ifNotExists && !fh.cloud.Capabilities().ConditionalCreate {
+		fh.lastWriteError = fh.checkConflict("")
+		if fh.lastWriteError != nil {
+			err = fh.lastWriteError
+			return
+		}
+		ifNotExists = false
+	}
+
+	quotaBytes = fh.nextWriteOffset
+	if created {
+		quotaObjects = 1
+	} else {
+		quotaBytes -= int64(*fh.inode.KnownSize)
+	}
+	err = fs.quota.Charge(quotaBytes, quotaObjects)
+	if err != nil {
+		return
 	}
+	quotaCharged = true
 
+	if fh.appendOffset != 0 {
+		// a PUT would lose what we are appending to, even a
+		// small append goes through the upload
+		err = fh.waitForCreateMPU()
+		if err != nil {
+			return
+		}
+	} else if fh.lastPartId == 0 && uint64(fh.nextWriteOffset) < fh.multipartThreshold() {
+		// we may have begun a multipart upload for what
+		// turned out to be a small file
+		fh.mpuWG.Wait()
+		if fh.mpuId != nil {
+			fh.abortMPU()
+		}
+		return fh.flushSmallFile(ifMatch, ifNotExists)
+	} else if fh.lastPartId == 0 {
+		// past --multipart-threshold, but all of it is in the
+		// first part
+		err = fh.waitForCreateMPU()
+		if err != nil {
+			return
+		}
+	}
+
+	// the filled parts have been uploading all along, we only
+	// have to wait for the ones still in flight
 	fh.mpuWG.Wait()
 
+	if fh.mpuError() == nil {
+		// what the flush we are resuming left
+		fh.setMPUError(fh.addPendingParts())
+	}
+
+	fh.lastWriteError = fh.mpuError()
 	if fh.lastWriteError != nil {
+		// backends that check when the upload begins
+		fh.lastWriteError = fh.conflictError(fh.lastWriteError, ifMatch, ifNotExists)
 		return fh.lastWriteError
 	}
 
@@ -680,30 +1980,96 @@ func (fh *FileHandle) FlushFile() (err error) {
 		return
 	}
 
-	nParts := fh.lastPartId
 	if fh.buf != nil {
-		// upload last part
-		nParts++
-		err = fh.mpuPartNoSpawn(fh.buf, nParts, fh.nextWriteOffset, true)
+		// upload last part, if it fails it's kept with the
+		// other pending ones
+		fh.lastPartId++
+		buf := fh.buf
+		fh.buf = nil
+		fh.inode.fs.dirtyBytes.add(uint64(buf.Len()))
+		err = fh.mpuPartNoSpawn(fh.writeContext(), buf, fh.lastPartId, fh.nextWriteOffset, true)
 		if err != nil {
 			return
 		}
-		fh.buf = nil
 	}
 
-	_, err = fh.cloud.MultipartBlobCommit(fh.mpuId)
+	fh.mpuId.IfMatch = ifMatch
+	fh.mpuId.IfNotExists = ifNotExists
+	fh.mpuId.Context = fh.writeContext()
+	resp, err := fh.cloud.MultipartBlobCommit(fh.mpuId)
 	if err != nil {
+		err = fh.conflictError(err, ifMatch, ifNotExists)
 		return
 	}
+	if resp.ETag != nil {
+		fh.inode.mu.Lock()
+		fh.inode.etag = *resp.ETag
+		fh.inode.mu.Unlock()
+		fh.readETag = resp.ETag
+	}
 
+	fs.liveUploads.Remove(fh.mpuId)
 	fh.mpuId = nil
 
 	// we want to get key from inode because the file could have been renamed
 	_, key := fh.inode.cloud()
 	if *fh.mpuName != key {
 		// the file was renamed
-		err = fh.inode.renameObject(fs, PUInt64(uint64(fh.nextWriteOffset)), *fh.mpuName, *fh.inode.FullName())
+		err = fh.inode.renameObject(fh.writeContext(), fs, PUInt64(uint64(fh.nextWriteOffset)),
+			*fh.mpuName, key)
+	}
+
+	return
+}
+
+// SyncFile makes sure what was written so far has been sent, without
+// finishing the upload like FlushFile does. The parts that are still
+// uploading are waited for, and on backends that take parts of any
+// size, what's buffered is sent as a part. On the others that has to
+// wait until close, as the last part, so this fails with ENOTSUP
+// rather than say it was sent
+func (fh *FileHandle) SyncFile() (err error) {
+	return fh.SyncFileWithContext(nil)
+}
+
+// SyncFileWithContext is SyncFile for a fuse op, the requests it
+// starts carry its trace id
+func (fh *FileHandle) SyncFileWithContext(ctx context.Context) (err error) {
+	fh.writeMu.Lock()
+	defer fh.writeMu.Unlock()
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	fh.writeTrace = TraceId(ctx)
+	defer func() { fh.writeTrace = "" }()
+
+	if !fh.dirty || fh.lastWriteError != nil {
+		return fh.lastWriteError
+	}
+
+	if fh.buf != nil && fh.buf.Len() != 0 && fh.cloud.Capabilities().AnyPartSize {
+		if fh.lastPartId < MAX_SYNC_PARTS {
+			err = fh.uploadCurrentBuf(false)
+			if err != nil {
+				return
+			}
+		} else if fh.lastPartId == MAX_SYNC_PARTS {
+			fh.inode.errFuse("SyncFile: too many parts, the rest is sent at close",
+				fh.lastPartId)
+		}
 	}
 
+	if fh.lastPartId != 0 {
+		fh.mpuWG.Wait()
+		fh.lastWriteError = fh.mpuError()
+		if fh.lastWriteError != nil {
+			return fh.lastWriteError
+		}
+	}
+
+	if fh.buf != nil && fh.buf.Len() != 0 {
+		fh.inode.logFuse("SyncFile: buffered until close", fh.buf.Len())
+		return syscall.ENOTSUP
+	}
 	return
 }
@@ -0,0 +1,1265 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// slowBackend keeps multipart uploads in memory and takes latency
+// to answer every request, like a far away bucket would
+type slowBackend struct {
+	memBackend
+	latency time.Duration
+	// this part fails, after the ones behind it are uploaded. Only
+	// the first failTimes times if that's set
+	failPart  uint32
+	failTimes int
+	// commits fail this many times
+	failCommit int
+	// failed parts and commits can be tried again
+	resumable bool
+	// fsync can send a part smaller than the buffer
+	anyPartSize bool
+	maxPartSize uint64
+	// of the object we read, which is a SeqReader
+	size uint64
+	// end responses after this fraction of what they promised, the
+	// first time a range is asked for, or always
+	cut       float64
+	cutAlways bool
+
+	// someone else deleted the object
+	deleted bool
+	// keep what was PUT last
+	keepPut bool
+	put     []byte
+	// of the object, and if PutBlob checks IfMatch and IfNotExists
+	// against it
+	etag        string
+	conditional bool
+
+	parts     map[uint32]int
+	failed    int
+	gets      int
+	puts      int
+	begun     int
+	aborted   int
+	committed int
+	// parts being added now, and the most there were at once
+	adding    int
+	maxAdding int
+}
+
+func (b *slowBackend) Capabilities() *Capabilities {
+	return &Capabilities{
+		Name:               "slow",
+		ConditionalWrite:   b.conditional,
+		ConditionalCreate:  b.conditional,
+		ResumableMultipart: b.resumable,
+		AnyPartSize:        b.anyPartSize,
+		MaxMultipartSize:   b.maxPartSize,
+	}
+}
+
+func (b *slowBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	time.Sleep(b.latency)
+	b.mu.Lock()
+	b.gets++
+	deleted := b.deleted
+	b.mu.Unlock()
+
+	if deleted {
+		return nil, syscall.ENOENT
+	}
+
+	count := b.size - param.Start
+	if param.Count != 0 && param.Count < count {
+		count = param.Count
+	}
+	body := io.LimitReader(&SeqReader{cur: int64(param.Start)}, int64(count))
+	if b.cut != 0 && (b.cutAlways || param.IfMatch == nil) {
+		body = io.LimitReader(body, int64(float64(count)*b.cut))
+	}
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				ETag: PString("\"etag\""),
+				Size: count,
+			},
+		},
+		Body: ioutil.NopCloser(body),
+	}, nil
+}
+
+func (b *slowBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	time.Sleep(b.latency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.deleted {
+		return nil, syscall.ENOENT
+	}
+	out := &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:  &param.Key,
+			Size: b.size,
+		},
+	}
+	if b.etag != "" {
+		out.ETag = PString(b.etag)
+	}
+	return out, nil
+}
+
+func (b *slowBackend) delete() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deleted = true
+}
+
+func (b *slowBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	var data []byte
+	if b.keepPut {
+		var err error
+		data, err = ioutil.ReadAll(param.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	time.Sleep(b.latency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conditional && param.IfMatch != nil && quoteETag(*param.IfMatch) != b.etag {
+		return nil, syscall.EBUSY
+	}
+	if b.conditional && param.IfNotExists && !b.deleted {
+		return nil, syscall.EBUSY
+	}
+	b.puts++
+	if b.keepPut {
+		b.put = data
+	}
+	if b.etag != "" {
+		b.etag = fmt.Sprintf("\"put%v\"", b.puts)
+		return &PutBlobOutput{ETag: PString(b.etag)}, nil
+	}
+	return &PutBlobOutput{}, nil
+}
+
+func (b *slowBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	time.Sleep(b.latency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.begun++
+	b.parts = make(map[uint32]int)
+	return &MultipartBlobCommitInput{Key: &param.Key}, nil
+}
+
+func (b *slowBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	b.mu.Lock()
+	b.adding++
+	b.maxAdding = MaxInt(b.maxAdding, b.adding)
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.adding--
+		b.mu.Unlock()
+	}()
+
+	// only the size is kept, so a big file doesn't take its size in
+	// memory here
+	n, err := io.Copy(ioutil.Discard, param.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.PartNumber == b.failPart {
+		b.mu.Lock()
+		fail := b.failTimes == 0 || b.failed < b.failTimes
+		b.failed++
+		b.mu.Unlock()
+
+		if fail {
+			time.Sleep(3 * b.latency)
+			return nil, syscall.EIO
+		}
+	}
+	time.Sleep(b.latency)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.parts[param.PartNumber] = int(n)
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (b *slowBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.aborted++
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (b *slowBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	time.Sleep(b.latency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failCommit != 0 {
+		b.failCommit--
+		return nil, syscall.EAGAIN
+	}
+	b.committed++
+	return &MultipartBlobCommitOutput{}, nil
+}
+
+func (b *slowBackend) numParts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.parts)
+}
+
+func (b *slowBackend) waitFor(counter *int, n int) bool {
+	for i := 0; i < 100; i++ {
+		b.mu.Lock()
+		done := *counter >= n
+		b.mu.Unlock()
+		if done {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+type FileTest struct {
+	cloud *slowBackend
+}
+
+var _ = Suite(&FileTest{})
+
+func (s *FileTest) SetUpTest(t *C) {
+	s.cloud = &slowBackend{latency: 50 * time.Millisecond}
+}
+
+func newTestInode(cloud StorageBackend) *Inode {
+	fs := newTestFs(cloud, nil)
+	return NewInode(fs, fs.testRoot(), PString("file"))
+}
+
+func newTestFileHandle(cloud StorageBackend) *FileHandle {
+	return NewFileHandle(newTestInode(cloud), fuseops.OpMetadata{})
+}
+
+func writeTestFile(fh *FileHandle, size int) (err error) {
+	chunk := make([]byte, 128*1024)
+	for off := 0; off < size; off += len(chunk) {
+		err = fh.WriteFile(int64(off), chunk[:MinInt(len(chunk), size-off)])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *FileTest) TestWritePipelined(t *C) {
+	fh := newTestFileHandle(s.cloud)
+
+	// not begun until the first part is full
+	t.Assert(writeTestFile(fh, 3*1024*1024), IsNil)
+	t.Assert(s.cloud.waitFor(&s.cloud.begun, 1), Equals, false)
+	t.Assert(fh.lastPartId, Equals, uint32(0))
+
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 13*1024*1024)), IsNil)
+	t.Assert(fh.lastPartId, Equals, uint32(3))
+	t.Assert(s.cloud.waitFor(&s.cloud.begun, 1), Equals, true)
+
+	// parts are uploaded without waiting for flush
+	for i := 0; i < 100 && s.cloud.numParts() != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Assert(s.cloud.numParts(), Equals, 3)
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 4)
+	t.Assert(s.cloud.parts[4], Equals, 1024*1024)
+	t.Assert(s.cloud.committed, Equals, 1)
+	t.Assert(s.cloud.aborted, Equals, 0)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) TestWriteBoundedMemory(t *C) {
+	s.cloud.latency = 5 * time.Millisecond
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MaxPartsInFlight = 2
+
+	// like a pipe, we don't know how big it will be
+	const size = 1024 * 1024 * 1024
+	var maxUsed uint64
+	chunk := make([]byte, 128*1024)
+	for off := 0; off < size; off += len(chunk) {
+		t.Assert(fh.WriteFile(int64(off), chunk), IsNil)
+		maxUsed = MaxUInt64(maxUsed, fh.poolHandle.Stats().UsedBytes)
+	}
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 205)
+	t.Assert(s.cloud.committed, Equals, 1)
+
+	t.Assert(s.cloud.maxAdding <= 2, Equals, true)
+	// the parts in flight and the one being written
+	t.Assert(maxUsed <= 3*DEFAULT_WRITE_BUFFER_SIZE, Equals, true,
+		Commentf("%v", maxUsed))
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) TestWriteWaitsForPartUnlocked(t *C) {
+	s.cloud.latency = 200 * time.Millisecond
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MaxPartsInFlight = 1
+
+	t.Assert(writeTestFile(fh, 5*1024*1024), IsNil)
+	t.Assert(fh.lastPartId, Equals, uint32(1))
+
+	// the second part waits for the first
+	done := make(chan error)
+	go func() {
+		done <- fh.WriteFile(fh.nextWriteOffset, make([]byte, 5*1024*1024))
+	}()
+	for fh.partsInFlight.Take(1, false) {
+		fh.partsInFlight.Return(1)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// but not with the handle locked
+	locked := make(chan struct{})
+	go func() {
+		fh.mu.Lock()
+		fh.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the handle is locked while the write waits")
+	}
+
+	t.Assert(<-done, IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 2)
+}
+
+func (s *FileTest) TestWriteSmallNoBegin(t *C) {
+	fh := newTestFileHandle(s.cloud)
+
+	// more than half a part, but it still fits in one
+	t.Assert(writeTestFile(fh, 4*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.begun, Equals, 0)
+	t.Assert(s.cloud.numParts(), Equals, 0)
+	t.Assert(s.cloud.aborted, Equals, 0)
+}
+
+func (s *FileTest) TestWriteSmallCheap(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.Cheap = true
+
+	t.Assert(writeTestFile(fh, 4*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.begun, Equals, 0)
+}
+
+func (s *FileTest) TestWriteBufferSize(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.PartSize = 8 * 1024 * 1024
+	// only for backends that take parts of any size
+	fh.inode.fs.flags.WriteBufferSize = 1024 * 1024
+
+	t.Assert(writeTestFile(fh, 20*1024*1024), IsNil)
+	t.Assert(fh.lastPartId, Equals, uint32(2))
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{
+		1: 8 * 1024 * 1024,
+		2: 8 * 1024 * 1024,
+		3: 4 * 1024 * 1024,
+	})
+
+	s.cloud.anyPartSize = true
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.PartSize = 8 * 1024 * 1024
+	fh.inode.fs.flags.WriteBufferSize = 1024 * 1024
+	t.Assert(writeTestFile(fh, 3*1024*1024+10), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{
+		1: 1024 * 1024,
+		2: 1024 * 1024,
+		3: 1024 * 1024,
+		4: 10,
+	})
+}
+
+func (s *FileTest) TestMultipartThreshold(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MultipartThreshold = 12 * 1024 * 1024
+
+	// more than a part, but still one PUT
+	t.Assert(writeTestFile(fh, 10*1024*1024), IsNil)
+	t.Assert(fh.lastPartId, Equals, uint32(0))
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.committed, Equals, 0)
+
+	// the first part is the threshold, the rest are parts
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MultipartThreshold = 12 * 1024 * 1024
+	t.Assert(writeTestFile(fh, 20*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{
+		1: 12 * 1024 * 1024,
+		2: 5 * 1024 * 1024,
+		3: 3 * 1024 * 1024,
+	})
+	t.Assert(s.cloud.committed, Equals, 1)
+}
+
+func (s *FileTest) TestMultipartThresholdSmall(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MultipartThreshold = 1024 * 1024
+
+	t.Assert(writeTestFile(fh, 2*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{1: 2 * 1024 * 1024})
+	t.Assert(s.cloud.committed, Equals, 1)
+
+	// smaller than that is still a PUT
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.MultipartThreshold = 1024 * 1024
+	t.Assert(writeTestFile(fh, 1000), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+}
+
+func (s *FileTest) TestCheckPartSize(t *C) {
+	flags := &FlagStorage{}
+	t.Assert(checkPartSize(s.cloud, flags), IsNil)
+
+	s.cloud.maxPartSize = 100 * 1024 * 1024
+	flags.PartSize = 200 * 1024 * 1024
+	t.Assert(checkPartSize(s.cloud, flags), NotNil)
+	flags.PartSize = 8 * 1024 * 1024
+	t.Assert(checkPartSize(s.cloud, flags), IsNil)
+	// not what this backend uses
+	flags.WriteBufferSize = 200 * 1024 * 1024
+	t.Assert(checkPartSize(s.cloud, flags), IsNil)
+	s.cloud.anyPartSize = true
+	t.Assert(checkPartSize(s.cloud, flags), NotNil)
+	flags.WriteBufferSize = 0
+	flags.MultipartThreshold = 200 * 1024 * 1024
+	t.Assert(checkPartSize(s.cloud, flags), NotNil)
+}
+
+func (s *FileTest) TestMaxFileSize(t *C) {
+	const MB = 1024 * 1024
+	t.Assert(maxFileSize(5*MB, 0), Equals, uint64((1000*5+1000*25+8000*125)*MB))
+	t.Assert(maxFileSize(200*MB, 0), Equals, uint64(10000*200*MB))
+	// parts don't grow past what the backend takes
+	t.Assert(maxFileSize(5*MB, 20*MB), Equals, uint64((1000*5+9000*20)*MB))
+}
+
+func (s *FileTest) TestSyncFile(t *C) {
+	s.cloud.anyPartSize = true
+	fh := newTestFileHandle(s.cloud)
+
+	// nothing to do
+	t.Assert(fh.SyncFile(), IsNil)
+	t.Assert(s.cloud.begun, Equals, 0)
+
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.SyncFile(), IsNil)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{1: 1024})
+
+	// and we go on writing
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 6*1024*1024)), IsNil)
+	t.Assert(fh.SyncFile(), IsNil)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{
+		1: 1024,
+		2: 5 * 1024 * 1024,
+		3: 1024 * 1024,
+	})
+
+	t.Assert(fh.SyncFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 3)
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 3)
+	t.Assert(s.cloud.committed, Equals, 1)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) TestSyncFileMinPartSize(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.Cheap = true
+
+	// has to wait to be the last part, which isn't what fsync
+	// promises
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.SyncFile(), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.begun, Equals, 0)
+
+	// but the full ones are sent
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 6*1024*1024)), IsNil)
+	t.Assert(fh.SyncFile(), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{1: 5 * 1024 * 1024})
+
+	// and there's nothing else to wait for
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 4*1024*1024-1024)), IsNil)
+	t.Assert(fh.SyncFile(), IsNil)
+	t.Assert(s.cloud.parts, DeepEquals, map[uint32]int{
+		1: 5 * 1024 * 1024,
+		2: 5 * 1024 * 1024,
+	})
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 2)
+	t.Assert(s.cloud.committed, Equals, 1)
+}
+
+func (s *FileTest) TestWriteSkipAhead(t *C) {
+	s.cloud.keepPut = true
+	fh := newTestFileHandle(s.cloud)
+
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	// what was written so far is flushed before failing
+	t.Assert(fh.WriteFile(2048, []byte{1}), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.put, HasLen, 1024)
+	t.Assert(*fh.inode.KnownSize, Equals, uint64(1024))
+
+	// and the handle stays failed
+	t.Assert(fh.FlushFile(), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.puts, Equals, 1)
+}
+
+func (s *FileTest) TestWriteErrorAfterLaterParts(t *C) {
+	s.cloud.failPart = 2
+	fh := newTestFileHandle(s.cloud)
+
+	t.Assert(writeTestFile(fh, 21*1024*1024), IsNil)
+	t.Assert(fh.lastPartId, Equals, uint32(4))
+
+	err := fh.FlushFile()
+	t.Assert(err, Equals, syscall.EIO)
+	// parts behind the failed one made it, but that's not enough
+	_, ok := s.cloud.parts[3]
+	t.Assert(ok, Equals, true)
+	t.Assert(s.cloud.committed, Equals, 0)
+	t.Assert(s.cloud.waitFor(&s.cloud.aborted, 1), Equals, true)
+
+	// the handle stays failed
+	t.Assert(fh.WriteFile(0, []byte{1}), Equals, syscall.EIO)
+	t.Assert(fh.FlushFile(), Equals, syscall.EIO)
+}
+
+func (s *FileTest) TestWriteErrorBeforeFlush(t *C) {
+	s.cloud.failPart = 1
+	fh := newTestFileHandle(s.cloud)
+
+	t.Assert(writeTestFile(fh, 6*1024*1024), IsNil)
+	// for the first part to fail
+	fh.mpuWG.Wait()
+
+	// the next write finds out
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, []byte{1}), Equals, syscall.EIO)
+	t.Assert(fh.FlushFile(), Equals, syscall.EIO)
+	t.Assert(s.cloud.committed, Equals, 0)
+}
+
+func (s *FileTest) TestWriteSizeHint(t *C) {
+	// rewriting a 4MB file with O_TRUNC, so no multipart upload
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.KnownSize = PUInt64(4 * 1024 * 1024)
+	fh.inode.setSizeHint(0)
+	t.Assert(writeTestFile(fh, 4*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.begun, Equals, 0)
+
+	// truncated to 18MB first, begin right away
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.setSizeHint(18 * 1024 * 1024)
+	t.Assert(fh.WriteFile(0, make([]byte, 4096)), IsNil)
+	t.Assert(s.cloud.waitFor(&s.cloud.begun, 1), Equals, true)
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 18*1024*1024-4096)), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.numParts(), Equals, 4)
+	t.Assert(s.cloud.committed, Equals, 1)
+	// the hint is only good for one write
+	t.Assert(fh.inode.file.sizeHint, Equals, uint64(0))
+}
+
+func (s *FileTest) TestWriteWrongSizeHint(t *C) {
+	// the file grows past what it was truncated to
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.setSizeHint(1024 * 1024)
+	t.Assert(writeTestFile(fh, 13*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(s.cloud.begun, Equals, 1)
+	t.Assert(s.cloud.numParts(), Equals, 3)
+	t.Assert(s.cloud.parts[3], Equals, 3*1024*1024)
+	t.Assert(s.cloud.committed, Equals, 1)
+
+	// or turns out much smaller
+	s.cloud.begun = 0
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.setSizeHint(20 * 1024 * 1024)
+	t.Assert(writeTestFile(fh, 1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.begun, Equals, 1)
+	t.Assert(s.cloud.waitFor(&s.cloud.aborted, 1), Equals, true)
+}
+
+// writes as fast as we can to a backend that takes 50ms for every
+// request, run with -check.b
+func (s *FileTest) BenchmarkWriteSlowBackend(t *C) {
+	const SIZE = 50 * 1024 * 1024
+	t.SetBytes(SIZE)
+
+	for i := 0; i < t.N; i++ {
+		fh := newTestFileHandle(s.cloud)
+		t.Assert(writeTestFile(fh, SIZE), IsNil)
+		t.Assert(fh.FlushFile(), IsNil)
+	}
+}
+
+func readTestFile(t *C, fh *FileHandle, size uint64) {
+	fh.inode.Attributes.Size = size
+	fh.inode.KnownSize = &size
+
+	buf := make([]byte, 128*1024)
+	for off := uint64(0); off < size; off += uint64(len(buf)) {
+		n, err := fh.ReadFile(int64(off), buf)
+		t.Assert(err, IsNil)
+		t.Assert(uint64(n), Equals, MinUInt64(uint64(len(buf)), size-off))
+		for i := 0; i < n; i++ {
+			if buf[i] != byte(off+uint64(i)+1) {
+				t.Fatalf("wrong data at %v", off+uint64(i))
+			}
+		}
+	}
+}
+
+func (s *FileTest) TestReadStreaming(t *C) {
+	s.cloud.size = 3*uint64(READAHEAD_CHUNK) + 12345
+	fh := newTestFileHandle(s.cloud)
+
+	readTestFile(t, fh, s.cloud.size)
+	t.Assert(fh.seqReadAmount, Equals, s.cloud.size)
+	t.Assert(fh.buffers, HasLen, 0)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) TestReadAheadSequential(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 100 * 1024 * 1024
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.ReadAhead = 2 * uint64(READAHEAD_CHUNK)
+	fh.inode.Attributes.Size = s.cloud.size
+
+	buf := make([]byte, 128*1024)
+	read := func(off uint64) {
+		n, err := fh.ReadFile(int64(off), buf)
+		t.Assert(err, IsNil)
+		t.Assert(n, Equals, len(buf))
+		t.Assert(buf[0], Equals, byte(off+1))
+		t.Assert(buf[n-1], Equals, byte(off+uint64(n)))
+	}
+
+	off := uint64(0)
+	for i := 0; i < READAHEAD_SEQ_READS; i++ {
+		read(off)
+		off += uint64(len(buf))
+		t.Assert(fh.buffers, HasLen, 0)
+	}
+
+	// now we know, read ahead as much as we are allowed to
+	read(off)
+	t.Assert(fh.buffers, HasLen, 2)
+	t.Assert(fh.buffers[1].offset, Equals, off+uint64(READAHEAD_CHUNK))
+	off += uint64(len(buf))
+	read(off)
+
+	// jumping somewhere else means we were wrong
+	for i := 1; i < READAHEAD_MAX_MISSES; i++ {
+		off = uint64(i) * 20 * 1024 * 1024
+		for j := 0; j <= READAHEAD_SEQ_READS; j++ {
+			read(off)
+			off += uint64(len(buf))
+		}
+		t.Assert(fh.numOOORead, Equals, uint64(i))
+		t.Assert(fh.buffers, HasLen, 2)
+	}
+
+	// too many times, so we give up on this handle
+	off = 60 * 1024 * 1024
+	for j := 0; j <= 2*READAHEAD_SEQ_READS; j++ {
+		read(off)
+		off += uint64(len(buf))
+	}
+	t.Assert(fh.numOOORead, Equals, uint64(READAHEAD_MAX_MISSES))
+	t.Assert(fh.buffers, HasLen, 0)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) truncateTestInode() (*metaBackend, *Inode) {
+	cloud := &metaBackend{}
+	cloud.keepPut = true
+	cloud.metadata = EncodeMetadata(map[string][]byte{"foo": []byte("bar")})
+
+	inode := newTestInode(cloud)
+	size := uint64(1024)
+	inode.KnownSize = &size
+	inode.Attributes.Size = size
+	return cloud, inode
+}
+
+func (s *FileTest) TestTruncateOpen(t *C) {
+	cloud, inode := s.truncateTestInode()
+
+	// O_TRUNC, which the kernel does right after the open
+	fh, err := inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(inode.truncate(0), IsNil)
+	t.Assert(inode.Attributes.Size, Equals, uint64(0))
+	t.Assert(cloud.puts, Equals, 0)
+
+	// nothing was written, but it's still empty now
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(cloud.puts, Equals, 1)
+	t.Assert(cloud.put, HasLen, 0)
+	t.Assert(*inode.KnownSize, Equals, uint64(0))
+	t.Assert(DecodeMetadata(cloud.metadata), DeepEquals,
+		map[string][]byte{"foo": []byte("bar")})
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(cloud.puts, Equals, 1)
+	fh.Release()
+}
+
+func (s *FileTest) TestTruncateOpenWritten(t *C) {
+	cloud, inode := s.truncateTestInode()
+
+	fh, err := inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(inode.truncate(0), IsNil)
+	t.Assert(fh.WriteFile(0, []byte("hello")), IsNil)
+
+	// only what was written is
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(cloud.puts, Equals, 1)
+	t.Assert(string(cloud.put), Equals, "hello")
+	t.Assert(DecodeMetadata(cloud.metadata), DeepEquals,
+		map[string][]byte{"foo": []byte("bar")})
+	t.Assert(inode.file.truncated, Equals, false)
+	fh.Release()
+}
+
+func (s *FileTest) TestTruncateClosed(t *C) {
+	cloud, inode := s.truncateTestInode()
+
+	// truncate(2), no one is going to flush it
+	t.Assert(inode.truncate(0), IsNil)
+	t.Assert(cloud.puts, Equals, 1)
+	t.Assert(cloud.put, HasLen, 0)
+	t.Assert(*inode.KnownSize, Equals, uint64(0))
+	t.Assert(DecodeMetadata(cloud.metadata), DeepEquals,
+		map[string][]byte{"foo": []byte("bar")})
+
+	// already empty
+	t.Assert(inode.truncate(0), IsNil)
+	t.Assert(cloud.puts, Equals, 1)
+
+	// growing it is zeros
+	t.Assert(inode.truncate(10), IsNil)
+	t.Assert(cloud.puts, Equals, 2)
+	t.Assert(cloud.put, DeepEquals, make([]byte, 10))
+	t.Assert(*inode.KnownSize, Equals, uint64(10))
+	t.Assert(DecodeMetadata(cloud.metadata), DeepEquals,
+		map[string][]byte{"foo": []byte("bar")})
+
+	// and shrinking it to anything but 0 we can't do
+	t.Assert(inode.truncate(5), IsNil)
+	t.Assert(cloud.puts, Equals, 2)
+	t.Assert(inode.Attributes.Size, Equals, uint64(10))
+}
+
+func (s *FileTest) TestExtendRewrite(t *C) {
+	cloud, inode := s.truncateTestInode()
+	cloud.size = 1024
+
+	// can't append, so what's there is read and written again
+	t.Assert(inode.truncate(3000), IsNil)
+	t.Assert(cloud.gets, Equals, 1)
+	t.Assert(cloud.puts, Equals, 1)
+	t.Assert(cloud.put, HasLen, 3000)
+	for i := 0; i < 1024; i++ {
+		t.Assert(cloud.put[i], Equals, byte(i+1))
+	}
+	t.Assert(cloud.put[1024:], DeepEquals, make([]byte, 3000-1024))
+	t.Assert(*inode.KnownSize, Equals, uint64(3000))
+	t.Assert(DecodeMetadata(cloud.metadata), DeepEquals,
+		map[string][]byte{"foo": []byte("bar")})
+}
+
+func (s *FileTest) TestReadShortResponses(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 3*uint64(READAHEAD_CHUNK) + 12345
+	s.cloud.cut = 0.7
+
+	// streaming, then readahead, all of them cut short once
+	fh := newTestFileHandle(s.cloud)
+	readTestFile(t, fh, s.cloud.size)
+
+	// the coalesced block is complete too
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.ReadCoalesceWindow = DEFAULT_READ_COALESCE_WINDOW
+	fh.inode.Attributes.Size = s.cloud.size
+	buf := make([]byte, 4096)
+	off := uint64(DEFAULT_READ_COALESCE_WINDOW - 4096)
+	n, err := fh.ReadFile(int64(off), buf)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, len(buf))
+	t.Assert(buf[4095], Equals, byte(off+4096))
+}
+
+func (s *FileTest) TestReadShortResponsesGiveUp(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 1024 * 1024
+	s.cloud.cut = 0.7
+	s.cloud.cutAlways = true
+
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.Attributes.Size = s.cloud.size
+	buf := make([]byte, s.cloud.size)
+	_, err := fh.ReadFile(0, buf)
+	t.Assert(err, Equals, syscall.EIO)
+	// the stream hands out what it got before giving up, which
+	// is enough reads to cut over to readahead, and that gives up
+	// too
+	t.Assert(s.cloud.gets, Equals, 2*(1+SHORT_READ_RETRIES))
+}
+
+func (s *FileTest) TestConcurrentWriters(t *C) {
+	s.cloud.latency = 0
+	s.cloud.keepPut = true
+
+	a := newTestFileHandle(s.cloud)
+	b := NewFileHandle(a.inode, fuseops.OpMetadata{})
+	aData := bytes.Repeat([]byte{'a'}, 1024*1024)
+	bData := bytes.Repeat([]byte{'b'}, 512*1024)
+
+	write := func(fh *FileHandle, data []byte, wg *sync.WaitGroup) {
+		defer wg.Done()
+		for off := 0; off < len(data); off += 4096 {
+			err := fh.WriteFile(int64(off), data[off:off+4096])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go write(a, aData, &wg)
+	go write(b, bData, &wg)
+	wg.Wait()
+
+	// neither sees the other's writes
+	t.Assert(a.nextWriteOffset, Equals, int64(len(aData)))
+	t.Assert(b.nextWriteOffset, Equals, int64(len(bData)))
+
+	// b is closed after a, so it wins
+	t.Assert(a.FlushFile(), IsNil)
+	t.Assert(b.FlushFile(), IsNil)
+	t.Assert(s.cloud.put, DeepEquals, bData)
+	t.Assert(a.inode.Attributes.Size, Equals, uint64(len(bData)))
+	t.Assert(*a.inode.KnownSize, Equals, uint64(len(bData)))
+
+	// both are closed while a flush is going on, the one that
+	// waited longest mustn't commit over the other
+	wg.Add(2)
+	go write(a, aData, &wg)
+	go write(b, bData, &wg)
+	wg.Wait()
+
+	file := a.inode.file
+	file.flushMu.Lock()
+	done := make(chan error, 2)
+	go func() { done <- b.FlushFile() }()
+	for atomic.LoadUint64(&file.flushSeq) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { done <- a.FlushFile() }()
+	for atomic.LoadUint64(&file.flushSeq) != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	file.flushMu.Unlock()
+
+	t.Assert(<-done, IsNil)
+	t.Assert(<-done, IsNil)
+	t.Assert(s.cloud.put, DeepEquals, aData)
+	t.Assert(*a.inode.KnownSize, Equals, uint64(len(aData)))
+	t.Assert(a.dirty, Equals, false)
+	t.Assert(b.dirty, Equals, false)
+}
+
+func (s *FileTest) TestReadDeletedRemotely(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 4 * 1024 * 1024
+	// so the stream has to come back for the second half
+	s.cloud.cut = 0.5
+
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.Cheap = true
+	fh.inode.Parent.insertChild(fh.inode)
+	fh.inode.Attributes.Size = s.cloud.size
+	fh.inode.KnownSize = &s.cloud.size
+
+	buf := make([]byte, 128*1024)
+	off := int64(0)
+	var err error
+	for uint64(off) < s.cloud.size {
+		var n int
+		n, err = fh.ReadFile(off, buf)
+		if err != nil {
+			break
+		}
+		off += int64(n)
+		if off == int64(len(buf)) {
+			s.cloud.delete()
+		}
+	}
+
+	// what was already on the way is served, then it's stale
+	t.Assert(err, Equals, syscall.ESTALE)
+	t.Assert(off, Equals, int64(s.cloud.size/2))
+	t.Assert(fh.inode.isStale(), Equals, true)
+
+	gets := s.cloud.gets
+	_, err = fh.ReadFile(0, buf)
+	t.Assert(err, Equals, syscall.ESTALE)
+	t.Assert(s.cloud.gets, Equals, gets)
+
+	// the next lookup goes to the backend, the kernel is told to
+	// look again if it opens what it has
+	t.Assert(fh.inode.Parent.findChild("file"), IsNil)
+	_, err = fh.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, Equals, syscall.ESTALE)
+}
+
+func (s *FileTest) TestFlushDeletedRemotely(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 1024
+
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.KnownSize = &s.cloud.size
+	t.Assert(writeTestFile(fh, 1024*1024), IsNil)
+
+	// we still have all of it, so the object is written again
+	s.cloud.delete()
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(fh.inode.isStale(), Equals, false)
+}
+
+func (s *FileTest) TestFlushDeletedRemotelyNoRecreate(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 1024
+
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.NoRecreateDeleted = true
+	fh.inode.KnownSize = &s.cloud.size
+	t.Assert(writeTestFile(fh, 1024*1024), IsNil)
+
+	s.cloud.delete()
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 0)
+	t.Assert(fh.inode.isStale(), Equals, true)
+	t.Assert(fh.inode.Attributes.Size, Equals, uint64(1024))
+
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, make([]byte, 10)), Equals, syscall.ESTALE)
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 0)
+
+	// a file that is still there is overwritten as usual
+	s.cloud.deleted = false
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.NoRecreateDeleted = true
+	fh.inode.KnownSize = &s.cloud.size
+	t.Assert(writeTestFile(fh, 1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+}
+
+func (s *FileTest) TestFlushConflict(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 1024
+	s.cloud.etag = "\"v1\""
+
+	open := func(failOnConflict bool) *FileHandle {
+		fh := newTestFileHandle(s.cloud)
+		fh.inode.fs.flags.FailOnConflict = failOnConflict
+		fh.inode.KnownSize = &s.cloud.size
+		// listings give us etags without the quotes
+		fh.inode.etag = "v1"
+		t.Assert(writeTestFile(fh, 1024*1024), IsNil)
+		return fh
+	}
+
+	// nobody else wrote it
+	fh := open(true)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(fh.inode.etag, Equals, s.cloud.etag)
+
+	// someone else wrote it after we looked
+	s.cloud.etag = "\"theirs\""
+	fh = open(true)
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(fh.inode.Attributes.Size, Equals, uint64(1024))
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+
+	// the backend checks it instead of a HEAD
+	s.cloud.conditional = true
+	fh = open(true)
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 1)
+
+	// last writer wins
+	fh = open(false)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 2)
+}
+
+func (s *FileTest) TestFlushCreateConflict(t *C) {
+	s.cloud.latency = 0
+	s.cloud.etag = "\"theirs\""
+
+	create := func() *FileHandle {
+		fh := newTestFileHandle(s.cloud)
+		fh.inode.fs.flags.FailOnConflict = true
+		t.Assert(writeTestFile(fh, 1024), IsNil)
+		return fh
+	}
+
+	// someone else created it since we looked
+	fh := create()
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 0)
+
+	s.cloud.conditional = true
+	fh = create()
+	t.Assert(fh.FlushFile(), Equals, syscall.ESTALE)
+	t.Assert(s.cloud.puts, Equals, 0)
+
+	// nobody did
+	s.cloud.delete()
+	fh = create()
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 1)
+
+	// and now it's ours, so it's overwritten if it's still what
+	// we wrote
+	s.cloud.deleted = false
+	t.Assert(fh.WriteFile(0, make([]byte, 10)), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.puts, Equals, 2)
+}
+
+func (s *FileTest) TestFlushResume(t *C) {
+	s.cloud.failPart = 2
+	s.cloud.failTimes = 1
+	s.cloud.resumable = true
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.FlushRetries = 3
+
+	t.Assert(writeTestFile(fh, 21*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), Equals, syscall.EIO)
+	t.Assert(s.cloud.committed, Equals, 0)
+	t.Assert(fh.flushFailed(), Equals, true)
+	// the parts that made it are kept, and so is the one that
+	// didn't. The last one wasn't tried
+	t.Assert(s.cloud.numParts(), Equals, 3)
+	t.Assert(fh.pendingParts, HasLen, 1)
+
+	// until it's flushed again
+	t.Assert(fh.WriteFile(fh.nextWriteOffset, []byte{1}), Equals, syscall.EIO)
+
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.begun, Equals, 1)
+	t.Assert(s.cloud.committed, Equals, 1)
+	t.Assert(s.cloud.aborted, Equals, 0)
+	t.Assert(s.cloud.failed, Equals, 2)
+	t.Assert(*fh.inode.KnownSize, Equals, uint64(21*1024*1024))
+
+	total := 0
+	for _, n := range s.cloud.parts {
+		total += n
+	}
+	t.Assert(total, Equals, 21*1024*1024)
+	t.Assert(fh.pendingParts, HasLen, 0)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *FileTest) TestFlushResumeGiveUp(t *C) {
+	s.cloud.latency = 0
+	s.cloud.failCommit = 100
+	s.cloud.resumable = true
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.FlushRetries = 2
+
+	t.Assert(writeTestFile(fh, 6*1024*1024), IsNil)
+	// the first flush, and one retry
+	for i := 0; i < 2; i++ {
+		t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+		t.Assert(fh.flushFailed(), Equals, true)
+		t.Assert(s.cloud.aborted, Equals, 0)
+	}
+
+	t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+	t.Assert(fh.flushFailed(), Equals, false)
+	t.Assert(s.cloud.waitFor(&s.cloud.aborted, 1), Equals, true)
+	t.Assert(s.cloud.failCommit, Equals, 100-3)
+
+	// and it stays failed
+	t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+	t.Assert(s.cloud.failCommit, Equals, 100-3)
+	t.Assert(s.cloud.puts, Equals, 0)
+
+	// too late to resume
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.FlushRetries = 2
+	fh.inode.fs.flags.FlushRetryAge = 50 * time.Millisecond
+	t.Assert(writeTestFile(fh, 6*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+	time.Sleep(100 * time.Millisecond)
+	t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+	t.Assert(s.cloud.failCommit, Equals, 100-4)
+	t.Assert(s.cloud.waitFor(&s.cloud.aborted, 2), Equals, true)
+
+	// not resumed without retries
+	fh = newTestFileHandle(s.cloud)
+	t.Assert(writeTestFile(fh, 6*1024*1024), IsNil)
+	t.Assert(fh.FlushFile(), Equals, syscall.EAGAIN)
+	t.Assert(fh.flushFailed(), Equals, false)
+	t.Assert(s.cloud.waitFor(&s.cloud.aborted, 3), Equals, true)
+}
+
+// reads a file backwards 4KB at a time, returns the number of
+// requests it took
+func (s *FileTest) readBackwards(t *C, window uint64) int {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.ReadCoalesceWindow = window
+	fh.inode.Attributes.Size = s.cloud.size
+	s.cloud.gets = 0
+
+	buf := make([]byte, 4096)
+	for off := int64(s.cloud.size) - 4096; off >= 0; off -= 4096 {
+		n, err := fh.ReadFile(off, buf)
+		t.Assert(err, IsNil)
+		t.Assert(n, Equals, 4096)
+		t.Assert(buf[0], Equals, byte(off+1))
+		t.Assert(buf[4095], Equals, byte(off+4096))
+	}
+	return s.cloud.gets
+}
+
+func (s *FileTest) TestReadCoalesce(t *C) {
+	s.cloud.latency = 0
+	s.cloud.size = 4 * 1024 * 1024
+
+	gets := s.readBackwards(t, 0)
+	t.Assert(gets, Equals, 1024)
+
+	coalescedGets := s.readBackwards(t, DEFAULT_READ_COALESCE_WINDOW)
+	t.Assert(coalescedGets, Equals, 4)
+	t.Assert(gets/coalescedGets >= 100, Equals, true)
+}
+
+func (s *FileTest) TestReadCoalesceConcurrent(t *C) {
+	s.cloud.size = 4 * 1024 * 1024
+	inode := newTestInode(s.cloud)
+	inode.fs.flags.ReadCoalesceWindow = DEFAULT_READ_COALESCE_WINDOW
+	inode.Attributes.Size = s.cloud.size
+	tgid := int32(1234)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		// threads of a process each opening the file
+		fh := NewFileHandle(inode, fuseops.OpMetadata{})
+		fh.Tgid = &tgid
+
+		wg.Add(1)
+		go func(fh *FileHandle, off int64) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			n, err := fh.ReadFile(off, buf)
+			t.Assert(err, IsNil)
+			t.Assert(n, Equals, 4096)
+			t.Assert(buf[0], Equals, byte(off+1))
+		}(fh, int64(4096*(i+1)))
+	}
+	wg.Wait()
+
+	// everyone waited for the same block
+	t.Assert(s.cloud.gets, Equals, 1)
+}
+
+// sequential reads from a backend that takes 50ms to answer, run
+// with -check.b
+func (s *FileTest) BenchmarkReadSlowBackend(t *C) {
+	const SIZE = 200 * 1024 * 1024
+	t.SetBytes(SIZE)
+	s.cloud.size = SIZE
+
+	for i := 0; i < t.N; i++ {
+		fh := newTestFileHandle(s.cloud)
+		readTestFile(t, fh, SIZE)
+		for _, b := range fh.buffers {
+			b.Close()
+		}
+	}
+}
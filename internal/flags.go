@@ -23,7 +23,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"text/template"
 	"time"
@@ -49,6 +51,7 @@ func init() {
 
 USAGE:
    {{.Name}} {{if .Flags}}[global options]{{end}} bucket[:prefix] mountpoint
+   {{.Name}} {{if .Flags}}[global options]{{end}} --fsck [fsck options] bucket[:prefix]
    {{if .Version}}
 VERSION:
    {{.Version}}
@@ -70,6 +73,9 @@ AWS S3 OPTIONS:
    {{end}}
 MISC OPTIONS:
    {{range category .Flags "misc"}}{{.}}
+   {{end}}
+FSCK OPTIONS:
+   {{range category .Flags "fsck"}}{{.}}
    {{end}}{{end}}{{if .Copyright }}
 COPYRIGHT:
    {{.Copyright}}
@@ -106,6 +112,12 @@ func NewApp() (app *cli.App) {
 				Usage: "Additional system-specific mount options. Be careful!",
 			},
 
+			cli.BoolFlag{
+				Name: "backend-read-only",
+				Usage: "Never change anything in the bucket, even for callers " +
+					"of the api package. Implied by -o ro",
+			},
+
 			cli.StringFlag{
 				Name: "cache",
 				Usage: "Directory to use for data cache. " +
@@ -114,6 +126,20 @@ func NewApp() (app *cli.App) {
 					"(ex: --cache \"--free:10%:$HOME/cache\") (default: off)",
 			},
 
+			cli.StringFlag{
+				Name: "disk-cache-dir",
+				Usage: "Keep blocks of what's read in this directory, and read " +
+					"them from there until the file changes. Unlike --cache " +
+					"this doesn't need catfs (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "disk-cache-size",
+				Value: DEFAULT_DISK_CACHE_SIZE_MB,
+				Usage: "How many MB --disk-cache-dir can have, the blocks read " +
+					"longest ago are removed first",
+			},
+
 			cli.IntFlag{
 				Name:  "dir-mode",
 				Value: 0755,
@@ -138,6 +164,155 @@ func NewApp() (app *cli.App) {
 				Usage: "GID owner of all inodes.",
 			},
 
+			cli.BoolFlag{
+				Name: "enable-perm-metadata",
+				Usage: "Keep chmod in the object's metadata, and use the mode, uid " +
+					"and gid metadata (as s3fs writes them) instead of the above. " +
+					"Lookups HEAD every file for it",
+			},
+
+			cli.BoolFlag{
+				Name: "preserve-mtime",
+				Usage: "Keep the mtime that utimens sets, as rsync does, in the " +
+					"object's metadata and show it instead of when the file was " +
+					"uploaded. Lookups HEAD every file for it",
+			},
+
+			cli.BoolFlag{
+				Name: "use-backend-acls",
+				Usage: "On ADLv2 accounts with a hierarchical namespace, show " +
+					"each path's own permissions instead of the above, and " +
+					"chmod them",
+			},
+
+			cli.StringSliceFlag{
+				Name: "acl-user-map",
+				Usage: "With --use-backend-acls, show paths owned by this AAD " +
+					"object id or name as this uid, for example " +
+					"<object id>=1000. Can be repeated",
+			},
+
+			cli.StringSliceFlag{
+				Name:  "acl-group-map",
+				Usage: "Like --acl-user-map, for owning groups and gids",
+			},
+
+			cli.BoolFlag{
+				Name: "exclude-apple-double",
+				Usage: "Hide and refuse to create AppleDouble (._*) files and " +
+					"com.apple.* xattrs (default: on for macOS)",
+			},
+
+			cli.BoolFlag{
+				Name:  "exclude-ds-store",
+				Usage: "Hide and refuse to create .DS_Store files (default: on for macOS)",
+			},
+
+			cli.BoolFlag{
+				Name:  "exclude-volume-icon",
+				Usage: "Hide and refuse to create .VolumeIcon.icns (default: on for macOS)",
+			},
+
+			cli.StringSliceFlag{
+				Name: "hide-pattern",
+				Usage: "Keep files whose name matches this glob, like '._*' or " +
+					".DS_Store, only in memory: they are never uploaded, left " +
+					"out of listings, and looking up one that isn't there " +
+					"doesn't ask the backend. Can be repeated",
+			},
+
+			cli.StringFlag{
+				Name:  "symlink-metadata-key",
+				Value: "goofys-symlink-target",
+				Usage: "Store symlinks as empty objects with their target in this metadata key, " +
+					"empty to not support symlinks",
+			},
+
+			cli.BoolFlag{
+				Name: "undelete",
+				Usage: "On azure with soft delete, getfattr -n user.goofys.deleted " +
+					"on a directory lists the deleted blobs in it that can be " +
+					"restored, and setfattr -n user.goofys.undelete -v <name> " +
+					"restores one. Reading and writing names to the hidden " +
+					RESTORE_FILE + " in a directory does the same",
+			},
+
+			cli.BoolFlag{
+				Name: "list-deleted",
+				Usage: "On azure with soft delete, list the deleted blobs along " +
+					"with the others, as files without permissions that can't " +
+					"be read until they are restored (default: off)",
+			},
+
+			cli.Uint64Flag{
+				Name: "write-quota-bytes",
+				Usage: "Fail with EDQUOT when files written through this mount " +
+					"would add up to more than this many bytes (default: unlimited)",
+			},
+
+			cli.Uint64Flag{
+				Name: "write-quota-objects",
+				Usage: "Fail with EDQUOT when this mount would create more than " +
+					"this many objects (default: unlimited)",
+			},
+
+			cli.Float64Flag{
+				Name:  "write-quota-soft-limit",
+				Value: QUOTA_SOFT_LIMIT,
+				Usage: "Warn once usage passes this fraction of a write quota",
+			},
+
+			cli.StringFlag{
+				Name: "write-quota-state",
+				Usage: "File to persist write quota usage and limits in across " +
+					"remounts (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "snapshots",
+				Usage: "Expose versions of the bucket as read-only point in time " +
+					"copies under /" + SNAPSHOT_DIR + " (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name:  "snapshot-granularity",
+				Value: 24 * time.Hour,
+				Usage: "Interval between listed snapshots",
+			},
+
+			cli.IntFlag{
+				Name:  "snapshot-count",
+				Value: 30,
+				Usage: "Number of snapshots to list",
+			},
+
+			cli.BoolFlag{
+				Name: "snapshot-visible",
+				Usage: "Show " + SNAPSHOT_DIR + " when listing the root, which " +
+					"means recursive operations will walk all the snapshots (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "enable-versioned-view",
+				Usage: "Every directory gets a hidden, read-only " + VERSIONS_DIR +
+					" with a directory for each file in it, which has every " +
+					"version of the file in it (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "dir-mtime-from-children",
+				Usage: "The mtime of a directory is that of its newest child, or " +
+					"when a child was last removed through this mount, so backup " +
+					"tools can skip directories that didn't change (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "escape-invalid-names",
+				Usage: "Show keys that aren't valid file names, like ones with a " +
+					"newline or a backslash or a . or .. in their path, with the " +
+					"bad characters %-escaped. They are skipped otherwise (default: off)",
+			},
+
 			/////////////////////////
 			// S3
 			/////////////////////////
@@ -149,6 +324,13 @@ func NewApp() (app *cli.App) {
 					" Possible values: http://127.0.0.1:8081/",
 			},
 
+			cli.StringSliceFlag{
+				Name: "request-header",
+				Usage: "Add this header to every request, as <name>=<value>, " +
+					"for gateways that want a tenant or routing header. " +
+					"Can be repeated",
+			},
+
 			cli.StringFlag{
 				Name:  "region",
 				Value: s3Default.Region,
@@ -163,6 +345,19 @@ func NewApp() (app *cli.App) {
 				Usage: "Whether to allow access to requester-pays buckets (default: off)",
 			},
 
+			cli.BoolFlag{
+				Name: "respect-object-lock",
+				Usage: "Check Object Lock retention and legal holds before removing " +
+					"or truncating a file, and fail with EPERM without sending " +
+					"anything if it's locked. Costs a HEAD each (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "anonymous",
+				Usage: "Don't sign requests, for public buckets. The mount is read-only. " +
+					"Without credentials this is detected (default: off)",
+			},
+
 			cli.StringFlag{
 				Name:  "storage-class",
 				Value: s3Default.StorageClass,
@@ -180,6 +375,18 @@ func NewApp() (app *cli.App) {
 				Usage: "Set Content-Type according to file extension and /etc/mime.types (default: off)",
 			},
 
+			cli.StringFlag{
+				Name: "mime-types",
+				Usage: "Content-Types of extensions from this `file`, in the mime.types " +
+					"format, taking precedence over the built-in ones. Implies --use-content-type",
+			},
+
+			cli.StringFlag{
+				Name: "content-type-default",
+				Usage: "Content-Type of files whose extension isn't known, instead " +
+					"of what the backend defaults to. Implies --use-content-type",
+			},
+
 			/// http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectPUT.html
 			/// See http://docs.aws.amazon.com/AmazonS3/latest/dev/UsingServerSideEncryption.html
 			cli.BoolFlag{
@@ -193,9 +400,17 @@ func NewApp() (app *cli.App) {
 				Value: "",
 			},
 
+			cli.StringSliceFlag{
+				Name: "sse-kms-prefix",
+				Usage: "Encrypt what's written under this prefix of the bucket " +
+					"with another KMS key than --sse-kms, as <prefix>=<key-id>. " +
+					"The prefix is a directory, and the deepest one a file is " +
+					"in wins. Can be repeated",
+			},
+
 			cli.StringFlag{
 				Name:  "sse-c",
-				Usage: "Enable server-side encryption using this base64-encoded key (default: off)",
+				Usage: "Enable server-side encryption with a customer-provided key (SSE-C), either this base64-encoded 256-bit `key` or a file that has it (default: off)",
 				Value: "",
 			},
 
@@ -211,6 +426,48 @@ func NewApp() (app *cli.App) {
 				Usage: "Enable subdomain mode of S3",
 			},
 
+			/////////////////////////
+			// GCS
+			/////////////////////////
+
+			cli.BoolFlag{
+				Name: "gcs",
+				Usage: "Use the GCS json api instead of the S3 interop, with the " +
+					"Application Default Credentials. Implied by gs://bucket (default: off)",
+			},
+
+			/////////////////////////
+			// Azure
+			/////////////////////////
+
+			cli.StringFlag{
+				Name: "credentials-command",
+				Usage: "Sign ADLv1 and ADLv2 requests with the token this `command` " +
+					"prints as json, {\"access_token\": ..., \"expires_on\": ...}. " +
+					"It's run again before the token expires",
+			},
+
+			cli.DurationFlag{
+				Name:  "credentials-refresh",
+				Value: 5 * time.Minute,
+				Usage: "Run --credentials-command again when the token expires sooner than this",
+			},
+
+			/////////////////////////
+			// WebHDFS
+			/////////////////////////
+
+			cli.StringFlag{
+				Name: "webhdfs-user",
+				Usage: "Make webhdfs:// requests as this `user` (default: " +
+					"$HADOOP_USER_NAME or the current user)",
+			},
+
+			cli.StringFlag{
+				Name:  "webhdfs-delegation-token",
+				Usage: "Authenticate webhdfs:// requests with this delegation `token` instead",
+			},
+
 			/////////////////////////
 			// Tuning
 			/////////////////////////
@@ -225,6 +482,15 @@ func NewApp() (app *cli.App) {
 				Usage: "Assume all directory objects (\"dir/\") exist (default: off)",
 			},
 
+			cli.StringFlag{
+				Name:  "dir-marker-style",
+				Value: "slash",
+				Usage: "What mkdir creates: \"none\", a \"dir/\" object (\"slash\")," +
+					" one with s3fs' content type (\"s3fs\") or \"dir_$folder$\" (\"hadoop\")." +
+					" \"dir_$folder$\" objects are taken for dirs with any of them," +
+					" hadoop also looks them up",
+			},
+
 			cli.DurationFlag{
 				Name:  "stat-cache-ttl",
 				Value: time.Minute,
@@ -237,10 +503,333 @@ func NewApp() (app *cli.App) {
 				Usage: "How long to cache name -> file/dir mappings in directory " +
 					"inodes.",
 			},
+
+			cli.DurationFlag{
+				Name:  "neg-cache-ttl",
+				Value: DEFAULT_NEG_CACHE_TTL,
+				Usage: "How long to remember that a name wasn't found, so that " +
+					"looking it up again doesn't ask the backend. Creating it " +
+					"here clears it, 0 to not cache",
+			},
+
+			cli.StringSliceFlag{
+				Name: "cache-ttl-override",
+				Usage: "Use a different --stat-cache-ttl and --type-cache-ttl " +
+					"for a path under the mount point and what's in it, for " +
+					"example incoming=0s or archive=12h. The longest match " +
+					"wins. Can be repeated",
+			},
+
+			cli.DurationFlag{
+				Name:  "statfs-cache-ttl",
+				Value: 5 * time.Minute,
+				Usage: "How long to cache the bucket usage that df shows, on " +
+					"backends that can tell (ADLv1)",
+			},
 			cli.DurationFlag{
 				Name:  "http-timeout",
 				Value: 30 * time.Second,
-				Usage: "Set the timeout on HTTP requests to S3",
+				Usage: "Set the timeout on each HTTP request to the backend",
+			},
+
+			cli.DurationFlag{
+				Name: "op-timeout",
+				Usage: "Give up on a request to the backend, retries included, " +
+					"with ETIMEDOUT after this long (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-retries",
+				Value: 5,
+				Usage: "How many times to send again a part of a multipart upload to " +
+					"Azure that failed because the server was busy or it timed out",
+			},
+
+			cli.IntFlag{
+				Name: "http-max-idle-conns, max-idle-conns",
+				Usage: "How many idle connections to keep open in total " +
+					"(default: same as --http-max-idle-conns-per-host)",
+			},
+
+			cli.IntFlag{
+				Name:  "http-max-idle-conns-per-host, max-idle-conns-per-host",
+				Value: DEFAULT_MAX_IDLE_CONNS_PER_HOST,
+				Usage: "How many idle connections to keep open to the storage " +
+					"endpoint. Should be more than the number of parallel requests",
+			},
+
+			cli.DurationFlag{
+				Name:  "http-idle-timeout",
+				Value: DEFAULT_IDLE_CONN_TIMEOUT,
+				Usage: "How long to keep an idle connection open",
+			},
+
+			cli.DurationFlag{
+				Name:  "http-tls-handshake-timeout",
+				Value: DEFAULT_TLS_HANDSHAKE_TIMEOUT,
+				Usage: "Set the timeout on TLS handshakes",
+			},
+
+			cli.DurationFlag{
+				Name:  "http-dial-timeout, dial-timeout",
+				Value: DEFAULT_DIAL_TIMEOUT,
+				Usage: "Give up on connecting to the storage endpoint after this long",
+			},
+
+			cli.BoolFlag{
+				Name:  "no-http2, disable-http2",
+				Usage: "Don't negotiate HTTP/2 with the storage endpoint (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name:  "no-http-compression",
+				Usage: "Don't ask for gzip compressed responses (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name: "hedge-delay",
+				Usage: "If a small read hasn't been answered after this long, " +
+					"send it again and take whichever answers first. " +
+					"Something close to the p95 latency of the bucket works " +
+					"well (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "hedge-max-size",
+				Value: DEFAULT_HEDGE_MAX_SIZE,
+				Usage: "Only hedge reads of up to this many bytes",
+			},
+
+			cli.IntFlag{
+				Name:  "hedge-percent",
+				Value: DEFAULT_HEDGE_PERCENT,
+				Usage: "Hedge at most this percent of reads",
+			},
+
+			cli.BoolFlag{
+				Name: "adaptive-retry",
+				Usage: "Send fewer reads and writes at once when the backend " +
+					"throttles us, and more again as they go through",
+			},
+
+			cli.IntFlag{
+				Name: "max-data-requests",
+				Usage: "How many GETs, PUTs and uploaded parts can be sent " +
+					"at once, apart from the rest so a big read doesn't " +
+					"hold up stat and ls (default: no limit)",
+			},
+
+			cli.IntFlag{
+				Name: "max-metadata-requests",
+				Usage: "How many HEADs, listings, deletes and renames can " +
+					"be sent at once (default: no limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "delete-concurrency",
+				Value: DEFAULT_DELETE_CONCURRENCY,
+				Usage: "Number of batches of deletes to run at once when " +
+					"removing a tree through the control socket, " +
+					"or with --batch-unlink",
+			},
+
+			cli.BoolFlag{
+				Name: "batch-unlink",
+				Usage: "Return from unlink before the object is deleted, and " +
+					"delete in batches. Makes `rm -rf` much faster, but an " +
+					"unlink that fails later is only logged",
+			},
+
+			cli.IntFlag{
+				Name:  "rename-parallelism",
+				Value: DEFAULT_RENAME_PARALLELISM,
+				Usage: "Number of objects to copy at once when renaming a " +
+					"directory on backends without real directories",
+			},
+
+			cli.IntFlag{
+				Name:  "adl-append-chunk",
+				Value: ADLV1_MAX_APPEND,
+				Usage: "Split an ADLv1 upload that's rejected as too large into " +
+					"appends of this many bytes",
+			},
+
+			cli.IntFlag{
+				Name:  "copy-part-size",
+				Value: DEFAULT_COPY_PART_SIZE,
+				Usage: "On ADLv2, which can't copy on the server, copies read " +
+					"and append ranges of this many bytes, two at a time",
+			},
+
+			cli.BoolFlag{
+				Name: "check-read-integrity",
+				Usage: "When a read gets a whole object, hash it on the way " +
+					"and fail with EIO if it doesn't match what the backend " +
+					"says it should be: the ETag of objects S3 didn't " +
+					"upload in parts, x-amz-checksum-*, or Content-MD5 on " +
+					"azure (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "no-recreate-deleted",
+				Usage: "If someone else deletes a file while it's open for " +
+					"writing here, fail the flush with ESTALE instead of " +
+					"writing the file again. Costs a HEAD per flush",
+			},
+
+			cli.BoolFlag{
+				Name: "fail-on-conflict, detect-write-conflicts",
+				Usage: "If someone else changed a file since it was last " +
+					"looked up here, or created one we are creating, fail " +
+					"the flush with ESTALE instead of overwriting their " +
+					"change. Uses conditional writes on AWS S3, azure, GCS " +
+					"and ADLv2, elsewhere it costs a HEAD per flush and is " +
+					"best effort",
+			},
+
+			cli.IntFlag{
+				Name:  "flush-retries",
+				Value: 3,
+				Usage: "When a multipart upload fails in a way that may go away, " +
+					"keep it so the next close() or fsync() of the file only " +
+					"uploads what's missing. Give up after this many. 0 to " +
+					"abort it right away",
+			},
+
+			cli.DurationFlag{
+				Name:  "flush-retry-age",
+				Value: 10 * time.Minute,
+				Usage: "Don't resume an upload that first failed longer ago than this",
+			},
+
+			cli.IntFlag{
+				Name: "raw-consistency-retries",
+				Usage: "For stores without read-after-write consistency like " +
+					"Ceph RGW: when a file we wrote isn't found, try the lookup " +
+					"or read again this many times before believing it's gone. " +
+					"Files we didn't write aren't retried (default: 0)",
+			},
+
+			cli.DurationFlag{
+				Name:  "raw-consistency-window",
+				Value: 10 * time.Second,
+				Usage: "How long after we write a file --raw-consistency-retries applies",
+			},
+
+			cli.BoolFlag{
+				Name: "abandon-interrupted-flush",
+				Usage: "Return EINTR right away when close() is interrupted " +
+					"and let the upload finish in the background. By default " +
+					"the interrupt is ignored so errors are still returned",
+			},
+
+			cli.DurationFlag{
+				Name:  "drain-timeout",
+				Value: 30 * time.Second,
+				Usage: "On SIGTERM or SIGINT, how long to wait for open files " +
+					"to be flushed. Uploads still going after that are aborted " +
+					"and the mount is unmounted",
+			},
+
+			cli.BoolFlag{
+				Name: "no-mpu-cleanup",
+				Usage: "Don't abort abandoned multipart uploads under the mount " +
+					"prefix. Useful if many writers share the bucket and a " +
+					"lifecycle rule takes care of them",
+			},
+
+			cli.DurationFlag{
+				Name:  "mpu-cleanup-interval",
+				Value: DEFAULT_MPU_CLEANUP_INTERVAL,
+				Usage: "How often to look for abandoned multipart uploads",
+			},
+
+			cli.DurationFlag{
+				Name:  "mpu-cleanup-age",
+				Value: DEFAULT_MPU_CLEANUP_AGE,
+				Usage: "Only abort multipart uploads started longer ago than this",
+			},
+
+			cli.StringSliceFlag{
+				Name: "map-error",
+				Usage: "Return a different errno for an http status or " +
+					"provider error code, for example 503=EIO or " +
+					"SlowDown=EAGAIN. Can be repeated",
+			},
+
+			cli.IntFlag{
+				Name: "multipart-part-size",
+				Usage: "Collect sequential writes into parts of this many bytes before " +
+					"uploading them, at least 5MB and at most what the backend takes. " +
+					"Past 1000 and 2000 parts they grow to 25MB and 125MB so big " +
+					"files fit (default: 5MB, 20MB on ADLv1)",
+			},
+
+			cli.IntFlag{
+				Name: "write-buffer-size",
+				Usage: "On backends that take parts of any size (all but S3), " +
+					"collect sequential writes into this many bytes before sending " +
+					"them as a part, instead of --multipart-part-size. Smaller ones " +
+					"are sent sooner, bigger ones in fewer requests " +
+					"(default: --multipart-part-size)",
+			},
+
+			cli.IntFlag{
+				Name: "multipart-threshold",
+				Usage: "Upload files of at least this many bytes in parts, smaller " +
+					"ones with one request. Files up to it are kept in memory " +
+					"until they are closed (default: --multipart-part-size)",
+			},
+
+			cli.IntFlag{
+				Name: "max-dirty-bytes",
+				Usage: "Writes wait, in the order they came, once this many bytes " +
+					"of parts are waiting to be uploaded. Can go over by a part " +
+					"per file being written (default: off)",
+			},
+
+			cli.IntFlag{
+				Name: "max-parts-in-flight",
+				Usage: "Writes to a file wait once this many of its parts are " +
+					"being uploaded, which bounds the memory a file being " +
+					"written takes to one more part than this (default: as " +
+					"many as are uploaded at once, 16)",
+			},
+
+			cli.IntFlag{
+				Name: "max-cached-inodes",
+				Usage: "Drop the least recently used files and directories that " +
+					"the kernel doesn't have and that aren't open once more than " +
+					"this many are cached. They are looked up again when needed " +
+					"(default: off)",
+			},
+
+			cli.IntFlag{
+				Name: "read-ahead-mb",
+				Usage: "Once a file is being read sequentially, read this many " +
+					"MB ahead of it in parallel (default: 400)",
+			},
+
+			cli.IntFlag{
+				Name:  "read-coalesce-window",
+				Value: DEFAULT_READ_COALESCE_WINDOW,
+				Usage: "Serve small reads that aren't sequential from aligned " +
+					"blocks of this many bytes, fetched once. 0 to disable",
+			},
+
+			cli.IntFlag{
+				Name: "list-prefetch",
+				Usage: "When listing a directory, also list up to this many of " +
+					"its subdirectories in the background to speed up " +
+					"directory walks, at the cost of listings that may never " +
+					"be needed (default: off)",
+			},
+
+			cli.IntFlag{
+				Name: "readdir-max-pages-ahead",
+				Usage: "List up to this many pages of a directory ahead of what " +
+					"readdir has returned. 0 to list a page only once it's " +
+					"needed (default: 0)",
 			},
 
 			/////////////////////////
@@ -257,10 +846,74 @@ func NewApp() (app *cli.App) {
 				Usage: "Enable S3-related debugging output.",
 			},
 
+			cli.StringFlag{
+				Name:  "log-format",
+				Value: "text",
+				Usage: "text, or json for one object per line. Fuse ops and the " +
+					"backend requests they cause log the same trace id with " +
+					"--debug_fuse and --debug_s3 or --debug_adl",
+			},
+
+			cli.BoolFlag{
+				Name: "debug_adl",
+				Usage: "Enable ADLv1 and ADLv2 debugging output, including the " +
+					"request made at mount to check the account.",
+			},
+
 			cli.BoolFlag{
 				Name:  "f",
 				Usage: "Run goofys in foreground.",
 			},
+
+			cli.StringFlag{
+				Name: "control-socket",
+				Usage: "Listen for control commands on this unix socket. " +
+					"`events' streams file system changes as json (default: off)",
+			},
+
+			cli.StringFlag{
+				Name: "metrics-listen",
+				Usage: "Serve prometheus metrics of backend requests on " +
+					"http://`ADDR`/metrics, e.g. 127.0.0.1:9167 (default: off)",
+			},
+
+			/////////////////////////
+			// fsck
+			/////////////////////////
+
+			cli.BoolFlag{
+				Name: "fsck",
+				Usage: "Check bucket[:prefix] for what goofys left behind " +
+					"instead of mounting it, takes no mountpoint",
+			},
+
+			cli.BoolFlag{
+				Name:  "fix-markers",
+				Usage: "With --fsck, delete directory markers with nothing under them.",
+			},
+
+			cli.BoolFlag{
+				Name:  "fix-mpu",
+				Usage: "With --fsck, abort abandoned multipart uploads.",
+			},
+
+			cli.BoolFlag{
+				Name: "check-metadata",
+				Usage: "With --fsck, look for metadata written by older versions. " +
+					"Takes a HEAD per object.",
+			},
+
+			cli.BoolFlag{
+				Name: "fix-metadata",
+				Usage: "With --fsck, rewrite metadata written by older versions, " +
+					"implies --check-metadata.",
+			},
+
+			cli.DurationFlag{
+				Name:  "mpu-age",
+				Value: DEFAULT_MPU_CLEANUP_AGE,
+				Usage: "With --fsck, multipart uploads older than this are abandoned.",
+			},
 		},
 	}
 
@@ -271,18 +924,34 @@ func NewApp() (app *cli.App) {
 
 	flagCategories = map[string]string{}
 
-	for _, f := range []string{"region", "sse", "sse-kms", "sse-c", "storage-class", "acl", "requester-pays"} {
+	for _, f := range []string{"region", "sse", "sse-kms", "sse-kms-prefix", "sse-c", "storage-class", "acl", "requester-pays", "respect-object-lock", "anonymous"} {
 		flagCategories[f] = "aws"
 	}
 
-	for _, f := range []string{"cheap", "no-implicit-dir", "stat-cache-ttl", "type-cache-ttl", "http-timeout"} {
+	for _, f := range []string{"cheap", "no-implicit-dir", "dir-marker-style", "stat-cache-ttl", "type-cache-ttl", "neg-cache-ttl", "cache-ttl-override", "statfs-cache-ttl", "http-timeout", "op-timeout",
+		"max-retries",
+		"http-max-idle-conns, max-idle-conns", "http-max-idle-conns-per-host, max-idle-conns-per-host",
+		"http-idle-timeout", "http-tls-handshake-timeout", "http-dial-timeout, dial-timeout", "no-http2, disable-http2",
+		"no-http-compression", "hedge-delay", "hedge-max-size", "hedge-percent", "adaptive-retry",
+		"max-data-requests", "max-metadata-requests", "delete-concurrency", "batch-unlink",
+		"rename-parallelism", "adl-append-chunk", "copy-part-size", "check-read-integrity",
+		"multipart-part-size", "write-buffer-size", "multipart-threshold", "max-dirty-bytes", "max-parts-in-flight", "max-cached-inodes", "read-ahead-mb", "read-coalesce-window", "list-prefetch", "readdir-max-pages-ahead", "map-error",
+		"no-recreate-deleted", "fail-on-conflict, detect-write-conflicts", "flush-retries", "flush-retry-age",
+		"raw-consistency-retries", "raw-consistency-window",
+		"abandon-interrupted-flush", "drain-timeout",
+		"no-mpu-cleanup", "mpu-cleanup-interval", "mpu-cleanup-age"} {
 		flagCategories[f] = "tuning"
 	}
 
-	for _, f := range []string{"help, h", "debug_fuse", "debug_s3", "version, v", "f"} {
+	for _, f := range []string{"help, h", "debug_fuse", "debug_s3", "debug_adl", "log-format", "version, v", "f", "control-socket",
+		"metrics-listen"} {
 		flagCategories[f] = "misc"
 	}
 
+	for _, f := range []string{"fsck", "fix-markers", "fix-mpu", "check-metadata", "fix-metadata", "mpu-age"} {
+		flagCategories[f] = "fsck"
+	}
+
 	cli.HelpPrinter = func(w io.Writer, templ string, data interface{}) {
 		w = tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
 		var tmplGet = template.Must(template.New("help").Funcs(funcMap).Parse(templ))
@@ -315,9 +984,40 @@ func parseOptions(m map[string]string, s string) {
 	return
 }
 
-// PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
-// variables into which the flags will parse.
-func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
+// boolOrDefault returns def unless the flag is explicitly specified,
+// so --flag=false can turn off a platform default
+func boolOrDefault(c *cli.Context, name string, def bool) bool {
+	if c.IsSet(name) {
+		return c.Bool(name)
+	}
+	return def
+}
+
+func loadMimeTypes(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMimeTypes(f)
+}
+
+// sseCKey sets the customer key from --sse-c, which is either the key
+// in base64 or a file that has it, so that it needn't be in ps
+func sseCKey(config *S3Config, value string) error {
+	if st, err := os.Stat(value); err == nil && st.Mode().IsRegular() {
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	return config.SetSseC(value)
+}
+
+// PopulateBackendFlags parses the flags that don't have anything to
+// do with the mount point, which is enough to talk to the bucket
+func PopulateBackendFlags(c *cli.Context) (ret *FlagStorage) {
 	flags := &FlagStorage{
 		// File system
 		MountOptions: make(map[string]string),
@@ -325,28 +1025,132 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		FileMode:     os.FileMode(c.Int("file-mode")),
 		Uid:          uint32(c.Int("uid")),
 		Gid:          uint32(c.Int("gid")),
+		PermMetadata: c.Bool("enable-perm-metadata"),
+
+		UseBackendACLs: c.Bool("use-backend-acls"),
+		PreserveMtime:  c.Bool("preserve-mtime"),
+
+		RespectObjectLock: c.Bool("respect-object-lock"),
+
+		BackendReadOnly: c.Bool("backend-read-only"),
+
+		DiskCacheDir:  c.String("disk-cache-dir"),
+		DiskCacheSize: uint64(c.Int("disk-cache-size")) * 1024 * 1024,
+
+		ExcludeAppleDouble: boolOrDefault(c, "exclude-apple-double", DEFAULT_EXCLUDE_APPLE_FILES),
+		ExcludeDSStore:     boolOrDefault(c, "exclude-ds-store", DEFAULT_EXCLUDE_APPLE_FILES),
+		ExcludeVolumeIcon:  boolOrDefault(c, "exclude-volume-icon", DEFAULT_EXCLUDE_APPLE_FILES),
+		SymlinkMetadataKey: c.String("symlink-metadata-key"),
+		Undelete:           c.Bool("undelete"),
+		ListDeleted:        c.Bool("list-deleted"),
 
 		// Tuning,
-		Cheap:        c.Bool("cheap"),
-		ExplicitDir:  c.Bool("no-implicit-dir"),
-		StatCacheTTL: c.Duration("stat-cache-ttl"),
-		TypeCacheTTL: c.Duration("type-cache-ttl"),
-		HTTPTimeout:  c.Duration("http-timeout"),
+		Cheap:          c.Bool("cheap"),
+		ExplicitDir:    c.Bool("no-implicit-dir"),
+		DirMarkerStyle: c.String("dir-marker-style"),
+		StatCacheTTL:   c.Duration("stat-cache-ttl"),
+		TypeCacheTTL:   c.Duration("type-cache-ttl"),
+		NegCacheTTL:    c.Duration("neg-cache-ttl"),
+		HTTPTimeout:    c.Duration("http-timeout"),
+		OpTimeout:      c.Duration("op-timeout"),
+		MaxRetries:     c.Int("max-retries"),
+
+		MaxIdleConns:        c.Int("http-max-idle-conns"),
+		MaxIdleConnsPerHost: c.Int("http-max-idle-conns-per-host"),
+		IdleConnTimeout:     c.Duration("http-idle-timeout"),
+		TLSHandshakeTimeout: c.Duration("http-tls-handshake-timeout"),
+		DialTimeout:         c.Duration("http-dial-timeout"),
+		NoHTTP2:             c.Bool("no-http2"),
+		NoCompression:       c.Bool("no-http-compression"),
+
+		ReadCoalesceWindow: uint64(c.Int("read-coalesce-window")),
+		ReadAhead:          uint64(c.Int("read-ahead-mb")) * 1024 * 1024,
+		PartSize:           uint64(c.Int("multipart-part-size")),
+		WriteBufferSize:    uint64(c.Int("write-buffer-size")),
+		MultipartThreshold: uint64(c.Int("multipart-threshold")),
+		MaxDirtyBytes:      uint64(c.Int("max-dirty-bytes")),
+		MaxPartsInFlight:   c.Int("max-parts-in-flight"),
+
+		MaxCachedInodes: c.Int("max-cached-inodes"),
+
+		HedgeDelay:   c.Duration("hedge-delay"),
+		HedgeMaxSize: uint64(c.Int("hedge-max-size")),
+		HedgePercent: c.Int("hedge-percent"),
+
+		AdaptiveRetry: c.Bool("adaptive-retry"),
+
+		MaxDataRequests:     c.Int("max-data-requests"),
+		MaxMetadataRequests: c.Int("max-metadata-requests"),
+
+		DeleteConcurrency: c.Int("delete-concurrency"),
+		BatchUnlink:       c.Bool("batch-unlink"),
+		RenameParallelism: c.Int("rename-parallelism"),
+		ADLv1AppendChunk:  uint64(c.Int("adl-append-chunk")),
+		CopyPartSize:      uint64(c.Int("copy-part-size")),
+
+		StatFSCacheTTL: c.Duration("statfs-cache-ttl"),
+
+		CheckReadIntegrity: c.Bool("check-read-integrity"),
+
+		NoRecreateDeleted: c.Bool("no-recreate-deleted"),
+		FailOnConflict:    c.Bool("fail-on-conflict"),
+
+		FlushRetries:            c.Int("flush-retries"),
+		FlushRetryAge:           c.Duration("flush-retry-age"),
+		RawConsistencyRetries:   c.Int("raw-consistency-retries"),
+		RawConsistencyWindow:    c.Duration("raw-consistency-window"),
+		AbandonInterruptedFlush: c.Bool("abandon-interrupted-flush"),
+		DrainTimeout:            c.Duration("drain-timeout"),
+
+		NoMPUCleanup:       c.Bool("no-mpu-cleanup"),
+		MPUCleanupInterval: c.Duration("mpu-cleanup-interval"),
+		MPUCleanupAge:      c.Duration("mpu-cleanup-age"),
 
 		// Common Backend Config
 		Endpoint:       c.String("endpoint"),
 		UseContentType: c.Bool("use-content-type"),
 
+		CredentialsCommand: c.String("credentials-command"),
+		CredentialsRefresh: c.Duration("credentials-refresh"),
+
+		WebHDFSUser:            c.String("webhdfs-user"),
+		WebHDFSDelegationToken: Secret(c.String("webhdfs-delegation-token")),
+
 		// Debugging,
 		DebugFuse:  c.Bool("debug_fuse"),
 		DebugS3:    c.Bool("debug_s3"),
+		DebugADL:   c.Bool("debug_adl"),
 		Foreground: c.Bool("f"),
+		LogFormat:  c.String("log-format"),
+
+		ControlSocket: c.String("control-socket"),
+		MetricsListen: c.String("metrics-listen"),
+
+		Snapshots:           c.Bool("snapshots"),
+		SnapshotGranularity: c.Duration("snapshot-granularity"),
+		SnapshotCount:       c.Int("snapshot-count"),
+		SnapshotVisible:     c.Bool("snapshot-visible"),
+		VersionedView:       c.Bool("enable-versioned-view"),
+
+		DirMtimeFromChildren: c.Bool("dir-mtime-from-children"),
+		EscapeInvalidNames:   c.Bool("escape-invalid-names"),
+
+		WriteQuotaBytes:   c.Uint64("write-quota-bytes"),
+		WriteQuotaObjects: c.Uint64("write-quota-objects"),
+		WriteQuotaSoft:    c.Float64("write-quota-soft-limit"),
+		WriteQuotaState:   c.String("write-quota-state"),
 	}
 
+	// listing ahead pays for requests that may never be needed, so
+	// only when asked
+	flags.ListPrefetch = c.Int("list-prefetch")
+	flags.ReaddirMaxPagesAhead = c.Int("readdir-max-pages-ahead")
+
 	// S3
 	if c.IsSet("region") || c.IsSet("requester-pays") || c.IsSet("storage-class") ||
-		c.IsSet("profile") || c.IsSet("sse") || c.IsSet("sse-kms") ||
-		c.IsSet("sse-c") || c.IsSet("acl") || c.IsSet("subdomain") {
+		c.IsSet("profile") || c.IsSet("sse") || c.IsSet("sse-kms") || c.IsSet("sse-kms-prefix") ||
+		c.IsSet("sse-c") || c.IsSet("acl") || c.IsSet("subdomain") ||
+		c.IsSet("anonymous") {
 
 		if flags.Backend == nil {
 			flags.Backend = (&S3Config{}).Init()
@@ -361,14 +1165,53 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		config.UseSSE = c.Bool("sse")
 		config.UseKMS = c.IsSet("sse-kms")
 		config.KMSKeyID = c.String("sse-kms")
-		config.SseC = c.String("sse-c")
+		for _, p := range c.StringSlice("sse-kms-prefix") {
+			idx := strings.LastIndex(p, "=")
+			if idx == -1 || idx == len(p)-1 {
+				io.WriteString(cli.ErrWriter,
+					fmt.Sprintf("Invalid value \"%v\" for --sse-kms-prefix: expecting <prefix>=<key-id>\n\n", p))
+				return nil
+			}
+			if config.KMSKeyPrefixes == nil {
+				config.KMSKeyPrefixes = make(map[string]string)
+			}
+			config.KMSKeyPrefixes[strings.TrimPrefix(p[:idx], "/")] = p[idx+1:]
+		}
+		if c.IsSet("sse-c") {
+			if err := sseCKey(config, c.String("sse-c")); err != nil {
+				io.WriteString(cli.ErrWriter,
+					fmt.Sprintf("Invalid value for --sse-c: %v\n\n", err))
+				return nil
+			}
+		}
 		config.ACL = c.String("acl")
 		config.Subdomain = c.Bool("subdomain")
+		config.Anonymous = c.Bool("anonymous")
 
 		// KMS implies SSE
 		if config.UseKMS {
 			config.UseSSE = true
 		}
+		if (config.UseSSE || config.KMSKeyPrefixes != nil) && config.SseC != "" {
+			io.WriteString(cli.ErrWriter,
+				"Invalid value for --sse-c: can't be used with --sse, --sse-kms or --sse-kms-prefix\n\n")
+			return nil
+		}
+		// requester pays needs to know who the requester is
+		if config.Anonymous && (config.RequesterPays || config.Profile != "") {
+			io.WriteString(cli.ErrWriter,
+				"Invalid value for --anonymous: can't be used with --requester-pays or --profile\n\n")
+			return nil
+		}
+	}
+
+	if c.Bool("gcs") {
+		if flags.Backend != nil {
+			io.WriteString(cli.ErrWriter,
+				"Invalid value for --gcs: can't be used with the S3 options\n\n")
+			return nil
+		}
+		flags.Backend = (&GCSConfig{}).Init()
 	}
 
 	// Handle the repeated "-o" flag.
@@ -376,6 +1219,222 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		parseOptions(flags.MountOptions, o)
 	}
 
+	if path := c.String("mime-types"); path != "" {
+		types, err := loadMimeTypes(path)
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --mime-types: %v\n\n", path, err))
+			return nil
+		}
+		flags.MimeTypes = types
+		flags.UseContentType = true
+	}
+	if c.IsSet("content-type-default") {
+		flags.ContentTypeDefault = c.String("content-type-default")
+		flags.UseContentType = true
+	}
+
+	for _, name := range []string{"acl-user-map", "acl-group-map"} {
+		for _, m := range c.StringSlice(name) {
+			owner, id, err := parseACLMapping(m)
+			if err != nil {
+				io.WriteString(cli.ErrWriter,
+					fmt.Sprintf("Invalid value \"%v\" for --%v: %v\n\n", m, name, err))
+				return nil
+			}
+			table := &flags.ACLUsers
+			if name == "acl-group-map" {
+				table = &flags.ACLGroups
+			}
+			if *table == nil {
+				*table = make(map[string]uint32)
+			}
+			(*table)[owner] = id
+		}
+	}
+
+	for _, m := range c.StringSlice("map-error") {
+		code, errno, err := ParseErrorMapping(m)
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --map-error: %v\n\n", m, err))
+			return nil
+		}
+		if flags.ErrorMap == nil {
+			flags.ErrorMap = make(map[string]syscall.Errno)
+		}
+		flags.ErrorMap[code] = errno
+	}
+
+	for _, p := range c.StringSlice("hide-pattern") {
+		if _, err := path.Match(p, ""); err != nil || p == "" || strings.Contains(p, "/") {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --hide-pattern: expecting a glob of names\n\n", p))
+			return nil
+		}
+		flags.HidePatterns = append(flags.HidePatterns, p)
+	}
+
+	for _, h := range c.StringSlice("request-header") {
+		idx := strings.Index(h, "=")
+		if idx <= 0 {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --request-header: expecting <name>=<value>\n\n", h))
+			return nil
+		}
+		if flags.RequestHeaders == nil {
+			flags.RequestHeaders = make(map[string]string)
+		}
+		flags.RequestHeaders[strings.TrimSpace(h[:idx])] = h[idx+1:]
+	}
+
+	for _, o := range c.StringSlice("cache-ttl-override") {
+		idx := strings.LastIndex(o, "=")
+		var ttl time.Duration
+		var err error
+		if idx == -1 {
+			err = fmt.Errorf("expecting <path>=<duration>")
+		} else {
+			ttl, err = time.ParseDuration(o[idx+1:])
+		}
+		if err == nil && ttl < 0 {
+			err = fmt.Errorf("can't be negative")
+		}
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --cache-ttl-override: %v\n\n", o, err))
+			return nil
+		}
+		if flags.CacheTTLOverrides == nil {
+			flags.CacheTTLOverrides = &CacheTTLOverrides{}
+		}
+		flags.CacheTTLOverrides.Set(o[:idx], ttl)
+	}
+
+	if c.IsSet("multipart-part-size") && flags.PartSize < MIN_WRITE_BUFFER_SIZE {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --multipart-part-size: must be at least %v\n\n",
+				c.Int("multipart-part-size"), MIN_WRITE_BUFFER_SIZE))
+		return nil
+	}
+
+	if c.IsSet("write-buffer-size") && c.Int("write-buffer-size") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --write-buffer-size: must be positive\n\n",
+				c.Int("write-buffer-size")))
+		return nil
+	}
+
+	if c.IsSet("multipart-threshold") && c.Int("multipart-threshold") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --multipart-threshold: must be positive\n\n",
+				c.Int("multipart-threshold")))
+		return nil
+	}
+
+	if f := flags.LogFormat; f != "" && f != "text" && f != "json" {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --log-format: must be text or json\n\n", f))
+		return nil
+	}
+
+	switch flags.DirMarkerStyle {
+	case DIR_MARKER_NONE, DIR_MARKER_SLASH, DIR_MARKER_S3FS, DIR_MARKER_HADOOP:
+	default:
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --dir-marker-style: must be none, slash, s3fs or hadoop\n\n",
+				flags.DirMarkerStyle))
+		return nil
+	}
+
+	if c.Int("max-dirty-bytes") < 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --max-dirty-bytes: must not be negative\n\n",
+				c.Int("max-dirty-bytes")))
+		return nil
+	}
+
+	if c.Int("max-parts-in-flight") < 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --max-parts-in-flight: can't be negative\n\n",
+				c.Int("max-parts-in-flight")))
+		return nil
+	}
+
+	for _, name := range []string{"max-data-requests", "max-metadata-requests"} {
+		if c.Int(name) < 0 {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --%v: must not be negative\n\n",
+					c.Int(name), name))
+			return nil
+		}
+	}
+
+	if c.Int("max-cached-inodes") < 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --max-cached-inodes: must not be negative\n\n",
+				c.Int("max-cached-inodes")))
+		return nil
+	}
+
+	if c.Int("disk-cache-size") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --disk-cache-size: must be positive\n\n",
+				c.Int("disk-cache-size")))
+		return nil
+	}
+
+	if c.IsSet("disk-cache-dir") && c.IsSet("cache") {
+		io.WriteString(cli.ErrWriter,
+			"Invalid value for --disk-cache-dir: can't be used with --cache\n\n")
+		return nil
+	}
+
+	if c.Int("adl-append-chunk") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --adl-append-chunk: must be positive\n\n",
+				c.Int("adl-append-chunk")))
+		return nil
+	}
+
+	if c.Int("copy-part-size") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --copy-part-size: must be positive\n\n",
+				c.Int("copy-part-size")))
+		return nil
+	}
+
+	if c.IsSet("read-ahead-mb") && c.Int("read-ahead-mb") <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --read-ahead-mb: must be positive\n\n",
+				c.Int("read-ahead-mb")))
+		return nil
+	}
+
+	if flags.MPUCleanupAge < MIN_MPU_CLEANUP_AGE {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --mpu-cleanup-age: must be at least %v\n\n",
+				flags.MPUCleanupAge, MIN_MPU_CLEANUP_AGE))
+		return nil
+	}
+	if flags.MPUCleanupInterval <= 0 {
+		io.WriteString(cli.ErrWriter,
+			fmt.Sprintf("Invalid value \"%v\" for --mpu-cleanup-interval: must be positive\n\n",
+				flags.MPUCleanupInterval))
+		return nil
+	}
+
+	return flags
+}
+
+// PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
+// variables into which the flags will parse.
+func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
+	flags := PopulateBackendFlags(c)
+	if flags == nil {
+		return nil
+	}
+
 	flags.MountPointArg = c.Args()[1]
 	flags.MountPoint = flags.MountPointArg
 	var err error
@@ -0,0 +1,285 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// `goofys fsck bucket[:prefix]` goes through a prefix without
+// mounting it, and reports what goofys (or a crashed goofys) tends to
+// leave behind:
+//
+// - a directory marker with nothing in it, which is also what mkdir
+//   makes, so only deleted with --fix-markers
+// - a file and a directory with the same name, which one of them
+//   hides the other. Never fixed, someone has to decide
+// - multipart uploads that were never finished or aborted
+// - metadata from before it had a version, with --check-metadata
+//   since it takes a HEAD per object
+//
+// Everything is listed in one pass without a delimiter, and reported
+// as it's found, so a huge prefix doesn't have to fit in memory
+
+const (
+	FSCK_EMPTY_MARKER  = "empty-marker"
+	FSCK_CONFLICT      = "file-dir-conflict"
+	FSCK_ABANDONED_MPU = "abandoned-mpu"
+	FSCK_OLD_METADATA  = "old-metadata"
+)
+
+type FsckOptions struct {
+	FixMarkers    bool
+	FixMPU        bool
+	CheckMetadata bool
+	FixMetadata   bool
+	// multipart uploads older than this are abandoned,
+	// DEFAULT_MPU_CLEANUP_AGE if 0
+	MPUAge time.Duration
+}
+
+type FsckAnomaly struct {
+	Type   string
+	Key    string
+	Detail string
+	Fixed  bool
+}
+
+func (a FsckAnomaly) String() string {
+	s := a.Type + "\t" + a.Key
+	if a.Detail != "" {
+		s += "\t" + a.Detail
+	}
+	if a.Fixed {
+		s += "\t(fixed)"
+	}
+	return s
+}
+
+type fsck struct {
+	cloud  StorageBackend
+	prefix string
+	opts   FsckOptions
+	report func(FsckAnomaly)
+
+	// anomalies that weren't fixed
+	remaining int
+
+	// the last key if it's a directory marker we haven't seen
+	// anything under yet
+	marker string
+	// files that something listed later can still be under, for
+	// "a" that's until we are past "a/"
+	files []string
+}
+
+// Fsck checks bucket[:prefix] and writes what it finds to out, one
+// line each. It returns how many weren't fixed
+func Fsck(bucket string, flags *FlagStorage, opts FsckOptions, out io.Writer) (int, error) {
+	spec, err := ParseBucketSpec(bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	if spec.Scheme == "gs" && flags.Backend == nil {
+		flags.Backend = (&GCSConfig{}).Init()
+	}
+
+	errorMap(flags.ErrorMap).logMapping()
+
+	cloud, err := NewBackend(spec.Bucket, flags)
+	if err != nil {
+		return 0, err
+	}
+	if c := findDiskCacheBackend(cloud); c != nil {
+		defer c.Close()
+	}
+	err = cloud.Init(spec.Prefix + RandStringBytesMaskImprSrc(32))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to access '%v': %v", spec.Bucket, err)
+	}
+
+	c := newFsck(cloud, spec.Prefix, opts, func(a FsckAnomaly) {
+		fmt.Fprintln(out, a)
+	})
+	err = c.run()
+	return c.remaining, err
+}
+
+func newFsck(cloud StorageBackend, prefix string, opts FsckOptions,
+	report func(FsckAnomaly)) *fsck {
+
+	if opts.MPUAge == 0 {
+		opts.MPUAge = DEFAULT_MPU_CLEANUP_AGE
+	}
+	return &fsck{
+		cloud:  cloud,
+		prefix: prefix,
+		opts:   opts,
+		report: report,
+	}
+}
+
+func (c *fsck) found(a FsckAnomaly) {
+	if !a.Fixed {
+		c.remaining++
+	}
+	c.report(a)
+}
+
+func (c *fsck) run() error {
+	err := c.checkUploads()
+	if err != nil {
+		return err
+	}
+
+	param := ListBlobsInput{Prefix: &c.prefix}
+	for {
+		resp, err := c.cloud.ListBlobs(&param)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range resp.Items {
+			c.checkKey(item)
+		}
+
+		if !resp.IsTruncated {
+			break
+		}
+		param.ContinuationToken = resp.NextContinuationToken
+	}
+
+	// the last one had nothing after it
+	c.checkKey(BlobItemOutput{})
+	return nil
+}
+
+// checkKey is called with every key in order, and once more with an
+// empty one at the end
+func (c *fsck) checkKey(item BlobItemOutput) {
+	key := nilStr(item.Key)
+
+	if c.marker != "" && !strings.HasPrefix(key, c.marker) {
+		c.emptyMarker(c.marker)
+	}
+	c.marker = ""
+	if key == "" {
+		return
+	}
+
+	// a file can only have something under it until we are past
+	// "a/", which sorts right before "a0"
+	files := c.files[:0]
+	for _, f := range c.files {
+		if strings.HasPrefix(key, f+"/") {
+			// and once is enough
+			c.found(FsckAnomaly{
+				Type:   FSCK_CONFLICT,
+				Key:    f,
+				Detail: "and " + key,
+			})
+		} else if key < f+"0" {
+			files = append(files, f)
+		}
+	}
+	c.files = files
+
+	if strings.HasSuffix(key, "/") {
+		if !c.cloud.Capabilities().DirBlob && key != c.prefix {
+			c.marker = key
+		}
+		return
+	}
+	c.files = append(c.files, key)
+
+	if c.opts.CheckMetadata {
+		c.checkMetadata(item)
+	}
+}
+
+func (c *fsck) emptyMarker(key string) {
+	a := FsckAnomaly{Type: FSCK_EMPTY_MARKER, Key: key}
+	if c.opts.FixMarkers {
+		_, err := c.cloud.DeleteBlob(&DeleteBlobInput{Key: key})
+		if err != nil {
+			a.Detail = fmt.Sprintf("unable to delete: %v", err)
+		} else {
+			a.Fixed = true
+		}
+	}
+	c.found(a)
+}
+
+func (c *fsck) checkMetadata(item BlobItemOutput) {
+	key := *item.Key
+	head, err := c.cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if err != nil {
+		// deleted since we listed it
+		return
+	}
+	if len(head.Metadata) == 0 || head.Metadata[METADATA_VERSION_KEY] != nil {
+		return
+	}
+
+	a := FsckAnomaly{Type: FSCK_OLD_METADATA, Key: key}
+	if c.opts.FixMetadata {
+		// copied onto itself, only if it's still what we looked at
+		_, err = c.cloud.CopyBlob(&CopyBlobInput{
+			Source:       key,
+			Destination:  key,
+			Size:         &head.Size,
+			ETag:         head.ETag,
+			Metadata:     EncodeMetadata(DecodeMetadata(head.Metadata)),
+			StorageClass: head.StorageClass,
+		})
+		if err != nil {
+			a.Detail = fmt.Sprintf("unable to rewrite: %v", err)
+		} else {
+			a.Fixed = true
+		}
+	}
+	c.found(a)
+}
+
+func (c *fsck) checkUploads() error {
+	resp, err := c.cloud.MultipartExpire(&MultipartExpireInput{
+		Prefix:    c.prefix,
+		OlderThan: c.opts.MPUAge,
+		DryRun:    !c.opts.FixMPU,
+	})
+	if err == syscall.ENOTSUP {
+		// nothing is left behind, or we can't tell
+		return nil
+	}
+	if resp != nil {
+		for _, upload := range resp.Aborted {
+			c.found(FsckAnomaly{
+				Type: FSCK_ABANDONED_MPU,
+				Key:  upload.Key,
+				Detail: fmt.Sprintf("started %v, %v bytes",
+					upload.Initiated.Format(time.RFC3339), upload.Size),
+				Fixed: c.opts.FixMPU,
+			})
+		}
+	}
+	return err
+}
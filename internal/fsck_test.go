@@ -0,0 +1,168 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// fsckBackend is a memBackend that remembers what fsck did to it
+type fsckBackend struct {
+	memBackend
+	uploads []ExpiredUpload
+
+	deleted []string
+	copied  []string
+	dryRun  bool
+}
+
+func (b *fsckBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	b.deleted = append(b.deleted, param.Key)
+	return &DeleteBlobOutput{}, nil
+}
+
+func (b *fsckBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.copied = append(b.copied, param.Destination)
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *fsckBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	if b.uploads == nil {
+		return nil, syscall.ENOTSUP
+	}
+	b.dryRun = param.DryRun
+	return &MultipartExpireOutput{Aborted: b.uploads}, nil
+}
+
+type FsckTest struct {
+	cloud *fsckBackend
+	found []FsckAnomaly
+}
+
+var _ = Suite(&FsckTest{})
+
+func (s *FsckTest) SetUpTest(t *C) {
+	s.cloud = &fsckBackend{}
+	s.found = nil
+}
+
+func (s *FsckTest) fsck(prefix string, opts FsckOptions) int {
+	c := newFsck(s.cloud, prefix, opts, func(a FsckAnomaly) {
+		s.found = append(s.found, a)
+	})
+	err := c.run()
+	if err != nil {
+		panic(err)
+	}
+	return c.remaining
+}
+
+func (s *FsckTest) keys(typ string) (keys []string) {
+	for _, a := range s.found {
+		if a.Type == typ {
+			keys = append(keys, a.Key)
+		}
+	}
+	return
+}
+
+func (s *FsckTest) TestEmptyMarkers(t *C) {
+	s.cloud.add(
+		"dir/", "dir/empty/", "dir/file", "dir/sub/", "dir/sub/file",
+		"dir/z/", "empty/",
+	)
+
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 3)
+	t.Assert(s.keys(FSCK_EMPTY_MARKER), DeepEquals,
+		[]string{"dir/empty/", "dir/z/", "empty/"})
+	t.Assert(s.cloud.deleted, IsNil)
+
+	// the prefix itself is fine to be empty
+	s.found = nil
+	t.Assert(s.fsck("empty/", FsckOptions{}), Equals, 0)
+
+	s.found = nil
+	t.Assert(s.fsck("", FsckOptions{FixMarkers: true}), Equals, 0)
+	t.Assert(s.cloud.deleted, DeepEquals, []string{"dir/empty/", "dir/z/", "empty/"})
+
+	// that's what directories are on these
+	s.found = nil
+	s.cloud.cap.DirBlob = true
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 0)
+}
+
+func (s *FsckTest) TestConflicts(t *C) {
+	// "a-b" sorts between "a" and "a/"
+	s.cloud.add(
+		"a", "a-b", "a-b/c", "a/", "a/b", "a/c", "b", "b0", "c", "c/",
+	)
+
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 4)
+	t.Assert(s.keys(FSCK_CONFLICT), DeepEquals, []string{"a-b", "a", "c"})
+	// with nothing in it, c/ is also an empty marker
+	t.Assert(s.keys(FSCK_EMPTY_MARKER), DeepEquals, []string{"c/"})
+
+	// conflicts are never fixed
+	s.found = nil
+	t.Assert(s.fsck("", FsckOptions{FixMarkers: true}), Equals, 3)
+	t.Assert(len(s.keys(FSCK_CONFLICT)), Equals, 3)
+}
+
+func (s *FsckTest) TestOldMetadata(t *C) {
+	s.cloud.add("none")
+	s.cloud.PutBlob(&PutBlobInput{
+		Key:      "new",
+		Metadata: EncodeMetadata(map[string][]byte{"k": []byte("v")}),
+	})
+	s.cloud.PutBlob(&PutBlobInput{
+		Key:      "old",
+		Metadata: map[string]*string{"k": PString("v")},
+	})
+
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 0)
+
+	t.Assert(s.fsck("", FsckOptions{CheckMetadata: true}), Equals, 1)
+	t.Assert(s.keys(FSCK_OLD_METADATA), DeepEquals, []string{"old"})
+	t.Assert(s.cloud.copied, IsNil)
+
+	s.found = nil
+	t.Assert(s.fsck("", FsckOptions{CheckMetadata: true, FixMetadata: true}), Equals, 0)
+	t.Assert(s.cloud.copied, DeepEquals, []string{"old"})
+}
+
+func (s *FsckTest) TestUploads(t *C) {
+	s.cloud.uploads = []ExpiredUpload{
+		{Key: "file", UploadId: "1", Initiated: time.Now().Add(-72 * time.Hour)},
+	}
+
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 1)
+	t.Assert(s.cloud.dryRun, Equals, true)
+	t.Assert(s.keys(FSCK_ABANDONED_MPU), DeepEquals, []string{"file"})
+
+	s.found = nil
+	t.Assert(s.fsck("", FsckOptions{FixMPU: true}), Equals, 0)
+	t.Assert(s.cloud.dryRun, Equals, false)
+	t.Assert(s.found[0].Fixed, Equals, true)
+
+	// no multipart uploads to leave behind
+	s.found = nil
+	s.cloud.uploads = nil
+	t.Assert(s.fsck("", FsckOptions{}), Equals, 0)
+}
@@ -20,10 +20,12 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -47,9 +49,20 @@ import (
 
 type Goofys struct {
 	fuseutil.NotImplementedFileSystem
+	// lookups of expired inodes that a recent listing could
+	// answer. First so that it's aligned for atomic access
+	lookupsFromListing uint64
+	// times the backend contradicted the dir cache, see
+	// reconcileDir
+	reconciledDirs uint64
+	// lookups answered with ENOENT from --neg-cache-ttl
+	lookupsNotFound uint64
+
 	bucket string
 
 	flags *FlagStorage
+	// --map-error, the backend has the same
+	errorMap
 
 	umask uint32
 
@@ -77,8 +90,10 @@ type Goofys struct {
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
 	//
-	// GUARDED_BY(mu)
-	inodes map[fuseops.InodeID]*Inode
+	// Lookups don't need mu, the table has its own locks. Inserts
+	// and removals are still done under mu, together with the
+	// changes to the tree
+	inodes *InodeTable
 
 	nextHandleID fuseops.HandleID
 	dirHandles   map[fuseops.HandleID]*DirHandle
@@ -88,7 +103,39 @@ type Goofys struct {
 	replicators *Ticket
 	restorers   *Ticket
 
+	listPrefetchers   *Ticket
+	listPrefetchQueue *Ticket
+
 	forgotCnt uint32
+	// set by Shutdown, writes fail with EROFS from then on.
+	// Updated atomically
+	draining int32
+
+	events *EventStream
+	quota  *WriteQuota
+	// parts that are not uploaded yet, see --max-dirty-bytes
+	dirtyBytes *DirtyBytes
+	// what's least recently used, see --max-cached-inodes
+	inodeCache *InodeCache
+	// for user.goofys.last-errors
+	failedRequests *FailedRequests
+
+	liveUploads liveUploads
+	mpuCleaner  *mpuCleaner
+	// nil without --batch-unlink
+	batchUnlink *BatchUnlinkBackend
+	// nil without --control-socket
+	control *ControlServer
+	// closed by Destroy, nil without --disk-cache-dir
+	diskCache *DiskCacheBackend
+	// nil without --hide-pattern
+	hidden *HiddenBackend
+
+	usage bucketUsage
+
+	// keys that aren't valid file names we warned about, see
+	// listedName
+	invalidNames sync.Map
 }
 
 var s3Log = GetLogger("s3")
@@ -101,11 +148,28 @@ func NewBackend(bucket string, flags *FlagStorage) (cloud StorageBackend, err er
 	}
 
 	if config, ok := flags.Backend.(*AZBlobConfig); ok {
-		cloud, err = NewAZBlob(bucket, config)
+		config.HTTPClient = &http.Client{
+			Transport: GetHTTPTransport(flags),
+			Timeout:   flags.HTTPTimeout,
+		}
+		config.MaxRetries = flags.MaxRetries
+		config.ListDeleted = flags.ListDeleted
+		config.RequestHeaders = flags.RequestHeaders
+		var b *AZBlob
+		b, err = NewAZBlob(bucket, config)
+		if err == nil {
+			b.errorMap = flags.ErrorMap
+			b.opTimeout = opTimeout(flags.OpTimeout)
+			cloud = b
+		}
 	} else if config, ok := flags.Backend.(*ADLv1Config); ok {
 		cloud, err = NewADLv1(bucket, flags, config)
 	} else if config, ok := flags.Backend.(*ADLv2Config); ok {
 		cloud, err = NewADLv2(bucket, flags, config)
+	} else if config, ok := flags.Backend.(*GCSConfig); ok {
+		cloud, err = NewGCS(bucket, flags, config)
+	} else if config, ok := flags.Backend.(*WebHDFSConfig); ok {
+		cloud, err = NewWebHDFS(bucket, flags, config)
 	} else if config, ok := flags.Backend.(*S3Config); ok {
 		if strings.HasSuffix(flags.Endpoint, "/storage.googleapis.com") {
 			cloud, err = NewGCS3(bucket, flags, config)
@@ -116,6 +180,41 @@ func NewBackend(bucket string, flags *FlagStorage) (cloud StorageBackend, err er
 		err = fmt.Errorf("Unknown backend config: %T", flags.Backend)
 	}
 
+	if err == nil && isReadOnlyMount(flags) {
+		cloud = NewReadOnlyBackend(cloud)
+	}
+	if err == nil && flags.MetricsListen != "" {
+		// under the hedging, so both of the hedged requests count
+		cloud = NewMetricsBackend(cloud)
+	}
+	if err == nil && flags.AdaptiveRetry {
+		// over the metrics, waiting for a slot isn't latency
+		// of the backend
+		cloud = NewAdaptiveBackend(cloud)
+	}
+	if err == nil && (flags.MaxDataRequests != 0 || flags.MaxMetadataRequests != 0) {
+		// over the metrics too, and under the hedging so a
+		// hedged GET is another data request
+		cloud = NewPriorityBackend(cloud, flags)
+	}
+	if err == nil && flags.HedgeDelay != 0 {
+		cloud = NewHedgedBackend(cloud, flags)
+	}
+	if err == nil && flags.BatchUnlink {
+		// over the hedging, a delete that's waiting isn't
+		// waiting on the backend
+		cloud = NewBatchUnlinkBackend(cloud, flags)
+	}
+	if err == nil && flags.DiskCacheDir != "" {
+		// over everything, what's cached doesn't go anywhere
+		cloud, err = NewDiskCacheBackend(cloud, bucket, flags.DiskCacheDir,
+			flags.DiskCacheSize)
+	}
+	if err == nil && len(flags.HidePatterns) != 0 {
+		// over the disk cache too, hidden files don't go anywhere
+		cloud = NewHiddenBackend(cloud, flags.HidePatterns)
+	}
+
 	return
 }
 
@@ -153,29 +252,53 @@ func ParseBucketSpec(bucket string) (spec BucketSpec, err error) {
 		}
 	}
 
-	spec.Prefix = strings.Trim(spec.Prefix, "/")
-	if spec.Prefix != "" {
-		spec.Prefix += "/"
-	}
+	spec.Prefix = normalizePrefix(spec.Prefix)
 	return
 }
 
+// normalizePrefix puts a mount prefix in the form keys are made
+// from, which is prefix + path: no empty components, and ending with
+// / unless it's empty. "/a//b" is "a/b/"
+func normalizePrefix(prefix string) string {
+	var parts []string
+	for _, p := range strings.Split(prefix, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
 func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
+	fs, _ := NewGoofysWithError(ctx, bucket, flags)
+	return fs
+}
+
+// NewGoofysWithError is NewGoofys that also says why it failed, for
+// the mount to print
+func NewGoofysWithError(ctx context.Context, bucket string, flags *FlagStorage) (*Goofys, error) {
+	return newGoofys(ctx, bucket, flags, NewBackend)
+}
+
+// newGoofys is NewGoofysWithError with the backend from newBackend,
+// tests bring their own
+func newGoofys(ctx context.Context, bucket string, flags *FlagStorage,
+	newBackend func(string, *FlagStorage) (StorageBackend, error)) (*Goofys, error) {
 	// Set up the basic struct.
 	fs := &Goofys{
-		bucket: bucket,
-		flags:  flags,
-		umask:  0122,
+		bucket:         bucket,
+		flags:          flags,
+		umask:          0122,
+		failedRequests: failedRequests,
 	}
 
 	var prefix string
 	colon := strings.Index(bucket, ":")
 	if colon != -1 {
-		prefix = bucket[colon+1:]
-		prefix = strings.Trim(prefix, "/")
-		if prefix != "" {
-			prefix += "/"
-		}
+		prefix = normalizePrefix(bucket[colon+1:])
 
 		fs.bucket = bucket[0:colon]
 		bucket = fs.bucket
@@ -185,20 +308,35 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 		s3Log.Level = logrus.DebugLevel
 	}
 
-	cloud, err := NewBackend(bucket, flags)
+	fs.errorMap = errorMap(flags.ErrorMap)
+	fs.logMapping()
+
+	cloud, err := newBackend(bucket, flags)
 	if err != nil {
 		log.Errorf("Unable to setup backend: %v", err)
-		return nil
+		return nil, fmt.Errorf("Unable to setup backend: %v", err)
 	}
-	_, fs.gcs = cloud.(*GCS3)
+	_, fs.gcs = unwrapBackend(cloud).(*GCS3)
+	fs.batchUnlink = findBatchUnlinkBackend(cloud)
+	fs.diskCache = findDiskCacheBackend(cloud)
+	fs.hidden = findHiddenBackend(cloud)
 
 	randomObjectName := prefix + (RandStringBytesMaskImprSrc(32))
 	err = cloud.Init(randomObjectName)
 	if err != nil {
 		log.Errorf("Unable to access '%v': %v", bucket, err)
-		return nil
+		return nil, fmt.Errorf("Unable to access '%v': %v", bucket, err)
+	}
+	err = checkPartSize(cloud, flags)
+	if err != nil {
+		log.Errorf("%v", err)
+		return nil, err
+	}
+	if !flags.NoMPUCleanup && !cloud.Capabilities().ReadOnly {
+		fs.mpuCleaner = newMPUCleaner(cloud, prefix, flags.MPUCleanupInterval,
+			flags.MPUCleanupAge, &fs.liveUploads)
+		go fs.mpuCleaner.Run()
 	}
-	go cloud.MultipartExpire(&MultipartExpireInput{})
 
 	now := time.Now()
 	fs.rootAttrs = InodeAttributes{
@@ -209,7 +347,11 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	fs.bufferPool = BufferPool{}.Init()
 
 	fs.nextInodeID = fuseops.RootInodeID + 1
-	fs.inodes = make(map[fuseops.InodeID]*Inode)
+	fs.inodes = NewInodeTable()
+	fs.inodeCache = NewInodeCache(fs, flags.MaxCachedInodes)
+	if fs.inodeCache != nil {
+		go fs.inodeCache.Run()
+	}
 	root := NewInode(fs, nil, PString(""))
 	root.Id = fuseops.RootInodeID
 	root.ToDir()
@@ -217,7 +359,7 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	root.dir.mountPrefix = prefix
 	root.Attributes.Mtime = fs.rootAttrs.Mtime
 
-	fs.inodes[fuseops.RootInodeID] = root
+	fs.inodes.Set(fuseops.RootInodeID, root)
 	fs.addDotAndDotDot(root)
 
 	fs.nextHandleID = 1
@@ -226,9 +368,25 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
 
 	fs.replicators = Ticket{Total: 16}.Init()
+	fs.dirtyBytes = NewDirtyBytes(flags.MaxDirtyBytes)
 	fs.restorers = Ticket{Total: 20}.Init()
+	fs.listPrefetchers = Ticket{Total: LIST_PREFETCH_CONCURRENCY}.Init()
+	fs.listPrefetchQueue = Ticket{Total: LIST_PREFETCH_QUEUE}.Init()
 
-	return fs
+	if flags.Snapshots {
+		fs.mountSnapshots(cloud, prefix)
+	}
+
+	fs.events = NewEventStream()
+
+	fs.quota, err = NewWriteQuota(flags.WriteQuotaBytes, flags.WriteQuotaObjects,
+		flags.WriteQuotaSoft, flags.WriteQuotaState)
+	if err != nil {
+		log.Errorf("Unable to setup write quota: %v", err)
+		return nil, fmt.Errorf("Unable to setup write quota: %v", err)
+	}
+
+	return fs, nil
 }
 
 // from https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang
@@ -261,16 +419,30 @@ func (fs *Goofys) SigUsr1() {
 	fs.mu.RLock()
 
 	log.Infof("forgot %v inodes", fs.forgotCnt)
-	log.Infof("%v inodes", len(fs.inodes))
+	log.Infof("%v lookups served from listings",
+		atomic.LoadUint64(&fs.lookupsFromListing))
+	log.Infof("%v lookups of recently missing names",
+		atomic.LoadUint64(&fs.lookupsNotFound))
+	log.Infof("%v inodes", fs.inodes.Len())
+	log.Infof("evicted %v inodes", fs.inodeCache.Evicted())
+	log.Infof("%v dirs reconciled after the cache was wrong",
+		atomic.LoadUint64(&fs.reconciledDirs))
+	if fs.hidden != nil {
+		log.Infof("%v requests for --hide-pattern names kept from the backend",
+			fs.hidden.Avoided())
+	}
+	if fs.mpuCleaner != nil {
+		status := fs.mpuCleaner.Status()
+		log.Infof("aborted %v abandoned multipart uploads, reclaimed %v bytes",
+			status.Aborted, status.BytesReclaimed)
+	}
 	fs.mu.RUnlock()
 	debug.FreeOSMemory()
 }
 
 // Find the given inode. Panic if it doesn't exist.
-//
-// RLOCKS_REQUIRED(fs.mu)
 func (fs *Goofys) getInodeOrDie(id fuseops.InodeID) (inode *Inode) {
-	inode = fs.inodes[id]
+	inode = fs.inodes.Get(id)
 	if inode == nil {
 		panic(fmt.Sprintf("Unknown inode: %v", id))
 	}
@@ -330,7 +502,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		mountInode := NewInode(fs, mp, &name)
 		mountInode.ToDir()
 		mountInode.dir.cloud = b.cloud
-		mountInode.dir.mountPrefix = b.prefix
+		mountInode.dir.mountPrefix = normalizePrefix(b.prefix)
 		mountInode.AttrTime = TIME_MAX
 
 		fs.mu.Lock()
@@ -350,7 +522,8 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		prev.mu.Lock()
 		defer prev.mu.Unlock()
 		prev.dir.cloud = b.cloud
-		prev.dir.mountPrefix = b.prefix
+		prev.dir.mountPrefix = normalizePrefix(b.prefix)
+		prev.dir.notFound = nil
 		prev.AttrTime = TIME_MAX
 
 	}
@@ -359,9 +532,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 }
 
 func (fs *Goofys) MountAll(mounts []*Mount) {
-	fs.mu.RLock()
 	root := fs.getInodeOrDie(fuseops.RootInodeID)
-	fs.mu.RUnlock()
 
 	for _, m := range mounts {
 		fs.mount(root, m)
@@ -369,16 +540,12 @@ func (fs *Goofys) MountAll(mounts []*Mount) {
 }
 
 func (fs *Goofys) Mount(mount *Mount) {
-	fs.mu.RLock()
 	root := fs.getInodeOrDie(fuseops.RootInodeID)
-	fs.mu.RUnlock()
 	fs.mount(root, mount)
 }
 
 func (fs *Goofys) Unmount(mountPoint string) {
-	fs.mu.RLock()
 	mp := fs.getInodeOrDie(fuseops.RootInodeID)
-	fs.mu.RUnlock()
 
 	fuseLog.Infof("Attempting to unmount %v", mountPoint)
 	path := strings.Split(strings.Trim(mountPoint, "/"), "/")
@@ -395,6 +562,29 @@ func (fs *Goofys) Unmount(mountPoint string) {
 	return
 }
 
+// Destroy is called once the kernel is done with us, after unmount
+func (fs *Goofys) Destroy() {
+	if fs.control != nil {
+		err := fs.control.Close()
+		if err != nil {
+			log.Errorf("closing control socket: %v", err)
+		}
+	}
+	// ends the event streams of the control socket too
+	fs.events.Close()
+	if fs.batchUnlink != nil {
+		// the unlinks the kernel was told are done
+		fs.batchUnlink.Close()
+	}
+	if fs.diskCache != nil {
+		err := fs.diskCache.Close()
+		if err != nil {
+			log.Errorf("closing disk cache: %v", err)
+		}
+	}
+	fs.quota.Close()
+}
+
 func (fs *Goofys) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
@@ -410,6 +600,19 @@ func (fs *Goofys) StatFS(
 	op.IoSize = 1 * 1024 * 1024 // 1MB
 	op.Inodes = INODES
 	op.InodesFree = INODES
+
+	// there's no limit to how much more we can write, but if the
+	// backend knows what's used we can at least show that
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	if root.dir.cloud == nil {
+		return
+	}
+	usage := fs.usage.get(root.dir.cloud, fs.flags.StatFSCacheTTL)
+	if usage != nil {
+		used := (usage.Bytes + BLOCK_SIZE - 1) / BLOCK_SIZE
+		op.Blocks += used
+		op.Inodes += usage.Objects
+	}
 	return
 }
 
@@ -417,14 +620,12 @@ func (fs *Goofys) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
 
-	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
 	}
 
 	return
@@ -432,9 +633,11 @@ func (fs *Goofys) GetInodeAttributes(
 
 func (fs *Goofys) GetXattr(ctx context.Context,
 	op *fuseops.GetXattrOp) (err error) {
-	fs.mu.RLock()
+	if fs.isExcludedXattr(op.Name) {
+		return ENOATTR
+	}
+
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
 	value, err := inode.GetXattr(op.Name)
 	if err != nil {
@@ -453,9 +656,7 @@ func (fs *Goofys) GetXattr(ctx context.Context,
 
 func (fs *Goofys) ListXattr(ctx context.Context,
 	op *fuseops.ListXattrOp) (err error) {
-	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
 	xattrs, err := inode.ListXattr()
 
@@ -483,55 +684,55 @@ func (fs *Goofys) ListXattr(ctx context.Context,
 
 func (fs *Goofys) RemoveXattr(ctx context.Context,
 	op *fuseops.RemoveXattrOp) (err error) {
-	fs.mu.RLock()
+	if fs.isExcludedXattr(op.Name) {
+		return ENOATTR
+	}
+
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
-	err = inode.RemoveXattr(op.Name)
+	if inode.readOnly() {
+		return syscall.EROFS
+	}
+
+	err = inode.RemoveXattrWithContext(ctx, op.Name)
 
 	return
 }
 
 func (fs *Goofys) SetXattr(ctx context.Context,
 	op *fuseops.SetXattrOp) (err error) {
-	fs.mu.RLock()
-	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
+	if fs.isExcludedXattr(op.Name) {
+		// finder info, quarantine bits and the like. We
+		// can't store them so pretend the filesystem doesn't
+		// support them
+		return syscall.ENOTSUP
+	}
 
-	err = inode.SetXattr(op.Name, op.Value, op.Flags)
-	return
-}
+	inode := fs.getInodeOrDie(op.Inode)
 
-func mapHttpError(status int) error {
-	switch status {
-	case 400:
-		return fuse.EINVAL
-	case 401:
-		return syscall.EACCES
-	case 403:
-		return syscall.EACCES
-	case 404:
-		return fuse.ENOENT
-	case 405:
-		return syscall.ENOTSUP
-	case 429:
-		return syscall.EAGAIN
-	case 500:
-		return syscall.EAGAIN
-	default:
-		return nil
+	if inode.readOnly() {
+		return syscall.EROFS
 	}
+
+	err = inode.SetXattrWithContext(ctx, op.Name, op.Value, op.Flags)
+	return
 }
 
-func mapAwsError(err error) error {
+func (m errorMap) mapAwsError(err error) error {
 	if err == nil {
 		return nil
 	}
 
 	if awsErr, ok := err.(awserr.Error); ok {
 		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			if objectLockDenied(awsErr.Code(), awsErr.Message()) {
+				return syscall.EPERM
+			}
 			// A service error occurred
-			err = mapHttpError(reqErr.StatusCode())
+			err = m.mapErrorCode(awsErr.Code())
+			if err == nil {
+				err = m.mapHttpError(reqErr.StatusCode())
+			}
 			if err != nil {
 				return err
 			} else {
@@ -539,6 +740,9 @@ func mapAwsError(err error) error {
 				return reqErr
 			}
 		} else {
+			if timedOut(awsErr.OrigErr()) {
+				return syscall.ETIMEDOUT
+			}
 			switch awsErr.Code() {
 			case "BucketRegionError":
 				// don't need to log anything, we should detect region after
@@ -580,20 +784,29 @@ func (fs *Goofys) LookUpInode(
 	op *fuseops.LookUpInodeOp) (err error) {
 
 	var inode *Inode
-	var ok bool
+	var ok, hydrate bool
 	defer func() { fuseLog.Debugf("<-- LookUpInode %v %v %v", op.Parent, op.Name, err) }()
 
-	fs.mu.RLock()
+	if fs.isExcludedName(op.Name) {
+		return fuse.ENOENT
+	}
+
 	parent := fs.getInodeOrDie(op.Parent)
-	fs.mu.RUnlock()
+	if fs.flags.VersionedView && op.Name == VERSIONS_DIR {
+		fs.addVersionsDir(parent)
+	}
+	if fs.flags.Undelete && op.Name == RESTORE_FILE {
+		fs.addRestoreFile(parent)
+	}
 
-	parent.mu.Lock()
+	parent.mu.RLock()
 	inode = parent.findChildUnlocked(op.Name)
 	if inode != nil {
 		ok = true
 		inode.Ref()
+		fs.inodeCache.touch(inode)
 
-		if expired(inode.AttrTime, fs.flags.StatCacheTTL) {
+		if expired(inode.AttrTime, inode.statCacheTTL()) || inode.needsMetadata() {
 			ok = false
 			if inode.fileHandles != 0 {
 				// we have an open file handle, object
@@ -602,25 +815,45 @@ func (fs *Goofys) LookUpInode(
 				// return what we know which is
 				// potentially more accurate
 				ok = true
+			} else if parent.listedRecently(inode) && !inode.needsMetadata() {
+				ok = true
+				atomic.AddUint64(&fs.lookupsFromListing, 1)
+			} else if parent.listedRecently(inode) {
+				// only the metadata is missing
+				hydrate = true
 			} else {
 				inode.logFuse("lookup expired")
 			}
 		}
+	} else if parent.knownMissing(op.Name) {
+		parent.mu.RUnlock()
+		atomic.AddUint64(&fs.lookupsNotFound, 1)
+		return fuse.ENOENT
 	} else {
 		ok = false
 	}
-	parent.mu.Unlock()
+	parent.mu.RUnlock()
+
+	if hydrate && fs.hydrateListed(parent, inode) {
+		ok = true
+		atomic.AddUint64(&fs.lookupsFromListing, 1)
+	}
 
 	if !ok {
 		var newInode *Inode
 
-		newInode, err = parent.LookUp(op.Name)
+		newInode, err = parent.LookUpWithContext(ctx, op.Name)
 		if err == fuse.ENOENT && inode != nil && inode.isDir() {
 			// we may not be able to look up an implicit
 			// dir if all the children are removed, so we
 			// just pretend this dir is still around
 			err = nil
 		} else if err != nil {
+			if err == fuse.ENOENT {
+				parent.mu.Lock()
+				parent.addMissing(op.Name)
+				parent.mu.Unlock()
+			}
 			if inode != nil {
 				// just kidding! pretend we didn't up the ref
 				fs.mu.Lock()
@@ -628,7 +861,7 @@ func (fs *Goofys) LookUpInode(
 
 				stale := inode.DeRef(1)
 				if stale {
-					delete(fs.inodes, inode.Id)
+					fs.inodes.Delete(inode.Id)
 					parent.removeChild(inode)
 				}
 			}
@@ -645,14 +878,30 @@ func (fs *Goofys) LookUpInode(
 				inode = newInode
 				fs.insertInode(parent, inode)
 				fs.mu.Unlock()
+			} else {
+				// the kernel gets a ref for this
+				// lookup too
+				inode.Ref()
+				fs.inodeCache.touch(inode)
 			}
 			parent.mu.Unlock()
 		} else {
 			if newInode != nil {
-				if newInode.Attributes.Mtime.IsZero() {
+				if newInode.Attributes.Mtime.IsZero() ||
+					(inode.isDir() && fs.flags.DirMtimeFromChildren &&
+						newInode.Attributes.Mtime.Before(inode.Attributes.Mtime)) {
+					// a directory's own one only if
+					// it's newer than its children
 					newInode.Attributes.Mtime = inode.Attributes.Mtime
 				}
 				inode.Attributes = newInode.Attributes
+
+				inode.mu.Lock()
+				inode.userMetadata = newInode.userMetadata
+				inode.symlink = newInode.symlink
+				inode.perm = newInode.perm
+				inode.etag = newInode.etag
+				inode.mu.Unlock()
 			}
 			inode.AttrTime = time.Now()
 		}
@@ -660,8 +909,8 @@ func (fs *Goofys) LookUpInode(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.typeCacheTTL())
 
 	return
 }
@@ -686,7 +935,8 @@ func (fs *Goofys) insertInode(parent *Inode, inode *Inode) {
 	}
 	parent.insertChildUnlocked(inode)
 	if addInode {
-		fs.inodes[inode.Id] = inode
+		fs.inodes.Set(inode.Id, inode)
+		fs.inodeCache.touch(inode)
 
 		// if we are inserting a new directory, also create
 		// the child . and ..
@@ -712,9 +962,7 @@ func (fs *Goofys) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) (err error) {
 
-	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
 	if inode.Parent != nil {
 		inode.Parent.mu.Lock()
@@ -722,15 +970,25 @@ func (fs *Goofys) ForgetInode(
 	}
 	stale := inode.DeRef(op.N)
 
+	if stale && inode.Parent != nil && inode.Parent.readdirNeeds(inode) {
+		// like what a listing adds, it's left for the inode
+		// cache to evict
+		stale = false
+	}
+
 	if stale {
 		fs.mu.Lock()
 		defer fs.mu.Unlock()
 
-		delete(fs.inodes, op.Inode)
+		fs.inodes.Delete(op.Inode)
+		fs.inodeCache.remove(inode)
 		fs.forgotCnt += 1
 
-		if inode.Parent != nil {
-			inode.Parent.removeChildUnlocked(inode)
+		if parent := inode.Parent; parent != nil {
+			parent.removeChildUnlocked(inode)
+			// what's cached of the dir isn't all of it
+			// anymore
+			parent.dir.DirTime = time.Time{}
 		}
 	}
 
@@ -789,7 +1047,7 @@ func (fs *Goofys) ReadDir(
 	defer dh.mu.Unlock()
 
 	for i := op.Offset; ; i++ {
-		e, err := dh.ReadDir(i)
+		e, err := dh.ReadDirInterruptible(ctx, i)
 		if err != nil {
 			return err
 		}
@@ -801,6 +1059,10 @@ func (fs *Goofys) ReadDir(
 			panic(fmt.Sprintf("unset inode %v", e.Name))
 		}
 
+		if fs.isUnlistedName(inode, e.Name) {
+			continue
+		}
+
 		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], makeDirEntry(e))
 		if n == 0 {
 			break
@@ -819,24 +1081,22 @@ func (fs *Goofys) ReleaseDirHandle(
 	op *fuseops.ReleaseDirHandleOp) (err error) {
 
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	dh := fs.dirHandles[op.Handle]
+	delete(fs.dirHandles, op.Handle)
+	fs.mu.Unlock()
+
+	// it takes the dir's lock, which comes before fs.mu
 	dh.CloseDir()
 
 	fuseLog.Debugln("ReleaseDirHandle", *dh.inode.FullName())
 
-	delete(fs.dirHandles, op.Handle)
-
 	return
 }
 
 func (fs *Goofys) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	fs.mu.RLock()
 	in := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
 
 	fh, err := in.OpenFile(op.Metadata)
 	if err != nil {
@@ -852,7 +1112,9 @@ func (fs *Goofys) OpenFile(
 	fs.fileHandles[handleID] = fh
 
 	op.Handle = handleID
-	op.KeepPageCache = true
+	op.KeepPageCache = fh.keepPageCache
+	// it's 0 bytes, the kernel would never read it
+	op.UseDirectIO = in.isRestoreFile()
 
 	return
 }
@@ -865,7 +1127,12 @@ func (fs *Goofys) ReadFile(
 	fh := fs.fileHandles[op.Handle]
 	fs.mu.RUnlock()
 
-	op.BytesRead, err = fh.ReadFile(op.Offset, op.Dst)
+	if fh.inode.isRestoreFile() {
+		op.BytesRead, err = fh.inode.readRestoreFile(op.Offset, op.Dst)
+		return
+	}
+
+	op.BytesRead, err = fh.ReadFileInterruptible(ctx, op.Offset, op.Dst)
 
 	return
 }
@@ -874,8 +1141,23 @@ func (fs *Goofys) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
 
-	// intentionally ignored, so that write()/sync()/write() works
-	// see https://github.com/kahing/goofys/issues/154
+	// the file isn't flushed, so that write()/sync()/write()
+	// works, see https://github.com/kahing/goofys/issues/154. We
+	// only make sure what was written has been sent
+	//
+	// except to try again a flush that failed, see --flush-retries
+	fs.mu.RLock()
+	fh := fs.fileHandles[op.Handle]
+	fs.mu.RUnlock()
+
+	if fh == nil {
+		return
+	}
+	if fh.flushFailed() {
+		err = fh.FlushFileWithContext(ctx)
+	} else {
+		err = fh.SyncFileWithContext(ctx)
+	}
 	return
 }
 
@@ -907,19 +1189,23 @@ func (fs *Goofys) FlushFile(
 		}
 	}
 
-	err = fh.FlushFile()
+	if fs.flags.AbandonInterruptedFlush && interruptDone(ctx) != nil {
+		err = fs.flushAbandonable(ctx, fh)
+	} else {
+		// the upload can't be taken back halfway, so by default an
+		// interrupt doesn't stop us from telling close() how it went
+		err = fh.FlushFileWithContext(ctx)
+	}
 	if err != nil {
 		// if we returned success from creat() earlier
 		// linux may think this file exists even when it doesn't,
 		// until TypeCacheTTL is over
 		// TODO: figure out a way to make the kernel forget this inode
-		// see TestWriteAnonymousFuse
-		fs.mu.RLock()
 		inode := fs.getInodeOrDie(op.Inode)
-		fs.mu.RUnlock()
 
 		if inode.KnownSize == nil {
 			inode.AttrTime = time.Time{}
+			inode.listGen = 0
 		}
 
 	}
@@ -927,13 +1213,49 @@ func (fs *Goofys) FlushFile(
 	return
 }
 
+// flushAbandonable returns EINTR if ctx is done before the flush is,
+// the flush carries on and only logs how it went
+func (fs *Goofys) flushAbandonable(ctx context.Context, fh *FileHandle) error {
+	done := make(chan error, 1)
+	fh.flushWG.Add(1)
+	trace := TraceOnly(ctx)
+	go func() {
+		err := fh.FlushFileWithContext(trace)
+		fh.flushWG.Done()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		fh.inode.logFuse("FlushFile interrupted, finishing in the background")
+		atomic.StoreInt32(&fh.flushAbandoned, 1)
+		go func() {
+			if err := <-done; err != nil {
+				log.Errorf("interrupted flush of %v failed: %v",
+					*fh.inode.FullName(), err)
+			}
+		}()
+		return syscall.EINTR
+	}
+}
+
 func (fs *Goofys) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	fh := fs.fileHandles[op.Handle]
-	fh.Release()
+	if atomic.LoadInt32(&fh.flushAbandoned) != 0 {
+		// don't free the buffers from under the upload
+		go func() {
+			fh.flushWG.Wait()
+			fh.Release()
+		}()
+	} else {
+		fh.Release()
+	}
 
 	fuseLog.Debugln("ReleaseFileHandle", *fh.inode.FullName(), op.Handle, fh.inode.Id)
 
@@ -948,9 +1270,20 @@ func (fs *Goofys) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
 
-	fs.mu.RLock()
+	if fs.isExcludedName(op.Name) {
+		return syscall.EPERM
+	}
+
 	parent := fs.getInodeOrDie(op.Parent)
-	fs.mu.RUnlock()
+
+	if parent.readOnly() {
+		return syscall.EROFS
+	}
+
+	err = parent.checkChildKey(op.Name, false)
+	if err != nil {
+		return
+	}
 
 	inode, fh := parent.Create(op.Name, op.Metadata)
 
@@ -964,8 +1297,8 @@ func (fs *Goofys) CreateFile(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.typeCacheTTL())
 
 	// Allocate a handle.
 	handleID := fs.nextHandleID
@@ -984,13 +1317,28 @@ func (fs *Goofys) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
 
-	fs.mu.RLock()
+	if fs.isExcludedName(op.Name) {
+		return syscall.EPERM
+	}
+
 	parent := fs.getInodeOrDie(op.Parent)
-	fs.mu.RUnlock()
+
+	if parent.readOnly() {
+		return syscall.EROFS
+	}
+
+	err = parent.checkChildKey(op.Name, true)
+	if err != nil {
+		return
+	}
 
 	// ignore op.Mode for now
-	inode, err := parent.MkDir(op.Name)
+	inode, err := parent.MkDirWithContext(ctx, op.Name)
 	if err != nil {
+		if err == syscall.EEXIST {
+			// the kernel asked because we said it didn't
+			go fs.reconcileDir(parent, "mkdir of an existing "+op.Name)
+		}
 		return err
 	}
 
@@ -1004,21 +1352,80 @@ func (fs *Goofys) MkDir(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.typeCacheTTL())
 
 	return
 }
 
+func (fs *Goofys) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+
+	if fs.isExcludedName(op.Name) {
+		return syscall.EPERM
+	}
+
+	parent := fs.getInodeOrDie(op.Parent)
+
+	if parent.readOnly() {
+		return syscall.EROFS
+	}
+
+	err = parent.checkChildKey(op.Name, false)
+	if err != nil {
+		return
+	}
+
+	inode, err := parent.CreateSymlinkWithContext(ctx, op.Name, op.Target)
+	if err != nil {
+		return err
+	}
+
+	parent.mu.Lock()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.insertInode(parent, inode)
+
+	parent.mu.Unlock()
+
+	op.Entry.Child = inode.Id
+	op.Entry.Attributes = inode.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(inode.typeCacheTTL())
+
+	return
+}
+
+func (fs *Goofys) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+
+	inode := fs.getInodeOrDie(op.Inode)
+	inode.logFuse("ReadSymlink")
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	if inode.symlink == nil {
+		return syscall.EINVAL
+	}
+	op.Target = *inode.symlink
+	return
+}
+
 func (fs *Goofys) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
 
-	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
-	fs.mu.RUnlock()
 
-	err = parent.RmDir(op.Name)
+	if parent.readOnly() || parent.findChild(op.Name).readOnly() {
+		return syscall.EROFS
+	}
+
+	err = parent.RmDirWithContext(ctx, op.Name)
 	parent.logFuse("<-- RmDir", op.Name, err)
 	return
 }
@@ -1027,14 +1434,45 @@ func (fs *Goofys) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
 
-	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
-	fs.mu.RUnlock()
+
+	if (op.Size != nil || (op.Mode != nil &&
+		(fs.flags.PermMetadata || fs.flags.UseBackendACLs)) ||
+		(op.Mtime != nil && fs.flags.PreserveMtime)) &&
+		inode.readOnly() {
+		return syscall.EROFS
+	}
+
+	// > .goofys-restore truncates it, which it already is
+	if op.Size != nil && !inode.isDir() && !inode.isRestoreFile() {
+		err = inode.checkObjectLock()
+		if err != nil {
+			return
+		}
+		err = inode.truncate(*op.Size)
+		if err != nil {
+			return
+		}
+	}
+
+	if op.Mode != nil {
+		err = inode.SetModeWithContext(ctx, *op.Mode)
+		if err != nil {
+			return
+		}
+	}
+
+	if op.Mtime != nil {
+		err = inode.SetMtimeWithContext(ctx, *op.Mtime)
+		if err != nil {
+			return
+		}
+	}
 
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
 	}
 	return
 }
@@ -1051,7 +1489,15 @@ func (fs *Goofys) WriteFile(
 	}
 	fs.mu.RUnlock()
 
-	err = fh.WriteFile(op.Offset, op.Data)
+	if fh.inode.readOnly() {
+		return syscall.EROFS
+	}
+	if fh.inode.isRestoreFile() {
+		// nothing is kept, so there's nothing to flush
+		return fh.inode.writeRestoreFile(op.Data)
+	}
+
+	err = fh.WriteFileWithContext(ctx, op.Offset, op.Data)
 
 	return
 }
@@ -1060,11 +1506,19 @@ func (fs *Goofys) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
 
-	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
-	fs.mu.RUnlock()
 
-	err = parent.Unlink(op.Name)
+	if parent.readOnly() {
+		return syscall.EROFS
+	}
+	if child := parent.findChild(op.Name); child != nil {
+		err = child.checkObjectLock()
+		if err != nil {
+			return
+		}
+	}
+
+	err = parent.UnlinkWithContext(ctx, op.Name)
 	return
 }
 
@@ -1074,10 +1528,31 @@ func (fs *Goofys) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
 
-	fs.mu.RLock()
+	if fs.isExcludedName(op.NewName) {
+		return syscall.EPERM
+	}
+
 	parent := fs.getInodeOrDie(op.OldParent)
 	newParent := fs.getInodeOrDie(op.NewParent)
-	fs.mu.RUnlock()
+
+	if parent.readOnly() || newParent.readOnly() ||
+		parent.findChild(op.OldName).readOnly() ||
+		newParent.findChild(op.NewName).readOnly() {
+		return syscall.EROFS
+	}
+
+	from := parent.findChild(op.OldName)
+	err = newParent.checkChildKey(op.NewName, from != nil && from.isDir())
+	if err != nil {
+		return
+	}
+	// the old one is removed once it's copied
+	if from != nil {
+		err = from.checkObjectLock()
+		if err != nil {
+			return
+		}
+	}
 
 	// XXX don't hold the lock the entire time
 	if op.OldParent == op.NewParent {
@@ -1096,7 +1571,7 @@ func (fs *Goofys) Rename(
 		defer newParent.mu.Unlock()
 	}
 
-	err = parent.Rename(op.OldName, newParent, op.NewName)
+	err = parent.RenameWithContext(ctx, op.OldName, newParent, op.NewName)
 	if err != nil {
 		if err == fuse.ENOENT {
 			// if the source doesn't exist, it could be
@@ -1128,9 +1603,12 @@ func (fs *Goofys) Rename(
 			}
 
 			inode.Name = &op.NewName
+			inode.rawName = nil
 			inode.Parent = newParent
 			newParent.insertChildUnlocked(inode)
 		}
+		parent.childrenChanged()
+		newParent.childrenChanged()
 	}
 	return
 }
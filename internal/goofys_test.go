@@ -482,7 +482,7 @@ func (s *GoofysTest) SetUpTest(t *C) {
 }
 
 func (s *GoofysTest) getRoot(t *C) (inode *Inode) {
-	inode = s.fs.inodes[fuseops.RootInodeID]
+	inode = s.fs.inodes.Get(fuseops.RootInodeID)
 	t.Assert(inode, NotNil)
 	return
 }
@@ -523,7 +523,7 @@ func (s *GoofysTest) LookUpInode(t *C, name string) (in *Inode, err error) {
 		if err != nil {
 			return
 		}
-		parent = s.fs.inodes[lookup.Entry.Child]
+		parent = s.fs.inodes.Get(lookup.Entry.Child)
 	}
 
 	lookup := fuseops.LookUpInodeOp{
@@ -535,7 +535,7 @@ func (s *GoofysTest) LookUpInode(t *C, name string) (in *Inode, err error) {
 	if err != nil {
 		return
 	}
-	in = s.fs.inodes[lookup.Entry.Child]
+	in = s.fs.inodes.Get(lookup.Entry.Child)
 	return
 }
 
@@ -825,7 +825,7 @@ func (s *GoofysTest) TestUnlink(t *C) {
 
 	// make sure that it's gone from s3
 	_, err = s.cloud.GetBlob(&GetBlobInput{Key: fileName})
-	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	t.Assert(s.fs.mapAwsError(err), Equals, fuse.ENOENT)
 }
 
 type FileHandleReader struct {
@@ -880,7 +880,7 @@ func (s *GoofysTest) testWriteFileAt(t *C, fileName string, offset int64, size i
 			t.Assert(err, IsNil)
 		}
 	} else {
-		in := s.fs.inodes[lookup.Entry.Child]
+		in := s.fs.inodes.Get(lookup.Entry.Child)
 		fh, err = in.OpenFile(fuseops.OpMetadata{uint32(os.Getpid())})
 		t.Assert(err, IsNil)
 	}
@@ -931,11 +931,11 @@ func (s *GoofysTest) TestWriteReplicatorThrottle(t *C) {
 
 func (s *GoofysTest) TestReadWriteMinimumMemory(t *C) {
 	if _, ok := s.cloud.(*ADLv1); ok {
-		s.fs.bufferPool.maxBuffers = 4
+		s.fs.bufferPool.maxBytes = 4 * BUF_SIZE
 	} else {
-		s.fs.bufferPool.maxBuffers = 2
+		s.fs.bufferPool.maxBytes = 2 * BUF_SIZE
 	}
-	s.fs.bufferPool.computedMaxbuffers = s.fs.bufferPool.maxBuffers
+	s.fs.bufferPool.computedMaxBytes = s.fs.bufferPool.maxBytes
 	s.testWriteFile(t, "testLargeFile", 21*1024*1024, 128*1024)
 }
 
@@ -1128,7 +1128,7 @@ func (s *GoofysTest) TestBackendListPagination(t *C) {
 					// ignore the error here,
 					// anything we didn't cleanup
 					// will be handled by teardown
-					_, _ = s.cloud.DeleteBlob(&DeleteBlobInput{key})
+					_, _ = s.cloud.DeleteBlob(&DeleteBlobInput{Key: key})
 					SmallActionsGate.Return(1)
 					wg.Done()
 				}(b)
@@ -1147,6 +1147,17 @@ func (s *GoofysTest) TestBackendListPagination(t *C) {
 	t.Assert(children, DeepEquals, expect)
 }
 
+func (s *GoofysTest) TestBackendListConformance(t *C) {
+	if s.azurite {
+		// https://github.com/Azure/Azurite/issues/262
+		t.Skip("Azurite doesn't support pagination")
+	}
+
+	for _, prefix := range []string{"", "dir2/", "empty_dir/", "empty_dir", "file1"} {
+		checkListConformance(t, s.cloud, prefix, PString("/"))
+	}
+}
+
 func (s *GoofysTest) TestBackendListPrefix(t *C) {
 	res, err := s.cloud.ListBlobs(&ListBlobsInput{
 		Prefix:    PString("random"),
@@ -1313,7 +1324,7 @@ func (s *GoofysTest) TestRename(t *C) {
 	t.Assert(err, IsNil)
 
 	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: from})
-	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	t.Assert(s.fs.mapAwsError(err), Equals, fuse.ENOENT)
 
 	from, to = "file3", "new_file2"
 	dir, _ := s.LookUpInode(t, "dir1")
@@ -1324,7 +1335,7 @@ func (s *GoofysTest) TestRename(t *C) {
 	t.Assert(err, IsNil)
 
 	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: from})
-	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+	t.Assert(s.fs.mapAwsError(err), Equals, fuse.ENOENT)
 
 	from, to = "no_such_file", "new_file"
 	err = root.Rename(from, root, to)
@@ -1334,7 +1345,7 @@ func (s *GoofysTest) TestRename(t *C) {
 		if !hasEnv("GCS") {
 			// not really rename but can be used by rename
 			from, to = s.fs.bucket+"/file2", "new_file"
-			_, err = s3.copyObjectMultipart(int64(len("file2")), from, to, "", nil, nil, nil)
+			_, err = s3.copyObjectMultipart(nil, int64(len("file2")), from, to, "", nil, nil, nil, nil)
 			t.Assert(err, IsNil)
 		}
 	}
@@ -1785,11 +1796,12 @@ func (s *GoofysTest) anonymous(t *C) {
 		t.Skip("anonymous access is disabled with profile")
 	}
 	t.Assert(s3.awsConfig.Credentials, Equals, credentials.AnonymousCredentials)
+	t.Assert(s3.Capabilities().ReadOnly, Equals, true)
 }
 
 func (s *GoofysTest) disableS3() {
 	time.Sleep(1 * time.Second) // wait for any background goroutines to finish
-	s.fs.inodes[fuseops.RootInodeID].dir.cloud = nil
+	s.fs.inodes.Get(fuseops.RootInodeID).dir.cloud = nil
 }
 
 func (s *GoofysTest) TestWriteAnonymous(t *C) {
@@ -1804,26 +1816,16 @@ func (s *GoofysTest) TestWriteAnonymous(t *C) {
 		Name:   fileName,
 	}
 
+	// anonymous mounts are read-only, so it fails right away
+	// instead of when it's flushed
 	err := s.fs.CreateFile(s.ctx, &createOp)
-	t.Assert(err, IsNil)
-
-	err = s.fs.FlushFile(s.ctx, &fuseops.FlushFileOp{
-		Handle: createOp.Handle,
-		Inode:  createOp.Entry.Child,
-	})
-	t.Assert(err, Equals, syscall.EACCES)
-
-	err = s.fs.ReleaseFileHandle(s.ctx, &fuseops.ReleaseFileHandleOp{Handle: createOp.Handle})
-	t.Assert(err, IsNil)
+	t.Assert(err, Equals, syscall.EROFS)
 
 	err = s.fs.LookUpInode(s.ctx, &fuseops.LookUpInodeOp{
 		Parent: s.getRoot(t).Id,
 		Name:   fileName,
 	})
 	t.Assert(err, Equals, fuse.ENOENT)
-	// BUG! the file shouldn't exist, see test below for comment,
-	// this behaves as expected only because we are bypassing
-	// linux vfs in this test
 }
 
 func (s *GoofysTest) TestWriteAnonymousFuse(t *C) {
@@ -1840,26 +1842,9 @@ func (s *GoofysTest) TestWriteAnonymousFuse(t *C) {
 	t.Assert(err, NotNil)
 	pathErr, ok := err.(*os.PathError)
 	t.Assert(ok, Equals, true)
-	t.Assert(pathErr.Err, Equals, syscall.EACCES)
+	t.Assert(pathErr.Err, Equals, syscall.EROFS)
 
-	_, err = os.Stat(mountPoint + "/test")
-	t.Assert(err, IsNil)
-	// BUG! the file shouldn't exist, the condition below should hold instead
-	// see comment in Goofys.FlushFile
-	// pathErr, ok = err.(*os.PathError)
-	// t.Assert(ok, Equals, true)
-	// t.Assert(pathErr.Err, Equals, fuse.ENOENT)
-
-	_, err = ioutil.ReadFile(mountPoint + "/test")
-	t.Assert(err, NotNil)
-	pathErr, ok = err.(*os.PathError)
-	t.Assert(ok, Equals, true)
-	t.Assert(pathErr.Err, Equals, fuse.ENOENT)
-
-	// reading the file and getting ENOENT causes the kernel to
-	// invalidate the entry, failing at open is not sufficient, we
-	// have to fail at read (which means that if the application
-	// uses splice(2) it won't get to us, so this wouldn't work
+	// creat() failed, so the kernel never thought it was there
 	_, err = os.Stat(mountPoint + "/test")
 	t.Assert(err, NotNil)
 	pathErr, ok = err.(*os.PathError)
@@ -1931,6 +1916,27 @@ func (s *GoofysTest) TestIssue162(t *C) {
 	t.Assert(resp.Size, Equals, uint64(3))
 }
 
+// backendXattrNames is what ListXattr has for an object that was
+// HEAD'ed, and then names. s3.sse is left out of names, it depends on
+// how the bucket is set up
+func (s *GoofysTest) backendXattrNames(names []string, expected ...string) ([]string, []string) {
+	ns := xattrNamespace(s.cloud)
+	for _, k := range []string{XATTR_BACKEND_ENDPOINT, "etag", XATTR_BACKEND_KEY,
+		XATTR_BACKEND_LAST_MODIFIED, "storage-class", XATTR_BACKEND_URL} {
+		expected = append(expected, ns+k)
+	}
+	sort.Strings(expected)
+
+	var got []string
+	for _, n := range names {
+		if n != ns+XATTR_BACKEND_SSE {
+			got = append(got, n)
+		}
+	}
+	sort.Strings(got)
+	return got, expected
+}
+
 func (s *GoofysTest) TestXAttrGet(t *C) {
 	if _, ok := s.cloud.(*ADLv1); ok {
 		t.Skip("ADLv1 doesn't support metadata")
@@ -1943,8 +1949,18 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 
 	names, err := file1.ListXattr()
 	t.Assert(err, IsNil)
-	sort.Strings(names)
-	t.Assert(names, DeepEquals, []string{"s3.etag", "s3.storage-class", "user.name"})
+	names, expected := s.backendXattrNames(names, "user.name")
+	t.Assert(names, DeepEquals, expected)
+
+	value, err := file1.GetXattr(xattrNamespace(s.cloud) + XATTR_BACKEND_KEY)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "file1")
+	value, err = file1.GetXattr(xattrNamespace(s.cloud) + XATTR_BACKEND_LAST_MODIFIED)
+	t.Assert(err, IsNil)
+	_, err = time.Parse(time.RFC3339, string(value))
+	t.Assert(err, IsNil)
+	t.Assert(file1.SetXattr(xattrNamespace(s.cloud)+XATTR_BACKEND_KEY, value, 0),
+		Equals, syscall.EPERM)
 
 	_, err = file1.GetXattr("user.foobar")
 	// xattr.IsNotExist seems broken on recent version of macOS
@@ -1957,7 +1973,7 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 		t.Assert(string(value), Equals, "\"826e8142e6baabe8af779f5f490cf5f5\"")
 	}
 
-	value, err := file1.GetXattr("user.name")
+	value, err = file1.GetXattr("user.name")
 	t.Assert(err, IsNil)
 	t.Assert(string(value), Equals, "file1+/#\x00")
 
@@ -1974,7 +1990,7 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 
 	s.readDirIntoCache(t, lookup.Entry.Child)
 
-	dir1 = s.fs.inodes[lookup.Entry.Child]
+	dir1 = s.fs.inodes.Get(lookup.Entry.Child)
 	file3 := dir1.findChild("file3")
 	t.Assert(file3, NotNil)
 	t.Assert(file3.userMetadata, IsNil)
@@ -1994,8 +2010,8 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 
 	names, err = emptyDir2.ListXattr()
 	t.Assert(err, IsNil)
-	sort.Strings(names)
-	t.Assert(names, DeepEquals, []string{"s3.etag", "s3.storage-class", "user.name"})
+	names, expected = s.backendXattrNames(names, "user.name")
+	t.Assert(names, DeepEquals, expected)
 
 	emptyDir, err := s.LookUpInode(t, "empty_dir")
 	t.Assert(err, IsNil)
@@ -2030,7 +2046,8 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 		t.Assert(err, IsNil)
 
 		names, err = ia.ListXattr()
-		t.Assert(names, DeepEquals, []string{"s3.etag", "s3.storage-class"})
+		names, expected = s.backendXattrNames(names)
+		t.Assert(names, DeepEquals, expected)
 
 		value, err = ia.GetXattr("s3.storage-class")
 		t.Assert(err, IsNil)
@@ -2041,7 +2058,8 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 		time.Sleep(100 * time.Millisecond)
 
 		names, err = ia.ListXattr()
-		t.Assert(names, DeepEquals, []string{"s3.etag", "s3.storage-class"})
+		names, expected = s.backendXattrNames(names)
+		t.Assert(names, DeepEquals, expected)
 
 		value, err = ia.GetXattr("s3.storage-class")
 		t.Assert(err, IsNil)
@@ -2403,6 +2421,38 @@ func (s *GoofysTest) TestReadDirSlurpSubtree(t *C) {
 	s.assertEntries(t, in, []string{"file4"})
 }
 
+func (s *GoofysTest) TestReadDirPrefetch(t *C) {
+	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.flags.ListPrefetch = 16
+
+	s.readDirIntoCache(t, fuseops.RootInodeID)
+	// subdirectories are listed in the background
+	s.disableS3()
+
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+	t.Assert(expired(dir2.dir.DirTime, s.fs.flags.TypeCacheTTL), Equals, false)
+	s.assertEntries(t, dir2, []string{"dir3"})
+
+	// only one level ahead
+	dir3, err := s.LookUpInode(t, "dir2/dir3")
+	t.Assert(err, IsNil)
+	t.Assert(dir3.dir.DirTime.IsZero(), Equals, true)
+}
+
+func (s *GoofysTest) TestReadDirPrefetchDisabled(t *C) {
+	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.flags.ListPrefetch = 0
+
+	s.readDirIntoCache(t, fuseops.RootInodeID)
+	time.Sleep(1 * time.Second)
+
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+	t.Assert(dir2.dir.DirTime.IsZero(), Equals, true)
+}
+
 func (s *GoofysTest) TestReadDirCached(t *C) {
 	s.fs.flags.StatCacheTTL = 1 * time.Minute
 	s.fs.flags.TypeCacheTTL = 1 * time.Minute
@@ -3212,7 +3262,7 @@ func (s *GoofysTest) TestMountsNewMounts(t *C) {
 	t.Assert(err, IsNil)
 	t.Assert(*c2.Name, Equals, "cloud2")
 	t.Assert(c2.dir.cloud == cloud, Equals, true)
-	t.Assert(c2.dir.mountPrefix, Equals, "cloudprefix")
+	t.Assert(c2.dir.mountPrefix, Equals, "cloudprefix/")
 }
 
 func (s *GoofysTest) TestMountsError(t *C) {
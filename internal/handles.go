@@ -15,12 +15,16 @@
 package internal
 
 import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"container/list"
+	"context"
 	"fmt"
-	"net/url"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,6 +39,25 @@ import (
 type InodeAttributes struct {
 	Size  uint64
 	Mtime time.Time
+	// from backends that have them, nil shows as mtime. Pointers
+	// because most don't, and every cached inode has these
+	Atime  *time.Time
+	Crtime *time.Time
+}
+
+// setOtherTimes takes atime and crtime from item, or forgets them if
+// the backend doesn't have them
+func (attr *InodeAttributes) setOtherTimes(item *BlobItemOutput) {
+	attr.Atime, attr.Crtime = nil, nil
+	// the item may be reused, keep our own copy
+	if item.Atime != nil {
+		atime := *item.Atime
+		attr.Atime = &atime
+	}
+	if item.Crtime != nil {
+		crtime := *item.Crtime
+		attr.Crtime = &crtime
+	}
 }
 
 type Inode struct {
@@ -53,12 +76,17 @@ type Inode struct {
 	// Ref: https://github.com/golang/go/blob/e42ae65a8507/src/time/time.go#L12:L56
 	AttrTime time.Time
 
-	mu sync.Mutex // everything below is protected by mu
+	// everything below is protected by mu. Lookups of children
+	// only need the read lock
+	mu sync.RWMutex
 
 	// We are not very consistent about enforcing locks for `Parent` because, the
 	// parent field very very rarely changes and it is generally fine to operate on
 	// stale parent informaiton
 	Parent *Inode
+	// the part of the key that Name was escaped from, nil if it's
+	// Name. Changes with Name, see listedName
+	rawName *string
 
 	dir *DirInodeData
 
@@ -66,13 +94,49 @@ type Inode struct {
 	ImplicitDir bool
 
 	fileHandles uint32
+	// the listing of the parent we were last seen in, see
+	// DirInodeData.listGen
+	listGen uint32
+	// set once we find out that someone else deleted the object
+	// while we had it open, see markStale. Updated atomically
+	stale uint32
+	// in UnixNano, when we last wrote the object. Updated
+	// atomically, see recentlyWritten
+	writtenAt int64
+
+	// nil until the file is opened, truncated or has its storage
+	// class set, see fileData
+	file *FileInodeData
 
 	userMetadata map[string][]byte
-	s3Metadata   map[string][]byte
-
-	// the refcnt is an exception, it's protected by the global lock
-	// Goofys.mu
+	// the target if this is a symlink, which is in userMetadata
+	// under --symlink-metadata-key
+	symlink *string
+	// exposed as the s3.etag and s3.storage-class xattrs. These
+	// are kept as plain fields rather than a map because every
+	// cached inode has them
+	etag         string
+	storageClass string
+	// the rest of the backend xattrs that only HEAD has, nil until
+	// then
+	head *headXattrs
+	// from the last HEAD, so that changing the metadata doesn't
+	// change it too
+	contentType string
+	// from the last HEAD, nil if there's no retention or legal
+	// hold. See checkObjectLock
+	objectLock *objectLock
+	// from userMetadata with --enable-perm-metadata, or the ACL
+	// with --use-backend-acls. Kept apart so attributes can be had
+	// without the lock
+	perm *inodePerm
+
+	// the refcnt is an exception, it's updated atomically. It
+	// goes up under the parent's read lock in LookUpInode and is
+	// realized to 0 under Goofys.mu for fake dir entries
 	refcnt uint64
+	// where we are in the InodeCache, protected by its lock
+	cacheElem *list.Element
 }
 
 func NewInode(fs *Goofys, parent *Inode, name *string) (inode *Inode) {
@@ -80,13 +144,16 @@ func NewInode(fs *Goofys, parent *Inode, name *string) (inode *Inode) {
 		fuseLog.Errorf("%v is not a valid name", *name)
 	}
 
+	// names are usually sliced out of a listed key, don't hold on
+	// to the whole key
+	n := string([]byte(*name))
+
 	inode = &Inode{
-		Name:       name,
-		fs:         fs,
-		AttrTime:   time.Now(),
-		Parent:     parent,
-		s3Metadata: make(map[string][]byte),
-		refcnt:     1,
+		Name:     &n,
+		fs:       fs,
+		AttrTime: time.Now(),
+		Parent:   parent,
+		refcnt:   1,
 	}
 
 	return
@@ -104,16 +171,27 @@ func (inode *Inode) SetFromBlobItem(item *BlobItemOutput) {
 	} else {
 		inode.Attributes.Mtime = inode.fs.rootAttrs.Mtime
 	}
-	if item.ETag != nil {
-		inode.s3Metadata["etag"] = []byte(*item.ETag)
-	} else {
-		delete(inode.s3Metadata, "etag")
-	}
-	if item.StorageClass != nil {
-		inode.s3Metadata["storage-class"] = []byte(*item.StorageClass)
-	} else {
-		delete(inode.s3Metadata, "storage-class")
-	}
+	inode.Attributes.setOtherTimes(item)
+	etag := aws.StringValue(item.ETag)
+	if etag != inode.etag {
+		// replaced by someone else, what we have of the
+		// metadata is of the old one
+		inode.userMetadata, inode.symlink, inode.perm = nil, nil, nil
+	}
+	if item.Deleted {
+		// shows as ---------- until it's restored
+		var mode os.FileMode
+		inode.perm = &inodePerm{mode: &mode, deleted: true}
+	} else if inode.perm != nil && inode.perm.deleted {
+		// restored
+		inode.perm = nil
+	}
+	if item.ACL != nil && inode.fs.flags.UseBackendACLs {
+		inode.perm = permFromACL(item.ACL, inode.fs.flags)
+	}
+	inode.fillMtime()
+	inode.etag = etag
+	inode.storageClass = internStorageClass(aws.StringValue(item.StorageClass))
 	now := time.Now()
 	// don't want to update time if this inode is setup to never expire
 	if inode.AttrTime.Before(now) {
@@ -126,7 +204,7 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 	var dir *Inode
 
 	if inode.dir == nil {
-		path = *inode.Name
+		path = inode.keyName()
 		dir = inode.Parent
 	} else {
 		dir = inode
@@ -156,10 +234,10 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 		}
 
 		if path == "" {
-			path = *p.Name
+			path = p.keyName()
 		} else if p.Parent != nil {
 			// don't prepend if I am already the root node
-			path = *p.Name + "/" + path
+			path = p.keyName() + "/" + path
 		}
 	}
 
@@ -171,6 +249,18 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 	return
 }
 
+// readOnly is nil-safe so it can be used on the result of findChild
+func (inode *Inode) readOnly() bool {
+	if inode == nil {
+		return false
+	}
+	if atomic.LoadInt32(&inode.fs.draining) != 0 {
+		return true
+	}
+	cloud, _ := inode.cloud()
+	return cloud != nil && cloud.Capabilities().ReadOnly
+}
+
 func (inode *Inode) FullName() *string {
 	if inode.Parent == nil {
 		return inode.Name
@@ -180,6 +270,29 @@ func (inode *Inode) FullName() *string {
 	}
 }
 
+// statCacheTTL is --stat-cache-ttl, unless --cache-ttl-override has
+// something else for this inode
+func (inode *Inode) statCacheTTL() time.Duration {
+	flags := inode.fs.flags
+	if flags.CacheTTLOverrides != nil {
+		if ttl, ok := flags.CacheTTLOverrides.Lookup(*inode.FullName()); ok {
+			return ttl
+		}
+	}
+	return flags.StatCacheTTL
+}
+
+// typeCacheTTL is statCacheTTL for --type-cache-ttl
+func (inode *Inode) typeCacheTTL() time.Duration {
+	flags := inode.fs.flags
+	if flags.CacheTTLOverrides != nil {
+		if ttl, ok := flags.CacheTTLOverrides.Lookup(*inode.FullName()); ok {
+			return ttl
+		}
+	}
+	return flags.TypeCacheTTL
+}
+
 func (inode *Inode) touch() {
 	inode.Attributes.Mtime = time.Now()
 }
@@ -190,12 +303,24 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 		mtime = inode.fs.rootAttrs.Mtime
 	}
 
+	// what we wrote since is newer
+	atime := mtime
+	if a := inode.Attributes.Atime; a != nil && a.After(mtime) {
+		atime = *a
+	}
+	crtime := mtime
+	if c := inode.Attributes.Crtime; c != nil && !c.IsZero() {
+		crtime = *c
+	}
+
+	// nothing has a separate ctime, changing metadata rewrites
+	// the object, which changes mtime too
 	attr = fuseops.InodeAttributes{
 		Size:   inode.Attributes.Size,
-		Atime:  mtime,
+		Atime:  atime,
 		Mtime:  mtime,
 		Ctime:  mtime,
-		Crtime: mtime,
+		Crtime: crtime,
 		Uid:    inode.fs.flags.Uid,
 		Gid:    inode.fs.flags.Gid,
 	}
@@ -203,10 +328,27 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 	if inode.dir != nil {
 		attr.Nlink = 2
 		attr.Mode = inode.fs.flags.DirMode | os.ModeDir
+	} else if inode.symlink != nil {
+		attr.Nlink = 1
+		// permissions of symlinks are never checked
+		attr.Mode = 0777 | os.ModeSymlink
+		attr.Size = uint64(len(*inode.symlink))
 	} else {
 		attr.Nlink = 1
 		attr.Mode = inode.fs.flags.FileMode
 	}
+
+	if perm := inode.perm; perm != nil {
+		if perm.mode != nil && inode.symlink == nil {
+			attr.Mode = attr.Mode&^os.ModePerm | *perm.mode
+		}
+		if perm.uid != nil {
+			attr.Uid = *perm.uid
+		}
+		if perm.gid != nil {
+			attr.Gid = *perm.gid
+		}
+	}
 	return
 }
 
@@ -236,22 +378,20 @@ func (inode *Inode) ToDir() {
 // which no long does anything, need to look into that to see if
 // that was legacy
 func (inode *Inode) Ref() {
-	inode.logFuse("Ref", inode.refcnt)
-
-	inode.refcnt++
+	refcnt := atomic.AddUint64(&inode.refcnt, 1)
+	inode.logFuse("Ref", refcnt-1)
 	return
 }
 
 func (inode *Inode) DeRef(n uint64) (stale bool) {
-	inode.logFuse("DeRef", n, inode.refcnt)
+	refcnt := atomic.AddUint64(&inode.refcnt, ^(n - 1))
+	inode.logFuse("DeRef", n, refcnt+n)
 
-	if inode.refcnt < n {
-		panic(fmt.Sprintf("deref %v from %v", n, inode.refcnt))
+	if refcnt+n < n {
+		panic(fmt.Sprintf("deref %v from %v", n, refcnt+n))
 	}
 
-	inode.refcnt -= n
-
-	stale = (inode.refcnt == 0)
+	stale = (refcnt == 0)
 	return
 }
 
@@ -265,35 +405,146 @@ func (inode *Inode) GetAttributes() (*fuseops.InodeAttributes, error) {
 	return &attr, nil
 }
 
+func (inode *Inode) isStale() bool {
+	return atomic.LoadUint32(&inode.stale) != 0
+}
+
+// markStale is for when a GET of an open file says the object is
+// gone. Handles that are already open get ESTALE from then on instead
+// of an ENOENT in the middle of a read. The inode is taken out of its
+// parent so the next lookup asks the backend, and opening it returns
+// ESTALE, which makes the kernel look the name up again. We can't
+// invalidate the kernel's entry directly
+func (inode *Inode) markStale() {
+	if !atomic.CompareAndSwapUint32(&inode.stale, 0, 1) {
+		return
+	}
+
+	fuseLog.Warnf("%v was deleted by someone else while it was open",
+		*inode.FullName())
+
+	parent := inode.Parent
+	if parent == nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if parent.findChildUnlocked(*inode.Name) == inode {
+		parent.removeChildUnlocked(inode)
+		// and see what else changed
+		go inode.fs.reconcileDir(parent, "read of a missing "+*inode.Name)
+	}
+}
+
 func (inode *Inode) isDir() bool {
 	return inode.dir != nil
 }
 
+// linux only lets users set xattrs in the user namespace, so that's
+// where the storage class is. It's not listed, tools copying xattrs
+// would change the storage class of the copy
+const XATTR_STORAGE_CLASS = "user.s3.storage-class"
+
+// storage classes are a handful of values repeated on every object,
+// share one copy of each
+var storageClasses sync.Map
+
+func internStorageClass(class string) string {
+	if class == "" {
+		return ""
+	}
+	if v, ok := storageClasses.Load(class); ok {
+		return v.(string)
+	}
+	v, _ := storageClasses.LoadOrStore(class, class)
+	return v.(string)
+}
+
 // LOCKS_REQUIRED(inode.mu)
-func (inode *Inode) fillXattrFromHead(resp *HeadBlobOutput) {
-	inode.userMetadata = make(map[string][]byte)
+func (inode *Inode) s3Metadata() (meta map[string][]byte) {
+	meta = make(map[string][]byte)
+	if inode.etag != "" {
+		meta["etag"] = []byte(inode.etag)
+	}
+	if inode.storageClass != "" {
+		meta["storage-class"] = []byte(inode.storageClass)
+	}
+	return
+}
 
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillXattrFromHead(resp *HeadBlobOutput) {
 	if resp.ETag != nil {
-		inode.s3Metadata["etag"] = []byte(*resp.ETag)
+		inode.etag = *resp.ETag
 	}
 	if resp.StorageClass != nil {
-		inode.s3Metadata["storage-class"] = []byte(*resp.StorageClass)
+		inode.storageClass = internStorageClass(*resp.StorageClass)
 	} else {
-		inode.s3Metadata["storage-class"] = []byte("STANDARD")
+		inode.storageClass = "STANDARD"
 	}
 
-	for k, v := range resp.Metadata {
-		k = strings.ToLower(k)
-		value, err := url.PathUnescape(*v)
-		if err != nil {
-			value = *v
+	inode.head = newHeadXattrs(inode.etag, resp)
+	inode.contentType = nilStr(resp.ContentType)
+	inode.objectLock = objectLockFromHead(resp)
+	inode.userMetadata = DecodeMetadata(resp.Metadata)
+	if resp.ACL != nil && inode.fs.flags.UseBackendACLs {
+		inode.perm = permFromACL(resp.ACL, inode.fs.flags)
+	}
+	inode.fillPerm()
+	inode.fillMtime()
+
+	inode.symlink = nil
+	if key := inode.fs.flags.SymlinkMetadataKey; key != "" && inode.dir == nil {
+		if target, ok := inode.userMetadata[key]; ok {
+			inode.symlink = PString(string(target))
 		}
-		inode.userMetadata[k] = []byte(value)
 	}
 }
 
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillPerm() {
+	if inode.fs.flags.PermMetadata && (inode.perm == nil || !inode.perm.backend) {
+		inode.perm = permFromMetadata(inode.userMetadata)
+	}
+}
+
+// needsMetadata is whether a lookup should HEAD this even if it was
+// just listed, because the attributes depend on metadata that listings
+// don't have. Listings have the ACLs of files but not of dirs
+func (inode *Inode) needsMetadata() bool {
+	flags := inode.fs.flags
+	return inode.maybeSymlink() || ((flags.PermMetadata || flags.PreserveMtime) &&
+		inode.dir == nil && inode.userMetadata == nil) ||
+		inode.needsACL()
+}
+
+func (inode *Inode) needsACL() bool {
+	if inode.perm != nil || inode.userMetadata != nil || inode.ImplicitDir ||
+		!inode.fs.flags.UseBackendACLs {
+		return false
+	}
+	cloud, _ := inode.cloud()
+	return cloud != nil && hasBackendACLs(cloud, inode.fs.flags)
+}
+
+// maybeSymlink is whether this could be a symlink that we don't know
+// about yet, because listings don't have metadata and it hasn't been
+// HEAD'ed
+func (inode *Inode) maybeSymlink() bool {
+	return inode.fs.flags.SymlinkMetadataKey != "" && inode.dir == nil &&
+		inode.Attributes.Size == 0 && inode.userMetadata == nil
+}
+
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) fillXattr() (err error) {
+	if inode.userMetadata == nil && inode.KnownSize == nil && !inode.isDir() {
+		// not in the bucket yet, what's set now goes with the
+		// first flush
+		inode.userMetadata = make(map[string][]byte)
+	}
+
 	if !inode.ImplicitDir && inode.userMetadata == nil {
 
 		fullName := *inode.FullName()
@@ -305,7 +556,7 @@ func (inode *Inode) fillXattr() (err error) {
 		params := &HeadBlobInput{Key: key}
 		resp, err := cloud.HeadBlob(params)
 		if err != nil {
-			err = mapAwsError(err)
+			err = inode.fs.mapAwsError(err)
 			if err == fuse.ENOENT {
 				err = nil
 				if inode.isDir() {
@@ -325,64 +576,258 @@ func (inode *Inode) fillXattr() (err error) {
 func (inode *Inode) getXattrMap(name string, userOnly bool) (
 	meta map[string][]byte, newName string, err error) {
 
-	if strings.HasPrefix(name, "s3.") {
+	if backendName, ok := inode.backendXattrName(name); ok {
 		if userOnly {
-			return nil, "", syscall.EACCES
+			return nil, "", syscall.EPERM
 		}
 
-		newName = name[3:]
-		meta = inode.s3Metadata
+		newName = backendName
+		meta = inode.backendXattrs()
 	} else if strings.HasPrefix(name, "user.") {
 		err = inode.fillXattr()
 		if err != nil {
 			return nil, "", err
 		}
 
+		if userOnly {
+			if cloud, _ := inode.cloud(); cloud.Capabilities().NoMetadata {
+				return nil, "", syscall.ENOTSUP
+			}
+		}
+
 		newName = name[5:]
 		meta = inode.userMetadata
 	} else {
 		if userOnly {
 			return nil, "", syscall.EACCES
 		} else {
-			return nil, "", syscall.ENODATA
+			return nil, "", ENOATTR
 		}
 	}
 
 	if meta == nil {
-		return nil, "", syscall.ENODATA
+		return nil, "", ENOATTR
 	}
 
 	return
 }
 
-func convertMetadata(meta map[string][]byte) (metadata map[string]*string) {
-	metadata = make(map[string]*string)
-	for k, v := range meta {
-		k = strings.ToLower(k)
-		metadata[k] = aws.String(xattrEscape(v))
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) getStorageClass() ([]byte, error) {
+	if inode.KnownSize == nil {
+		// not flushed yet
+		if inode.file == nil || inode.file.wantStorageClass == "" {
+			return nil, ENOATTR
+		}
+		return []byte(inode.file.wantStorageClass), nil
 	}
+
+	err := inode.fillXattr()
+	if err != nil {
+		return nil, err
+	}
+	if inode.storageClass == "" {
+		return nil, ENOATTR
+	}
+	return []byte(inode.storageClass), nil
+}
+
+// setStorageClass changes the storage class of what's already in the
+// bucket by copying it onto itself, and of whatever we write to it
+// later
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) setStorageClass(ctx context.Context, class string) (err error) {
+	cloud, key := inode.cloud()
+	if inode.isDir() || !cloud.Capabilities().StorageClass {
+		return syscall.ENOTSUP
+	}
+	if class == "" {
+		return syscall.EINVAL
+	}
+
+	if inode.KnownSize != nil {
+		err = inode.fillXattr()
+		if err != nil {
+			return
+		}
+
+		if class != inode.storageClass {
+			_, err = cloud.CopyBlob(&CopyBlobInput{
+				Source:       key,
+				Destination:  key,
+				Size:         &inode.Attributes.Size,
+				ETag:         aws.String(inode.etag),
+				Metadata:     EncodeMetadata(inode.userMetadata),
+				StorageClass: &class,
+				ContentType:  PStringOrNil(inode.contentType),
+				Context:      ctx,
+			})
+			if err != nil {
+				return
+			}
+			inode.storageClass = internStorageClass(class)
+		}
+	}
+
+	inode.fileData().wantStorageClass = internStorageClass(class)
 	return
 }
 
+// metadataToWrite is what an overwrite of the file should keep, if
+// we know it
+func (inode *Inode) metadataToWrite() map[string]*string {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.userMetadata == nil {
+		return nil
+	}
+	// the upload takes it
+	if inode.file != nil {
+		inode.file.mtimePending = false
+	}
+	return EncodeMetadata(inode.userMetadata)
+}
+
+// updateXattr writes userMetadata by copying the object onto itself,
+// or for backends that can, just its metadata. The storage class and
+// content type stay what they were
+//
 // LOCKS_REQUIRED(inode.mu)
-func (inode *Inode) updateXattr() (err error) {
+func (inode *Inode) updateXattr(ctx context.Context) (err error) {
 	cloud, key := inode.cloud()
+	meta := EncodeMetadata(inode.userMetadata)
+	err = checkMetadata(cloud.Capabilities(), key, meta)
+	if err != nil {
+		return
+	}
+	// the perm metadata can be changed as xattrs too
+	defer func() {
+		if err == nil {
+			inode.fillPerm()
+		}
+	}()
+	if inode.KnownSize == nil && !inode.isDir() {
+		// see fillXattr
+		return
+	}
+
+	var storageClass *string
+	if cloud.Capabilities().StorageClass {
+		storageClass = PStringOrNil(inode.storageClass)
+	}
+
 	_, err = cloud.CopyBlob(&CopyBlobInput{
-		Source:      key,
-		Destination: key,
-		Size:        &inode.Attributes.Size,
-		ETag:        aws.String(string(inode.s3Metadata["etag"])),
-		Metadata:    convertMetadata(inode.userMetadata),
+		Source:       key,
+		Destination:  key,
+		Size:         &inode.Attributes.Size,
+		ETag:         aws.String(inode.etag),
+		Metadata:     meta,
+		StorageClass: storageClass,
+		ContentType:  PStringOrNil(inode.contentType),
+		Context:      ctx,
 	})
 	return
 }
 
+// SetMode is chmod with --enable-perm-metadata. It's kept in the mode
+// metadata like an xattr, except on ADLv1 and WebHDFS, and ADLv2 with
+// --use-backend-acls, which have real permissions. Without the flags,
+// or where there's nothing to keep it in, it's ignored like before
+func (inode *Inode) SetMode(mode os.FileMode) (err error) {
+	return inode.SetModeWithContext(nil, mode)
+}
+
+// SetModeWithContext is SetMode for a fuse op, whose trace id the
+// request carries
+func (inode *Inode) SetModeWithContext(ctx context.Context, mode os.FileMode) (err error) {
+	inode.logFuse("SetMode", mode)
+
+	flags := inode.fs.flags
+	if !(flags.PermMetadata || flags.UseBackendACLs) || inode.symlink != nil {
+		return
+	}
+	// the permissionSetter one below isn't behind the backend wrappers
+	if inode.readOnly() {
+		return syscall.EROFS
+	}
+	mode = mode.Perm()
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	cloud, key := inode.cloud()
+	if setter := permissionSetterOf(cloud, flags); setter != nil {
+		if inode.KnownSize == nil && !inode.isDir() {
+			// not created yet
+			return
+		}
+		err = setter.SetPermission(key, mode)
+		if err == nil {
+			var perm inodePerm
+			if inode.perm != nil {
+				perm = *inode.perm
+			}
+			perm.mode = &mode
+			inode.perm = &perm
+		}
+		return
+	}
+	if !flags.PermMetadata {
+		return
+	}
+
+	err = inode.fillXattr()
+	if err != nil {
+		return
+	}
+	if inode.userMetadata == nil || cloud.Capabilities().NoMetadata {
+		// an implicit dir
+		return
+	}
+
+	old, had := inode.userMetadata[PERM_METADATA_MODE]
+	inode.userMetadata[PERM_METADATA_MODE] = permModeMetadata(mode, inode.isDir())
+	err = inode.updateXattr(TraceOnly(ctx))
+	if err != nil {
+		if had {
+			inode.userMetadata[PERM_METADATA_MODE] = old
+		} else {
+			delete(inode.userMetadata, PERM_METADATA_MODE)
+		}
+	}
+	return
+}
+
 func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
-	inode.logFuse("RemoveXattr", name)
+	return inode.SetXattrWithContext(nil, name, value, flags)
+}
+
+// SetXattrWithContext is SetXattr for a fuse op, whose trace id the
+// request carries
+func (inode *Inode) SetXattrWithContext(ctx context.Context, name string, value []byte,
+	flags uint32) error {
+
+	inode.logFuse("SetXattr", name)
+	ctx = TraceOnly(ctx)
 
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if name == XATTR_STORAGE_CLASS {
+		return inode.setStorageClass(ctx, string(value))
+	}
+	if isObjectLockXattr(name) {
+		return syscall.EPERM
+	}
+	if inode.fs.flags.Undelete && isUndeleteXattr(name) {
+		if name == XATTR_DELETED {
+			return syscall.EPERM
+		}
+		return inode.undelete(string(value))
+	}
+
 	meta, name, err := inode.getXattrMap(name, true)
 	if err != nil {
 		return err
@@ -396,33 +841,68 @@ func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 			}
 		} else if flags == 0x2 {
 			if !ok {
-				return syscall.ENODATA
+				return ENOATTR
 			}
 		}
 	}
 
+	if name == "" {
+		return syscall.EINVAL
+	}
+
+	old, had := meta[name]
 	meta[name] = Dup(value)
-	err = inode.updateXattr()
+	err = inode.updateXattr(ctx)
+	if err != nil {
+		// still what's in the bucket
+		if had {
+			meta[name] = old
+		} else {
+			delete(meta, name)
+		}
+	}
 	return err
 }
 
 func (inode *Inode) RemoveXattr(name string) error {
+	return inode.RemoveXattrWithContext(nil, name)
+}
+
+// RemoveXattrWithContext is RemoveXattr for a fuse op, whose trace id
+// the request carries
+func (inode *Inode) RemoveXattrWithContext(ctx context.Context, name string) error {
 	inode.logFuse("RemoveXattr", name)
 
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if name == XATTR_STORAGE_CLASS {
+		// what's there stays, but later writes go back to
+		// --storage-class
+		if inode.file == nil || inode.file.wantStorageClass == "" {
+			return ENOATTR
+		}
+		inode.file.wantStorageClass = ""
+		return nil
+	}
+	if isObjectLockXattr(name) {
+		return syscall.EPERM
+	}
+
 	meta, name, err := inode.getXattrMap(name, true)
 	if err != nil {
 		return err
 	}
 
-	if _, ok := meta[name]; ok {
+	if old, ok := meta[name]; ok {
 		delete(meta, name)
-		err = inode.updateXattr()
+		err = inode.updateXattr(TraceOnly(ctx))
+		if err != nil {
+			meta[name] = old
+		}
 		return err
 	} else {
-		return syscall.ENODATA
+		return ENOATTR
 	}
 }
 
@@ -432,6 +912,28 @@ func (inode *Inode) GetXattr(name string) ([]byte, error) {
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if name == XATTR_STORAGE_CLASS {
+		return inode.getStorageClass()
+	}
+	if isObjectLockXattr(name) {
+		return inode.getObjectLockXattr(name)
+	}
+	if name == XATTR_LAST_ERRORS && inode.Id == fuseops.RootInodeID {
+		return inode.fs.failedRequests.JSON(), nil
+	}
+	if name == XATTR_DIRTY_BYTES && inode.Id == fuseops.RootInodeID {
+		return inode.fs.dirtyBytes.xattr(), nil
+	}
+	if inode.fs.flags.Undelete && isUndeleteXattr(name) {
+		if name == XATTR_UNDELETE {
+			return nil, ENOATTR
+		}
+		return inode.listDeleted()
+	}
+	if backendName, ok := inode.backendXattrName(name); ok {
+		return inode.getBackendXattr(backendName)
+	}
+
 	meta, name, err := inode.getXattrMap(name, false)
 	if err != nil {
 		return nil, err
@@ -441,7 +943,7 @@ func (inode *Inode) GetXattr(name string) ([]byte, error) {
 	if ok {
 		return value, nil
 	} else {
-		return nil, syscall.ENODATA
+		return nil, ENOATTR
 	}
 }
 
@@ -458,13 +960,17 @@ func (inode *Inode) ListXattr() ([]string, error) {
 		return nil, err
 	}
 
-	for k, _ := range inode.s3Metadata {
-		xattrs = append(xattrs, "s3."+k)
+	xattrs, err = inode.listBackendXattrs()
+	if err != nil {
+		return nil, err
 	}
 
 	for k, _ := range inode.userMetadata {
 		xattrs = append(xattrs, "user."+k)
 	}
+	if inode.Id == fuseops.RootInodeID {
+		xattrs = append(xattrs, XATTR_LAST_ERRORS, XATTR_DIRTY_BYTES)
+	}
 
 	sort.Strings(xattrs)
 
@@ -474,10 +980,25 @@ func (inode *Inode) ListXattr() ([]string, error) {
 func (inode *Inode) OpenFile(metadata fuseops.OpMetadata) (fh *FileHandle, err error) {
 	inode.logFuse("OpenFile")
 
+	if inode.isStale() {
+		return nil, syscall.ESTALE
+	}
+
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
 	fh = NewFileHandle(inode, metadata)
 	inode.fileHandles += 1
+
+	if inode.KnownSize != nil && inode.etag != "" {
+		fh.readETag = PString(inode.etag)
+	}
+	// we can't tell the kernel to drop what it cached when the
+	// object changes, but it does that on open unless we ask it to
+	// keep the cache
+	file := inode.fileData()
+	fh.keepPageCache = !file.pageCacheStale &&
+		(file.openedETag == "" || file.openedETag == inode.etag)
+	file.openedETag, file.pageCacheStale = inode.etag, false
 	return
 }
@@ -0,0 +1,186 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const DEFAULT_HEDGE_MAX_SIZE = 1024 * 1024
+const DEFAULT_HEDGE_PERCENT = 5
+
+// HedgedBackend sends a second GET for a small range if the first
+// one hasn't answered within a delay, and takes whichever answers
+// first. A few slow responses are what make up the tail latency of
+// reads, and a second try usually lands on a faster server. Nothing
+// else is hedged, in particular nothing that changes the bucket
+type HedgedBackend struct {
+	StorageBackend
+
+	delay   time.Duration
+	maxSize uint64
+	// at most this percent of requests are hedged
+	percent uint64
+
+	requests uint64
+	hedges   uint64
+	wins     uint64
+}
+
+type HedgeStats struct {
+	Requests uint64 `json:"requests"`
+	Hedges   uint64 `json:"hedges"`
+	// how many times the second request answered first
+	Wins uint64 `json:"wins"`
+}
+
+func NewHedgedBackend(cloud StorageBackend, flags *FlagStorage) *HedgedBackend {
+	return &HedgedBackend{
+		StorageBackend: cloud,
+		delay:          flags.HedgeDelay,
+		maxSize:        flags.HedgeMaxSize,
+		percent:        uint64(flags.HedgePercent),
+	}
+}
+
+func (b *HedgedBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+// backendWrapper is a StorageBackend that forwards to another one,
+// like the ones NewBackend stacks up
+type backendWrapper interface {
+	Unwrap() StorageBackend
+}
+
+// walkBackends calls fn on cloud and then on every backend it wraps,
+// outermost first, until fn returns true
+func walkBackends(cloud StorageBackend, fn func(StorageBackend) bool) {
+	for {
+		if fn(cloud) {
+			return
+		}
+		w, ok := cloud.(backendWrapper)
+		if !ok {
+			return
+		}
+		cloud = w.Unwrap()
+	}
+}
+
+// unwrapBackend returns the backend behind all the wrappers, for when
+// we need to know what kind of backend it is. Don't change the bucket
+// through it
+func unwrapBackend(cloud StorageBackend) StorageBackend {
+	walkBackends(cloud, func(b StorageBackend) bool {
+		cloud = b
+		return false
+	})
+	return cloud
+}
+
+type hedgeResult struct {
+	resp  *GetBlobOutput
+	err   error
+	hedge bool
+}
+
+func (b *HedgedBackend) allowHedge() bool {
+	requests := atomic.LoadUint64(&b.requests)
+	hedges := atomic.LoadUint64(&b.hedges)
+	return hedges*100 < requests*b.percent
+}
+
+func (b *HedgedBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	if param.Count == 0 || param.Count > b.maxSize {
+		return b.StorageBackend.GetBlob(param)
+	}
+
+	atomic.AddUint64(&b.requests, 1)
+
+	results := make(chan hedgeResult, 2)
+	get := func(hedge bool) {
+		p := *param
+		resp, err := b.StorageBackend.GetBlob(&p)
+		results <- hedgeResult{resp, err, hedge}
+	}
+
+	go get(false)
+	inflight := 1
+
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err != nil && inflight != 0 {
+				// the other one may still make it
+				continue
+			}
+			if inflight != 0 {
+				go discardHedge(results)
+			}
+			if res.hedge && res.err == nil {
+				atomic.AddUint64(&b.wins, 1)
+			}
+			return res.resp, res.err
+		case <-timer.C:
+			if b.allowHedge() {
+				atomic.AddUint64(&b.hedges, 1)
+				s3Log.Debugf("hedging GET %v %v-%v", param.Key,
+					param.Start, param.Start+param.Count)
+				go get(true)
+				inflight++
+			}
+		}
+	}
+}
+
+// discardHedge waits for the request that lost. Closing the body
+// before it's read aborts the transfer
+func discardHedge(results chan hedgeResult) {
+	res := <-results
+	if res.err == nil {
+		res.resp.Body.Close()
+	}
+}
+
+func (b *HedgedBackend) Stats() HedgeStats {
+	return HedgeStats{
+		Requests: atomic.LoadUint64(&b.requests),
+		Hedges:   atomic.LoadUint64(&b.hedges),
+		Wins:     atomic.LoadUint64(&b.wins),
+	}
+}
+
+// controlHedge prints how many reads were hedged, and how many times
+// that paid off
+func controlHedge(fs *Goofys, args []string, conn net.Conn) error {
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	hedged, ok := root.dir.cloud.(*HedgedBackend)
+	if !ok {
+		return fmt.Errorf("hedging is off")
+	}
+	return writeControlReply(conn, nil, hedged.Stats())
+}
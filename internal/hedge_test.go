@@ -0,0 +1,172 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// stragglerBackend answers every GET quickly, except for the ones
+// it's told to be slow or fail on
+type stragglerBackend struct {
+	memBackend
+
+	gets   int
+	slow   map[int]bool
+	fail   map[int]bool
+	closed int
+}
+
+type closeCounter struct {
+	io.Reader
+	b *stragglerBackend
+}
+
+func (c closeCounter) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.b.closed++
+	return nil
+}
+
+func (b *stragglerBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.mu.Lock()
+	n := b.gets
+	b.gets++
+	b.mu.Unlock()
+
+	if b.slow[n] {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if b.fail[n] {
+		return nil, syscall.EIO
+	}
+	return &GetBlobOutput{
+		Body: closeCounter{strings.NewReader("hello"), b},
+	}, nil
+}
+
+func (b *stragglerBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	time.Sleep(500 * time.Millisecond)
+	return &DeleteBlobOutput{}, nil
+}
+
+type HedgeTest struct {
+	cloud  *stragglerBackend
+	hedged *HedgedBackend
+}
+
+var _ = Suite(&HedgeTest{})
+
+func (s *HedgeTest) SetUpTest(t *C) {
+	s.cloud = &stragglerBackend{
+		slow: make(map[int]bool),
+		fail: make(map[int]bool),
+	}
+	s.hedged = NewHedgedBackend(s.cloud, &FlagStorage{
+		HedgeDelay:   50 * time.Millisecond,
+		HedgeMaxSize: DEFAULT_HEDGE_MAX_SIZE,
+		HedgePercent: 100,
+	})
+}
+
+func (s *HedgeTest) get(t *C, count uint64) (time.Duration, error) {
+	start := time.Now()
+	resp, err := s.hedged.GetBlob(&GetBlobInput{Key: "file", Count: count})
+	if err == nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		t.Assert(err, IsNil)
+		t.Assert(string(data), Equals, "hello")
+		resp.Body.Close()
+	}
+	return time.Since(start), err
+}
+
+func (s *HedgeTest) TestHedgeWins(t *C) {
+	s.cloud.slow[0] = true
+
+	elapsed, err := s.get(t, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(elapsed < 400*time.Millisecond, Equals, true)
+	t.Assert(s.hedged.Stats(), Equals, HedgeStats{Requests: 1, Hedges: 1, Wins: 1})
+
+	// the straggler is thrown away once it shows up
+	time.Sleep(600 * time.Millisecond)
+	s.cloud.mu.Lock()
+	t.Assert(s.cloud.closed, Equals, 2)
+	s.cloud.mu.Unlock()
+}
+
+func (s *HedgeTest) TestHedgeFast(t *C) {
+	_, err := s.get(t, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.gets, Equals, 1)
+	t.Assert(s.hedged.Stats(), Equals, HedgeStats{Requests: 1})
+}
+
+func (s *HedgeTest) TestHedgeError(t *C) {
+	// the hedge fails, so we wait for the original
+	s.cloud.slow[0] = true
+	s.cloud.fail[1] = true
+
+	elapsed, err := s.get(t, 4096)
+	t.Assert(err, IsNil)
+	t.Assert(elapsed >= 500*time.Millisecond, Equals, true)
+	t.Assert(s.hedged.Stats(), Equals, HedgeStats{Requests: 1, Hedges: 1})
+
+	// both fail
+	s.cloud.slow[2] = true
+	s.cloud.fail[2] = true
+	s.cloud.fail[3] = true
+	_, err = s.get(t, 4096)
+	t.Assert(err, Equals, syscall.EIO)
+}
+
+func (s *HedgeTest) TestHedgeLimits(t *C) {
+	// too big, or the whole object
+	s.cloud.slow[0] = true
+	s.cloud.slow[1] = true
+	_, err := s.get(t, DEFAULT_HEDGE_MAX_SIZE+1)
+	t.Assert(err, IsNil)
+	_, err = s.get(t, 0)
+	t.Assert(err, IsNil)
+	t.Assert(s.cloud.gets, Equals, 2)
+	t.Assert(s.hedged.Stats(), Equals, HedgeStats{})
+
+	// only 5% of requests may be hedged
+	s.hedged.percent = 5
+	for i := 2; i < 42; i++ {
+		s.cloud.slow[i] = true
+	}
+	for i := 0; i < 20; i++ {
+		_, err = s.get(t, 4096)
+		t.Assert(err, IsNil)
+	}
+	t.Assert(s.hedged.Stats().Hedges, Equals, uint64(1))
+
+	// writes are never hedged
+	start := time.Now()
+	_, err = s.hedged.DeleteBlob(&DeleteBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(time.Since(start) >= 500*time.Millisecond, Equals, true)
+}
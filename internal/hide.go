@@ -0,0 +1,605 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// macOS clients, through an SMB re-export of a mount among others,
+// write a ._foo AppleDouble next to every file they touch and a
+// .DS_Store in every directory they open. Each of those is a PUT and
+// stays in the bucket. HiddenBackend keeps the keys with a name that
+// matches --hide-pattern, or that are under a dir with one, in memory
+// instead: they can be written and read back like any other file, but
+// are never uploaded, are left out of listings, and looking up one
+// that isn't there doesn't ask the backend. What's kept is bounded,
+// past HIDE_MAX_FILES or HIDE_MAX_BYTES the least recently used go
+// away as if someone else removed them
+
+const HIDE_MAX_FILES = 10000
+const HIDE_MAX_BYTES = 64 * 1024 * 1024
+
+type hiddenBlob struct {
+	key          string
+	data         []byte
+	metadata     map[string]*string
+	contentType  *string
+	dirBlob      bool
+	etag         string
+	lastModified time.Time
+}
+
+func (blob *hiddenBlob) item() BlobItemOutput {
+	return BlobItemOutput{
+		Key:          PString(blob.key),
+		ETag:         PString(blob.etag),
+		LastModified: PTime(blob.lastModified),
+		Size:         uint64(len(blob.data)),
+	}
+}
+
+func (blob *hiddenBlob) head() *HeadBlobOutput {
+	return &HeadBlobOutput{
+		BlobItemOutput: blob.item(),
+		ContentType:    blob.contentType,
+		Metadata:       blob.metadata,
+		IsDirBlob:      blob.dirBlob,
+	}
+}
+
+// hiddenUpload is a multipart upload or append of a hidden key, its
+// parts are kept until the commit
+type hiddenUpload struct {
+	// what's there already, for an append
+	base        []byte
+	contentType *string
+	parts       map[uint32][]byte
+}
+
+type HiddenBackend struct {
+	StorageBackend
+	patterns []string
+	maxFiles int
+	maxBytes uint64
+
+	mu sync.Mutex
+	// of *hiddenBlob, least recently used first. A blob doesn't
+	// change once it's in here, it's replaced
+	lru     *list.List
+	blobs   map[string]*list.Element
+	size    uint64
+	uploads map[string]*hiddenUpload
+	nextId  uint64
+
+	// requests that didn't go to the backend, updated atomically
+	avoided uint64
+}
+
+func NewHiddenBackend(cloud StorageBackend, patterns []string) *HiddenBackend {
+	return &HiddenBackend{
+		StorageBackend: cloud,
+		patterns:       patterns,
+		maxFiles:       HIDE_MAX_FILES,
+		maxBytes:       HIDE_MAX_BYTES,
+		lru:            list.New(),
+		blobs:          make(map[string]*list.Element),
+		uploads:        make(map[string]*hiddenUpload),
+	}
+}
+
+func (b *HiddenBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+// isHiddenName is whether a file or dir named name is only kept in
+// memory
+func isHiddenName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isHidden is whether key has a hidden name, or is under a dir that
+// has one
+func (b *HiddenBackend) isHidden(key string) bool {
+	for _, name := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if name != "" && isHiddenName(b.patterns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func findHiddenBackend(cloud StorageBackend) (hidden *HiddenBackend) {
+	walkBackends(cloud, func(b StorageBackend) bool {
+		hidden, _ = b.(*HiddenBackend)
+		return hidden != nil
+	})
+	return
+}
+
+func (b *HiddenBackend) Avoided() uint64 {
+	return atomic.LoadUint64(&b.avoided)
+}
+
+func (b *HiddenBackend) avoid() {
+	atomic.AddUint64(&b.avoided, 1)
+}
+
+func (b *HiddenBackend) get(key string) *hiddenBlob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.blobs[key]
+	if !ok {
+		return nil
+	}
+	b.lru.MoveToBack(e)
+	return e.Value.(*hiddenBlob)
+}
+
+// put replaces what's kept of blob.key with blob, and drops the least
+// recently used blobs if there are too many now
+func (b *HiddenBackend) put(blob *hiddenBlob) error {
+	if uint64(len(blob.data)) > b.maxBytes {
+		return syscall.ENOSPC
+	}
+	blob.etag = fmt.Sprintf("\"%x\"", md5.Sum(blob.data))
+	blob.lastModified = time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeUnlocked(blob.key)
+	b.blobs[blob.key] = b.lru.PushBack(blob)
+	b.size += uint64(len(blob.data))
+
+	for b.lru.Len() > b.maxFiles || b.size > b.maxBytes {
+		old := b.lru.Front().Value.(*hiddenBlob)
+		log.Debugf("dropping %v from memory", old.key)
+		b.removeUnlocked(old.key)
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *HiddenBackend) removeUnlocked(key string) {
+	if e, ok := b.blobs[key]; ok {
+		b.size -= uint64(len(e.Value.(*hiddenBlob).data))
+		b.lru.Remove(e)
+		delete(b.blobs, key)
+	}
+}
+
+func (b *HiddenBackend) remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeUnlocked(key)
+}
+
+func copyMetadata(metadata map[string]*string) map[string]*string {
+	if metadata == nil {
+		return nil
+	}
+	c := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
+func (b *HiddenBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.HeadBlob(param)
+	}
+	b.avoid()
+
+	blob := b.get(param.Key)
+	if blob == nil {
+		return nil, fuse.ENOENT
+	}
+	return blob.head(), nil
+}
+
+func (b *HiddenBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var prefix string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	if b.isHidden(prefix) {
+		b.avoid()
+		return b.list(param), nil
+	}
+
+	resp, err := b.StorageBackend.ListBlobs(param)
+	if err != nil {
+		return nil, err
+	}
+	items := resp.Items[:0]
+	for _, item := range resp.Items {
+		if !b.isHidden(*item.Key) {
+			items = append(items, item)
+		}
+	}
+	resp.Items = items
+	prefixes := resp.Prefixes[:0]
+	for _, p := range resp.Prefixes {
+		if !b.isHidden(*p.Prefix) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	resp.Prefixes = prefixes
+	return resp, nil
+}
+
+// list is a listing of what's in memory under a hidden dir, in one
+// page
+func (b *HiddenBackend) list(param *ListBlobsInput) *ListBlobsOutput {
+	var prefix, delimiter, startAfter string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	if param.Delimiter != nil {
+		delimiter = *param.Delimiter
+	}
+	if param.StartAfter != nil && param.ContinuationToken == nil {
+		startAfter = *param.StartAfter
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := &ListBlobsOutput{}
+	seen := make(map[string]bool)
+	for key, e := range b.blobs {
+		if !strings.HasPrefix(key, prefix) || key <= startAfter {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					resp.Prefixes = append(resp.Prefixes, BlobPrefixOutput{Prefix: PString(p)})
+				}
+				continue
+			}
+		}
+		resp.Items = append(resp.Items, e.Value.(*hiddenBlob).item())
+	}
+	sort.Sort(sortBlobItemOutput(resp.Items))
+	sort.Sort(sortBlobPrefixOutput(resp.Prefixes))
+	return resp
+}
+
+func (b *HiddenBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.DeleteBlob(param)
+	}
+	b.avoid()
+	b.remove(param.Key)
+	return &DeleteBlobOutput{}, nil
+}
+
+func (b *HiddenBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	if len(param.Items) == 0 {
+		return &DeleteBlobsOutput{}, nil
+	}
+
+	var rest []string
+	for _, key := range param.Items {
+		if b.isHidden(key) {
+			b.remove(key)
+		} else {
+			rest = append(rest, key)
+		}
+	}
+	if len(rest) == len(param.Items) {
+		return b.StorageBackend.DeleteBlobs(param)
+	}
+	b.avoid()
+	if len(rest) == 0 {
+		return &DeleteBlobsOutput{}, nil
+	}
+	return b.StorageBackend.DeleteBlobs(&DeleteBlobsInput{
+		Items:   rest,
+		Context: param.Context,
+	})
+}
+
+func (b *HiddenBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	from, to := b.isHidden(param.Source), b.isHidden(param.Destination)
+	if !from && !to {
+		return b.StorageBackend.RenameBlob(param)
+	} else if from != to {
+		// one of them is in the bucket, the caller copies and
+		// deletes instead
+		return nil, syscall.ENOTSUP
+	}
+	b.avoid()
+
+	blob := b.get(param.Source)
+	if blob == nil {
+		return nil, fuse.ENOENT
+	}
+	renamed := *blob
+	renamed.key = param.Destination
+	err := b.put(&renamed)
+	if err != nil {
+		return nil, err
+	}
+	b.remove(param.Source)
+	return &RenameBlobOutput{}, nil
+}
+
+func (b *HiddenBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	from, to := b.isHidden(param.Source), b.isHidden(param.Destination)
+	if !from && !to {
+		return b.StorageBackend.CopyBlob(param)
+	}
+
+	var blob *hiddenBlob
+	if from {
+		b.avoid()
+		blob = b.get(param.Source)
+		if blob == nil {
+			return nil, fuse.ENOENT
+		}
+	} else {
+		// a file of the bucket that's copied to a hidden name
+		// is read into memory
+		resp, err := b.StorageBackend.GetBlob(&GetBlobInput{Key: param.Source})
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		blob = &hiddenBlob{
+			data:        data,
+			metadata:    resp.Metadata,
+			contentType: resp.ContentType,
+		}
+	}
+
+	metadata := blob.metadata
+	if param.Metadata != nil {
+		metadata = param.Metadata
+	}
+	contentType := blob.contentType
+	if param.ContentType != nil {
+		contentType = param.ContentType
+	}
+
+	if !to {
+		// under its new name it's a file like any other
+		_, err := b.StorageBackend.PutBlob(&PutBlobInput{
+			Key:          param.Destination,
+			Metadata:     metadata,
+			ContentType:  contentType,
+			StorageClass: param.StorageClass,
+			Body:         bytes.NewReader(blob.data),
+			Size:         PUInt64(uint64(len(blob.data))),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &CopyBlobOutput{}, nil
+	}
+
+	err := b.put(&hiddenBlob{
+		key:         param.Destination,
+		data:        blob.data,
+		metadata:    copyMetadata(metadata),
+		contentType: contentType,
+		dirBlob:     blob.dirBlob,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *HiddenBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.GetBlob(param)
+	}
+	b.avoid()
+
+	blob := b.get(param.Key)
+	if blob == nil {
+		return nil, fuse.ENOENT
+	}
+	if param.IfMatch != nil && *param.IfMatch != blob.etag {
+		return nil, syscall.ESTALE
+	}
+
+	size := uint64(len(blob.data))
+	start := MinUInt64(param.Start, size)
+	end := size
+	if param.Count != 0 {
+		end = MinUInt64(start+param.Count, size)
+	}
+	return &GetBlobOutput{
+		HeadBlobOutput: *blob.head(),
+		Body:           ioutil.NopCloser(bytes.NewReader(blob.data[start:end])),
+	}, nil
+}
+
+func (b *HiddenBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.PutBlob(param)
+	}
+	b.avoid()
+
+	var data []byte
+	if param.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(param.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blob := &hiddenBlob{
+		key:         param.Key,
+		data:        data,
+		metadata:    copyMetadata(param.Metadata),
+		contentType: param.ContentType,
+		dirBlob:     param.DirBlob,
+	}
+	err := b.put(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &PutBlobOutput{ETag: PString(blob.etag)}, nil
+}
+
+func (b *HiddenBackend) beginUpload(key string, base []byte, metadata map[string]*string,
+	contentType *string) *MultipartBlobCommitInput {
+
+	b.mu.Lock()
+	b.nextId++
+	uploadId := fmt.Sprintf("hidden-%v", b.nextId)
+	b.uploads[uploadId] = &hiddenUpload{
+		base:        base,
+		contentType: contentType,
+		parts:       make(map[uint32][]byte),
+	}
+	b.mu.Unlock()
+
+	return &MultipartBlobCommitInput{
+		Key:      PString(key),
+		Metadata: metadata,
+		UploadId: PString(uploadId),
+		Parts:    make([]*string, 10000), // at most 10K parts
+	}
+}
+
+func (b *HiddenBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.MultipartBlobBegin(param)
+	}
+	b.avoid()
+	return b.beginUpload(param.Key, nil, param.Metadata, param.ContentType), nil
+}
+
+func (b *HiddenBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	if !b.isHidden(param.Key) {
+		return b.StorageBackend.AppendBlob(param)
+	}
+	b.avoid()
+
+	blob := b.get(param.Key)
+	if blob == nil {
+		return nil, fuse.ENOENT
+	}
+	if uint64(len(blob.data)) != param.Offset {
+		return nil, syscall.EBUSY
+	}
+	contentType := blob.contentType
+	if param.ContentType != nil {
+		contentType = param.ContentType
+	}
+	return b.beginUpload(param.Key, blob.data, blob.metadata, contentType), nil
+}
+
+func (b *HiddenBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	if !b.isHidden(*param.Commit.Key) {
+		return b.StorageBackend.MultipartBlobAdd(param)
+	}
+	b.avoid()
+
+	data, err := ioutil.ReadAll(param.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	upload, ok := b.uploads[*param.Commit.UploadId]
+	if ok {
+		upload.parts[param.PartNumber] = data
+	}
+	b.mu.Unlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(data))
+	param.Commit.Parts[param.PartNumber-1] = &etag
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (b *HiddenBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	if !b.isHidden(*param.Key) {
+		return b.StorageBackend.MultipartBlobAbort(param)
+	}
+	b.avoid()
+
+	b.mu.Lock()
+	delete(b.uploads, *param.UploadId)
+	b.mu.Unlock()
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (b *HiddenBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	if !b.isHidden(*param.Key) {
+		return b.StorageBackend.MultipartBlobCommit(param)
+	}
+	b.avoid()
+
+	b.mu.Lock()
+	upload, ok := b.uploads[*param.UploadId]
+	delete(b.uploads, *param.UploadId)
+	b.mu.Unlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	// the base is still what the blob it came from has
+	data := append([]byte(nil), upload.base...)
+	for i := uint32(1); i <= param.NumParts; i++ {
+		data = append(data, upload.parts[i]...)
+	}
+	blob := &hiddenBlob{
+		key:         *param.Key,
+		data:        data,
+		metadata:    copyMetadata(param.Metadata),
+		contentType: upload.contentType,
+	}
+	err := b.put(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &MultipartBlobCommitOutput{ETag: PString(blob.etag)}, nil
+}
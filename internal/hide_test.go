@@ -0,0 +1,230 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"io/ioutil"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+// listedBackend lists everything in one page and without a
+// delimiter, and has a prefix of its own
+type listedBackend struct {
+	objectsBackend
+}
+
+func (b *listedBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	resp, err := b.objectsBackend.ListBlobs(&ListBlobsInput{})
+	if err != nil {
+		return nil, err
+	}
+	resp.Prefixes = append(resp.Prefixes, BlobPrefixOutput{Prefix: PString("dir/._sub/")})
+	return resp, nil
+}
+
+type HideTest struct {
+	cloud *listedBackend
+	b     *HiddenBackend
+}
+
+var _ = Suite(&HideTest{})
+
+func (s *HideTest) SetUpTest(t *C) {
+	s.cloud = &listedBackend{}
+	s.b = NewHiddenBackend(s.cloud, []string{"._*", ".DS_Store"})
+}
+
+func (s *HideTest) put(t *C, key string, data string) {
+	_, err := s.b.PutBlob(&PutBlobInput{
+		Key:  key,
+		Body: bytes.NewReader([]byte(data)),
+		Size: PUInt64(uint64(len(data))),
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *HideTest) read(t *C, key string) string {
+	resp, err := s.b.GetBlob(&GetBlobInput{Key: key})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *HideTest) TestNeverUploaded(t *C) {
+	s.put(t, "dir/._file", "sidecar")
+	s.put(t, "dir/.DS_Store", "finder")
+	s.put(t, "dir/._sub/file", "under a hidden dir")
+	s.put(t, "dir/file", "data")
+
+	t.Assert(s.cloud.keys(), HasLen, 1)
+	t.Assert(string(s.cloud.get("dir/file").data), Equals, "data")
+	t.Assert(s.read(t, "dir/._file"), Equals, "sidecar")
+	t.Assert(s.read(t, "dir/._sub/file"), Equals, "under a hidden dir")
+
+	head, err := s.b.HeadBlob(&HeadBlobInput{Key: "dir/.DS_Store"})
+	t.Assert(err, IsNil)
+	t.Assert(head.Size, Equals, uint64(6))
+
+	// answered without asking the backend, they count below
+	_, err = s.b.HeadBlob(&HeadBlobInput{Key: "dir/._missing"})
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.b.HeadBlob(&HeadBlobInput{Key: "dir/._missing/"})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	_, err = s.b.DeleteBlob(&DeleteBlobInput{Key: "dir/._file"})
+	t.Assert(err, IsNil)
+	_, err = s.b.GetBlob(&GetBlobInput{Key: "dir/._file"})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	t.Assert(s.b.Avoided(), Equals, uint64(10))
+
+	// the backend doesn't even see an empty batch
+	_, err = s.b.DeleteBlobs(&DeleteBlobsInput{})
+	t.Assert(err, IsNil)
+	_, err = s.b.DeleteBlobs(&DeleteBlobsInput{Items: []string{"dir/._a"}})
+	t.Assert(err, IsNil)
+}
+
+func (s *HideTest) TestListing(t *C) {
+	s.cloud.set("dir/._old", []byte("written before"))
+	s.cloud.set("dir/file", []byte("data"))
+	s.put(t, "dir/._sub/", "")
+	s.put(t, "dir/._sub/a", "a")
+	s.put(t, "dir/._sub/b/c", "c")
+
+	resp, err := s.b.ListBlobs(&ListBlobsInput{Prefix: PString("dir/")})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 1)
+	t.Assert(*resp.Items[0].Key, Equals, "dir/file")
+	t.Assert(resp.Prefixes, HasLen, 0)
+
+	resp, err = s.b.ListBlobs(&ListBlobsInput{
+		Prefix:    PString("dir/._sub/"),
+		Delimiter: PString("/"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 2)
+	t.Assert(*resp.Items[0].Key, Equals, "dir/._sub/")
+	t.Assert(*resp.Items[1].Key, Equals, "dir/._sub/a")
+	t.Assert(resp.Prefixes, HasLen, 1)
+	t.Assert(*resp.Prefixes[0].Prefix, Equals, "dir/._sub/b/")
+}
+
+func (s *HideTest) TestLRU(t *C) {
+	s.b.maxFiles = 2
+	s.b.maxBytes = 10
+
+	s.put(t, "._a", "a")
+	s.put(t, "._b", "b")
+	// used more recently than ._b now
+	t.Assert(s.read(t, "._a"), Equals, "a")
+	s.put(t, "._c", "c")
+
+	_, err := s.b.HeadBlob(&HeadBlobInput{Key: "._b"})
+	t.Assert(err, Equals, fuse.ENOENT)
+	t.Assert(s.read(t, "._a"), Equals, "a")
+
+	// ._c goes to make room
+	s.put(t, "._big", "12345678")
+	t.Assert(s.b.lru.Len(), Equals, 2)
+	t.Assert(s.b.size, Equals, uint64(9))
+	_, err = s.b.HeadBlob(&HeadBlobInput{Key: "._c"})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	_, err = s.b.PutBlob(&PutBlobInput{
+		Key:  "._huge",
+		Body: bytes.NewReader([]byte("12345678901")),
+	})
+	t.Assert(err, Equals, syscall.ENOSPC)
+}
+
+func (s *HideTest) TestRename(t *C) {
+	s.put(t, "._tmp", "data")
+
+	_, err := s.b.RenameBlob(&RenameBlobInput{Source: "._tmp", Destination: "._a"})
+	t.Assert(err, IsNil)
+	t.Assert(s.read(t, "._a"), Equals, "data")
+
+	// to a name that's not hidden it's uploaded
+	_, err = s.b.RenameBlob(&RenameBlobInput{Source: "._a", Destination: "file"})
+	t.Assert(err, Equals, syscall.ENOTSUP)
+	_, err = s.b.CopyBlob(&CopyBlobInput{Source: "._a", Destination: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(string(s.cloud.get("file").data), Equals, "data")
+
+	// and the other way read into memory
+	_, err = s.b.CopyBlob(&CopyBlobInput{Source: "file", Destination: "._b"})
+	t.Assert(err, IsNil)
+	t.Assert(s.read(t, "._b"), Equals, "data")
+	t.Assert(s.cloud.keys(), HasLen, 1)
+}
+
+func (s *HideTest) TestMultipart(t *C) {
+	commit, err := s.b.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "._big"})
+	t.Assert(err, IsNil)
+	for i, part := range []string{"hello ", "world"} {
+		_, err = s.b.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     commit,
+			PartNumber: uint32(i + 1),
+			Body:       bytes.NewReader([]byte(part)),
+		})
+		t.Assert(err, IsNil)
+		commit.NumParts++
+	}
+	_, err = s.b.MultipartBlobCommit(commit)
+	t.Assert(err, IsNil)
+	t.Assert(s.read(t, "._big"), Equals, "hello world")
+
+	commit, err = s.b.AppendBlob(&AppendBlobInput{Key: "._big", Offset: 11})
+	t.Assert(err, IsNil)
+	_, err = s.b.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("!")),
+	})
+	t.Assert(err, IsNil)
+	commit.NumParts = 1
+	_, err = s.b.MultipartBlobCommit(commit)
+	t.Assert(err, IsNil)
+	t.Assert(s.read(t, "._big"), Equals, "hello world!")
+	t.Assert(s.b.uploads, HasLen, 0)
+}
+
+func (s *HideTest) TestFlag(t *C) {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run([]string{"goofys", "--hide-pattern", "._*", "--hide-pattern", ".DS_Store",
+		"bucket", "/mnt"})
+	t.Assert(flags, NotNil)
+	t.Assert(flags.HidePatterns, DeepEquals, []string{"._*", ".DS_Store"})
+
+	flags = nil
+	app.Run([]string{"goofys", "--hide-pattern", "[", "bucket", "/mnt"})
+	t.Assert(flags, IsNil)
+	app.Run([]string{"goofys", "--hide-pattern", "dir/._*", "bucket", "/mnt"})
+	t.Assert(flags, IsNil)
+}
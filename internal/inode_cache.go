@@ -0,0 +1,218 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InodeCache keeps the inodes in the order they were last inserted or
+// looked up, so that with --max-cached-inodes the ones that haven't
+// been for the longest can be dropped. Listings add an inode for
+// every entry, and the kernel never forgets those because it never
+// looked them up, so without this a mount that walks a big bucket
+// keeps all of it.
+//
+// Only inodes nobody can tell apart from not being cached are
+// evicted: the kernel doesn't have them, they are not open, and they
+// are not a directory with children or a mount. The next lookup of
+// one goes to the backend again. A nil one never evicts anything
+type InodeCache struct {
+	fs  *Goofys
+	max int
+
+	mu sync.Mutex
+	// of *Inode, least recently used first. Inodes that are
+	// forgotten stay in it until a pass finds them
+	lru *list.List
+	// passes don't start until the list is longer than this, so
+	// that inodes that can't be evicted don't have every insert
+	// walk over them
+	next int
+
+	kick chan struct{}
+	// updated atomically
+	evicted uint64
+}
+
+func NewInodeCache(fs *Goofys, max int) *InodeCache {
+	if max <= 0 {
+		return nil
+	}
+	return &InodeCache{
+		fs:   fs,
+		max:  max,
+		lru:  list.New(),
+		next: max,
+		kick: make(chan struct{}, 1),
+	}
+}
+
+func (c *InodeCache) Evicted() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.evicted)
+}
+
+// touch marks inode as just used, and starts a pass if there are too
+// many
+func (c *InodeCache) touch(inode *Inode) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if inode.cacheElem == nil {
+		inode.cacheElem = c.lru.PushBack(inode)
+	} else {
+		c.lru.MoveToBack(inode.cacheElem)
+	}
+	full := c.lru.Len() > c.next
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *InodeCache) remove(inode *Inode) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if inode.cacheElem != nil {
+		c.lru.Remove(inode.cacheElem)
+		inode.cacheElem = nil
+	}
+}
+
+func (c *InodeCache) Run() {
+	for range c.kick {
+		start := time.Now()
+		n := c.evict()
+		fuseLog.Debugf("evicted %v inodes in %v", n, time.Since(start))
+	}
+}
+
+// evict goes through the list from the least recently used until
+// it's a tenth under the limit, or it has seen everything once
+func (c *InodeCache) evict() (evicted int) {
+	low := c.max - c.max/10
+
+	c.mu.Lock()
+	n := c.lru.Len()
+	c.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		c.mu.Lock()
+		if c.lru.Len() <= low {
+			c.mu.Unlock()
+			break
+		}
+		e := c.lru.Front()
+		inode := e.Value.(*Inode)
+		// until we know whether it can go, so a lookup
+		// meanwhile doesn't lose its place
+		c.lru.MoveToBack(e)
+		c.mu.Unlock()
+
+		gone, ok := c.evictInode(inode)
+		if gone {
+			c.remove(inode)
+		}
+		if ok {
+			evicted++
+		}
+	}
+
+	c.mu.Lock()
+	c.next = MaxInt(c.max, c.lru.Len()+c.max/10)
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.evicted, uint64(evicted))
+	return
+}
+
+// evictInode takes inode out of the tree and the inode table if
+// nobody is using it. gone is whether it's not cached anymore, which
+// it may already not have been
+func (c *InodeCache) evictInode(inode *Inode) (gone bool, evicted bool) {
+	fs := c.fs
+
+	parent := inode.Parent
+	if parent == nil {
+		// taken out of the tree, by a listing that didn't
+		// have it anymore for example. Nothing can look it up
+		// so only the kernel could still have it
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.inodes.Get(inode.Id) != inode {
+			return true, false
+		}
+		if atomic.LoadUint64(&inode.refcnt) != 0 {
+			return
+		}
+		fs.inodes.Delete(inode.Id)
+		return true, true
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if parent.findChildUnlocked(*inode.Name) != inode {
+		return fs.inodes.Get(inode.Id) != inode, false
+	}
+
+	// lookups Ref under the parent's read lock, so this can't go
+	// up while we hold it
+	if atomic.LoadUint64(&inode.refcnt) != 0 {
+		return
+	}
+	// a readdir that has gone past it doesn't need it anymore
+	if parent.readdirNeeds(inode) {
+		return
+	}
+
+	inode.mu.RLock()
+	busy := inode.fileHandles != 0 ||
+		inode.file != nil && (inode.file.truncated || inode.file.extendTo != 0)
+	if inode.dir != nil {
+		// . and .. are always there
+		busy = busy || len(inode.dir.Children) > 2 ||
+			inode.dir.cloud != nil || len(inode.dir.readdirs) != 0
+	}
+	inode.mu.RUnlock()
+	if busy || inode.AttrTime.Equal(TIME_MAX) {
+		return
+	}
+
+	fs.mu.Lock()
+	fs.inodes.Delete(inode.Id)
+	parent.removeChildUnlocked(inode)
+	fs.mu.Unlock()
+
+	// what's cached of the dir isn't all of it anymore
+	parent.dir.DirTime = time.Time{}
+	return true, true
+}
@@ -0,0 +1,307 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// gridBackend has dirs of files, d0000/f0000 and so on. Dirs are
+// blobs of their own like on ADLv1, so looking one up is one HEAD
+type gridBackend struct {
+	memBackend
+	dirs  int
+	files int
+}
+
+func (b *gridBackend) Capabilities() *Capabilities {
+	return &Capabilities{Name: "tree", DirBlob: true}
+}
+
+func (b *gridBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	var d, f int
+	parts := strings.Split(param.Key, "/")
+	if len(parts) > 2 || len(parts[0]) != 5 {
+		return nil, fuse.ENOENT
+	}
+	if _, err := fmt.Sscanf(parts[0], "d%04d", &d); err != nil || d >= b.dirs {
+		return nil, fuse.ENOENT
+	}
+	if len(parts) == 1 {
+		return &HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          &param.Key,
+				LastModified: PTime(time.Now()),
+			},
+			IsDirBlob: true,
+		}, nil
+	}
+	if len(parts[1]) != 5 {
+		return nil, fuse.ENOENT
+	}
+	if _, err := fmt.Sscanf(parts[1], "f%04d", &f); err != nil || f >= b.files {
+		return nil, fuse.ENOENT
+	}
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          &param.Key,
+			LastModified: PTime(time.Now()),
+			Size:         uint64(f),
+		},
+	}, nil
+}
+
+func (b *gridBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	resp := &ListBlobsOutput{}
+	prefix := nilStr(param.Prefix)
+	now := time.Now()
+
+	if prefix == "" {
+		for d := 0; d < b.dirs; d++ {
+			resp.Prefixes = append(resp.Prefixes, BlobPrefixOutput{
+				Prefix: PString(fmt.Sprintf("d%04d/", d)),
+			})
+		}
+		return resp, nil
+	}
+
+	var d int
+	if _, err := fmt.Sscanf(prefix, "d%04d/", &d); err != nil || d >= b.dirs {
+		return resp, nil
+	}
+	for f := 0; f < b.files; f++ {
+		resp.Items = append(resp.Items, BlobItemOutput{
+			Key:          PString(fmt.Sprintf("%vf%04d", prefix, f)),
+			LastModified: &now,
+			Size:         uint64(f),
+		})
+	}
+	return resp, nil
+}
+
+type InodeCacheTest struct {
+}
+
+var _ = Suite(&InodeCacheTest{})
+
+func newTreeFs(dirs, files, max int) (fs *Goofys, root *Inode) {
+	fs = newTestFs(&gridBackend{dirs: dirs, files: files}, &FlagStorage{
+		Cheap:        true,
+		StatCacheTTL: time.Minute,
+		TypeCacheTTL: time.Minute,
+	})
+	// tests run the cache themselves
+	fs.inodeCache = NewInodeCache(fs, max)
+	return fs, fs.testRoot()
+}
+
+// listDir reads dir like the kernel does, through a handle it opened
+func listDir(t *C, dir *Inode) (entries int) {
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	for {
+		en, err := dh.ReadDir(fuseops.DirOffset(entries))
+		t.Assert(err, IsNil)
+		if en == nil {
+			return
+		}
+		entries++
+	}
+}
+
+func lookUpId(fs *Goofys, parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+	lookup := fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+	err := fs.LookUpInode(nil, &lookup)
+	return lookup.Entry.Child, err
+}
+
+func forget(fs *Goofys, id fuseops.InodeID) {
+	fs.ForgetInode(nil, &fuseops.ForgetInodeOp{Inode: id, N: 1})
+}
+
+func (s *InodeCacheTest) TestEvictWalk(t *C) {
+	const dirs, files, max = 200, 250, 1000
+
+	before := heapInUse()
+	fs, root := newTreeFs(dirs, files, max)
+	t.Assert(listDir(t, root), Equals, dirs+2)
+
+	var peak int
+	for d := 0; d < dirs; d++ {
+		id, err := lookUpId(fs, root.Id, fmt.Sprintf("d%04d", d))
+		t.Assert(err, IsNil)
+		t.Assert(listDir(t, fs.getInodeOrDie(id)), Equals, files+2)
+		forget(fs, id)
+		peak = MaxInt(peak, fs.inodes.Len())
+
+		// what Run would do, without racing the walk
+		select {
+		case <-fs.inodeCache.kick:
+			fs.inodeCache.evict()
+		default:
+		}
+	}
+
+	// root, and a listing in between passes
+	t.Assert(peak <= max+files+3, Equals, true, Commentf("%v", peak))
+	t.Assert(fs.inodeCache.Evicted() >= uint64(dirs*files-max-files), Equals, true)
+
+	// they would take ~20MB if all of them were kept
+	after := heapInUse()
+	runtime.KeepAlive(fs)
+	t.Assert(after < before+uint64(dirs*files)*50, Equals, true,
+		Commentf("%v -> %v bytes", before, after))
+
+	// the walk can be done again, from the backend
+	t.Assert(listDir(t, root), Equals, dirs+2)
+	id, err := lookUpId(fs, root.Id, "d0000")
+	t.Assert(err, IsNil)
+	t.Assert(listDir(t, fs.getInodeOrDie(id)), Equals, files+2)
+}
+
+func (s *InodeCacheTest) TestEvictKeepsInUse(t *C) {
+	fs, root := newTreeFs(1, 100, 10)
+	listDir(t, root)
+
+	dirId, err := lookUpId(fs, root.Id, "d0000")
+	t.Assert(err, IsNil)
+	dir := fs.getInodeOrDie(dirId)
+	fileId, err := lookUpId(fs, dirId, "f0000")
+	t.Assert(err, IsNil)
+
+	// a readdir is going through it
+	dh := dir.OpenDir()
+	t.Assert(listDir(t, dir), Equals, 100+2)
+	fs.inodeCache.evict()
+	t.Assert(len(dir.dir.Children), Equals, 100+2)
+	dh.CloseDir()
+
+	fs.inodeCache.evict()
+	// the kernel has these
+	t.Assert(fs.inodes.Get(dirId), Equals, dir)
+	t.Assert(fs.inodes.Get(fileId), NotNil)
+	t.Assert(dir.findChild("f0000"), NotNil)
+	t.Assert(dir.findChild("f0001"), IsNil)
+	t.Assert(fs.inodes.Len() <= 10, Equals, true)
+
+	// what's cached of it isn't all of it, so it's listed again
+	t.Assert(listDir(t, dir), Equals, 100+2)
+
+	forget(fs, fileId)
+	forget(fs, dirId)
+	fs.inodeCache.evict()
+	t.Assert(fs.inodes.Get(fileId), IsNil)
+	t.Assert(fs.inodes.Len() <= 10, Equals, true)
+}
+
+func (s *InodeCacheTest) TestEvictReturned(t *C) {
+	fs, root := newTreeFs(1, 100, 10)
+	listDir(t, root)
+
+	dirId, err := lookUpId(fs, root.Id, "d0000")
+	t.Assert(err, IsNil)
+	dir := fs.getInodeOrDie(dirId)
+
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	// . and .. and half of the files
+	for i := 0; i < 52; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		t.Assert(en, NotNil)
+	}
+
+	// the readdir only needs the ones it hasn't returned yet
+	fs.inodeCache.evict()
+	t.Assert(dir.findChild("f0000"), IsNil)
+	t.Assert(dir.findChild("f0050"), NotNil)
+
+	var names []string
+	for i := 52; ; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		if en == nil {
+			break
+		}
+		t.Assert(en.Offset, Equals, fuseops.DirOffset(i+1))
+		names = append(names, en.Name)
+	}
+	t.Assert(names, HasLen, 50)
+	t.Assert(names[0], Equals, "f0050")
+	t.Assert(names[49], Equals, "f0099")
+}
+
+func (s *InodeCacheTest) TestEvictConcurrentLookUp(t *C) {
+	const dirs, files = 20, 50
+
+	fs, root := newTreeFs(dirs, files, 100)
+	go fs.inodeCache.Run()
+	listDir(t, root)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+
+			for i := 0; i < 500; i++ {
+				dirName := fmt.Sprintf("d%04d", r.Intn(dirs))
+				dirId, err := lookUpId(fs, root.Id, dirName)
+				t.Assert(err, IsNil)
+				dir := fs.getInodeOrDie(dirId)
+				t.Assert(*dir.Name, Equals, dirName)
+
+				if g%2 == 0 {
+					// listings add what gets evicted
+					t.Assert(listDir(t, dir), Equals, files+2)
+				}
+
+				name := fmt.Sprintf("f%04d", r.Intn(files))
+				id, err := lookUpId(fs, dirId, name)
+				t.Assert(err, IsNil)
+				t.Assert(*fs.getInodeOrDie(id).Name, Equals, name)
+
+				forget(fs, id)
+				forget(fs, dirId)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	t.Assert(fs.inodeCache.Evicted() > 0, Equals, true)
+	fs.inodeCache.evict()
+	t.Assert(fs.inodes.Len() <= 100, Equals, true, Commentf("%v", fs.inodes.Len()))
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const INODE_TABLE_SHARDS = 64
+
+// InodeTable maps inode ids to inodes. Every fuse op starts by
+// looking up its inode, so the table is split into shards with their
+// own locks instead of having all of them go through Goofys.mu
+type InodeTable struct {
+	shards [INODE_TABLE_SHARDS]inodeShard
+}
+
+type inodeShard struct {
+	mu     sync.RWMutex
+	inodes map[fuseops.InodeID]*Inode
+	// keep each shard on its own cache line
+	_ [32]byte
+}
+
+func NewInodeTable() *InodeTable {
+	t := &InodeTable{}
+	for i := range t.shards {
+		t.shards[i].inodes = make(map[fuseops.InodeID]*Inode)
+	}
+	return t
+}
+
+func (t *InodeTable) shard(id fuseops.InodeID) *inodeShard {
+	// ids are handed out sequentially, so they spread evenly
+	return &t.shards[uint64(id)%INODE_TABLE_SHARDS]
+}
+
+func (t *InodeTable) Get(id fuseops.InodeID) *Inode {
+	s := t.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inodes[id]
+}
+
+func (t *InodeTable) Set(id fuseops.InodeID, inode *Inode) {
+	s := t.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inodes[id] = inode
+}
+
+func (t *InodeTable) Delete(id fuseops.InodeID) {
+	s := t.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inodes, id)
+}
+
+func (t *InodeTable) Len() (n int) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		n += len(s.inodes)
+		s.mu.RUnlock()
+	}
+	return
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type InodeTableTest struct {
+}
+
+var _ = Suite(&InodeTableTest{})
+
+func (s *InodeTableTest) TestInodeTable(t *C) {
+	table := NewInodeTable()
+	inodes := make([]*Inode, 1000)
+	for i := range inodes {
+		inodes[i] = &Inode{Id: fuseops.InodeID(i + 1)}
+		table.Set(inodes[i].Id, inodes[i])
+	}
+	t.Assert(table.Len(), Equals, len(inodes))
+
+	for _, inode := range inodes {
+		t.Assert(table.Get(inode.Id), Equals, inode)
+	}
+
+	table.Delete(inodes[0].Id)
+	t.Assert(table.Get(inodes[0].Id), IsNil)
+	t.Assert(table.Len(), Equals, len(inodes)-1)
+}
+
+const STAT_FILES = 10000
+
+// statFiles looks up and stats n distinct files from each of
+// goroutines, all in the same directory
+func statFiles(t *C, fs *Goofys, dir *Inode, goroutines int, n int) {
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < n; i++ {
+				lookup := fuseops.LookUpInodeOp{
+					Parent: dir.Id,
+					Name:   fmt.Sprintf("file%08d", (g*n+i)%STAT_FILES),
+				}
+				err := fs.LookUpInode(nil, &lookup)
+				t.Assert(err, IsNil)
+
+				getattr := fuseops.GetInodeAttributesOp{
+					Inode: lookup.Entry.Child,
+				}
+				err = fs.GetInodeAttributes(nil, &getattr)
+				t.Assert(err, IsNil)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func newStatFs(t *C) (fs *Goofys, dir *Inode) {
+	fs, dir = newListingFs(STAT_FILES)
+	// lookups should be served from what we listed
+	fs.flags.StatCacheTTL = time.Hour
+	fs.flags.TypeCacheTTL = time.Hour
+	t.Assert(listTestDir(t, dir), Equals, STAT_FILES+2)
+	return
+}
+
+func (s *InodeTableTest) TestConcurrentLookUp(t *C) {
+	fs, dir := newStatFs(t)
+
+	statFiles(t, fs, dir, 64, STAT_FILES/64)
+
+	// every lookup took a reference
+	refs := uint64(0)
+	dir.mu.RLock()
+	for _, c := range dir.dir.Children {
+		if *c.Name != "." && *c.Name != ".." {
+			refs += c.refcnt
+		}
+	}
+	dir.mu.RUnlock()
+	t.Assert(refs, Equals, uint64(STAT_FILES/64*64))
+}
+
+// compare ns/op of these two to see how lookups scale, run with
+// -check.b
+func (s *InodeTableTest) BenchmarkStat1(t *C) {
+	fs, dir := newStatFs(t)
+	t.ResetTimer()
+	statFiles(t, fs, dir, 1, t.N)
+}
+
+func (s *InodeTableTest) BenchmarkStat64(t *C) {
+	fs, dir := newStatFs(t)
+	t.ResetTimer()
+	statFiles(t, fs, dir, 64, t.N/64+1)
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+)
+
+// When a process blocked on us gets a signal the kernel sends
+// FUSE_INTERRUPT, and the fuse library cancels the context of that
+// op. Whoever is waiting on the backend for that op should give up
+// and return EINTR
+
+// watchInterrupt calls interrupt if ctx is done before stop is
+// called. stop doesn't return until interrupt has returned, if it
+// was called at all
+func watchInterrupt(ctx context.Context, interrupt func()) (stop func()) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			interrupt()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// interruptDone is ctx.Done() that's ok with a nil ctx, for the
+// tests that don't have one
+func interruptDone(ctx context.Context) <-chan struct{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Done()
+}
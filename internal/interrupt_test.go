@@ -0,0 +1,204 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// stalledBackend hangs, like a bucket that stopped answering. Bodies
+// send good bytes and then nothing until the request is cancelled or
+// closed, listings send nothing at all
+type stalledBackend struct {
+	slowBackend
+	good  uint64
+	stall int32
+}
+
+type stalledBody struct {
+	ctx       context.Context
+	r         io.Reader
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (b *stalledBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n != 0 || err != io.EOF {
+		return n, err
+	}
+
+	select {
+	case <-interruptDone(b.ctx):
+		return 0, b.ctx.Err()
+	case <-b.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (b *stalledBody) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *stalledBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	resp, err := b.slowBackend.GetBlob(param)
+	if err != nil || atomic.LoadInt32(&b.stall) == 0 {
+		return resp, err
+	}
+
+	resp.Body = &stalledBody{
+		ctx:    param.Context,
+		r:      io.LimitReader(resp.Body, int64(b.good)),
+		closed: make(chan struct{}),
+	}
+	return resp, nil
+}
+
+func (b *stalledBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	if atomic.LoadInt32(&b.stall) == 0 {
+		return b.slowBackend.ListBlobs(param)
+	}
+
+	<-interruptDone(param.Context)
+	return nil, param.Context.Err()
+}
+
+type InterruptTest struct {
+	cloud *stalledBackend
+	// goroutines before the test
+	goroutines int
+}
+
+var _ = Suite(&InterruptTest{})
+
+func (s *InterruptTest) SetUpTest(t *C) {
+	s.cloud = &stalledBackend{good: 64 * 1024, stall: 1}
+	s.cloud.size = 2 * uint64(READAHEAD_CHUNK)
+	s.goroutines = runtime.NumGoroutine()
+}
+
+// interruptAfter is what the fuse library does when the kernel sends
+// FUSE_INTERRUPT
+func interruptAfter(d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(d, cancel)
+	return ctx
+}
+
+func (s *InterruptTest) checkNoLeak(t *C) {
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= s.goroutines {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v goroutines, was %v", runtime.NumGoroutine(), s.goroutines)
+}
+
+func (s *InterruptTest) readInterrupted(t *C, fh *FileHandle) {
+	fh.inode.Attributes.Size = s.cloud.size
+
+	start := time.Now()
+	n, err := fh.ReadFileInterruptible(interruptAfter(50*time.Millisecond),
+		0, make([]byte, 128*1024))
+	t.Assert(err, Equals, syscall.EINTR)
+	t.Assert(n, Equals, 0)
+	t.Assert(time.Since(start) < time.Second, Equals, true)
+
+	t.Assert(fh.reader, IsNil)
+	t.Assert(fh.buffers, HasLen, 0)
+	s.checkNoLeak(t)
+
+	// the next read is fine
+	atomic.StoreInt32(&s.cloud.stall, 0)
+	readTestFile(t, fh, 1024*1024)
+}
+
+func (s *InterruptTest) TestReadStream(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	s.readInterrupted(t, fh)
+}
+
+func (s *InterruptTest) TestReadAhead(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.seqReadAmount = uint64(READAHEAD_CHUNK)
+	s.readInterrupted(t, fh)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+}
+
+func (s *InterruptTest) TestReadAheadSeek(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.Attributes.Size = s.cloud.size
+	fh.poolHandle = fh.inode.fs.bufferPool
+	t.Assert(fh.readAhead(0, 0), IsNil)
+	t.Assert(fh.buffers, HasLen, 2)
+
+	// the readahead is stuck, moving away mustn't wait for it
+	start := time.Now()
+	buf := make([]byte, 4096)
+	n, err := fh.ReadFile(int64(READAHEAD_CHUNK), buf)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, len(buf))
+	t.Assert(time.Since(start) < time.Second, Equals, true)
+	t.Assert(fh.buffers, HasLen, 0)
+	t.Assert(fh.poolHandle.Stats().UsedBytes, Equals, uint64(0))
+
+	// as if it was opened
+	fh.inode.fileHandles = 1
+	fh.Release()
+	s.checkNoLeak(t)
+}
+
+func (s *InterruptTest) TestReadDir(t *C) {
+	_, dir := newListingFs(0)
+	dir.Parent.dir.cloud = s.cloud
+
+	dh := NewDirHandle(dir)
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	ctx := interruptAfter(50 * time.Millisecond)
+	start := time.Now()
+	var err error
+	for i := 0; err == nil; i++ {
+		_, err = dh.ReadDirInterruptible(ctx, fuseops.DirOffset(i))
+	}
+	t.Assert(err, Equals, syscall.EINTR)
+	t.Assert(time.Since(start) < time.Second, Equals, true)
+	s.checkNoLeak(t)
+
+	atomic.StoreInt32(&s.cloud.stall, 0)
+	entries := 0
+	for {
+		en, err := dh.ReadDir(fuseops.DirOffset(entries))
+		t.Assert(err, IsNil)
+		if en == nil {
+			break
+		}
+		entries++
+	}
+	// . and ..
+	t.Assert(entries, Equals, 2)
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+// A key the backend won't take fails with a 400 that doesn't say
+// much, after we've told the kernel the file was created. So keys we
+// are about to create are checked against the limits in
+// Capabilities first
+
+// keyLength is the length of key the way the backend counts it
+func keyLength(cap *Capabilities, key string) int {
+	if cap.KeyLengthInChars {
+		return utf8.RuneCountInString(key)
+	}
+	return len(key)
+}
+
+// checkKey returns ENAMETOOLONG or EINVAL if the backend won't take
+// key, and logs which part of it is the problem. Directories are
+// checked with the trailing / they are created with
+func checkKey(cap *Capabilities, key string) error {
+	components := strings.Split(strings.TrimSuffix(key, "/"), "/")
+
+	for _, c := range components {
+		if !utf8.ValidString(c) {
+			log.Warnf("%q in %q is not valid UTF-8", c, key)
+			return syscall.EINVAL
+		}
+		if i := strings.IndexAny(c, cap.InvalidKeyChars); i != -1 {
+			log.Warnf("%q in %q has %q, which %v doesn't allow",
+				c, key, c[i], cap.Name)
+			return syscall.EINVAL
+		}
+	}
+
+	if cap.MaxKeyLength != 0 && keyLength(cap, key) > cap.MaxKeyLength {
+		log.Warnf("%q is longer than the %v %v allows, at %q",
+			key, cap.MaxKeyLength, cap.Name, components[len(components)-1])
+		return syscall.ENAMETOOLONG
+	}
+	if cap.MaxPathDepth != 0 && len(components) > cap.MaxPathDepth {
+		log.Warnf("%q is deeper than the %v levels %v allows, at %q",
+			key, cap.MaxPathDepth, cap.Name, components[len(components)-1])
+		return syscall.ENAMETOOLONG
+	}
+	return nil
+}
+
+// checkChildKey checks the key of a child we are about to create or
+// rename to
+func (parent *Inode) checkChildKey(name string, isDir bool) error {
+	cloud, key := parent.cloud()
+	key = appendChildName(key, name)
+	if isDir && !cloud.Capabilities().DirBlob {
+		key += "/"
+	}
+	return checkKey(cloud.Capabilities(), key)
+}
+
+// metadataSize is the size of user metadata the way S3 counts it,
+// the keys without the x-amz-meta- and the values
+func metadataSize(meta map[string]*string) (size int) {
+	for k, v := range meta {
+		size += len(k) + len(nilStr(v))
+	}
+	return
+}
+
+// checkMetadata returns E2BIG if the backend won't take meta for key
+func checkMetadata(cap *Capabilities, key string, meta map[string]*string) error {
+	if cap.MaxMetadataSize == 0 {
+		return nil
+	}
+	if size := metadataSize(meta); size > cap.MaxMetadataSize {
+		log.Warnf("metadata of %q is %v bytes, more than the %v %v allows",
+			key, size, cap.MaxMetadataSize, cap.Name)
+		return syscall.E2BIG
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// limitedBackend is a memBackend with the limits of a real one, that
+// counts copies instead of doing them
+type limitedBackend struct {
+	memBackend
+
+	copies int
+}
+
+func (b *limitedBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.copies++
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *limitedBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	return &DeleteBlobsOutput{}, nil
+}
+
+type KeyLimitsTest struct {
+	s3    Capabilities
+	azure Capabilities
+	gcs   Capabilities
+}
+
+var _ = Suite(&KeyLimitsTest{})
+
+func (s *KeyLimitsTest) SetUpTest(t *C) {
+	s.s3 = Capabilities{Name: "s3", MaxKeyLength: 1024}
+	s.azure = Capabilities{Name: "wasb", MaxKeyLength: 1024,
+		KeyLengthInChars: true, MaxPathDepth: 254}
+	s.gcs = Capabilities{Name: "gcs", MaxKeyLength: 1024, InvalidKeyChars: "\r\n"}
+}
+
+func (s *KeyLimitsTest) TestCheckKey(t *C) {
+	t.Assert(checkKey(&s.s3, strings.Repeat("a", 1024)), IsNil)
+	t.Assert(checkKey(&s.s3, strings.Repeat("a", 1025)), Equals, syscall.ENAMETOOLONG)
+	t.Assert(checkKey(&s.s3, strings.Repeat("a", 1023)+"/"), IsNil)
+	t.Assert(checkKey(&s.s3, strings.Repeat("a", 1024)+"/"), Equals, syscall.ENAMETOOLONG)
+	t.Assert(checkKey(&s.s3, "dir/\xff"), Equals, syscall.EINVAL)
+	t.Assert(checkKey(&s.s3, "new\nline"), IsNil)
+
+	// azure counts characters
+	t.Assert(checkKey(&s.azure, strings.Repeat("é", 1024)), IsNil)
+	t.Assert(checkKey(&s.s3, strings.Repeat("é", 1024)), Equals, syscall.ENAMETOOLONG)
+	t.Assert(checkKey(&s.azure, strings.Repeat("d/", 253)+"f"), IsNil)
+	t.Assert(checkKey(&s.azure, strings.Repeat("d/", 254)+"f"), Equals, syscall.ENAMETOOLONG)
+	t.Assert(checkKey(&s.azure, strings.Repeat("d/", 254)), IsNil)
+
+	t.Assert(checkKey(&s.gcs, "new\nline"), Equals, syscall.EINVAL)
+	t.Assert(checkKey(&Capabilities{}, strings.Repeat("a", 4096)), IsNil)
+}
+
+func (s *KeyLimitsTest) TestCheckChildKey(t *C) {
+	cloud := &limitedBackend{memBackend: memBackend{cap: s.s3}}
+	dir := newTestInode(cloud).Parent
+
+	t.Assert(dir.checkChildKey(strings.Repeat("a", 1024), false), IsNil)
+	// with the trailing /
+	t.Assert(dir.checkChildKey(strings.Repeat("a", 1024), true), Equals, syscall.ENAMETOOLONG)
+
+	cloud.cap.DirBlob = true
+	t.Assert(dir.checkChildKey(strings.Repeat("a", 1024), true), IsNil)
+}
+
+func (s *KeyLimitsTest) TestRenameChildren(t *C) {
+	long := strings.Repeat("x", 1000)
+	cloud := &limitedBackend{memBackend: memBackend{cap: s.s3}}
+	cloud.add("dir/a", "dir/sub/"+long, "dir/z")
+	dir := newTestInode(cloud)
+
+	// dir/sub/xxx is fine, renamed/sub/xxx still is, but not
+	// something much longer
+	t.Assert(dir.renameChildren(nil, cloud, "dir/", dir, strings.Repeat("r", 15)+"/"),
+		IsNil)
+	t.Assert(cloud.copies, Equals, 3)
+
+	cloud.copies = 0
+	t.Assert(dir.renameChildren(nil, cloud, "dir/", dir, strings.Repeat("r", 30)+"/"),
+		Equals, syscall.ENAMETOOLONG)
+	t.Assert(cloud.copies, Equals, 0)
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "gopkg.in/check.v1"
+)
+
+// listAll follows the tokens and returns every entry, prefixes end
+// with /, in the order they came. Each page is checked on the way
+func listAll(t *C, cloud StorageBackend, param ListBlobsInput) (entries []string) {
+	param.ContinuationToken = nil
+
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatalf("too many pages listing %v", nilStr(param.Prefix))
+		}
+
+		resp, err := cloud.ListBlobs(&param)
+		t.Assert(err, IsNil)
+
+		var keys, prefixes []string
+		for _, i := range resp.Items {
+			keys = append(keys, *i.Key)
+		}
+		for _, p := range resp.Prefixes {
+			prefixes = append(prefixes, *p.Prefix)
+		}
+		t.Assert(sort.StringsAreSorted(keys), Equals, true,
+			Commentf("items out of order: %v", keys))
+		t.Assert(sort.StringsAreSorted(prefixes), Equals, true,
+			Commentf("prefixes out of order: %v", prefixes))
+		if param.MaxKeys != nil {
+			t.Assert(len(keys)+len(prefixes) <= int(*param.MaxKeys), Equals, true,
+				Commentf("%v entries with MaxKeys %v", len(keys)+len(prefixes), *param.MaxKeys))
+		}
+		t.Assert(resp.IsTruncated, Equals, resp.NextContinuationToken != nil)
+
+		page := append(keys, prefixes...)
+		sort.Strings(page)
+		entries = append(entries, page...)
+
+		if !resp.IsTruncated {
+			return
+		}
+		param.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// checkListConformance lists prefix with different MaxKeys, the
+// pages put together have to be the same as listing it in one go
+func checkListConformance(t *C, cloud StorageBackend, prefix string, delim *string) []string {
+	all := listAll(t, cloud, ListBlobsInput{Prefix: &prefix, Delimiter: delim})
+	t.Assert(sort.StringsAreSorted(all), Equals, true)
+
+	for maxKeys := uint32(1); maxKeys <= 3; maxKeys++ {
+		paged := listAll(t, cloud, ListBlobsInput{
+			Prefix:    &prefix,
+			Delimiter: delim,
+			MaxKeys:   PUInt32(maxKeys),
+		})
+		t.Assert(paged, DeepEquals, all,
+			Commentf("prefix %v with MaxKeys %v", prefix, maxKeys))
+	}
+
+	return all
+}
+
+type ListConformanceTest struct {
+	cloud *memBackend
+}
+
+var _ = Suite(&ListConformanceTest{})
+
+func (s *ListConformanceTest) SetUpTest(t *C) {
+	s.cloud = newMemBackend(
+		"a",
+		"dir/",
+		"dir/b",
+		"dir/c/d",
+		"dir/e",
+		"dir2/f",
+		"empty_dir/",
+		"file",
+	)
+}
+
+func (s *ListConformanceTest) TestList(t *C) {
+	t.Assert(checkListConformance(t, s.cloud, "", aws.String("/")), DeepEquals,
+		[]string{"a", "dir/", "dir2/", "empty_dir/", "file"})
+	t.Assert(checkListConformance(t, s.cloud, "", nil), DeepEquals, s.cloud.keys())
+
+	// the dir itself, once
+	t.Assert(checkListConformance(t, s.cloud, "dir/", aws.String("/")), DeepEquals,
+		[]string{"dir/", "dir/b", "dir/c/", "dir/e"})
+	t.Assert(checkListConformance(t, s.cloud, "empty_dir/", aws.String("/")), DeepEquals,
+		[]string{"empty_dir/"})
+	t.Assert(checkListConformance(t, s.cloud, "dir", aws.String("/")), DeepEquals,
+		[]string{"dir/", "dir2/"})
+
+	// prefix is a file
+	t.Assert(checkListConformance(t, s.cloud, "file", aws.String("/")), DeepEquals,
+		[]string{"file"})
+	t.Assert(checkListConformance(t, s.cloud, "file/", aws.String("/")), IsNil)
+	t.Assert(checkListConformance(t, s.cloud, "random", aws.String("/")), IsNil)
+}
+
+func (s *ListConformanceTest) TestStartAfter(t *C) {
+	t.Assert(listAll(t, s.cloud, ListBlobsInput{
+		Delimiter:  aws.String("/"),
+		StartAfter: aws.String("dir/"),
+		MaxKeys:    PUInt32(1),
+	}), DeepEquals, []string{"dir2/", "empty_dir/", "file"})
+
+	// the token wins
+	resp, err := s.cloud.ListBlobs(&ListBlobsInput{
+		Delimiter:         aws.String("/"),
+		StartAfter:        aws.String("a"),
+		ContinuationToken: aws.String("empty_dir/"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Prefixes), Equals, 0)
+	t.Assert(len(resp.Items), Equals, 1)
+	t.Assert(*resp.Items[0].Key, Equals, "file")
+	t.Assert(resp.IsTruncated, Equals, false)
+}
+
+func (s *ListConformanceTest) TestPageListResults(t *C) {
+	prefixes := []BlobPrefixOutput{{PString("b/")}, {PString("a/")}}
+	items := []BlobItemOutput{{Key: PString("c")}, {Key: PString("a")}, {Key: PString("b")}}
+
+	p, i, next := pageListResults(prefixes, items, "", 3)
+	t.Assert(len(p), Equals, 1)
+	t.Assert(*p[0].Prefix, Equals, "a/")
+	t.Assert(len(i), Equals, 2)
+	t.Assert(*i[0].Key, Equals, "a")
+	t.Assert(*i[1].Key, Equals, "b")
+	t.Assert(*next, Equals, "b")
+
+	p, i, next = pageListResults(prefixes, items, *next, 3)
+	t.Assert(len(p), Equals, 1)
+	t.Assert(*p[0].Prefix, Equals, "b/")
+	t.Assert(len(i), Equals, 1)
+	t.Assert(*i[0].Key, Equals, "c")
+	t.Assert(next, IsNil)
+
+	// no limit
+	p, i, next = pageListResults(prefixes, items, "", 0)
+	t.Assert(len(p)+len(i), Equals, 5)
+	t.Assert(next, IsNil)
+}
+
+func (s *ListConformanceTest) TestV1NextMarker(t *C) {
+	// what S3 v1 listings look like when they are truncated
+	t.Assert(v1NextMarker(&s3.ListObjectsOutput{}), IsNil)
+
+	objs := &s3.ListObjectsOutput{
+		Contents: []*s3.Object{{Key: aws.String("a")}, {Key: aws.String("c")}},
+	}
+	t.Assert(*v1NextMarker(objs), Equals, "c")
+
+	objs.CommonPrefixes = []*s3.CommonPrefix{{Prefix: aws.String("b/")}}
+	t.Assert(*v1NextMarker(objs), Equals, "c")
+
+	objs.CommonPrefixes = append(objs.CommonPrefixes,
+		&s3.CommonPrefix{Prefix: aws.String("d/")})
+	t.Assert(*v1NextMarker(objs), Equals, "d/")
+
+	objs.Contents = nil
+	t.Assert(*v1NextMarker(objs), Equals, "d/")
+}
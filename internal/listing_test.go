@@ -0,0 +1,425 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// listingBackend has one directory of numbered objects, and pages
+// through them 1000 at a time like S3 does
+type listingBackend struct {
+	memBackend
+	keys int
+
+	heads int
+	lists int
+	// if set, listings wait for it to be closed
+	block chan struct{}
+}
+
+func (b *listingBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.mu.Lock()
+	b.heads++
+	b.mu.Unlock()
+
+	var i int
+	_, err := fmt.Sscanf(param.Key, LISTING_TEST_DIR+"/file%08d", &i)
+	if err != nil || i >= b.keys {
+		return nil, fuse.ENOENT
+	}
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          &param.Key,
+			LastModified: PTime(time.Now()),
+			Size:         uint64(i),
+		},
+	}, nil
+}
+
+func (b *listingBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	if *param.Prefix != LISTING_TEST_DIR+"/" {
+		return &ListBlobsOutput{}, nil
+	}
+
+	b.mu.Lock()
+	b.lists++
+	block := b.block
+	b.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	start := 0
+	if param.ContinuationToken != nil {
+		start, _ = strconv.Atoi(*param.ContinuationToken)
+	}
+	end := MinInt(start+1000, b.keys)
+
+	now := time.Now()
+	items := getListItems()
+	for i := start; i < end; i++ {
+		items = append(items, BlobItemOutput{
+			Key:          PString(fmt.Sprintf("%vfile%08d", *param.Prefix, i)),
+			ETag:         PString(fmt.Sprintf("\"%032x\"", i)),
+			LastModified: &now,
+			Size:         uint64(i),
+			// decoded from the response, so every item
+			// has its own copy
+			StorageClass: PString(string([]byte("STANDARD"))),
+		})
+	}
+
+	resp := &ListBlobsOutput{
+		Items:       items,
+		IsTruncated: end < b.keys,
+	}
+	if resp.IsTruncated {
+		resp.NextContinuationToken = PString(strconv.Itoa(end))
+	}
+	return resp, nil
+}
+
+type ListingTest struct {
+}
+
+var _ = Suite(&ListingTest{})
+
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+const LISTING_TEST_DIR = "training-data-2019-06-01"
+
+// newListingFs returns a file system with a training-data directory
+// of n objects, which hasn't been listed yet
+func newListingFs(n int) (fs *Goofys, dir *Inode) {
+	fs = newTestFs(&listingBackend{keys: n}, &FlagStorage{Cheap: true})
+	return fs, newTestDir(fs.testRoot(), LISTING_TEST_DIR)
+}
+
+func listTestDir(t *C, dir *Inode) (entries int) {
+	dh := NewDirHandle(dir)
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	for {
+		en, err := dh.ReadDir(fuseops.DirOffset(entries))
+		t.Assert(err, IsNil)
+		if en == nil {
+			return
+		}
+		entries++
+	}
+}
+
+// bytesPerInode lists a directory of n objects and returns how much
+// memory the resulting inodes hold on to
+func bytesPerInode(t *C, n int) uint64 {
+	before := heapInUse()
+
+	fs, dir := newListingFs(n)
+	// plus . and ..
+	t.Assert(listTestDir(t, dir), Equals, n+2)
+
+	after := heapInUse()
+	runtime.KeepAlive(fs)
+	return (after - before) / uint64(n)
+}
+
+func (s *ListingTest) TestInodeMemory(t *C) {
+	// it used to be 700+, mostly for a map of the etag and
+	// storage class, and the full key behind the name
+	t.Assert(bytesPerInode(t, 100000) < 450, Equals, true)
+}
+
+// run with -check.b, takes a few GB of memory
+func (s *ListingTest) BenchmarkInodeMemory(t *C) {
+	for i := 0; i < t.N; i++ {
+		t.Logf("%v bytes per inode", bytesPerInode(t, 10*1000*1000))
+	}
+}
+
+func (s *ListingTest) lookUp(t *C, fs *Goofys, dir *Inode, name string) *Inode {
+	lookup := fuseops.LookUpInodeOp{
+		Parent: dir.Id,
+		Name:   name,
+	}
+	err := fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+	return fs.getInodeOrDie(lookup.Entry.Child)
+}
+
+func (s *ListingTest) TestLookUpFromListing(t *C) {
+	fs, dir := newListingFs(100)
+	fs.flags.StatCacheTTL = time.Minute
+	fs.flags.TypeCacheTTL = time.Minute
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	listTestDir(t, dir)
+	// as if the listing took a while, and the first entries
+	// expired by the time it was done
+	file := dir.findChildUnlocked("file00000000")
+	file.AttrTime = time.Now().Add(-2 * time.Minute)
+
+	t.Assert(s.lookUp(t, fs, dir, "file00000000"), Equals, file)
+	t.Assert(cloud.heads, Equals, 0)
+	t.Assert(fs.lookupsFromListing, Equals, uint64(1))
+
+	// the listing itself is too old
+	dir.dir.DirTime = time.Now().Add(-time.Minute - time.Second)
+	t.Assert(s.lookUp(t, fs, dir, "file00000000"), Equals, file)
+	t.Assert(cloud.heads, Equals, 1)
+
+	// fresh listing, but it didn't include this entry
+	dir.dir.DirTime = time.Now()
+	file = dir.findChildUnlocked("file00000001")
+	file.AttrTime = time.Now().Add(-2 * time.Minute)
+	file.listGen = 0
+	t.Assert(s.lookUp(t, fs, dir, "file00000001"), Equals, file)
+	t.Assert(cloud.heads, Equals, 2)
+	t.Assert(fs.lookupsFromListing, Equals, uint64(1))
+}
+
+func (s *ListingTest) TestLookUpFromOlderListing(t *C) {
+	fs, dir := newListingFs(100)
+	fs.flags.StatCacheTTL = time.Minute
+	fs.flags.TypeCacheTTL = time.Minute
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	listTestDir(t, dir)
+	file := dir.findChildUnlocked("file00000002")
+	file.AttrTime = time.Now().Add(-2 * time.Minute)
+
+	// the directory has been listed again since, and the entry
+	// wasn't refreshed by it
+	dir.dir.DirTime = time.Time{}
+	listTestDir(t, dir)
+	file.listGen--
+	file.AttrTime = time.Now().Add(-2 * time.Minute)
+
+	t.Assert(s.lookUp(t, fs, dir, "file00000002"), Equals, file)
+	t.Assert(cloud.heads, Equals, 1)
+	t.Assert(fs.lookupsFromListing, Equals, uint64(0))
+}
+
+func (s *ListingTest) TestLookUpHydrate(t *C) {
+	fs, dir := newListingFs(100)
+	fs.flags.Cheap = false
+	fs.flags.StatCacheTTL = time.Minute
+	fs.flags.TypeCacheTTL = time.Minute
+	// the mode is in metadata, which listings don't have
+	fs.flags.PermMetadata = true
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	listTestDir(t, dir)
+	file := s.lookUp(t, fs, dir, "file00000000")
+	t.Assert(file.needsMetadata(), Equals, false)
+
+	// the first lookup started on the rest, whichever gets to an
+	// entry first HEADs it and the other one waits
+	for i := 1; i < 100; i++ {
+		file = s.lookUp(t, fs, dir, fmt.Sprintf("file%08d", i))
+		t.Assert(file.needsMetadata(), Equals, false)
+	}
+	cloud.mu.Lock()
+	t.Assert(cloud.heads, Equals, 100)
+	cloud.mu.Unlock()
+	t.Assert(fs.lookupsFromListing, Equals, uint64(100))
+}
+
+func (s *ListingTest) lookUpErr(fs *Goofys, dir *Inode, name string) error {
+	return fs.LookUpInode(nil, &fuseops.LookUpInodeOp{
+		Parent: dir.Id,
+		Name:   name,
+	})
+}
+
+func (s *ListingTest) TestNegativeLookUp(t *C) {
+	fs, dir := newListingFs(100)
+	fs.flags.NegCacheTTL = time.Minute
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	t.Assert(s.lookUpErr(fs, dir, "file00000150"), Equals, fuse.ENOENT)
+	heads := cloud.heads
+	t.Assert(heads > 0, Equals, true)
+
+	t.Assert(s.lookUpErr(fs, dir, "file00000150"), Equals, fuse.ENOENT)
+	t.Assert(cloud.heads, Equals, heads)
+	t.Assert(fs.lookupsNotFound, Equals, uint64(1))
+
+	// someone else created it, and a listing showed it
+	cloud.keys = 200
+	listTestDir(t, dir)
+	t.Assert(s.lookUp(t, fs, dir, "file00000150"), NotNil)
+
+	// expired
+	t.Assert(s.lookUpErr(fs, dir, "file00000250"), Equals, fuse.ENOENT)
+	heads = cloud.heads
+	dir.dir.notFound["file00000250"] = time.Now().Add(-time.Second)
+	t.Assert(s.lookUpErr(fs, dir, "file00000250"), Equals, fuse.ENOENT)
+	t.Assert(cloud.heads > heads, Equals, true)
+
+	// or off
+	fs.flags.NegCacheTTL = 0
+	heads = cloud.heads
+	t.Assert(s.lookUpErr(fs, dir, "file00000300"), Equals, fuse.ENOENT)
+	t.Assert(s.lookUpErr(fs, dir, "file00000300"), Equals, fuse.ENOENT)
+	t.Assert(cloud.heads > heads+1, Equals, true)
+}
+
+func (s *ListingTest) TestNegativeLookUpCreate(t *C) {
+	fs, dir := newListingFs(100)
+	fs.flags.NegCacheTTL = time.Minute
+	fs.bufferPool = BufferPool{}.Init()
+	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
+
+	t.Assert(s.lookUpErr(fs, dir, "config.h"), Equals, fuse.ENOENT)
+
+	create := fuseops.CreateFileOp{Parent: dir.Id, Name: "config.h"}
+	t.Assert(fs.CreateFile(nil, &create), IsNil)
+	t.Assert(s.lookUp(t, fs, dir, "config.h").Id, Equals, create.Entry.Child)
+}
+
+func (s *ListingTest) TestNegativeLookUpBounded(t *C) {
+	fs, dir := newListingFs(0)
+	fs.flags.NegCacheTTL = time.Minute
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for i := 0; i < NEG_CACHE_MAX+10; i++ {
+		dir.addMissing(fmt.Sprintf("missing%v", i))
+	}
+	t.Assert(len(dir.dir.notFound) <= NEG_CACHE_MAX, Equals, true)
+	t.Assert(dir.knownMissing(fmt.Sprintf("missing%v", NEG_CACHE_MAX+9)), Equals, true)
+}
+
+func (s *ListingTest) TestReadDirPagesAhead(t *C) {
+	fs, dir := newListingFs(10000)
+	fs.flags.ReaddirMaxPagesAhead = 2
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	// . and .. and the first page
+	for i := 0; i < 1002; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		t.Assert(en, NotNil)
+	}
+	cloud.mu.Lock()
+	t.Assert(cloud.lists <= 3, Equals, true, Commentf("%v", cloud.lists))
+	cloud.mu.Unlock()
+
+	for i := 1002; ; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		if en == nil {
+			t.Assert(i, Equals, 10000+2)
+			break
+		}
+	}
+	cloud.mu.Lock()
+	t.Assert(cloud.lists, Equals, 10)
+	cloud.mu.Unlock()
+}
+
+func (s *ListingTest) TestReadDirNoPagesAhead(t *C) {
+	_, dir := newListingFs(3000)
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	for i := 0; i < 1002; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		t.Assert(en, NotNil)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cloud.mu.Lock()
+	t.Assert(cloud.lists, Equals, 1)
+	cloud.mu.Unlock()
+}
+
+func (s *ListingTest) TestReadDirSingleFlight(t *C) {
+	_, dir := newListingFs(100)
+	cloud := dir.Parent.dir.cloud.(*listingBackend)
+	cloud.block = make(chan struct{})
+
+	dh1 := dir.OpenDir()
+	defer dh1.CloseDir()
+	dh2 := dir.OpenDir()
+	defer dh2.CloseDir()
+
+	prefix := LISTING_TEST_DIR + "/"
+	page := dh1.listPage(nil, prefix, nil)
+	t.Assert(dh2.listPage(nil, prefix, nil), Equals, page)
+	close(cloud.block)
+	<-page.ready
+
+	dh1.dropPage(page)
+	dh2.dropPage(page)
+	t.Assert(cloud.lists, Equals, 1)
+	t.Assert(dir.dir.listing, HasLen, 0)
+
+	// two readdirs at once make one listing
+	cloud.block = make(chan struct{})
+	var wg sync.WaitGroup
+	for _, dh := range []*DirHandle{dh1, dh2} {
+		wg.Add(1)
+		go func(dh *DirHandle) {
+			defer wg.Done()
+			dh.mu.Lock()
+			defer dh.mu.Unlock()
+			for i := 0; ; i++ {
+				en, err := dh.ReadDir(fuseops.DirOffset(i))
+				t.Check(err, IsNil)
+				if en == nil {
+					t.Check(i, Equals, 100+2)
+					return
+				}
+			}
+		}(dh)
+	}
+
+	for waiting := false; !waiting; time.Sleep(time.Millisecond) {
+		dir.mu.Lock()
+		page := dir.dir.listing[""]
+		waiting = page != nil && page.refs == 2
+		dir.mu.Unlock()
+	}
+	close(cloud.block)
+	wg.Wait()
+	t.Assert(cloud.lists, Equals, 2)
+}
@@ -0,0 +1,409 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type memObject struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	metadata     map[string]*string
+	contentType  *string
+	storageClass *string
+}
+
+func (o *memObject) head(key string) *HeadBlobOutput {
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          PString(key),
+			ETag:         PString(o.etag),
+			LastModified: PTime(o.lastModified),
+			Size:         uint64(len(o.data)),
+			StorageClass: o.storageClass,
+		},
+		ContentType: o.contentType,
+		Metadata:    o.metadata,
+		IsDirBlob:   strings.HasSuffix(key, "/"),
+	}
+}
+
+// memBackend keeps objects in memory, and lists them the way
+// ListBlobsInput says all backends should. It pages with
+// pageListResults like ADLv1 does. The zero value is an empty
+// bucket. Tests that need a backend to do something else embed it
+// and override what they need
+type memBackend struct {
+	cap Capabilities
+
+	mu      sync.Mutex
+	objects map[string]*memObject
+	etags   int
+	// multipart uploads, by id
+	uploads map[string]map[uint32][]byte
+}
+
+func newMemBackend(keys ...string) *memBackend {
+	b := &memBackend{}
+	b.add(keys...)
+	return b
+}
+
+// add creates empty objects
+func (b *memBackend) add(keys ...string) {
+	for _, k := range keys {
+		b.set(k, nil)
+	}
+}
+
+func (b *memBackend) set(key string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.putUnlocked(key, &memObject{data: data})
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *memBackend) putUnlocked(key string, o *memObject) {
+	if b.objects == nil {
+		b.objects = make(map[string]*memObject)
+	}
+	b.etags++
+	o.etag = fmt.Sprintf("\"%v\"", b.etags)
+	o.lastModified = time.Now()
+	b.objects[key] = o
+}
+
+func (b *memBackend) get(key string) *memObject {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.objects[key]
+}
+
+// keys are what's in the bucket, sorted
+func (b *memBackend) keys() (keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.keysUnlocked()
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *memBackend) keysUnlocked() (keys []string) {
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (b *memBackend) Init(key string) error {
+	return nil
+}
+
+func (b *memBackend) Capabilities() *Capabilities {
+	return &b.cap
+}
+
+func (b *memBackend) Bucket() string {
+	return "mem"
+}
+
+func (b *memBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[param.Key]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return o.head(param.Key), nil
+}
+
+func (b *memBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prefix := nilStr(param.Prefix)
+	var prefixes []BlobPrefixOutput
+	var items []BlobItemOutput
+	seen := make(map[string]bool)
+
+	for _, k := range b.keysUnlocked() {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if param.Delimiter != nil {
+			rest := k[len(prefix):]
+			if i := strings.Index(rest, *param.Delimiter); i != -1 {
+				p := prefix + rest[:i+1]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, BlobPrefixOutput{Prefix: PString(p)})
+				}
+				continue
+			}
+		}
+		items = append(items, b.objects[k].head(k).BlobItemOutput)
+	}
+
+	startAfter := param.StartAfter
+	if param.ContinuationToken != nil {
+		startAfter = param.ContinuationToken
+	}
+	prefixes, items, next := pageListResults(prefixes, items,
+		nilStr(startAfter), nilUint32(param.MaxKeys))
+
+	return &ListBlobsOutput{
+		Prefixes:              prefixes,
+		Items:                 items,
+		NextContinuationToken: next,
+		IsTruncated:           next != nil,
+	}, nil
+}
+
+func (b *memBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *memBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.objects[param.Key]; !ok {
+		return nil, fuse.ENOENT
+	}
+	delete(b.objects, param.Key)
+	return &DeleteBlobOutput{}, nil
+}
+
+func (b *memBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, k := range param.Items {
+		delete(b.objects, k)
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+func (b *memBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *memBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[param.Source]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if param.ETag != nil && quoteETag(*param.ETag) != o.etag {
+		return nil, syscall.ESTALE
+	}
+
+	dst := *o
+	if param.Metadata != nil {
+		dst.metadata = param.Metadata
+		dst.contentType = param.ContentType
+	}
+	if param.StorageClass != nil {
+		dst.storageClass = param.StorageClass
+	}
+	b.putUnlocked(param.Destination, &dst)
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *memBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[param.Key]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if param.IfMatch != nil && quoteETag(*param.IfMatch) != o.etag {
+		return nil, syscall.ESTALE
+	}
+
+	data := o.data[MinUInt64(param.Start, uint64(len(o.data))):]
+	if param.Count != 0 && param.Count < uint64(len(data)) {
+		data = data[:param.Count]
+	}
+	return &GetBlobOutput{
+		HeadBlobOutput: *o.head(param.Key),
+		Body:           ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func (b *memBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	var data []byte
+	if param.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(param.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old, exists := b.objects[param.Key]
+	if b.cap.ConditionalWrite && param.IfMatch != nil &&
+		(!exists || quoteETag(*param.IfMatch) != old.etag) {
+		return nil, syscall.EBUSY
+	}
+	if b.cap.ConditionalCreate && param.IfNotExists && exists {
+		return nil, syscall.EBUSY
+	}
+
+	o := &memObject{
+		data:         data,
+		metadata:     param.Metadata,
+		contentType:  param.ContentType,
+		storageClass: param.StorageClass,
+	}
+	b.putUnlocked(param.Key, o)
+	return &PutBlobOutput{ETag: PString(o.etag)}, nil
+}
+
+func (b *memBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.uploads == nil {
+		b.uploads = make(map[string]map[uint32][]byte)
+	}
+	b.etags++
+	id := fmt.Sprintf("mem-%v", b.etags)
+	b.uploads[id] = make(map[uint32][]byte)
+	return &MultipartBlobCommitInput{
+		Key:      PString(param.Key),
+		Metadata: param.Metadata,
+		UploadId: PString(id),
+		Parts:    make([]*string, 10000), // at most 10K parts
+	}, nil
+}
+
+func (b *memBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	data, err := ioutil.ReadAll(param.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	parts, ok := b.uploads[*param.Commit.UploadId]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	parts[param.PartNumber] = data
+	param.Commit.Parts[param.PartNumber-1] = PString(fmt.Sprint(param.PartNumber))
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (b *memBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.uploads, *param.UploadId)
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (b *memBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	parts, ok := b.uploads[*param.UploadId]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	delete(b.uploads, *param.UploadId)
+
+	var data []byte
+	for i := uint32(1); i <= param.NumParts; i++ {
+		data = append(data, parts[i]...)
+	}
+	o := &memObject{data: data, metadata: param.Metadata}
+	b.putUnlocked(*param.Key, o)
+	return &MultipartBlobCommitOutput{ETag: PString(o.etag)}, nil
+}
+
+func (b *memBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *memBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *memBackend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	return &RemoveBucketOutput{}, nil
+}
+
+func (b *memBackend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return &MakeBucketOutput{}, nil
+}
+
+func (b *memBackend) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// newTestFs mounts cloud the way NewGoofys would, with the flags
+// that were given and nothing else. Nil flags are the zero ones
+func newTestFs(cloud StorageBackend, flags *FlagStorage) *Goofys {
+	if flags == nil {
+		flags = &FlagStorage{}
+	}
+	// there's nothing to clean up, and it would race the test
+	flags.NoMPUCleanup = true
+
+	fs, err := newGoofys(context.Background(), "bucket", flags,
+		func(string, *FlagStorage) (StorageBackend, error) {
+			return cloud, nil
+		})
+	if err != nil {
+		panic(err)
+	}
+	return fs
+}
+
+// newTestDir puts a directory named name in parent, like a lookup
+// would
+func newTestDir(parent *Inode, name string) *Inode {
+	dir := NewInode(parent.fs, parent, PString(name))
+	dir.ToDir()
+	parent.fs.insertInode(parent, dir)
+	return dir
+}
+
+func (fs *Goofys) testRoot() *Inode {
+	return fs.getInodeOrDie(fuseops.RootInodeID)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"regexp"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetadataTest struct {
+	meta map[string][]byte
+}
+
+var _ = Suite(&MetadataTest{})
+
+func (s *MetadataTest) SetUpTest(t *C) {
+	s.meta = map[string][]byte{
+		"plain":        []byte("value"),
+		"Mixed.Case-1": []byte("100% done"),
+		"1st":          []byte("\x00\x01"),
+		"ключ":         []byte("значение"),
+		"under_score":  []byte(""),
+	}
+}
+
+func (s *MetadataTest) TestFormat(t *C) {
+	// don't change these, they are in people's buckets
+	t.Assert(EncodeMetadataKey("plain"), Equals, "plain")
+	t.Assert(EncodeMetadataKey("Mixed.Case-1"), Equals, "_4dixed_2e_43ase_2d1")
+	t.Assert(EncodeMetadataKey("1st"), Equals, "_31st")
+	t.Assert(EncodeMetadataKey("under_score"), Equals, "under_5fscore")
+	t.Assert(EncodeMetadataValue([]byte("100% done")), Equals, "100%25 done")
+	t.Assert(EncodeMetadataValue([]byte("\x00é")), Equals, "%00%C3%A9")
+
+	enc := EncodeMetadata(s.meta)
+	t.Assert(*enc[METADATA_VERSION_KEY], Equals, "1")
+	t.Assert(len(enc), Equals, len(s.meta)+1)
+	t.Assert(EncodeMetadata(nil), HasLen, 0)
+
+	// valid for all of them: azure wants C# identifiers and S3
+	// wants ASCII
+	identifier := regexp.MustCompile("^[a-z_][a-z0-9_]*$")
+	for k, v := range enc {
+		t.Assert(identifier.MatchString(k), Equals, true, Commentf("key %v", k))
+		for _, c := range []byte(*v) {
+			t.Assert(c >= 0x20 && c < 0x7f, Equals, true, Commentf("value %q", *v))
+		}
+	}
+
+	t.Assert(DecodeMetadata(enc), DeepEquals, s.meta)
+}
+
+func (s *MetadataTest) TestRoundTrip(t *C) {
+	// what each backend does to metadata on the way out and back
+	t.Assert(DecodeMetadata(metadataToLower(EncodeMetadata(s.meta))), DeepEquals, s.meta)
+	t.Assert(DecodeMetadata(pMetadata(nilMetadata(EncodeMetadata(s.meta)))), DeepEquals, s.meta)
+
+	adl := (&ADLv2{}).toADLProperties(EncodeMetadata(s.meta))
+	t.Assert(DecodeMetadata(fromADLProperties("key", []string{adl})), DeepEquals, s.meta)
+
+	// written on s3, read on azure
+	t.Assert(DecodeMetadata(pMetadata(nilMetadata(metadataToLower(EncodeMetadata(s.meta))))),
+		DeepEquals, s.meta)
+}
+
+func (s *MetadataTest) TestLegacy(t *C) {
+	// from before there was a version, or from someone else
+	meta := DecodeMetadata(map[string]*string{
+		"Foo":     PString("a%20b"),
+		"percent": PString("100%"),
+		"under_x": PString("y"),
+	})
+	t.Assert(meta, DeepEquals, map[string][]byte{
+		"foo":     []byte("a b"),
+		"percent": []byte("100%"),
+		"under_x": []byte("y"),
+	})
+
+	// added by someone else after we wrote it
+	enc := EncodeMetadata(map[string][]byte{"a": []byte("b")})
+	enc["not_ours"] = PString("c")
+	t.Assert(DecodeMetadata(enc), DeepEquals, map[string][]byte{
+		"a":        []byte("b"),
+		"not_ours": []byte("c"),
+	})
+}
@@ -0,0 +1,368 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// the prometheus client's default buckets, in seconds
+var METRICS_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	METRICS_OK        = "ok"
+	METRICS_THROTTLED = "throttled"
+	METRICS_ERROR     = "error"
+)
+
+type metricsKey struct {
+	backend string
+	op      string
+	status  string
+}
+
+type opMetrics struct {
+	count uint64
+	sum   float64
+	// not cumulative, unlike what we write out
+	buckets []uint64
+}
+
+// BackendMetrics counts the requests of every MetricsBackend in the
+// process, and how long they took. It's written out in the
+// prometheus text format, which is simple enough that we don't need
+// their client for it
+type BackendMetrics struct {
+	mu  sync.Mutex
+	ops map[metricsKey]*opMetrics
+}
+
+var backendMetrics = &BackendMetrics{}
+
+// metricsStatus tells throttling apart from other errors, a lot of
+// it means we should be sending fewer requests
+func metricsStatus(err error) string {
+	if err == nil {
+		return METRICS_OK
+	}
+	if err == syscall.EAGAIN {
+		return METRICS_THROTTLED
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		// s3 sends SlowDown as a 503, which we don't map
+		switch reqErr.StatusCode() {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return METRICS_THROTTLED
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "SlowDown", "RequestLimitExceeded":
+			return METRICS_THROTTLED
+		}
+	}
+	return METRICS_ERROR
+}
+
+func isThrottled(err error) bool {
+	return metricsStatus(err) == METRICS_THROTTLED
+}
+
+func (m *BackendMetrics) observe(backend, op string, err error, d time.Duration) {
+	key := metricsKey{backend, op, metricsStatus(err)}
+	secs := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ops == nil {
+		m.ops = make(map[metricsKey]*opMetrics)
+	}
+	o := m.ops[key]
+	if o == nil {
+		o = &opMetrics{buckets: make([]uint64, len(METRICS_BUCKETS))}
+		m.ops[key] = o
+	}
+
+	o.count++
+	o.sum += secs
+	for i, le := range METRICS_BUCKETS {
+		if secs <= le {
+			o.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *BackendMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricsKey, 0, len(m.ops))
+	for k := range m.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.backend != b.backend {
+			return a.backend < b.backend
+		}
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		return a.status < b.status
+	})
+
+	fmt.Fprintf(w, "# HELP goofys_backend_requests_total Requests sent to the backend.\n")
+	fmt.Fprintf(w, "# TYPE goofys_backend_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "goofys_backend_requests_total{%v} %v\n", k.labels(), m.ops[k].count)
+	}
+
+	fmt.Fprintf(w, "# HELP goofys_backend_request_duration_seconds How long backend requests took, "+
+		"until the response headers for GetBlob.\n")
+	fmt.Fprintf(w, "# TYPE goofys_backend_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		o := m.ops[k]
+		labels := k.labels()
+		var n uint64
+		for i, le := range METRICS_BUCKETS {
+			n += o.buckets[i]
+			fmt.Fprintf(w, "goofys_backend_request_duration_seconds_bucket{%v,le=\"%v\"} %v\n",
+				labels, le, n)
+		}
+		fmt.Fprintf(w, "goofys_backend_request_duration_seconds_bucket{%v,le=\"+Inf\"} %v\n",
+			labels, o.count)
+		fmt.Fprintf(w, "goofys_backend_request_duration_seconds_sum{%v} %v\n", labels, o.sum)
+		fmt.Fprintf(w, "goofys_backend_request_duration_seconds_count{%v} %v\n", labels, o.count)
+	}
+}
+
+func (k metricsKey) labels() string {
+	return fmt.Sprintf("backend=%q,op=%q,status=%q", k.backend, k.op, k.status)
+}
+
+// MetricsBackend records every request to the backend behind it in
+// backendMetrics
+type MetricsBackend struct {
+	StorageBackend
+	metrics *BackendMetrics
+}
+
+func NewMetricsBackend(cloud StorageBackend) *MetricsBackend {
+	return &MetricsBackend{
+		StorageBackend: cloud,
+		metrics:        backendMetrics,
+	}
+}
+
+func (b *MetricsBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+func (b *MetricsBackend) observe(op string, start time.Time, err error) {
+	b.metrics.observe(b.Capabilities().Name, op, err, time.Since(start))
+}
+
+func (b *MetricsBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.HeadBlob(param)
+	b.observe("HeadBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.ListBlobs(param)
+	b.observe("ListBlobs", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.ListBlobVersions(param)
+	b.observe("ListBlobVersions", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.DeleteBlob(param)
+	b.observe("DeleteBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.DeleteBlobs(param)
+	b.observe("DeleteBlobs", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.RenameBlob(param)
+	b.observe("RenameBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.CopyBlob(param)
+	b.observe("CopyBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.GetBlob(param)
+	b.observe("GetBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.PutBlob(param)
+	b.observe("PutBlob", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.MultipartBlobBegin(param)
+	b.observe("MultipartBlobBegin", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.MultipartBlobAdd(param)
+	b.observe("MultipartBlobAdd", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.MultipartBlobAbort(param)
+	b.observe("MultipartBlobAbort", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.MultipartBlobCommit(param)
+	b.observe("MultipartBlobCommit", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.MultipartExpire(param)
+	b.observe("MultipartExpire", start, err)
+	return resp, err
+}
+
+func (b *MetricsBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	start := time.Now()
+	resp, err := b.StorageBackend.AppendBlob(param)
+	b.observe("AppendBlob", start, err)
+	return resp, err
+}
+
+type MetricsServer struct {
+	fs       *Goofys
+	listener net.Listener
+}
+
+// ListenMetrics serves backendMetrics, and a few gauges of this
+// mount, on http://addr/metrics
+func (fs *Goofys) ListenMetrics(addr string) (server *MetricsServer, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server = &MetricsServer{
+		fs:       fs,
+		listener: l,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server)
+	go func() {
+		err := http.Serve(l, mux)
+		log.Debugf("metrics %v: %v", addr, err)
+	}()
+
+	log.Infof("serving metrics on http://%v/metrics", l.Addr())
+	return
+}
+
+func (s *MetricsServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	backendMetrics.write(w)
+	s.fs.writeMetrics(w)
+}
+
+func (fs *Goofys) writeMetrics(w io.Writer) {
+	fs.mu.RLock()
+	handles := len(fs.fileHandles)
+	fs.mu.RUnlock()
+
+	gauge := func(name, help string, v int) {
+		writeGauge(w, name, help, uint64(v))
+	}
+	gauge("goofys_open_file_handles", "Files that are open.", handles)
+	gauge("goofys_inodes", "Inodes the kernel knows about.", fs.inodes.Len())
+	gauge("goofys_inflight_multipart_uploads", "Multipart uploads that are being written.",
+		fs.liveUploads.Len())
+	gauge("goofys_dirty_bytes", "Bytes in parts that are written but not uploaded yet.",
+		int(fs.dirtyBytes.Bytes()))
+
+	fmt.Fprintf(w, "# HELP goofys_evicted_inodes_total Inodes dropped because of --max-cached-inodes.\n")
+	fmt.Fprintf(w, "# TYPE goofys_evicted_inodes_total counter\n")
+	fmt.Fprintf(w, "goofys_evicted_inodes_total %v\n", fs.inodeCache.Evicted())
+
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	if adaptive := findAdaptiveBackend(root.dir.cloud); adaptive != nil {
+		window, inflight := adaptive.Window()
+		gauge("goofys_adaptive_window", "Reads and writes allowed in flight by --adaptive-retry.",
+			window)
+		gauge("goofys_adaptive_inflight", "Reads and writes in flight.", inflight)
+	}
+
+	if fs.quota != nil {
+		fs.quota.writeMetrics(w)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v gauge\n", name)
+	fmt.Fprintf(w, "%v %v\n", name, v)
+}
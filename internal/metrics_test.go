@@ -0,0 +1,98 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	. "gopkg.in/check.v1"
+)
+
+type MetricsTest struct {
+	metrics *BackendMetrics
+}
+
+var _ = Suite(&MetricsTest{})
+
+func (s *MetricsTest) SetUpTest(t *C) {
+	s.metrics = &BackendMetrics{}
+}
+
+func (s *MetricsTest) lines() []string {
+	var buf bytes.Buffer
+	s.metrics.write(&buf)
+	return strings.Split(buf.String(), "\n")
+}
+
+func (s *MetricsTest) hasLine(t *C, line string) {
+	for _, l := range s.lines() {
+		if l == line {
+			return
+		}
+	}
+	t.Fatalf("%v not in %v", line, strings.Join(s.lines(), "\n"))
+}
+
+func (s *MetricsTest) TestBackend(t *C) {
+	cloud := &slowBackend{size: 10}
+	b := &MetricsBackend{StorageBackend: cloud, metrics: s.metrics}
+
+	_, err := b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	resp, err := b.GetBlob(&GetBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+
+	cloud.delete()
+	_, err = b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, Equals, syscall.ENOENT)
+
+	s.hasLine(t, `goofys_backend_requests_total{backend="slow",op="GetBlob",status="ok"} 1`)
+	s.hasLine(t, `goofys_backend_requests_total{backend="slow",op="HeadBlob",status="ok"} 1`)
+	s.hasLine(t, `goofys_backend_requests_total{backend="slow",op="HeadBlob",status="error"} 1`)
+	s.hasLine(t, `goofys_backend_request_duration_seconds_count{backend="slow",op="HeadBlob",status="error"} 1`)
+}
+
+func (s *MetricsTest) TestStatus(t *C) {
+	t.Assert(metricsStatus(nil), Equals, METRICS_OK)
+	t.Assert(metricsStatus(syscall.EAGAIN), Equals, METRICS_THROTTLED)
+	t.Assert(metricsStatus(syscall.EACCES), Equals, METRICS_ERROR)
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "")
+	t.Assert(metricsStatus(slowDown), Equals, METRICS_THROTTLED)
+}
+
+func (s *MetricsTest) TestHistogram(t *C) {
+	s.metrics.observe("s3", "PutBlob", nil, 30*time.Millisecond)
+	s.metrics.observe("s3", "PutBlob", nil, 20*time.Second)
+
+	labels := `backend="s3",op="PutBlob",status="ok"`
+	s.hasLine(t, `goofys_backend_request_duration_seconds_bucket{`+labels+`,le="0.025"} 0`)
+	s.hasLine(t, `goofys_backend_request_duration_seconds_bucket{`+labels+`,le="0.05"} 1`)
+	s.hasLine(t, `goofys_backend_request_duration_seconds_bucket{`+labels+`,le="10"} 1`)
+	s.hasLine(t, `goofys_backend_request_duration_seconds_bucket{`+labels+`,le="+Inf"} 2`)
+	s.hasLine(t, `goofys_backend_request_duration_seconds_count{`+labels+`} 2`)
+}
+
+func (s *MetricsTest) TestUnwrap(t *C) {
+	cloud := &slowBackend{}
+	wrapped := NewHedgedBackend(NewMetricsBackend(cloud), &FlagStorage{})
+	t.Assert(unwrapBackend(wrapped), Equals, StorageBackend(cloud))
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// copyBackend can't rename, and remembers the copies it's asked for
+type copyBackend struct {
+	memBackend
+	copies []CopyBlobInput
+}
+
+func (b *copyBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *copyBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.copies = append(b.copies, *param)
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *copyBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return &DeleteBlobOutput{}, nil
+}
+
+type MimeTypesTest struct {
+	flags *FlagStorage
+}
+
+var _ = Suite(&MimeTypesTest{})
+
+func (s *MimeTypesTest) SetUpTest(t *C) {
+	types, err := ParseMimeTypes(strings.NewReader(`
+# ours
+application/vnd.apache.parquet	parquet
+application/avro+binary		avro AVRO2
+text/x-ours			css   # instead of text/css
+`))
+	t.Assert(err, IsNil)
+	s.flags = &FlagStorage{UseContentType: true, MimeTypes: types}
+}
+
+func (s *MimeTypesTest) mimeType(name string) string {
+	return nilStr(s.flags.GetMimeType(name))
+}
+
+func (s *MimeTypesTest) TestParse(t *C) {
+	t.Assert(s.flags.MimeTypes, DeepEquals, map[string]string{
+		".parquet": "application/vnd.apache.parquet",
+		".avro":    "application/avro+binary",
+		".avro2":   "application/avro+binary",
+		".css":     "text/x-ours",
+	})
+
+	_, err := ParseMimeTypes(strings.NewReader("parquet application/vnd.apache.parquet"))
+	t.Assert(err, NotNil)
+}
+
+func (s *MimeTypesTest) TestGetMimeType(t *C) {
+	t.Assert(s.mimeType("dir/data.parquet"), Equals, "application/vnd.apache.parquet")
+	t.Assert(s.mimeType("data.AVRO2"), Equals, "application/avro+binary")
+	t.Assert(s.mimeType("style.css"), Equals, "text/x-ours")
+	// still the built-in ones
+	t.Assert(s.mimeType("photo.jpg"), Equals, "image/jpeg")
+	t.Assert(s.mimeType("data.unknownExtension"), Equals, "")
+	t.Assert(s.mimeType("dir.parquet/data"), Equals, "")
+
+	s.flags.ContentTypeDefault = "application/x-ours"
+	t.Assert(s.mimeType("data.unknownExtension"), Equals, "application/x-ours")
+	t.Assert(s.mimeType("data"), Equals, "application/x-ours")
+
+	s.flags.UseContentType = false
+	t.Assert(s.flags.GetMimeType("data.parquet"), IsNil)
+}
+
+func (s *MimeTypesTest) TestRename(t *C) {
+	cloud := &copyBackend{}
+	inode := newTestInode(cloud)
+	inode.fs.flags = s.flags
+	root := inode.Parent
+
+	t.Assert(root.renameObject(nil, inode.fs, nil, "data.csv", "data.parquet"), IsNil)
+	t.Assert(root.renameObject(nil, inode.fs, nil, "data.parquet", "data"), IsNil)
+	t.Assert(root.renameObject(nil, inode.fs, PUInt64(0), "dir.csv/", "dir.parquet/"), IsNil)
+
+	t.Assert(cloud.copies, HasLen, 3)
+	t.Assert(*cloud.copies[0].ContentType, Equals, "application/vnd.apache.parquet")
+	// not known, so what it was stays
+	t.Assert(cloud.copies[1].ContentType, IsNil)
+	t.Assert(cloud.copies[2].ContentType, IsNil)
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_MPU_CLEANUP_INTERVAL = 24 * time.Hour
+
+// an upload that has been going on for this long is from a mount that
+// crashed, or is too slow to ever finish
+const DEFAULT_MPU_CLEANUP_AGE = 48 * time.Hour
+
+// anything shorter than this risks aborting uploads of other mounts
+// that are still writing
+const MIN_MPU_CLEANUP_AGE = time.Hour
+
+// liveUploads are the multipart uploads our file handles are still
+// writing to. The zero value is ready to use
+type liveUploads struct {
+	mu  sync.Mutex
+	ids map[string]liveUpload
+}
+
+// liveUpload is what it takes to abort the upload
+type liveUpload struct {
+	cloud StorageBackend
+	mpu   *MultipartBlobCommitInput
+}
+
+func (l *liveUploads) Add(cloud StorageBackend, mpu *MultipartBlobCommitInput) {
+	if mpu == nil || mpu.UploadId == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ids == nil {
+		l.ids = make(map[string]liveUpload)
+	}
+	l.ids[*mpu.UploadId] = liveUpload{cloud, mpu}
+}
+
+func (l *liveUploads) Remove(mpu *MultipartBlobCommitInput) {
+	if mpu == nil || mpu.UploadId == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.ids, *mpu.UploadId)
+}
+
+func (l *liveUploads) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.ids)
+}
+
+func (l *liveUploads) Has(uploadId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.ids[uploadId]
+	return ok
+}
+
+// AbortAll aborts every upload that's still going, for when we can't
+// wait for them any longer. Returns how many there were
+func (l *liveUploads) AbortAll() int {
+	l.mu.Lock()
+	uploads := l.ids
+	l.ids = nil
+	l.mu.Unlock()
+
+	for _, u := range uploads {
+		_, err := u.cloud.MultipartBlobAbort(u.mpu)
+		if err != nil {
+			log.Warnf("aborting upload of %v: %v", nilStr(u.mpu.Key), err)
+		}
+	}
+	return len(uploads)
+}
+
+type MPUCleanupStatus struct {
+	Runs           uint64    `json:"runs"`
+	Aborted        uint64    `json:"aborted"`
+	BytesReclaimed uint64    `json:"bytes_reclaimed"`
+	LastRun        time.Time `json:"last_run"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// mpuCleaner periodically aborts multipart uploads under the mount
+// prefix that were left behind, usually by a mount that crashed
+// before it could commit or abort them. They are invisible but
+// storage is still charged for their parts
+type mpuCleaner struct {
+	cloud    StorageBackend
+	prefix   string
+	interval time.Duration
+	age      time.Duration
+	live     *liveUploads
+
+	mu     sync.Mutex
+	status MPUCleanupStatus
+}
+
+func newMPUCleaner(cloud StorageBackend, prefix string, interval time.Duration,
+	age time.Duration, live *liveUploads) *mpuCleaner {
+
+	if interval == 0 {
+		interval = DEFAULT_MPU_CLEANUP_INTERVAL
+	}
+	if age == 0 {
+		age = DEFAULT_MPU_CLEANUP_AGE
+	}
+
+	return &mpuCleaner{
+		cloud:    cloud,
+		prefix:   prefix,
+		interval: interval,
+		age:      age,
+		live:     live,
+	}
+}
+
+func (c *mpuCleaner) Run() {
+	for {
+		err := c.cleanup()
+		if err == syscall.ENOTSUP {
+			// nothing to clean up on this backend
+			return
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *mpuCleaner) cleanup() error {
+	resp, err := c.cloud.MultipartExpire(&MultipartExpireInput{
+		Prefix:    c.prefix,
+		OlderThan: c.age,
+		Live:      c.live.Has,
+	})
+	if err == syscall.ENOTSUP {
+		return err
+	}
+
+	var bytes uint64
+	if resp != nil {
+		for _, upload := range resp.Aborted {
+			log.Infof("aborted multipart upload of %v started at %v, reclaimed %v bytes",
+				upload.Key, upload.Initiated.Format(time.RFC3339), upload.Size)
+			bytes += upload.Size
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.Runs++
+	c.status.LastRun = time.Now()
+	c.status.LastError = ""
+	if resp != nil {
+		c.status.Aborted += uint64(len(resp.Aborted))
+		c.status.BytesReclaimed += bytes
+		if len(resp.Aborted) != 0 {
+			log.Infof("aborted %v abandoned multipart uploads, reclaimed %v bytes",
+				len(resp.Aborted), bytes)
+		}
+	}
+	if err != nil {
+		if err == syscall.EACCES {
+			log.Warnf("not allowed to abort abandoned multipart uploads, "+
+				"consider --no-mpu-cleanup: %v", err)
+		} else {
+			log.Warnf("unable to clean up abandoned multipart uploads: %v", err)
+		}
+		c.status.LastError = err.Error()
+	}
+
+	return err
+}
+
+func (c *mpuCleaner) Status() MPUCleanupStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// controlMPU reports what the cleanup has aborted so far
+func controlMPU(fs *Goofys, args []string, conn net.Conn) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: mpu")
+	}
+	if fs.mpuCleaner == nil {
+		return fmt.Errorf("multipart upload cleanup is not enabled")
+	}
+
+	return writeControlReply(conn, nil, fs.mpuCleaner.Status())
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type expireBackend struct {
+	memBackend
+
+	uploads map[string]ExpiredUpload
+	err     error
+}
+
+func (b *expireBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	out := &MultipartExpireOutput{}
+	for id, upload := range b.uploads {
+		if !strings.HasPrefix(upload.Key, param.Prefix) ||
+			time.Since(upload.Initiated) < param.OlderThan ||
+			param.Live(id) {
+			continue
+		}
+		out.Aborted = append(out.Aborted, upload)
+		delete(b.uploads, id)
+	}
+	return out, nil
+}
+
+type MPUCleanupTest struct {
+	cloud *expireBackend
+	live  *liveUploads
+}
+
+var _ = Suite(&MPUCleanupTest{})
+
+func (s *MPUCleanupTest) SetUpTest(t *C) {
+	old := time.Now().Add(-72 * time.Hour)
+	s.cloud = &expireBackend{
+		uploads: map[string]ExpiredUpload{
+			"crashed": {Key: "mnt/a", UploadId: "crashed", Initiated: old, Size: 100},
+			"writing": {Key: "mnt/b", UploadId: "writing", Initiated: old, Size: 10},
+			"recent":  {Key: "mnt/c", UploadId: "recent", Initiated: time.Now(), Size: 10},
+			"other":   {Key: "other/d", UploadId: "other", Initiated: old, Size: 10},
+			"big":     {Key: "mnt/e/f", UploadId: "big", Initiated: old, Size: 1000},
+		},
+	}
+	s.live = &liveUploads{}
+}
+
+func (s *MPUCleanupTest) TestCleanup(t *C) {
+	writing := &MultipartBlobCommitInput{UploadId: PString("writing")}
+	s.live.Add(nil, writing)
+	s.live.Add(nil, &MultipartBlobCommitInput{})
+
+	c := newMPUCleaner(s.cloud, "mnt/", 0, 0, s.live)
+	t.Assert(c.interval, Equals, DEFAULT_MPU_CLEANUP_INTERVAL)
+	t.Assert(c.age, Equals, DEFAULT_MPU_CLEANUP_AGE)
+
+	t.Assert(c.cleanup(), IsNil)
+	status := c.Status()
+	t.Assert(status.Runs, Equals, uint64(1))
+	t.Assert(status.Aborted, Equals, uint64(2))
+	t.Assert(status.BytesReclaimed, Equals, uint64(1100))
+	t.Assert(len(s.cloud.uploads), Equals, 3)
+
+	// done writing but it was never committed
+	s.live.Remove(writing)
+	t.Assert(s.live.Has("writing"), Equals, false)
+	t.Assert(c.cleanup(), IsNil)
+	status = c.Status()
+	t.Assert(status.Runs, Equals, uint64(2))
+	t.Assert(status.Aborted, Equals, uint64(3))
+	t.Assert(status.BytesReclaimed, Equals, uint64(1110))
+
+	_, ok := s.cloud.uploads["recent"]
+	t.Assert(ok, Equals, true)
+	_, ok = s.cloud.uploads["other"]
+	t.Assert(ok, Equals, true)
+}
+
+func (s *MPUCleanupTest) TestCleanupErrors(t *C) {
+	c := newMPUCleaner(s.cloud, "", time.Hour, time.Hour, s.live)
+
+	s.cloud.err = syscall.EACCES
+	t.Assert(c.cleanup(), Equals, syscall.EACCES)
+	t.Assert(c.Status().LastError, Equals, syscall.EACCES.Error())
+
+	s.cloud.err = nil
+	t.Assert(c.cleanup(), IsNil)
+	t.Assert(c.Status().LastError, Equals, "")
+	t.Assert(c.Status().Aborted, Equals, uint64(4))
+
+	// backends that can't expire uploads stop the loop
+	s.cloud.err = syscall.ENOTSUP
+	done := make(chan bool)
+	go func() {
+		c.Run()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup didn't stop")
+	}
+}
+
+func (s *MPUCleanupTest) TestAzureUploadId(t *C) {
+	// what MultipartBlobBegin and MultipartBlobAdd make
+	uploadId := "0b1d3c1e-8e5c-4cf1-9d7e-1e4b7c8f9a60::%05d"
+	blockId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(uploadId, 42)))
+
+	id, ok := azbUploadId(blockId)
+	t.Assert(ok, Equals, true)
+	t.Assert(id, Equals, uploadId)
+
+	// blocks someone else staged
+	_, ok = azbUploadId(base64.StdEncoding.EncodeToString([]byte("block-1")))
+	t.Assert(ok, Equals, false)
+	_, ok = azbUploadId("not base64!")
+	t.Assert(ok, Equals, false)
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"context"
+	"syscall"
+	"time"
+)
+
+// With --preserve-mtime the mtime that utimens sets on a file is kept
+// in its goofys-mtime metadata and shown instead of when the object
+// was uploaded, so rsync can tell that it already copied it. If the
+// file is open it goes with the upload at flush, or is copied onto the
+// object after if the upload began before it came. Otherwise the
+// object is copied onto itself with it right away. A write drops it,
+// the file is as new as its upload again. Listings don't have
+// metadata, so lookups HEAD the files we don't have it of
+
+const MTIME_METADATA = "goofys-mtime"
+
+// SetMtime is utimens with --preserve-mtime, ignored like before
+// without it
+func (inode *Inode) SetMtime(mtime time.Time) (err error) {
+	return inode.SetMtimeWithContext(nil, mtime)
+}
+
+// SetMtimeWithContext is SetMtime for a fuse op, whose trace id the
+// request carries
+func (inode *Inode) SetMtimeWithContext(ctx context.Context, mtime time.Time) (err error) {
+	inode.logFuse("SetMtime", mtime)
+
+	if !inode.fs.flags.PreserveMtime || inode.isDir() || inode.symlink != nil {
+		return
+	}
+	if inode.readOnly() {
+		return syscall.EROFS
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	err = inode.fillXattr()
+	if err != nil {
+		return
+	}
+	cloud, _ := inode.cloud()
+	if inode.userMetadata == nil || cloud.Capabilities().NoMetadata {
+		return
+	}
+
+	old, had := inode.userMetadata[MTIME_METADATA]
+	inode.userMetadata[MTIME_METADATA] = []byte(mtime.UTC().Format(time.RFC3339Nano))
+	if inode.fileHandles != 0 {
+		// see flushMtime
+		inode.fileData().mtimePending = true
+	} else {
+		err = inode.updateXattr(TraceOnly(ctx))
+		if err != nil {
+			if had {
+				inode.userMetadata[MTIME_METADATA] = old
+			} else {
+				delete(inode.userMetadata, MTIME_METADATA)
+			}
+			return
+		}
+	}
+	inode.Attributes.Mtime = mtime
+	return
+}
+
+// fillMtime uses the mtime metadata if there is one
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillMtime() {
+	if !inode.fs.flags.PreserveMtime {
+		return
+	}
+	v, ok := inode.userMetadata[MTIME_METADATA]
+	if !ok {
+		return
+	}
+	mtime, err := time.Parse(time.RFC3339Nano, string(v))
+	if err != nil {
+		inode.errFuse("ignoring mtime metadata", string(v), err)
+		return
+	}
+	inode.Attributes.Mtime = mtime
+}
+
+// dropMtime is for the first write after the file was opened, which
+// makes it newer than what utimens said
+func (inode *Inode) dropMtime() {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if _, ok := inode.userMetadata[MTIME_METADATA]; ok {
+		delete(inode.userMetadata, MTIME_METADATA)
+		inode.touch()
+	}
+	if inode.file != nil {
+		inode.file.mtimePending = false
+	}
+}
+
+// flushMtime copies the mtime onto the object after a flush, if
+// utimens came while the file was open and the upload didn't take it
+func (inode *Inode) flushMtime(ctx context.Context) (err error) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.file == nil || !inode.file.mtimePending || inode.KnownSize == nil {
+		return
+	}
+	err = inode.updateXattr(ctx)
+	if err == nil {
+		inode.file.mtimePending = false
+	}
+	return
+}
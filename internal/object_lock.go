@@ -0,0 +1,139 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// S3 Object Lock keeps an object from being deleted or overwritten
+// until its retention runs out, or while it has a legal hold. S3
+// refuses with an AccessDenied that only the message tells apart,
+// which is EPERM rather than EACCES. That's only found out once
+// whatever was written has been uploaded, --respect-object-lock
+// HEADs the object first so that unlink and truncate fail right away
+
+// retention and legal hold can't be set through the mount, they are
+// read-only and not listed like XATTR_STORAGE_CLASS
+const XATTR_RETAIN_UNTIL = "user.s3.object-lock-retain-until"
+const XATTR_LEGAL_HOLD = "user.s3.object-lock-legal-hold"
+
+func isObjectLockXattr(name string) bool {
+	return name == XATTR_RETAIN_UNTIL || name == XATTR_LEGAL_HOLD
+}
+
+type objectLock struct {
+	// GOVERNANCE or COMPLIANCE
+	mode        string
+	retainUntil time.Time
+	legalHold   bool
+}
+
+func objectLockFromHead(resp *HeadBlobOutput) *objectLock {
+	if resp.ObjectLockMode == nil && resp.RetainUntil == nil && !resp.LegalHold {
+		return nil
+	}
+	l := &objectLock{
+		mode:      nilStr(resp.ObjectLockMode),
+		legalHold: resp.LegalHold,
+	}
+	if resp.RetainUntil != nil {
+		l.retainUntil = *resp.RetainUntil
+	}
+	return l
+}
+
+// locked is whether the object can't be removed or overwritten now
+func (l *objectLock) locked(now time.Time) bool {
+	return l != nil && (l.legalHold || l.retainUntil.After(now))
+}
+
+// objectLockDenied is whether an AccessDenied is because of Object
+// Lock, from its message
+func objectLockDenied(code string, message string) bool {
+	return code == "AccessDenied" &&
+		strings.Contains(strings.ToLower(message), "object lock")
+}
+
+// checkObjectLock fails with EPERM if the file is under Object Lock,
+// with --respect-object-lock. It always HEADs, the retention may have
+// been extended since we last looked
+func (inode *Inode) checkObjectLock() error {
+	if !inode.fs.flags.RespectObjectLock || inode.isDir() {
+		return nil
+	}
+
+	inode.mu.Lock()
+	flushed := inode.KnownSize != nil
+	inode.mu.Unlock()
+	if !flushed {
+		// nothing in the bucket to protect
+		return nil
+	}
+
+	cloud, key := inode.cloud()
+	resp, err := cloud.HeadBlob(&HeadBlobInput{Key: key})
+	if err != nil {
+		err = inode.fs.mapAwsError(err)
+		if err == fuse.ENOENT {
+			err = nil
+		}
+		return err
+	}
+
+	lock := objectLockFromHead(resp)
+	inode.mu.Lock()
+	inode.objectLock = lock
+	inode.mu.Unlock()
+
+	if lock.locked(time.Now()) {
+		inode.logFuse("object locked", lock.mode, lock.retainUntil, lock.legalHold)
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) getObjectLockXattr(name string) ([]byte, error) {
+	if inode.isDir() {
+		return nil, ENOATTR
+	}
+	err := inode.fillXattr()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := inode.objectLock
+	if lock == nil {
+		return nil, ENOATTR
+	}
+	switch name {
+	case XATTR_RETAIN_UNTIL:
+		if lock.retainUntil.IsZero() {
+			return nil, ENOATTR
+		}
+		return []byte(lock.retainUntil.UTC().Format(time.RFC3339)), nil
+	case XATTR_LEGAL_HOLD:
+		if !lock.legalHold {
+			return nil, ENOATTR
+		}
+		return []byte("ON"), nil
+	}
+	return nil, ENOATTR
+}
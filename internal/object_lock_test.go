@@ -0,0 +1,117 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "gopkg.in/check.v1"
+)
+
+type ObjectLockTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+}
+
+var _ = Suite(&ObjectLockTest{})
+
+func (s *ObjectLockTest) SetUpTest(t *C) {
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+
+			switch r.Method {
+			case "HEAD":
+				w.Header().Set("ETag", "\"etag\"")
+				w.Header().Set("Content-Length", "5")
+				w.Header().Set("X-Amz-Object-Lock-Mode", "COMPLIANCE")
+				w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date",
+					"2030-01-01T00:00:00Z")
+				w.Header().Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+			case "DELETE":
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, "<Error><Code>AccessDenied</Code>"+
+					"<Message>Access Denied because object protected by object lock.</Message>"+
+					"</Error>")
+			}
+		}))
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	t.Assert(err, IsNil)
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.newS3()
+}
+
+func (s *ObjectLockTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *ObjectLockTest) TestHead(t *C) {
+	resp, err := s.s3.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(*resp.ObjectLockMode, Equals, "COMPLIANCE")
+	t.Assert(resp.RetainUntil.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	t.Assert(resp.LegalHold, Equals, true)
+}
+
+func (s *ObjectLockTest) TestDeleteDenied(t *C) {
+	_, err := s.s3.DeleteBlob(&DeleteBlobInput{Key: "file"})
+	t.Assert(err, Equals, syscall.EPERM)
+}
+
+func (s *ObjectLockTest) newFile(t *C, respect bool) *Inode {
+	fs := newTestFs(s.s3, &FlagStorage{RespectObjectLock: respect})
+	root := fs.testRoot()
+
+	fs.mu.Lock()
+	root.mu.Lock()
+	file := NewInode(fs, root, PString("file"))
+	file.KnownSize = PUInt64(5)
+	fs.insertInode(root, file)
+	root.mu.Unlock()
+	fs.mu.Unlock()
+	return file
+}
+
+func (s *ObjectLockTest) TestCheck(t *C) {
+	t.Assert(s.newFile(t, false).checkObjectLock(), IsNil)
+	t.Assert(s.newFile(t, true).checkObjectLock(), Equals, syscall.EPERM)
+}
+
+func (s *ObjectLockTest) TestXattr(t *C) {
+	file := s.newFile(t, false)
+
+	value, err := file.GetXattr(XATTR_RETAIN_UNTIL)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "2030-01-01T00:00:00Z")
+	value, err = file.GetXattr(XATTR_LEGAL_HOLD)
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "ON")
+
+	t.Assert(file.SetXattr(XATTR_LEGAL_HOLD, []byte("OFF"), 0), Equals, syscall.EPERM)
+}
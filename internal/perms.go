@@ -17,10 +17,132 @@
 package internal
 
 import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"syscall"
+)
+
+// with --enable-perm-metadata, the same metadata s3fs uses: decimal
+// numbers, and the mode has the file type bits too
+const (
+	PERM_METADATA_MODE = "mode"
+	PERM_METADATA_UID  = "uid"
+	PERM_METADATA_GID  = "gid"
 )
 
+// permissionSetter is a backend with real permissions, ADLv1 and
+// WebHDFS, and ADLv2 with --use-backend-acls, where chmod doesn't go
+// in metadata
+type permissionSetter interface {
+	SetPermission(key string, mode os.FileMode) error
+}
+
+// permissionSetterOf is nil if cloud has no permissions to chmod
+func permissionSetterOf(cloud StorageBackend, flags *FlagStorage) permissionSetter {
+	cloud = unwrapBackend(cloud)
+	if _, ok := cloud.(*ADLv2); ok && !flags.UseBackendACLs {
+		// not every account has a hierarchical namespace
+		return nil
+	}
+	setter, _ := cloud.(permissionSetter)
+	return setter
+}
+
+// hasBackendACLs is whether listings and HEADs say what the
+// permissions of cloud's objects are
+func hasBackendACLs(cloud StorageBackend, flags *FlagStorage) bool {
+	_, ok := unwrapBackend(cloud).(*ADLv2)
+	return ok && flags.UseBackendACLs
+}
+
+// inodePerm is what the perm metadata of an object says, nil is the
+// mount's default
+type inodePerm struct {
+	mode     *os.FileMode
+	uid, gid *uint32
+	// a soft deleted blob from --list-deleted, which has no
+	// permissions
+	deleted bool
+	// from the backend's ACL, not metadata
+	backend bool
+}
+
+// permFromACL maps the owner and group through --acl-user-map and
+// --acl-group-map, the ones that aren't in them are --uid and --gid
+func permFromACL(acl *BlobACL, flags *FlagStorage) *inodePerm {
+	mode := acl.Mode.Perm()
+	perm := &inodePerm{mode: &mode, backend: true}
+	if uid, ok := flags.ACLUsers[acl.Owner]; ok {
+		perm.uid = &uid
+	}
+	if gid, ok := flags.ACLGroups[acl.Group]; ok {
+		perm.gid = &gid
+	}
+	return perm
+}
+
+// parseACLMapping parses <object id or name>=<id>
+func parseACLMapping(s string) (owner string, id uint32, err error) {
+	idx := strings.LastIndex(s, "=")
+	if idx <= 0 {
+		return "", 0, fmt.Errorf("expecting <object id or name>=<id>")
+	}
+	n, err := strconv.ParseUint(s[idx+1:], 10, 32)
+	if err != nil {
+		return "", 0, err
+	}
+	return s[:idx], uint32(n), nil
+}
+
+// permFromMetadata is nil if there's none of it, like for files that
+// were written before --enable-perm-metadata
+func permFromMetadata(meta map[string][]byte) *inodePerm {
+	var perm inodePerm
+	if v, ok := parsePermMetadata(meta, PERM_METADATA_MODE); ok {
+		mode := os.FileMode(v) & os.ModePerm
+		perm.mode = &mode
+	}
+	if v, ok := parsePermMetadata(meta, PERM_METADATA_UID); ok {
+		perm.uid = &v
+	}
+	if v, ok := parsePermMetadata(meta, PERM_METADATA_GID); ok {
+		perm.gid = &v
+	}
+
+	if perm.mode == nil && perm.uid == nil && perm.gid == nil {
+		return nil
+	}
+	return &perm
+}
+
+func parsePermMetadata(meta map[string][]byte, key string) (uint32, bool) {
+	v, ok := meta[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(v), 10, 32)
+	if err != nil {
+		log.Warnf("ignoring %v metadata %q: %v", key, v, err)
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func permModeMetadata(mode os.FileMode, dir bool) []byte {
+	bits := uint64(mode.Perm())
+	if dir {
+		bits |= syscall.S_IFDIR
+	} else {
+		bits |= syscall.S_IFREG
+	}
+	return []byte(strconv.FormatUint(bits, 10))
+}
+
 // MyUserAndGroup returns the UID and GID of this process.
 func MyUserAndGroup() (uid int, gid int) {
 	// Ask for the current user.
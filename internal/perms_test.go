@@ -0,0 +1,180 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type PermsTest struct {
+	cloud *xattrBackend
+}
+
+var _ = Suite(&PermsTest{})
+
+func (s *PermsTest) SetUpTest(t *C) {
+	s.cloud = &xattrBackend{}
+	s.cloud.etag = "\"etag\""
+	s.cloud.size = 1024
+}
+
+func (s *PermsTest) existing() *Inode {
+	inode := newTestInode(s.cloud)
+	inode.fs.flags.FileMode = 0644
+	inode.fs.flags.Uid = 1
+	inode.fs.flags.Gid = 2
+	inode.fs.flags.PermMetadata = true
+	inode.KnownSize = PUInt64(s.cloud.size)
+	inode.Attributes.Size = s.cloud.size
+	return inode
+}
+
+func (s *PermsTest) TestFromMetadata(t *C) {
+	// what s3fs writes for a 0755 file
+	perm := permFromMetadata(map[string][]byte{
+		"mode": []byte("33261"),
+		"uid":  []byte("1000"),
+		"gid":  []byte("not a number"),
+	})
+	t.Assert(perm, NotNil)
+	t.Assert(*perm.mode, Equals, os.FileMode(0755))
+	t.Assert(*perm.uid, Equals, uint32(1000))
+	t.Assert(perm.gid, IsNil)
+
+	t.Assert(permFromMetadata(map[string][]byte{"foo": []byte("bar")}), IsNil)
+	t.Assert(string(permModeMetadata(0755, false)), Equals, "33261")
+	t.Assert(string(permModeMetadata(0700, true)), Equals, "16832")
+}
+
+func (s *PermsTest) TestHead(t *C) {
+	s.cloud.meta = EncodeMetadata(map[string][]byte{
+		"uid": []byte("1000"),
+		"gid": []byte("1001"),
+	})
+	inode := s.existing()
+	t.Assert(inode.needsMetadata(), Equals, true)
+
+	inode.mu.Lock()
+	t.Assert(inode.fillXattr(), IsNil)
+	inode.mu.Unlock()
+	t.Assert(inode.needsMetadata(), Equals, false)
+
+	attr := inode.InflateAttributes()
+	t.Assert(attr.Mode, Equals, os.FileMode(0644))
+	t.Assert(attr.Uid, Equals, uint32(1000))
+	t.Assert(attr.Gid, Equals, uint32(1001))
+}
+
+func (s *PermsTest) TestChmod(t *C) {
+	inode := s.existing()
+
+	t.Assert(inode.SetMode(0700|os.ModeSetuid), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 1)
+	t.Assert(string(DecodeMetadata(s.cloud.meta)["mode"]), Equals, "33216")
+	t.Assert(inode.InflateAttributes().Mode, Equals, os.FileMode(0700))
+	// and the rest of the attributes are still the defaults
+	t.Assert(inode.InflateAttributes().Uid, Equals, uint32(1))
+
+	// the same as setting the xattr
+	t.Assert(inode.SetXattr("user.mode", []byte("33188"), 0), IsNil)
+	t.Assert(inode.InflateAttributes().Mode, Equals, os.FileMode(0644))
+
+	s.cloud.failCopy = true
+	t.Assert(inode.SetMode(0600), NotNil)
+	t.Assert(inode.InflateAttributes().Mode, Equals, os.FileMode(0644))
+}
+
+func (s *PermsTest) TestChmodNewFile(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.PermMetadata = true
+
+	t.Assert(fh.inode.SetMode(0600), IsNil)
+	t.Assert(fh.inode.InflateAttributes().Mode, Equals, os.FileMode(0600))
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+
+	t.Assert(s.cloud.copies, HasLen, 0)
+	t.Assert(string(DecodeMetadata(s.cloud.putMeta)["mode"]), Equals, "33152")
+}
+
+func (s *PermsTest) TestDisabled(t *C) {
+	inode := s.existing()
+	inode.fs.flags.PermMetadata = false
+
+	t.Assert(inode.needsMetadata(), Equals, false)
+	t.Assert(inode.SetMode(0700), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 0)
+	t.Assert(inode.InflateAttributes().Mode, Equals, os.FileMode(0644))
+}
+
+func (s *PermsTest) TestADLv2Permissions(t *C) {
+	for p, expected := range map[string]os.FileMode{
+		"rwxr-x---":  0750,
+		"rw-r--r--+": 0644,
+		"rwxrwxrwt":  0777 | os.ModeSticky,
+		"rwxrwxrwT":  0776 | os.ModeSticky,
+	} {
+		mode, ok := parseADLv2Permissions(p)
+		t.Assert(ok, Equals, true)
+		t.Assert(mode, Equals, expected)
+	}
+	for _, p := range []string{"", "rwxr-x", "rwxr-x--x-", "rwxrwxrwz"} {
+		_, ok := parseADLv2Permissions(p)
+		t.Assert(ok, Equals, false)
+	}
+	t.Assert(adlv2ACL(PString("o"), nil, nil), IsNil)
+}
+
+func (s *PermsTest) TestFromACL(t *C) {
+	s.cloud.meta = EncodeMetadata(map[string][]byte{"mode": []byte("33261")})
+	inode := s.existing()
+	inode.fs.flags.UseBackendACLs = true
+	inode.fs.flags.ACLGroups = map[string]uint32{"group-object-id": 1001}
+
+	item := BlobItemOutput{
+		Key:  PString("file"),
+		ETag: PString("\"etag\""),
+		Size: s.cloud.size,
+		ACL: &BlobACL{
+			Owner: "owner-object-id",
+			Group: "group-object-id",
+			Mode:  0640,
+		},
+	}
+	inode.SetFromBlobItem(&item)
+
+	attr := inode.InflateAttributes()
+	t.Assert(attr.Mode, Equals, os.FileMode(0640))
+	// not in --acl-user-map
+	t.Assert(attr.Uid, Equals, uint32(1))
+	t.Assert(attr.Gid, Equals, uint32(1001))
+
+	// and the mode metadata doesn't override it
+	inode.mu.Lock()
+	t.Assert(inode.fillXattr(), IsNil)
+	inode.mu.Unlock()
+	t.Assert(inode.InflateAttributes().Mode, Equals, os.FileMode(0640))
+
+	owner, id, err := parseACLMapping("name=with=equals=1000")
+	t.Assert(err, IsNil)
+	t.Assert(owner, Equals, "name=with=equals")
+	t.Assert(id, Equals, uint32(1000))
+	_, _, err = parseACLMapping("=1000")
+	t.Assert(err, NotNil)
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// how many speculative listings can be in flight, and how many more
+// can be waiting for their turn. Anything beyond that is dropped, the
+// walker will just list those itself
+const LIST_PREFETCH_CONCURRENCY = 8
+const LIST_PREFETCH_QUEUE = 256
+
+// directories that take more pages than this are not worth listing
+// ahead, we would hold on to too much
+const LIST_PREFETCH_MAX_PAGES = 4
+
+// how many HEADs fill in the metadata of what a listing returned at
+// the same time, and how many of its entries they go through. The
+// rest are looked up one at a time as usual
+const LIST_HYDRATE_CONCURRENCY = 8
+const LIST_HYDRATE_MAX = 1024
+
+// prefetchListings lists dirs in the background so that the
+// ReadDirs of a directory walk that follows can be served from
+// cache. dirs should be freshly created by a listing and have no
+// children yet
+func (fs *Goofys) prefetchListings(dirs []*Inode) {
+	for _, dir := range dirs {
+		if !fs.listPrefetchQueue.Take(1, false) {
+			fuseLog.Debugf("list prefetch queue is full, dropping %v",
+				*dir.FullName())
+			return
+		}
+
+		go func(dir *Inode) {
+			defer fs.listPrefetchQueue.Return(1)
+
+			fs.listPrefetchers.Take(1, true)
+			defer fs.listPrefetchers.Return(1)
+
+			fs.prefetchListing(dir)
+		}(dir)
+	}
+}
+
+func (fs *Goofys) skipPrefetch(dir *Inode) bool {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	// already listed by someone else, or gone
+	return dir.Parent == nil || !expired(dir.dir.DirTime, dir.typeCacheTTL())
+}
+
+func (fs *Goofys) prefetchListing(dir *Inode) {
+	if fs.skipPrefetch(dir) {
+		return
+	}
+
+	cloud, prefix := dir.cloud()
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	params := &ListBlobsInput{
+		Delimiter: aws.String("/"),
+		Prefix:    &prefix,
+	}
+
+	var prefixes []BlobPrefixOutput
+	var items []BlobItemOutput
+
+	for pages := 0; ; pages++ {
+		// memory is better spent on reads and writes, and
+		// requests on things the user is waiting for
+		if pages == LIST_PREFETCH_MAX_PAGES || fs.bufferPool.Exhausted() {
+			fuseLog.Debugf("cancelled list prefetch of %v", *dir.FullName())
+			return
+		}
+
+		if !SmallActionsGate.Take(1, false) {
+			return
+		}
+		resp, err := cloud.ListBlobs(params)
+		SmallActionsGate.Return(1)
+		if err != nil {
+			s3Log.Debugf("prefetch ListObjects %v = %v", prefix, err)
+			return
+		}
+
+		prefixes = append(prefixes, resp.Prefixes...)
+		items = append(items, resp.Items...)
+		putListItems(resp.Items)
+
+		if !resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	// the walker may have beaten us to it while we were listing
+	if dir.Parent == nil || !expired(dir.dir.DirTime, dir.typeCacheTTL()) {
+		return
+	}
+
+	gen := dir.dir.listGen + 1
+
+	fs.mu.Lock()
+	for _, p := range prefixes {
+		rawName := (*p.Prefix)[len(prefix) : len(*p.Prefix)-1]
+		if len(rawName) == 0 {
+			continue
+		}
+		dirName, ok := dir.listedName(rawName)
+		if !ok {
+			continue
+		}
+
+		inode := dir.findChildUnlocked(dirName)
+		if inode != nil {
+			inode.AttrTime = time.Now()
+		} else {
+			inode = NewInode(fs, dir, &dirName)
+			inode.setRawName(rawName)
+			inode.ToDir()
+			fs.insertInode(dir, inode)
+			inode.refcnt = 0
+		}
+		inode.listGen = gen
+	}
+
+	for i := range items {
+		obj := &items[i]
+		rawName := (*obj.Key)[len(prefix):]
+		if len(rawName) == 0 || strings.Contains(rawName, "/") {
+			continue
+		}
+		baseName, ok := dir.listedName(rawName)
+		if !ok {
+			continue
+		}
+
+		inode := dir.findChildUnlocked(baseName)
+		if inode == nil {
+			inode = NewInode(fs, dir, &baseName)
+			inode.setRawName(rawName)
+			inode.refcnt = 0
+			fs.insertInode(dir, inode)
+		}
+		inode.SetFromBlobItem(obj)
+		inode.listGen = gen
+	}
+	fs.mu.Unlock()
+
+	dir.dir.DirTime = time.Now()
+	dir.dir.listGen = gen
+	dir.Attributes.Mtime = dir.findChildMaxTime()
+}
+
+// hydrateListed fills in the metadata of inode, which the listing it
+// came from didn't have. The first lookup of a listing that needs to
+// do this also starts HEADing the rest of it in the background, ls -l
+// is about to ask for them one by one. Returns whether inode can be
+// answered from what we have now
+func (fs *Goofys) hydrateListed(parent *Inode, inode *Inode) bool {
+	var todo []*Inode
+
+	parent.mu.Lock()
+	gen := parent.dir.listGen
+	if parent.dir.hydratedGen != gen && !fs.flags.Cheap {
+		parent.dir.hydratedGen = gen
+		for _, child := range parent.dir.Children {
+			if len(todo) == LIST_HYDRATE_MAX {
+				break
+			}
+			if child != inode && child.listGen == gen && child.needsMetadata() {
+				todo = append(todo, child)
+			}
+		}
+	}
+	parent.mu.Unlock()
+
+	if len(todo) != 0 {
+		fs.hydrateInodes(parent, todo)
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// if a worker got to it first, this waited for it and there's
+	// nothing left to do
+	err := inode.fillXattr()
+	return err == nil && !inode.needsMetadata()
+}
+
+func (fs *Goofys) hydrateInodes(parent *Inode, inodes []*Inode) {
+	work := make(chan *Inode, len(inodes))
+	for _, inode := range inodes {
+		work <- inode
+	}
+	close(work)
+
+	for i := 0; i < MinInt(LIST_HYDRATE_CONCURRENCY, len(inodes)); i++ {
+		go func() {
+			for inode := range work {
+				parent.mu.RLock()
+				gone := inode.Parent != parent
+				parent.mu.RUnlock()
+				if gone {
+					continue
+				}
+
+				inode.mu.Lock()
+				if inode.needsMetadata() {
+					// if it fails, the lookup will
+					// try again
+					inode.fillXattr()
+				}
+				inode.mu.Unlock()
+			}
+		}()
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// prefixBackend is a memBackend that keeps every key that was
+// written, copied or deleted
+type prefixBackend struct {
+	memBackend
+	touched []string
+}
+
+func (b *prefixBackend) touch(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.touched = append(b.touched, keys...)
+}
+
+func (b *prefixBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.touch(param.Key)
+	return b.memBackend.PutBlob(param)
+}
+
+func (b *prefixBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	resp, err := b.memBackend.CopyBlob(param)
+	if err == nil {
+		b.touch(param.Source, param.Destination)
+	}
+	return resp, err
+}
+
+func (b *prefixBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	resp, err := b.memBackend.DeleteBlob(param)
+	if err == nil {
+		b.touch(param.Key)
+	}
+	return resp, err
+}
+
+type PrefixTest struct {
+	cloud *prefixBackend
+	fs    *Goofys
+	root  *Inode
+}
+
+var _ = Suite(&PrefixTest{})
+
+func (s *PrefixTest) SetUpTest(t *C) {
+	s.cloud = &prefixBackend{}
+	s.cloud.add(
+		"deep/prefix/dir/",
+		"deep/prefix/dir/a",
+		"deep/prefix/dir/sub/b",
+		"deep/prefix/dir2",
+		"deep/prefix/other",
+		"deep/x",
+	)
+
+	s.fs = newTestFs(s.cloud, &FlagStorage{Cheap: true})
+	s.root = s.fs.testRoot()
+	s.root.dir.mountPrefix = normalizePrefix("/deep//prefix/dir")
+}
+
+func (s *PrefixTest) readDir(t *C) (names []string) {
+	dh := NewDirHandle(s.root)
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	for i := 0; ; i++ {
+		en, err := dh.ReadDir(fuseops.DirOffset(i))
+		t.Assert(err, IsNil)
+		if en == nil {
+			break
+		}
+		if en.Name != "." && en.Name != ".." {
+			names = append(names, en.Name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (s *PrefixTest) TestNormalizePrefix(t *C) {
+	t.Assert(normalizePrefix(""), Equals, "")
+	t.Assert(normalizePrefix("/"), Equals, "")
+	t.Assert(normalizePrefix("a"), Equals, "a/")
+	t.Assert(normalizePrefix("/a//b/c/"), Equals, "a/b/c/")
+
+	spec, err := ParseBucketSpec("bucket:some//deep/prefix/")
+	t.Assert(err, IsNil)
+	t.Assert(spec.Bucket, Equals, "bucket")
+	t.Assert(spec.Prefix, Equals, "some/deep/prefix/")
+
+	spec, err = ParseBucketSpec("adl://account.azuredatalakestore.net/some/deep/")
+	t.Assert(err, IsNil)
+	t.Assert(spec.Prefix, Equals, "some/deep/")
+}
+
+func (s *PrefixTest) TestReadDir(t *C) {
+	// not the prefix itself, nor what's next to it
+	t.Assert(s.readDir(t), DeepEquals, []string{"a", "sub"})
+
+	_, key := s.root.findChild("sub").cloud()
+	t.Assert(key, Equals, "deep/prefix/dir/sub")
+}
+
+func (s *PrefixTest) TestWrite(t *C) {
+	inode, fh := s.root.Create("new", fuseops.OpMetadata{})
+	s.fs.insertInode(s.root, inode)
+	t.Assert(fh.WriteFile(0, []byte("hello")), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+
+	t.Assert(s.root.Rename("new", s.root, "renamed"), IsNil)
+	t.Assert(s.root.Unlink("a"), IsNil)
+
+	t.Assert(s.cloud.touched, DeepEquals, []string{
+		"deep/prefix/dir/new",
+		"deep/prefix/dir/new",
+		"deep/prefix/dir/renamed",
+		"deep/prefix/dir/new",
+		"deep/prefix/dir/a",
+	})
+	for _, key := range s.cloud.keys() {
+		t.Assert(strings.HasPrefix(key, "deep/prefix/dir/") ||
+			key == "deep/prefix/dir2" || key == "deep/prefix/other" ||
+			key == "deep/x", Equals, true, Commentf("%v", key))
+	}
+	t.Assert(s.readDir(t), DeepEquals, []string{"renamed", "sub"})
+}
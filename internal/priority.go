@@ -0,0 +1,164 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"sync"
+)
+
+// PriorityBackend keeps reads and writes of data and metadata
+// requests apart, each with its own limit of requests in flight from
+// --max-data-requests and --max-metadata-requests. A big sequential
+// read fills the data slots, and a stat or ls next to it still goes
+// right through on the metadata ones instead of waiting behind every
+// range GET. A GET of a range holds its slot until its body is closed,
+// the body holds on to the connection until then too. A GET to the
+// end of the object gives it back once the headers are in: a file
+// handle reads from one of those for as long as the file is read
+// sequentially, and enough of them open would leave nothing for the
+// others
+type PriorityBackend struct {
+	StorageBackend
+
+	// nil is no limit
+	data     *Ticket
+	metadata *Ticket
+}
+
+func NewPriorityBackend(cloud StorageBackend, flags *FlagStorage) *PriorityBackend {
+	b := &PriorityBackend{StorageBackend: cloud}
+	if flags.MaxDataRequests != 0 {
+		b.data = Ticket{Total: uint32(flags.MaxDataRequests)}.Init()
+	}
+	if flags.MaxMetadataRequests != 0 {
+		b.metadata = Ticket{Total: uint32(flags.MaxMetadataRequests)}.Init()
+	}
+	return b
+}
+
+func (b *PriorityBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+func takeSlot(ticket *Ticket) {
+	if ticket != nil {
+		ticket.Take(1, true)
+	}
+}
+
+func returnSlot(ticket *Ticket) {
+	if ticket != nil {
+		ticket.Return(1)
+	}
+}
+
+func (b *PriorityBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.HeadBlob(param)
+}
+
+func (b *PriorityBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.ListBlobs(param)
+}
+
+func (b *PriorityBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.DeleteBlob(param)
+}
+
+func (b *PriorityBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.DeleteBlobs(param)
+}
+
+func (b *PriorityBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.RenameBlob(param)
+}
+
+func (b *PriorityBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.MultipartBlobBegin(param)
+}
+
+func (b *PriorityBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.MultipartBlobAbort(param)
+}
+
+func (b *PriorityBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	takeSlot(b.metadata)
+	defer returnSlot(b.metadata)
+	return b.StorageBackend.MultipartBlobCommit(param)
+}
+
+// slotBody returns the slot of a GET when its body is closed
+type slotBody struct {
+	io.ReadCloser
+	ticket *Ticket
+	once   sync.Once
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.ticket.Return(1) })
+	return err
+}
+
+func (b *PriorityBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	takeSlot(b.data)
+	resp, err := b.StorageBackend.GetBlob(param)
+	if err != nil || b.data == nil || param.Count == 0 {
+		returnSlot(b.data)
+		return resp, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body, ticket: b.data}
+	return resp, nil
+}
+
+func (b *PriorityBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	takeSlot(b.data)
+	defer returnSlot(b.data)
+	return b.StorageBackend.PutBlob(param)
+}
+
+func (b *PriorityBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	takeSlot(b.data)
+	defer returnSlot(b.data)
+	return b.StorageBackend.MultipartBlobAdd(param)
+}
+
+func (b *PriorityBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	takeSlot(b.data)
+	defer returnSlot(b.data)
+	return b.StorageBackend.AppendBlob(param)
+}
+
+func (b *PriorityBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	takeSlot(b.data)
+	defer returnSlot(b.data)
+	return b.StorageBackend.CopyBlob(param)
+}
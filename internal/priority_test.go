@@ -0,0 +1,249 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+// streamingBackend has a few connections that every request takes
+// one of, like a transport with a cap on connections or http/2
+// streams. A GET keeps its connection until its body is closed, and
+// the body takes a while, like a range of a big file. Connections
+// are handed out in the order they were asked for, a Ticket would let
+// a reader that just gave one back take it again before a HEAD that
+// was waiting, which can starve the HEAD for as long as the readers
+// keep going
+type streamingBackend struct {
+	memBackend
+	conns chan struct{}
+
+	gets        int
+	maxGets     int
+	getDuration time.Duration
+}
+
+type streamingBody struct {
+	b      *streamingBackend
+	read   bool
+	closed bool
+}
+
+func (r *streamingBody) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		time.Sleep(r.b.getDuration)
+	}
+	return 0, io.EOF
+}
+
+func (r *streamingBody) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.b.mu.Lock()
+	r.b.gets--
+	r.b.mu.Unlock()
+	<-r.b.conns
+	return nil
+}
+
+func (b *streamingBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.conns <- struct{}{}
+	b.mu.Lock()
+	b.gets++
+	b.maxGets = MaxInt(b.maxGets, b.gets)
+	b.mu.Unlock()
+
+	return &GetBlobOutput{Body: &streamingBody{b: b}}, nil
+}
+
+func (b *streamingBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.conns <- struct{}{}
+	defer func() { <-b.conns }()
+	return &HeadBlobOutput{}, nil
+}
+
+type PriorityTest struct {
+	cloud *streamingBackend
+}
+
+var _ = Suite(&PriorityTest{})
+
+func (s *PriorityTest) SetUpTest(t *C) {
+	s.cloud = &streamingBackend{
+		conns:       make(chan struct{}, 4),
+		getDuration: 20 * time.Millisecond,
+	}
+}
+
+// p95StatUnderLoad is the p95 latency of HEADs while 16 readers keep
+// reading
+func (s *PriorityTest) p95StatUnderLoad(t *C, b StorageBackend) time.Duration {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					resp, err := b.GetBlob(&GetBlobInput{
+						Key:   "big",
+						Count: 1024 * 1024,
+					})
+					t.Assert(err, IsNil)
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+	// let them fill the connections
+	time.Sleep(50 * time.Millisecond)
+
+	var latencies []time.Duration
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		_, err := b.HeadBlob(&HeadBlobInput{Key: "small"})
+		t.Assert(err, IsNil)
+		latencies = append(latencies, time.Since(start))
+	}
+	close(done)
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return latencies[len(latencies)*95/100]
+}
+
+func (s *PriorityTest) TestStatUnderLoad(t *C) {
+	// without limits the reads take every connection
+	before := s.p95StatUnderLoad(t, s.cloud)
+	t.Assert(s.cloud.maxGets, Equals, 4)
+
+	s.cloud.maxGets = 0
+	b := NewPriorityBackend(s.cloud, &FlagStorage{
+		MaxDataRequests:     3,
+		MaxMetadataRequests: 1,
+	})
+	after := s.p95StatUnderLoad(t, b)
+	t.Assert(s.cloud.maxGets, Equals, 3)
+
+	t.Logf("p95 of stat under load: %v before, %v after", before, after)
+	t.Assert(before >= s.cloud.getDuration/2, Equals, true)
+	t.Assert(after < 10*time.Millisecond, Equals, true)
+}
+
+func (s *PriorityTest) TestSlotUntilClose(t *C) {
+	b := NewPriorityBackend(s.cloud, &FlagStorage{MaxDataRequests: 1})
+
+	resp, err := b.GetBlob(&GetBlobInput{Key: "big", Count: 1024})
+	t.Assert(err, IsNil)
+
+	got := make(chan struct{})
+	go func() {
+		resp, err := b.GetBlob(&GetBlobInput{Key: "big", Count: 1024})
+		t.Assert(err, IsNil)
+		resp.Body.Close()
+		close(got)
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("the second GET didn't wait for the first body")
+	case <-time.After(20 * time.Millisecond):
+	}
+	resp.Body.Close()
+	// closing twice doesn't give back another slot
+	resp.Body.Close()
+	<-got
+	t.Assert(b.data.Take(1, false), Equals, true)
+	t.Assert(b.data.Take(1, false), Equals, false)
+}
+
+func (s *PriorityTest) TestSlotUntilHeaders(t *C) {
+	s.cloud.conns = make(chan struct{}, 8)
+	b := NewPriorityBackend(s.cloud, &FlagStorage{MaxDataRequests: 1})
+
+	// readers that keep their bodies open don't hold the slots
+	var bodies []io.ReadCloser
+	for i := 0; i < 4; i++ {
+		resp, err := b.GetBlob(&GetBlobInput{Key: "big"})
+		t.Assert(err, IsNil)
+		bodies = append(bodies, resp.Body)
+	}
+	t.Assert(b.data.Take(1, false), Equals, true)
+	b.data.Return(1)
+
+	for _, body := range bodies {
+		body.Close()
+	}
+}
+
+func (s *PriorityTest) TestDefaults(t *C) {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run([]string{"goofys", "bucket", "/mnt"})
+	t.Assert(flags, NotNil)
+	t.Assert(flags.MaxDataRequests, Equals, 0)
+	t.Assert(flags.MaxMetadataRequests, Equals, 0)
+
+	app.Run([]string{"goofys", "--max-data-requests", "64", "bucket", "/mnt"})
+	t.Assert(flags.MaxDataRequests, Equals, 64)
+}
+
+func (s *PriorityTest) TestNoLimit(t *C) {
+	s.cloud.conns = make(chan struct{}, 8)
+	b := NewPriorityBackend(s.cloud, &FlagStorage{MaxMetadataRequests: 1})
+	t.Assert(b.data, IsNil)
+
+	var wg sync.WaitGroup
+	bodies := make(chan io.ReadCloser, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := b.GetBlob(&GetBlobInput{Key: "big"})
+			bodies <- resp.Body
+		}()
+	}
+	wg.Wait()
+	t.Assert(s.cloud.maxGets, Equals, 8)
+	close(bodies)
+	for body := range bodies {
+		body.Close()
+	}
+
+	t.Assert(unwrapBackend(b), Equals, StorageBackend(s.cloud))
+}
@@ -0,0 +1,332 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// by default warn once usage goes above this fraction of a limit
+const QUOTA_SOFT_LIMIT = 0.9
+
+// usage is written to the state file at most this often
+const QUOTA_SAVE_INTERVAL = time.Second
+
+// WriteQuota limits how much data and how many objects this mount
+// may write. It only accounts for what goes through this mount:
+// creating or growing a file is charged when the file is flushed,
+// deleting a file that we know the size of gives the space back. The
+// usage and the limits are optionally persisted so they survive
+// remounts.
+type WriteQuota struct {
+	mu sync.Mutex
+
+	MaxBytes   uint64 `json:"max_bytes"`
+	MaxObjects uint64 `json:"max_objects"`
+	Bytes      uint64 `json:"bytes"`
+	Objects    uint64 `json:"objects"`
+
+	soft   float64
+	path   string
+	warned bool
+
+	// usage changed since it was last written to path
+	dirty     bool
+	saveTimer *time.Timer
+}
+
+// NewWriteQuota returns nil if there's no limit. soft is the fraction
+// of a limit past which we warn, QUOTA_SOFT_LIMIT if 0
+func NewWriteQuota(maxBytes, maxObjects uint64, soft float64, path string) (q *WriteQuota, err error) {
+	if maxBytes == 0 && maxObjects == 0 && path == "" {
+		return nil, nil
+	}
+
+	if soft == 0 {
+		soft = QUOTA_SOFT_LIMIT
+	} else if soft < 0 || soft > 1 {
+		return nil, fmt.Errorf("invalid soft limit %v, must be between 0 and 1", soft)
+	}
+
+	q = &WriteQuota{soft: soft, path: path}
+
+	if path != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, q)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota state %v: %v", path, err)
+			}
+		} else if os.IsNotExist(err) {
+			err = nil
+		} else {
+			return nil, err
+		}
+	}
+
+	// a limit on the command line wins over the one last set with
+	// the control socket
+	if maxBytes != 0 {
+		q.MaxBytes = maxBytes
+	}
+	if maxObjects != 0 {
+		q.MaxObjects = maxObjects
+	}
+	if q.MaxBytes == 0 && q.MaxObjects == 0 {
+		return nil, nil
+	}
+	return
+}
+
+func exceeds(usage uint64, delta int64, max uint64) bool {
+	return max != 0 && delta > 0 && usage+uint64(delta) > max
+}
+
+func addDelta(usage uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > usage {
+		return 0
+	}
+	return uint64(int64(usage) + delta)
+}
+
+// Charge accounts for a flush that grows usage by bytes and objects
+// (either can be negative when a file shrinks). Returns EDQUOT
+// without charging anything if that would go over the limit.
+func (q *WriteQuota) Charge(bytes int64, objects int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if exceeds(q.Bytes, bytes, q.MaxBytes) || exceeds(q.Objects, objects, q.MaxObjects) {
+		log.Errorf("write quota exceeded: %v/%v bytes %v/%v objects",
+			q.Bytes, q.MaxBytes, q.Objects, q.MaxObjects)
+		return syscall.EDQUOT
+	}
+
+	q.Bytes = addDelta(q.Bytes, bytes)
+	q.Objects = addDelta(q.Objects, objects)
+	q.checkSoftLimit()
+	q.save()
+	return nil
+}
+
+// Credit gives back space after a delete or a failed flush
+func (q *WriteQuota) Credit(bytes int64, objects int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.Bytes = addDelta(q.Bytes, -bytes)
+	q.Objects = addDelta(q.Objects, -objects)
+	q.checkSoftLimit()
+	q.save()
+}
+
+// softLimit is where we start warning about max, 0 if there's no
+// limit
+func (q *WriteQuota) softLimit(max uint64) uint64 {
+	return uint64(q.soft * float64(max))
+}
+
+// LOCKS_REQUIRED(q.mu)
+func (q *WriteQuota) overSoftLimit() bool {
+	return (q.MaxBytes != 0 && q.Bytes >= q.softLimit(q.MaxBytes)) ||
+		(q.MaxObjects != 0 && q.Objects >= q.softLimit(q.MaxObjects))
+}
+
+// LOCKS_REQUIRED(q.mu)
+func (q *WriteQuota) checkSoftLimit() {
+	over := q.overSoftLimit()
+
+	if over && !q.warned {
+		log.Warnf("write quota almost exhausted: %v/%v bytes %v/%v objects",
+			q.Bytes, q.MaxBytes, q.Objects, q.MaxObjects)
+	}
+	q.warned = over
+}
+
+// save writes the state out within QUOTA_SAVE_INTERVAL, so a burst
+// of flushes is one write
+//
+// LOCKS_REQUIRED(q.mu)
+func (q *WriteQuota) save() {
+	if q.path == "" {
+		return
+	}
+
+	q.dirty = true
+	if q.saveTimer == nil {
+		q.saveTimer = time.AfterFunc(QUOTA_SAVE_INTERVAL, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.saveTimer = nil
+			q.write()
+		})
+	}
+}
+
+// LOCKS_REQUIRED(q.mu)
+func (q *WriteQuota) write() {
+	if q.path == "" || !q.dirty {
+		return
+	}
+	q.dirty = false
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		log.Errorf("unable to encode quota state: %v", err)
+		return
+	}
+
+	tmp := q.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		log.Errorf("unable to save quota state to %v: %v", q.path, err)
+	}
+}
+
+// Close writes out what's not saved yet
+func (q *WriteQuota) Close() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.saveTimer != nil {
+		q.saveTimer.Stop()
+		q.saveTimer = nil
+	}
+	q.write()
+}
+
+func (q *WriteQuota) SetLimits(maxBytes, maxObjects *uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if maxBytes != nil {
+		q.MaxBytes = *maxBytes
+	}
+	if maxObjects != nil {
+		q.MaxObjects = *maxObjects
+	}
+	log.Infof("write quota is now %v bytes %v objects", q.MaxBytes, q.MaxObjects)
+	q.checkSoftLimit()
+	// rare enough to not wait for
+	q.dirty = true
+	q.write()
+}
+
+type WriteQuotaStatus struct {
+	MaxBytes      uint64 `json:"max_bytes"`
+	MaxObjects    uint64 `json:"max_objects"`
+	SoftBytes     uint64 `json:"soft_bytes"`
+	SoftObjects   uint64 `json:"soft_objects"`
+	Bytes         uint64 `json:"bytes"`
+	Objects       uint64 `json:"objects"`
+	OverSoftLimit bool   `json:"over_soft_limit"`
+}
+
+func (q *WriteQuota) Status() WriteQuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return WriteQuotaStatus{
+		MaxBytes:      q.MaxBytes,
+		MaxObjects:    q.MaxObjects,
+		SoftBytes:     q.softLimit(q.MaxBytes),
+		SoftObjects:   q.softLimit(q.MaxObjects),
+		Bytes:         q.Bytes,
+		Objects:       q.Objects,
+		OverSoftLimit: q.overSoftLimit(),
+	}
+}
+
+// writeMetrics adds the usage and the limits to the metrics. A limit
+// of 0 is no limit
+func (q *WriteQuota) writeMetrics(w io.Writer) {
+	status := q.Status()
+
+	writeGauge(w, "goofys_write_quota_bytes",
+		"Bytes written through this mount, see --write-quota-bytes.", status.Bytes)
+	writeGauge(w, "goofys_write_quota_max_bytes",
+		"--write-quota-bytes, 0 if there's no limit.", status.MaxBytes)
+	writeGauge(w, "goofys_write_quota_soft_limit_bytes",
+		"Bytes written after which we warn.", status.SoftBytes)
+	writeGauge(w, "goofys_write_quota_objects",
+		"Objects written through this mount, see --write-quota-objects.", status.Objects)
+	writeGauge(w, "goofys_write_quota_max_objects",
+		"--write-quota-objects, 0 if there's no limit.", status.MaxObjects)
+	writeGauge(w, "goofys_write_quota_soft_limit_objects",
+		"Objects written after which we warn.", status.SoftObjects)
+
+	over := uint64(0)
+	if status.OverSoftLimit {
+		over = 1
+	}
+	writeGauge(w, "goofys_write_quota_over_soft_limit",
+		"1 if usage is past a soft limit.", over)
+}
+
+// controlQuota prints the current usage and limits. `quota bytes N'
+// and `quota objects N' change the respective limit.
+func controlQuota(fs *Goofys, args []string, conn net.Conn) error {
+	if fs.quota == nil {
+		return fmt.Errorf("write quota is not enabled")
+	}
+
+	if len(args) != 0 {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: quota [bytes|objects N]")
+		}
+
+		n, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %v: %v", args[1], err)
+		}
+
+		switch args[0] {
+		case "bytes":
+			fs.quota.SetLimits(&n, nil)
+		case "objects":
+			fs.quota.SetLimits(nil, &n)
+		default:
+			return fmt.Errorf("usage: quota [bytes|objects N]")
+		}
+	}
+
+	return writeControlReply(conn, nil, fs.quota.Status())
+}
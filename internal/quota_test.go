@@ -0,0 +1,164 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+type QuotaTest struct {
+}
+
+var _ = Suite(&QuotaTest{})
+
+func (s *QuotaTest) TestUnlimited(t *C) {
+	q, err := NewWriteQuota(0, 0, 0, "")
+	t.Assert(err, IsNil)
+	t.Assert(q, IsNil)
+
+	// nil quota allows everything
+	t.Assert(q.Charge(1<<40, 1000), IsNil)
+	q.Credit(1, 1)
+}
+
+func (s *QuotaTest) TestChargeCredit(t *C) {
+	q, err := NewWriteQuota(100, 2, 0, "")
+	t.Assert(err, IsNil)
+
+	t.Assert(q.Charge(60, 1), IsNil)
+	t.Assert(q.Charge(50, 1), Equals, syscall.EDQUOT)
+	// failed charges don't count
+	t.Assert(q.Status().Bytes, Equals, uint64(60))
+	t.Assert(q.Status().Objects, Equals, uint64(1))
+
+	t.Assert(q.Charge(40, 1), IsNil)
+	t.Assert(q.Charge(0, 1), Equals, syscall.EDQUOT)
+
+	// shrinking a file is always allowed
+	t.Assert(q.Charge(-30, 0), IsNil)
+	t.Assert(q.Status().Bytes, Equals, uint64(70))
+
+	q.Credit(70, 2)
+	t.Assert(q.Status().Bytes, Equals, uint64(0))
+	t.Assert(q.Status().Objects, Equals, uint64(0))
+
+	// never go negative
+	q.Credit(10, 1)
+	t.Assert(q.Status().Bytes, Equals, uint64(0))
+	t.Assert(q.Status().Objects, Equals, uint64(0))
+}
+
+func (s *QuotaTest) TestRaise(t *C) {
+	q, err := NewWriteQuota(10, 0, 0, "")
+	t.Assert(err, IsNil)
+
+	t.Assert(q.Charge(20, 1), Equals, syscall.EDQUOT)
+	q.SetLimits(PUInt64(100), nil)
+	t.Assert(q.Charge(20, 1), IsNil)
+	// objects are still unlimited
+	t.Assert(q.Charge(0, 1000), IsNil)
+}
+
+func (s *QuotaTest) TestMetrics(t *C) {
+	q, err := NewWriteQuota(100, 0, 0, "")
+	t.Assert(err, IsNil)
+	t.Assert(q.Charge(95, 1), IsNil)
+
+	var buf bytes.Buffer
+	q.writeMetrics(&buf)
+	lines := strings.Split(buf.String(), "\n")
+	for _, l := range []string{
+		"goofys_write_quota_bytes 95",
+		"goofys_write_quota_max_bytes 100",
+		"goofys_write_quota_soft_limit_bytes 90",
+		"goofys_write_quota_objects 1",
+		"goofys_write_quota_max_objects 0",
+		"goofys_write_quota_over_soft_limit 1",
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || line == l
+		}
+		t.Assert(found, Equals, true, Commentf("%v not in %v", l, buf.String()))
+	}
+
+	q.Credit(50, 0)
+	t.Assert(q.Status().OverSoftLimit, Equals, false)
+}
+
+func (s *QuotaTest) TestSoftLimit(t *C) {
+	q, err := NewWriteQuota(100, 0, 0.5, "")
+	t.Assert(err, IsNil)
+	t.Assert(q.Charge(49, 1), IsNil)
+	t.Assert(q.Status().SoftBytes, Equals, uint64(50))
+	t.Assert(q.Status().OverSoftLimit, Equals, false)
+	t.Assert(q.Charge(1, 0), IsNil)
+	t.Assert(q.Status().OverSoftLimit, Equals, true)
+
+	_, err = NewWriteQuota(100, 0, 1.5, "")
+	t.Assert(err, NotNil)
+}
+
+func (s *QuotaTest) TestPersist(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-quota")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state")
+
+	q, err := NewWriteQuota(100, 10, 0, path)
+	t.Assert(err, IsNil)
+	t.Assert(q.Charge(40, 2), IsNil)
+	t.Assert(q.Charge(2, 1), IsNil)
+	// writes are batched
+	_, err = os.Stat(path)
+	t.Assert(os.IsNotExist(err), Equals, true)
+	q.Close()
+
+	q, err = NewWriteQuota(50, 10, 0, path)
+	t.Assert(err, IsNil)
+	t.Assert(q.Status(), Equals, WriteQuotaStatus{
+		MaxBytes:    50,
+		MaxObjects:  10,
+		SoftBytes:   45,
+		SoftObjects: 9,
+		Bytes:       42,
+		Objects:     3,
+	})
+	t.Assert(q.Charge(10, 1), Equals, syscall.EDQUOT)
+
+	// so are limits set on the control socket, unless the command
+	// line has one
+	q.SetLimits(nil, PUInt64(20))
+	q, err = NewWriteQuota(0, 0, 0, path)
+	t.Assert(err, IsNil)
+	t.Assert(q.Status().MaxBytes, Equals, uint64(50))
+	t.Assert(q.Status().MaxObjects, Equals, uint64(20))
+	q, err = NewWriteQuota(0, 5, 0, path)
+	t.Assert(err, IsNil)
+	t.Assert(q.Status().MaxObjects, Equals, uint64(5))
+
+	err = ioutil.WriteFile(path, []byte("garbage"), 0600)
+	t.Assert(err, IsNil)
+	_, err = NewWriteQuota(50, 10, 0, path)
+	t.Assert(err, NotNil)
+}
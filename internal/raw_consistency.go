@@ -0,0 +1,81 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Some S3-compatible stores, Ceph RGW among them, can 404 a HEAD or
+// GET of an object that was just written. A file we flushed a moment
+// ago is then taken for deleted by someone else, and what's done with
+// it next fails. With --raw-consistency-retries a lookup or read that
+// doesn't find a file we wrote in the last --raw-consistency-window is
+// tried again a few times before it's believed. Files we didn't write
+// aren't retried, a delete by someone else still shows right away
+
+// the first retry waits this long, and each one after twice as long
+// as the one before, up to RAW_CONSISTENCY_MAX_BACKOFF
+const RAW_CONSISTENCY_BACKOFF = 100 * time.Millisecond
+const RAW_CONSISTENCY_MAX_BACKOFF = 2 * time.Second
+
+// noteWritten is that we just wrote the object of inode
+func (inode *Inode) noteWritten() {
+	atomic.StoreInt64(&inode.writtenAt, time.Now().UnixNano())
+}
+
+// recentlyWritten is whether we wrote inode in the last
+// --raw-consistency-window. nil-safe for lookups of what isn't cached
+func (inode *Inode) recentlyWritten() bool {
+	if inode == nil || inode.fs.flags.RawConsistencyRetries == 0 {
+		return false
+	}
+	at := atomic.LoadInt64(&inode.writtenAt)
+	return at != 0 &&
+		time.Since(time.Unix(0, at)) < inode.fs.flags.RawConsistencyWindow
+}
+
+func rawConsistencyBackoff(retry int) time.Duration {
+	d := RAW_CONSISTENCY_BACKOFF
+	for i := 0; i < retry && d < RAW_CONSISTENCY_MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > RAW_CONSISTENCY_MAX_BACKOFF {
+		d = RAW_CONSISTENCY_MAX_BACKOFF
+	}
+	return d
+}
+
+// retryIfWritten calls op, and again while it fails with ENOENT if we
+// recently wrote inode, up to --raw-consistency-retries more times
+func (inode *Inode) retryIfWritten(op func() error) error {
+	err := op()
+	if err != syscall.ENOENT || !inode.recentlyWritten() {
+		return err
+	}
+
+	for i := 0; i < inode.fs.flags.RawConsistencyRetries; i++ {
+		inode.logFuse("not found right after we wrote it, trying again", i+1)
+		time.Sleep(rawConsistencyBackoff(i))
+		err = op()
+		if err != syscall.ENOENT {
+			return err
+		}
+	}
+	inode.logFuse("still not found after we wrote it", err)
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// laggyBackend doesn't find what's there for the first lag HEADs
+type laggyBackend struct {
+	slowBackend
+	lag   int
+	heads int
+}
+
+func (b *laggyBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.heads++
+	if b.heads <= b.lag {
+		return nil, syscall.ENOENT
+	}
+	return b.slowBackend.HeadBlob(param)
+}
+
+type RawConsistencyTest struct {
+	cloud *laggyBackend
+}
+
+var _ = Suite(&RawConsistencyTest{})
+
+func (s *RawConsistencyTest) SetUpTest(t *C) {
+	s.cloud = &laggyBackend{lag: 2}
+	s.cloud.etag = "\"etag\""
+}
+
+func (s *RawConsistencyTest) fileHandle(retries int) *FileHandle {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.RawConsistencyRetries = retries
+	fh.inode.fs.flags.RawConsistencyWindow = 10 * time.Second
+	fh.inode.KnownSize = PUInt64(0)
+	return fh
+}
+
+func (s *RawConsistencyTest) TestRetryWritten(t *C) {
+	fh := s.fileHandle(3)
+	fh.inode.noteWritten()
+
+	t.Assert(fh.deletedRemotely(), Equals, false)
+	t.Assert(s.cloud.heads, Equals, 3)
+	t.Assert(fh.inode.isStale(), Equals, false)
+}
+
+func (s *RawConsistencyTest) TestGiveUp(t *C) {
+	s.cloud.lag = 10
+	fh := s.fileHandle(2)
+	fh.inode.noteWritten()
+
+	t.Assert(fh.deletedRemotely(), Equals, true)
+	t.Assert(s.cloud.heads, Equals, 3)
+}
+
+func (s *RawConsistencyTest) TestNotWritten(t *C) {
+	// someone else's file is believed right away
+	fh := s.fileHandle(3)
+	t.Assert(fh.deletedRemotely(), Equals, true)
+	t.Assert(s.cloud.heads, Equals, 1)
+
+	// and so is ours once it's out of the window
+	s.SetUpTest(t)
+	fh = s.fileHandle(3)
+	fh.inode.writtenAt = time.Now().Add(-time.Minute).UnixNano()
+	t.Assert(fh.deletedRemotely(), Equals, true)
+	t.Assert(s.cloud.heads, Equals, 1)
+
+	// or when it's off
+	s.SetUpTest(t)
+	fh = s.fileHandle(0)
+	fh.inode.noteWritten()
+	t.Assert(fh.deletedRemotely(), Equals, true)
+	t.Assert(s.cloud.heads, Equals, 1)
+}
+
+func (s *RawConsistencyTest) TestBackoff(t *C) {
+	t.Assert(rawConsistencyBackoff(0), Equals, RAW_CONSISTENCY_BACKOFF)
+	t.Assert(rawConsistencyBackoff(1), Equals, 2*RAW_CONSISTENCY_BACKOFF)
+	t.Assert(rawConsistencyBackoff(100), Equals, RAW_CONSISTENCY_MAX_BACKOFF)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// etagBackend is a slowBackend whose GetBlob checks IfMatch
+type etagBackend struct {
+	slowBackend
+	// what each GET asked for
+	ifMatch []string
+}
+
+func (b *etagBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	b.mu.Lock()
+	etag := b.etag
+	b.ifMatch = append(b.ifMatch, nilStr(param.IfMatch))
+	b.mu.Unlock()
+
+	if param.IfMatch != nil && *param.IfMatch != etag {
+		return nil, syscall.ESTALE
+	}
+	resp, err := b.slowBackend.GetBlob(param)
+	if err == nil {
+		resp.ETag = PString(etag)
+	}
+	return resp, err
+}
+
+func (b *etagBackend) replace(etag string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.etag = etag
+}
+
+type ReadETagTest struct {
+	cloud *etagBackend
+	inode *Inode
+}
+
+var _ = Suite(&ReadETagTest{})
+
+func (s *ReadETagTest) SetUpTest(t *C) {
+	s.cloud = &etagBackend{}
+	s.cloud.size = 1024 * 1024
+	s.cloud.etag = "\"v1\""
+
+	s.inode = newTestInode(s.cloud)
+	s.inode.KnownSize = &s.cloud.size
+	s.inode.Attributes.Size = s.cloud.size
+	s.inode.etag = "\"v1\""
+}
+
+func (s *ReadETagTest) read(t *C, fh *FileHandle, off int64) {
+	buf := make([]byte, 4096)
+	n, err := fh.ReadFile(off, buf)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, len(buf))
+	for i := 0; i < n; i++ {
+		if buf[i] != byte(off+int64(i)+1) {
+			t.Fatalf("wrong data at %v", off+int64(i))
+		}
+	}
+}
+
+func (s *ReadETagTest) TestReplaced(t *C) {
+	fh, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(fh.keepPageCache, Equals, true)
+
+	s.read(t, fh, 0)
+	t.Assert(s.cloud.ifMatch, DeepEquals, []string{"\"v1\""})
+
+	// the next request finds out, and goes on with the new one
+	s.cloud.replace("\"v2\"")
+	s.read(t, fh, 512*1024)
+	t.Assert(s.cloud.ifMatch, DeepEquals, []string{"\"v1\"", "\"v1\"", ""})
+	t.Assert(*fh.readETag, Equals, "\"v2\"")
+	t.Assert(s.inode.AttrTime.IsZero(), Equals, true)
+
+	s.read(t, fh, 0)
+	t.Assert(s.cloud.ifMatch[3], Equals, "\"v2\"")
+
+	// what the kernel has is of v1
+	fh2, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(fh2.keepPageCache, Equals, false)
+	fh3, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(fh3.keepPageCache, Equals, true)
+}
+
+func (s *ReadETagTest) TestChangedBetweenOpens(t *C) {
+	fh, err := s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(fh.keepPageCache, Equals, true)
+	fh.Release()
+
+	// a lookup saw the new one
+	s.cloud.replace("\"v2\"")
+	s.inode.etag = "\"v2\""
+
+	fh, err = s.inode.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, IsNil)
+	t.Assert(fh.keepPageCache, Equals, false)
+	s.read(t, fh, 0)
+	t.Assert(s.cloud.ifMatch, DeepEquals, []string{"\"v2\""})
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"syscall"
+)
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "crc32":
+		return crc32.NewIEEE()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// isWholeRange is whether a Content-Range of "bytes 0-99/100" is all
+// of the object. A missing one means the response wasn't a range
+func isWholeRange(contentRange string) bool {
+	if contentRange == "" {
+		return true
+	}
+
+	var first, last, size uint64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &size)
+	return err == nil && first == 0 && last+1 == size
+}
+
+// etagMD5 is the md5 that an ETag is, if it is one. Objects uploaded
+// in parts have a "-N" suffix, and those encrypted with SSE-KMS or
+// SSE-C have something else that looks the same, callers have to
+// know it's not one of those
+func etagMD5(etag *string) *BlobChecksum {
+	if etag == nil {
+		return nil
+	}
+	s := strings.Trim(*etag, "\"")
+	if len(s) != md5.Size*2 {
+		return nil
+	}
+	sum, err := hex.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return &BlobChecksum{Algorithm: "md5", Value: sum}
+}
+
+// base64Checksum decodes an x-amz-checksum-* or Content-MD5 value. The
+// ones of multipart uploads are checksums of the part checksums, with
+// a "-N" suffix, and are no good to us
+func base64Checksum(algorithm string, value *string) *BlobChecksum {
+	if value == nil || *value == "" || strings.Contains(*value, "-") {
+		return nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(*value)
+	if err != nil || len(sum) != newChecksumHash(algorithm).Size() {
+		return nil
+	}
+	return &BlobChecksum{Algorithm: algorithm, Value: sum}
+}
+
+// verifiedBody hashes what goes through it, and fails the read that
+// gets to the end if it's not what it should be. It counts on the
+// body under it to end when it says it would, which is what
+// checkedBody is for
+type verifiedBody struct {
+	io.ReadCloser
+	key      string
+	checksum *BlobChecksum
+	hash     hash.Hash
+	size     uint64
+	read     uint64
+	// sticks once we found a mismatch
+	err error
+}
+
+func newVerifiedBody(key string, body io.ReadCloser, checksum *BlobChecksum,
+	size uint64) io.ReadCloser {
+
+	h := newChecksumHash(checksum.Algorithm)
+	if h == nil {
+		return body
+	}
+	return &verifiedBody{
+		ReadCloser: body,
+		key:        key,
+		checksum:   checksum,
+		hash:       h,
+		size:       size,
+	}
+}
+
+func (b *verifiedBody) Read(p []byte) (n int, err error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err = b.ReadCloser.Read(p)
+	if n == 0 || b.read == b.size {
+		return
+	}
+
+	b.hash.Write(p[:n])
+	b.read += uint64(n)
+	if b.read != b.size {
+		return
+	}
+
+	// readers often stop at the size they expect without
+	// seeing EOF, so check here instead of waiting for it
+	sum := b.hash.Sum(nil)
+	if !bytes.Equal(sum, b.checksum.Value) {
+		s3Log.Errorf("%v: %v is %x, but should be %x",
+			b.key, b.checksum.Algorithm, sum, b.checksum.Value)
+		b.err = syscall.EIO
+		return n, b.err
+	}
+	return
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// checksumBackend is a slowBackend that has the md5 of the object
+type checksumBackend struct {
+	slowBackend
+	sum []byte
+}
+
+func (b *checksumBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	resp, err := b.slowBackend.GetBlob(param)
+	if err == nil && param.Checksum && param.Start == 0 &&
+		(param.Count == 0 || param.Count >= b.size) {
+		resp.Checksum = &BlobChecksum{Algorithm: "md5", Value: b.sum}
+	}
+	return resp, err
+}
+
+type ReadIntegrityTest struct {
+	cloud *checksumBackend
+}
+
+var _ = Suite(&ReadIntegrityTest{})
+
+func (s *ReadIntegrityTest) SetUpTest(t *C) {
+	s.cloud = &checksumBackend{}
+	s.cloud.size = 1024*1024 + 123
+
+	h := md5.New()
+	io.Copy(h, io.LimitReader(&SeqReader{}, int64(s.cloud.size)))
+	s.cloud.sum = h.Sum(nil)
+}
+
+func (s *ReadIntegrityTest) TestWholeRange(t *C) {
+	t.Assert(isWholeRange(""), Equals, true)
+	t.Assert(isWholeRange("bytes 0-99/100"), Equals, true)
+	t.Assert(isWholeRange("bytes 0-98/100"), Equals, false)
+	t.Assert(isWholeRange("bytes 1-99/100"), Equals, false)
+	t.Assert(isWholeRange("bytes */100"), Equals, false)
+}
+
+func (s *ReadIntegrityTest) TestParseChecksum(t *C) {
+	sum := etagMD5(PString("\"d41d8cd98f00b204e9800998ecf8427e\""))
+	t.Assert(sum, NotNil)
+	t.Assert(sum.Algorithm, Equals, "md5")
+	t.Assert(sum.Value, HasLen, md5.Size)
+
+	// uploaded in parts
+	t.Assert(etagMD5(PString("\"d41d8cd98f00b204e9800998ecf8427e-2\"")), IsNil)
+	t.Assert(etagMD5(PString("\"v1\"")), IsNil)
+	t.Assert(etagMD5(nil), IsNil)
+
+	sum = base64Checksum("crc32c", PString("AAAAAA=="))
+	t.Assert(sum, NotNil)
+	t.Assert(sum.Value, HasLen, 4)
+	// of the parts, or the wrong size
+	t.Assert(base64Checksum("crc32c", PString("AAAAAA==-3")), IsNil)
+	t.Assert(base64Checksum("sha256", PString("AAAAAA==")), IsNil)
+	t.Assert(base64Checksum("sha256", nil), IsNil)
+}
+
+func (s *ReadIntegrityTest) read(param *GetBlobInput) error {
+	resp, err := getBlobChecked(s.cloud, param)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	return err
+}
+
+func (s *ReadIntegrityTest) TestVerify(t *C) {
+	t.Assert(s.read(&GetBlobInput{Key: "file", Checksum: true}), IsNil)
+
+	// the rest of a short response counts too
+	s.cloud.cut = 0.7
+	t.Assert(s.read(&GetBlobInput{Key: "file", Checksum: true}), IsNil)
+	t.Assert(s.cloud.gets, Equals, 3)
+
+	s.cloud.sum[0]++
+	t.Assert(s.read(&GetBlobInput{Key: "file", Checksum: true}), Equals, syscall.EIO)
+	// not asked for, or not all of it
+	t.Assert(s.read(&GetBlobInput{Key: "file"}), IsNil)
+	t.Assert(s.read(&GetBlobInput{Key: "file", Start: 1, Checksum: true}), IsNil)
+}
+
+func (s *ReadIntegrityTest) TestReadFile(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.CheckReadIntegrity = true
+	readTestFile(t, fh, s.cloud.size)
+
+	s.cloud.sum[0]++
+	fh = newTestFileHandle(s.cloud)
+	fh.inode.fs.flags.CheckReadIntegrity = true
+	fh.inode.Attributes.Size = s.cloud.size
+	buf := make([]byte, s.cloud.size)
+	_, err := fh.ReadFile(0, buf)
+	t.Assert(err, Equals, syscall.EIO)
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"syscall"
+)
+
+// ReadOnlyBackend fails everything that would change the bucket with
+// EROFS and passes the rest on. -o ro only has the kernel refuse
+// writes, this also stops what we send on our own, and what embedders
+// of the api package ask for directly
+type ReadOnlyBackend struct {
+	StorageBackend
+}
+
+func NewReadOnlyBackend(cloud StorageBackend) *ReadOnlyBackend {
+	return &ReadOnlyBackend{StorageBackend: cloud}
+}
+
+func (b *ReadOnlyBackend) Unwrap() StorageBackend {
+	return b.StorageBackend
+}
+
+// isReadOnlyMount is whether NewBackend puts a ReadOnlyBackend in
+func isReadOnlyMount(flags *FlagStorage) bool {
+	_, ro := flags.MountOptions["ro"]
+	if config, ok := flags.Backend.(*S3Config); ok && config.Anonymous {
+		// nothing can be written without credentials
+		ro = true
+	}
+	return ro || flags.BackendReadOnly
+}
+
+func (b *ReadOnlyBackend) Capabilities() *Capabilities {
+	// a copy, the backend's can change after Init
+	cap := *b.StorageBackend.Capabilities()
+	cap.ReadOnly = true
+	return &cap
+}
+
+func (b *ReadOnlyBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	return nil, syscall.EROFS
+}
+
+// MultipartExpire aborts other people's uploads
+func (b *ReadOnlyBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *ReadOnlyBackend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return nil, syscall.EROFS
+}
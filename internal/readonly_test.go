@@ -0,0 +1,140 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// readsOnlyBackend only implements reads, anything else that gets to
+// it panics
+type readsOnlyBackend struct {
+	memBackend
+	heads int
+}
+
+func (b *readsOnlyBackend) Capabilities() *Capabilities {
+	return &Capabilities{Name: "reads"}
+}
+
+func (b *readsOnlyBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	b.heads++
+	return &HeadBlobOutput{}, nil
+}
+
+type ReadOnlyTest struct{}
+
+var _ = Suite(&ReadOnlyTest{})
+
+func (s *ReadOnlyTest) TestNothingEscapes(t *C) {
+	cloud := &readsOnlyBackend{}
+	b := NewReadOnlyBackend(cloud)
+
+	_, err := b.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, IsNil)
+	t.Assert(cloud.heads, Equals, 1)
+	t.Assert(b.Capabilities().ReadOnly, Equals, true)
+	t.Assert(b.Capabilities().Name, Equals, "reads")
+	t.Assert(cloud.Capabilities().ReadOnly, Equals, false)
+
+	calls := map[string]func() error{
+		"DeleteBlob": func() error {
+			_, err := b.DeleteBlob(&DeleteBlobInput{Key: "file"})
+			return err
+		},
+		"DeleteBlobs": func() error {
+			_, err := b.DeleteBlobs(&DeleteBlobsInput{Items: []string{"file"}})
+			return err
+		},
+		"RenameBlob": func() error {
+			_, err := b.RenameBlob(&RenameBlobInput{Source: "a", Destination: "b"})
+			return err
+		},
+		"CopyBlob": func() error {
+			_, err := b.CopyBlob(&CopyBlobInput{Source: "a", Destination: "b"})
+			return err
+		},
+		"PutBlob": func() error {
+			_, err := b.PutBlob(&PutBlobInput{Key: "file"})
+			return err
+		},
+		"MultipartBlobBegin": func() error {
+			_, err := b.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "file"})
+			return err
+		},
+		"MultipartBlobAdd": func() error {
+			_, err := b.MultipartBlobAdd(&MultipartBlobAddInput{})
+			return err
+		},
+		"MultipartBlobAbort": func() error {
+			_, err := b.MultipartBlobAbort(&MultipartBlobCommitInput{})
+			return err
+		},
+		"MultipartBlobCommit": func() error {
+			_, err := b.MultipartBlobCommit(&MultipartBlobCommitInput{})
+			return err
+		},
+		"MultipartExpire": func() error {
+			_, err := b.MultipartExpire(&MultipartExpireInput{})
+			return err
+		},
+		"AppendBlob": func() error {
+			_, err := b.AppendBlob(&AppendBlobInput{Key: "file"})
+			return err
+		},
+		"RemoveBucket": func() error {
+			_, err := b.RemoveBucket(&RemoveBucketInput{})
+			return err
+		},
+		"MakeBucket": func() error {
+			_, err := b.MakeBucket(&MakeBucketInput{})
+			return err
+		},
+	}
+	for name, call := range calls {
+		t.Assert(call(), Equals, syscall.EROFS, Commentf("%v", name))
+	}
+
+	// and everything above it knows
+	inode := newTestInode(b)
+	t.Assert(inode.readOnly(), Equals, true)
+	t.Assert(unwrapBackend(b), Equals, cloud)
+}
+
+func (s *ReadOnlyTest) TestInstalled(t *C) {
+	newBackend := func(flags *FlagStorage) StorageBackend {
+		flags.Backend = &S3Config{
+			Region:    "us-east-1",
+			AccessKey: "access",
+			SecretKey: "secret",
+		}
+		cloud, err := NewBackend("bucket", flags)
+		t.Assert(err, IsNil)
+		return cloud
+	}
+
+	_, ok := newBackend(&FlagStorage{}).(*ReadOnlyBackend)
+	t.Assert(ok, Equals, false)
+	_, ok = newBackend(&FlagStorage{BackendReadOnly: true}).(*ReadOnlyBackend)
+	t.Assert(ok, Equals, true)
+	_, ok = newBackend(&FlagStorage{
+		MountOptions: map[string]string{"ro": ""},
+	}).(*ReadOnlyBackend)
+	t.Assert(ok, Equals, true)
+}
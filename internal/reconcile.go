@@ -0,0 +1,194 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// reconcileDir is for when the backend contradicts what we have
+// cached for dir: a child we have cached doesn't exist, or a name we
+// don't know about does. That happens when someone else changes the
+// bucket and the TTLs are long. We list dir right away, whatever the
+// TTLs say, and make the cache match. Only one runs per dir at a time,
+// the rest are dropped
+func (fs *Goofys) reconcileDir(dir *Inode, reason string) {
+	dir.mu.Lock()
+	if dir.dir == nil || dir.dir.reconciling {
+		dir.mu.Unlock()
+		return
+	}
+	dir.dir.reconciling = true
+	dir.mu.Unlock()
+
+	defer func() {
+		dir.mu.Lock()
+		dir.dir.reconciling = false
+		dir.mu.Unlock()
+	}()
+
+	cloud, prefix := dir.cloud()
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	params := &ListBlobsInput{
+		Delimiter: aws.String("/"),
+		Prefix:    &prefix,
+	}
+
+	start := time.Now()
+	var prefixes []BlobPrefixOutput
+	var items []BlobItemOutput
+
+	for {
+		resp, err := cloud.ListBlobs(params)
+		if err != nil {
+			s3Log.Warnf("unable to list %v to reconcile it: %v", prefix, err)
+			return
+		}
+
+		prefixes = append(prefixes, resp.Prefixes...)
+		items = append(items, resp.Items...)
+		putListItems(resp.Items)
+
+		if !resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.Parent == nil && dir.Id != fuseops.RootInodeID {
+		// removed while we were listing
+		return
+	}
+
+	gen := dir.dir.listGen + 1
+	listed := make(map[string]bool)
+	var added, removed int
+
+	fs.mu.Lock()
+
+	addDir := func(rawName string) {
+		name, ok := dir.listedName(rawName)
+		if !ok || listed[name] {
+			return
+		}
+		listed[name] = true
+
+		inode := dir.findChildUnlocked(name)
+		if inode != nil && !inode.isDir() {
+			// it's a file and a dir, a file wins
+			return
+		}
+		if inode == nil {
+			inode = NewInode(fs, dir, &name)
+			inode.setRawName(rawName)
+			inode.ToDir()
+			fs.insertInode(dir, inode)
+			inode.refcnt = 0
+			added++
+		}
+		inode.AttrTime = time.Now()
+		inode.listGen = gen
+	}
+
+	for _, p := range prefixes {
+		name := (*p.Prefix)[len(prefix) : len(*p.Prefix)-1]
+		if len(name) != 0 {
+			addDir(name)
+		}
+	}
+
+	for i := range items {
+		obj := &items[i]
+		name := (*obj.Key)[len(prefix):]
+		if slash := strings.Index(name, "/"); slash != -1 {
+			// a dir blob, or a backend that doesn't do
+			// delimiters
+			if slash != 0 {
+				addDir(name[:slash])
+			}
+			continue
+		}
+		if len(name) == 0 {
+			continue
+		}
+		rawName := name
+		name, ok := dir.listedName(rawName)
+		if !ok {
+			continue
+		}
+		listed[name] = true
+
+		inode := dir.findChildUnlocked(name)
+		if inode == nil {
+			inode = NewInode(fs, dir, &name)
+			inode.setRawName(rawName)
+			inode.refcnt = 0
+			fs.insertInode(dir, inode)
+			added++
+		} else if inode.isDir() {
+			continue
+		}
+		inode.SetFromBlobItem(obj)
+		inode.listGen = gen
+	}
+
+	fs.mu.Unlock()
+
+	for i := 0; i < len(dir.dir.Children); {
+		child := dir.dir.Children[i]
+		name := *child.Name
+		// mounts and what was created while we were listing
+		// have a newer AttrTime
+		if listed[name] || name == "." || name == ".." ||
+			child.AttrTime.After(start) || child.isUnflushed() {
+			i++
+			continue
+		}
+
+		dir.removeChildUnlocked(child)
+		// like markStale, so the kernel looks up the name
+		// again instead of opening what it has
+		atomic.StoreUint32(&child.stale, 1)
+		removed++
+	}
+
+	dir.dir.DirTime = time.Now()
+	dir.dir.listGen = gen
+	dir.Attributes.Mtime = dir.findChildMaxTime()
+
+	atomic.AddUint64(&fs.reconciledDirs, 1)
+	log.Infof("reconciled %v after %v: %v added, %v removed",
+		prefix, reason, added, removed)
+}
+
+// isUnflushed is for a file that was created here and hasn't been
+// written out yet, so it's not in any listing
+func (inode *Inode) isUnflushed() bool {
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	return inode.Invalid || (inode.KnownSize == nil && inode.fileHandles != 0)
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type ReconcileTest struct {
+	fs    *Goofys
+	cloud *treeBackend
+	dir   *Inode
+}
+
+var _ = Suite(&ReconcileTest{})
+
+func (s *ReconcileTest) SetUpTest(t *C) {
+	s.cloud = &treeBackend{}
+	s.cloud.add("dir/", "dir/kept", "dir/new", "dir/newdir/x", "dir/olddir/y",
+		"dir/other/z/w")
+
+	s.fs = newTestFs(s.cloud, &FlagStorage{
+		StatCacheTTL: time.Hour,
+		TypeCacheTTL: time.Hour,
+	})
+	s.dir = newTestDir(s.fs.testRoot(), "dir")
+
+	// what we cached an hour ago
+	for _, name := range []string{"kept", "gone", "olddir"} {
+		child := NewInode(s.fs, s.dir, PString(name))
+		if name == "olddir" {
+			child.ToDir()
+		} else {
+			child.KnownSize = PUInt64(0)
+		}
+		child.AttrTime = time.Now().Add(-time.Hour)
+		s.fs.insertInode(s.dir, child)
+	}
+	s.dir.dir.DirTime = time.Now()
+}
+
+func (s *ReconcileTest) TestReconcile(t *C) {
+	kept := s.dir.findChild("kept")
+	gone := s.dir.findChild("gone")
+
+	// created here, but not flushed yet
+	created, _ := s.dir.Create("created", fuseops.OpMetadata{})
+	created.AttrTime = time.Now().Add(-time.Hour)
+	s.fs.insertInode(s.dir, created)
+
+	s.fs.reconcileDir(s.dir, "test")
+
+	t.Assert(atomic.LoadUint64(&s.fs.reconciledDirs), Equals, uint64(1))
+	t.Assert(s.dir.findChild("kept"), Equals, kept)
+	t.Assert(s.dir.findChild("created"), Equals, created)
+	t.Assert(s.dir.findChild("olddir"), NotNil)
+	t.Assert(s.dir.findChild("gone"), IsNil)
+	t.Assert(gone.isStale(), Equals, true)
+	t.Assert(kept.isStale(), Equals, false)
+
+	t.Assert(s.dir.findChild("new"), NotNil)
+	t.Assert(s.dir.findChild("new").isDir(), Equals, false)
+	t.Assert(s.dir.findChild("newdir"), NotNil)
+	t.Assert(s.dir.findChild("newdir").isDir(), Equals, true)
+	t.Assert(s.dir.findChild("other").isDir(), Equals, true)
+
+	// the kernel has to look it up again
+	_, err := gone.OpenFile(fuseops.OpMetadata{})
+	t.Assert(err, Equals, syscall.ESTALE)
+}
+
+func (s *ReconcileTest) TestReconcileOnUnlink(t *C) {
+	// the listing doesn't have it anymore
+	_, err := s.cloud.DeleteBlob(&DeleteBlobInput{Key: "dir/olddir/y"})
+	t.Assert(err, IsNil)
+
+	t.Assert(s.dir.Unlink("gone"), IsNil)
+	for i := 0; atomic.LoadUint64(&s.fs.reconciledDirs) == 0; i++ {
+		if i == 100 {
+			t.Fatal("not reconciled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.dir.mu.RLock()
+	defer s.dir.mu.RUnlock()
+	t.Assert(s.dir.findChildUnlocked("olddir"), IsNil)
+	t.Assert(s.dir.findChildUnlocked("new"), NotNil)
+}
@@ -0,0 +1,398 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const DEFAULT_DELETE_CONCURRENCY = 8
+
+// multi-delete is capped to 1000 keys on aws
+const DELETE_BATCH_SIZE = 1000
+
+const REMOVE_PROGRESS_INTERVAL = time.Second
+
+type RemoveProgress struct {
+	Listed  uint64 `json:"listed"`
+	Deleted uint64 `json:"deleted"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+// treeRemover deletes everything under a prefix. Objects are deleted
+// a page at a time as the listing comes back, so nothing has to wait
+// for the whole tree to be listed. Directory blobs are held back
+// until all the objects are gone, and are deleted deepest first, so
+// stopping halfway never leaves a child without its parent
+type treeRemover struct {
+	fs    *Goofys
+	cloud StorageBackend
+	key   string
+	// the deepest cached directory on the way to key, and its key
+	base    *Inode
+	baseKey string
+
+	gate *Ticket
+	wg   sync.WaitGroup
+
+	listed  uint64
+	deleted uint64
+
+	mu   sync.Mutex
+	err  error
+	dirs []string
+}
+
+func newTreeRemover(fs *Goofys, base *Inode, path string) *treeRemover {
+	cloud, baseKey := base.cloud()
+
+	concurrency := fs.flags.DeleteConcurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_DELETE_CONCURRENCY
+	}
+
+	return &treeRemover{
+		fs:      fs,
+		cloud:   cloud,
+		key:     appendChildName(baseKey, path),
+		base:    base,
+		baseKey: baseKey,
+		gate:    Ticket{Total: uint32(concurrency)}.Init(),
+	}
+}
+
+func (r *treeRemover) Progress() RemoveProgress {
+	return RemoveProgress{
+		Listed:  atomic.LoadUint64(&r.listed),
+		Deleted: atomic.LoadUint64(&r.deleted),
+	}
+}
+
+func (r *treeRemover) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *treeRemover) getErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Stop makes the remover give up after the batches that are already
+// in flight
+func (r *treeRemover) Stop() {
+	r.setErr(syscall.EINTR)
+}
+
+func (r *treeRemover) Run() (err error) {
+	prefix := r.key + "/"
+	var token *string
+	sawMarker := false
+
+	for {
+		resp, listErr := r.cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if listErr != nil {
+			r.setErr(listErr)
+			break
+		}
+
+		batch := make([]string, 0, len(resp.Items))
+		for _, item := range resp.Items {
+			key := *item.Key
+			if strings.HasSuffix(key, "/") {
+				r.mu.Lock()
+				r.dirs = append(r.dirs, key)
+				r.mu.Unlock()
+				if key == prefix {
+					sawMarker = true
+				}
+			} else {
+				batch = append(batch, key)
+			}
+		}
+		atomic.AddUint64(&r.listed, uint64(len(resp.Items)))
+		putListItems(resp.Items)
+
+		r.deleteBatches(batch)
+
+		if !resp.IsTruncated || r.getErr() != nil {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+
+	r.wg.Wait()
+	if err = r.getErr(); err != nil {
+		return
+	}
+
+	if atomic.LoadUint64(&r.listed) == 0 {
+		return fuse.ENOENT
+	}
+
+	// deepest first, and a level is only started after the one
+	// below it is gone. ADLv1/ADLv2 refuse to delete a directory
+	// that's not empty
+	byDepth := make(map[int][]string)
+	depths := make([]int, 0)
+	for _, d := range r.dirs {
+		depth := strings.Count(d, "/")
+		if _, ok := byDepth[depth]; !ok {
+			depths = append(depths, depth)
+		}
+		byDepth[depth] = append(byDepth[depth], d)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(depths)))
+
+	for _, depth := range depths {
+		r.deleteBatches(byDepth[depth])
+		r.wg.Wait()
+		if err = r.getErr(); err != nil {
+			return
+		}
+	}
+
+	ticket := r.fs.events.reserve(prefix)
+	defer ticket.cancel()
+
+	if !sawMarker {
+		// hierarchical backends don't list the directory itself
+		_, err = r.cloud.DeleteBlob(&DeleteBlobInput{Key: prefix})
+		if err == fuse.ENOENT {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	r.forget(prefix, ticket)
+
+	return
+}
+
+// deleteBatches splits keys into multi-deletes and starts them, each
+// in its own goroutine, blocking while too many are in flight
+func (r *treeRemover) deleteBatches(keys []string) {
+	for len(keys) != 0 {
+		n := MinInt(len(keys), DELETE_BATCH_SIZE)
+		batch := keys[:n]
+		keys = keys[n:]
+
+		r.gate.Take(1, true)
+		if r.getErr() != nil {
+			r.gate.Return(1)
+			return
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer r.gate.Return(1)
+
+			// the ADL backends sort the batch in place
+			items := make([]string, len(batch))
+			copy(items, batch)
+
+			tickets := make([]*eventTicket, len(batch))
+			for i, key := range batch {
+				tickets[i] = r.fs.events.reserve(key)
+				defer tickets[i].cancel()
+			}
+
+			var failed map[string]error
+			_, err := r.cloud.DeleteBlobs(&DeleteBlobsInput{Items: items})
+			if partial, ok := err.(*DeleteBlobsError); ok {
+				// the rest are gone, the cache has to
+				// agree
+				s3Log.Errorf("DeleteBlobs %v...: %v", batch[0], err)
+				failed = partial.Failed
+				r.setErr(partial.Errno())
+			} else if err != nil {
+				s3Log.Errorf("DeleteBlobs %v...: %v", batch[0], err)
+				r.setErr(err)
+				return
+			}
+
+			atomic.AddUint64(&r.deleted, uint64(len(batch)-len(failed)))
+			for i, key := range batch {
+				if _, ok := failed[key]; !ok {
+					r.forget(key, tickets[i])
+				}
+			}
+		}()
+	}
+}
+
+// forget drops a deleted key from the cache, if we have it, so
+// readers see the tree shrink as it's being deleted
+func (r *treeRemover) forget(key string, ticket *eventTicket) {
+	ticket.publish(Event{Type: EVENT_UNLINK, Key: key})
+
+	path := strings.TrimSuffix(key, "/")
+	if r.baseKey != "" {
+		path = strings.TrimPrefix(path, r.baseKey+"/")
+	}
+
+	inode := r.base.findPath(path)
+	if inode == nil {
+		return
+	}
+	parent := inode.Parent
+	if parent == nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if parent.findChildUnlocked(*inode.Name) != inode {
+		return
+	}
+	if !inode.isDir() && inode.KnownSize != nil {
+		r.fs.quota.Credit(int64(*inode.KnownSize), 1)
+	}
+	parent.removeChildUnlocked(inode)
+	inode.Parent = nil
+	// what we have left of this directory is no longer the
+	// complete listing
+	parent.dir.DirTime = time.Time{}
+}
+
+// resolveRemovePath walks path down the cached tree as far as it
+// goes, and returns where it stopped and what's left of the path
+func resolveRemovePath(fs *Goofys, path string) (base *Inode, rest string, err error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, "", fmt.Errorf("refusing to remove the root")
+	}
+
+	base = fs.getInodeOrDie(fuseops.RootInodeID)
+	rest = path
+	for {
+		idx := strings.Index(rest, "/")
+		if idx == -1 {
+			break
+		}
+		child := base.findChild(rest[:idx])
+		if child == nil {
+			break
+		}
+		if !child.isDir() {
+			return nil, "", fuse.ENOTDIR
+		}
+		base = child
+		rest = rest[idx+1:]
+	}
+
+	if child := base.findChild(rest); child != nil && !child.isDir() {
+		return nil, "", fuse.ENOTDIR
+	}
+	return
+}
+
+// canRemove is whether uid:gid could have unlinked through the
+// mount, which needs write and search on the directories and every
+// directory has --dir-mode
+func (fs *Goofys) canRemove(uid uint32, gid uint32) bool {
+	if uid == 0 {
+		return true
+	}
+
+	perm := fs.flags.DirMode.Perm()
+	if uid == fs.flags.Uid {
+		perm >>= 6
+	} else if gid == fs.flags.Gid {
+		perm >>= 3
+	}
+	return perm&03 == 03
+}
+
+// controlRm deletes a directory and everything under it, which is
+// what `rm -rf` would do a file at a time. Progress is reported as a
+// json object every second, and hanging up stops the delete
+func controlRm(fs *Goofys, args []string, conn net.Conn) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rm <path>")
+	}
+
+	base, rest, err := resolveRemovePath(fs, args[0])
+	if err != nil {
+		return err
+	}
+	if base.readOnly() {
+		return syscall.EROFS
+	}
+	uid, gid, err := controlPeer(conn)
+	if err != nil {
+		return err
+	}
+	if !fs.canRemove(uid, gid) {
+		return syscall.EACCES
+	}
+
+	r := newTreeRemover(fs, base, rest)
+	log.Infof("removing %v recursively", r.key)
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run()
+	}()
+
+	ticker := time.NewTicker(REMOVE_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err = <-done:
+			progress := r.Progress()
+			log.Infof("removed %v objects under %v: %v",
+				progress.Deleted, r.key, err)
+			progress.Done = err == nil
+			return writeControlReply(conn, err, progress)
+		case <-ticker.C:
+			writeControlReply(conn, nil, r.Progress())
+		case <-closed:
+			r.Stop()
+			closed = nil
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// treeBackend behaves like ADLv1 in that it refuses to delete a
+// directory blob that still has children
+type treeBackend struct {
+	memBackend
+
+	inflight    int
+	maxInflight int
+	// fail the batch that has this key
+	fail string
+	// the rest of the batch is deleted, but not this key
+	denied     string
+	violations []string
+}
+
+// ListBlobs pages 1000 at a time like S3 does, the tests know where the
+// pages end
+func (b *treeBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	if param.MaxKeys == nil {
+		input := *param
+		input.MaxKeys = PUInt32(1000)
+		param = &input
+	}
+	return b.memBackend.ListBlobs(param)
+}
+
+func (b *treeBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	_, err := b.DeleteBlobs(&DeleteBlobsInput{Items: []string{param.Key}})
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteBlobOutput{}, nil
+}
+
+func (b *treeBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	for _, k := range param.Items {
+		if k == b.fail {
+			return nil, syscall.EIO
+		}
+	}
+
+	b.mu.Lock()
+	b.inflight++
+	b.maxInflight = MaxInt(b.maxInflight, b.inflight)
+	b.mu.Unlock()
+
+	// give the other batches a chance to overlap
+	time.Sleep(10 * time.Millisecond)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inflight--
+
+	failed := make(map[string]error)
+	for _, k := range param.Items {
+		if k == b.denied {
+			failed[k] = syscall.EACCES
+			continue
+		}
+		if _, ok := b.objects[k]; !ok {
+			return nil, fuse.ENOENT
+		}
+		if strings.HasSuffix(k, "/") {
+			for other := range b.objects {
+				if other != k && strings.HasPrefix(other, k) {
+					b.violations = append(b.violations, k)
+					break
+				}
+			}
+		}
+		delete(b.objects, k)
+	}
+	if len(failed) != 0 {
+		return nil, &DeleteBlobsError{Failed: failed}
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+type RemoveTest struct {
+	fs    *Goofys
+	cloud *treeBackend
+	dir   *Inode
+}
+
+var _ = Suite(&RemoveTest{})
+
+func (s *RemoveTest) SetUpTest(t *C) {
+	s.cloud = &treeBackend{}
+	s.cloud.add("keep", "tree/")
+	for d := 0; d < 3; d++ {
+		s.cloud.add(fmt.Sprintf("tree/dir%v/", d), fmt.Sprintf("tree/dir%v/sub/", d))
+		for i := 0; i < 1500; i++ {
+			s.cloud.add(fmt.Sprintf("tree/dir%v/sub/file%v", d, i))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		s.cloud.add(fmt.Sprintf("tree/file%v", i))
+	}
+
+	s.fs = newTestFs(s.cloud, &FlagStorage{DeleteConcurrency: 4})
+	s.dir = newTestDir(s.fs.testRoot(), "tree")
+
+	file := NewInode(s.fs, s.dir, PString("file0"))
+	s.fs.insertInode(s.dir, file)
+	s.dir.dir.DirTime = time.Now()
+}
+
+func (s *RemoveTest) TestRemoveTree(t *C) {
+	base, rest, err := resolveRemovePath(s.fs, "/tree/")
+	t.Assert(err, IsNil)
+	t.Assert(base, Equals, s.fs.getInodeOrDie(fuseops.RootInodeID))
+	t.Assert(rest, Equals, "tree")
+
+	r := newTreeRemover(s.fs, base, rest)
+	t.Assert(r.Run(), IsNil)
+
+	t.Assert(s.cloud.keys(), DeepEquals, []string{"keep"})
+	t.Assert(s.cloud.violations, IsNil)
+	t.Assert(s.cloud.maxInflight > 1, Equals, true)
+	t.Assert(s.cloud.maxInflight <= 4, Equals, true)
+	t.Assert(r.Progress(), Equals, RemoveProgress{Listed: 4517, Deleted: 4517})
+
+	// the cache forgot about all of it
+	t.Assert(s.dir.findChild("file0"), IsNil)
+	t.Assert(s.dir.dir.DirTime.IsZero(), Equals, true)
+	t.Assert(base.findChild("tree"), IsNil)
+
+	r = newTreeRemover(s.fs, base, rest)
+	t.Assert(r.Run(), Equals, fuse.ENOENT)
+}
+
+func (s *RemoveTest) TestRemoveTreeInterrupted(t *C) {
+	// this is the last key, so the first page is deleted
+	s.cloud.fail = "tree/dir1/sub/file999"
+
+	base, rest, err := resolveRemovePath(s.fs, "tree/dir1")
+	t.Assert(err, IsNil)
+	t.Assert(base, Equals, s.dir)
+	t.Assert(rest, Equals, "dir1")
+
+	r := newTreeRemover(s.fs, base, rest)
+	t.Assert(r.Run(), Equals, syscall.EIO)
+
+	// only files were deleted, every directory is still there
+	t.Assert(s.cloud.violations, IsNil)
+	t.Assert(s.cloud.get("tree/dir1/"), NotNil)
+	t.Assert(s.cloud.get("tree/dir1/sub/"), NotNil)
+	t.Assert(r.Progress(), Equals, RemoveProgress{Listed: 1502, Deleted: 998})
+	t.Assert(s.cloud.get("tree/dir0/sub/file0"), NotNil)
+
+	_, _, err = resolveRemovePath(s.fs, "tree/file0/x")
+	t.Assert(err, Equals, fuse.ENOTDIR)
+}
+
+func (s *RemoveTest) TestRemoveTreePartial(t *C) {
+	// on the last page, so everything else was sent
+	s.cloud.denied = "tree/file3"
+
+	base, rest, err := resolveRemovePath(s.fs, "tree")
+	t.Assert(err, IsNil)
+
+	r := newTreeRemover(s.fs, base, rest)
+	t.Assert(r.Run(), Equals, syscall.EACCES)
+
+	// the directories are left since one of them isn't empty
+	t.Assert(s.cloud.violations, IsNil)
+	t.Assert(s.cloud.get("tree/file3"), NotNil)
+	t.Assert(s.cloud.get("tree/file4"), IsNil)
+	t.Assert(s.cloud.get("tree/"), NotNil)
+	t.Assert(r.Progress(), Equals, RemoveProgress{Listed: 4517, Deleted: 4509})
+
+	// the rest of the batch was forgotten
+	t.Assert(s.dir.findChild("file0"), IsNil)
+	t.Assert(base.findChild("tree"), Equals, s.dir)
+}
+
+func (s *RemoveTest) TestADLv1DeleteRoots(t *C) {
+	roots := adlv1DeleteRoots([]string{
+		"dir1/", "dir1/file", "dir1/sub/", "dir1/sub/file",
+		"dir1-file", "dir2/file", "dir3/",
+	})
+	t.Assert(roots, DeepEquals, map[string]bool{
+		// everything under it goes with it
+		"dir1": true,
+		// "dir2" wasn't asked for
+		"dir1-file": false,
+		"dir2/file": false,
+		"dir3":      false,
+	})
+}
+
+func (s *RemoveTest) TestCanRemove(t *C) {
+	s.fs.flags.Uid = 1000
+	s.fs.flags.Gid = 1000
+	s.fs.flags.DirMode = 0755
+
+	t.Assert(s.fs.canRemove(0, 0), Equals, true)
+	t.Assert(s.fs.canRemove(1000, 2000), Equals, true)
+	t.Assert(s.fs.canRemove(2000, 1000), Equals, false)
+	t.Assert(s.fs.canRemove(2000, 2000), Equals, false)
+
+	s.fs.flags.DirMode = 0771
+	t.Assert(s.fs.canRemove(2000, 1000), Equals, true)
+	t.Assert(s.fs.canRemove(2000, 2000), Equals, false)
+}
+
+func (s *RemoveTest) TestBatchUnlink(t *C) {
+	b := NewBatchUnlinkBackend(s.cloud, s.fs.flags)
+
+	// what `rm -rf tree/dir0` sends, children first
+	keys := []string{"tree/dir0/sub/file0", "tree/dir0/sub/file1"}
+	for i := 2; i < 1500; i++ {
+		keys = append(keys, fmt.Sprintf("tree/dir0/sub/file%v", i))
+	}
+	keys = append(keys, "tree/dir0/sub/", "tree/dir0/")
+	for _, k := range keys {
+		_, err := b.DeleteBlob(&DeleteBlobInput{Key: k})
+		t.Assert(err, IsNil)
+	}
+
+	// a listing under it waits for all of them
+	resp, err := b.ListBlobs(&ListBlobsInput{Prefix: PString("tree/dir0/")})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 0)
+	t.Assert(s.cloud.violations, IsNil)
+	t.Assert(s.cloud.get("tree/dir1/"), NotNil)
+	// one batch was full, the rest went after it
+	t.Assert(s.cloud.maxInflight <= 2, Equals, true)
+}
+
+func (s *RemoveTest) TestBatchUnlinkFailed(t *C) {
+	s.cloud.denied = "tree/file3"
+	b := NewBatchUnlinkBackend(s.cloud, s.fs.flags)
+
+	for i := 0; i < 10; i++ {
+		_, err := b.DeleteBlob(&DeleteBlobInput{Key: fmt.Sprintf("tree/file%v", i)})
+		t.Assert(err, IsNil)
+	}
+	b.waitFor(PString("tree/file"))
+
+	// it's still there, so rmdir finds it
+	t.Assert(s.cloud.get("tree/file3"), NotNil)
+	t.Assert(s.cloud.get("tree/file4"), IsNil)
+	t.Assert(b.pending, HasLen, 0)
+	t.Assert(b.deleted, Equals, uint64(9))
+
+	// and the next unlink finds out, without deleting anything
+	_, err := b.DeleteBlob(&DeleteBlobInput{Key: "tree/file10"})
+	t.Assert(err, Equals, syscall.EACCES)
+	t.Assert(b.pending, HasLen, 0)
+	_, err = b.DeleteBlob(&DeleteBlobInput{Key: "tree/file10"})
+	t.Assert(err, IsNil)
+	b.Close()
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// renameBackend is a memBackend that lists 1000 keys a page, and
+// counts the copies and deletes of a directory rename
+type renameBackend struct {
+	memBackend
+	failCopy string
+
+	inFlight    int
+	maxInFlight int
+	copied      map[string]string
+	deleted     []string
+	deletes     int
+}
+
+func (b *renameBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	param.MaxKeys = PUInt32(1000)
+	return b.memBackend.ListBlobs(param)
+}
+
+func (b *renameBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight--
+	if param.Source == b.failCopy {
+		return nil, syscall.EIO
+	}
+	b.copied[param.Source] = param.Destination
+	return &CopyBlobOutput{}, nil
+}
+
+func (b *renameBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deletes++
+	b.deleted = append(b.deleted, param.Items...)
+	return &DeleteBlobsOutput{}, nil
+}
+
+type RenameTest struct {
+	cloud *renameBackend
+	dir   *Inode
+}
+
+var _ = Suite(&RenameTest{})
+
+func (s *RenameTest) SetUpTest(t *C) {
+	s.cloud = &renameBackend{copied: make(map[string]string)}
+	for i := 0; i < 2500; i++ {
+		s.cloud.add(fmt.Sprintf("dir/%04d", i))
+	}
+	s.dir = newTestInode(s.cloud)
+	s.dir.fs.flags.RenameParallelism = 5
+}
+
+func (s *RenameTest) TestRenameChildren(t *C) {
+	t.Assert(s.dir.renameChildren(nil, s.cloud, "dir/", s.dir, "new/"), IsNil)
+
+	t.Assert(s.cloud.copied, HasLen, 2500)
+	t.Assert(s.cloud.copied["dir/1234"], Equals, "new/1234")
+	t.Assert(s.cloud.deleted, HasLen, 2500)
+	// a page at a time
+	t.Assert(s.cloud.deletes, Equals, 3)
+	t.Assert(s.cloud.maxInFlight > 1, Equals, true)
+	t.Assert(s.cloud.maxInFlight <= 5, Equals, true)
+}
+
+func (s *RenameTest) TestRenameChildrenFails(t *C) {
+	s.cloud.failCopy = "dir/1500"
+
+	t.Assert(s.dir.renameChildren(nil, s.cloud, "dir/", s.dir, "new/"), Equals, syscall.EIO)
+
+	// the first page is moved, the second stopped early and what
+	// made it is moved too
+	copied := len(s.cloud.copied)
+	t.Assert(copied >= 1500, Equals, true)
+	t.Assert(copied < 2000, Equals, true)
+	t.Assert(s.cloud.deleted, HasLen, copied)
+	t.Assert(s.cloud.deletes, Equals, 2)
+	for _, key := range s.cloud.deleted {
+		_, ok := s.cloud.copied[key]
+		t.Assert(ok, Equals, true)
+	}
+}
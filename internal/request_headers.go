@@ -0,0 +1,40 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Some S3-compatible stores sit behind a gateway that wants a tenant
+// or routing header on every request. --request-header adds them to
+// the requests of every backend: S3 adds them before signing so
+// they're signed like the rest, ADLv1 and ADLv2 with the request id,
+// and azblob and WebHDFS right before sending. Azure doesn't sign
+// them, x-ms-* ones would break its signature
+
+// setRequestHeaders adds the --request-header headers to h
+func setRequestHeaders(h http.Header, headers map[string]string) {
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+}
+
+// addRequestHeaders is a Build handler for --request-header
+func (s *S3Backend) addRequestHeaders(req *request.Request) {
+	setRequestHeaders(req.HTTPRequest.Header, s.flags.RequestHeaders)
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+type RequestHeadersTest struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+var _ = Suite(&RequestHeadersTest{})
+
+func (s *RequestHeadersTest) SetUpTest(t *C) {
+	s.requests = nil
+	s.bodies = nil
+	s.server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			s.mu.Lock()
+			s.requests = append(s.requests, r)
+			s.bodies = append(s.bodies, body)
+			s.mu.Unlock()
+
+			w.Header().Set("ETag", "\"etag\"")
+			if r.Method == "HEAD" {
+				w.Header().Set("Content-Length", "5")
+			}
+		}))
+}
+
+func (s *RequestHeadersTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *RequestHeadersTest) newS3(t *C, flags *FlagStorage, config *S3Config) *S3Backend {
+	flags.Endpoint = s.server.URL
+	config.Region = "us-east-1"
+	config.AccessKey = "access"
+	config.SecretKey = "secret"
+
+	cloud, err := NewS3("bucket", flags, config)
+	t.Assert(err, IsNil)
+	cloud.awsConfig.MaxRetries = aws.Int(0)
+	cloud.awsConfig.HTTPClient = s.server.Client()
+	cloud.newS3()
+	return cloud
+}
+
+func (s *RequestHeadersTest) TestS3(t *C) {
+	cloud := s.newS3(t, &FlagStorage{
+		RequestHeaders: map[string]string{"X-Tenant": "tenant"},
+	}, &S3Config{})
+
+	_, err := cloud.HeadBlob(&HeadBlobInput{Key: "a"})
+	t.Assert(err, IsNil)
+	_, err = cloud.PutBlob(&PutBlobInput{
+		Key:  "a",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+
+	t.Assert(s.requests, HasLen, 2)
+	for _, r := range s.requests {
+		t.Assert(r.Header.Get("X-Tenant"), Equals, "tenant")
+		// it's signed like the rest
+		t.Assert(strings.Contains(r.Header.Get("Authorization"), "x-tenant"),
+			Equals, true)
+	}
+}
+
+// the sdk signs the payload hash and sends the Content-Length, which
+// is what stores that don't take streaming signatures want
+func (s *RequestHeadersTest) TestPayloadSigned(t *C) {
+	cloud := s.newS3(t, &FlagStorage{}, &S3Config{})
+
+	_, err := cloud.PutBlob(&PutBlobInput{
+		Key:  "a",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	t.Assert(err, IsNil)
+	_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit: &MultipartBlobCommitInput{
+			Key:      PString("b"),
+			UploadId: PString("upload"),
+			Parts:    make([]*string, 1),
+		},
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("world")),
+		Size:       5,
+	})
+	t.Assert(err, IsNil)
+
+	t.Assert(s.requests, HasLen, 2)
+	for i, r := range s.requests {
+		hash := sha256.Sum256(s.bodies[i])
+		t.Assert(r.Header.Get("X-Amz-Content-Sha256"), Equals,
+			hex.EncodeToString(hash[:]))
+		t.Assert(r.ContentLength, Equals, int64(5))
+		t.Assert(r.TransferEncoding, HasLen, 0)
+	}
+}
+
+func (s *RequestHeadersTest) TestAzBlob(t *C) {
+	cloud, err := NewAZBlob("container", &AZBlobConfig{
+		Endpoint:    s.server.URL,
+		AccountName: "account",
+		AccountKey:  "a2V5",
+		HTTPClient:  s.server.Client(),
+		RequestHeaders: map[string]string{
+			"X-Tenant": "tenant",
+		},
+	})
+	t.Assert(err, IsNil)
+
+	cloud.HeadBlob(&HeadBlobInput{Key: "a"})
+	t.Assert(len(s.requests) > 0, Equals, true)
+	for _, r := range s.requests {
+		t.Assert(r.Header.Get("X-Tenant"), Equals, "tenant")
+	}
+}
+
+func (s *RequestHeadersTest) TestFlag(t *C) {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run([]string{"goofys", "--request-header", "X-Tenant=a=b",
+		"--request-header", "X-Route=east", "bucket", "/mnt"})
+	t.Assert(flags, NotNil)
+	t.Assert(flags.RequestHeaders, DeepEquals, map[string]string{
+		"X-Tenant": "a=b",
+		"X-Route":  "east",
+	})
+
+	flags = nil
+	app.Run([]string{"goofys", "--request-header", "X-Tenant", "bucket", "/mnt"})
+	t.Assert(flags, IsNil)
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "gopkg.in/check.v1"
+)
+
+type RequesterPaysTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+
+	mu       sync.Mutex
+	requests map[string][]string
+}
+
+var _ = Suite(&RequesterPaysTest{})
+
+func (s *RequesterPaysTest) SetUpTest(t *C) {
+	s.requests = make(map[string][]string)
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+
+			s.mu.Lock()
+			s.requests[r.Method] = append(s.requests[r.Method],
+				r.Header.Get("x-amz-request-payer"))
+			s.mu.Unlock()
+
+			if r.Header.Get("x-amz-request-payer") != "requester" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("X-Amz-Bucket-Region", "us-west-2")
+			w.Header().Set("ETag", "\"etag\"")
+			if r.Method == "HEAD" {
+				// nothing is written, so it's not sent
+				// unless we do
+				w.Header().Set("Content-Length", "0")
+			}
+			if _, ok := r.URL.Query()["uploads"]; ok {
+				io.WriteString(w, "<InitiateMultipartUploadResult>"+
+					"<UploadId>upload</UploadId>"+
+					"</InitiateMultipartUploadResult>")
+			} else if _, ok := r.URL.Query()["prefix"]; ok {
+				io.WriteString(w, "<ListBucketResult>"+
+					"<IsTruncated>false</IsTruncated>"+
+					"</ListBucketResult>")
+			}
+		}))
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, &S3Config{
+		Region:        "us-east-1",
+		AccessKey:     "access",
+		SecretKey:     "secret",
+		RequesterPays: true,
+	})
+	t.Assert(err, IsNil)
+	// the mock server isn't worth retrying
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.newS3()
+}
+
+func (s *RequesterPaysTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *RequesterPaysTest) assertAllPaid(t *C, methods ...string) {
+	for _, m := range methods {
+		t.Assert(len(s.requests[m]) > 0, Equals, true, Commentf("no %v", m))
+	}
+	for m, payers := range s.requests {
+		for _, p := range payers {
+			t.Assert(p, Equals, "requester", Commentf("%v", m))
+		}
+	}
+}
+
+func (s *RequesterPaysTest) TestDetectRegion(t *C) {
+	err, _ := s.s3.detectBucketLocationByHEAD()
+	t.Assert(err, IsNil)
+	t.Assert(*s.s3.awsConfig.Region, Equals, "us-west-2")
+	s.assertAllPaid(t, "HEAD")
+}
+
+func (s *RequesterPaysTest) TestEveryRequest(t *C) {
+	// we only care about what's sent, some of the responses won't
+	// parse
+	s.s3.HeadBlob(&HeadBlobInput{Key: "file"})
+	s.s3.GetBlob(&GetBlobInput{Key: "file"})
+	s.s3.ListBlobs(&ListBlobsInput{Prefix: PString("dir/")})
+	s.s3.PutBlob(&PutBlobInput{
+		Key:  "file",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	s.s3.DeleteBlob(&DeleteBlobInput{Key: "file"})
+
+	commit, err := s.s3.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "mpu"})
+	t.Assert(err, IsNil)
+	_, err = s.s3.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("part")),
+		Size:       4,
+	})
+	t.Assert(err, IsNil)
+	s.s3.MultipartBlobCommit(commit)
+	s.s3.MultipartBlobAbort(commit)
+
+	s.assertAllPaid(t, "HEAD", "GET", "PUT", "POST", "DELETE")
+	// begin and commit
+	t.Assert(len(s.requests["POST"]), Equals, 2)
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"math/rand"
+	"time"
+)
+
+// the backoff before the first retry of a part, it doubles with every
+// retry up to PART_RETRY_MAX_BACKOFF
+const PART_RETRY_BACKOFF = 200 * time.Millisecond
+const PART_RETRY_MAX_BACKOFF = 10 * time.Second
+
+// partRetryBackoff is how long to wait before the retry after the
+// given one. It's a random time up to the exponential backoff, parts
+// that were throttled together shouldn't all come back together
+func partRetryBackoff(attempt int) time.Duration {
+	backoff := PART_RETRY_BACKOFF << uint(attempt)
+	if attempt >= 16 || backoff > PART_RETRY_MAX_BACKOFF {
+		backoff = PART_RETRY_MAX_BACKOFF
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// retryPart calls send to upload a part, and again up to maxRetries
+// more times for as long as it says the failure is worth retrying,
+// which is the server being busy or broken, or a timeout. body is
+// rewound to where it was before every retry. If we still fail, it's
+// with the last error
+func retryPart(log *LogHandle, key string, part uint32, body io.ReadSeeker,
+	maxRetries int, send func() (retryable bool, err error)) (err error) {
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		retryable, err = send()
+		if err == nil || !retryable {
+			return
+		}
+		if attempt > maxRetries {
+			log.Errorf("%v part %v failed after %v attempts: %v", key, part, attempt, err)
+			return
+		}
+
+		backoff := partRetryBackoff(attempt - 1)
+		log.Debugf("%v part %v attempt %v failed, retrying in %v: %v",
+			key, part, attempt, backoff, err)
+		time.Sleep(backoff)
+
+		_, seekErr := body.Seek(start, io.SeekStart)
+		if seekErr != nil {
+			return seekErr
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetryTest struct {
+	body  *bytes.Reader
+	sent  []string
+	fails int
+}
+
+var _ = Suite(&RetryTest{})
+
+func (s *RetryTest) SetUpTest(t *C) {
+	s.body = bytes.NewReader([]byte("headpart"))
+	// the part starts after what was before it
+	s.body.Seek(4, io.SeekStart)
+	s.sent = nil
+	s.fails = 0
+}
+
+// send reads the whole part, and fails with err the first fails times
+func (s *RetryTest) send(err error, retryable bool) func() (bool, error) {
+	return func() (bool, error) {
+		data, _ := ioutil.ReadAll(s.body)
+		s.sent = append(s.sent, string(data))
+		if len(s.sent) <= s.fails {
+			return retryable, err
+		}
+		return false, nil
+	}
+}
+
+func (s *RetryTest) TestRetried(t *C) {
+	s.fails = 2
+	err := retryPart(log, "key", 1, s.body, 2, s.send(syscall.EAGAIN, true))
+	t.Assert(err, IsNil)
+	t.Assert(s.sent, DeepEquals, []string{"part", "part", "part"})
+}
+
+func (s *RetryTest) TestGiveUp(t *C) {
+	s.fails = 3
+	err := retryPart(log, "key", 1, s.body, 2, s.send(syscall.EAGAIN, true))
+	t.Assert(err, Equals, syscall.EAGAIN)
+	t.Assert(len(s.sent), Equals, 3)
+
+	s.SetUpTest(t)
+	s.fails = 1
+	err = retryPart(log, "key", 1, s.body, 0, s.send(syscall.EAGAIN, true))
+	t.Assert(err, Equals, syscall.EAGAIN)
+	t.Assert(len(s.sent), Equals, 1)
+}
+
+func (s *RetryTest) TestNotRetryable(t *C) {
+	s.fails = 1
+	err := retryPart(log, "key", 1, s.body, 2, s.send(syscall.EACCES, false))
+	t.Assert(err, Equals, syscall.EACCES)
+	t.Assert(len(s.sent), Equals, 1)
+}
+
+func (s *RetryTest) TestBackoff(t *C) {
+	for i := 0; i < 100; i++ {
+		t.Assert(partRetryBackoff(0) < PART_RETRY_BACKOFF, Equals, true)
+		t.Assert(partRetryBackoff(2) < 4*PART_RETRY_BACKOFF, Equals, true)
+		t.Assert(partRetryBackoff(100) < PART_RETRY_MAX_BACKOFF, Equals, true)
+	}
+}
+
+func (s *RetryTest) TestADLv2Retryable(t *C) {
+	t.Assert(adl2Retryable(nil, nil), Equals, false)
+	t.Assert(adl2Retryable(nil, syscall.EAGAIN), Equals, true)
+	t.Assert(adl2Retryable(&http.Response{StatusCode: 503}, syscall.EINVAL), Equals, true)
+	t.Assert(adl2Retryable(&http.Response{StatusCode: 500}, syscall.EAGAIN), Equals, true)
+	t.Assert(adl2Retryable(&http.Response{StatusCode: 403}, syscall.EACCES), Equals, false)
+}
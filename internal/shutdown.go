@@ -0,0 +1,93 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Shutdown stops the mount without losing what was written to it:
+// writes fail with EROFS from now on, every open file is flushed, and
+// the uploads of those that aren't done when ctx is, are aborted so
+// they don't leave parts behind. Then it unmounts
+func (fs *Goofys) Shutdown(ctx context.Context) error {
+	drainErr := fs.drain(ctx)
+	if drainErr != nil {
+		log.Errorf("Shutdown: %v", drainErr)
+	}
+
+	err := TryUnmount(fs.flags.MountPoint)
+	if err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// drain is the part of Shutdown before unmounting
+func (fs *Goofys) drain(ctx context.Context) error {
+	atomic.StoreInt32(&fs.draining, 1)
+
+	// the kernel may release a handle while we flush it, like
+	// with flushAbandonable that waits for flushWG
+	fs.mu.RLock()
+	handles := make([]*FileHandle, 0, len(fs.fileHandles))
+	for _, fh := range fs.fileHandles {
+		fh.flushWG.Add(1)
+		atomic.StoreInt32(&fh.flushAbandoned, 1)
+		handles = append(handles, fh)
+	}
+	fs.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	var failed int32
+	for _, fh := range handles {
+		wg.Add(1)
+		go func(fh *FileHandle) {
+			defer wg.Done()
+			defer fh.flushWG.Done()
+
+			// the ones with nothing to write return right away
+			err := fh.FlushFile()
+			if err != nil {
+				log.Errorf("flushing %v on shutdown: %v",
+					*fh.inode.FullName(), err)
+				atomic.AddInt32(&failed, 1)
+			}
+		}(fh)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		aborted := fs.liveUploads.AbortAll()
+		return fmt.Errorf("flushes didn't finish in time, aborted %v uploads",
+			aborted)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%v of %v open files failed to flush", failed,
+			len(handles))
+	}
+	return nil
+}
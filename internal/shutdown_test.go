@@ -0,0 +1,100 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+// uploadIdBackend is a slowBackend whose uploads have ids, so that
+// they are live uploads
+type uploadIdBackend struct {
+	slowBackend
+}
+
+func (b *uploadIdBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	mpu, err := b.slowBackend.MultipartBlobBegin(param)
+	if err == nil {
+		mpu.UploadId = PString("upload")
+	}
+	return mpu, err
+}
+
+type ShutdownTest struct {
+	cloud *uploadIdBackend
+}
+
+var _ = Suite(&ShutdownTest{})
+
+func (s *ShutdownTest) SetUpTest(t *C) {
+	s.cloud = &uploadIdBackend{}
+}
+
+func (s *ShutdownTest) open(fs *Goofys) *FileHandle {
+	fh := NewFileHandle(newTestInode(s.cloud), fuseops.OpMetadata{})
+	fh.inode.fs = fs
+	fs.fileHandles[fuseops.HandleID(len(fs.fileHandles))] = fh
+	return fh
+}
+
+func (s *ShutdownTest) newFS() *Goofys {
+	fs := newTestInode(s.cloud).fs
+	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
+	return fs
+}
+
+func (s *ShutdownTest) TestDrain(t *C) {
+	fs := s.newFS()
+	small := s.open(fs)
+	big := s.open(fs)
+	idle := s.open(fs)
+
+	t.Assert(writeTestFile(small, 1024), IsNil)
+	t.Assert(writeTestFile(big, 12*1024*1024), IsNil)
+	t.Assert(small.inode.readOnly(), Equals, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	t.Assert(fs.drain(ctx), IsNil)
+
+	t.Assert(s.cloud.puts, Equals, 1)
+	t.Assert(s.cloud.committed, Equals, 1)
+	t.Assert(s.cloud.aborted, Equals, 0)
+	t.Assert(fs.liveUploads.Len(), Equals, 0)
+	// and nothing more can be written
+	t.Assert(idle.inode.readOnly(), Equals, true)
+}
+
+func (s *ShutdownTest) TestDrainTimeout(t *C) {
+	fs := s.newFS()
+	fh := s.open(fs)
+	t.Assert(writeTestFile(fh, 12*1024*1024), IsNil)
+	t.Assert(s.cloud.waitFor(&s.cloud.begun, 1), Equals, true)
+	s.cloud.latency = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	t.Assert(fs.drain(ctx), ErrorMatches, ".*aborted 1 uploads")
+	t.Assert(s.cloud.aborted, Equals, 1)
+	t.Assert(fs.liveUploads.Len(), Equals, 0)
+
+	// the flush is still going, it's waited for before the handle
+	// is let go
+	fh.flushWG.Wait()
+}
@@ -0,0 +1,375 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+const SNAPSHOT_DIR = ".snapshots"
+const SNAPSHOT_TIME_FORMAT = "2006-01-02T15:04"
+
+// forget resolved versions once we've accumulated this many
+const SNAPSHOT_CACHE_SIZE = 100000
+
+// SnapshotBackend presents a versioned bucket as it was at different
+// points in time. Keys look like 2024-05-01T00:00/path/to/file. The
+// top level is generated from the granularity and count without
+// talking to the bucket, anything below that is resolved by listing
+// versions and picking the newest version that's not newer than the
+// snapshot time. Any timestamp can be looked up, not just the listed
+// ones.
+//
+// Directories are listed from the version history so a directory that
+// only came into existence after the snapshot time shows up empty.
+type SnapshotBackend struct {
+	cloud       StorageBackend
+	prefix      string
+	granularity time.Duration
+	count       int
+	cap         Capabilities
+
+	mu sync.Mutex
+	// snapshot key -> the version it resolved to. A snapshot
+	// never changes so there's no need to expire these
+	versions map[string]BlobVersionOutput
+}
+
+func NewSnapshotBackend(cloud StorageBackend, prefix string,
+	granularity time.Duration, count int) *SnapshotBackend {
+
+	return &SnapshotBackend{
+		cloud:       cloud,
+		prefix:      prefix,
+		granularity: granularity,
+		count:       count,
+		cap: Capabilities{
+			Name:     "snapshot",
+			ReadOnly: true,
+		},
+		versions: make(map[string]BlobVersionOutput),
+	}
+}
+
+func (fs *Goofys) mountSnapshots(cloud StorageBackend, prefix string) {
+	// make sure we can actually list versions, otherwise every
+	// snapshot would just be empty
+	_, err := cloud.ListBlobVersions(&ListBlobVersionsInput{
+		Prefix:  &prefix,
+		MaxKeys: PUInt32(1),
+	})
+	if err != nil {
+		log.Errorf("Unable to list versions, not mounting %v: %v", SNAPSHOT_DIR, err)
+		return
+	}
+
+	fs.Mount(&Mount{
+		name: SNAPSHOT_DIR,
+		cloud: NewSnapshotBackend(cloud, prefix,
+			fs.flags.SnapshotGranularity, fs.flags.SnapshotCount),
+	})
+}
+
+// snapshotTimes returns the most recent count snapshot times, oldest
+// first
+func snapshotTimes(now time.Time, granularity time.Duration, count int) []time.Time {
+	latest := now.UTC().Truncate(granularity)
+	times := make([]time.Time, count)
+	for i := 0; i < count; i++ {
+		times[count-1-i] = latest.Add(-time.Duration(i) * granularity)
+	}
+	return times
+}
+
+// parseSnapshotKey splits 2024-05-01T00:00/a/b into the snapshot time
+// and a/b. dir is true if there was a / after the time
+func parseSnapshotKey(key string) (t time.Time, rest string, dir bool, err error) {
+	ts := key
+	if slash := strings.Index(key, "/"); slash != -1 {
+		ts = key[:slash]
+		rest = key[slash+1:]
+		dir = true
+	}
+
+	t, err = time.ParseInLocation(SNAPSHOT_TIME_FORMAT, ts, time.UTC)
+	if err != nil {
+		err = fuse.ENOENT
+	}
+	return
+}
+
+func (s *SnapshotBackend) remember(key string, v *BlobVersionOutput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.versions) >= SNAPSHOT_CACHE_SIZE {
+		s.versions = make(map[string]BlobVersionOutput)
+	}
+	s.versions[key] = *v
+}
+
+func (s *SnapshotBackend) recall(key string) (v BlobVersionOutput, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok = s.versions[key]
+	return
+}
+
+// resolve finds the version of key that was current at t. key is the
+// full key in the underlying bucket
+func (s *SnapshotBackend) resolve(t time.Time, key string) (*BlobVersionOutput, error) {
+	versions, err := versionsOf(s.cloud, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range versions {
+		if v.LastModified.After(t) {
+			continue
+		}
+		if v.IsDeleteMarker {
+			return nil, fuse.ENOENT
+		}
+		return &versions[i], nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (s *SnapshotBackend) lookup(key string) (t time.Time, v *BlobVersionOutput, err error) {
+	t, rest, dir, err := parseSnapshotKey(key)
+	if err != nil {
+		return
+	}
+	if !dir || rest == "" {
+		err = fuse.ENOENT
+		return
+	}
+
+	if cached, ok := s.recall(key); ok {
+		v = &cached
+		return
+	}
+
+	v, err = s.resolve(t, s.prefix+rest)
+	if err != nil {
+		return
+	}
+	s.remember(key, v)
+	return
+}
+
+func (s *SnapshotBackend) Init(key string) error {
+	return nil
+}
+
+func (s *SnapshotBackend) Capabilities() *Capabilities {
+	return &s.cap
+}
+
+func (s *SnapshotBackend) Bucket() string {
+	return s.cloud.Bucket()
+}
+
+func (s *SnapshotBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	t, rest, dir, err := parseSnapshotKey(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir && rest == "" {
+		// the snapshot itself
+		return &HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          &param.Key,
+				LastModified: &t,
+			},
+			IsDirBlob: true,
+		}, nil
+	}
+
+	_, v, err := s.lookup(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	item := v.BlobItemOutput
+	item.Key = &param.Key
+	return &HeadBlobOutput{
+		BlobItemOutput: item,
+		IsDirBlob:      strings.HasSuffix(param.Key, "/"),
+	}, nil
+}
+
+func (s *SnapshotBackend) listSnapshots() *ListBlobsOutput {
+	var prefixes []BlobPrefixOutput
+	for _, t := range snapshotTimes(time.Now(), s.granularity, s.count) {
+		prefixes = append(prefixes, BlobPrefixOutput{
+			Prefix: PString(t.Format(SNAPSHOT_TIME_FORMAT) + "/"),
+		})
+	}
+	return &ListBlobsOutput{
+		Prefixes: prefixes,
+	}
+}
+
+func (s *SnapshotBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var prefix, startAfter string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	if param.StartAfter != nil {
+		startAfter = *param.StartAfter
+	}
+
+	var ts string
+	if prefix != "" {
+		ts = prefix
+	} else if param.Delimiter != nil {
+		return s.listSnapshots(), nil
+	} else if startAfter != "" {
+		// slurping everything under a snapshot
+		ts = startAfter
+	} else {
+		// we don't want to list all the snapshots recursively
+		return nil, syscall.ENOTSUP
+	}
+
+	t, rest, _, err := parseSnapshotKey(ts)
+	if err != nil {
+		return nil, err
+	}
+	tsPrefix := t.Format(SNAPSHOT_TIME_FORMAT) + "/"
+
+	params := &ListBlobVersionsInput{
+		Delimiter: param.Delimiter,
+	}
+	if prefix != "" {
+		params.Prefix = PString(s.prefix + rest)
+	} else {
+		params.Prefix = PString(s.prefix)
+	}
+	if strings.HasPrefix(startAfter, tsPrefix) && len(startAfter) > len(tsPrefix) {
+		params.KeyMarker = PString(s.prefix + startAfter[len(tsPrefix):])
+	}
+
+	return listVersions(s.cloud, params, param.ContinuationToken,
+		func(out *ListBlobsOutput, p *BlobPrefixOutput) {
+			out.Prefixes = append(out.Prefixes, BlobPrefixOutput{
+				Prefix: PString(tsPrefix + (*p.Prefix)[len(s.prefix):]),
+			})
+		},
+		func(out *ListBlobsOutput, v *BlobVersionOutput) bool {
+			if v.LastModified.After(t) {
+				return false
+			}
+			// versions are newest first, so this is the
+			// one at time t
+			if !v.IsDeleteMarker {
+				item := v.BlobItemOutput
+				item.Key = PString(tsPrefix + (*v.Key)[len(s.prefix):])
+				out.Items = append(out.Items, item)
+				s.remember(*item.Key, v)
+			}
+			return true
+		})
+}
+
+func (s *SnapshotBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (s *SnapshotBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	_, v, err := s.lookup(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.cloud.GetBlob(&GetBlobInput{
+		Key:       *v.Key,
+		Start:     param.Start,
+		Count:     param.Count,
+		IfMatch:   param.IfMatch,
+		VersionId: v.VersionId,
+		Context:   param.Context,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Key = &param.Key
+	return resp, nil
+}
+
+func (s *SnapshotBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return &MultipartExpireOutput{}, nil
+}
+
+func (s *SnapshotBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *SnapshotBackend) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	return nil, syscall.ENOTSUP
+}
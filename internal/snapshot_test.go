@@ -0,0 +1,388 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+// versionedBackend lists versions from memory, pageSize at a time
+type versionedBackend struct {
+	memBackend
+	versions []BlobVersionOutput
+	pageSize int
+	lists    int
+}
+
+func (b *versionedBackend) add(key string, t time.Time, id string, deleted bool) {
+	b.versions = append(b.versions, BlobVersionOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          PString(key),
+			LastModified: PTime(t),
+			Size:         uint64(len(id)),
+		},
+		VersionId:      PString(id),
+		IsDeleteMarker: deleted,
+	})
+	sort.Stable(sortBlobVersionOutput(b.versions))
+}
+
+func (b *versionedBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	b.lists++
+	out := &ListBlobVersionsOutput{}
+	seenPrefix := make(map[string]bool)
+	skipping := param.KeyMarker != nil
+	var last *BlobVersionOutput
+
+	for i, v := range b.versions {
+		key := *v.Key
+		if skipping {
+			if key < *param.KeyMarker {
+				continue
+			} else if key == *param.KeyMarker {
+				if param.VersionIdMarker == nil {
+					continue
+				} else if *v.VersionId == *param.VersionIdMarker {
+					skipping = false
+					continue
+				} else {
+					continue
+				}
+			}
+			skipping = false
+		}
+		if param.Prefix != nil && !strings.HasPrefix(key, *param.Prefix) {
+			continue
+		}
+
+		if len(out.Versions)+len(out.Prefixes) == b.pageSize {
+			out.IsTruncated = true
+			out.NextKeyMarker = last.Key
+			out.NextVersionIdMarker = last.VersionId
+			break
+		}
+
+		if param.Delimiter != nil {
+			rest := key[len(*param.Prefix):]
+			if slash := strings.Index(rest, "/"); slash != -1 {
+				p := (*param.Prefix) + rest[:slash+1]
+				if !seenPrefix[p] {
+					seenPrefix[p] = true
+					out.Prefixes = append(out.Prefixes, BlobPrefixOutput{Prefix: PString(p)})
+				}
+				continue
+			}
+		}
+		out.Versions = append(out.Versions, v)
+		last = &b.versions[i]
+	}
+	return out, nil
+}
+
+func (b *versionedBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	for _, v := range b.versions {
+		if *v.Key == param.Key && *v.VersionId == *param.VersionId {
+			return &GetBlobOutput{
+				HeadBlobOutput: HeadBlobOutput{BlobItemOutput: v.BlobItemOutput},
+				Body:           ioutil.NopCloser(strings.NewReader(*v.VersionId)),
+			}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+type SnapshotTest struct {
+	cloud *versionedBackend
+	snap  *SnapshotBackend
+	t0    time.Time
+}
+
+var _ = Suite(&SnapshotTest{})
+
+func (s *SnapshotTest) SetUpTest(t *C) {
+	s.t0 = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	s.cloud = &versionedBackend{pageSize: 1000}
+	s.snap = NewSnapshotBackend(s.cloud, "prefix/", 24*time.Hour, 3)
+
+	day := 24 * time.Hour
+	// a: v1 on day 0, v2 on day 1, deleted on day 2
+	s.cloud.add("prefix/a", s.t0.Add(-time.Hour), "a1", false)
+	s.cloud.add("prefix/a", s.t0.Add(day-time.Hour), "a2", false)
+	s.cloud.add("prefix/a", s.t0.Add(2*day-time.Hour), "a3", true)
+	// b only exists from day 1
+	s.cloud.add("prefix/b", s.t0.Add(day-time.Hour), "b1", false)
+	s.cloud.add("prefix/dir/c", s.t0.Add(-time.Hour), "c1", false)
+	// outside of the mount prefix
+	s.cloud.add("other", s.t0.Add(-time.Hour), "o1", false)
+}
+
+func (s *SnapshotTest) TestSnapshotTimes(t *C) {
+	now := time.Date(2024, 5, 3, 13, 14, 0, 0, time.UTC)
+	times := snapshotTimes(now, 24*time.Hour, 3)
+	t.Assert(times, HasLen, 3)
+	t.Assert(times[0].Format(SNAPSHOT_TIME_FORMAT), Equals, "2024-05-01T00:00")
+	t.Assert(times[2].Format(SNAPSHOT_TIME_FORMAT), Equals, "2024-05-03T00:00")
+
+	times = snapshotTimes(now, time.Hour, 2)
+	t.Assert(times[0].Format(SNAPSHOT_TIME_FORMAT), Equals, "2024-05-03T12:00")
+	t.Assert(times[1].Format(SNAPSHOT_TIME_FORMAT), Equals, "2024-05-03T13:00")
+
+	_, _, _, err := parseSnapshotKey("yesterday/a")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	ts, rest, dir, err := parseSnapshotKey("2024-05-01T00:00/a/b")
+	t.Assert(err, IsNil)
+	t.Assert(ts.Equal(s.t0), Equals, true)
+	t.Assert(rest, Equals, "a/b")
+	t.Assert(dir, Equals, true)
+}
+
+func (s *SnapshotTest) listNames(t *C, prefix string) (names []string) {
+	resp, err := s.snap.ListBlobs(&ListBlobsInput{
+		Prefix:    PString(prefix),
+		Delimiter: PString("/"),
+	})
+	t.Assert(err, IsNil)
+	for _, p := range resp.Prefixes {
+		names = append(names, *p.Prefix)
+	}
+	for _, i := range resp.Items {
+		names = append(names, *i.Key)
+	}
+	return
+}
+
+func (s *SnapshotTest) TestListAtTime(t *C) {
+	t.Assert(s.listNames(t, "2024-05-01T00:00/"), DeepEquals, []string{
+		"2024-05-01T00:00/dir/", "2024-05-01T00:00/a",
+	})
+	t.Assert(s.listNames(t, "2024-05-02T00:00/"), DeepEquals, []string{
+		"2024-05-02T00:00/dir/", "2024-05-02T00:00/a", "2024-05-02T00:00/b",
+	})
+	t.Assert(s.listNames(t, "2024-05-03T00:00/"), DeepEquals, []string{
+		"2024-05-03T00:00/dir/", "2024-05-03T00:00/b",
+	})
+	t.Assert(s.listNames(t, "2024-04-01T00:00/"), DeepEquals, []string{
+		"2024-04-01T00:00/dir/",
+	})
+}
+
+func (s *SnapshotTest) TestListPaginated(t *C) {
+	s.cloud.pageSize = 1
+
+	var names []string
+	params := &ListBlobsInput{
+		Prefix: PString("2024-05-02T00:00/"),
+	}
+	for {
+		resp, err := s.snap.ListBlobs(params)
+		t.Assert(err, IsNil)
+		for _, i := range resp.Items {
+			names = append(names, *i.Key)
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	// older versions of a on later pages must not show up again
+	t.Assert(names, DeepEquals, []string{
+		"2024-05-02T00:00/a", "2024-05-02T00:00/b", "2024-05-02T00:00/dir/c",
+	})
+}
+
+func (s *SnapshotTest) TestSlurp(t *C) {
+	resp, err := s.snap.ListBlobs(&ListBlobsInput{
+		Prefix:     PString(""),
+		StartAfter: PString("2024-05-01T00:00/"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 2)
+	t.Assert(*resp.Items[0].Key, Equals, "2024-05-01T00:00/a")
+	t.Assert(*resp.Items[1].Key, Equals, "2024-05-01T00:00/dir/c")
+
+	_, err = s.snap.ListBlobs(&ListBlobsInput{})
+	t.Assert(err, Equals, syscall.ENOTSUP)
+}
+
+func (s *SnapshotTest) TestHeadGet(t *C) {
+	head, err := s.snap.HeadBlob(&HeadBlobInput{Key: "2024-05-01T00:00/"})
+	t.Assert(err, IsNil)
+	t.Assert(head.IsDirBlob, Equals, true)
+
+	_, err = s.snap.HeadBlob(&HeadBlobInput{Key: "2024-05-01T00:00/b"})
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.snap.HeadBlob(&HeadBlobInput{Key: "2024-05-03T00:00/a"})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	head, err = s.snap.HeadBlob(&HeadBlobInput{Key: "2024-05-02T00:00/a"})
+	t.Assert(err, IsNil)
+	t.Assert(*head.Key, Equals, "2024-05-02T00:00/a")
+
+	lists := s.cloud.lists
+	resp, err := s.snap.GetBlob(&GetBlobInput{Key: "2024-05-02T00:00/a"})
+	t.Assert(err, IsNil)
+	// resolved version is remembered
+	t.Assert(s.cloud.lists, Equals, lists)
+	t.Assert(*resp.Key, Equals, "2024-05-02T00:00/a")
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "a2")
+
+	_, err = s.snap.PutBlob(&PutBlobInput{Key: "2024-05-02T00:00/a"})
+	t.Assert(err, Equals, syscall.EROFS)
+	t.Assert(s.snap.Capabilities().ReadOnly, Equals, true)
+}
+
+type azureSnapshot struct {
+	name     string
+	snapshot string
+	day      int
+}
+
+// TestAzureVersions lists snapshots from a fake azure server, a blob
+// at a time so versions and prefixes are split across pages
+func (s *SnapshotTest) TestAzureVersions(t *C) {
+	blobs := []azureSnapshot{
+		{"a", "2024-05-01T00:00:00.0000000Z", 0},
+		{"a", "", 1},
+		{"dir/b", "", 0},
+		{"dir/c", "", 0},
+		{"e", "", 2},
+	}
+	var snapshots []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("comp") != "list" {
+			snapshots = append(snapshots, q.Get("snapshot"))
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("Last-Modified", s.t0.Format(http.TimeFormat))
+			w.Header().Set("x-ms-blob-type", "BlockBlob")
+			io.WriteString(w, "data")
+			return
+		}
+
+		t.Check(q.Get("include"), Equals, "metadata,snapshots")
+		i, _ := strconv.Atoi(q.Get("marker"))
+		b := blobs[i]
+		next := ""
+		if i+1 < len(blobs) {
+			next = strconv.Itoa(i + 1)
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+			`<EnumerationResults ContainerName="container"><Blobs><Blob>`+
+			`<Name>%v</Name><Snapshot>%v</Snapshot><Properties>`+
+			`<Last-Modified>%v</Last-Modified><Etag>0x1</Etag>`+
+			`<Content-Length>4</Content-Length><BlobType>BlockBlob</BlobType>`+
+			`</Properties><Metadata /></Blob></Blobs>`+
+			`<NextMarker>%v</NextMarker></EnumerationResults>`,
+			b.name, b.snapshot,
+			s.t0.Add(time.Duration(b.day)*24*time.Hour).Format(http.TimeFormat), next)
+	}))
+	defer server.Close()
+
+	azb, err := NewAZBlob("container", &AZBlobConfig{
+		Endpoint:    server.URL + "/",
+		AccountName: "account",
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("key")),
+	})
+	t.Assert(err, IsNil)
+
+	// a is only done once the blob itself is listed, newest first
+	resp, err := azb.ListBlobVersions(&ListBlobVersionsInput{Delimiter: PString("/")})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Versions), Equals, 2)
+	t.Assert(*resp.Versions[0].VersionId, Equals, AZBLOB_CURRENT_VERSION)
+	t.Assert(resp.Versions[0].IsLatest, Equals, true)
+	t.Assert(*resp.Versions[1].VersionId, Equals, blobs[0].snapshot)
+	t.Assert(resp.IsTruncated, Equals, true)
+
+	// dir/ is only returned once
+	resp, err = azb.ListBlobVersions(&ListBlobVersionsInput{
+		Delimiter:       PString("/"),
+		KeyMarker:       resp.NextKeyMarker,
+		VersionIdMarker: resp.NextVersionIdMarker,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Prefixes), Equals, 1)
+	t.Assert(*resp.Prefixes[0].Prefix, Equals, "dir/")
+	resp, err = azb.ListBlobVersions(&ListBlobVersionsInput{
+		Delimiter:       PString("/"),
+		KeyMarker:       resp.NextKeyMarker,
+		VersionIdMarker: resp.NextVersionIdMarker,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Prefixes), Equals, 0)
+	t.Assert(len(resp.Versions), Equals, 0)
+	t.Assert(resp.IsTruncated, Equals, true)
+
+	// .snapshots and .versions work the same as on S3
+	snap := NewSnapshotBackend(azb, "", 24*time.Hour, 3)
+	list, err := snap.ListBlobs(&ListBlobsInput{
+		Prefix:    PString("2024-05-01T12:00/"),
+		Delimiter: PString("/"),
+	})
+	t.Assert(err, IsNil)
+	var names []string
+	for list != nil {
+		for _, p := range list.Prefixes {
+			names = append(names, *p.Prefix)
+		}
+		for _, i := range list.Items {
+			names = append(names, *i.Key)
+		}
+		if !list.IsTruncated {
+			break
+		}
+		list, err = snap.ListBlobs(&ListBlobsInput{
+			Prefix:            PString("2024-05-01T12:00/"),
+			Delimiter:         PString("/"),
+			ContinuationToken: list.NextContinuationToken,
+		})
+		t.Assert(err, IsNil)
+	}
+	t.Assert(names, DeepEquals, []string{"2024-05-01T12:00/a", "2024-05-01T12:00/dir/"})
+
+	get, err := snap.GetBlob(&GetBlobInput{Key: "2024-05-01T12:00/a"})
+	t.Assert(err, IsNil)
+	get.Body.Close()
+
+	versions := NewVersionsBackend(azb, "")
+	get, err = versions.GetBlob(&GetBlobInput{
+		Key: "a/2024-05-02T00:00:00Z_" + AZBLOB_CURRENT_VERSION,
+	})
+	t.Assert(err, IsNil)
+	get.Body.Close()
+
+	// the blob itself isn't a snapshot
+	t.Assert(snapshots, DeepEquals, []string{blobs[0].snapshot, ""})
+}
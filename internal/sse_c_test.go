@@ -0,0 +1,189 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+type SseCTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+	key    []byte
+
+	mu sync.Mutex
+	// the key md5 and copy source key md5 of each request, by
+	// method, and "COPY" for the ones with a copy source
+	requests map[string][][2]string
+}
+
+var _ = Suite(&SseCTest{})
+
+func (s *SseCTest) SetUpTest(t *C) {
+	s.key = bytes.Repeat([]byte("k"), 32)
+	s.requests = make(map[string][][2]string)
+	// the sdk won't send the key over plain http
+	s.server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+
+			method := r.Method
+			if r.Header.Get("x-amz-copy-source") != "" {
+				method = "COPY"
+			}
+			s.mu.Lock()
+			s.requests[method] = append(s.requests[method], [2]string{
+				r.Header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+				r.Header.Get("x-amz-copy-source-server-side-encryption-customer-key-MD5"),
+			})
+			s.mu.Unlock()
+
+			w.Header().Set("ETag", "\"etag\"")
+			if r.Method == "HEAD" {
+				// nothing is written, so it's not sent
+				// unless we do
+				w.Header().Set("Content-Length", "0")
+			}
+			if _, ok := r.URL.Query()["uploads"]; ok {
+				io.WriteString(w, "<InitiateMultipartUploadResult>"+
+					"<UploadId>upload</UploadId>"+
+					"</InitiateMultipartUploadResult>")
+			} else if method == "COPY" {
+				io.WriteString(w, "<CopyPartResult><ETag>\"etag\"</ETag></CopyPartResult>")
+			}
+		}))
+
+	config := &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	t.Assert(config.SetSseC(base64.StdEncoding.EncodeToString(s.key)), IsNil)
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, config)
+	t.Assert(err, IsNil)
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.awsConfig.HTTPClient = s.server.Client()
+	s.s3.newS3()
+}
+
+func (s *SseCTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *SseCTest) parse(args ...string) *FlagStorage {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run(append(append([]string{"goofys"}, args...), "bucket", "/mnt"))
+	return flags
+}
+
+func (s *SseCTest) TestFlag(t *C) {
+	encoded := base64.StdEncoding.EncodeToString(s.key)
+	digest := md5.Sum(s.key)
+
+	flags := s.parse("--sse-c", encoded)
+	t.Assert(flags, NotNil)
+	config := flags.Backend.(*S3Config)
+	t.Assert(config.SseC, Equals, string(s.key))
+	t.Assert(config.SseCDigest, Equals, base64.StdEncoding.EncodeToString(digest[:]))
+
+	// or from a file
+	f, err := ioutil.TempFile("", "sse-c")
+	t.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString(encoded + "\n")
+	f.Close()
+
+	flags = s.parse("--sse-c", f.Name())
+	t.Assert(flags, NotNil)
+	t.Assert(flags.Backend.(*S3Config).SseC, Equals, string(s.key))
+
+	t.Assert(s.parse("--sse-c", base64.StdEncoding.EncodeToString(s.key[:16])), IsNil)
+	t.Assert(s.parse("--sse-c", "not base64"), IsNil)
+	t.Assert(s.parse("--sse-c", encoded, "--sse"), IsNil)
+}
+
+func (s *SseCTest) TestEveryRequest(t *C) {
+	// only what's sent matters, some of the responses won't parse
+	s.s3.HeadBlob(&HeadBlobInput{Key: "file"})
+	s.s3.GetBlob(&GetBlobInput{Key: "file"})
+	s.s3.PutBlob(&PutBlobInput{
+		Key:  "file",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	s.s3.CopyBlob(&CopyBlobInput{
+		Source:      "file",
+		Destination: "file2",
+		Size:        PUInt64(5),
+		ETag:        PString("\"etag\""),
+	})
+
+	commit, err := s.s3.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "mpu"})
+	t.Assert(err, IsNil)
+	_, err = s.s3.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("part")),
+		Size:       4,
+	})
+	t.Assert(err, IsNil)
+	s.s3.copyObjectMultipart(nil, 5, "bucket/file", "file3", "", PString("\"etag\""),
+		nil, PString("STANDARD"), nil)
+
+	digest := md5.Sum(s.key)
+	sum := base64.StdEncoding.EncodeToString(digest[:])
+
+	for _, m := range []string{"HEAD", "GET", "PUT"} {
+		t.Assert(len(s.requests[m]) > 0, Equals, true, Commentf("no %v", m))
+		for _, r := range s.requests[m] {
+			t.Assert(r, Equals, [2]string{sum, ""}, Commentf("%v", m))
+		}
+	}
+	// CopyObject and UploadPartCopy need both
+	t.Assert(s.requests["COPY"], HasLen, 2)
+	for _, r := range s.requests["COPY"] {
+		t.Assert(r, Equals, [2]string{sum, sum})
+	}
+	// the two CreateMultipartUploads have it, completing doesn't
+	// need it
+	var withKey int
+	for _, r := range s.requests["POST"] {
+		if r[0] == sum {
+			withKey++
+		}
+	}
+	t.Assert(withKey, Equals, 2)
+}
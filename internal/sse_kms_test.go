@@ -0,0 +1,208 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/urfave/cli"
+	. "gopkg.in/check.v1"
+)
+
+type SseKMSTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+
+	mu sync.Mutex
+	// the kms key of each write, by key, parts and completing an
+	// upload aside
+	keys map[string]string
+}
+
+var _ = Suite(&SseKMSTest{})
+
+func (s *SseKMSTest) SetUpTest(t *C) {
+	s.keys = make(map[string]string)
+	s.server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+
+			_, part := r.URL.Query()["uploadId"]
+			if (r.Method == "PUT" || r.Method == "POST") && !part {
+				s.mu.Lock()
+				key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+				s.keys[key] = r.Header.Get("x-amz-server-side-encryption-aws-kms-key-id")
+				if r.Header.Get("x-amz-server-side-encryption") == "" {
+					s.keys[key] = "none"
+				}
+				s.mu.Unlock()
+			}
+
+			w.Header().Set("ETag", "\"etag\"")
+			if _, ok := r.URL.Query()["uploads"]; ok {
+				io.WriteString(w, "<InitiateMultipartUploadResult>"+
+					"<UploadId>upload</UploadId>"+
+					"</InitiateMultipartUploadResult>")
+			} else if r.Header.Get("x-amz-copy-source") != "" {
+				io.WriteString(w, "<CopyObjectResult><ETag>\"etag\"</ETag></CopyObjectResult>")
+			}
+		}))
+
+	config := &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		UseSSE:    true,
+		UseKMS:    true,
+		KMSKeyID:  "global",
+		KMSKeyPrefixes: map[string]string{
+			"restricted/":        "restricted",
+			"restricted/secret/": "secret",
+		},
+	}
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, config)
+	t.Assert(err, IsNil)
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.awsConfig.HTTPClient = s.server.Client()
+	s.s3.newS3()
+}
+
+func (s *SseKMSTest) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *SseKMSTest) TestKeyFor(t *C) {
+	config := s.s3.config
+	config.KMSKeyPrefixes["archive"] = "archive"
+	for key, expected := range map[string]string{
+		"restricted/a":        "restricted",
+		"restricted/secret/a": "secret",
+		"restricted-not/a":    "",
+		"a":                   "",
+		// whole directories, with or without the /
+		"archive/a":     "archive",
+		"archive/":      "archive",
+		"archive-old/a": "",
+		"archive":       "",
+	} {
+		id, ok := config.KMSKeyFor(key)
+		t.Assert(ok, Equals, expected != "")
+		t.Assert(id, Equals, expected)
+	}
+}
+
+func (s *SseKMSTest) TestEveryWrite(t *C) {
+	s.s3.PutBlob(&PutBlobInput{
+		Key:  "a",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	s.s3.PutBlob(&PutBlobInput{
+		Key:  "restricted/a",
+		Body: bytes.NewReader([]byte("hello")),
+		Size: PUInt64(5),
+	})
+	_, err := s.s3.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key: "restricted/secret/mpu",
+	})
+	t.Assert(err, IsNil)
+	// copied into a prefix with another key is encrypted again
+	// with it
+	s.s3.CopyBlob(&CopyBlobInput{
+		Source:      "a",
+		Destination: "restricted/b",
+		Size:        PUInt64(5),
+		ETag:        PString("\"etag\""),
+	})
+	s.s3.copyObjectMultipart(nil, 5, "bucket/a", "restricted/secret/c", "",
+		PString("\"etag\""), nil, PString("STANDARD"), nil)
+
+	t.Assert(s.keys, DeepEquals, map[string]string{
+		"a":                     "global",
+		"restricted/a":          "restricted",
+		"restricted/secret/mpu": "secret",
+		"restricted/b":          "restricted",
+		"restricted/secret/c":   "secret",
+	})
+}
+
+func (s *SseKMSTest) TestCheckKeys(t *C) {
+	var keys []string
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req kms.GenerateDataKeyInput
+			json.NewDecoder(r.Body).Decode(&req)
+			keys = append(keys, aws.StringValue(req.KeyId))
+
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			if aws.StringValue(req.KeyId) == "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"__type":"NotFoundException",`+
+					`"message":"Alias arn:aws:kms:secret is not found."}`)
+				return
+			}
+			io.WriteString(w, "{}")
+		}))
+	defer server.Close()
+
+	config := s.s3.awsConfig.Copy()
+	config.Endpoint = aws.String(server.URL)
+	config.HTTPClient = server.Client()
+	client := kms.New(s.s3.config.Session, config)
+
+	err := s.s3.checkKMSKeys(client)
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "restricted/secret/"), Equals, true)
+
+	delete(s.s3.config.KMSKeyPrefixes, "restricted/secret/")
+	keys = nil
+	t.Assert(s.s3.checkKMSKeys(client), IsNil)
+	t.Assert(keys, DeepEquals, []string{"restricted"})
+}
+
+func (s *SseKMSTest) TestFlag(t *C) {
+	var flags *FlagStorage
+	app := NewApp()
+	app.Action = func(c *cli.Context) error {
+		flags = PopulateFlags(c)
+		return nil
+	}
+	app.Run([]string{"goofys", "--sse-kms-prefix", "/restricted/=arn:aws:kms:k",
+		"bucket", "/mnt"})
+	t.Assert(flags, NotNil)
+	config := flags.Backend.(*S3Config)
+	t.Assert(config.KMSKeyPrefixes, DeepEquals, map[string]string{
+		"restricted/": "arn:aws:kms:k",
+	})
+	// only the prefixes are encrypted
+	t.Assert(config.UseSSE, Equals, false)
+
+	flags = nil
+	app.Run([]string{"goofys", "--sse-kms-prefix", "restricted", "bucket", "/mnt"})
+	t.Assert(flags, IsNil)
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// classBackend remembers the storage class of what was written to it
+type classBackend struct {
+	slowBackend
+	noClass bool
+
+	class  string
+	copies int
+}
+
+func (b *classBackend) Capabilities() *Capabilities {
+	return &Capabilities{Name: "class", StorageClass: !b.noClass}
+}
+
+func (b *classBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	out, err := b.slowBackend.HeadBlob(param)
+	if err == nil && b.class != "" {
+		out.StorageClass = PString(b.class)
+	}
+	return out, err
+}
+
+func (b *classBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.class = nilStr(param.StorageClass)
+	return b.slowBackend.PutBlob(param)
+}
+
+func (b *classBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.copies++
+	b.class = nilStr(param.StorageClass)
+	return &CopyBlobOutput{}, nil
+}
+
+type StorageClassTest struct {
+	cloud *classBackend
+}
+
+var _ = Suite(&StorageClassTest{})
+
+func (s *StorageClassTest) SetUpTest(t *C) {
+	s.cloud = &classBackend{}
+	s.cloud.etag = "\"etag\""
+}
+
+func (s *StorageClassTest) TestNewFile(t *C) {
+	fh := newTestFileHandle(s.cloud)
+	inode := fh.inode
+
+	_, err := inode.GetXattr(XATTR_STORAGE_CLASS)
+	t.Assert(err, Equals, ENOATTR)
+
+	t.Assert(inode.SetXattr(XATTR_STORAGE_CLASS, []byte("STANDARD_IA"), 0), IsNil)
+	// nothing to copy yet
+	t.Assert(s.cloud.copies, Equals, 0)
+	class, err := inode.GetXattr(XATTR_STORAGE_CLASS)
+	t.Assert(err, IsNil)
+	t.Assert(string(class), Equals, "STANDARD_IA")
+
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.class, Equals, "STANDARD_IA")
+
+	// later writes go back to the default
+	t.Assert(inode.RemoveXattr(XATTR_STORAGE_CLASS), IsNil)
+	t.Assert(inode.RemoveXattr(XATTR_STORAGE_CLASS), Equals, ENOATTR)
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.class, Equals, "")
+}
+
+func (s *StorageClassTest) TestExistingFile(t *C) {
+	inode := newTestInode(s.cloud)
+	size := uint64(1024)
+	inode.KnownSize = &size
+	inode.Attributes.Size = size
+
+	class, err := inode.GetXattr(XATTR_STORAGE_CLASS)
+	t.Assert(err, IsNil)
+	t.Assert(string(class), Equals, "STANDARD")
+
+	t.Assert(inode.SetXattr(XATTR_STORAGE_CLASS, []byte("INTELLIGENT_TIERING"), 0), IsNil)
+	t.Assert(s.cloud.copies, Equals, 1)
+	t.Assert(s.cloud.class, Equals, "INTELLIGENT_TIERING")
+	class, err = inode.GetXattr(XATTR_STORAGE_CLASS)
+	t.Assert(err, IsNil)
+	t.Assert(string(class), Equals, "INTELLIGENT_TIERING")
+
+	// already is
+	t.Assert(inode.SetXattr(XATTR_STORAGE_CLASS, []byte("INTELLIGENT_TIERING"), 0), IsNil)
+	t.Assert(s.cloud.copies, Equals, 1)
+
+	t.Assert(inode.SetXattr(XATTR_STORAGE_CLASS, nil, 0), Equals, syscall.EINVAL)
+
+	// and it's not user metadata
+	xattrs, err := inode.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(xattrs, DeepEquals, []string{"s3.etag", "s3.key", "s3.storage-class"})
+}
+
+func (s *StorageClassTest) TestNotSupported(t *C) {
+	s.cloud.noClass = true
+	inode := newTestInode(s.cloud)
+
+	t.Assert(inode.SetXattr(XATTR_STORAGE_CLASS, []byte("STANDARD_IA"), 0),
+		Equals, syscall.ENOTSUP)
+}
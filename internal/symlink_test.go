@@ -0,0 +1,143 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"os"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// metaBackend keeps the metadata of what was put, and HEADs
+// everything as an empty object with it
+type metaBackend struct {
+	slowBackend
+	noMetadata bool
+	metadata   map[string]*string
+}
+
+func (b *metaBackend) Capabilities() *Capabilities {
+	return &Capabilities{Name: "meta", DirBlob: true, NoMetadata: b.noMetadata}
+}
+
+func (b *metaBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	out, err := b.slowBackend.HeadBlob(param)
+	if err == nil {
+		out.LastModified = PTime(time.Now())
+		out.Metadata = b.metadata
+	}
+	return out, err
+}
+
+func (b *metaBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.metadata = param.Metadata
+	return b.slowBackend.PutBlob(param)
+}
+
+type SymlinkTest struct {
+	cloud *metaBackend
+	root  *Inode
+}
+
+var _ = Suite(&SymlinkTest{})
+
+func (s *SymlinkTest) SetUpTest(t *C) {
+	s.cloud = &metaBackend{}
+	s.cloud.etag = "\"etag\""
+	s.root = newTestInode(s.cloud).Parent
+	s.root.fs.flags.SymlinkMetadataKey = "goofys-symlink-target"
+}
+
+func (s *SymlinkTest) assertSymlink(t *C, inode *Inode, target string) {
+	t.Assert(inode.symlink, NotNil)
+	t.Assert(*inode.symlink, Equals, target)
+
+	attr := inode.InflateAttributes()
+	t.Assert(attr.Mode&os.ModeType, Equals, os.ModeSymlink)
+	t.Assert(attr.Size, Equals, uint64(len(target)))
+}
+
+func (s *SymlinkTest) TestCreate(t *C) {
+	inode, err := s.root.CreateSymlink("link", "../some/target")
+	t.Assert(err, IsNil)
+	s.assertSymlink(t, inode, "../some/target")
+	t.Assert(inode.maybeSymlink(), Equals, false)
+
+	// stored like any other metadata
+	t.Assert(DecodeMetadata(s.cloud.metadata), DeepEquals,
+		map[string][]byte{"goofys-symlink-target": []byte("../some/target")})
+
+	inode, err = s.root.LookUp("link")
+	t.Assert(err, IsNil)
+	s.assertSymlink(t, inode, "../some/target")
+}
+
+func (s *SymlinkTest) TestLookUp(t *C) {
+	s.cloud.metadata = map[string]*string{"some": PString("thing")}
+	inode, err := s.root.LookUp("file")
+	t.Assert(err, IsNil)
+	t.Assert(inode.symlink, IsNil)
+	t.Assert(inode.InflateAttributes().Mode, Equals, s.root.fs.flags.FileMode)
+
+	// the key is only looked at if it's turned on
+	s.cloud.metadata = EncodeMetadata(map[string][]byte{"goofys-symlink-target": []byte("target")})
+	s.root.fs.flags.SymlinkMetadataKey = ""
+	inode, err = s.root.LookUp("file")
+	t.Assert(err, IsNil)
+	t.Assert(inode.symlink, IsNil)
+}
+
+func (s *SymlinkTest) TestListed(t *C) {
+	inode := NewInode(s.root.fs, s.root, PString("link"))
+	inode.SetFromBlobItem(&BlobItemOutput{Key: PString("link"), ETag: PString("\"1\"")})
+	// could be, the listing doesn't tell
+	t.Assert(inode.maybeSymlink(), Equals, true)
+
+	inode.fillXattrFromHead(&HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{ETag: PString("\"1\"")},
+		Metadata:       EncodeMetadata(map[string][]byte{"goofys-symlink-target": []byte("target")}),
+	})
+	s.assertSymlink(t, inode, "target")
+	t.Assert(inode.maybeSymlink(), Equals, false)
+
+	// the same one listed again
+	inode.SetFromBlobItem(&BlobItemOutput{Key: PString("link"), ETag: PString("\"1\"")})
+	s.assertSymlink(t, inode, "target")
+
+	// replaced by something we have to look at again
+	inode.SetFromBlobItem(&BlobItemOutput{Key: PString("link"), ETag: PString("\"2\"")})
+	t.Assert(inode.symlink, IsNil)
+	t.Assert(inode.maybeSymlink(), Equals, true)
+
+	// non-empty files can't be symlinks
+	inode.SetFromBlobItem(&BlobItemOutput{Key: PString("link"), ETag: PString("\"3\""), Size: 1})
+	t.Assert(inode.maybeSymlink(), Equals, false)
+}
+
+func (s *SymlinkTest) TestNotSupported(t *C) {
+	s.cloud.noMetadata = true
+	_, err := s.root.CreateSymlink("link", "target")
+	t.Assert(err, Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.puts, Equals, 0)
+
+	s.cloud.noMetadata = false
+	s.root.fs.flags.SymlinkMetadataKey = ""
+	_, err = s.root.CreateSymlink("link", "target")
+	t.Assert(err, Equals, syscall.ENOTSUP)
+}
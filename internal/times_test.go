@@ -0,0 +1,194 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"time"
+
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+type TimesTest struct {
+	inode *Inode
+}
+
+var _ = Suite(&TimesTest{})
+
+var (
+	testCrtime = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	testMtime  = time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	testAtime  = time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func (s *TimesTest) SetUpTest(t *C) {
+	s.inode = newTestInode(&slowBackend{})
+}
+
+func (s *TimesTest) TestFromBackend(t *C) {
+	s.inode.SetFromBlobItem(&BlobItemOutput{
+		Key:          PString("file"),
+		LastModified: PTime(testMtime),
+		Atime:        PTime(testAtime),
+		Crtime:       PTime(testCrtime),
+	})
+
+	attr, err := s.inode.GetAttributes()
+	t.Assert(err, IsNil)
+	t.Assert(attr.Crtime, Equals, testCrtime)
+	t.Assert(attr.Mtime, Equals, testMtime)
+	t.Assert(attr.Ctime, Equals, testMtime)
+	t.Assert(attr.Atime, Equals, testAtime)
+
+	// a write is newer than when it was last read
+	s.inode.Attributes.Mtime = testAtime.Add(time.Hour)
+	attr, err = s.inode.GetAttributes()
+	t.Assert(err, IsNil)
+	t.Assert(attr.Atime, Equals, testAtime.Add(time.Hour))
+	t.Assert(attr.Crtime, Equals, testCrtime)
+}
+
+func (s *TimesTest) TestNotFromBackend(t *C) {
+	s.inode.SetFromBlobItem(&BlobItemOutput{
+		Key:          PString("file"),
+		LastModified: PTime(testMtime),
+		Atime:        PTime(testAtime),
+		Crtime:       PTime(testCrtime),
+	})
+	// listed again by something that doesn't have them
+	s.inode.SetFromBlobItem(&BlobItemOutput{
+		Key:          PString("file"),
+		LastModified: PTime(testMtime),
+	})
+
+	attr, err := s.inode.GetAttributes()
+	t.Assert(err, IsNil)
+	t.Assert(attr.Crtime, Equals, testMtime)
+	t.Assert(attr.Ctime, Equals, testMtime)
+	t.Assert(attr.Atime, Equals, testMtime)
+}
+
+// childTimesBackend has dir/file, written at testMtime
+type childTimesBackend struct {
+	memBackend
+}
+
+func (b *childTimesBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	return nil, fuse.ENOENT
+}
+
+func (b *childTimesBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	return &ListBlobsOutput{
+		Items: []BlobItemOutput{{
+			Key:          PString("dir/file"),
+			LastModified: PTime(testMtime),
+		}},
+	}, nil
+}
+
+func (b *childTimesBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return &DeleteBlobOutput{}, nil
+}
+
+func (s *TimesTest) TestDirMtimeFromChildren(t *C) {
+	root := s.inode.Parent
+	root.dir.cloud = &childTimesBackend{}
+
+	// a directory that's only there because of its children
+	dir, err := root.LookUpInodeMaybeDir(nil, "dir", "dir")
+	t.Assert(err, IsNil)
+	t.Assert(dir.isDir(), Equals, true)
+	t.Assert(dir.Attributes.Mtime.IsZero(), Equals, true)
+
+	s.inode.fs.flags.DirMtimeFromChildren = true
+	dir, err = root.LookUpInodeMaybeDir(nil, "dir", "dir")
+	t.Assert(err, IsNil)
+	t.Assert(dir.Attributes.Mtime, Equals, testMtime)
+}
+
+func (s *TimesTest) TestDirMtimeRemove(t *C) {
+	root := s.inode.Parent
+	root.dir.cloud = &childTimesBackend{}
+	root.Attributes.Mtime = testMtime
+
+	t.Assert(root.Unlink("file"), IsNil)
+	t.Assert(root.Attributes.Mtime, Equals, testMtime)
+
+	s.inode.fs.flags.DirMtimeFromChildren = true
+	t.Assert(root.Unlink("file"), IsNil)
+	t.Assert(root.Attributes.Mtime.After(testMtime), Equals, true)
+}
+
+func (s *TimesTest) TestPreserveMtime(t *C) {
+	cloud := &xattrBackend{}
+	cloud.etag = "\"etag\""
+	cloud.size = 1024
+	inode := newTestInode(cloud)
+	inode.fs.flags.PreserveMtime = true
+	inode.KnownSize = PUInt64(cloud.size)
+	inode.etag = cloud.etag
+
+	t.Assert(inode.SetMtime(testMtime), IsNil)
+	t.Assert(cloud.copies, HasLen, 1)
+	t.Assert(string(DecodeMetadata(cloud.meta)[MTIME_METADATA]), Equals,
+		"2019-02-01T00:00:00Z")
+	t.Assert(inode.InflateAttributes().Mtime, Equals, testMtime)
+
+	// listed again, it's still the same object
+	inode.SetFromBlobItem(&BlobItemOutput{
+		Key:          PString("file"),
+		ETag:         PString(cloud.etag),
+		LastModified: PTime(testAtime),
+	})
+	t.Assert(inode.InflateAttributes().Mtime, Equals, testMtime)
+
+	// and after the copy, it's in the metadata a HEAD has
+	inode.SetFromBlobItem(&BlobItemOutput{
+		Key:          PString("file"),
+		ETag:         PString("\"copied\""),
+		LastModified: PTime(testAtime),
+	})
+	t.Assert(inode.InflateAttributes().Mtime, Equals, testAtime)
+	t.Assert(inode.needsMetadata(), Equals, true)
+	inode.mu.Lock()
+	t.Assert(inode.fillXattr(), IsNil)
+	inode.mu.Unlock()
+	t.Assert(inode.InflateAttributes().Mtime, Equals, testMtime)
+}
+
+func (s *TimesTest) TestPreserveMtimeOpen(t *C) {
+	cloud := &xattrBackend{}
+	fh := newTestFileHandle(cloud)
+	fh.inode.fs.flags.PreserveMtime = true
+	fh.inode.fileHandles = 1
+
+	// rsync sets it before it closes the file
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.inode.SetMtime(testMtime), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(cloud.copies, HasLen, 0)
+	t.Assert(string(DecodeMetadata(cloud.putMeta)[MTIME_METADATA]), Equals,
+		"2019-02-01T00:00:00Z")
+	t.Assert(fh.inode.InflateAttributes().Mtime, Equals, testMtime)
+
+	// written again, it's new
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	_, ok := DecodeMetadata(cloud.putMeta)[MTIME_METADATA]
+	t.Assert(ok, Equals, false)
+	t.Assert(fh.inode.InflateAttributes().Mtime.After(testMtime), Equals, true)
+}
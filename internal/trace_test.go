@@ -0,0 +1,109 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+type TraceTest struct {
+	server *httptest.Server
+	s3     *S3Backend
+
+	mu     sync.Mutex
+	traces map[string][]string
+}
+
+var _ = Suite(&TraceTest{})
+
+func (s *TraceTest) SetUpTest(t *C) {
+	s.traces = make(map[string][]string)
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+
+			s.mu.Lock()
+			s.traces[r.Method] = append(s.traces[r.Method],
+				r.Header.Get(TRACE_ID_HEADER))
+			s.mu.Unlock()
+
+			w.Header().Set("ETag", "\"etag\"")
+			if r.Method == "HEAD" {
+				// nothing is written, so it's not sent
+				// unless we do
+				w.Header().Set("Content-Length", "0")
+			}
+		}))
+
+	var err error
+	s.s3, err = NewS3("bucket", &FlagStorage{Endpoint: s.server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	t.Assert(err, IsNil)
+	s.s3.awsConfig.MaxRetries = aws.Int(0)
+	s.s3.newS3()
+}
+
+func (s *TraceTest) TearDownTest(t *C) {
+	s.server.Close()
+	SetLogFormat("text")
+}
+
+func (s *TraceTest) TestHeader(t *C) {
+	ctx := WithTraceId(nil, "trace1")
+	s.s3.HeadBlob(&HeadBlobInput{Key: "file", Context: ctx})
+	s.s3.GetBlob(&GetBlobInput{Key: "file", Context: ctx})
+	// not for an op
+	s.s3.HeadBlob(&HeadBlobInput{Key: "file"})
+
+	t.Assert(s.traces["HEAD"], DeepEquals, []string{"trace1", ""})
+	t.Assert(s.traces["GET"], DeepEquals, []string{"trace1"})
+}
+
+func (s *TraceTest) TestNewTraceId(t *C) {
+	t.Assert(NewTraceId(), Not(Equals), NewTraceId())
+	t.Assert(TraceId(nil), Equals, "")
+}
+
+func (s *TraceTest) TestJSON(t *C) {
+	t.Assert(SetLogFormat("xml"), NotNil)
+	t.Assert(SetLogFormat("json"), IsNil)
+
+	l := NewLogger("s3")
+	e := l.WithField("trace", "trace1")
+	e.Level = logrus.DebugLevel
+	e.Message = "HeadObject /bucket/file"
+	buf, err := l.Format(e)
+	t.Assert(err, IsNil)
+
+	var fields map[string]interface{}
+	t.Assert(json.Unmarshal(buf, &fields), IsNil)
+	t.Assert(fields["trace"], Equals, "trace1")
+	t.Assert(fields["logger"], Equals, "s3")
+	t.Assert(fields["level"], Equals, "debug")
+	t.Assert(fields["msg"], Equals, "HeadObject /bucket/file")
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+type TransportTest struct {
+}
+
+var _ = Suite(&TransportTest{})
+
+func (s *TransportTest) TestTransportStats(t *C) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	t.Assert(err, IsNil)
+
+	client := &http.Client{Transport: GetHTTPTransport(&FlagStorage{})}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		t.Assert(err, IsNil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	stats, ok := GetTransportStats()[u.Host]
+	t.Assert(ok, Equals, true)
+	t.Assert(stats.Requests, Equals, uint64(3))
+	t.Assert(stats.NewConns, Equals, uint64(1))
+	t.Assert(stats.ReusedConns, Equals, uint64(2))
+	t.Assert(stats.ConnectTime > 0, Equals, true)
+}
+
+func (s *TransportTest) TestTransportPerSettings(t *C) {
+	flags := &FlagStorage{}
+	transport := GetHTTPTransport(flags)
+	t.Assert(GetHTTPTransport(&FlagStorage{
+		MaxIdleConnsPerHost: DEFAULT_MAX_IDLE_CONNS_PER_HOST,
+		DialTimeout:         DEFAULT_DIAL_TIMEOUT,
+	}), Equals, transport)
+
+	flags.NoHTTP2 = true
+	flags.MaxIdleConnsPerHost = 10
+	other := GetHTTPTransport(flags)
+	t.Assert(other, Not(Equals), transport)
+	t.Assert(GetHTTPTransport(flags), Equals, other)
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"syscall"
+	"time"
+)
+
+// with --undelete, on a directory. The first lists the names that can
+// be restored, one per line, setting the second to one of them
+// restores it
+const XATTR_DELETED = "user.goofys.deleted"
+const XATTR_UNDELETE = "user.goofys.undelete"
+
+// also with --undelete, every directory has a hidden
+// .goofys-restore. Reading it is the same as the first xattr, names
+// written to it, one per line, are restored
+const RESTORE_FILE = ".goofys-restore"
+
+// undeleter is a backend that keeps what's deleted for a while and
+// can bring it back, like azure with soft delete on
+type undeleter interface {
+	// names of the deleted blobs right under prefix, which ends
+	// with / unless it's the root. Not the ones that were
+	// replaced by a new blob
+	ListDeletedBlobs(prefix string) ([]string, error)
+	UndeleteBlob(key string) error
+}
+
+func isUndeleteXattr(name string) bool {
+	return name == XATTR_DELETED || name == XATTR_UNDELETE
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) undeleter() (u undeleter, key string, err error) {
+	if !inode.isDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+
+	cloud, key := inode.cloud()
+	u, ok := unwrapBackend(cloud).(undeleter)
+	if !ok {
+		return nil, "", syscall.ENOTSUP
+	}
+	return u, key, nil
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) listDeleted() ([]byte, error) {
+	u, prefix, err := inode.undeleter()
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	names, err := u.ListDeletedBlobs(prefix)
+	if err != nil {
+		return nil, inode.fs.mapAwsError(err)
+	}
+	if len(names) == 0 {
+		return []byte{}, nil
+	}
+	return []byte(strings.Join(names, "\n") + "\n"), nil
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) undelete(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.Contains(name, "/") {
+		return syscall.EINVAL
+	}
+
+	u, key, err := inode.undeleter()
+	if err != nil {
+		return err
+	}
+
+	err = u.UndeleteBlob(appendChildName(key, name))
+	if err != nil {
+		return inode.fs.mapAwsError(err)
+	}
+
+	// so the next lookup and listing go looking for it
+	delete(inode.dir.notFound, name)
+	inode.dir.DirTime = time.Time{}
+	return nil
+}
+
+func (inode *Inode) isRestoreFile() bool {
+	return inode.fs.flags.Undelete && inode.dir == nil &&
+		inode.Parent != nil && *inode.Name == RESTORE_FILE
+}
+
+// addRestoreFile puts .goofys-restore in dir if it's not there yet.
+// Like .versions it never expires, and it's left out of listings by
+// isUnlistedName
+func (fs *Goofys) addRestoreFile(dir *Inode) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.findChildUnlocked(RESTORE_FILE) != nil {
+		return
+	}
+
+	inode := NewInode(fs, dir, PString(RESTORE_FILE))
+	inode.Attributes.Mtime = dir.Attributes.Mtime
+	// so it's never looked up for its metadata
+	inode.userMetadata = make(map[string][]byte)
+	inode.AttrTime = TIME_MAX
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.insertInode(dir, inode)
+}
+
+// readRestoreFile lists the directory's deleted blobs again for every
+// read. The file is opened with direct io because its size is always
+// 0, so a read is usually the whole list
+func (inode *Inode) readRestoreFile(offset int64, buf []byte) (int, error) {
+	dir := inode.Parent
+	dir.mu.Lock()
+	deleted, err := dir.listDeleted()
+	dir.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if offset >= int64(len(deleted)) {
+		return 0, nil
+	}
+	return copy(buf, deleted[offset:]), nil
+}
+
+// writeRestoreFile restores every name in data, which has whole
+// lines. It stops at the first one that can't be restored
+func (inode *Inode) writeRestoreFile(data []byte) error {
+	dir := inode.Parent
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	for _, name := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		err := dir.undelete(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// undeleteBackend keeps the keys that were soft deleted
+type undeleteBackend struct {
+	memBackend
+	deleted map[string]bool
+}
+
+func (b *undeleteBackend) ListDeletedBlobs(prefix string) ([]string, error) {
+	var names []string
+	for key := range b.deleted {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			names = append(names, key[len(prefix):])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *undeleteBackend) UndeleteBlob(key string) error {
+	if !b.deleted[key] {
+		return syscall.ENOENT
+	}
+	delete(b.deleted, key)
+	return nil
+}
+
+type UndeleteTest struct {
+	cloud *undeleteBackend
+	dir   *Inode
+}
+
+var _ = Suite(&UndeleteTest{})
+
+func (s *UndeleteTest) SetUpTest(t *C) {
+	s.cloud = &undeleteBackend{
+		deleted: map[string]bool{
+			"dir/a":     true,
+			"dir/b":     true,
+			"dir/sub/c": true,
+			"d":         true,
+		},
+	}
+
+	root := newTestInode(s.cloud).Parent
+	root.fs.flags.Undelete = true
+	s.dir = NewInode(root.fs, root, PString("dir"))
+	s.dir.ToDir()
+}
+
+func (s *UndeleteTest) TestList(t *C) {
+	deleted, err := s.dir.GetXattr(XATTR_DELETED)
+	t.Assert(err, IsNil)
+	t.Assert(string(deleted), Equals, "a\nb\n")
+
+	deleted, err = s.dir.Parent.GetXattr(XATTR_DELETED)
+	t.Assert(err, IsNil)
+	t.Assert(string(deleted), Equals, "d\n")
+
+	_, err = s.dir.GetXattr(XATTR_UNDELETE)
+	t.Assert(err, Equals, ENOATTR)
+}
+
+func (s *UndeleteTest) TestUndelete(t *C) {
+	s.dir.dir.notFound = map[string]time.Time{"a": time.Now().Add(time.Minute)}
+	s.dir.dir.DirTime = time.Now()
+
+	t.Assert(s.dir.SetXattr(XATTR_UNDELETE, []byte("a\n"), 0), IsNil)
+	t.Assert(s.cloud.deleted["dir/a"], Equals, false)
+	// looked up and listed again
+	t.Assert(s.dir.dir.notFound, HasLen, 0)
+	t.Assert(s.dir.dir.DirTime.IsZero(), Equals, true)
+
+	t.Assert(s.dir.SetXattr(XATTR_UNDELETE, []byte("a"), 0), Equals, syscall.ENOENT)
+	t.Assert(s.dir.SetXattr(XATTR_UNDELETE, []byte("sub/c"), 0), Equals, syscall.EINVAL)
+	t.Assert(s.dir.SetXattr(XATTR_DELETED, []byte("b"), 0), Equals, syscall.EPERM)
+
+	file := NewInode(s.dir.fs, s.dir, PString("b"))
+	t.Assert(file.SetXattr(XATTR_UNDELETE, []byte("b"), 0), Equals, syscall.ENOTDIR)
+}
+
+func (s *UndeleteTest) TestNotSupported(t *C) {
+	inode := newTestInode(&copyBackend{})
+	inode.fs.flags.Undelete = true
+
+	_, err := inode.Parent.GetXattr(XATTR_DELETED)
+	t.Assert(err, Equals, syscall.ENOTSUP)
+}
+
+func (s *UndeleteTest) TestRestoreFile(t *C) {
+	fs := s.dir.fs
+	fs.addRestoreFile(s.dir)
+	file := s.dir.findChild(RESTORE_FILE)
+	t.Assert(file, NotNil)
+	t.Assert(file.isRestoreFile(), Equals, true)
+	t.Assert(fs.isUnlistedName(s.dir, RESTORE_FILE), Equals, true)
+	// there's only ever one
+	fs.addRestoreFile(s.dir)
+	t.Assert(s.dir.findChild(RESTORE_FILE), Equals, file)
+
+	buf := make([]byte, 3)
+	n, err := file.readRestoreFile(0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:n]), Equals, "a\nb")
+	n, err = file.readRestoreFile(3, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:n]), Equals, "\n")
+	n, err = file.readRestoreFile(4, buf)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 0)
+
+	s.dir.dir.DirTime = time.Now()
+	t.Assert(file.writeRestoreFile([]byte("a\n\nb\n")), IsNil)
+	t.Assert(s.cloud.deleted["dir/a"], Equals, false)
+	t.Assert(s.cloud.deleted["dir/b"], Equals, false)
+	t.Assert(s.dir.dir.DirTime.IsZero(), Equals, true)
+	t.Assert(file.writeRestoreFile([]byte("a\n")), Equals, syscall.ENOENT)
+
+	n, err = file.readRestoreFile(0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 0)
+
+	// only with --undelete
+	fs.flags.Undelete = false
+	t.Assert(file.isRestoreFile(), Equals, false)
+	t.Assert(fs.isUnlistedName(s.dir, RESTORE_FILE), Equals, false)
+}
+
+func (s *UndeleteTest) TestListDeleted(t *C) {
+	file := NewInode(s.dir.fs, s.dir, PString("a"))
+	file.SetFromBlobItem(&BlobItemOutput{
+		Key:     PString("dir/a"),
+		ETag:    PString("1"),
+		Deleted: true,
+	})
+	attr, err := file.GetAttributes()
+	t.Assert(err, IsNil)
+	t.Assert(attr.Mode, Equals, os.FileMode(0))
+
+	// restored by someone else
+	file.SetFromBlobItem(&BlobItemOutput{
+		Key:  PString("dir/a"),
+		ETag: PString("1"),
+	})
+	attr, err = file.GetAttributes()
+	t.Assert(err, IsNil)
+	t.Assert(attr.Mode, Equals, s.dir.fs.flags.FileMode)
+}
+
+// TestAzureListDeleted lists a fake azure container that has deleted
+// blobs, with --list-deleted
+func (s *UndeleteTest) TestAzureListDeleted(t *C) {
+	type blob struct {
+		name    string
+		deleted bool
+		dir     bool
+	}
+	blobs := []blob{
+		{"a", false, false},
+		{"a", true, false},
+		{"b", true, false},
+		{"b", true, false},
+		{"c", true, false},
+		{"c", false, false},
+		{"d", true, true},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Check(r.URL.Query().Get("include"), Equals, "deleted,metadata")
+		io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>`+
+			`<EnumerationResults ContainerName="container"><Blobs>`)
+		for _, b := range blobs {
+			metadata := "<Metadata />"
+			if b.dir {
+				metadata = "<Metadata><hdi_isfolder>true</hdi_isfolder></Metadata>"
+			}
+			fmt.Fprintf(w, `<Blob><Name>%v</Name><Deleted>%v</Deleted><Properties>`+
+				`<Last-Modified>Wed, 01 May 2024 00:00:00 GMT</Last-Modified>`+
+				`<Etag>0x1</Etag><Content-Length>1</Content-Length>`+
+				`<BlobType>BlockBlob</BlobType></Properties>%v</Blob>`,
+				b.name, b.deleted, metadata)
+		}
+		io.WriteString(w, `</Blobs><NextMarker /></EnumerationResults>`)
+	}))
+	defer server.Close()
+
+	azb, err := NewAZBlob("container", &AZBlobConfig{
+		Endpoint:    server.URL + "/",
+		AccountName: "account",
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("key")),
+		ListDeleted: true,
+	})
+	t.Assert(err, IsNil)
+
+	resp, err := azb.ListBlobs(&ListBlobsInput{Delimiter: PString("/")})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Prefixes, HasLen, 0)
+	t.Assert(resp.Items, HasLen, 3)
+	t.Assert(*resp.Items[0].Key, Equals, "a")
+	t.Assert(resp.Items[0].Deleted, Equals, false)
+	t.Assert(*resp.Items[1].Key, Equals, "b")
+	t.Assert(resp.Items[1].Deleted, Equals, true)
+	t.Assert(*resp.Items[2].Key, Equals, "c")
+	t.Assert(resp.Items[2].Deleted, Equals, false)
+}
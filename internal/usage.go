@@ -0,0 +1,54 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// bucketUsage remembers what the backend last said the bucket takes
+// up, so every df doesn't cost a request
+type bucketUsage struct {
+	mu      sync.Mutex
+	usage   *GetBucketUsageOutput
+	fetched time.Time
+	// the backend can't tell, don't ask again
+	notSupported bool
+}
+
+// get returns the usage, asking cloud if what we have is older than
+// ttl. nil if the backend doesn't know. If asking fails we go on
+// with what we had
+func (u *bucketUsage) get(cloud StorageBackend, ttl time.Duration) *GetBucketUsageOutput {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.notSupported || (u.usage != nil && time.Since(u.fetched) < ttl) {
+		return u.usage
+	}
+
+	usage, err := cloud.GetBucketUsage(&GetBucketUsageInput{})
+	if err == syscall.ENOTSUP {
+		u.notSupported = true
+	} else if err != nil {
+		log.Warnf("Unable to get bucket usage: %v", err)
+	} else {
+		u.usage = usage
+		u.fetched = time.Now()
+	}
+	return u.usage
+}
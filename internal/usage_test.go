@@ -0,0 +1,97 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type usageBackend struct {
+	slowBackend
+	usage *GetBucketUsageOutput
+	err   error
+	calls int
+}
+
+func (b *usageBackend) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.usage, nil
+}
+
+type UsageTest struct {
+	cloud *usageBackend
+	fs    *Goofys
+}
+
+var _ = Suite(&UsageTest{})
+
+func (s *UsageTest) SetUpTest(t *C) {
+	s.cloud = &usageBackend{
+		usage: &GetBucketUsageOutput{Bytes: 10*4096 + 1, Objects: 3},
+	}
+	s.fs = newTestFs(s.cloud, &FlagStorage{StatFSCacheTTL: time.Minute})
+}
+
+func (s *UsageTest) statFS(t *C) *fuseops.StatFSOp {
+	op := &fuseops.StatFSOp{}
+	err := s.fs.StatFS(context.TODO(), op)
+	t.Assert(err, IsNil)
+	return op
+}
+
+func (s *UsageTest) TestUsage(t *C) {
+	op := s.statFS(t)
+	t.Assert(op.Blocks-op.BlocksFree, Equals, uint64(11))
+	t.Assert(op.BlocksAvailable, Equals, op.BlocksFree)
+	t.Assert(op.Inodes-op.InodesFree, Equals, uint64(3))
+
+	// cached
+	s.cloud.usage = &GetBucketUsageOutput{Bytes: 4096}
+	op = s.statFS(t)
+	t.Assert(op.Blocks-op.BlocksFree, Equals, uint64(11))
+	t.Assert(s.cloud.calls, Equals, 1)
+
+	s.fs.usage.fetched = time.Now().Add(-time.Hour)
+	op = s.statFS(t)
+	t.Assert(op.Blocks-op.BlocksFree, Equals, uint64(1))
+	t.Assert(s.cloud.calls, Equals, 2)
+
+	// what we had is better than nothing
+	s.cloud.err = syscall.EIO
+	s.fs.usage.fetched = time.Now().Add(-time.Hour)
+	op = s.statFS(t)
+	t.Assert(op.Blocks-op.BlocksFree, Equals, uint64(1))
+	t.Assert(s.cloud.calls, Equals, 3)
+}
+
+func (s *UsageTest) TestNotSupported(t *C) {
+	s.cloud.err = syscall.ENOTSUP
+	op := s.statFS(t)
+	t.Assert(op.Blocks, Equals, op.BlocksFree)
+	t.Assert(op.Inodes, Equals, op.InodesFree)
+
+	s.statFS(t)
+	t.Assert(s.cloud.calls, Equals, 1)
+}
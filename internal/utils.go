@@ -15,9 +15,8 @@
 package internal
 
 import (
-	"fmt"
+	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jacobsa/fuse"
 	"github.com/shirou/gopsutil/process"
@@ -113,22 +112,26 @@ func PString(v string) *string {
 	return &v
 }
 
+// PStringOrNil is nil for "", for optional fields we only know
+// sometimes
+func PStringOrNil(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
 func PTime(v time.Time) *time.Time {
 	return &v
 }
 
-func xattrEscape(value []byte) (s string) {
-	for _, c := range value {
-		if c == '%' {
-			s += "%25"
-		} else if unicode.IsPrint(rune(c)) {
-			s += string(c)
-		} else {
-			s += "%" + fmt.Sprintf("%02X", c)
-		}
+// quoteETag is for comparing and sending etags, some listings
+// return them without the quotes
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, "\"") {
+		return etag
 	}
-
-	return
+	return "\"" + etag + "\""
 }
 
 func Dup(value []byte) []byte {
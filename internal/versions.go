@@ -0,0 +1,443 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+const VERSIONS_DIR = ".versions"
+
+// versions are named <time>_<version id>, so that they sort oldest
+// first. Version ids don't have a / in them
+const VERSION_TIME_FORMAT = "2006-01-02T15:04:05Z"
+
+// VersionsBackend is what's under the .versions of a directory with
+// --enable-versioned-view: a directory for every file that's in it,
+// or was, with every version of that file in it. Keys look like
+// file/2024-05-01T10:20:30Z_3HL4kqtJlcpXroDTDmJ. Reading one reads
+// that version, and nothing can be written.
+//
+// Files that are deleted now still have their directory as long as
+// there's a version that's not a delete marker, so they can be
+// copied back
+type VersionsBackend struct {
+	cloud StorageBackend
+	// of the directory, with the trailing / unless it's the root
+	// of the bucket
+	prefix string
+	cap    Capabilities
+}
+
+func NewVersionsBackend(cloud StorageBackend, prefix string) *VersionsBackend {
+	return &VersionsBackend{
+		cloud:  cloud,
+		prefix: prefix,
+		cap: Capabilities{
+			Name:     "versions",
+			ReadOnly: true,
+			// so a lookup is one HEAD
+			DirBlob: true,
+		},
+	}
+}
+
+// addVersionsDir puts .versions in dir if it's not there yet. It
+// never expires, and it's left out of listings by isUnlistedName
+func (fs *Goofys) addVersionsDir(dir *Inode) {
+	cloud, key := dir.cloud()
+	if cloud == nil {
+		return
+	}
+	switch cloud.(type) {
+	case *VersionsBackend, *SnapshotBackend:
+		// these are versions already
+		return
+	}
+
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	if dir.findChildUnlocked(VERSIONS_DIR) != nil {
+		return
+	}
+
+	if key != "" {
+		key += "/"
+	}
+	inode := NewInode(fs, dir, PString(VERSIONS_DIR))
+	inode.ToDir()
+	inode.dir.cloud = NewVersionsBackend(cloud, key)
+	inode.Attributes.Mtime = dir.Attributes.Mtime
+	inode.AttrTime = TIME_MAX
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.insertInode(dir, inode)
+}
+
+func versionName(v *BlobVersionOutput) string {
+	return v.LastModified.UTC().Format(VERSION_TIME_FORMAT) + "_" + nilStr(v.VersionId)
+}
+
+// parseVersionKey splits file/<time>_<id> into the file and the
+// version id. id is empty if there's no version in key
+func parseVersionKey(key string) (name string, id string, err error) {
+	name = key
+	slash := strings.Index(key, "/")
+	if slash == -1 {
+		return
+	}
+	name = key[:slash]
+
+	underscore := strings.Index(key[slash+1:], "_")
+	if underscore == -1 {
+		err = fuse.ENOENT
+		return
+	}
+	ts := key[slash+1 : slash+1+underscore]
+	if _, err = time.Parse(VERSION_TIME_FORMAT, ts); err != nil {
+		err = fuse.ENOENT
+		return
+	}
+	id = key[slash+1+underscore+1:]
+	if id == "" || strings.Index(id, "/") != -1 {
+		err = fuse.ENOENT
+	}
+	return
+}
+
+// versionsOf returns the versions of key, newest first, including
+// the delete markers. .snapshots and .versions look keys up with it
+func versionsOf(cloud StorageBackend, key string) (versions []BlobVersionOutput, err error) {
+	params := &ListBlobVersionsInput{
+		Prefix: &key,
+	}
+
+	for {
+		resp, err := cloud.ListBlobVersions(params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range resp.Versions {
+			// key sorts before anything else that has it
+			// as prefix, so once we see another key we are
+			// done
+			if *v.Key != key {
+				return versions, nil
+			}
+			versions = append(versions, v)
+		}
+
+		if !resp.IsTruncated {
+			return versions, nil
+		}
+		params.KeyMarker = resp.NextKeyMarker
+		params.VersionIdMarker = resp.NextVersionIdMarker
+	}
+}
+
+type versionListToken struct {
+	KeyMarker       *string `json:"k,omitempty"`
+	VersionIdMarker *string `json:"v,omitempty"`
+	// the last key on the previous page may have older versions
+	// on this page that we must skip
+	Settled string `json:"r,omitempty"`
+}
+
+func (tok *versionListToken) encode() *string {
+	data, _ := json.Marshal(tok)
+	return PString(base64.RawURLEncoding.EncodeToString(data))
+}
+
+func decodeVersionListToken(s string) (tok versionListToken, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &tok)
+	}
+	if err != nil {
+		err = fuse.EINVAL
+	}
+	return
+}
+
+// listVersions is how .snapshots and .versions list a directory. It
+// pages through the versions under params, newest first for each key,
+// and hands them to version until it says the key is settled, the
+// older versions of that key are skipped. prefix gets the common
+// prefixes, it can be nil. A page of only skipped versions would come
+// back empty but truncated, so this keeps going until there's
+// something in the output. token is from the page before
+func listVersions(cloud StorageBackend, params *ListBlobVersionsInput, token *string,
+	prefix func(out *ListBlobsOutput, p *BlobPrefixOutput),
+	version func(out *ListBlobsOutput, v *BlobVersionOutput) (settled bool)) (*ListBlobsOutput, error) {
+
+	var settled string
+	if token != nil {
+		tok, err := decodeVersionListToken(*token)
+		if err != nil {
+			return nil, err
+		}
+		params.KeyMarker = tok.KeyMarker
+		params.VersionIdMarker = tok.VersionIdMarker
+		settled = tok.Settled
+	}
+
+	out := &ListBlobsOutput{}
+
+	for {
+		resp, err := cloud.ListBlobVersions(params)
+		if err != nil {
+			return nil, err
+		}
+
+		if prefix != nil {
+			for i := range resp.Prefixes {
+				prefix(out, &resp.Prefixes[i])
+			}
+		}
+
+		for i := range resp.Versions {
+			v := &resp.Versions[i]
+			if *v.Key == settled {
+				continue
+			}
+			if version(out, v) {
+				settled = *v.Key
+			}
+		}
+
+		out.IsTruncated = resp.IsTruncated
+		out.RequestId = resp.RequestId
+		if !resp.IsTruncated {
+			break
+		}
+
+		params.KeyMarker = resp.NextKeyMarker
+		params.VersionIdMarker = resp.NextVersionIdMarker
+		if len(out.Items) != 0 || len(out.Prefixes) != 0 {
+			out.NextContinuationToken = (&versionListToken{
+				KeyMarker:       params.KeyMarker,
+				VersionIdMarker: params.VersionIdMarker,
+				Settled:         settled,
+			}).encode()
+			break
+		}
+	}
+
+	return out, nil
+}
+
+func (b *VersionsBackend) Init(key string) error {
+	return nil
+}
+
+func (b *VersionsBackend) Capabilities() *Capabilities {
+	return &b.cap
+}
+
+func (b *VersionsBackend) Bucket() string {
+	return b.cloud.Bucket()
+}
+
+func (b *VersionsBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	name, id, err := parseVersionKey(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := versionsOf(b.cloud, b.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range versions {
+		v := &versions[i]
+		if v.IsDeleteMarker {
+			continue
+		}
+		if id == "" {
+			// the directory of the file, as new as its
+			// newest version
+			return &HeadBlobOutput{
+				BlobItemOutput: BlobItemOutput{
+					Key:          &param.Key,
+					LastModified: v.LastModified,
+				},
+				IsDirBlob: true,
+			}, nil
+		}
+		if nilStr(v.VersionId) == id {
+			item := v.BlobItemOutput
+			item.Key = &param.Key
+			return &HeadBlobOutput{BlobItemOutput: item}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// listFiles is the .versions directory itself
+func (b *VersionsBackend) listFiles(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	params := &ListBlobVersionsInput{
+		Prefix:    &b.prefix,
+		Delimiter: PString("/"),
+	}
+
+	// subdirectories have a .versions of their own, so prefixes
+	// are left out
+	return listVersions(b.cloud, params, param.ContinuationToken, nil,
+		func(out *ListBlobsOutput, v *BlobVersionOutput) bool {
+			name := (*v.Key)[len(b.prefix):]
+			if name == "" || v.IsDeleteMarker {
+				return false
+			}
+			out.Prefixes = append(out.Prefixes, BlobPrefixOutput{
+				Prefix: PString(name + "/"),
+			})
+			return true
+		})
+}
+
+func (b *VersionsBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	prefix := nilStr(param.Prefix)
+	if prefix == "" {
+		if param.Delimiter == nil {
+			// we don't want to list every version of
+			// everything recursively
+			return nil, syscall.ENOTSUP
+		}
+		return b.listFiles(param)
+	}
+
+	name := strings.TrimSuffix(prefix, "/")
+	if strings.Index(name, "/") != -1 {
+		// versions are files, there's nothing under them
+		return &ListBlobsOutput{}, nil
+	}
+
+	versions, err := versionsOf(b.cloud, b.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ListBlobsOutput{}
+	for i := range versions {
+		v := &versions[i]
+		if v.IsDeleteMarker {
+			continue
+		}
+		item := v.BlobItemOutput
+		item.Key = PString(name + "/" + versionName(v))
+		out.Items = append(out.Items, item)
+	}
+	sort.Slice(out.Items, func(i, j int) bool {
+		return *out.Items[i].Key < *out.Items[j].Key
+	})
+	return out, nil
+}
+
+func (b *VersionsBackend) ListBlobVersions(param *ListBlobVersionsInput) (*ListBlobVersionsOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (b *VersionsBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	name, id, err := parseVersionKey(param.Key)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, syscall.EISDIR
+	}
+
+	resp, err := b.cloud.GetBlob(&GetBlobInput{
+		Key:       b.prefix + name,
+		Start:     param.Start,
+		Count:     param.Count,
+		IfMatch:   param.IfMatch,
+		VersionId: &id,
+		Context:   param.Context,
+		Checksum:  param.Checksum,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Key = &param.Key
+	return resp, nil
+}
+
+func (b *VersionsBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return &MultipartExpireOutput{}, nil
+}
+
+func (b *VersionsBackend) AppendBlob(param *AppendBlobInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (b *VersionsBackend) GetBucketUsage(param *GetBucketUsageInput) (*GetBucketUsageOutput, error) {
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"io/ioutil"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	. "gopkg.in/check.v1"
+)
+
+type VersionsTest struct {
+	cloud    *versionedBackend
+	versions *VersionsBackend
+	t0       time.Time
+}
+
+var _ = Suite(&VersionsTest{})
+
+func (s *VersionsTest) SetUpTest(t *C) {
+	s.t0 = time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC)
+	s.cloud = &versionedBackend{pageSize: 1000}
+	s.versions = NewVersionsBackend(s.cloud, "dir/")
+
+	// a was written twice and then deleted
+	s.cloud.add("dir/a", s.t0, "a1", false)
+	s.cloud.add("dir/a", s.t0.Add(time.Hour), "a2", false)
+	s.cloud.add("dir/a", s.t0.Add(2*time.Hour), "a3", true)
+	s.cloud.add("dir/b", s.t0, "b1", false)
+	// only ever a delete marker
+	s.cloud.add("dir/d", s.t0, "d1", true)
+	// has a .versions of its own
+	s.cloud.add("dir/sub/c", s.t0, "c1", false)
+	s.cloud.add("dira", s.t0, "x1", false)
+}
+
+func (s *VersionsTest) listFiles(t *C) (names []string) {
+	var token *string
+	for {
+		resp, err := s.versions.ListBlobs(&ListBlobsInput{
+			Delimiter:         PString("/"),
+			ContinuationToken: token,
+		})
+		t.Assert(err, IsNil)
+		t.Assert(resp.Items, HasLen, 0)
+		for _, p := range resp.Prefixes {
+			names = append(names, *p.Prefix)
+		}
+		if !resp.IsTruncated {
+			return
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+func (s *VersionsTest) TestListFiles(t *C) {
+	t.Assert(s.listFiles(t), DeepEquals, []string{"a/", "b/"})
+
+	// a page of only the rest of a's versions
+	s.cloud.pageSize = 1
+	t.Assert(s.listFiles(t), DeepEquals, []string{"a/", "b/"})
+}
+
+func (s *VersionsTest) TestListVersions(t *C) {
+	resp, err := s.versions.ListBlobs(&ListBlobsInput{
+		Prefix:    PString("a/"),
+		Delimiter: PString("/"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 2)
+	t.Assert(*resp.Items[0].Key, Equals, "a/2024-05-01T10:20:30Z_a1")
+	t.Assert(*resp.Items[1].Key, Equals, "a/2024-05-01T11:20:30Z_a2")
+	t.Assert(resp.Items[1].Size, Equals, uint64(2))
+
+	resp, err = s.versions.ListBlobs(&ListBlobsInput{
+		Prefix:    PString("nope/"),
+		Delimiter: PString("/"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Items, HasLen, 0)
+}
+
+func (s *VersionsTest) TestHeadBlob(t *C) {
+	resp, err := s.versions.HeadBlob(&HeadBlobInput{Key: "a"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.IsDirBlob, Equals, true)
+	t.Assert(*resp.LastModified, Equals, s.t0.Add(time.Hour))
+
+	resp, err = s.versions.HeadBlob(&HeadBlobInput{Key: "a/2024-05-01T10:20:30Z_a1"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.IsDirBlob, Equals, false)
+	t.Assert(*resp.Key, Equals, "a/2024-05-01T10:20:30Z_a1")
+	t.Assert(*resp.LastModified, Equals, s.t0)
+
+	for _, key := range []string{"d", "nope", "a/2024-05-01T12:20:30Z_a3", "a/a1",
+		"a/garbage_a1", "a/2024-05-01T10:20:30Z_", "a/2024-05-01T10:20:30Z_a9"} {
+		_, err = s.versions.HeadBlob(&HeadBlobInput{Key: key})
+		t.Assert(err, Equals, fuse.ENOENT, Commentf("%v", key))
+	}
+}
+
+func (s *VersionsTest) TestGetBlob(t *C) {
+	resp, err := s.versions.GetBlob(&GetBlobInput{Key: "a/2024-05-01T10:20:30Z_a1"})
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "a1")
+	t.Assert(*resp.Key, Equals, "a/2024-05-01T10:20:30Z_a1")
+
+	_, err = s.versions.GetBlob(&GetBlobInput{Key: "a"})
+	t.Assert(err, Equals, syscall.EISDIR)
+}
+
+func (s *VersionsTest) TestReadOnly(t *C) {
+	_, err := s.versions.PutBlob(&PutBlobInput{Key: "a/2024-05-01T10:20:30Z_a1"})
+	t.Assert(err, Equals, syscall.EROFS)
+	_, err = s.versions.DeleteBlob(&DeleteBlobInput{Key: "a/2024-05-01T10:20:30Z_a1"})
+	t.Assert(err, Equals, syscall.EROFS)
+}
+
+func (s *VersionsTest) TestLookUp(t *C) {
+	fs := newTestFs(s.cloud, &FlagStorage{VersionedView: true})
+	root := fs.testRoot()
+	dir := newTestDir(root, "dir")
+
+	id, err := lookUpId(fs, dir.Id, VERSIONS_DIR)
+	t.Assert(err, IsNil)
+	versions := fs.getInodeOrDie(id)
+	t.Assert(versions.dir.cloud.(*VersionsBackend).prefix, Equals, "dir/")
+	t.Assert(versions.readOnly(), Equals, true)
+	t.Assert(fs.isUnlistedName(dir, VERSIONS_DIR), Equals, true)
+
+	// the same one every time
+	again, err := lookUpId(fs, dir.Id, VERSIONS_DIR)
+	t.Assert(err, IsNil)
+	t.Assert(again, Equals, id)
+
+	// and at the top too
+	id, err = lookUpId(fs, root.Id, VERSIONS_DIR)
+	t.Assert(err, IsNil)
+	t.Assert(fs.getInodeOrDie(id).dir.cloud.(*VersionsBackend).prefix, Equals, "")
+
+	// but no versions of versions
+	fs.addVersionsDir(versions)
+	t.Assert(versions.findChild(VERSIONS_DIR), IsNil)
+}
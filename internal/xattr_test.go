@@ -0,0 +1,171 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/AITRICS/goofys/api/common"
+
+	"bytes"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// xattrBackend keeps the metadata, content type and storage class of
+// one object, and what every copy asked for
+type xattrBackend struct {
+	slowBackend
+	noMetadata bool
+	failCopy   bool
+
+	meta        map[string]*string
+	contentType string
+	class       string
+	putMeta     map[string]*string
+	copies      []CopyBlobInput
+}
+
+func (b *xattrBackend) Capabilities() *Capabilities {
+	return &Capabilities{
+		Name:            "meta",
+		StorageClass:    true,
+		NoMetadata:      b.noMetadata,
+		MaxMetadataSize: 2048,
+	}
+}
+
+func (b *xattrBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	out, err := b.slowBackend.HeadBlob(param)
+	if err == nil {
+		out.Metadata = b.meta
+		out.ContentType = PString(b.contentType)
+		out.StorageClass = PString(b.class)
+	}
+	return out, err
+}
+
+func (b *xattrBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	b.putMeta = param.Metadata
+	return b.slowBackend.PutBlob(param)
+}
+
+func (b *xattrBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	b.copies = append(b.copies, *param)
+	if b.failCopy {
+		return nil, syscall.EIO
+	}
+	b.meta = param.Metadata
+	return &CopyBlobOutput{}, nil
+}
+
+type XattrTest struct {
+	cloud *xattrBackend
+}
+
+var _ = Suite(&XattrTest{})
+
+func (s *XattrTest) SetUpTest(t *C) {
+	s.cloud = &xattrBackend{
+		contentType: "text/x-custom",
+		class:       "STANDARD_IA",
+	}
+	s.cloud.etag = "\"etag\""
+	s.cloud.size = 1024
+}
+
+func (s *XattrTest) existing() *Inode {
+	inode := newTestInode(s.cloud)
+	inode.KnownSize = PUInt64(s.cloud.size)
+	inode.Attributes.Size = s.cloud.size
+	return inode
+}
+
+func (s *XattrTest) TestRoundTrip(t *C) {
+	inode := s.existing()
+
+	t.Assert(inode.SetXattr("user.Foo", []byte("bar"), 0), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 1)
+	c := s.cloud.copies[0]
+	t.Assert(c.Source, Equals, c.Destination)
+	// the rest of the object stays the same
+	t.Assert(*c.ContentType, Equals, "text/x-custom")
+	t.Assert(*c.StorageClass, Equals, "STANDARD_IA")
+
+	value, err := inode.GetXattr("user.Foo")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "bar")
+
+	// what's in the bucket has it, with the case kept
+	inode = s.existing()
+	xattrs, err := inode.ListXattr()
+	t.Assert(err, IsNil)
+	t.Assert(xattrs, DeepEquals, []string{"s3.etag", "s3.key", "s3.storage-class", "user.Foo"})
+	_, err = inode.GetXattr("user.foo")
+	t.Assert(err, Equals, ENOATTR)
+
+	t.Assert(inode.SetXattr("user.Foo", []byte("baz"), 0x1), Equals, syscall.EEXIST)
+	t.Assert(inode.SetXattr("user.other", []byte("baz"), 0x2), Equals, ENOATTR)
+
+	t.Assert(inode.RemoveXattr("user.Foo"), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 2)
+	t.Assert(inode.RemoveXattr("user.Foo"), Equals, ENOATTR)
+	t.Assert(DecodeMetadata(s.cloud.meta), HasLen, 0)
+}
+
+func (s *XattrTest) TestLimits(t *C) {
+	inode := s.existing()
+
+	t.Assert(inode.SetXattr("user.big", bytes.Repeat([]byte("x"), 2048), 0),
+		Equals, syscall.E2BIG)
+	t.Assert(inode.SetXattr("user.", []byte("x"), 0), Equals, syscall.EINVAL)
+	t.Assert(s.cloud.copies, HasLen, 0)
+
+	_, err := inode.GetXattr("user.big")
+	t.Assert(err, Equals, ENOATTR)
+}
+
+func (s *XattrTest) TestFailedCopy(t *C) {
+	inode := s.existing()
+	s.cloud.failCopy = true
+
+	t.Assert(inode.SetXattr("user.foo", []byte("bar"), 0), Equals, syscall.EIO)
+	_, err := inode.GetXattr("user.foo")
+	t.Assert(err, Equals, ENOATTR)
+}
+
+func (s *XattrTest) TestNewFile(t *C) {
+	fh := newTestFileHandle(s.cloud)
+
+	// kept until the file is written
+	t.Assert(fh.inode.SetXattr("user.foo", []byte("bar"), 0), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 0)
+	value, err := fh.inode.GetXattr("user.foo")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "bar")
+
+	t.Assert(writeTestFile(fh, 1024), IsNil)
+	t.Assert(fh.FlushFile(), IsNil)
+	t.Assert(s.cloud.copies, HasLen, 0)
+	t.Assert(string(DecodeMetadata(s.cloud.putMeta)["foo"]), Equals, "bar")
+}
+
+func (s *XattrTest) TestNoMetadata(t *C) {
+	s.cloud.noMetadata = true
+	inode := s.existing()
+
+	t.Assert(inode.SetXattr("user.foo", []byte("bar"), 0), Equals, syscall.ENOTSUP)
+	t.Assert(inode.RemoveXattr("user.foo"), Equals, syscall.ENOTSUP)
+	t.Assert(s.cloud.copies, HasLen, 0)
+}
@@ -55,11 +55,14 @@ func registerSIGINTHandler(fs *Goofys, flags *FlagStorage) {
 			}
 
 			if len(flags.Cache) == 0 {
-				log.Infof("Received %v, attempting to unmount...", s)
+				log.Infof("Received %v, flushing and unmounting...", s)
 
-				err := TryUnmount(flags.MountPoint)
+				ctx, cancel := context.WithTimeout(context.Background(),
+					flags.DrainTimeout)
+				err := fs.Shutdown(ctx)
+				cancel()
 				if err != nil {
-					log.Errorf("Failed to unmount in response to %v: %v", s, err)
+					log.Errorf("Failed to shut down in response to %v: %v", s, err)
 				} else {
 					log.Printf("Successfully unmounted %v in response to %v",
 						flags.MountPoint, s)
@@ -131,6 +134,47 @@ func massageArg0() {
 	}
 }
 
+// fsck is --fsck, it checks the bucket instead of mounting it
+func fsck(c *cli.Context, envConfig *EnvConfig) (err error) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintf(
+			os.Stderr,
+			"Error: %s --fsck takes exactly one argument.\n\n",
+			c.App.Name)
+		cli.ShowAppHelp(c)
+		os.Exit(1)
+	}
+
+	flags := PopulateBackendFlags(c)
+	if flags == nil {
+		cli.ShowAppHelp(c)
+		err = fmt.Errorf("invalid arguments")
+		return
+	}
+	defer flags.Cleanup()
+	envConfig.ApplyCredentials(flags)
+	SetLogFormat(flags.LogFormat)
+	InitLoggers(false)
+
+	opts := FsckOptions{
+		FixMarkers:    c.Bool("fix-markers"),
+		FixMPU:        c.Bool("fix-mpu"),
+		CheckMetadata: c.Bool("check-metadata") || c.Bool("fix-metadata"),
+		FixMetadata:   c.Bool("fix-metadata"),
+		MPUAge:        c.Duration("mpu-age"),
+	}
+
+	remaining, err := Fsck(c.Args()[0], flags, opts, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	if remaining != 0 {
+		err = fmt.Errorf("%v problems left", remaining)
+	}
+	return
+}
+
 var Version = "use `make build' to fill version hash correctly"
 
 func main() {
@@ -138,12 +182,22 @@ func main() {
 
 	massagePath()
 
+	envConfig, err := LoadEnvConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	app := NewApp()
 
 	var flags *FlagStorage
 	var child *os.Process
 
 	app.Action = func(c *cli.Context) (err error) {
+		if c.Bool("fsck") {
+			return fsck(c, envConfig)
+		}
+
 		// We should get two arguments exactly. Otherwise error out.
 		if len(c.Args()) != 2 {
 			fmt.Fprintf(
@@ -166,6 +220,8 @@ func main() {
 			time.Sleep(time.Second)
 			flags.Cleanup()
 		}()
+		envConfig.ApplyCredentials(flags)
+		SetLogFormat(flags.LogFormat)
 
 		if !flags.Foreground {
 			var wg sync.WaitGroup
@@ -173,7 +229,11 @@ func main() {
 
 			massageArg0()
 
-			ctx := new(daemon.Context)
+			ctx := &daemon.Context{
+				// we took the config out of our own
+				// environment but the child needs it
+				Env: envConfig.Environ(),
+			}
 			child, err = ctx.Reborn()
 
 			if err != nil {
@@ -237,7 +297,12 @@ func main() {
 		return
 	}
 
-	err := app.Run(MassageMountFlags(os.Args))
+	args, err := envConfig.Args(app, MassageMountFlags(os.Args))
+	if err == nil {
+		err = app.Run(args)
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
 	if err != nil {
 		if flags != nil && !flags.Foreground && child != nil {
 			log.Fatalln("Unable to mount file system, see syslog for details")